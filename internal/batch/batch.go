@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package batch reads job files listing many images to convert, and runs the
+// conversions concurrently.
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is a job file.
+type File struct {
+	// Args are command line flags applied to every job (eg. "--reproducible"),
+	// ahead of those of the job itself.
+	Args []string `json:"args,omitempty"`
+	// Jobs are the images to convert.
+	Jobs []Job `json:"jobs"`
+}
+
+// Job is a single image to convert.
+type Job struct {
+	// Image is the image to convert, as given on the command line (eg. a
+	// path or "docker://alpine:3.20").
+	Image string `json:"image"`
+	// Ref selects an image by name or manifest digest (as with --ref).
+	Ref string `json:"ref,omitempty"`
+	// Platform selects the platform to convert (as with --platform).
+	Platform string `json:"platform,omitempty"`
+	// Output is the path of the EROFS image to write.
+	Output string `json:"output"`
+	// Args are additional command line flags for this job.
+	Args []string `json:"args,omitempty"`
+}
+
+// Load reads a job file, in either YAML or JSON format.
+func Load(name string) (*File, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job file: %w", err)
+	}
+
+	// YAML is a superset of JSON, so both are decoded as YAML and then
+	// mapped onto the (JSON tagged) job types.
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse job file: %w", err)
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse job file: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var f File
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to parse job file: %w", err)
+	}
+
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *File) validate() error {
+	if len(f.Jobs) == 0 {
+		return errors.New("job file does not list any jobs")
+	}
+
+	outputs := make(map[string]int)
+	for i, job := range f.Jobs {
+		if job.Image == "" {
+			return fmt.Errorf("job %d: image is required", i)
+		}
+
+		if job.Output == "" || job.Output == "-" {
+			return fmt.Errorf("job %d: output path is required", i)
+		}
+
+		if j, ok := outputs[job.Output]; ok {
+			return fmt.Errorf("job %d: output %q is also written by job %d", i, job.Output, j)
+		}
+		outputs[job.Output] = i
+	}
+
+	return nil
+}
+
+// CommandLine returns the command line arguments (flags followed by the
+// image and output paths) of the given job.
+func (f *File) CommandLine(job Job) []string {
+	args := append([]string{}, f.Args...)
+	args = append(args, job.Args...)
+
+	if job.Ref != "" {
+		args = append(args, "--ref", job.Ref)
+	}
+
+	if job.Platform != "" {
+		args = append(args, "--platform", job.Platform)
+	}
+
+	return append(args, job.Image, job.Output)
+}
+
+// Run calls convert for every job, running up to parallel jobs at a time.
+// Every job is run even if some fail, and the errors of the failed jobs are
+// returned together. Jobs that have not started when the context is cancelled
+// are skipped.
+func Run(ctx context.Context, jobs []Job, parallel int, convert func(ctx context.Context, job Job) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, parallel)
+
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("%s: %w", job.Output, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := convert(ctx, job); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", job.Output, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
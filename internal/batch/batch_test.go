@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package batch_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/batch"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		f, err := batch.Load(writeFile(t, "jobs.yaml", `
+args: [--reproducible]
+jobs:
+  - image: docker://alpine:3.20
+    platform: linux/arm64
+    output: alpine-arm64.erofs
+  - image: debian.tar
+    ref: debian:bookworm
+    output: debian.erofs
+    args: [--exclude, /var/cache]
+`))
+		require.NoError(t, err)
+
+		require.Len(t, f.Jobs, 2)
+		require.Equal(t, []string{"--reproducible", "--platform", "linux/arm64", "docker://alpine:3.20", "alpine-arm64.erofs"}, f.CommandLine(f.Jobs[0]))
+		require.Equal(t, []string{"--reproducible", "--exclude", "/var/cache", "--ref", "debian:bookworm", "debian.tar", "debian.erofs"}, f.CommandLine(f.Jobs[1]))
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		f, err := batch.Load(writeFile(t, "jobs.json", `{"jobs": [{"image": "image.tar", "output": "image.erofs"}]}`))
+		require.NoError(t, err)
+
+		require.Equal(t, []batch.Job{{Image: "image.tar", Output: "image.erofs"}}, f.Jobs)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"Unknown Field":     "jobs: [{image: a.tar, output: a.erofs, outptu: b.erofs}]",
+			"No Jobs":           "args: [--verify]",
+			"Missing Image":     "jobs: [{output: a.erofs}]",
+			"Missing Output":    "jobs: [{image: a.tar}]",
+			"Stdout":            "jobs: [{image: a.tar, output: '-'}]",
+			"Duplicate Outputs": "jobs: [{image: a.tar, output: a.erofs}, {image: b.tar, output: a.erofs}]",
+			"Malformed":         "jobs: [",
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := batch.Load(writeFile(t, "jobs.yaml", content))
+				require.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	jobs := []batch.Job{
+		{Image: "a.tar", Output: "a.erofs"},
+		{Image: "b.tar", Output: "b.erofs"},
+		{Image: "c.tar", Output: "c.erofs"},
+		{Image: "d.tar", Output: "d.erofs"},
+	}
+
+	t.Run("Parallel", func(t *testing.T) {
+		var running, maxRunning, done atomic.Int32
+		err := batch.Run(context.Background(), jobs, 2, func(ctx context.Context, job batch.Job) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			done.Add(1)
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, int32(len(jobs)), done.Load())
+		require.Equal(t, int32(2), maxRunning.Load())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		errFailed := errors.New("failed")
+
+		var done atomic.Int32
+		err := batch.Run(context.Background(), jobs, 2, func(ctx context.Context, job batch.Job) error {
+			done.Add(1)
+			if job.Image == "b.tar" || job.Image == "d.tar" {
+				return errFailed
+			}
+			return nil
+		})
+		require.ErrorIs(t, err, errFailed)
+		require.ErrorContains(t, err, "b.erofs")
+		require.ErrorContains(t, err, "d.erofs")
+		require.NotContains(t, err.Error(), "a.erofs")
+
+		// A failed job does not stop the others.
+		require.Equal(t, int32(len(jobs)), done.Load())
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var done atomic.Int32
+		err := batch.Run(ctx, jobs, 1, func(ctx context.Context, job batch.Job) error {
+			done.Add(1)
+			cancel()
+			return ctx.Err()
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, done.Load(), int32(len(jobs)))
+	})
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
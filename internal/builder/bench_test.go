@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/immutos/oci2erofs/internal/builder"
+	"github.com/stretchr/testify/require"
+)
+
+// The benchmarks build synthetic trees shaped like the extremes seen in
+// real images, eg.
+//
+//	go test -run '^$' -bench . -benchmem ./internal/builder
+func BenchmarkBuild(b *testing.B) {
+	b.Run("Small Files", func(b *testing.B) {
+		// Eg. a Python or Node.js dependency tree.
+		var files []benchFile
+		for i := range 20000 {
+			files = append(files, benchFile{
+				name: fmt.Sprintf("lib/pkg%03d/module%03d.py", i/100, i%100),
+				size: 512 + int64(i%7)*100,
+			})
+		}
+
+		benchmarkBuild(b, files)
+	})
+
+	b.Run("Large Files", func(b *testing.B) {
+		// Eg. model weights or a database.
+		var files []benchFile
+		for i := range 4 {
+			files = append(files, benchFile{name: fmt.Sprintf("data/blob%d.bin", i), size: 32 << 20})
+		}
+
+		benchmarkBuild(b, files)
+	})
+
+	b.Run("Deep Directories", func(b *testing.B) {
+		var files []benchFile
+		dir := "."
+		for i := range 200 {
+			dir = path.Join(dir, fmt.Sprintf("level%03d", i))
+			files = append(files, benchFile{name: path.Join(dir, "file"), size: 64})
+		}
+
+		benchmarkBuild(b, files)
+	})
+
+	b.Run("Wide Directory", func(b *testing.B) {
+		// Eg. a flat cache or object store.
+		var files []benchFile
+		for i := range 50000 {
+			files = append(files, benchFile{name: fmt.Sprintf("objects/%08x", i*2654435761), size: 32})
+		}
+
+		benchmarkBuild(b, files)
+	})
+}
+
+type benchFile struct {
+	name string
+	size int64
+}
+
+// benchmarkBuild builds an image of the given files, reporting the
+// throughput of file contents and the files written per second.
+func benchmarkBuild(b *testing.B, files []benchFile) {
+	src := createBenchFS(b, files)
+
+	var dataBytes int64
+	for _, f := range files {
+		dataBytes += f.size
+	}
+
+	outputFile, err := os.Create(filepath.Join(b.TempDir(), "image.erofs"))
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		require.NoError(b, outputFile.Close())
+	})
+
+	b.SetBytes(dataBytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		require.NoError(b, outputFile.Truncate(0))
+
+		_, err := builder.Build(context.Background(), outputFile, src, nil)
+		require.NoError(b, err)
+	}
+
+	b.ReportMetric(float64(len(files)*b.N)/b.Elapsed().Seconds(), "files/s")
+}
+
+// createBenchFS returns an in-memory tree of the given files (and their
+// parent directories), filled with a repeating pattern.
+func createBenchFS(b *testing.B, files []benchFile) fs.FS {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	var maxSize int64
+	for _, f := range files {
+		maxSize = max(maxSize, f.size)
+	}
+	content := []byte(strings.Repeat("oci2erofs", int(maxSize)/9+1))
+
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		var missing []string
+		for dir := path.Dir(f.name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			missing = append(missing, dir)
+		}
+
+		for i := len(missing) - 1; i >= 0; i-- {
+			require.NoError(b, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: missing[i] + "/", Mode: 0o755}))
+		}
+
+		require.NoError(b, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0o644, Size: f.size}))
+		_, err := tw.Write(content[:f.size])
+		require.NoError(b, err)
+	}
+	require.NoError(b, tw.Close())
+
+	fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(b, err)
+
+	return fsys
+}
@@ -0,0 +1,615 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// MaxSymlinkSize is the longest symbolic link target that Linux will read
+// back in full (it truncates targets to a block, less the terminating NUL).
+const MaxSymlinkSize = erofs.BlockSize - 1
+
+// DefaultBlockSize is the default size of the blocks of the image, which
+// every kernel can mount.
+const DefaultBlockSize = erofs.BlockSize
+
+// BlockSizes are the sizes of the blocks of the image that the builder can
+// produce (see Options.BlockSize).
+var BlockSizes = []int{4096, 16384, 65536}
+
+// DefaultWriteConcurrency is the default number of files whose data is
+// written to the image at once.
+const DefaultWriteConcurrency = 4
+
+// ErrSymlinkTooLong is returned when the target of a symbolic link is longer
+// than MaxSymlinkSize.
+var ErrSymlinkTooLong = errors.New("symbolic link target is too long")
+
+// ErrNameTooLong is returned when the name of a file is longer than
+// erofs.MaxNameLen bytes (the kernel refuses to look such names up).
+var ErrNameTooLong = errors.New("file name is too long")
+
+// MaxImageSize is the size of the largest image the builder can produce with
+// the default block size, as block addresses are 32 bits wide (about 16 TiB
+// with 4 KiB blocks, and proportionally more with larger blocks). Larger
+// images would need the 48-bit block addresses of Linux 6.15, which the
+// builder does not emit.
+const MaxImageSize int64 = math.MaxUint32 * erofs.BlockSize
+
+// ErrImageTooLarge is returned when the image would be larger than
+// MaxImageSize (or its equivalent for the block size).
+var ErrImageTooLarge = errors.New("image is too large")
+
+// Summary describes the EROFS filesystem produced by a build.
+type Summary struct {
+	// Inodes is the total number of inodes written.
+	Inodes int
+	// Directories is the number of directory inodes written.
+	Directories int
+	// RegularFiles is the number of regular file inodes written.
+	RegularFiles int
+	// Symlinks is the number of symbolic link inodes written.
+	Symlinks int
+	// DataBytes is the total size of all regular file contents.
+	DataBytes int64
+	// HardLinks is the number of regular files written as hard links to
+	// another, either because they are hard links in the source (see
+	// util.HardLinkFS) or because they are identical (see
+	// Options.HardlinkDedup).
+	HardLinks int
+	// SharedFiles is the number of regular files that share the data blocks
+	// of another file with identical contents (see Options.Dedupe).
+	SharedFiles int
+	// DedupBytes is the size of the contents of the identical files (written
+	// as hard links or sharing data blocks), which are not repeated in the
+	// image.
+	DedupBytes int64
+	// CompressionRatio is the ratio of the size of the file contents to the
+	// size of the image. Data is not compressed, so it only rises above one
+	// when files are deduplicated.
+	CompressionRatio float64
+	// Xattrs is the number of extended attributes written. None are written
+	// yet, those of the source raise warnings instead.
+	Xattrs int
+	// ResumedFiles is the number of regular files whose data was already
+	// written by an interrupted build (see Options.Checkpoint), and
+	// ResumedBytes the size of that data.
+	ResumedFiles int
+	ResumedBytes int64
+	// ImageSize is the size of the resulting image in bytes (if known).
+	ImageSize int64
+	// Features are the optional EROFS features that the image uses.
+	Features []Feature
+	// ScanDuration is the time spent walking the source filesystem, staging
+	// and laying out its inodes.
+	ScanDuration time.Duration
+	// WriteDuration is the time spent encoding and writing the image.
+	WriteDuration time.Duration
+}
+
+// Options configures how an EROFS filesystem is built.
+type Options struct {
+	// SourceDateEpoch, if set, clamps all timestamps so that none are later
+	// than it (see https://reproducible-builds.org/specs/source-date-epoch/).
+	SourceDateEpoch *time.Time
+	// ClampModTime, if set, clamps all timestamps so that none are later
+	// than it, independently of SourceDateEpoch.
+	ClampModTime *time.Time
+	// ModTime, if set, replaces all timestamps.
+	ModTime *time.Time
+	// Progress, if set, is called as each regular file is written.
+	Progress progress.Func
+	// UUID, if set, is written into the superblock (like mkfs.erofs -U).
+	UUID *[16]byte
+	// BlockSize is the size in bytes of the blocks of the image, one of
+	// BlockSizes (defaults to DefaultBlockSize). Linux only mounts images
+	// whose blocks are no larger than its page size, so larger blocks suit
+	// kernels with larger pages (eg. arm64 with 16 KiB or 64 KiB pages),
+	// where they mean fewer blocks to address and read.
+	BlockSize int
+	// VolumeName, if set, is written into the superblock as the volume
+	// label (like mkfs.erofs -L). It is at most 16 bytes long.
+	VolumeName string
+	// DisabledFeatures are the EROFS features that the image must not use,
+	// eg. those not supported by the target kernel (see UnsupportedFeatures).
+	DisabledFeatures []Feature
+	// Owner, if set, is given ownership of every file (before any ID maps
+	// are applied).
+	Owner *Owner
+	// ModeMask are the permission bits, in the octal form used by chmod (eg.
+	// 0o022, or 0o6000 for the setuid and setgid bits), cleared from every
+	// file other than symbolic links.
+	ModeMask uint32
+	// UIDMap and GIDMap, if set, shift the owner of every file (eg. for
+	// images mounted in a user namespace). Files owned by an ID that is not
+	// mapped cause the build to fail with ErrUnmappedID.
+	UIDMap []IDMap
+	GIDMap []IDMap
+	// InodeFormat selects between compact and extended inodes (see
+	// InodeFormatAuto, the default).
+	InodeFormat InodeFormat
+	// MaxMemory is the size in bytes up to which the metadata staged for
+	// each inode is held in memory, beyond which it spills over to a
+	// temporary file (unlimited if zero).
+	MaxMemory int64
+	// TempDir is where temporary files are created (defaults to
+	// os.TempDir).
+	TempDir string
+	// WriteConcurrency is the number of files whose data is written to the
+	// image at once (defaults to DefaultWriteConcurrency). The source file
+	// system must be safe for concurrent use if it is greater than one.
+	WriteConcurrency int
+	// Preallocate reserves the full size of the image up front when writing
+	// to a file. This can make writing it faster, but the image is then not
+	// left sparse.
+	Preallocate bool
+	// HardlinkDedup writes regular files that are identical (in contents,
+	// mode, owner and modification time) as hard links to a single inode.
+	// Their contents are read an extra time to find them.
+	HardlinkDedup bool
+	// Dedupe writes the data of regular files with identical contents once,
+	// shared by all of their inodes, whatever their metadata (as
+	// mkfs.erofs -Ededupe does, but for whole files). Files whose data is
+	// inline have nothing to share, and each file keeps its own inline tail. Their contents are read an extra time
+	// to find them.
+	Dedupe bool
+	// TransformFile, if set, rewrites each regular file as it is built into
+	// the image (see FileTransform). It runs before the other options that
+	// change the metadata of files (eg. ModeMask), once for each file, and
+	// its rewritten contents are staged in a temporary file in TempDir.
+	// Hard links in the source are written as separate files when it is
+	// set, as each of them may be rewritten differently.
+	TransformFile FileTransform
+	// DataOrder is an access order profile: the paths of regular files (eg.
+	// as read when a container starts), whose data is laid out first and in
+	// this order, so that it can be read ahead in a single sweep. Paths that
+	// are not in the image are ignored.
+	DataOrder []string
+	// Checkpoint, if set, keeps a journal of the files written to dst, so
+	// that an interrupted build can be resumed (see Checkpoint). It is
+	// ignored by a dry run.
+	Checkpoint *Checkpoint
+	// DryRun lays out the image without writing it (dst may be nil), so
+	// that the summary describes the image that would be built. Files are
+	// not deduplicated, as that would mean reading their contents.
+	DryRun bool
+}
+
+// Build creates an EROFS filesystem image from the source filesystem and
+// writes it to the destination writer. The build is aborted if the context
+// is cancelled. The output is deterministic for a given source filesystem,
+// including the inode numbers (nids), which are assigned in the lexical
+// order of the tree (depth first).
+func Build(ctx context.Context, dst io.WriterAt, src fs.FS, opts *Options) (*Summary, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	enc, done, err := newEncoder(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	summary := enc.summary
+	if opts.DryRun {
+		summary.ImageSize = enc.size()
+
+		return summary, nil
+	}
+
+	startTime := time.Now()
+	enc.dst = dst
+
+	if opts.Checkpoint != nil {
+		fingerprint, err := enc.fingerprint(opts.Checkpoint.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fingerprint image: %w", err)
+		}
+
+		var sync func() error
+		if f, ok := dst.(*os.File); ok {
+			sync = f.Sync
+		}
+
+		j, resumed, err := openJournal(opts.Checkpoint, fingerprint, enc.table.Len(), sync)
+		if err != nil {
+			return nil, err
+		}
+		enc.journal = j
+
+		// Start over from an empty file, rather than leave any of the data
+		// of another build behind.
+		if f, ok := dst.(*os.File); ok && !resumed {
+			if err := f.Truncate(0); err != nil {
+				_ = j.Close()
+				return nil, fmt.Errorf("failed to truncate image: %w", err)
+			}
+		}
+	}
+
+	// Leave runs of zeros as holes when writing to a new file.
+	if f, ok := dst.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			if enc.journal != nil {
+				_ = enc.journal.Close()
+			}
+			return nil, fmt.Errorf("failed to stat image: %w", err)
+		}
+
+		if fi.Mode().IsRegular() {
+			if fi.Size() == 0 {
+				enc.dst = &sparseWriterAt{f: f}
+			}
+
+			if opts.Preallocate {
+				enc.preallocate = func(size int64) error {
+					return preallocate(f, size)
+				}
+			}
+		}
+	}
+
+	if err := enc.encode(); err != nil {
+		// Surface the cancellation rather than whatever the encoder made of it.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, fmt.Errorf("failed to create EROFS filesystem: %w", err)
+	}
+
+	sb := newSuperBlock(enc, opts)
+	if err := writeSuperBlock(dst, sb); err != nil {
+		return nil, err
+	}
+
+	summary.ResumedFiles = enc.resumedFiles
+	summary.ResumedBytes = enc.resumedBytes
+	summary.WriteDuration = time.Since(startTime)
+
+	// Trim the image to its final size, extending it over any trailing hole.
+	if f, ok := dst.(*os.File); ok {
+		if err := f.Truncate(enc.size()); err != nil {
+			return nil, fmt.Errorf("failed to truncate image: %w", err)
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat image: %w", err)
+		}
+
+		summary.ImageSize = fi.Size()
+	}
+
+	return summary, nil
+}
+
+// newEncoder returns an encoder that has planned the image of the source
+// file system, along with a function that releases its resources.
+func newEncoder(ctx context.Context, src fs.FS, opts *Options) (_ *encoder, _ func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(opts.VolumeName) > len(erofs.SuperBlock{}.VolumeName) {
+		return nil, nil, fmt.Errorf("volume name %q is longer than %d bytes", opts.VolumeName, len(erofs.SuperBlock{}.VolumeName))
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if !slices.Contains(BlockSizes, blockSize) {
+		return nil, nil, fmt.Errorf("unsupported block size %d (must be one of %v)", blockSize, BlockSizes)
+	}
+
+	var closers []func()
+	done := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			done()
+		}
+	}()
+
+	// Which files are hard links is known to the source file system, rather
+	// than to the transforms wrapped around it.
+	hardlinks := src
+
+	var transforms []transform
+	if opts.SourceDateEpoch != nil {
+		transforms = append(transforms, clampModTime(*opts.SourceDateEpoch))
+	}
+	if opts.ClampModTime != nil {
+		transforms = append(transforms, clampModTime(*opts.ClampModTime))
+	}
+	if opts.ModTime != nil {
+		transforms = append(transforms, setModTime(*opts.ModTime))
+	}
+	if opts.Owner != nil {
+		transforms = append(transforms, forceOwner(*opts.Owner))
+	}
+	if opts.ModeMask != 0 {
+		transforms = append(transforms, maskMode(opts.ModeMask))
+	}
+	if opts.UIDMap != nil || opts.GIDMap != nil {
+		transforms = append(transforms, remapOwners(opts.UIDMap, opts.GIDMap))
+	}
+
+	// After any other transforms, as they may change the timestamps, sizes
+	// and owners that decide the format.
+	switch opts.InodeFormat {
+	case "", InodeFormatAuto:
+	case InodeFormatExtended:
+		transforms = append(transforms, extendedInodes())
+	case InodeFormatCompact:
+		transforms = append(transforms, compactInodes())
+	default:
+		return nil, nil, fmt.Errorf("unknown inode format %q", opts.InodeFormat)
+	}
+
+	if len(transforms) > 0 || opts.TransformFile != nil {
+		tfs := &transformFS{fsys: src, transforms: transforms}
+		if opts.TransformFile != nil {
+			tfs.files = newFileTransformer(src, opts.TransformFile, opts.TempDir)
+			closers = append(closers, func() { _ = tfs.files.Close() })
+		}
+		src = tfs
+	}
+
+	src = &contextFS{ctx: ctx, fsys: src}
+
+	summary := &Summary{}
+
+	table := newStagingTable(opts.MaxMemory, opts.TempDir)
+	closers = append(closers, func() { _ = table.Close() })
+
+	enc := &encoder{src: src, table: table, blockSize: int64(blockSize), summary: summary, concurrency: opts.WriteConcurrency}
+	if enc.concurrency == 0 {
+		enc.concurrency = DefaultWriteConcurrency
+	}
+	if opts.TransformFile == nil {
+		enc.hardlinks = hardlinks
+		enc.linked = make(map[any]int)
+	}
+	if opts.HardlinkDedup && !opts.DryRun {
+		enc.dedup = make(map[contentKey]int)
+	}
+	if opts.Dedupe && !opts.DryRun {
+		enc.shared = make(map[dataKey]int)
+	}
+	if len(opts.DataOrder) > 0 {
+		enc.order = newDataOrder(opts.DataOrder)
+	}
+
+	if !slices.Contains(opts.DisabledFeatures, FeatureSuperBlockChecksum) {
+		summary.Features = append(summary.Features, FeatureSuperBlockChecksum)
+	}
+
+	startTime := time.Now()
+	if err := enc.plan(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+
+		return nil, nil, fmt.Errorf("failed to plan EROFS filesystem: %w", err)
+	}
+	summary.ScanDuration = time.Since(startTime)
+
+	if size := enc.size(); size > 0 {
+		summary.CompressionRatio = float64(summary.DataBytes) / float64(size)
+	}
+
+	if opts.Progress != nil {
+		var written int64
+		enc.onFile = func() {
+			written++
+			opts.Progress(progress.Event{Stage: progress.StageBuild, Current: written, Total: int64(summary.RegularFiles)})
+		}
+	}
+
+	return enc, done, nil
+}
+
+// newSuperBlock returns the superblock of the image planned by the encoder.
+func newSuperBlock(e *encoder, opts *Options) *erofs.SuperBlock {
+	sb := &erofs.SuperBlock{
+		Magic:         erofs.SuperBlockMagicV1,
+		BlockSizeBits: uint8(bits.TrailingZeros64(uint64(e.blockSize))),
+		Inodes:        uint64(e.summary.Inodes),
+		Blocks:        uint32(e.size() / e.blockSize),
+		MetaBlockAddr: 1,
+	}
+
+	if opts.UUID != nil {
+		sb.UUID = *opts.UUID
+	}
+	copy(sb.VolumeName[:], opts.VolumeName)
+
+	if slices.Contains(e.summary.Features, FeatureSuperBlockChecksum) {
+		sb.FeatureCompat |= erofs.FeatureCompatSuperBlockChecksum
+	}
+
+	return sb
+}
+
+// clampModTime returns a transform that clamps timestamps to be no later
+// than the given time.
+func clampModTime(epoch time.Time) transform {
+	return func(_ string, hdr *tar.Header) error {
+		if hdr.ModTime.After(epoch) {
+			hdr.ModTime = epoch
+		}
+		if hdr.AccessTime.After(epoch) {
+			hdr.AccessTime = epoch
+		}
+		if hdr.ChangeTime.After(epoch) {
+			hdr.ChangeTime = epoch
+		}
+		return nil
+	}
+}
+
+// setModTime returns a transform that sets all timestamps to the given time.
+func setModTime(t time.Time) transform {
+	// Files without a timestamp are written as compact inodes, which take
+	// their time from the superblock (the epoch).
+	if t.Equal(time.Unix(0, 0)) {
+		t = time.Time{}
+	}
+
+	return func(_ string, hdr *tar.Header) error {
+		hdr.ModTime = t
+		hdr.AccessTime = t
+		hdr.ChangeTime = t
+		return nil
+	}
+}
+
+// forceOwner returns a transform that gives every file the same owner.
+func forceOwner(owner Owner) transform {
+	return func(_ string, hdr *tar.Header) error {
+		hdr.Uid = owner.UID
+		hdr.Gid = owner.GID
+		hdr.Uname = ""
+		hdr.Gname = ""
+		return nil
+	}
+}
+
+// maskMode returns a transform that clears the given permission bits.
+func maskMode(mask uint32) transform {
+	return func(_ string, hdr *tar.Header) error {
+		if hdr.Typeflag != tar.TypeSymlink {
+			hdr.Mode &^= int64(mask)
+		}
+		return nil
+	}
+}
+
+var (
+	_ fs.ReadDirFS         = (*contextFS)(nil)
+	_ fs.StatFS            = (*contextFS)(nil)
+	_ archivefs.ReadLinkFS = (*contextFS)(nil)
+)
+
+// contextFS is a file system that fails all operations once the context has
+// been cancelled.
+type contextFS struct {
+	ctx  context.Context
+	fsys fs.FS
+}
+
+func (fsys *contextFS) Open(name string) (fs.File, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextFile{File: f, r: util.ContextReader(fsys.ctx, f)}, nil
+}
+
+func (fsys *contextFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inodes are numbered in the order that the tree is walked. Sort the
+	// entries, rather than trusting the source file system to, so that the
+	// numbering is stable across rebuilds.
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+func (fsys *contextFS) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return fs.Stat(fsys.fsys, name)
+}
+
+func (fsys *contextFS) ReadLink(name string) (string, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return "", err
+	}
+
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", fmt.Errorf("file system does not support symbolic links: %w", fs.ErrInvalid)
+	}
+
+	return linkFS.ReadLink(name)
+}
+
+func (fsys *contextFS) StatLink(name string) (fs.FileInfo, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return nil, fmt.Errorf("file system does not support symbolic links: %w", fs.ErrInvalid)
+	}
+
+	return linkFS.StatLink(name)
+}
+
+type contextFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
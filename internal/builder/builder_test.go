@@ -0,0 +1,1347 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/immutos/oci2erofs/internal/builder"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	src := createTestFS(t, time.Time{})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		summary, err := builder.Build(context.Background(), outputFile, src, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, 7, summary.Inodes)
+		require.Equal(t, 4, summary.Directories)
+		require.Equal(t, 2, summary.RegularFiles)
+		require.Equal(t, 1, summary.Symlinks)
+		require.Equal(t, int64(22), summary.DataBytes)
+
+		fi, err := outputFile.Stat()
+		require.NoError(t, err)
+		require.Equal(t, fi.Size(), summary.ImageSize)
+		require.InDelta(t, 22/float64(fi.Size()), summary.CompressionRatio, 1e-9)
+		require.Zero(t, summary.Xattrs)
+
+		fsys, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, fsys)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(ctx, outputFile, src, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Reproducible", func(t *testing.T) {
+		src := createTestFS(t, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC))
+
+		first := buildImage(t, src, nil)
+		second := buildImage(t, src, nil)
+
+		require.Equal(t, first, second)
+	})
+
+	t.Run("Max Memory", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		// Only room for a couple of inodes, the rest spill to disk.
+		spilled := buildImage(t, src, &builder.Options{MaxMemory: 64, TempDir: tempDir})
+		require.Equal(t, buildImage(t, src, nil), spilled)
+
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Inode Numbers", func(t *testing.T) {
+		image, err := erofs.Open(bytes.NewReader(buildImage(t, src, nil)))
+		require.NoError(t, err)
+
+		// Numbered in the order the (sorted) tree is walked.
+		var nids []uint64
+		err = fs.WalkDir(image, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			fi, err := image.StatLink(path)
+			if err != nil {
+				return err
+			}
+
+			nids = append(nids, fi.Sys().(*erofs.Inode).Nid())
+			return nil
+		})
+		require.NoError(t, err)
+		require.Len(t, nids, 7)
+		require.True(t, slices.IsSorted(nids))
+
+		// Regardless of the order in which the source lists its entries.
+		unsorted := buildImage(t, &reversedFS{src.(fs.ReadDirFS)}, nil)
+		require.Equal(t, buildImage(t, src, nil), unsorted)
+	})
+
+	t.Run("Source Date Epoch", func(t *testing.T) {
+		epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		opts := &builder.Options{SourceDateEpoch: &epoch}
+
+		// Timestamps later than the epoch are clamped.
+		first := buildImage(t, createTestFS(t, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)), opts)
+		second := buildImage(t, createTestFS(t, time.Date(2025, 6, 7, 8, 9, 10, 11, time.UTC)), opts)
+		require.Equal(t, first, second)
+
+		fsys, err := erofs.Open(bytes.NewReader(first))
+		require.NoError(t, err)
+
+		fi, err := fsys.Stat("etc/hostname")
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(epoch))
+
+		// Earlier timestamps are retained.
+		earlier := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+		fsys, err = erofs.Open(bytes.NewReader(buildImage(t, createTestFS(t, earlier), opts)))
+		require.NoError(t, err)
+
+		fi, err = fsys.Stat("etc/hostname")
+		require.NoError(t, err)
+		require.True(t, fi.ModTime().Equal(earlier))
+	})
+
+	t.Run("Mod Time", func(t *testing.T) {
+		src := createTestFS(t, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC))
+
+		for name, tc := range map[string]struct {
+			opts     *builder.Options
+			expected time.Time
+		}{
+			"Set":   {opts: &builder.Options{ModTime: ptr(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))}, expected: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+			"Zero":  {opts: &builder.Options{ModTime: ptr(time.Unix(0, 0))}, expected: time.Unix(0, 0)},
+			"Clamp": {opts: &builder.Options{ClampModTime: ptr(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))}, expected: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+			"Clamp Later": {
+				opts:     &builder.Options{ClampModTime: ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))},
+				expected: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				fsys, err := erofs.Open(bytes.NewReader(buildImage(t, src, tc.opts)))
+				require.NoError(t, err)
+
+				for _, path := range []string{"etc/hostname", "usr/bin/sh"} {
+					fi, err := fsys.Stat(path)
+					require.NoError(t, err)
+					require.True(t, fi.ModTime().Equal(tc.expected), path)
+				}
+			})
+		}
+	})
+
+	t.Run("Inode Format", func(t *testing.T) {
+		modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		src := createTestFS(t, modTime)
+
+		for name, tc := range map[string]struct {
+			opts     *builder.Options
+			layout   uint16
+			expected time.Time
+		}{
+			"Auto":           {opts: &builder.Options{}, layout: erofs.InodeLayoutExtended, expected: modTime},
+			"Auto Zero Time": {opts: &builder.Options{ModTime: ptr(time.Unix(0, 0))}, layout: erofs.InodeLayoutCompact, expected: time.Unix(0, 0)},
+			"Extended":       {opts: &builder.Options{ModTime: ptr(time.Unix(0, 0)), InodeFormat: builder.InodeFormatExtended}, layout: erofs.InodeLayoutExtended, expected: time.Unix(0, 0)},
+			"Compact":        {opts: &builder.Options{InodeFormat: builder.InodeFormatCompact}, layout: erofs.InodeLayoutCompact, expected: time.Unix(0, 0)},
+		} {
+			t.Run(name, func(t *testing.T) {
+				fsys, err := erofs.Open(bytes.NewReader(buildImage(t, src, tc.opts)))
+				require.NoError(t, err)
+
+				for _, path := range []string{"etc/hostname", "usr/bin/sh", "bin"} {
+					fi, err := fsys.StatLink(path)
+					require.NoError(t, err)
+					require.Equal(t, tc.layout, fi.Sys().(*erofs.Inode).Layout(), path)
+					require.True(t, fi.ModTime().Equal(tc.expected), path)
+				}
+			})
+		}
+
+		t.Run("Unknown", func(t *testing.T) {
+			_, err := builder.Build(context.Background(), nil, src, &builder.Options{InodeFormat: "tiny"})
+			require.ErrorContains(t, err, "unknown inode format")
+		})
+	})
+
+	t.Run("Sparse", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		content := make([]byte, 8<<20)
+		copy(content[4<<20:], "data")
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "zeros", Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(context.Background(), outputFile, src, nil)
+		require.NoError(t, err)
+
+		// Only the blocks holding data are written out to disk.
+		fi, err := outputFile.Stat()
+		require.NoError(t, err)
+		require.Greater(t, fi.Size(), int64(len(content)))
+		if usage, ok := util.DiskUsage(fi); ok {
+			require.Less(t, usage, int64(1<<20))
+		}
+
+		image, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+	})
+
+	t.Run("Tail Packing", func(t *testing.T) {
+		files := []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "small", Mode: 0o644}, Content: strings.Repeat("s", 100)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "tail", Mode: 0o644}, Content: strings.Repeat("t", erofs.BlockSize+10)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "whole", Mode: 0o644}, Content: strings.Repeat("w", 2*erofs.BlockSize)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "long-tail", Mode: 0o644}, Content: strings.Repeat("l", erofs.BlockSize+2000)},
+		}
+		// Enough entries for the directory to span a block, and a bit.
+		for i := range 300 {
+			files = append(files, testutil.File{Header: tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("many/%03d", i), Mode: 0o644}})
+		}
+		src := testutil.CreateTarFS(t, files)
+
+		data := buildImage(t, src, nil)
+
+		image, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		// The data (or its tail) of each inode follows it if it is small.
+		for name, layout := range map[string]uint16{
+			"small":     erofs.InodeDataLayoutFlatInline,
+			"tail":      erofs.InodeDataLayoutFlatInline,
+			"whole":     erofs.InodeDataLayoutFlatPlain,
+			"long-tail": erofs.InodeDataLayoutFlatPlain,
+			"many":      erofs.InodeDataLayoutFlatInline,
+		} {
+			fi, err := image.Stat(name)
+			require.NoError(t, err)
+			require.Equal(t, layout, fi.Sys().(*erofs.Inode).DataLayout(), name)
+		}
+
+		// The superblock, five blocks of (extended) inodes, and only the
+		// whole blocks of the directory and files (1 + 1 + 2 + 2).
+		require.Len(t, data, (1+5+6)*erofs.BlockSize)
+
+		requireEqualFS(t, src, image)
+	})
+
+	t.Run("Write Concurrency", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range 32 {
+			content := bytes.Repeat([]byte{byte('a' + i%26)}, 8192+i*1000)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("file%d", i), Mode: 0o644, Size: int64(len(content))}))
+			_, err := tw.Write(content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		sequential := buildImage(t, src, &builder.Options{WriteConcurrency: 1})
+		concurrent := buildImage(t, src, &builder.Options{WriteConcurrency: 16})
+		require.Equal(t, sequential, concurrent)
+
+		image, err := erofs.Open(bytes.NewReader(concurrent))
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+	})
+
+	t.Run("Hardlink Dedup", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, f := range []struct {
+			name    string
+			mode    int64
+			content string
+		}{
+			{"a/copyright", 0o644, strings.Repeat("GPL ", 2048)},
+			{"b/copyright", 0o644, strings.Repeat("GPL ", 2048)},
+			{"c/copyright", 0o644, strings.Repeat("GPL ", 2048)},
+			{"c/executable", 0o755, strings.Repeat("GPL ", 2048)},
+			{"c/other", 0o644, "MIT"},
+		} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.content))}))
+			_, err := tw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		summary, err := builder.Build(context.Background(), outputFile, src, &builder.Options{HardlinkDedup: true})
+		require.NoError(t, err)
+
+		require.Equal(t, 2, summary.HardLinks)
+		require.Equal(t, int64(2*8192), summary.DedupBytes)
+		require.Equal(t, 9-2, summary.Inodes)
+
+		image, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+
+		inode := func(path string) *erofs.Inode {
+			fi, err := image.Stat(path)
+			require.NoError(t, err)
+			return fi.Sys().(*erofs.Inode)
+		}
+
+		// Identical files share an inode.
+		require.Equal(t, inode("a/copyright").Nid(), inode("b/copyright").Nid())
+		require.Equal(t, inode("a/copyright").Nid(), inode("c/copyright").Nid())
+		require.Equal(t, uint32(3), inode("a/copyright").Nlink())
+
+		// Files that differ in mode or contents do not.
+		require.NotEqual(t, inode("a/copyright").Nid(), inode("c/executable").Nid())
+		require.Equal(t, uint32(1), inode("c/executable").Nlink())
+		require.Equal(t, uint32(1), inode("c/other").Nlink())
+
+		// Without the option, every file has its own inode.
+		image, err = erofs.Open(bytes.NewReader(buildImage(t, src, nil)))
+		require.NoError(t, err)
+
+		fi, err := image.Stat("b/copyright")
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), fi.Sys().(*erofs.Inode).Nlink())
+	})
+
+	t.Run("Dedupe", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, f := range []struct {
+			name    string
+			mode    int64
+			content string
+		}{
+			{"a/copyright", 0o644, strings.Repeat("GPL ", 2048)},
+			{"b/copyright", 0o644, strings.Repeat("GPL ", 2048)},
+			{"c/executable", 0o755, strings.Repeat("GPL ", 2048)},
+			{"c/other", 0o644, strings.Repeat("MIT ", 2048)},
+			{"c/small", 0o644, "MIT"},
+			{"d/small", 0o644, "MIT"},
+		} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: f.mode, Size: int64(len(f.content))}))
+			_, err := tw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		summary, err := builder.Build(context.Background(), outputFile, src, &builder.Options{Dedupe: true})
+		require.NoError(t, err)
+
+		// Inline data is not shared.
+		require.Equal(t, 2, summary.SharedFiles)
+		require.Equal(t, int64(2*8192), summary.DedupBytes)
+		require.Zero(t, summary.HardLinks)
+
+		image, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+
+		// Every file keeps its own inode.
+		nids := make(map[uint64]bool)
+		for _, name := range []string{"a/copyright", "b/copyright", "c/executable", "c/other"} {
+			fi, err := image.Stat(name)
+			require.NoError(t, err)
+
+			ino := fi.Sys().(*erofs.Inode)
+			require.Equal(t, uint32(1), ino.Nlink())
+			nids[ino.Nid()] = true
+		}
+		require.Len(t, nids, 4)
+
+		// The data of the identical files is written once.
+		withoutDedupe := buildImage(t, src, nil)
+		require.Equal(t, int64(len(withoutDedupe))-2*8192, summary.ImageSize)
+		require.InDelta(t, float64(summary.DataBytes)/float64(summary.ImageSize), summary.CompressionRatio, 1e-9)
+
+		t.Run("Data Order", func(t *testing.T) {
+			image, err := erofs.Open(bytes.NewReader(buildImage(t, src, &builder.Options{
+				Dedupe:    true,
+				DataOrder: []string{"c/executable", "c/other"},
+			})))
+			require.NoError(t, err)
+
+			requireEqualFS(t, src, image)
+		})
+	})
+
+	t.Run("Hard Links", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		content := strings.Repeat("GPL ", 2048)
+		for _, hdr := range []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "a/file", Mode: 0o644, Size: int64(len(content))},
+			{Typeflag: tar.TypeLink, Name: "b/link", Linkname: "a/file"},
+			{Typeflag: tar.TypeLink, Name: "c/other", Linkname: "a/file"},
+			{Typeflag: tar.TypeLink, Name: "d/replaced", Linkname: "a/file"},
+			{Typeflag: tar.TypeReg, Name: "d/replaced", Mode: 0o644, Size: int64(len(content))},
+		} {
+			require.NoError(t, tw.WriteHeader(hdr))
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := tw.Write([]byte(content))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := util.OpenTar(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		summary, err := builder.Build(context.Background(), outputFile, src, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, 2, summary.HardLinks)
+		require.Zero(t, summary.DedupBytes)
+
+		image, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+
+		inode := func(path string) *erofs.Inode {
+			fi, err := image.Stat(path)
+			require.NoError(t, err)
+			return fi.Sys().(*erofs.Inode)
+		}
+
+		require.Equal(t, inode("a/file").Nid(), inode("b/link").Nid())
+		require.Equal(t, inode("a/file").Nid(), inode("c/other").Nid())
+		require.Equal(t, uint32(3), inode("a/file").Nlink())
+
+		// A hard link replaced by a later entry is no longer one.
+		require.NotEqual(t, inode("a/file").Nid(), inode("d/replaced").Nid())
+		require.Equal(t, uint32(1), inode("d/replaced").Nlink())
+
+		t.Run("Directory", func(t *testing.T) {
+			if runtime.GOOS == "windows" {
+				t.Skip("hard links are not identified on Windows")
+			}
+
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0o644))
+			require.NoError(t, os.Link(filepath.Join(dir, "file"), filepath.Join(dir, "link")))
+
+			image, err := erofs.Open(bytes.NewReader(buildImage(t, dirfs.New(dir), nil)))
+			require.NoError(t, err)
+
+			file, err := image.Stat("file")
+			require.NoError(t, err)
+
+			link, err := image.Stat("link")
+			require.NoError(t, err)
+
+			require.Equal(t, file.Sys().(*erofs.Inode).Nid(), link.Sys().(*erofs.Inode).Nid())
+			require.Equal(t, uint32(2), link.Sys().(*erofs.Inode).Nlink())
+		})
+	})
+
+	t.Run("Data Order", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, f := range []struct {
+			name    string
+			content string
+		}{
+			{"a/first", strings.Repeat("A", 8192)},
+			{"b/second", strings.Repeat("B", 8192)},
+			{"c/third", strings.Repeat("C", 8192)},
+			{"c/small", "tiny"},
+		} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0o644, Size: int64(len(f.content))}))
+			_, err := tw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		dataOffsets := func(data []byte) []int {
+			var offsets []int
+			for _, c := range "ABC" {
+				offsets = append(offsets, bytes.Index(data, bytes.Repeat([]byte{byte(c)}, 8192)))
+			}
+			return offsets
+		}
+
+		// By default, the data is in the order that the tree is walked.
+		offsets := dataOffsets(buildImage(t, src, nil))
+		require.True(t, offsets[0] < offsets[1] && offsets[1] < offsets[2])
+
+		data := buildImage(t, src, &builder.Options{
+			DataOrder: []string{"/c/third", "c/small", "missing", "b/second", "c/third"},
+		})
+
+		offsets = dataOffsets(data)
+		require.True(t, offsets[2] < offsets[1] && offsets[1] < offsets[0])
+
+		image, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+	})
+
+	t.Run("Preallocate", func(t *testing.T) {
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(context.Background(), outputFile, src, &builder.Options{Preallocate: true})
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(outputFile.Name())
+		require.NoError(t, err)
+		require.Equal(t, buildImage(t, src, nil), data)
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		src := createTestFS(t, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC))
+
+		summary, err := builder.Build(context.Background(), nil, src, &builder.Options{DryRun: true})
+		require.NoError(t, err)
+
+		require.Equal(t, 7, summary.Inodes)
+		require.Equal(t, int64(22), summary.DataBytes)
+		require.Equal(t, int64(len(buildImage(t, src, nil))), summary.ImageSize)
+		require.Equal(t, []builder.Feature{builder.FeatureSuperBlockChecksum}, summary.Features)
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i := range 8 {
+			content := bytes.Repeat([]byte{byte('a' + i)}, 8192+i*1000)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("file%d", i), Mode: 0o644, Size: int64(len(content))}))
+			_, err := tw.Write(content)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		want := buildImage(t, src, nil)
+
+		dir := t.TempDir()
+		outputFile, err := os.Create(filepath.Join(dir, "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		build := func(t *testing.T, src fs.FS, key string) (*builder.Summary, error) {
+			return builder.Build(context.Background(), outputFile, src, &builder.Options{
+				WriteConcurrency: 1,
+				Checkpoint:       &builder.Checkpoint{Path: filepath.Join(dir, "image.checkpoint"), Key: key},
+			})
+		}
+
+		// Interrupted part way through.
+		errInterrupted := errors.New("interrupted")
+		_, err = build(t, &openFS{ReadDirFS: src, fail: "file5", err: errInterrupted}, "v1")
+		require.ErrorIs(t, err, errInterrupted)
+
+		t.Run("Resume", func(t *testing.T) {
+			opened := &openFS{ReadDirFS: src}
+			summary, err := build(t, opened, "v1")
+			require.NoError(t, err)
+
+			require.GreaterOrEqual(t, summary.ResumedFiles, 5)
+			require.NotContains(t, opened.names(), "file0")
+			require.Contains(t, opened.names(), "file5")
+
+			data, err := os.ReadFile(outputFile.Name())
+			require.NoError(t, err)
+			require.Equal(t, want, data)
+		})
+
+		t.Run("Different Key", func(t *testing.T) {
+			summary, err := build(t, src, "v2")
+			require.NoError(t, err)
+			require.Zero(t, summary.ResumedFiles)
+
+			data, err := os.ReadFile(outputFile.Name())
+			require.NoError(t, err)
+			require.Equal(t, want, data)
+		})
+	})
+
+	t.Run("Empty Files", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "empty", Mode: 0o644}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "small", Mode: 0o644, Size: 5}))
+		_, err := tw.Write([]byte("small"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(context.Background(), outputFile, src, nil)
+		require.NoError(t, err)
+
+		// Empty inodes have a plain data layout, rather than an inline one
+		// without a tail (which the reader rejects).
+		img, err := erofs.OpenImage(outputFile)
+		require.NoError(t, err)
+
+		root, err := img.Inode(img.RootNid())
+		require.NoError(t, err)
+
+		for name, layout := range map[string]uint16{
+			"empty": erofs.InodeDataLayoutFlatPlain,
+			"small": erofs.InodeDataLayoutFlatInline,
+		} {
+			dirent, err := root.Lookup(name)
+			require.NoError(t, err)
+
+			ino, err := img.Inode(dirent.Nid)
+			require.NoError(t, err, name)
+			require.Equal(t, layout, ino.DataLayout(), name)
+		}
+
+		image, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		requireEqualFS(t, src, image)
+	})
+
+	t.Run("Long Directory", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "share/", Mode: 0o755}))
+
+		// More entries than a compact inode can count links for, with names
+		// of varying lengths so that the blocks are filled unevenly.
+		const entries = 70000
+		var names []string
+		for i := range entries {
+			names = append(names, fmt.Sprintf("%0*d", 1+i%40, i))
+		}
+
+		// Names that sort before "." and "..".
+		names = append(names, "!bang", "+plus", "-dash")
+
+		for _, name := range names {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "share/" + name, Mode: 0o644}))
+		}
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		img, err := erofs.OpenImage(bytes.NewReader(buildImage(t, src, nil)))
+		require.NoError(t, err)
+
+		root, err := img.Inode(img.RootNid())
+		require.NoError(t, err)
+
+		dirent, err := root.Lookup("share")
+		require.NoError(t, err)
+
+		dir, err := img.Inode(dirent.Nid)
+		require.NoError(t, err)
+		require.Equal(t, uint16(erofs.InodeLayoutExtended), dir.Layout())
+		require.Equal(t, uint32(len(names)+2), dir.Nlink())
+
+		var listed []string
+		require.NoError(t, dir.IterDirents(func(name string, _ uint8, _ uint64) error {
+			listed = append(listed, name)
+			return nil
+		}))
+		require.True(t, slices.IsSorted(listed))
+		require.Len(t, listed, len(names)+2)
+
+		for _, name := range append(names, ".", "..") {
+			_, err := dir.Lookup(name)
+			require.NoError(t, err, name)
+		}
+	})
+
+	t.Run("Long Name", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: strings.Repeat("a", 256), Mode: 0o644}))
+		require.NoError(t, tw.Close())
+
+		src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(context.Background(), outputFile, src, nil)
+		require.ErrorIs(t, err, builder.ErrNameTooLong)
+	})
+
+	t.Run("Superblock Checksum", func(t *testing.T) {
+		image := buildImage(t, src, nil)
+
+		img, err := erofs.OpenImage(bytes.NewReader(image))
+		require.NoError(t, err)
+		require.NotZero(t, img.SuperBlock().FeatureCompat&erofs.FeatureCompatSuperBlockChecksum)
+
+		// Corrupt the volume name.
+		image[erofs.SuperBlockOffset+64] ^= 0xff
+
+		_, err = erofs.OpenImage(bytes.NewReader(image))
+		require.ErrorContains(t, err, "checksum")
+	})
+
+	t.Run("Disabled Features", func(t *testing.T) {
+		img, err := erofs.OpenImage(bytes.NewReader(buildImage(t, src, &builder.Options{
+			DisabledFeatures: []builder.Feature{builder.FeatureSuperBlockChecksum},
+		})))
+		require.NoError(t, err)
+		require.Zero(t, img.SuperBlock().FeatureCompat&erofs.FeatureCompatSuperBlockChecksum)
+	})
+
+	t.Run("Block Size", func(t *testing.T) {
+		files := []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/big", Mode: 0o644}, Content: strings.Repeat("x", 3*65536+1)},
+			{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"}},
+		}
+		// Enough entries for the directory to span several 16 KiB blocks.
+		for i := range 2000 {
+			files = append(files, testutil.File{Header: tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("var/spool/%04d", i), Mode: 0o644}})
+		}
+		src := testutil.CreateTarFS(t, files)
+
+		for _, blockSize := range []int{16384, 65536} {
+			t.Run(fmt.Sprintf("%d", blockSize), func(t *testing.T) {
+				data := buildImage(t, src, &builder.Options{BlockSize: blockSize})
+				require.Zero(t, len(data)%blockSize)
+
+				img, err := erofs.OpenImage(bytes.NewReader(data))
+				require.NoError(t, err)
+				require.Equal(t, uint32(blockSize), img.BlockSize())
+				require.Equal(t, uint32(len(data)/blockSize), img.SuperBlock().Blocks)
+
+				image, err := erofs.Open(bytes.NewReader(data))
+				require.NoError(t, err)
+
+				requireEqualFS(t, src, image)
+			})
+		}
+
+		t.Run("Unsupported", func(t *testing.T) {
+			_, err := builder.Build(context.Background(), nil, src, &builder.Options{BlockSize: 8192, DryRun: true})
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("UUID and Volume Name", func(t *testing.T) {
+		uuid := [16]byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+		img, err := erofs.OpenImage(bytes.NewReader(buildImage(t, src, &builder.Options{
+			UUID:       &uuid,
+			VolumeName: "rootfs",
+		})))
+		require.NoError(t, err)
+
+		sb := img.SuperBlock()
+		require.Equal(t, uuid, sb.UUID)
+		require.Equal(t, "rootfs", strings.TrimRight(string(sb.VolumeName[:]), "\x00"))
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = builder.Build(context.Background(), outputFile, src, &builder.Options{
+			VolumeName: "a-volume-name-that-is-too-long",
+		})
+		require.Error(t, err)
+	})
+	t.Run("Owner and Mode Mask", func(t *testing.T) {
+		fsys, err := erofs.Open(bytes.NewReader(buildImage(t, src, &builder.Options{
+			Owner:    &builder.Owner{UID: 0, GID: 0},
+			ModeMask: 0o4022,
+			UIDMap:   []builder.IDMap{{ContainerID: 0, HostID: 100000, Size: 1}},
+		})))
+		require.NoError(t, err)
+
+		for path, mode := range map[string]fs.FileMode{
+			"etc/hostname": 0o644,
+			"usr/bin/sh":   0o755,
+			"usr/bin":      fs.ModeDir | 0o755,
+		} {
+			fi, err := fsys.Stat(path)
+			require.NoError(t, err)
+			require.Equal(t, mode, fi.Mode(), path)
+
+			// The owner is forced before the ID maps are applied.
+			ino := fi.Sys().(*erofs.Inode)
+			require.Equal(t, [2]uint32{100000, 0}, [2]uint32{ino.UID(), ino.GID()}, path)
+		}
+
+		fi, err := fsys.StatLink("bin")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink|0o777, fi.Mode())
+	})
+
+	t.Run("Transform File", func(t *testing.T) {
+		var mu sync.Mutex
+		calls := make(map[string]int)
+
+		fsys, err := erofs.Open(bytes.NewReader(buildImage(t, src, &builder.Options{
+			ModeMask: 0o022,
+			TransformFile: func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+				mu.Lock()
+				calls[path]++
+				mu.Unlock()
+
+				if path != "etc/hostname" {
+					return hdr, r, nil
+				}
+
+				data, err := io.ReadAll(r)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				hdr.Mode = 0o666
+				return hdr, strings.NewReader(strings.ToUpper(string(data)) + "LOCALDOMAIN\n"), nil
+			},
+		})))
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]int{"etc/hostname": 1, "usr/bin/sh": 1}, calls)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "LOCALHOST\nLOCALDOMAIN\n", string(hostname))
+
+		// The mode mask applies to the transformed header.
+		fi, err := fsys.Stat("etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
+
+		sh, err := fs.ReadFile(fsys, "usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "#!/bin/true\n", string(sh))
+
+		t.Run("Error", func(t *testing.T) {
+			_, err := builder.Build(context.Background(), nil, src, &builder.Options{
+				DryRun: true,
+				TransformFile: func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+					return nil, nil, errors.New("boom")
+				},
+			})
+			require.ErrorContains(t, err, "boom")
+		})
+
+		t.Run("Type Change", func(t *testing.T) {
+			_, err := builder.Build(context.Background(), nil, src, &builder.Options{
+				DryRun: true,
+				TransformFile: func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+					hdr.Typeflag = tar.TypeSymlink
+					return hdr, r, nil
+				},
+			})
+			require.ErrorContains(t, err, "cannot be transformed")
+		})
+	})
+
+	t.Run("ID Maps", func(t *testing.T) {
+		fsys, err := erofs.Open(bytes.NewReader(buildImage(t, src, &builder.Options{
+			UIDMap: []builder.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			GIDMap: []builder.IDMap{{ContainerID: 0, HostID: 200000, Size: 1000}},
+		})))
+		require.NoError(t, err)
+
+		for path, owner := range map[string][2]uint32{
+			".":            {100000, 200000},
+			"etc/hostname": {101000, 200100},
+			"usr/bin/sh":   {100000, 200000},
+		} {
+			fi, err := fsys.Stat(path)
+			require.NoError(t, err)
+
+			ino := fi.Sys().(*erofs.Inode)
+			require.Equal(t, owner, [2]uint32{ino.UID(), ino.GID()}, path)
+		}
+
+		// Unset times stay at the epoch in the (now extended) inodes.
+		fi, err := fsys.Stat(".")
+		require.NoError(t, err)
+		require.Zero(t, fi.Sys().(*erofs.Inode).Mtime())
+
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		// The owner of etc/hostname (uid 1000) is not mapped.
+		_, err = builder.Build(context.Background(), outputFile, src, &builder.Options{
+			UIDMap: []builder.IDMap{{ContainerID: 0, HostID: 100000, Size: 1000}},
+		})
+		require.ErrorIs(t, err, builder.ErrUnmappedID)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		// Nothing is read or written, so the file need not hold any data.
+		_, err := builder.Build(context.Background(), nil, &sizedFS{
+			ReadDirFS: src.(fs.ReadDirFS),
+			name:      "etc/hostname",
+			size:      builder.MaxImageSize,
+		}, &builder.Options{DryRun: true})
+		require.ErrorIs(t, err, builder.ErrImageTooLarge)
+	})
+}
+
+func TestStream(t *testing.T) {
+	files := []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/a", Mode: 0o644}, Content: strings.Repeat("a", 3*erofs.BlockSize+1)},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/b", Mode: 0o644}, Content: strings.Repeat("b", 2*erofs.BlockSize)},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/copy", Mode: 0o600}, Content: strings.Repeat("a", 3*erofs.BlockSize+1)},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"}},
+	}
+	// Enough entries for the directory not to be inline.
+	for i := range 300 {
+		files = append(files, testutil.File{Header: tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("var/spool/%03d", i), Mode: 0o644}})
+	}
+	src := testutil.CreateTarFS(t, files)
+
+	for name, opts := range map[string]*builder.Options{
+		"Default":    nil,
+		"Data Order": {DataOrder: []string{"usr/lib/b", "usr/lib/copy"}},
+		"Dedupe":     {Dedupe: true, UUID: &[16]byte{1}, VolumeName: "stream"},
+		"Block Size": {BlockSize: 16384},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			summary, err := builder.Stream(context.Background(), &buf, src, opts)
+			require.NoError(t, err)
+
+			// Byte for byte the image that Build writes.
+			require.Equal(t, buildImage(t, src, opts), buf.Bytes())
+			require.Equal(t, int64(buf.Len()), summary.ImageSize)
+
+			image, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+
+			requireEqualFS(t, src, image)
+		})
+	}
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		_, err := builder.Stream(context.Background(), io.Discard, src, &builder.Options{
+			Checkpoint: &builder.Checkpoint{Path: filepath.Join(t.TempDir(), "checkpoint")},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestParseOwner(t *testing.T) {
+	owner, err := builder.ParseOwner("0:100")
+	require.NoError(t, err)
+	require.Equal(t, builder.Owner{UID: 0, GID: 100}, owner)
+
+	for _, s := range []string{"0", "root:root", "0:-1", ":0"} {
+		_, err := builder.ParseOwner(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseIDMap(t *testing.T) {
+	m, err := builder.ParseIDMap("0:100000:65536")
+	require.NoError(t, err)
+	require.Equal(t, builder.IDMap{ContainerID: 0, HostID: 100000, Size: 65536}, m)
+
+	for _, s := range []string{"0:100000", "0:100000:0", "a:b:c", "0:4294967295:2", "-1:0:1"} {
+		_, err := builder.ParseIDMap(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	unsupported, err := builder.UnsupportedFeatures("6.1.0-18-amd64")
+	require.NoError(t, err)
+	require.Equal(t, []builder.Feature{builder.FeatureXattrPrefixes, builder.FeatureZstd}, unsupported)
+
+	unsupported, err = builder.UnsupportedFeatures("5.4")
+	require.NoError(t, err)
+	require.Contains(t, unsupported, builder.FeatureSuperBlockChecksum)
+
+	unsupported, err = builder.UnsupportedFeatures("6.10")
+	require.NoError(t, err)
+	require.Empty(t, unsupported)
+
+	_, err = builder.UnsupportedFeatures("4.14")
+	require.Error(t, err)
+
+	_, err = builder.UnsupportedFeatures("latest")
+	require.Error(t, err)
+}
+
+// buildImage builds an EROFS image from the source filesystem and returns
+// its contents.
+func buildImage(t *testing.T, src fs.FS, opts *builder.Options) []byte {
+	outputPath := filepath.Join(t.TempDir(), "image.erofs")
+
+	outputFile, err := os.Create(outputPath)
+	require.NoError(t, err)
+
+	_, err = builder.Build(context.Background(), outputFile, src, opts)
+	require.NoError(t, err)
+	require.NoError(t, outputFile.Close())
+
+	data, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+
+	return data
+}
+
+// reversedFS lists directory entries in reverse order.
+type reversedFS struct {
+	fs.ReadDirFS
+}
+
+func (fsys *reversedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.ReadDirFS.ReadDir(name)
+	slices.Reverse(entries)
+	return entries, err
+}
+
+func (fsys *reversedFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.ReadDirFS, name)
+}
+
+func (fsys *reversedFS) ReadLink(name string) (string, error) {
+	return fsys.ReadDirFS.(archivefs.ReadLinkFS).ReadLink(name)
+}
+
+func (fsys *reversedFS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.ReadDirFS.(archivefs.ReadLinkFS).StatLink(name)
+}
+
+// openFS records the files opened, and fails to open the file named fail.
+type openFS struct {
+	fs.ReadDirFS
+	fail   string
+	err    error
+	mu     sync.Mutex
+	opened []string
+}
+
+func (fsys *openFS) Open(name string) (fs.File, error) {
+	fsys.mu.Lock()
+	fsys.opened = append(fsys.opened, name)
+	fsys.mu.Unlock()
+
+	if name == fsys.fail {
+		return nil, fsys.err
+	}
+
+	return fsys.ReadDirFS.Open(name)
+}
+
+func (fsys *openFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.ReadDirFS, name)
+}
+
+func (fsys *openFS) ReadLink(name string) (string, error) {
+	return fsys.ReadDirFS.(archivefs.ReadLinkFS).ReadLink(name)
+}
+
+func (fsys *openFS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.ReadDirFS.(archivefs.ReadLinkFS).StatLink(name)
+}
+
+func (fsys *openFS) names() []string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return slices.Clone(fsys.opened)
+}
+
+// sizedFS reports the file called name as size bytes long.
+type sizedFS struct {
+	fs.ReadDirFS
+	name string
+	size int64
+}
+
+func (fsys *sizedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.ReadDirFS.ReadDir(name)
+	for i, entry := range entries {
+		if path.Join(name, entry.Name()) == fsys.name {
+			entries[i] = &sizedEntry{DirEntry: entry, size: fsys.size}
+		}
+	}
+	return entries, err
+}
+
+func (fsys *sizedFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(fsys.ReadDirFS, name)
+	return fsys.resize(name, fi, err)
+}
+
+func (fsys *sizedFS) ReadLink(name string) (string, error) {
+	return fsys.ReadDirFS.(archivefs.ReadLinkFS).ReadLink(name)
+}
+
+func (fsys *sizedFS) StatLink(name string) (fs.FileInfo, error) {
+	fi, err := fsys.ReadDirFS.(archivefs.ReadLinkFS).StatLink(name)
+	return fsys.resize(name, fi, err)
+}
+
+func (fsys *sizedFS) resize(name string, fi fs.FileInfo, err error) (fs.FileInfo, error) {
+	if err != nil || name != fsys.name {
+		return fi, err
+	}
+	return &sizedInfo{FileInfo: fi, size: fsys.size}, nil
+}
+
+type sizedEntry struct {
+	fs.DirEntry
+	size int64
+}
+
+func (e *sizedEntry) Info() (fs.FileInfo, error) {
+	fi, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return &sizedInfo{FileInfo: fi, size: e.size}, nil
+}
+
+type sizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi *sizedInfo) Size() int64 {
+	return fi.size
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func createTestFS(t *testing.T, modTime time.Time) fs.FS {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	headers := []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 100}, content: "localhost\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/sh", Mode: 0o4755}, content: "#!/bin/true\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777}},
+	}
+
+	for _, h := range headers {
+		hdr := h.hdr
+		hdr.Size = int64(len(h.content))
+		hdr.ModTime = modTime
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		_, err := tw.Write([]byte(h.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	return fsys
+}
+
+// requireEqualFS asserts that the EROFS image decodes to the same tree
+// (structure, content, modes, ownership and symlink targets) as the source.
+func requireEqualFS(t *testing.T, src fs.FS, image *erofs.Filesystem) {
+	srcLinkFS := src.(archivefs.ReadLinkFS)
+
+	var paths []string
+	err := fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, path)
+
+		// The root directory is synthesized by both file systems.
+		if path == "." {
+			return nil
+		}
+
+		expected, err := srcLinkFS.StatLink(path)
+		if err != nil {
+			return err
+		}
+
+		actual, err := image.StatLink(path)
+		require.NoError(t, err, path)
+
+		// The archivefs reader does not decode the setuid/setgid/sticky bits.
+		modeMask := fs.ModeType | fs.ModePerm
+		require.Equal(t, expected.Mode()&modeMask, actual.Mode()&modeMask, path)
+
+		hdr := expected.Sys().(*tar.Header)
+		ino := actual.Sys().(*erofs.Inode)
+		require.Equal(t, uint32(hdr.Uid), ino.UID(), path)
+		require.Equal(t, uint32(hdr.Gid), ino.GID(), path)
+
+		switch {
+		case expected.Mode()&fs.ModeSymlink != 0:
+			expectedTarget, err := srcLinkFS.ReadLink(path)
+			require.NoError(t, err)
+
+			actualTarget, err := image.ReadLink(path)
+			require.NoError(t, err, path)
+
+			require.Equal(t, expectedTarget, actualTarget, path)
+
+		case expected.Mode().IsRegular():
+			expectedContent, err := fs.ReadFile(src, path)
+			require.NoError(t, err)
+
+			actualContent, err := fs.ReadFile(image, path)
+			require.NoError(t, err, path)
+
+			require.Equal(t, expectedContent, actualContent, path)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// And nothing extra made it into the image.
+	var imagePaths []string
+	err = fs.WalkDir(image, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		imagePaths = append(imagePaths, path)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, paths, imagePaths)
+}
@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckpointInterval is the default interval at which a checkpoint
+// journal is brought up to date.
+const DefaultCheckpointInterval = 30 * time.Second
+
+// journalMagic starts the header of a checkpoint journal.
+const journalMagic = "oci2erofs checkpoint "
+
+// Checkpoint configures a journal of the regular files whose data has been
+// written to the image, so that a build that is interrupted part way through
+// (eg. on a preempted spot instance) can be resumed by building the same
+// source into the same, partially written, destination.
+type Checkpoint struct {
+	// Path is the journal file. It is created if it does not exist.
+	Path string
+	// Key identifies the source, eg. by the digest of the image. A journal
+	// written for a different key, or for an image that is laid out
+	// differently, is started over.
+	Key string
+	// Interval is how often the journal is brought up to date (defaults to
+	// DefaultCheckpointInterval). The destination is synced to disk first,
+	// so that the journal never gets ahead of it. At most this much work is
+	// lost if the process is killed, while a failed or cancelled build
+	// records everything that it wrote.
+	Interval time.Duration
+}
+
+// journal records the indexes of the inode records whose data has been
+// written. It is a header line, holding a fingerprint of the key and the
+// layout of the image, followed by a little-endian uint32 per record.
+type journal struct {
+	f        *os.File
+	interval time.Duration
+	// sync, if set, syncs the destination to disk.
+	sync func() error
+	// written has a bit set for each record whose data is on disk.
+	written []uint64
+
+	mu        sync.Mutex
+	pending   []uint32
+	lastFlush time.Time
+	// flushMu serializes flushes, which run outside of mu.
+	flushMu sync.Mutex
+}
+
+// openJournal opens the checkpoint journal for an image with n records and
+// the given fingerprint. It reports whether the journal was resumed, rather
+// than started over.
+func openJournal(cp *Checkpoint, fingerprint []byte, n int, sync func() error) (*journal, bool, error) {
+	f, err := os.OpenFile(cp.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+
+	j := &journal{
+		f:         f,
+		interval:  cp.Interval,
+		sync:      sync,
+		written:   make([]uint64, (n+63)/64),
+		lastFlush: time.Now(),
+	}
+	if j.interval <= 0 {
+		j.interval = DefaultCheckpointInterval
+	}
+
+	header := []byte(journalMagic + hex.EncodeToString(fingerprint) + "\n")
+
+	resumed, err := j.load(header, n)
+	if err != nil {
+		_ = f.Close()
+		return nil, false, err
+	}
+
+	if !resumed {
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return nil, false, fmt.Errorf("failed to reset checkpoint: %w", err)
+		}
+
+		if _, err := f.WriteAt(header, 0); err != nil {
+			_ = f.Close()
+			return nil, false, fmt.Errorf("failed to write checkpoint: %w", err)
+		}
+	}
+
+	// Records are appended after those already in the journal, dropping any
+	// that was only partly written.
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, false, fmt.Errorf("failed to stat checkpoint: %w", err)
+	}
+
+	end := int64(len(header)) + (fi.Size()-int64(len(header)))/4*4
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, false, fmt.Errorf("failed to seek checkpoint: %w", err)
+	}
+
+	return j, resumed, nil
+}
+
+// load reads the records of an existing journal, if its header matches.
+func (j *journal) load(header []byte, n int) (bool, error) {
+	data, err := io.ReadAll(j.f)
+	if err != nil {
+		return false, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	records, ok := bytes.CutPrefix(data, header)
+	if !ok {
+		return false, nil
+	}
+
+	for len(records) >= 4 {
+		i := binary.LittleEndian.Uint32(records)
+		records = records[4:]
+
+		if int(i) >= n {
+			return false, nil
+		}
+
+		j.written[i/64] |= 1 << (i % 64)
+	}
+
+	return true, nil
+}
+
+// done reports whether the data of record i has already been written.
+func (j *journal) done(i int) bool {
+	return j.written[i/64]&(1<<(i%64)) != 0
+}
+
+// add records that the data of record i has been written, flushing the
+// journal if it is due.
+func (j *journal) add(i int) error {
+	j.mu.Lock()
+	j.pending = append(j.pending, uint32(i))
+	due := time.Since(j.lastFlush) >= j.interval
+	if due {
+		j.lastFlush = time.Now()
+	}
+	j.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	return j.flush()
+}
+
+// flush syncs the destination and then appends the records written since
+// the last flush.
+func (j *journal) flush() error {
+	j.flushMu.Lock()
+	defer j.flushMu.Unlock()
+
+	j.mu.Lock()
+	pending := j.pending
+	j.pending = nil
+	j.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if j.sync != nil {
+		if err := j.sync(); err != nil {
+			return fmt.Errorf("failed to sync image: %w", err)
+		}
+	}
+
+	if err := binary.Write(j.f, binary.LittleEndian, pending); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// Close flushes and closes the journal.
+func (j *journal) Close() error {
+	return errors.Join(j.flush(), j.f.Close())
+}
+
+// fingerprint identifies the layout of the image for the given key, so that
+// a journal is only resumed by a build that writes every file to the same
+// place.
+func (e *encoder) fingerprint(key string) ([]byte, error) {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00", key, e.blockSize, e.metaSize, e.dataSize)
+
+	for i := range e.table.Len() {
+		r, err := e.table.Get(i)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := binary.Write(h, binary.LittleEndian, r); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.Sum(nil), nil
+}
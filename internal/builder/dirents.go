@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+// dirent is an entry of a directory to be encoded.
+type dirent struct {
+	name     string
+	nid      uint64
+	fileType uint8
+}
+
+// newDirents returns the entries of a directory with the given children
+// (sorted by name, as listed by fs.ReadDir), along with entries for the
+// directory itself and, unless it is the root, its parent. The entries for
+// "." and ".." are left without an inode number, as the kernel does not use
+// them (it tracks parents in the dentry cache).
+//
+// The kernel looks names up with a binary search, first over the blocks of
+// the directory and then within a block, so every entry (including "." and
+// "..", which sort after eg. "-") must be in byte order.
+func newDirents(root bool, children []dirent) []dirent {
+	special := []dirent{{name: ".", fileType: erofs.FT_DIR}, {name: "..", fileType: erofs.FT_DIR}}
+	if root {
+		special = special[:1]
+	}
+
+	dirents := make([]dirent, 0, len(children)+len(special))
+	for _, child := range children {
+		for len(special) > 0 && special[0].name < child.name {
+			dirents = append(dirents, special[0])
+			special = special[1:]
+		}
+		dirents = append(dirents, child)
+	}
+
+	return append(dirents, special...)
+}
+
+// packDirents splits the entries of a directory into blocks of the given
+// size, returning the number of entries in each. Each block holds its entries
+// followed by their names, with no name spanning blocks. As the order of the
+// entries is fixed, filling every block before starting the next needs the
+// fewest blocks.
+//
+// Names are not terminated: the length of the last name in a block is implied
+// by the end of the block (or the directory), and any padding is zeroed.
+func packDirents(dirents []dirent, blockSize int64) []int {
+	var blocks []int
+
+	var n int
+	var used int64
+	for _, d := range dirents {
+		size := erofs.DirentSize + int64(len(d.name))
+		if n > 0 && used+size > blockSize {
+			blocks = append(blocks, n)
+			n, used = 0, 0
+		}
+
+		n++
+		used += size
+	}
+
+	if n > 0 {
+		blocks = append(blocks, n)
+	}
+
+	return blocks
+}
+
+// direntsSize returns the size of the encoded entries of a directory. Every
+// block but the last is full.
+func direntsSize(dirents []dirent, blockSize int64) int64 {
+	blocks := packDirents(dirents, blockSize)
+
+	var last int64
+	for _, d := range dirents[len(dirents)-blocks[len(blocks)-1]:] {
+		last += erofs.DirentSize + int64(len(d.name))
+	}
+
+	return int64(len(blocks)-1)*blockSize + last
+}
+
+// encodeDirents encodes the entries of a directory (see packDirents).
+func encodeDirents(dirents []dirent, blockSize int64) []byte {
+	buf := make([]byte, 0, direntsSize(dirents, blockSize))
+
+	for _, n := range packDirents(dirents, blockSize) {
+		// Pad the previous block.
+		buf = append(buf, make([]byte, roundUp(int64(len(buf)), blockSize)-int64(len(buf)))...)
+
+		block := dirents[:n]
+		dirents = dirents[n:]
+
+		nameOff := uint16(int64(n) * erofs.DirentSize)
+		for _, d := range block {
+			buf = binary.LittleEndian.AppendUint64(buf, d.nid)
+			buf = binary.LittleEndian.AppendUint16(buf, nameOff)
+			buf = append(buf, d.fileType, 0)
+
+			nameOff += uint16(len(d.name))
+		}
+
+		for _, d := range block {
+			buf = append(buf, d.name...)
+		}
+	}
+
+	return buf
+}
+
+// sortDirents sorts the children of a directory into byte order, should the
+// source file system not list them that way.
+func sortDirents(children []dirent) {
+	compare := func(a, b dirent) int {
+		return strings.Compare(a.name, b.name)
+	}
+
+	if !slices.IsSortedFunc(children, compare) {
+		slices.SortFunc(children, compare)
+	}
+}
@@ -0,0 +1,1002 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"golang.org/x/sync/errgroup"
+)
+
+// errChanged is returned when the source file system changes between the
+// passes of the encoder.
+var errChanged = errors.New("changed during build")
+
+// copyBufferPool holds the buffers used to copy file data into the image,
+// large enough to keep fast disks busy.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 1<<20)
+		return &buf
+	},
+}
+
+// encoder writes an EROFS image in three passes over the source file
+// system: staging the size and format of every inode, laying out the image,
+// and writing it. Only a fixed size record is kept per inode (see
+// stagingTable), so large trees can be encoded in bounded memory.
+//
+// The image has the layout that mkfs.erofs gives an uncompressed image: the
+// superblock, followed by the inodes (with inline data and tails) in the
+// order that the tree is walked, and then the data blocks of any larger
+// files. The data
+// blocks are in the order that the tree is walked too, which keeps the files
+// of each directory together, except that those of the files in an access
+// order profile (if any) come first.
+type encoder struct {
+	src   fs.FS
+	dst   io.WriterAt
+	table *stagingTable
+	// blockSize is the size of the blocks of the image.
+	blockSize int64
+	// summary is filled in with the inodes as they are staged.
+	summary *Summary
+	// concurrency is the number of files whose data is written at once.
+	concurrency int
+	// preallocate, if set, is called with the size of the image once it has
+	// been laid out.
+	preallocate func(size int64) error
+	// hardlinks, if set, is the file system that is asked which regular files
+	// are hard links to one another (see util.HardLinkFS), and linked maps
+	// the identity of each such file to the index of its record.
+	hardlinks fs.FS
+	linked    map[any]int
+	// dedup, if set, maps the contents of each regular file to the index of
+	// its record, so that identical files are written as hard links.
+	dedup map[contentKey]int
+	// shared, if set, maps the contents of each regular file whose data is
+	// not inline to the index of its record, so that files with identical
+	// contents (but not metadata) share their data blocks.
+	shared map[dataKey]int
+	// order, if set, is the access order profile that the data of the files
+	// in it is laid out in.
+	order *dataOrder
+	// sequential is set if dst only accepts writes in the order of their
+	// offsets (see sequentialWriterAt). The data blocks are then written once
+	// all of the inodes have been, one file at a time.
+	sequential bool
+	// onFile, if set, is called as each regular file is written.
+	onFile   func()
+	onFileMu sync.Mutex
+	// journal, if set, records the files whose data has been written, and
+	// those that were already written by an interrupted build are skipped.
+	// resumedFiles and resumedBytes count the files skipped.
+	journal      *journal
+	resumedFiles int
+	resumedBytes int64
+
+	metaSize int64
+	dataSize int64
+}
+
+// encode writes the image (other than its superblock), once it has been
+// planned.
+func (e *encoder) encode() (err error) {
+	if e.journal != nil {
+		// Whatever was written is recorded even if the build failed, so
+		// that it can be resumed.
+		defer func() {
+			if closeErr := e.journal.Close(); err == nil && closeErr != nil {
+				err = closeErr
+			}
+		}()
+	}
+
+	if e.preallocate != nil {
+		if err := e.preallocate(e.size()); err != nil {
+			return fmt.Errorf("failed to preallocate image: %w", err)
+		}
+	}
+
+	return e.write()
+}
+
+// plan stages and lays out every inode, without writing anything.
+func (e *encoder) plan() error {
+	if err := e.stage(); err != nil {
+		return fmt.Errorf("failed to stage inodes: %w", err)
+	}
+
+	if err := e.layout(); err != nil {
+		return fmt.Errorf("failed to lay out image: %w", err)
+	}
+
+	// Checked before anything is written, as block addresses beyond 32
+	// bits would otherwise wrap around.
+	if size, limit := e.size(), math.MaxUint32*e.blockSize; size > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrImageTooLarge, size, limit)
+	}
+
+	return nil
+}
+
+// size returns the size of the image, once it has been laid out.
+func (e *encoder) size() int64 {
+	return e.blockSize + e.metaSize + e.dataSize
+}
+
+// stage walks the source file system and records the size and format of
+// every inode.
+func (e *encoder) stage() error {
+	// The directories enclosing the current path, whose descendants are
+	// still being counted.
+	type openDir struct {
+		path  string
+		index int
+	}
+	var parents []openDir
+
+	closeDir := func() error {
+		dir := parents[len(parents)-1]
+		parents = parents[:len(parents)-1]
+
+		r, err := e.table.Get(dir.index)
+		if err != nil {
+			return err
+		}
+		r.Descendants = uint32(e.table.Len() - dir.index - 1)
+
+		return e.table.Set(dir.index, r)
+	}
+
+	err := fs.WalkDir(e.src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		for len(parents) > 0 && !isWithin(path, parents[len(parents)-1].path) {
+			if err := closeDir(); err != nil {
+				return err
+			}
+		}
+
+		if path != "." && len(d.Name()) > erofs.MaxNameLen {
+			return fmt.Errorf("%w: %q is %d bytes", ErrNameTooLong, path, len(d.Name()))
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var r inodeRecord
+		if isExtended(fi) {
+			r.Flags |= recordExtended
+		}
+
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			entries, err := fs.ReadDir(e.src, path)
+			if err != nil {
+				return fmt.Errorf("failed to read directory entries: %w", err)
+			}
+
+			children := make([]dirent, 0, len(entries))
+			for _, de := range entries {
+				children = append(children, dirent{name: de.Name()})
+			}
+			sortDirents(children)
+			r.Size = uint64(direntsSize(newDirents(path == ".", children), e.blockSize))
+
+			if len(entries)+2 > math.MaxUint16 {
+				r.Flags |= recordExtended
+			}
+
+			parents = append(parents, openDir{path: path, index: e.table.Len()})
+			e.summary.Directories++
+
+		case fs.ModeSymlink:
+			target, err := e.readLink(path)
+			if err != nil {
+				return err
+			}
+
+			if len(target) > MaxSymlinkSize {
+				return fmt.Errorf("%w: %q is %d bytes", ErrSymlinkTooLong, path, len(target))
+			}
+			r.Size = uint64(len(target))
+			e.summary.Symlinks++
+
+		case 0:
+			r.Size = uint64(fi.Size())
+			r.Links = 1
+			e.summary.RegularFiles++
+			e.summary.DataBytes += fi.Size()
+
+			// Hard links in the source share an inode, and so do identical
+			// files when deduplicating.
+			var id any
+			if e.hardlinks != nil {
+				if id, err = util.HardLinkID(e.hardlinks, path); err != nil {
+					return fmt.Errorf("failed to identify hard links of %q: %w", path, err)
+				}
+			}
+
+			linked := false
+			if target, ok := e.linked[id]; ok && id != nil {
+				if linked, err = e.link(target, &r); err != nil {
+					return err
+				}
+			}
+
+			shareable := e.shared != nil && r.Size > erofs.MaxInlineDataSize
+			if !linked && ((e.dedup != nil && r.Size > 0) || shareable) {
+				sum, err := e.hash(path)
+				if err != nil {
+					return err
+				}
+
+				if e.dedup != nil {
+					key := newContentKey(sum, fi)
+					if target, ok := e.dedup[key]; ok {
+						if linked, err = e.link(target, &r); err != nil {
+							return err
+						}
+					}
+
+					if linked {
+						e.summary.DedupBytes += int64(r.Size)
+					} else {
+						e.dedup[key] = e.table.Len()
+					}
+				}
+
+				if shareable && !linked {
+					key := dataKey{sum: sum, size: fi.Size()}
+					if target, ok := e.shared[key]; ok {
+						r.Data = uint32(target + 1)
+						e.summary.SharedFiles++
+						e.summary.DedupBytes += int64(r.Size)
+					} else {
+						e.shared[key] = e.table.Len()
+					}
+				}
+			}
+
+			// The inode (and data) of a hard link is that of its target, and
+			// the data of a file that shares it is that of the first file
+			// with the same contents.
+			index := e.table.Len()
+			if r.Link != 0 {
+				index = int(r.Link - 1)
+			}
+
+			if id != nil {
+				e.linked[id] = index
+			}
+
+			if e.order != nil {
+				if r.Data != 0 {
+					e.order.add(path, int(r.Data-1))
+				} else {
+					e.order.add(path, index)
+				}
+			}
+
+		default:
+			return fmt.Errorf("unsupported file type %o for %q", statMode(fi.Mode())&erofs.S_IFMT, path)
+		}
+
+		// Data of up to MaxInlineDataSize bytes follows the inode, as does
+		// the tail of larger data (past its last whole block) if it is no
+		// longer, rather than taking up a block of its own.
+		if tail := r.Size % uint64(e.blockSize); r.Size <= erofs.MaxInlineDataSize || (tail > 0 && tail <= erofs.MaxInlineDataSize) {
+			r.Flags |= recordInline
+		}
+
+		// Hard links share the inode of their target.
+		if r.Link == 0 {
+			e.summary.Inodes++
+		}
+
+		return e.table.Append(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(parents) > 0 {
+		if err := closeDir(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// link makes the file described by r a hard link to the inode whose record is
+// at index target, unless that inode already has as many links as a compact
+// inode can count.
+func (e *encoder) link(target int, r *inodeRecord) (bool, error) {
+	t, err := e.table.Get(target)
+	if err != nil {
+		return false, err
+	}
+
+	if t.Links == math.MaxUint16 {
+		return false, nil
+	}
+	t.Links++
+
+	r.Link = uint32(target + 1)
+	e.summary.HardLinks++
+
+	return true, e.table.Set(target, t)
+}
+
+// hash returns the SHA-256 digest of the contents of a regular file.
+func (e *encoder) hash(path string) (sum [sha256.Size]byte, err error) {
+	f, err := e.src.Open(path)
+	if err != nil {
+		return sum, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, *bufp); err != nil {
+		return sum, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	h.Sum(sum[:0])
+
+	return sum, nil
+}
+
+// newContentKey returns the key under which identical regular files are
+// deduplicated: their contents, and everything stored in their inode.
+func newContentKey(sum [sha256.Size]byte, fi fs.FileInfo) contentKey {
+	key := contentKey{sum: sum, size: fi.Size(), mode: fi.Mode()}
+	key.uid, key.gid = owner(fi)
+	if !fi.ModTime().IsZero() {
+		key.mtime, key.mtimeNsec = fi.ModTime().Unix(), fi.ModTime().Nanosecond()
+	}
+
+	return key
+}
+
+// contentKey identifies a regular file, for deduplication.
+type contentKey struct {
+	sum       [sha256.Size]byte
+	size      int64
+	mode      fs.FileMode
+	uid, gid  int
+	mtime     int64
+	mtimeNsec int
+}
+
+// dataKey identifies the contents of a regular file, for sharing data
+// blocks.
+type dataKey struct {
+	sum  [sha256.Size]byte
+	size int64
+}
+
+// layout assigns each inode its number, and the address of its data.
+func (e *encoder) layout() error {
+	var ordered map[int]bool
+	if e.order != nil {
+		indices := e.order.indices()
+		ordered = make(map[int]bool, len(indices))
+		for _, i := range indices {
+			r, err := e.table.Get(i)
+			if err != nil {
+				return err
+			}
+
+			blocks := int64(r.Size) - e.tailSize(r)
+			if blocks == 0 {
+				continue
+			}
+
+			r.BlockAddr = uint32(e.dataSize / e.blockSize)
+			e.dataSize = roundUp(e.dataSize+blocks, e.blockSize)
+			ordered[i] = true
+
+			if err := e.table.Set(i, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range e.table.Len() {
+		r, err := e.table.Get(i)
+		if err != nil {
+			return err
+		}
+
+		// Hard links share the inode of their target, which comes first.
+		if r.Link != 0 {
+			target, err := e.table.Get(int(r.Link - 1))
+			if err != nil {
+				return err
+			}
+			r.Nid = target.Nid
+
+			if err := e.table.Set(i, r); err != nil {
+				return err
+			}
+			continue
+		}
+
+		inodeSize := inodeSize(r)
+		tail := e.tailSize(r)
+
+		if r.Flags&recordInline != 0 {
+			// If the inode and its inline data would cross a block boundary,
+			// start them on the next block.
+			spaceAvailable := roundUp(e.metaSize, e.blockSize) - e.metaSize
+			if spaceAvailable > 0 && inodeSize+tail > spaceAvailable {
+				e.metaSize = roundUp(e.metaSize, e.blockSize)
+			}
+		}
+
+		if e.metaSize>>erofs.InodeSlotBits > math.MaxUint32 {
+			return errors.New("too many inodes")
+		}
+		r.Nid = uint32(e.metaSize >> erofs.InodeSlotBits)
+
+		e.metaSize += inodeSize
+		if r.Flags&recordInline != 0 {
+			e.metaSize = roundUp(e.metaSize+tail, erofs.InodeSlotSize)
+		}
+
+		if blocks := int64(r.Size) - tail; blocks > 0 {
+			if r.Data != 0 {
+				// The file whose data is shared comes first.
+				shared, err := e.table.Get(int(r.Data - 1))
+				if err != nil {
+					return err
+				}
+				r.BlockAddr = shared.BlockAddr
+			} else if !ordered[i] {
+				r.BlockAddr = uint32(e.dataSize / e.blockSize)
+				e.dataSize = roundUp(e.dataSize+blocks, e.blockSize)
+			}
+		}
+
+		if err := e.table.Set(i, r); err != nil {
+			return err
+		}
+	}
+
+	e.metaSize = roundUp(e.metaSize, e.blockSize)
+
+	return nil
+}
+
+// write walks the source file system again, writing each inode and its data
+// where it was laid out. The data blocks of larger files are written by
+// concurrent workers, while the walk carries on, unless writing sequentially.
+func (e *encoder) write() error {
+	metaOffset := e.blockSize
+	dataBlockAddr := uint32(1 + e.metaSize/e.blockSize)
+
+	g, gctx := errgroup.WithContext(context.Background())
+	g.SetLimit(max(e.concurrency, 1))
+
+	// The data blocks left until after the inodes, if writing sequentially.
+	var deferred []deferredData
+
+	var index int
+	err := fs.WalkDir(e.src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Stop if a worker has failed (its error is returned by Wait).
+		if err := gctx.Err(); err != nil {
+			return err
+		}
+
+		if index >= e.table.Len() {
+			return fmt.Errorf("%q %w", path, errChanged)
+		}
+
+		r, err := e.table.Get(index)
+		if err != nil {
+			return err
+		}
+		index++
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		// The inode of a hard link is written with its target.
+		if r.Link != 0 {
+			e.fileWritten()
+			return nil
+		}
+
+		nlink := 1
+
+		var data []byte
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			entries, err := fs.ReadDir(e.src, path)
+			if err != nil {
+				return fmt.Errorf("failed to read directory entries: %w", err)
+			}
+			nlink = len(entries) + 2
+
+			data, err = e.encodeDir(path, index-1, entries)
+			if err != nil {
+				return fmt.Errorf("failed to encode directory entries of %q: %w", path, err)
+			}
+
+		case fs.ModeSymlink:
+			target, err := e.readLink(path)
+			if err != nil {
+				return err
+			}
+			if uint64(len(target)) != r.Size {
+				return fmt.Errorf("%q %w", path, errChanged)
+			}
+			data = []byte(target)
+
+		default:
+			if fi.Size() != int64(r.Size) {
+				return fmt.Errorf("%q %w", path, errChanged)
+			}
+			nlink = int(r.Links)
+		}
+
+		ino, err := e.inode(fi, nlink, r, dataBlockAddr)
+		if err != nil {
+			return fmt.Errorf("%q %w", path, err)
+		}
+
+		off := metaOffset + int64(r.Nid)<<erofs.InodeSlotBits
+		if err := binary.Write(io.NewOffsetWriter(e.dst, off), binary.LittleEndian, ino); err != nil {
+			return fmt.Errorf("failed to write inode for %q: %w", path, err)
+		}
+
+		// Any tail of the data follows the inode, and the whole blocks
+		// before it are in the data area.
+		tail := e.tailSize(r)
+		blocks := int64(r.Size) - tail
+		tailSpan := span{start: blocks, size: tail, off: off + inodeSize(r)}
+		blocksSpan := span{size: blocks, off: int64(dataBlockAddr+r.BlockAddr) * e.blockSize}
+
+		if !fi.Mode().IsRegular() {
+			if err := e.writeData(path, tailSpan, bytes.NewReader(data[blocks:])); err != nil {
+				return err
+			}
+
+			if blocks == 0 {
+				return nil
+			}
+
+			if e.sequential {
+				deferred = append(deferred, deferredData{path: path, span: blocksSpan, data: data[:blocks]})
+				return nil
+			}
+
+			return e.writeData(path, blocksSpan, bytes.NewReader(data[:blocks]))
+		}
+
+		if blocks == 0 {
+			return e.writeFile(path, r.Size, tailSpan)
+		}
+
+		// The shared data blocks are written with the file that they belong
+		// to, but each file has a tail of its own.
+		if r.Data != 0 {
+			return e.writeFile(path, r.Size, tailSpan)
+		}
+
+		i := index - 1
+		if e.journal != nil && e.journal.done(i) {
+			e.resumedFiles++
+			e.resumedBytes += int64(r.Size)
+			e.fileWritten()
+			return nil
+		}
+
+		if e.sequential {
+			// The tail is written with the inode, ahead of the blocks.
+			if tail > 0 {
+				if err := e.writeSpans(path, r.Size, tailSpan); err != nil {
+					return err
+				}
+			}
+
+			deferred = append(deferred, deferredData{path: path, size: r.Size, span: blocksSpan})
+			return nil
+		}
+
+		g.Go(func() error {
+			if err := e.writeFile(path, r.Size, blocksSpan, tailSpan); err != nil {
+				return err
+			}
+
+			if e.journal != nil {
+				return e.journal.add(i)
+			}
+
+			return nil
+		})
+
+		return nil
+	})
+
+	if waitErr := g.Wait(); waitErr != nil {
+		return waitErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The data blocks are laid out in the order of the walk, other than
+	// those of the files in an access order profile.
+	slices.SortFunc(deferred, func(a, b deferredData) int {
+		return cmp.Compare(a.span.off, b.span.off)
+	})
+
+	for _, d := range deferred {
+		if d.data != nil {
+			err = e.writeData(d.path, d.span, bytes.NewReader(d.data))
+		} else {
+			err = e.writeFile(d.path, d.size, d.span)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// span is a range of the data of an inode, starting at start, and the offset
+// in the image that it is written at.
+type span struct {
+	start int64
+	size  int64
+	off   int64
+}
+
+// deferredData is the data blocks of an inode that are written after all of
+// the inodes, when writing sequentially. Those of directories and symbolic
+// links are held in memory, while those of a regular file (of the given size)
+// are read when written.
+type deferredData struct {
+	path string
+	size uint64
+	span span
+	data []byte
+}
+
+// writeFile writes the given spans of the contents of a regular file, which
+// is size bytes long, and reports it as written.
+func (e *encoder) writeFile(path string, size uint64, spans ...span) error {
+	if err := e.writeSpans(path, size, spans...); err != nil {
+		return err
+	}
+
+	e.fileWritten()
+
+	return nil
+}
+
+// writeSpans writes the given spans (in order) of the contents of a regular
+// file, which is size bytes long. Any contents skipped over are read and
+// discarded, as the file may not support seeking.
+func (e *encoder) writeSpans(path string, size uint64, spans ...span) error {
+	var f fs.File
+	var pos int64
+	for _, s := range spans {
+		if s.size == 0 {
+			continue
+		}
+
+		if f == nil {
+			var err error
+			if f, err = e.src.Open(path); err != nil {
+				return fmt.Errorf("failed to open %q: %w", path, err)
+			}
+			defer f.Close()
+		}
+
+		if _, err := io.CopyN(io.Discard, f, s.start-pos); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("%q %w", path, errChanged)
+			}
+			return fmt.Errorf("failed to read %q: %w", path, err)
+		}
+
+		if err := e.writeData(path, s, io.LimitReader(f, s.size)); err != nil {
+			return err
+		}
+		pos = s.start + s.size
+	}
+
+	// The file must not have grown since it was laid out.
+	if f != nil && pos == int64(size) {
+		var probe [1]byte
+		if n, _ := f.Read(probe[:]); n > 0 {
+			return fmt.Errorf("%q %w", path, errChanged)
+		}
+	}
+
+	return nil
+}
+
+// fileWritten reports that a regular file has been written.
+func (e *encoder) fileWritten() {
+	if e.onFile != nil {
+		e.onFileMu.Lock()
+		e.onFile()
+		e.onFileMu.Unlock()
+	}
+}
+
+// writeData copies a span of the data of an inode to the image, checking
+// that it is still the size that it was laid out for.
+func (e *encoder) writeData(path string, s span, data io.Reader) error {
+	if s.size == 0 {
+		return nil
+	}
+
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	n, err := io.CopyBuffer(io.NewOffsetWriter(e.dst, s.off), data, *bufp)
+	if err != nil {
+		return fmt.Errorf("failed to write data for %q: %w", path, err)
+	}
+	if n != s.size {
+		return fmt.Errorf("%q %w", path, errChanged)
+	}
+
+	return nil
+}
+
+// inode returns the on-disk inode for a file.
+func (e *encoder) inode(fi fs.FileInfo, nlink int, r inodeRecord, dataBlockAddr uint32) (any, error) {
+	// Directories with more entries than a compact inode can count links
+	// for are given an extended inode.
+	if (isExtended(fi) || nlink > math.MaxUint16) != (r.Flags&recordExtended != 0) {
+		return nil, errChanged
+	}
+
+	// Files without any data (including empty inline ones) are written as
+	// plain, as mkfs.erofs does, since some readers expect an inline tail.
+	layout := uint16(erofs.InodeDataLayoutFlatPlain)
+	if r.Flags&recordInline != 0 && r.Size > 0 {
+		layout = erofs.InodeDataLayoutFlatInline
+	}
+	var blockAddr uint32
+	if int64(r.Size) > e.tailSize(r) {
+		blockAddr = dataBlockAddr + r.BlockAddr
+	}
+	format := layout << erofs.InodeDataLayoutBit
+
+	uid, gid := owner(fi)
+	mode := statMode(fi.Mode())
+
+	if r.Flags&recordExtended == 0 {
+		return erofs.InodeCompact{
+			Format:       format | erofs.InodeLayoutCompact<<erofs.InodeLayoutBit,
+			Mode:         mode,
+			Nlink:        uint16(nlink),
+			Size:         uint32(r.Size),
+			RawBlockAddr: blockAddr,
+			Ino:          r.Nid,
+			UID:          uint16(uid),
+			GID:          uint16(gid),
+		}, nil
+	}
+
+	// Files that would otherwise have a compact inode keep the build time of
+	// the image, the epoch.
+	var mtime, mtimeNsec int64
+	if fi.ModTime() != (time.Time{}) {
+		mtime, mtimeNsec = fi.ModTime().Unix(), int64(fi.ModTime().Nanosecond())
+	}
+
+	return erofs.InodeExtended{
+		Format:       format | erofs.InodeLayoutExtended<<erofs.InodeLayoutBit,
+		Mode:         mode,
+		Size:         r.Size,
+		RawBlockAddr: blockAddr,
+		Ino:          r.Nid,
+		UID:          uint32(uid),
+		GID:          uint32(gid),
+		Mtime:        uint64(mtime),
+		MtimeNsec:    uint32(mtimeNsec),
+		Nlink:        uint32(nlink),
+	}, nil
+}
+
+// encodeDir encodes the entries of the directory whose record is at index.
+// The records of its entries follow it, each after the descendants of the
+// entry before.
+func (e *encoder) encodeDir(path string, index int, entries []fs.DirEntry) ([]byte, error) {
+	r, err := e.table.Get(index)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]dirent, 0, len(entries))
+	child := index + 1
+	for _, de := range entries {
+		entry, err := e.table.Get(child)
+		if err != nil {
+			return nil, err
+		}
+
+		children = append(children, dirent{
+			name:     de.Name(),
+			nid:      uint64(entry.Nid),
+			fileType: fileType(de.Type()),
+		})
+
+		child += 1 + int(entry.Descendants)
+	}
+	sortDirents(children)
+
+	buf := encodeDirents(newDirents(path == ".", children), e.blockSize)
+	if int64(len(buf)) != int64(r.Size) {
+		return nil, errChanged
+	}
+
+	return buf, nil
+}
+
+func (e *encoder) readLink(path string) (string, error) {
+	linkFS, ok := e.src.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", fmt.Errorf("file system does not support symbolic links: %w", fs.ErrInvalid)
+	}
+
+	target, err := linkFS.ReadLink(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink target: %w", err)
+	}
+
+	return target, nil
+}
+
+// tailSize returns the size of the part of the data of an inode that follows
+// it (all of the data, or its tail past the last whole block), if any.
+func (e *encoder) tailSize(r inodeRecord) int64 {
+	if r.Flags&recordInline == 0 {
+		return 0
+	}
+
+	return int64(r.Size) % e.blockSize
+}
+
+// inodeSize returns the on-disk size of an inode.
+func inodeSize(r inodeRecord) int64 {
+	if r.Flags&recordExtended != 0 {
+		return int64(binary.Size(erofs.InodeExtended{}))
+	}
+
+	return int64(binary.Size(erofs.InodeCompact{}))
+}
+
+// isExtended returns true if the file needs an extended inode, for its
+// modification time, size or owner.
+func isExtended(fi fs.FileInfo) bool {
+	uid, gid := owner(fi)
+	return fi.Size() > math.MaxUint32 || uid > math.MaxUint16 || gid > math.MaxUint16 ||
+		fi.ModTime() != time.Time{}
+}
+
+func owner(fi fs.FileInfo) (uid, gid int) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return sys.Uid, sys.Gid
+	default:
+		uid, gid, _ := util.StatOwner(fi)
+		return int(uid), int(gid)
+	}
+}
+
+func statMode(mode fs.FileMode) uint16 {
+	stMode := uint16(mode.Perm())
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		stMode |= erofs.S_IFDIR
+	case fs.ModeSymlink:
+		stMode |= erofs.S_IFLNK
+	case fs.ModeDevice:
+		stMode |= erofs.S_IFBLK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		stMode |= erofs.S_IFCHR
+	case fs.ModeNamedPipe:
+		stMode |= erofs.S_IFIFO
+	case fs.ModeSocket:
+		stMode |= erofs.S_IFSOCK
+	default:
+		stMode |= erofs.S_IFREG
+	}
+
+	if mode&fs.ModeSetuid != 0 {
+		stMode |= erofs.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		stMode |= erofs.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		stMode |= erofs.S_ISVTX
+	}
+
+	return stMode
+}
+
+func fileType(mode fs.FileMode) uint8 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return erofs.FT_DIR
+	case fs.ModeSymlink:
+		return erofs.FT_SYMLINK
+	case fs.ModeDevice:
+		return erofs.FT_BLKDEV
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return erofs.FT_CHRDEV
+	case fs.ModeNamedPipe:
+		return erofs.FT_FIFO
+	case fs.ModeSocket:
+		return erofs.FT_SOCK
+	default:
+		return erofs.FT_REG_FILE
+	}
+}
+
+// isWithin returns true if path is below the directory dir.
+func isWithin(path, dir string) bool {
+	return dir == "." || strings.HasPrefix(path, dir+"/")
+}
+
+func roundUp(x, align int64) int64 {
+	return (x + align - 1) &^ (align - 1)
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Feature is an optional EROFS on-disk feature, named as by mkfs.erofs.
+type Feature string
+
+// The features known to the builder. Of these, the encoder only emits the
+// superblock checksum, disabling the others guards against their future use.
+const (
+	FeatureSuperBlockChecksum Feature = "sb_chksum"
+	FeatureBigPcluster        Feature = "big_pcluster"
+	FeatureChunkedFile        Feature = "chunked_file"
+	FeatureZtailpacking       Feature = "ztailpacking"
+	FeatureFragments          Feature = "fragments"
+	FeatureDedupe             Feature = "dedupe"
+	FeatureXattrPrefixes      Feature = "xattr_prefixes"
+	FeatureZstd               Feature = "zstd"
+)
+
+// minKernelVersion is the oldest kernel that can mount EROFS images at all
+// (EROFS was merged into staging in Linux 4.19).
+var minKernelVersion = kernelVersion{4, 19}
+
+// featureKernelVersions is the first kernel release that supports each
+// feature.
+var featureKernelVersions = map[Feature]kernelVersion{
+	FeatureSuperBlockChecksum: {5, 5},
+	FeatureBigPcluster:        {5, 13},
+	FeatureChunkedFile:        {5, 15},
+	FeatureZtailpacking:       {5, 16},
+	FeatureFragments:          {6, 1},
+	FeatureDedupe:             {6, 1},
+	FeatureXattrPrefixes:      {6, 4},
+	FeatureZstd:               {6, 10},
+}
+
+// ParseFeature parses the name of an EROFS feature.
+func ParseFeature(name string) (Feature, error) {
+	if _, ok := featureKernelVersions[Feature(name)]; !ok {
+		return "", fmt.Errorf("unknown EROFS feature %q", name)
+	}
+
+	return Feature(name), nil
+}
+
+// UnsupportedFeatures returns the features that the given kernel release
+// (eg. "5.10" or "6.1.0-18-amd64") cannot mount, in the order they were
+// introduced. It fails if the kernel cannot mount EROFS images at all.
+func UnsupportedFeatures(kernel string) ([]Feature, error) {
+	version, err := parseKernelVersion(kernel)
+	if err != nil {
+		return nil, err
+	}
+
+	if version.less(minKernelVersion) {
+		return nil, fmt.Errorf("kernel %s does not support EROFS (requires %s or later)", kernel, minKernelVersion)
+	}
+
+	var unsupported []Feature
+	for feature, featureVersion := range featureKernelVersions {
+		if version.less(featureVersion) {
+			unsupported = append(unsupported, feature)
+		}
+	}
+
+	slices.SortFunc(unsupported, func(a, b Feature) int {
+		if c := featureKernelVersions[a].compare(featureKernelVersions[b]); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a), string(b))
+	})
+
+	return unsupported, nil
+}
+
+type kernelVersion [2]int
+
+func parseKernelVersion(s string) (kernelVersion, error) {
+	// Ignore the patch level and any local version suffix.
+	major, rest, ok := strings.Cut(s, ".")
+	minor, _, _ := strings.Cut(rest, ".")
+	minor, _, _ = strings.Cut(minor, "-")
+
+	var v kernelVersion
+	var err error
+	if v[0], err = strconv.Atoi(major); !ok || err != nil {
+		return v, fmt.Errorf("invalid kernel version %q", s)
+	}
+	if v[1], err = strconv.Atoi(minor); err != nil {
+		return v, fmt.Errorf("invalid kernel version %q", s)
+	}
+
+	return v, nil
+}
+
+func (v kernelVersion) compare(o kernelVersion) int {
+	if v[0] != o[0] {
+		return v[0] - o[0]
+	}
+	return v[1] - o[1]
+}
+
+func (v kernelVersion) less(o kernelVersion) bool {
+	return v.compare(o) < 0
+}
+
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v[0], v[1])
+}
@@ -0,0 +1,224 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package builder
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// FileTransform rewrites a regular file as it is built into the image (eg. to
+// strip binaries, or render configuration templates). It is called with the
+// path, header and contents of the file, and returns the header and contents
+// to write in their place. Returning r itself leaves the contents untouched,
+// otherwise the size in the header is ignored in favour of the length of the
+// contents returned. The file must remain a regular file.
+type FileTransform func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error)
+
+// fileTransformer applies a FileTransform to each regular file of a file
+// system once. The size of a file is needed to lay out the image before any
+// data is written, so rewritten contents are staged in a temporary file.
+type fileTransformer struct {
+	fsys      fs.FS
+	transform FileTransform
+	tempDir   string
+
+	mu    sync.Mutex
+	files map[string]*transformedFile
+
+	// stageMu guards the staging file.
+	stageMu sync.Mutex
+	staged  *os.File
+	size    int64
+}
+
+// transformedFile is the outcome of transforming a file.
+type transformedFile struct {
+	once sync.Once
+	hdr  *tar.Header
+	// off is the offset of the rewritten contents in the staging file, or
+	// -1 if the contents are unchanged.
+	off int64
+	err error
+}
+
+func newFileTransformer(fsys fs.FS, transform FileTransform, tempDir string) *fileTransformer {
+	return &fileTransformer{
+		fsys:      fsys,
+		transform: transform,
+		tempDir:   tempDir,
+		files:     make(map[string]*transformedFile),
+	}
+}
+
+// header returns the transformed header of the regular file at path.
+func (t *fileTransformer) header(path string, hdr *tar.Header) (*tar.Header, error) {
+	tf, err := t.get(path, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	hdrCopy := *tf.hdr
+	return &hdrCopy, nil
+}
+
+// open returns a reader of the rewritten contents of the regular file at
+// path, or nil if they are unchanged.
+func (t *fileTransformer) open(path string, hdr *tar.Header) (*io.SectionReader, error) {
+	tf, err := t.get(path, hdr)
+	if err != nil || tf.off < 0 {
+		return nil, err
+	}
+
+	return io.NewSectionReader(t.staged, tf.off, tf.hdr.Size), nil
+}
+
+func (t *fileTransformer) get(path string, hdr *tar.Header) (*transformedFile, error) {
+	t.mu.Lock()
+	tf, ok := t.files[path]
+	if !ok {
+		tf = &transformedFile{}
+		t.files[path] = tf
+	}
+	t.mu.Unlock()
+
+	tf.once.Do(func() {
+		tf.hdr, tf.off, tf.err = t.run(path, hdr)
+	})
+
+	return tf, tf.err
+}
+
+func (t *fileTransformer) run(path string, hdr *tar.Header) (*tar.Header, int64, error) {
+	src := &lazyFile{fsys: t.fsys, name: path}
+	defer src.Close()
+
+	hdrCopy := *hdr
+	newHdr, r, err := t.transform(path, &hdrCopy, src)
+	if err != nil {
+		return nil, -1, err
+	}
+	if newHdr == nil {
+		newHdr = &hdrCopy
+	}
+
+	if newHdr.Typeflag != hdr.Typeflag {
+		return nil, -1, errors.New("a regular file cannot be transformed into another type of file")
+	}
+
+	if r == io.Reader(src) {
+		newHdr.Size = hdr.Size
+		return newHdr, -1, nil
+	}
+
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	off, size, err := t.stage(r)
+	if err != nil {
+		return nil, -1, err
+	}
+	newHdr.Size = size
+
+	return newHdr, off, nil
+}
+
+// stage appends the contents to the staging file, returning their offset
+// and size.
+func (t *fileTransformer) stage(r io.Reader) (int64, int64, error) {
+	t.stageMu.Lock()
+	defer t.stageMu.Unlock()
+
+	if t.staged == nil {
+		f, err := os.CreateTemp(t.tempDir, "oci2erofs-transform-*")
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to create staging file: %w", err)
+		}
+
+		t.staged = f
+	}
+
+	off := t.size
+	n, err := io.Copy(io.NewOffsetWriter(t.staged, off), r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stage contents: %w", err)
+	}
+	t.size += n
+
+	return off, n, nil
+}
+
+func (t *fileTransformer) Close() error {
+	if t.staged == nil {
+		return nil
+	}
+
+	if err := t.staged.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(t.staged.Name())
+}
+
+// lazyFile is a file that is only opened once it is read from, so that
+// transforms that leave the contents untouched don't read them.
+type lazyFile struct {
+	fsys fs.FS
+	name string
+	f    fs.File
+}
+
+func (f *lazyFile) Read(p []byte) (int, error) {
+	if f.f == nil {
+		var err error
+		f.f, err = f.fsys.Open(f.name)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return f.f.Read(p)
+}
+
+func (f *lazyFile) Close() error {
+	if f.f == nil {
+		return nil
+	}
+
+	return f.f.Close()
+}
+
+// stagedFile serves the rewritten contents of a file.
+type stagedFile struct {
+	*io.SectionReader
+	fi fs.FileInfo
+}
+
+func (f *stagedFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *stagedFile) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrUnmappedID is returned when a file is owned by a user or group ID that
+// is not covered by any of the ID maps.
+var ErrUnmappedID = errors.New("ID is not mapped")
+
+// IDMap maps a range of user or group IDs as they appear in the image onto a
+// range of IDs on the host, like the ranges in /etc/subuid.
+type IDMap struct {
+	// ContainerID is the first ID of the range within the image.
+	ContainerID uint32
+	// HostID is the ID that ContainerID is mapped to.
+	HostID uint32
+	// Size is the number of IDs in the range.
+	Size uint32
+}
+
+// ParseIDMap parses an ID map of the form "container:host:size" (eg.
+// "0:100000:65536").
+func ParseIDMap(s string) (IDMap, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return IDMap{}, fmt.Errorf("invalid ID map %q: expected container:host:size", s)
+	}
+
+	var ids [3]uint32
+	for i, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return IDMap{}, fmt.Errorf("invalid ID map %q: %w", s, err)
+		}
+		ids[i] = uint32(id)
+	}
+
+	m := IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}
+	if m.Size == 0 {
+		return IDMap{}, fmt.Errorf("invalid ID map %q: size must be positive", s)
+	}
+
+	if uint64(m.ContainerID)+uint64(m.Size) > math.MaxUint32+1 || uint64(m.HostID)+uint64(m.Size) > math.MaxUint32+1 {
+		return IDMap{}, fmt.Errorf("invalid ID map %q: range exceeds the maximum ID", s)
+	}
+
+	return m, nil
+}
+
+// Owner is the user and group that own a file.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// ParseOwner parses an owner of the form "uid:gid" (eg. "0:0").
+func ParseOwner(s string) (Owner, error) {
+	uidStr, gidStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return Owner{}, fmt.Errorf("invalid owner %q: expected uid:gid", s)
+	}
+
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return Owner{}, fmt.Errorf("invalid owner %q: %w", s, err)
+	}
+
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return Owner{}, fmt.Errorf("invalid owner %q: %w", s, err)
+	}
+
+	return Owner{UID: int(uid), GID: int(gid)}, nil
+}
+
+// mapID returns the host ID for id, using the first map that covers it.
+func mapID(maps []IDMap, id int) (int, bool) {
+	for _, m := range maps {
+		if id >= int(m.ContainerID) && id-int(m.ContainerID) < int(m.Size) {
+			return int(m.HostID) + id - int(m.ContainerID), true
+		}
+	}
+
+	return 0, false
+}
+
+// remapOwners returns a transform that shifts the owner of every file
+// according to the given maps. A nil map leaves the corresponding IDs
+// unchanged.
+func remapOwners(uidMap, gidMap []IDMap) transform {
+	return func(path string, hdr *tar.Header) error {
+		if uidMap != nil {
+			uid, ok := mapID(uidMap, hdr.Uid)
+			if !ok {
+				return fmt.Errorf("%w: uid %d", ErrUnmappedID, hdr.Uid)
+			}
+			hdr.Uid = uid
+		}
+
+		if gidMap != nil {
+			gid, ok := mapID(gidMap, hdr.Gid)
+			if !ok {
+				return fmt.Errorf("%w: gid %d", ErrUnmappedID, hdr.Gid)
+			}
+			hdr.Gid = gid
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"math"
+	"time"
+)
+
+// InodeFormat selects between the compact (32 byte) and extended (64 byte)
+// on-disk inode formats.
+type InodeFormat string
+
+const (
+	// InodeFormatAuto uses a compact inode for every file that can be
+	// described by one, and an extended inode otherwise. Compact inodes have
+	// no modification time of their own, 32-bit sizes and 16-bit owners.
+	InodeFormatAuto InodeFormat = "auto"
+	// InodeFormatExtended uses extended inodes for every file, so that each
+	// keeps its own (nanosecond) modification time.
+	InodeFormatExtended InodeFormat = "extended"
+	// InodeFormatCompact uses compact inodes wherever the size and owner of
+	// a file allow, for the smallest metadata. The modification times of
+	// those files are dropped (they take the build time of the image, the
+	// epoch).
+	InodeFormatCompact InodeFormat = "compact"
+)
+
+// ParseInodeFormat parses the name of an inode format.
+func ParseInodeFormat(name string) (InodeFormat, error) {
+	switch format := InodeFormat(name); format {
+	case InodeFormatAuto, InodeFormatExtended, InodeFormatCompact:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown inode format %q", name)
+	}
+}
+
+// extendedInodes returns a transform that makes every inode extended. The
+// encoder only writes compact inodes for files without a modification time,
+// so the epoch is given explicitly instead.
+func extendedInodes() transform {
+	return func(_ string, hdr *tar.Header) error {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Unix(0, 0)
+		}
+		return nil
+	}
+}
+
+// compactInodes returns a transform that drops the timestamps of every file
+// that would otherwise fit in a compact inode.
+func compactInodes() transform {
+	return func(_ string, hdr *tar.Header) error {
+		if hdr.Size <= math.MaxUint32 && hdr.Uid <= math.MaxUint16 && hdr.Gid <= math.MaxUint16 {
+			hdr.ModTime = time.Time{}
+			hdr.AccessTime = time.Time{}
+			hdr.ChangeTime = time.Time{}
+		}
+		return nil
+	}
+}
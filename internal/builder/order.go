@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package builder
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// LoadDataOrder reads an access order profile (see Options.DataOrder) from a
+// file, one path per line. Blank lines and lines starting with '#' are
+// ignored.
+func LoadDataOrder(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		paths = append(paths, line)
+	}
+
+	return paths, scanner.Err()
+}
+
+// dataOrder maps the paths of an access order profile onto the records of
+// the files that they name.
+type dataOrder struct {
+	// positions maps each (cleaned, relative) path to its position in the
+	// profile. Only the first occurrence of a path counts.
+	positions map[string]int
+	// records are the indices of the records of the files found so far,
+	// with their positions.
+	records []orderedRecord
+}
+
+type orderedRecord struct {
+	position int
+	index    int
+}
+
+func newDataOrder(paths []string) *dataOrder {
+	o := &dataOrder{positions: make(map[string]int, len(paths))}
+	for i, p := range paths {
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if _, ok := o.positions[p]; !ok {
+			o.positions[p] = i
+		}
+	}
+
+	return o
+}
+
+// add records that the data of the file at path is held by the record at
+// index, if the file is in the profile.
+func (o *dataOrder) add(path string, index int) {
+	if position, ok := o.positions[path]; ok {
+		o.records = append(o.records, orderedRecord{position: position, index: index})
+	}
+}
+
+// indices returns the indices of the records in the order of the profile.
+// Each record is listed once, at its earliest position.
+func (o *dataOrder) indices() []int {
+	slices.SortStableFunc(o.records, func(a, b orderedRecord) int {
+		return a.position - b.position
+	})
+
+	indices := make([]int, 0, len(o.records))
+	seen := make(map[int]bool, len(o.records))
+	for _, r := range o.records {
+		if !seen[r.index] {
+			seen[r.index] = true
+			indices = append(indices, r.index)
+		}
+	}
+
+	return indices
+}
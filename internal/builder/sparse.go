@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+var zeroBlock [erofs.BlockSize]byte
+
+// sparseWriterAt writes to a new (empty) file, skipping blocks of zeros
+// rather than writing them so that they are left as holes. This keeps images
+// of sparse files (eg. large, mostly empty, model weights or disk images)
+// from taking up more disk space than the data they hold. The encoder writes
+// each block once, so skipping zeros never leaves stale data behind.
+type sparseWriterAt struct {
+	f *os.File
+}
+
+func (w *sparseWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// Take the longest run of blocks that either all hold data or are all
+		// zeros.
+		n := blockLen(off, len(p))
+		zero := isZero(p[:n])
+		for n < len(p) {
+			length := blockLen(off+int64(n), len(p)-n)
+			if isZero(p[n:n+length]) != zero {
+				break
+			}
+
+			n += length
+		}
+
+		if !zero {
+			if _, err := w.f.WriteAt(p[:n], off); err != nil {
+				return written, err
+			}
+		}
+
+		off += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// blockLen returns the length of the block (up to remaining bytes) starting
+// at off.
+func blockLen(off int64, remaining int) int {
+	return min(erofs.BlockSize-int(off%erofs.BlockSize), remaining)
+}
+
+func isZero(p []byte) bool {
+	return bytes.Equal(p, zeroBlock[:len(p)])
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// inodeRecord is what the encoder stages for each inode between passes. It
+// holds no names, as every pass walks the source file system in the same
+// order, so the nth inode visited is always the nth record.
+type inodeRecord struct {
+	// Size is the size of the data of the inode (file contents, encoded
+	// directory entries or symbolic link target).
+	Size uint64
+	// Nid is the inode number, assigned when the image is laid out.
+	Nid uint32
+	// BlockAddr is the first data block of the inode (relative to the
+	// start of the data area), unless all of its data is inline.
+	BlockAddr uint32
+	// Descendants is the number of inodes below a directory, used to find
+	// the records of its entries.
+	Descendants uint32
+	// Flags describes the on-disk format of the inode.
+	Flags uint32
+	// Link is one more than the index of the record of the inode that this
+	// file is a hard link to (zero if it is not a hard link).
+	Link uint32
+	// Links is the number of hard links to a regular file.
+	Links uint32
+	// Data is one more than the index of the record of the regular file
+	// whose data blocks this file shares (zero if it has its own).
+	Data uint32
+}
+
+const (
+	// recordExtended is set for inodes that use the extended format.
+	recordExtended uint32 = 1 << iota
+	// recordInline is set for inodes whose data, or the tail of it past its
+	// last whole block, follows the inode.
+	recordInline
+)
+
+// recordSize is the encoded size of an inodeRecord.
+var recordSize = binary.Size(inodeRecord{})
+
+// stagingTable is an array of inode records. Records are held in memory up
+// to a limit, beyond which they spill over to a temporary file, so that the
+// memory used to build an image does not grow with the number of files.
+type stagingTable struct {
+	tempDir string
+	limit   int
+	records []inodeRecord
+	file    *os.File
+	spilled int
+	buf     []byte
+}
+
+// newStagingTable returns a staging table that holds up to maxMemory bytes
+// of records in memory (unlimited if zero). Spilled records are written to
+// a temporary file in tempDir (or os.TempDir if empty).
+func newStagingTable(maxMemory int64, tempDir string) *stagingTable {
+	limit := -1
+	if maxMemory > 0 {
+		limit = int(maxMemory / int64(recordSize))
+	}
+
+	return &stagingTable{
+		tempDir: tempDir,
+		limit:   limit,
+		buf:     make([]byte, recordSize),
+	}
+}
+
+// Len returns the number of records in the table.
+func (t *stagingTable) Len() int {
+	return len(t.records) + t.spilled
+}
+
+// Append adds a record to the end of the table.
+func (t *stagingTable) Append(r inodeRecord) error {
+	if t.limit < 0 || len(t.records) < t.limit {
+		t.records = append(t.records, r)
+		return nil
+	}
+
+	if t.file == nil {
+		f, err := os.CreateTemp(t.tempDir, "oci2erofs-inodes-*")
+		if err != nil {
+			return fmt.Errorf("failed to create staging file: %w", err)
+		}
+
+		t.file = f
+	}
+
+	t.spilled++
+
+	return t.Set(t.Len()-1, r)
+}
+
+// Get returns the record at index i.
+func (t *stagingTable) Get(i int) (inodeRecord, error) {
+	if i < len(t.records) {
+		return t.records[i], nil
+	}
+
+	if _, err := t.file.ReadAt(t.buf, t.offset(i)); err != nil {
+		return inodeRecord{}, fmt.Errorf("failed to read staging file: %w", err)
+	}
+
+	return inodeRecord{
+		Size:        binary.LittleEndian.Uint64(t.buf[0:]),
+		Nid:         binary.LittleEndian.Uint32(t.buf[8:]),
+		BlockAddr:   binary.LittleEndian.Uint32(t.buf[12:]),
+		Descendants: binary.LittleEndian.Uint32(t.buf[16:]),
+		Flags:       binary.LittleEndian.Uint32(t.buf[20:]),
+		Link:        binary.LittleEndian.Uint32(t.buf[24:]),
+		Links:       binary.LittleEndian.Uint32(t.buf[28:]),
+	}, nil
+}
+
+// Set replaces the record at index i.
+func (t *stagingTable) Set(i int, r inodeRecord) error {
+	if i < len(t.records) {
+		t.records[i] = r
+		return nil
+	}
+
+	binary.LittleEndian.PutUint64(t.buf[0:], r.Size)
+	binary.LittleEndian.PutUint32(t.buf[8:], r.Nid)
+	binary.LittleEndian.PutUint32(t.buf[12:], r.BlockAddr)
+	binary.LittleEndian.PutUint32(t.buf[16:], r.Descendants)
+	binary.LittleEndian.PutUint32(t.buf[20:], r.Flags)
+	binary.LittleEndian.PutUint32(t.buf[24:], r.Link)
+	binary.LittleEndian.PutUint32(t.buf[28:], r.Links)
+
+	if _, err := t.file.WriteAt(t.buf, t.offset(i)); err != nil {
+		return fmt.Errorf("failed to write staging file: %w", err)
+	}
+
+	return nil
+}
+
+// Spilled returns true if records have been spilled to disk.
+func (t *stagingTable) Spilled() bool {
+	return t.file != nil
+}
+
+func (t *stagingTable) Close() error {
+	t.records = nil
+
+	if t.file == nil {
+		return nil
+	}
+
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(t.file.Name())
+}
+
+func (t *stagingTable) offset(i int) int64 {
+	return int64(i-len(t.records)) * int64(recordSize)
+}
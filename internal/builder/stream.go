@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+// Stream creates an EROFS filesystem image from the source filesystem like
+// Build, but writes it to w in a single pass, in order, so that it can be
+// written to a pipe (eg. standard output) without a temporary file. The
+// image is laid out before anything is written, and the data blocks of its
+// files are then written after all of the inodes, one file at a time
+// (WriteConcurrency is ignored). The paths of the files whose data is not
+// inline are held in memory until then. The inline tails of larger files are
+// written with their inodes, so such files are read up to their tail an extra
+// time. A streamed image cannot be resumed,
+// so Checkpoint must not be set.
+func Stream(ctx context.Context, w io.Writer, src fs.FS, opts *Options) (*Summary, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Checkpoint != nil {
+		return nil, errors.New("a streamed image cannot be checkpointed")
+	}
+
+	enc, done, err := newEncoder(ctx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	summary := enc.summary
+	summary.ImageSize = enc.size()
+	if opts.DryRun {
+		return summary, nil
+	}
+
+	startTime := time.Now()
+
+	sw := &sequentialWriterAt{w: w}
+	enc.dst = sw
+	enc.sequential = true
+
+	// The superblock comes first.
+	if err := writeSuperBlock(sw, newSuperBlock(enc, opts)); err != nil {
+		return nil, err
+	}
+
+	if err := enc.encode(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, fmt.Errorf("failed to create EROFS filesystem: %w", err)
+	}
+
+	// Up to the end of the last data block.
+	if err := sw.pad(enc.size()); err != nil {
+		return nil, fmt.Errorf("failed to write image: %w", err)
+	}
+
+	summary.WriteDuration = time.Since(startTime)
+
+	return summary, nil
+}
+
+// sequentialWriterAt writes to w, for an encoder that writes the image in the
+// order of its offsets. The gaps between writes are filled with zeros.
+type sequentialWriterAt struct {
+	w   io.Writer
+	off int64
+}
+
+func (s *sequentialWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < s.off {
+		return 0, fmt.Errorf("write at offset %d is behind the stream at offset %d", off, s.off)
+	}
+
+	if err := s.pad(off); err != nil {
+		return 0, err
+	}
+
+	n, err := s.w.Write(p)
+	s.off += int64(n)
+
+	return n, err
+}
+
+// pad writes zeros up to off.
+func (s *sequentialWriterAt) pad(off int64) error {
+	for s.off < off {
+		n, err := s.w.Write(zeroBlock[:min(off-s.off, erofs.BlockSize)])
+		s.off += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+// writeSuperBlock writes the superblock with a fresh checksum.
+func writeSuperBlock(dst io.WriterAt, sb *erofs.SuperBlock) error {
+	// The checksum covers the rest of the first block (with the checksum
+	// zeroed), which the encoder leaves empty, whatever the block size.
+	sb.Checksum = 0
+
+	block := bytes.NewBuffer(make([]byte, 0, (1<<sb.BlockSizeBits)-erofs.SuperBlockOffset))
+	if err := binary.Write(block, binary.LittleEndian, sb); err != nil {
+		return fmt.Errorf("failed to encode superblock: %w", err)
+	}
+	block.Write(make([]byte, block.Available()))
+
+	// The kernel uses the raw crc32c, without the final inversion.
+	sb.Checksum = ^crc32.Checksum(block.Bytes(), crc32.MakeTable(crc32.Castagnoli))
+
+	if err := binary.Write(io.NewOffsetWriter(dst, erofs.SuperBlockOffset), binary.LittleEndian, sb); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"math"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+)
+
+// transform modifies the metadata of the file at path in place.
+type transform func(path string, hdr *tar.Header) error
+
+var (
+	_ fs.ReadDirFS         = (*transformFS)(nil)
+	_ fs.StatFS            = (*transformFS)(nil)
+	_ archivefs.ReadLinkFS = (*transformFS)(nil)
+)
+
+// transformFS is a file system that rewrites the metadata of every file it
+// returns, eg. to clamp timestamps or remap owners, and (if files is set) the
+// contents of regular files.
+type transformFS struct {
+	fsys       fs.FS
+	transforms []transform
+	files      *fileTransformer
+}
+
+func (fsys *transformFS) Open(name string) (fs.File, error) {
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsys.files != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		if fi.Mode().IsRegular() {
+			hdr, err := fileHeader(name, fi)
+			if err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+
+			contents, err := fsys.files.open(name, hdr)
+			if err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("failed to transform %q: %w", name, err)
+			}
+
+			if contents != nil {
+				_ = f.Close()
+				return &transformFile{File: &stagedFile{SectionReader: contents, fi: fi}, fsys: fsys, name: name}, nil
+			}
+		}
+	}
+
+	return &transformFile{File: f, fsys: fsys, name: name}, nil
+}
+
+func (fsys *transformFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		entries[i] = &transformDirEntry{DirEntry: entry, fsys: fsys, path: joinPath(name, entry.Name())}
+	}
+
+	return entries, nil
+}
+
+func (fsys *transformFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(fsys.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.apply(name, fi)
+}
+
+func (fsys *transformFS) ReadLink(name string) (string, error) {
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", fmt.Errorf("file system does not support symbolic links: %w", fs.ErrInvalid)
+	}
+
+	return linkFS.ReadLink(name)
+}
+
+func (fsys *transformFS) StatLink(name string) (fs.FileInfo, error) {
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return nil, fmt.Errorf("file system does not support symbolic links: %w", fs.ErrInvalid)
+	}
+
+	fi, err := linkFS.StatLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.apply(name, fi)
+}
+
+// apply returns a copy of the file info with the transforms applied.
+func (fsys *transformFS) apply(path string, fi fs.FileInfo) (fs.FileInfo, error) {
+	hdr, err := fileHeader(path, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	// Before the other transforms, so that they apply to the new header.
+	if fsys.files != nil && fi.Mode().IsRegular() {
+		hdr, err = fsys.files.header(path, hdr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform %q: %w", path, err)
+		}
+	}
+
+	for _, t := range fsys.transforms {
+		if err := t(path, hdr); err != nil {
+			return nil, fmt.Errorf("failed to transform %q: %w", path, err)
+		}
+	}
+
+	// Unset times are only stored as the epoch in compact inodes, so would
+	// be garbled if a transform made the inode extended (eg. by remapping
+	// its owner above 65535).
+	if hdr.ModTime.IsZero() && (hdr.Uid > math.MaxUint16 || hdr.Gid > math.MaxUint16) {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+
+	return &transformFileInfo{FileInfo: hdr.FileInfo(), name: fi.Name()}, nil
+}
+
+// fileHeader returns a copy of the tar header describing the file.
+func fileHeader(path string, fi fs.FileInfo) (*tar.Header, error) {
+	if sysHdr, ok := fi.Sys().(*tar.Header); ok {
+		hdrCopy := *sysHdr
+		return &hdrCopy, nil
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create header for %q: %w", path, err)
+	}
+
+	return hdr, nil
+}
+
+type transformFile struct {
+	fs.File
+	fsys *transformFS
+	name string
+}
+
+func (f *transformFile) Stat() (fs.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.fsys.apply(f.name, fi)
+}
+
+type transformDirEntry struct {
+	fs.DirEntry
+	fsys *transformFS
+	path string
+}
+
+func (de *transformDirEntry) Info() (fs.FileInfo, error) {
+	fi, err := de.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return de.fsys.apply(de.path, fi)
+}
+
+// transformFileInfo preserves the original base name, as tar headers may
+// carry a full path (or a trailing slash for directories).
+type transformFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *transformFileInfo) Name() string {
+	return fi.name
+}
+
+func joinPath(dir, name string) string {
+	if dir == "." || dir == "" {
+		return name
+	}
+
+	return dir + "/" + name
+}
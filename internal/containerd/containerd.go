@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package containerd reads images from the image store of a running
+// containerd daemon, over its gRPC API.
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultAddress is the default path of the containerd socket.
+	DefaultAddress = "/run/containerd/containerd.sock"
+	// DefaultNamespace is the default containerd namespace.
+	DefaultNamespace = "default"
+)
+
+const (
+	methodGetImage    = "/containerd.services.images.v1.Images/Get"
+	methodContentInfo = "/containerd.services.content.v1.Content/Info"
+	methodReadContent = "/containerd.services.content.v1.Content/Read"
+)
+
+var _ oci.BlobProvider = (*Provider)(nil)
+
+// Client is a connection to a containerd daemon.
+type Client struct {
+	conn      *grpc.ClientConn
+	namespace string
+}
+
+// Dial connects to the containerd daemon listening on the unix socket at
+// address (defaults to DefaultAddress), using the given namespace (defaults
+// to DefaultNamespace).
+func Dial(ctx context.Context, address, namespace string) (*Client, error) {
+	if address == "" {
+		address = DefaultAddress
+	}
+
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	// Fail fast, rather than waiting for a daemon that is not running.
+	if _, err := os.Stat(address); err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+		grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd at %s: %w", address, err)
+	}
+
+	return &Client{conn: conn, namespace: namespace}, nil
+}
+
+// Close closes the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Image returns the descriptor of the manifest (or image index) of the image
+// with the given name (eg. "docker.io/library/alpine:3.19").
+func (c *Client) Image(ctx context.Context, name string) (ocispecs.Descriptor, error) {
+	req := appendString(nil, 1, name)
+
+	var resp []byte
+	if err := c.conn.Invoke(c.context(ctx), methodGetImage, &req, &resp); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return ocispecs.Descriptor{}, fmt.Errorf("%w: %s is not in namespace %s: %w", oci.ErrRefNotFound, name, c.namespace, fs.ErrNotExist)
+		}
+
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to get image %s: %w", name, err)
+	}
+
+	image, err := parseMessageField(resp, 1)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to decode image %s: %w", name, err)
+	}
+
+	target, err := parseMessageField(image, 3)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to decode image %s: %w", name, err)
+	}
+
+	desc, err := parseDescriptor(target)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to decode image %s: %w", name, err)
+	}
+
+	return desc, nil
+}
+
+// Provider returns a provider of the image with the given name.
+func (c *Client) Provider(name string) *Provider {
+	return &Provider{client: c, name: name}
+}
+
+// context adds the namespace to the outgoing request metadata.
+func (c *Client) context(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "containerd-namespace", c.namespace)
+}
+
+// blobSize returns the size of the blob with the given digest.
+func (c *Client) blobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	req := appendString(nil, 1, dgst.String())
+
+	var resp []byte
+	if err := c.conn.Invoke(c.context(ctx), methodContentInfo, &req, &resp); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return 0, &fs.PathError{Op: "open", Path: dgst.String(), Err: fs.ErrNotExist}
+		}
+
+		return 0, fmt.Errorf("failed to get blob %s: %w", dgst, err)
+	}
+
+	info, err := parseMessageField(resp, 1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode blob info: %w", err)
+	}
+
+	var size int64 = -1
+	if err := parseFields(info, func(f field) error {
+		if f.num == 2 {
+			size = int64(f.varint)
+		}
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to decode blob info: %w", err)
+	}
+
+	if size < 0 {
+		return 0, fmt.Errorf("blob %s has no size", dgst)
+	}
+
+	return size, nil
+}
+
+// readBlob streams size bytes (or the remainder, if zero) of the blob with
+// the given digest, starting at offset. The stream is closed once the
+// context is cancelled.
+func (c *Client) readBlob(ctx context.Context, dgst digest.Digest, offset, size int64) (grpc.ClientStream, error) {
+	stream, err := c.conn.NewStream(c.context(ctx), &grpc.StreamDesc{ServerStreams: true}, methodReadContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+
+	req := appendString(nil, 1, dgst.String())
+	req = appendInt64(req, 2, offset)
+	req = appendInt64(req, 3, size)
+
+	if err := stream.SendMsg(&req); err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+
+	return stream, nil
+}
+
+// Provider provides an image from the containerd image store. Its index
+// lists just the image, annotated with its name.
+type Provider struct {
+	client *Client
+	name   string
+}
+
+func (p *Provider) OpenIndex(ctx context.Context) (fs.File, error) {
+	desc, err := p.client.Image(ctx, p.name)
+	if err != nil {
+		return nil, err
+	}
+
+	desc.Annotations = map[string]string{ocispecs.AnnotationRefName: p.name}
+
+	data, err := json.Marshal(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{desc},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &indexFile{Reader: bytes.NewReader(data)}, nil
+}
+
+func (p *Provider) OpenBlob(ctx context.Context, dgst digest.Digest) (fs.File, error) {
+	size, err := p.client.blobSize(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &blobFile{ctx: ctx, cancel: cancel, client: p.client, dgst: dgst, size: size}, nil
+}
+
+// blobFile is a blob in the content store. It is read sequentially with a
+// single stream, and at random with a stream per call to ReadAt (eg. to
+// read the files of a layer with a table of contents).
+type blobFile struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *Client
+	dgst   digest.Digest
+	size   int64
+
+	stream grpc.ClientStream
+	buf    []byte
+}
+
+func (f *blobFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: f.dgst.Encoded(), size: f.size}, nil
+}
+
+func (f *blobFile) Read(p []byte) (int, error) {
+	if f.stream == nil {
+		stream, err := f.client.readBlob(f.ctx, f.dgst, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		f.stream = stream
+	}
+
+	for len(f.buf) == 0 {
+		data, err := recvData(f.stream)
+		if err != nil {
+			return 0, err
+		}
+		f.buf = data
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+
+	return n, nil
+}
+
+func (f *blobFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	size := min(int64(len(p)), f.size-off)
+
+	ctx, cancel := context.WithCancel(f.ctx)
+	defer cancel()
+
+	stream, err := f.client.readBlob(ctx, f.dgst, off, size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for int64(n) < size {
+		data, err := recvData(stream)
+		if errors.Is(err, io.EOF) {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:size], data)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *blobFile) Close() error {
+	f.cancel()
+	return nil
+}
+
+// recvData receives the data of the next ReadContentResponse of a stream.
+func recvData(stream grpc.ClientStream) ([]byte, error) {
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if err := parseFields(resp, func(f field) error {
+		if f.num == 2 {
+			data = f.bytes
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to decode blob content: %w", err)
+	}
+
+	return data, nil
+}
+
+// indexFile is the synthesized index of a provider.
+type indexFile struct {
+	*bytes.Reader
+}
+
+func (f *indexFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: "index.json", size: f.Size()}, nil
+}
+
+func (f *indexFile) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return nil }
@@ -0,0 +1,285 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package containerd_test
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/containerd"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestProvider(t *testing.T) {
+	const name = "docker.io/tianon/toybox:0.8.11"
+
+	address := startTestDaemon(t, "testing", map[string]ocispecs.Descriptor{
+		name: {
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Digest:    "sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce",
+			Size:      1021,
+		},
+	}, "../oci/testdata/toybox/blobs/sha256")
+
+	ctx := context.Background()
+
+	client, err := containerd.Dial(ctx, address, "testing")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	rootFS, closeAll, err := oci.LoadImageFrom(ctx, t.TempDir(), client.Provider(name), "", nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeAll())
+	})
+
+	h, err := util.HashFS(rootFS)
+	require.NoError(t, err)
+
+	require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+
+	t.Run("Read At", func(t *testing.T) {
+		const layer = "4e4ed2728f23408f0a3be0cf892b607bc5ec32d12941a093d001bc3de60f5425"
+
+		expected, err := os.ReadFile(filepath.Join("../oci/testdata/toybox/blobs/sha256", layer))
+		require.NoError(t, err)
+
+		f, err := client.Provider(name).OpenBlob(ctx, digest.NewDigestFromEncoded(digest.SHA256, layer))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		// Spanning several responses.
+		buf := make([]byte, 200000)
+		n, err := f.(io.ReaderAt).ReadAt(buf, 100000)
+		require.NoError(t, err)
+		require.Equal(t, expected[100000:100000+n], buf[:n])
+
+		n, err = f.(io.ReaderAt).ReadAt(buf, int64(len(expected))-10)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, expected[len(expected)-10:], buf[:n])
+	})
+
+	t.Run("Missing Image", func(t *testing.T) {
+		_, _, err := oci.LoadImageFrom(ctx, t.TempDir(), client.Provider("docker.io/library/missing:latest"), "", nil, nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Wrong Namespace", func(t *testing.T) {
+		client, err := containerd.Dial(ctx, address, "")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, client.Close())
+		})
+
+		_, _, err = oci.LoadImageFrom(ctx, t.TempDir(), client.Provider(name), "", nil, nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+// startTestDaemon serves a minimal containerd images and content API on a
+// unix socket, with the given images in a namespace and blobs from blobDir.
+// It returns the address of the socket.
+func startTestDaemon(t *testing.T, namespace string, images map[string]ocispecs.Descriptor, blobDir string) string {
+	address := filepath.Join(t.TempDir(), "containerd.sock")
+
+	lis, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	readBlob := func(req []byte) ([]byte, error) {
+		dgst, err := digest.Parse(string(messageField(t, req, 1)))
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		data, err := os.ReadFile(filepath.Join(blobDir, dgst.Encoded()))
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return data, nil
+	}
+
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if ns := md.Get("containerd-namespace"); len(ns) != 1 || ns[0] != namespace {
+			return status.Error(codes.NotFound, "namespace not found")
+		}
+
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+
+		method, _ := grpc.MethodFromServerStream(stream)
+		switch method {
+		case "/containerd.services.images.v1.Images/Get":
+			desc, ok := images[string(messageField(t, req, 1))]
+			if !ok {
+				return status.Error(codes.NotFound, "image not found")
+			}
+
+			var target []byte
+			target = protowire.AppendTag(target, 1, protowire.BytesType)
+			target = protowire.AppendString(target, desc.MediaType)
+			target = protowire.AppendTag(target, 2, protowire.BytesType)
+			target = protowire.AppendString(target, desc.Digest.String())
+			target = protowire.AppendTag(target, 3, protowire.VarintType)
+			target = protowire.AppendVarint(target, uint64(desc.Size))
+
+			var image []byte
+			image = protowire.AppendTag(image, 3, protowire.BytesType)
+			image = protowire.AppendBytes(image, target)
+
+			var resp []byte
+			resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+			resp = protowire.AppendBytes(resp, image)
+
+			return stream.SendMsg(&resp)
+		case "/containerd.services.content.v1.Content/Info":
+			data, err := readBlob(req)
+			if err != nil {
+				return err
+			}
+
+			var info []byte
+			info = protowire.AppendTag(info, 2, protowire.VarintType)
+			info = protowire.AppendVarint(info, uint64(len(data)))
+
+			var resp []byte
+			resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+			resp = protowire.AppendBytes(resp, info)
+
+			return stream.SendMsg(&resp)
+		case "/containerd.services.content.v1.Content/Read":
+			data, err := readBlob(req)
+			if err != nil {
+				return err
+			}
+
+			offset, size := int64(varintField(t, req, 2)), int64(varintField(t, req, 3))
+			data = data[offset:]
+			if size > 0 {
+				data = data[:size]
+			}
+
+			// Like containerd, respond in chunks.
+			for len(data) > 0 {
+				chunk := data[:min(len(data), 1<<16)]
+				data = data[len(chunk):]
+
+				var resp []byte
+				resp = protowire.AppendTag(resp, 1, protowire.VarintType)
+				resp = protowire.AppendVarint(resp, uint64(offset))
+				resp = protowire.AppendTag(resp, 2, protowire.BytesType)
+				resp = protowire.AppendBytes(resp, chunk)
+
+				if err := stream.SendMsg(&resp); err != nil {
+					return err
+				}
+
+				offset += int64(len(chunk))
+			}
+
+			return nil
+		default:
+			return status.Error(codes.Unimplemented, method)
+		}
+	}))
+
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	return address
+}
+
+// messageField returns the length delimited field with the given number.
+func messageField(t *testing.T, b []byte, num protowire.Number) []byte {
+	var value []byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		require.Greater(t, l, 0)
+		b = b[l:]
+
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		require.Greater(t, l, 0)
+
+		if n == num && typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(b)
+		}
+		b = b[l:]
+	}
+
+	return value
+}
+
+// varintField returns the varint field with the given number.
+func varintField(t *testing.T, b []byte, num protowire.Number) uint64 {
+	var value uint64
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		require.Greater(t, l, 0)
+		b = b[l:]
+
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		require.Greater(t, l, 0)
+
+		if n == num && typ == protowire.VarintType {
+			value, _ = protowire.ConsumeVarint(b)
+		}
+		b = b[l:]
+	}
+
+	return value
+}
+
+// rawCodec passes pre-encoded messages through gRPC unchanged.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package containerd
+
+import (
+	"errors"
+
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The containerd API messages are encoded by hand, rather than pulling in
+// the generated API packages (and their dependencies) for the handful of
+// fields used.
+
+// codec passes pre-encoded messages through gRPC unchanged.
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// field is a decoded message field. Only varint and length delimited fields
+// are of interest.
+type field struct {
+	num    protowire.Number
+	varint uint64
+	bytes  []byte
+}
+
+// parseFields calls fn with each of the fields of an encoded message.
+func parseFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMessageField returns the (last) embedded message with the given field
+// number.
+func parseMessageField(b []byte, num protowire.Number) ([]byte, error) {
+	var m []byte
+	err := parseFields(b, func(f field) error {
+		if f.num == num {
+			m = f.bytes
+		}
+		return nil
+	})
+	return m, err
+}
+
+// parseDescriptor decodes a containerd.types.Descriptor.
+func parseDescriptor(b []byte) (ocispecs.Descriptor, error) {
+	var desc ocispecs.Descriptor
+	err := parseFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			desc.MediaType = string(f.bytes)
+		case 2:
+			desc.Digest = digest.Digest(f.bytes)
+		case 3:
+			desc.Size = int64(f.varint)
+		case 5:
+			var key, value string
+			if err := parseFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					key = string(f.bytes)
+				case 2:
+					value = string(f.bytes)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if desc.Annotations == nil {
+				desc.Annotations = make(map[string]string)
+			}
+			desc.Annotations[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+
+	if desc.Digest == "" {
+		return ocispecs.Descriptor{}, errors.New("descriptor has no digest")
+	}
+
+	return desc, nil
+}
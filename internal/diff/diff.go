@@ -0,0 +1,375 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// Kind is the kind of change to a file.
+type Kind string
+
+const (
+	Added    Kind = "added"
+	Removed  Kind = "removed"
+	Modified Kind = "modified"
+)
+
+// Change describes how a file differs between two file systems.
+type Change struct {
+	Path string `json:"path"`
+	Kind Kind   `json:"kind"`
+	// Details lists what changed for modified files (type, mode, owner,
+	// mtime, size, content or target).
+	Details []string `json:"details,omitempty"`
+}
+
+// Options configures a comparison.
+type Options struct {
+	// IgnoreModTime does not report files whose only change is their
+	// modification time.
+	IgnoreModTime bool
+	// IgnoreOwner does not report files whose only change is their owner.
+	IgnoreOwner bool
+	// IgnoreMode does not report files whose only change is their
+	// permissions.
+	IgnoreMode bool
+}
+
+// Compare reports the changes needed to turn file system a into b. Either
+// may be a live directory tree (eg. the /usr of a running system, see
+// dirfs.New), in which case files that disappear while it is walked are
+// left out.
+func Compare(a, b archivefs.ReadLinkFS, opts *Options) ([]Change, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	aFiles, err := walk(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bFiles, err := walk(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for path := range aFiles {
+		paths = append(paths, path)
+	}
+	for path := range bFiles {
+		if _, ok := aFiles[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+
+	var changes []Change
+	for _, path := range paths {
+		aInfo, inA := aFiles[path]
+		bInfo, inB := bFiles[path]
+
+		switch {
+		case !inA:
+			changes = append(changes, Change{Path: path, Kind: Added})
+		case !inB:
+			changes = append(changes, Change{Path: path, Kind: Removed})
+		default:
+			details, err := compareFile(a, b, path, aInfo, bInfo, opts)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(details) > 0 {
+				changes = append(changes, Change{Path: path, Kind: Modified, Details: details})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// WriteText writes the changes in a human readable format.
+func WriteText(w io.Writer, changes []Change) error {
+	for _, c := range changes {
+		var err error
+		switch c.Kind {
+		case Added:
+			_, err = fmt.Fprintf(w, "+ %s\n", c.Path)
+		case Removed:
+			_, err = fmt.Fprintf(w, "- %s\n", c.Path)
+		default:
+			_, err = fmt.Fprintf(w, "M %s (%s)\n", c.Path, strings.Join(c.Details, ", "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sub returns the tree of fsys below the directory dir (eg. "usr"), to
+// compare it against another tree.
+func Sub(fsys archivefs.ReadLinkFS, dir string) (archivefs.ReadLinkFS, error) {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	if dir == "" {
+		return fsys, nil
+	}
+
+	fi, err := fs.Stat(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return &subFS{fsys: fsys, dir: dir}, nil
+}
+
+func walk(fsys archivefs.ReadLinkFS) (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed since its directory was read.
+			if path != "." && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		var fi fs.FileInfo
+		if path == "." {
+			// Not all file systems support StatLink on the root directory.
+			fi, err = fs.Stat(fsys, path)
+		} else {
+			fi, err = fsys.StatLink(path)
+		}
+		if err != nil {
+			if path != "." && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+
+		files[path] = fi
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk file system: %w", err)
+	}
+
+	return files, nil
+}
+
+func compareFile(a, b archivefs.ReadLinkFS, path string, aInfo, bInfo fs.FileInfo, opts *Options) ([]string, error) {
+	if aInfo.Mode().Type() != bInfo.Mode().Type() {
+		return []string{"type"}, nil
+	}
+
+	var details []string
+
+	// The archivefs EROFS reader does not decode the setuid/setgid/sticky bits.
+	if !opts.IgnoreMode && aInfo.Mode().Perm() != bInfo.Mode().Perm() {
+		details = append(details, "mode")
+	}
+
+	aUID, aGID, aOK := owner(aInfo)
+	bUID, bGID, bOK := owner(bInfo)
+	if !opts.IgnoreOwner && aOK && bOK && (aUID != bUID || aGID != bGID) {
+		details = append(details, "owner")
+	}
+
+	if !opts.IgnoreModTime && modTime(aInfo) != modTime(bInfo) {
+		details = append(details, "mtime")
+	}
+
+	switch aInfo.Mode().Type() {
+	case fs.ModeSymlink:
+		aTarget, err := a.ReadLink(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read link %q: %w", path, err)
+		}
+
+		bTarget, err := b.ReadLink(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read link %q: %w", path, err)
+		}
+
+		if aTarget != bTarget {
+			details = append(details, "target")
+		}
+	case 0:
+		if aInfo.Size() != bInfo.Size() {
+			details = append(details, "size", "content")
+			break
+		}
+
+		equal, err := equalContent(a, b, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !equal {
+			details = append(details, "content")
+		}
+	}
+
+	return details, nil
+}
+
+// modTime returns the modification time in seconds (as EROFS stores it). An
+// unset time is written as the Unix epoch.
+func modTime(fi fs.FileInfo) int64 {
+	if fi.ModTime().IsZero() {
+		return 0
+	}
+
+	return fi.ModTime().Unix()
+}
+
+func owner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	switch sys := fi.Sys().(type) {
+	case *erofs.Inode:
+		return sys.UID(), sys.GID(), true
+	case *tar.Header:
+		return uint32(sys.Uid), uint32(sys.Gid), true
+	default:
+		return util.StatOwner(fi)
+	}
+}
+
+func equalContent(a, b fs.FS, path string) (bool, error) {
+	aFile, err := a.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer aFile.Close()
+
+	bFile, err := b.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer bFile.Close()
+
+	aBuf := make([]byte, 32*1024)
+	bBuf := make([]byte, 32*1024)
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		if aErr != nil && !isEOF(aErr) {
+			return false, fmt.Errorf("failed to read %q: %w", path, aErr)
+		}
+
+		bN, bErr := io.ReadFull(bFile, bBuf)
+		if bErr != nil && !isEOF(bErr) {
+			return false, fmt.Errorf("failed to read %q: %w", path, bErr)
+		}
+
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+
+		if isEOF(aErr) || isEOF(bErr) {
+			return isEOF(aErr) && isEOF(bErr), nil
+		}
+	}
+}
+
+func isEOF(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// subFS is the tree of a file system below a directory.
+type subFS struct {
+	fsys archivefs.ReadLinkFS
+	dir  string
+}
+
+func (fsys *subFS) Open(name string) (fs.File, error) {
+	full, err := fsys.full("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.fsys.Open(full)
+}
+
+func (fsys *subFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := fsys.full("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.ReadDir(fsys.fsys, full)
+}
+
+func (fsys *subFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := fsys.full("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Stat(fsys.fsys, full)
+}
+
+func (fsys *subFS) ReadLink(name string) (string, error) {
+	full, err := fsys.full("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	return fsys.fsys.ReadLink(full)
+}
+
+func (fsys *subFS) StatLink(name string) (fs.FileInfo, error) {
+	full, err := fsys.full("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.fsys.StatLink(full)
+}
+
+func (fsys *subFS) full(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return path.Join(fsys.dir, name), nil
+}
@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package diff_test
+
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/diff"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	a := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, ModTime: modTime}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644, ModTime: modTime}, Content: "hello\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644, ModTime: modTime}, Content: "root\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o600, ModTime: modTime}, Content: "root\n"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "removed", Mode: 0o644, ModTime: modTime}},
+	})
+
+	b := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, ModTime: modTime}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644, ModTime: modTime}, Content: "howdy\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o600, Uid: 1000, ModTime: modTime}, Content: "root\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o600, ModTime: modTime.Add(time.Hour)}, Content: "root\n"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "/usr/bin", Mode: 0o777, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "added", Mode: 0o644, ModTime: modTime}},
+	})
+
+	t.Run("Changes", func(t *testing.T) {
+		changes, err := diff.Compare(a, b, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, []diff.Change{
+			{Path: "added", Kind: diff.Added},
+			{Path: "bin", Kind: diff.Modified, Details: []string{"target"}},
+			{Path: "etc/motd", Kind: diff.Modified, Details: []string{"content"}},
+			{Path: "etc/passwd", Kind: diff.Modified, Details: []string{"mode", "owner"}},
+			{Path: "etc/shadow", Kind: diff.Modified, Details: []string{"mtime"}},
+			{Path: "removed", Kind: diff.Removed},
+		}, changes)
+	})
+
+	t.Run("Ignore ModTime", func(t *testing.T) {
+		changes, err := diff.Compare(a, b, &diff.Options{IgnoreModTime: true})
+		require.NoError(t, err)
+
+		for _, c := range changes {
+			require.NotEqual(t, "etc/shadow", c.Path)
+		}
+	})
+
+	t.Run("Identical", func(t *testing.T) {
+		changes, err := diff.Compare(a, a, nil)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+	})
+
+	t.Run("Unset ModTime", func(t *testing.T) {
+		unset := testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0o644}},
+		})
+
+		epoch := testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0o644, ModTime: time.Unix(0, 0)}},
+		})
+
+		changes, err := diff.Compare(unset, epoch, nil)
+		require.NoError(t, err)
+		require.Empty(t, changes)
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		changes, err := diff.Compare(a, b, nil)
+		require.NoError(t, err)
+
+		var sb strings.Builder
+		require.NoError(t, diff.WriteText(&sb, changes))
+
+		require.Contains(t, sb.String(), "+ added\n")
+		require.Contains(t, sb.String(), "- removed\n")
+		require.Contains(t, sb.String(), "M etc/passwd (mode, owner)\n")
+	})
+}
+
+func TestCompareDir(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	image := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o755, ModTime: modTime}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/app", Mode: 0o755, ModTime: modTime}, Content: "v2\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/tool", Mode: 0o755, ModTime: modTime}, Content: "tool\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/new", Mode: 0o755, ModTime: modTime}},
+	})
+
+	// The live tree, as the image would be installed over.
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "bin"), 0o755))
+	for name, content := range map[string]string{"bin/app": "v1\n", "bin/tool": "tool\n", "bin/old": ""} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755))
+	}
+	for _, name := range []string{".", "bin", "bin/app", "bin/tool", "bin/old"} {
+		require.NoError(t, os.Chmod(filepath.Join(dir, name), 0o755))
+	}
+
+	usr, err := diff.Sub(image, "/usr")
+	require.NoError(t, err)
+
+	// Windows does not keep Unix permissions.
+	changes, err := diff.Compare(dirfs.New(dir), usr, &diff.Options{
+		IgnoreModTime: true,
+		IgnoreOwner:   true,
+		IgnoreMode:    runtime.GOOS == "windows",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []diff.Change{
+		{Path: "bin/app", Kind: diff.Modified, Details: []string{"content"}},
+		{Path: "bin/new", Kind: diff.Added},
+		{Path: "bin/old", Kind: diff.Removed},
+	}, changes)
+
+	t.Run("Not A Directory", func(t *testing.T) {
+		_, err := diff.Sub(image, "usr/bin/app")
+		require.ErrorContains(t, err, "not a directory")
+
+		_, err = diff.Sub(image, "missing")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
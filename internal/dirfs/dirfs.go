@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dirfs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
+)
+
+// FS is a read-only file system backed by a directory on the host. Unlike
+// os.DirFS it also reports symbolic links.
+type FS struct {
+	dir  string
+	fsys fs.FS
+}
+
+// New returns a file system for the tree of files rooted at dir.
+func New(dir string) *FS {
+	return &FS{dir: dir, fsys: os.DirFS(dir)}
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	return fsys.fsys.Open(name)
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(fsys.fsys, name)
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(fsys.fsys, name)
+}
+
+// ReadLink returns the destination of the named symbolic link.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	path, err := fsys.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Images always use forward slashes, whatever the host separator.
+	return filepath.ToSlash(target), nil
+}
+
+// StatLink returns a FileInfo describing the file without following any
+// symbolic links.
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	path, err := fsys.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Lstat(path)
+}
+
+// HardLinkID returns a value identifying the named regular file that is
+// shared by all of its hard links, or nil if it has no other links.
+func (fsys *FS) HardLinkID(name string) (any, error) {
+	fi, err := fsys.StatLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	id, ok := util.StatFileID(fi)
+	if !ok {
+		return nil, nil
+	}
+
+	return id, nil
+}
+
+func (fsys *FS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return filepath.Join(fsys.dir, filepath.FromSlash(name)), nil
+}
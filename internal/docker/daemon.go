@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// DefaultHost is the address of the Docker daemon if DOCKER_HOST is not set.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Save streams an archive of the named image (as produced by "docker save")
+// from the Docker daemon at host (defaults to DOCKER_HOST, or DefaultHost).
+// The host is either a unix socket ("unix:///path") or a plain HTTP address
+// ("tcp://host:port").
+func Save(ctx context.Context, host, name string) (io.ReadCloser, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultHost
+	}
+
+	client, baseURL, err := daemonClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	u := baseURL + "/images/get?" + url.Values{"names": []string{name}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Docker daemon at %s: %w", host, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		// Errors are reported as {"message": "..."}.
+		var daemonErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&daemonErr)
+		if daemonErr.Message == "" {
+			daemonErr.Message = resp.Status
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: failed to save image %s: %s: %w", util.ErrRefNotFound, name, daemonErr.Message, fs.ErrNotExist)
+		}
+
+		return nil, fmt.Errorf("failed to save image %s: %s", name, daemonErr.Message)
+	}
+
+	return resp.Body, nil
+}
+
+// daemonClient returns an HTTP client for the Docker daemon at host, and the
+// base URL of its API.
+func daemonClient(host string) (*http.Client, string, error) {
+	scheme, addr, ok := strings.Cut(host, "://")
+	if !ok {
+		return nil, "", fmt.Errorf("invalid Docker host %q", host)
+	}
+
+	switch scheme {
+	case "unix":
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}
+
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp", "http":
+		return http.DefaultClient, "http://" + addr, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported Docker host %q", host)
+	}
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package docker_test
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSave(t *testing.T) {
+	expected, err := os.ReadFile("testdata/toybox.tar")
+	require.NoError(t, err)
+
+	host := startTestDaemon(t, map[string][]byte{"tianon/toybox:0.8.11": expected})
+
+	archive, err := docker.Save(context.Background(), host, "tianon/toybox:0.8.11")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, archive.Close())
+	})
+
+	actual, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, err := docker.Save(context.Background(), host, "tianon/toybox:missing")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.ErrorContains(t, err, "No such image")
+	})
+
+	t.Run("Invalid Host", func(t *testing.T) {
+		_, err := docker.Save(context.Background(), "ssh://example.com", "tianon/toybox:0.8.11")
+		require.Error(t, err)
+	})
+}
+
+// startTestDaemon serves the images API of a Docker daemon on a unix socket,
+// returning its address.
+func startTestDaemon(t *testing.T, images map[string][]byte) string {
+	socketPath := filepath.Join(t.TempDir(), "docker.sock")
+
+	lis, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("names")
+
+		archive, ok := images[name]
+		if r.URL.Path != "/images/get" || !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"No such image: ` + name + `"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		_, _ = w.Write(archive)
+	}))
+	server.Listener = lis
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return "unix://" + socketPath
+}
@@ -19,69 +19,129 @@
 package docker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
-	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
-	"github.com/dpeckett/archivefs/tarfs"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/provenance"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// ErrManifestTooLarge is returned when the image manifest or config exceeds
+// the maximum allowed size.
+var ErrManifestTooLarge = util.ErrManifestTooLarge
+
+// Options configures how a Docker image is loaded.
+type Options struct {
+	// Layer configures how the image layers are loaded.
+	Layer layer.Options
+	// MaxManifestSize is the maximum size in bytes of the image manifest and
+	// config documents (defaults to util.DefaultMaxManifestSize).
+	MaxManifestSize int64
+	// EmbedProvenance stores a manifest recording which layer each file
+	// came from inside the root filesystem (see provenance.Path).
+	EmbedProvenance bool
+	// LayerRange, if set, selects the range of the image's layers to load.
+	LayerRange *layer.Range
+	// SkipLayers are the diff IDs of layers that are not loaded.
+	SkipLayers []digest.Digest
+	// OnResolve, if set, is called with the digest of the image config (the
+	// image ID) that the ref resolved to.
+	OnResolve func(digest.Digest)
+	// OnConfig, if set, is called with the image config document, as stored
+	// in the archive.
+	OnConfig func([]byte)
+	// OnProvenance, if set, is called with a manifest recording which layer
+	// each file in the root filesystem came from.
+	OnProvenance func(*provenance.Manifest)
+}
+
 // LoadImage loads a Docker image from the given imageFS, ref, and platform.
 // It returns an overlayfs.FS of the image's root filesystem, a function to
-// close the image, and an error if any.
-func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform) (fs.FS, func() error, error) {
-	config, err := configForRef(imageFS, ref, platform)
+// close the image, and an error if any. Loading is aborted if the context is
+// cancelled.
+func LoadImage(ctx context.Context, tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform, opts *Options) (fs.FS, func() error, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	manifest, config, configData, err := configForRef(imageFS, ref, platform, opts)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get image config: %w", err)
 	}
 
-	var layers []fs.FS
-	var closers []func() error
+	if opts.OnResolve != nil {
+		opts.OnResolve(digest.FromBytes(configData))
+	}
 
-	for _, layerDescriptor := range config.RootFS.DiffIDs {
-		layerDigest := strings.TrimPrefix(layerDescriptor, "sha256:")
+	if opts.OnConfig != nil {
+		opts.OnConfig(configData)
+	}
 
-		potentialLayerPaths := []string{
-			layerDigest + ".tar",
-			filepath.Join("blobs/sha256", layerDigest),
-			filepath.Join(layerDigest, "layer.tar"),
-		}
+	// The manifest lists the layer paths in the same order as the diff IDs.
+	// Older archives may omit them, in which case we fall back to looking
+	// for the layers by diff ID.
+	if len(manifest.Layers) != 0 && len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil, nil, fmt.Errorf("manifest lists %d layers but config has %d diff IDs",
+			len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	selected, err := selectLayers(config.RootFS.DiffIDs, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var descriptors []layer.Descriptor
+	var layerDescriptors []ocispecs.Descriptor
+	for _, i := range selected {
+		diffID := config.RootFS.DiffIDs[i]
+		layerDigest := strings.TrimPrefix(diffID, "sha256:")
 
 		var actualLayerPath string
-		for _, layerPath := range potentialLayerPaths {
-			if f, err := imageFS.Open(layerPath); err == nil {
-				_ = f.Close()
-				actualLayerPath = layerPath
-				break
+		if len(manifest.Layers) != 0 {
+			actualLayerPath = path.Clean(manifest.Layers[i])
+		} else {
+			potentialLayerPaths := []string{
+				layerDigest + ".tar",
+				filepath.Join("blobs/sha256", layerDigest),
+				filepath.Join(layerDigest, "layer.tar"),
 			}
-		}
-		if actualLayerPath == "" {
-			return nil, nil, fmt.Errorf("layer %s not found", layerDigest)
-		}
 
-		layer, close, err := loadLayer(tempDir, imageFS, actualLayerPath)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load layer %s: %w", layerDigest, err)
+			for _, layerPath := range potentialLayerPaths {
+				if f, err := imageFS.Open(layerPath); err == nil {
+					_ = f.Close()
+					actualLayerPath = layerPath
+					break
+				}
+			}
+			if actualLayerPath == "" {
+				return nil, nil, fmt.Errorf("layer %s not found", layerDigest)
+			}
 		}
 
-		layers = append(layers, layer)
-		closers = append(closers, close)
+		descriptors = append(descriptors, layer.Descriptor{
+			Path:   actualLayerPath,
+			DiffID: digest.Digest(diffID),
+		})
+		layerDescriptors = append(layerDescriptors, ocispecs.Descriptor{
+			MediaType: MediaTypeLayer,
+			Digest:    digest.Digest(diffID),
+		})
 	}
 
-	closeAll := func() error {
-		for _, close := range closers {
-			if err := close(); err != nil {
-				return err
-			}
-		}
-		return nil
+	layers, closeAll, err := layer.LoadAll(ctx, tempDir, imageFS, descriptors, &opts.Layer)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	rootFS, err := overlayfs.New(layers)
@@ -90,36 +150,104 @@ func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Pla
 		return nil, nil, fmt.Errorf("failed to create overlayfs: %w", err)
 	}
 
+	if opts.EmbedProvenance || opts.OnProvenance != nil {
+		history := make([]ocispecs.History, len(config.History))
+		for i, h := range config.History {
+			history[i] = ocispecs.History{
+				CreatedBy:  h.CreatedBy,
+				Author:     h.Author,
+				Comment:    h.Comment,
+				EmptyLayer: h.EmptyLayer,
+			}
+			if !h.Created.IsZero() {
+				created := h.Created
+				history[i].Created = &created
+			}
+		}
+
+		var layerHistory []ocispecs.History
+		if history := provenance.LayerHistory(history, len(config.RootFS.DiffIDs)); history != nil {
+			for _, i := range selected {
+				layerHistory = append(layerHistory, history[i])
+			}
+		}
+
+		m, err := provenance.Collect(rootFS, layerDescriptors, layerHistory)
+		if err != nil {
+			_ = closeAll()
+			return nil, nil, fmt.Errorf("failed to collect provenance: %w", err)
+		}
+
+		if opts.OnProvenance != nil {
+			opts.OnProvenance(m)
+		}
+
+		if opts.EmbedProvenance {
+			rootFS, err = provenance.Embed(rootFS, m)
+			if err != nil {
+				_ = closeAll()
+				return nil, nil, fmt.Errorf("failed to embed provenance: %w", err)
+			}
+		}
+	}
+
 	return rootFS, closeAll, nil
 }
 
-func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*Config, error) {
+// selectLayers returns the indices of the layers, identified by their diff
+// IDs, that are selected by the layer range and the layers to skip.
+func selectLayers(diffIDs []string, opts *Options) ([]int, error) {
+	if opts.LayerRange == nil && len(opts.SkipLayers) == 0 {
+		selected := make([]int, len(diffIDs))
+		for i := range diffIDs {
+			selected[i] = i
+		}
+
+		return selected, nil
+	}
+
+	digests := make([]digest.Digest, len(diffIDs))
+	for i, diffID := range diffIDs {
+		digests[i] = digest.Digest(diffID)
+	}
+
+	return layer.Select(digests, opts.LayerRange, opts.SkipLayers)
+}
+
+func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform, opts *Options) (*Manifest, *Config, []byte, error) {
 	manifestFile, err := imageFS.Open("manifest.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open manifest: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to open manifest: %w", err)
 	}
 	defer manifestFile.Close()
 
 	var manifests []Manifest
-	if err := json.NewDecoder(manifestFile).Decode(&manifests); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	if err := json.NewDecoder(util.ManifestReader(manifestFile, opts.MaxManifestSize)).Decode(&manifests); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
 	}
 
 	if len(manifests) == 0 {
-		return nil, fmt.Errorf("no manifests found")
+		return nil, nil, nil, fmt.Errorf("no manifests found")
 	}
 
 	var manifest *Manifest
 	if ref == "" {
 		if len(manifests) > 1 {
-			return nil, fmt.Errorf("multiple manifests found, ref must be specified")
+			return nil, nil, nil, fmt.Errorf("%w: multiple manifests found, ref must be specified", util.ErrAmbiguousRef)
 		}
 
 		manifest = &manifests[0]
+	} else if i, ok := util.RefIndex(ref); ok {
+		if i >= len(manifests) {
+			return nil, nil, nil, fmt.Errorf("%w: no manifest at position %d, the archive has %d", util.ErrRefNotFound, i, len(manifests))
+		}
+
+		manifest = &manifests[i]
 	} else {
 		for _, m := range manifests {
 			for _, tag := range m.RepoTags {
-				if tag == ref {
+				if util.MatchesRef(tag, ref) {
+					m := m
 					manifest = &m
 					break
 				}
@@ -127,54 +255,42 @@ func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*Conf
 		}
 	}
 	if manifest == nil {
-		return nil, fmt.Errorf("no manifest found for ref %s", ref)
+		return nil, nil, nil, fmt.Errorf("%w: no manifest found for ref %s", util.ErrRefNotFound, ref)
 	}
 
 	configFile, err := imageFS.Open(manifest.Config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open image config: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to open image config: %w", err)
 	}
 	defer configFile.Close()
 
-	var config Config
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
-	}
-
-	if platform != nil && (config.Architecture != platform.Architecture || config.OS != platform.OS) {
-		return nil, fmt.Errorf("no manifest found for platform %s/%s", platform.Architecture, platform.OS)
-	}
-
-	return &config, nil
-}
-
-func loadLayer(tempDir string, imageFS fs.FS, layerPath string) (fs.FS, func() error, error) {
-	f, err := imageFS.Open(layerPath)
+	configData, err := io.ReadAll(util.ManifestReader(configFile, opts.MaxManifestSize))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to read image config: %w", err)
 	}
-	defer f.Close()
 
-	dr, err := uncompr.NewReader(f)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create decompressing reader: %w", err)
+	var config Config
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal image config: %w", err)
 	}
-	defer dr.Close()
 
-	decompressedLayerPath := filepath.Join(tempDir, filepath.Base(layerPath)+".tar")
-	decompressedLayerFile, err := os.OpenFile(decompressedLayerPath, os.O_CREATE|os.O_RDWR, 0o644)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temporary tar file: %w", err)
+	if platform != nil && (config.Architecture != platform.Architecture || config.OS != platform.OS) {
+		return nil, nil, nil, fmt.Errorf("%w: no manifest found for platform %s/%s", util.ErrPlatformNotFound, platform.Architecture, platform.OS)
 	}
 
-	if _, err := io.Copy(decompressedLayerFile, dr); err != nil {
-		return nil, nil, fmt.Errorf("failed to decompress layer: %w", err)
+	if platform != nil && platform.OSVersion != "" && config.OSVersion != platform.OSVersion {
+		return nil, nil, nil, fmt.Errorf("%w: no manifest found for platform %s/%s (os.version %s), image has os.version %q", util.ErrPlatformNotFound,
+			platform.OS, platform.Architecture, platform.OSVersion, config.OSVersion)
 	}
 
-	fsys, err := tarfs.Open(decompressedLayerFile)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open decompressed layer: %w", err)
+	if platform != nil {
+		for _, feature := range platform.OSFeatures {
+			if !slices.Contains(config.OSFeatures, feature) {
+				return nil, nil, nil, fmt.Errorf("%w: no manifest found for platform %s/%s (os.features %s), image has os.features %q", util.ErrPlatformNotFound,
+					platform.OS, platform.Architecture, strings.Join(platform.OSFeatures, ","), config.OSFeatures)
+			}
+		}
 	}
 
-	return fsys, decompressedLayerFile.Close, nil
+	return manifest, &config, configData, nil
 }
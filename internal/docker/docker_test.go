@@ -19,12 +19,20 @@
 package docker_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/fs"
 	"os"
 	"testing"
 
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/testutil"
 	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,7 +48,7 @@ func TestLoadImage(t *testing.T) {
 	imageFS, err := tarfs.Open(imageFile)
 	require.NoError(t, err)
 
-	rootFS, closeAll, err := docker.LoadImage(t.TempDir(), imageFS, ref, nil)
+	rootFS, closeAll, err := docker.LoadImage(context.Background(), t.TempDir(), imageFS, ref, nil, nil)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		require.NoError(t, closeAll())
@@ -50,4 +58,87 @@ func TestLoadImage(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+
+	t.Run("Manifest Too Large", func(t *testing.T) {
+		_, _, err := docker.LoadImage(context.Background(), t.TempDir(), imageFS, ref, nil, &docker.Options{
+			MaxManifestSize: 64,
+		})
+		require.ErrorIs(t, err, docker.ErrManifestTooLarge)
+	})
+}
+
+func TestLoadImageLegacyArchive(t *testing.T) {
+	lowerLayer := testutil.CreateTar(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "lower\n"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644}, Content: "hello world\n"},
+	})
+
+	upperLayer := testutil.CreateTar(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "upper\n"},
+	})
+
+	// Some tools compress the layers of the archive.
+	var compressedUpperLayer bytes.Buffer
+	gw := gzip.NewWriter(&compressedUpperLayer)
+	_, err := gw.Write(upperLayer)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	config, err := json.Marshal(docker.Config{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: docker.RootFS{
+			Type: "layers",
+			DiffIDs: []string{
+				digest.FromBytes(lowerLayer).String(),
+				digest.FromBytes(upperLayer).String(),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// Layers are stored under their legacy v1 IDs (rather than diff IDs),
+	// and the repository tag is in its familiar form.
+	manifest, err := json.Marshal([]docker.Manifest{{
+		Config:   "config.json",
+		RepoTags: []string{"example/app:v1"},
+		Layers:   []string{"1111/layer.tar", "2222/layer.tar"},
+	}})
+	require.NoError(t, err)
+
+	imageFS := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "manifest.json", Mode: 0o644}, Content: string(manifest)},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "config.json", Mode: 0o644}, Content: string(config)},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "1111/layer.tar", Mode: 0o644}, Content: string(lowerLayer)},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "2222/layer.tar", Mode: 0o644}, Content: compressedUpperLayer.String()},
+	})
+
+	rootFS, closeAll, err := docker.LoadImage(context.Background(), t.TempDir(), imageFS, "docker.io/example/app:v1", nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeAll())
+	})
+
+	content, err := fs.ReadFile(rootFS, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "upper\n", string(content))
+
+	content, err = fs.ReadFile(rootFS, "etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", string(content))
+
+	t.Run("Diff ID Mismatch", func(t *testing.T) {
+		// The layers no longer match the diff IDs recorded in the config.
+		tamperedFS := testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "manifest.json", Mode: 0o644}, Content: string(manifest)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "config.json", Mode: 0o644}, Content: string(config)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "1111/layer.tar", Mode: 0o644}, Content: string(upperLayer)},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "2222/layer.tar", Mode: 0o644}, Content: string(lowerLayer)},
+		})
+
+		_, _, err := docker.LoadImage(context.Background(), t.TempDir(), tamperedFS, "docker.io/example/app:v1", nil, nil)
+		require.ErrorIs(t, err, util.ErrDigestMismatch)
+	})
 }
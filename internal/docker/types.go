@@ -20,6 +20,9 @@ package docker
 
 import "time"
 
+// MediaTypeLayer is the media type of an uncompressed Docker image layer.
+const MediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
 // Manifest represents the Docker image manifest, typically found in manifest.json.
 type Manifest struct {
 	SchemaVersion int      `json:"schemaVersion"`
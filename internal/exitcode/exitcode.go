@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package exitcode maps errors to the exit codes of the command line
+// interface, so scripts can tell classes of failure apart.
+package exitcode
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/immutos/oci2erofs/internal/synthetic"
+	"github.com/immutos/oci2erofs/internal/upperdir"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+)
+
+// Code is a process exit code.
+type Code int
+
+// The exit codes for each class of failure. Failures that don't fall into any
+// other class exit with Failure.
+const (
+	OK                 Code = 0
+	Failure            Code = 1
+	InputNotFound      Code = 3
+	RefNotFound        Code = 4
+	PlatformNotFound   Code = 5
+	Unsupported        Code = 6
+	VerificationFailed Code = 7
+)
+
+// String returns the name of the class of failure, eg. "ref-not-found".
+func (c Code) String() string {
+	switch c {
+	case OK:
+		return "ok"
+	case InputNotFound:
+		return "input-not-found"
+	case RefNotFound:
+		return "ref-not-found"
+	case PlatformNotFound:
+		return "platform-not-found"
+	case Unsupported:
+		return "unsupported"
+	case VerificationFailed:
+		return "verification-failed"
+	default:
+		return "failure"
+	}
+}
+
+// For returns the exit code for an error.
+func For(err error) Code {
+	switch {
+	case err == nil:
+		return OK
+	case errors.Is(err, oci2erofs.ErrVerificationFailed),
+		errors.Is(err, oci2erofs.ErrInvalidSignature),
+		errors.Is(err, oci2erofs.ErrBlobDigestMismatch):
+		return VerificationFailed
+	case errors.Is(err, oci2erofs.ErrPlatformNotFound):
+		return PlatformNotFound
+	case errors.Is(err, oci2erofs.ErrRefNotFound):
+		return RefNotFound
+	case errors.Is(err, oci2erofs.ErrUnsupportedLayout),
+		errors.Is(err, oci2erofs.ErrUnsupportedMediaType),
+		errors.Is(err, oci2erofs.ErrArtifact),
+		errors.Is(err, upperdir.ErrUnsupported),
+		errors.Is(err, oci2erofs.ErrUnsupportedFile),
+		errors.Is(err, oci2erofs.ErrImageTooLarge),
+		errors.Is(err, synthetic.ErrUnsupportedType),
+		errors.Is(err, errors.ErrUnsupported):
+		return Unsupported
+	// Checked last, as missing refs can also wrap fs.ErrNotExist.
+	case errors.Is(err, fs.ErrNotExist):
+		return InputNotFound
+	default:
+		return Failure
+	}
+}
+
+// Error describes a failure, for JSON error output.
+type Error struct {
+	// Message is the error message.
+	Message string `json:"message"`
+	// Class is the name of the class of failure (see Code.String).
+	Class string `json:"class"`
+	// ExitCode is the exit code of the process.
+	ExitCode Code `json:"exitCode"`
+}
+
+// NewError describes err.
+func NewError(err error) *Error {
+	code := For(err)
+
+	return &Error{
+		Message:  err.Error(),
+		Class:    code.String(),
+		ExitCode: code,
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package exitcode_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/exitcode"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFor(t *testing.T) {
+	t.Run("Classes", func(t *testing.T) {
+		tests := []struct {
+			err  error
+			code exitcode.Code
+		}{
+			{nil, exitcode.OK},
+			{errors.New("boom"), exitcode.Failure},
+			{fmt.Errorf("failed to open image: %w", fs.ErrNotExist), exitcode.InputNotFound},
+			{fmt.Errorf("failed to load OCI image: %w", oci2erofs.ErrRefNotFound), exitcode.RefNotFound},
+			{fmt.Errorf("%w: linux/s390x", oci2erofs.ErrPlatformNotFound), exitcode.PlatformNotFound},
+			{fmt.Errorf("%w: application/x-foo", oci2erofs.ErrUnsupportedMediaType), exitcode.Unsupported},
+			{fmt.Errorf("%w: \"dev/null\" is a device node or FIFO", oci2erofs.ErrUnsupportedFile), exitcode.Unsupported},
+			{fmt.Errorf("failed to plan EROFS filesystem: %w", oci2erofs.ErrImageTooLarge), exitcode.Unsupported},
+			{fmt.Errorf("%w: 3 files differ", oci2erofs.ErrVerificationFailed), exitcode.VerificationFailed},
+			{oci2erofs.ErrInvalidSignature, exitcode.VerificationFailed},
+		}
+
+		for _, tt := range tests {
+			require.Equal(t, tt.code, exitcode.For(tt.err), "%v", tt.err)
+		}
+	})
+
+	t.Run("Ref Not Found Before Input Not Found", func(t *testing.T) {
+		err := fmt.Errorf("%w: app is not in namespace default: %w", oci2erofs.ErrRefNotFound, fs.ErrNotExist)
+		require.Equal(t, exitcode.RefNotFound, exitcode.For(err))
+	})
+}
+
+func TestNewError(t *testing.T) {
+	failure := fmt.Errorf("failed to load OCI image: %w", oci2erofs.ErrRefNotFound)
+
+	data, err := json.Marshal(exitcode.NewError(failure))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"message":"failed to load OCI image: image not found","class":"ref-not-found","exitCode":4}`, string(data))
+}
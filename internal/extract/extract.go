@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extract
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// Options configures extraction.
+type Options struct {
+	// NoSameOwner extracts files as the current user rather than with the
+	// ownership recorded in the image.
+	NoSameOwner bool
+}
+
+// Extract unpacks the EROFS image into the given directory. Extraction is
+// aborted if the context is cancelled.
+func Extract(ctx context.Context, src io.ReaderAt, dir string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	fsys, err := erofs.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Directory metadata is applied once all of their children have been
+	// written (so that read-only directories can still be populated).
+	var dirs []string
+	var dirInfos []fs.FileInfo
+	// The directories created (or found) on disk, into which entries can be
+	// written without following a symbolic link.
+	created := make(map[string]bool)
+
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// A crafted image may name entries "..", or include slashes in
+		// their names, to place them outside of the directory.
+		if path != "." && !isSafeName(d.Name()) {
+			return fmt.Errorf("%w: %q", util.ErrUnsafePath, path)
+		}
+
+		fi, err := fsys.StatLink(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+
+		// Entries whose names are repeated in a directory may be listed as
+		// directories, but resolve to symbolic links, which would then be
+		// descended through.
+		if d.IsDir() != fi.IsDir() {
+			return fmt.Errorf("%w: %q does not match its directory entry", util.ErrUnsafePath, path)
+		}
+
+		dst := filepath.Join(dir, path)
+		if path != "." && !created[filepath.Dir(dst)] {
+			return fmt.Errorf("%w: the parent directory of %q was not extracted", util.ErrUnsafePath, path)
+		}
+
+		if !fi.IsDir() {
+			delete(created, dst)
+		}
+
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			// The directory itself was created above, and may be a symbolic
+			// link given by the caller.
+			if path != "." {
+				if err := mkdir(dst); err != nil {
+					return fmt.Errorf("failed to create directory %q: %w", path, err)
+				}
+			}
+			created[dst] = true
+
+			dirs = append(dirs, dst)
+			dirInfos = append(dirInfos, fi)
+
+			return nil
+		case fs.ModeSymlink:
+			target, err := fsys.ReadLink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read link %q: %w", path, err)
+			}
+
+			_ = os.Remove(dst)
+			if err := os.Symlink(filepath.FromSlash(target), dst); err != nil {
+				return fmt.Errorf("failed to create symlink %q: %w", path, err)
+			}
+		case 0:
+			if err := extractFile(ctx, fsys, path, dst); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type %q: %s", path, fi.Mode().Type())
+		}
+
+		return applyMetadata(dst, fi, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract image: %w", err)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// A later entry of the same name may have replaced the directory
+		// with a symbolic link, which chmod would follow.
+		if !created[dirs[i]] {
+			return fmt.Errorf("failed to extract image: %w: %q was replaced", util.ErrUnsafePath, dirs[i])
+		}
+
+		if err := applyMetadata(dirs[i], dirInfos[i], opts); err != nil {
+			return fmt.Errorf("failed to extract image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// isSafeName reports whether a directory entry name refers to a file within
+// its directory.
+func isSafeName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, "/"+string(filepath.Separator))
+}
+
+// mkdir creates the directory dst, unless it already exists. Anything else
+// in its place is replaced, so that the files beneath it are never written
+// through a symbolic link (eg. one left by an earlier entry of the same name,
+// or already in the directory being extracted into).
+func mkdir(dst string) error {
+	err := os.Mkdir(dst, 0o700)
+	if !os.IsExist(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return nil
+	}
+
+	if err := os.Remove(dst); err != nil {
+		return err
+	}
+
+	return os.Mkdir(dst, 0o700)
+}
+
+func extractFile(ctx context.Context, fsys fs.FS, path, dst string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+
+	_ = os.Remove(dst)
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create file %q: %w", path, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, util.ContextReader(ctx, f)); err != nil {
+		return fmt.Errorf("failed to write file %q: %w", path, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write file %q: %w", path, err)
+	}
+
+	return nil
+}
+
+func applyMetadata(dst string, fi fs.FileInfo, opts *Options) error {
+	// Windows has no numeric owners to apply.
+	if !opts.NoSameOwner && runtime.GOOS != "windows" {
+		if ino, ok := fi.Sys().(*erofs.Inode); ok {
+			if err := os.Lchown(dst, int(ino.UID()), int(ino.GID())); err != nil {
+				return fmt.Errorf("failed to change ownership of %q: %w", dst, err)
+			}
+		}
+	}
+
+	// Symlinks have no meaningful permissions or (portable) timestamps.
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := os.Chmod(dst, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return fmt.Errorf("failed to change mode of %q: %w", dst, err)
+	}
+
+	if err := os.Chtimes(dst, time.Time{}, fi.ModTime()); err != nil {
+		return fmt.Errorf("failed to change times of %q: %w", dst, err)
+	}
+
+	return nil
+}
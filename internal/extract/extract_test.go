@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extract_test
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/extract"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	image := testutil.BuildImage(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 100}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/sh", Mode: 0o755}, Content: "#!/bin/true\n"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o555}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777}},
+	}, modTime)
+
+	t.Run("No Same Owner", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Cleanup(func() {
+			// So that the temporary directory can be removed.
+			_ = os.Chmod(filepath.Join(dir, "usr/bin"), 0o755)
+		})
+
+		err := extract.Extract(context.Background(), image, dir, &extract.Options{NoSameOwner: true})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(content))
+
+		fi, err := os.Stat(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
+		require.True(t, fi.ModTime().Equal(modTime))
+
+		// Read-only directories are still populated.
+		fi, err = os.Stat(filepath.Join(dir, "usr/bin"))
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o555), fi.Mode().Perm())
+
+		content, err = os.ReadFile(filepath.Join(dir, "usr/bin/sh"))
+		require.NoError(t, err)
+		require.Equal(t, "#!/bin/true\n", string(content))
+
+		target, err := os.Readlink(filepath.Join(dir, "bin"))
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", target)
+	})
+
+	t.Run("Same Owner", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("requires root")
+		}
+
+		dir := t.TempDir()
+
+		err := extract.Extract(context.Background(), image, dir, nil)
+		require.NoError(t, err)
+
+		fi, err := os.Stat(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+
+		uid, gid, ok := util.StatOwner(fi)
+		require.True(t, ok)
+		require.Equal(t, uint32(1000), uid)
+		require.Equal(t, uint32(100), gid)
+	})
+
+	t.Run("Existing Symlink", func(t *testing.T) {
+		dir, outside := t.TempDir(), t.TempDir()
+		t.Cleanup(func() {
+			_ = os.Chmod(filepath.Join(dir, "usr/bin"), 0o755)
+		})
+		require.NoError(t, os.Symlink(outside, filepath.Join(dir, "etc")))
+
+		err := extract.Extract(context.Background(), image, dir, &extract.Options{NoSameOwner: true})
+		require.NoError(t, err)
+
+		fi, err := os.Lstat(filepath.Join(dir, "etc"))
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+
+		entries, err := os.ReadDir(outside)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Duplicate Names", func(t *testing.T) {
+		outside := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(outside, "passwd"), []byte("root\n"), 0o644))
+
+		// A symbolic link x pointing outside, followed by a directory entry
+		// of the same name. Within the image, the link resolves to a copy of
+		// the outside directory.
+		inside := strings.TrimPrefix(filepath.ToSlash(outside), "/")
+		image := testutil.BuildImageFS(t, &craftedFS{
+			MapFS: fstest.MapFS{
+				inside + "/passwd": {Mode: 0o644, Data: []byte("evil\n")},
+				"x":                {Mode: fs.ModeDir | 0o755},
+			},
+			extra: []fs.DirEntry{fs.FileInfoToDirEntry(&symlinkInfo{name: "x"})},
+			links: map[string]string{"x": outside},
+		})
+
+		err := extract.Extract(context.Background(), image, t.TempDir(), &extract.Options{NoSameOwner: true})
+		require.ErrorIs(t, err, util.ErrUnsafePath)
+
+		passwd, err := os.ReadFile(filepath.Join(outside, "passwd"))
+		require.NoError(t, err)
+		require.Equal(t, "root\n", string(passwd))
+	})
+
+	t.Run("Symlink Directory", func(t *testing.T) {
+		target := t.TempDir()
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		require.NoError(t, os.Symlink(target, dir))
+		t.Cleanup(func() {
+			_ = os.Chmod(filepath.Join(target, "usr/bin"), 0o755)
+		})
+
+		err := extract.Extract(context.Background(), image, dir, &extract.Options{NoSameOwner: true})
+		require.NoError(t, err)
+
+		_, err = os.Stat(filepath.Join(target, "etc/hostname"))
+		require.NoError(t, err)
+	})
+
+	t.Run("Unsafe Names", func(t *testing.T) {
+		for _, name := range []string{"a/b", "../b"} {
+			image := testutil.BuildImageFS(t, &craftedFS{
+				MapFS: fstest.MapFS{
+					"etc/hostname": {Mode: 0o644, Data: []byte("localhost\n")},
+				},
+				extra: []fs.DirEntry{fs.FileInfoToDirEntry(&symlinkInfo{name: name})},
+				links: map[string]string{name: "/etc"},
+			})
+
+			err := extract.Extract(context.Background(), image, t.TempDir(), &extract.Options{NoSameOwner: true})
+			require.ErrorIs(t, err, util.ErrUnsafePath, name)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := extract.Extract(ctx, image, t.TempDir(), &extract.Options{NoSameOwner: true})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// craftedFS lists extra entries, which are symbolic links, at the root ahead
+// of those of the underlying file system, even if their names are unsafe or
+// already taken.
+type craftedFS struct {
+	fstest.MapFS
+	extra []fs.DirEntry
+	links map[string]string
+}
+
+func (fsys *craftedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.MapFS.ReadDir(name)
+	if name == "." {
+		entries = append(slices.Clone(fsys.extra), entries...)
+	}
+	return entries, err
+}
+
+func (fsys *craftedFS) ReadLink(name string) (string, error) {
+	if target, ok := fsys.links[name]; ok {
+		return target, nil
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (fsys *craftedFS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.Stat(name)
+}
+
+type symlinkInfo struct {
+	name string
+}
+
+func (fi *symlinkInfo) Name() string       { return fi.name }
+func (fi *symlinkInfo) Size() int64        { return 0 }
+func (fi *symlinkInfo) Mode() fs.FileMode  { return fs.ModeSymlink | 0o777 }
+func (fi *symlinkInfo) ModTime() time.Time { return time.Time{} }
+func (fi *symlinkInfo) IsDir() bool        { return false }
+func (fi *symlinkInfo) Sys() any           { return nil }
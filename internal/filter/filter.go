@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package filter hides paths of a file system according to glob patterns.
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
+)
+
+// Options configures which paths are hidden.
+//
+// Patterns use path.Match syntax. A pattern containing a slash is matched
+// against the whole path relative to the root (a leading slash is optional),
+// otherwise it is matched against the base name of every path. A pattern
+// that matches a directory applies to everything beneath it.
+type Options struct {
+	// Exclude are the patterns of paths to hide.
+	Exclude []string
+	// Include are the patterns of paths to keep even if they are excluded.
+	// The directories leading to an included path are kept too.
+	Include []string
+}
+
+// FS is a file system that hides excluded paths.
+type FS struct {
+	fsys    archivefs.ReadLinkFS
+	exclude []string
+	include []string
+}
+
+// New returns a file system that hides the paths of fsys excluded by opts.
+func New(fsys archivefs.ReadLinkFS, opts *Options) (*FS, error) {
+	exclude, err := cleanPatterns(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	include, err := cleanPatterns(opts.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FS{fsys: fsys, exclude: exclude, include: include}, nil
+}
+
+// LoadPatterns reads patterns from a file, one per line. Blank lines and
+// lines starting with '#' are ignored.
+func LoadPatterns(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	if err := f.check("open", name); err != nil {
+		return nil, err
+	}
+
+	return f.fsys.Open(name)
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.check("readdir", name); err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if !f.Excluded(path.Join(name, entry.Name()), entry.IsDir()) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	if err := f.check("stat", name); err != nil {
+		return nil, err
+	}
+
+	return fs.Stat(f.fsys, name)
+}
+
+func (f *FS) ReadLink(name string) (string, error) {
+	if err := f.check("readlink", name); err != nil {
+		return "", err
+	}
+
+	return f.fsys.ReadLink(name)
+}
+
+func (f *FS) StatLink(name string) (fs.FileInfo, error) {
+	if err := f.check("lstat", name); err != nil {
+		return nil, err
+	}
+
+	return f.fsys.StatLink(name)
+}
+
+func (f *FS) HardLinkID(name string) (any, error) {
+	if err := f.check("hardlinkid", name); err != nil {
+		return nil, err
+	}
+
+	return util.HardLinkID(f.fsys, name)
+}
+
+// Excluded reports whether the path is hidden.
+func (f *FS) Excluded(name string, isDir bool) bool {
+	if name == "." || !matchesAny(f.exclude, name) || matchesAny(f.include, name) {
+		return false
+	}
+
+	return !isDir || !f.includesBeneath(name)
+}
+
+// check returns fs.ErrNotExist if name, or any of its parents, is hidden.
+func (f *FS) check(op, name string) error {
+	for p := name; p != "."; p = path.Dir(p) {
+		fi, err := f.fsys.StatLink(p)
+		if err != nil {
+			// Leave it to the underlying file system to report the error.
+			return nil
+		}
+
+		if f.Excluded(p, fi.IsDir()) {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+
+	return nil
+}
+
+// includesBeneath reports whether an include pattern may match a path
+// beneath the directory.
+func (f *FS) includesBeneath(dir string) bool {
+	dirParts := strings.Split(dir, "/")
+
+	for _, pattern := range f.include {
+		if !strings.HasPrefix(pattern, "/") {
+			return true
+		}
+
+		parts := strings.Split(pattern[1:], "/")
+		if len(parts) <= len(dirParts) {
+			continue
+		}
+
+		matched := true
+		for i, part := range dirParts {
+			if ok, _ := path.Match(parts[i], part); !ok {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesAny reports whether the path, or any of its parents, matches one
+// of the patterns.
+func matchesAny(patterns []string, name string) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			subject := "/" + p
+			if !strings.HasPrefix(pattern, "/") {
+				subject = path.Base(p)
+			}
+
+			if ok, _ := path.Match(pattern, subject); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// cleanPatterns normalizes the patterns so that those matched against the
+// whole path start with a slash, and the rest contain none.
+func cleanPatterns(patterns []string) ([]string, error) {
+	cleaned := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+
+		p := path.Clean("/" + pattern)
+		if p == "/" {
+			return nil, fmt.Errorf("invalid pattern %q: matches the root directory", pattern)
+		}
+
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+
+		if !anchored {
+			p = p[1:]
+		}
+
+		cleaned = append(cleaned, p)
+	}
+
+	return cleaned, nil
+}
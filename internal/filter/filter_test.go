@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filter_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/immutos/oci2erofs/internal/filter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{
+		"etc/hostname",
+		"usr/bin/sh",
+		"usr/lib/python3/foo.pyc",
+		"usr/lib/python3/foo.py",
+		"usr/share/doc/sh/copyright",
+		"usr/share/locale/de/LC_MESSAGES/sh.mo",
+		"usr/share/locale/en_GB/LC_MESSAGES/sh.mo",
+		"usr/share/locale/fr/LC_MESSAGES/sh.mo",
+		"opt/doc",
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}))
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "doc", Linkname: "usr/share/doc", Mode: 0o777}))
+	require.NoError(t, tw.Close())
+
+	src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	fsys, err := filter.New(src, &filter.Options{
+		Exclude: []string{"/usr/share/doc", "usr/share/locale/", "*.pyc"},
+		Include: []string{"/usr/share/locale/en*"},
+	})
+	require.NoError(t, err)
+
+	var paths []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []string{
+		"doc",
+		"etc/hostname",
+		"opt/doc",
+		"usr/bin/sh",
+		"usr/lib/python3/foo.py",
+		"usr/share/locale/en_GB/LC_MESSAGES/sh.mo",
+	}, paths)
+
+	_, err = fsys.Stat("usr/share/doc/sh/copyright")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsys.Open("usr/share/locale/de/LC_MESSAGES/sh.mo")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsys.StatLink("usr/lib/python3/foo.pyc")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	t.Run("Invalid Pattern", func(t *testing.T) {
+		_, err := filter.New(src, &filter.Options{Exclude: []string{"[a-"}})
+		require.Error(t, err)
+
+		_, err = filter.New(src, &filter.Options{Exclude: []string{"/"}})
+		require.Error(t, err)
+	})
+}
+
+func TestLoadPatterns(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "exclude")
+	require.NoError(t, os.WriteFile(name, []byte("# Documentation\n/usr/share/doc\n\n  *.pyc  \n"), 0o644))
+
+	patterns, err := filter.LoadPatterns(name)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/usr/share/doc", "*.pyc"}, patterns)
+}
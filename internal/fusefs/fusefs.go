@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fusefs serves EROFS images read-only over FUSE, so that they can be
+// inspected without CAP_SYS_ADMIN or kernel EROFS support (eg. on macOS or in
+// unprivileged CI containers).
+package fusefs
+
+// Options configures a FUSE mount.
+type Options struct {
+	// AllowOther allows users other than the one mounting the image to access
+	// it (requires user_allow_other in /etc/fuse.conf for non-root users).
+	AllowOther bool
+	// Debug logs every FUSE request.
+	Debug bool
+}
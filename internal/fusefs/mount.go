@@ -0,0 +1,333 @@
+//go:build linux || darwin
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dpeckett/archivefs/erofs"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// cacheTimeout is how long the kernel may cache entries and attributes. The
+// image is immutable so there is nothing to invalidate.
+const cacheTimeout = time.Hour
+
+var (
+	_ fusefs.NodeGetattrer  = (*node)(nil)
+	_ fusefs.NodeLookuper   = (*node)(nil)
+	_ fusefs.NodeReaddirer  = (*node)(nil)
+	_ fusefs.NodeReadlinker = (*node)(nil)
+	_ fusefs.NodeOpener     = (*node)(nil)
+	_ fusefs.NodeStatfser   = (*node)(nil)
+	_ fusefs.FileReader     = (*handle)(nil)
+)
+
+// Mount serves the EROFS image read-only at dir until ctx is cancelled, at
+// which point the image is unmounted.
+func Mount(ctx context.Context, image io.ReaderAt, dir string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	img, err := erofs.OpenImage(image)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+
+	rootIno, err := img.Inode(img.RootNid())
+	if err != nil {
+		return fmt.Errorf("failed to read root inode: %w", err)
+	}
+
+	timeout := cacheTimeout
+	server, err := fusefs.Mount(dir, &node{img: img, ino: rootIno}, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: opts.AllowOther,
+			Debug:      opts.Debug,
+			FsName:     "oci2erofs",
+			Name:       "erofs",
+			Options:    []string{"ro"},
+			// Mount directly when privileged, falling back to fusermount.
+			DirectMount: true,
+		},
+		EntryTimeout:   &timeout,
+		AttrTimeout:    &timeout,
+		RootStableAttr: &fusefs.StableAttr{Ino: inodeNumber(rootIno)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mount image: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Unmounted externally (eg. with fusermount -u).
+		return nil
+	case <-ctx.Done():
+	}
+
+	if err := server.Unmount(); err != nil {
+		return fmt.Errorf("failed to unmount image: %w", err)
+	}
+	<-done
+
+	return nil
+}
+
+// node is an inode in the image.
+type node struct {
+	fusefs.Inode
+	img *erofs.Image
+	ino erofs.Inode
+}
+
+func (n *node) Getattr(_ context.Context, _ fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillAttr(n.ino, &out.Attr)
+	out.SetTimeout(cacheTimeout)
+	return fusefs.OK
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if !n.ino.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	dirent, err := n.ino.Lookup(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, syscall.ENOENT
+		}
+		return nil, syscall.EIO
+	}
+
+	ino, err := n.img.Inode(dirent.Nid)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	fillAttr(ino, &out.Attr)
+
+	child := &node{img: n.img, ino: ino}
+	return n.NewInode(ctx, child, fusefs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+		Ino:  out.Attr.Ino,
+	}), fusefs.OK
+}
+
+func (n *node) Readdir(_ context.Context) (fusefs.DirStream, syscall.Errno) {
+	if !n.ino.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	var entries []fuse.DirEntry
+	err := n.ino.IterDirents(func(name string, _ uint8, nid uint64) error {
+		if name == "." || name == ".." {
+			return nil
+		}
+
+		ino, err := n.img.Inode(nid)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: fileMode(ino.Mode()) & syscall.S_IFMT,
+			Ino:  inodeNumber(ino),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	return fusefs.NewListDirStream(entries), fusefs.OK
+}
+
+func (n *node) Readlink(_ context.Context) ([]byte, syscall.Errno) {
+	if !n.ino.IsSymlink() {
+		return nil, syscall.EINVAL
+	}
+
+	target, err := n.ino.Readlink()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	return []byte(target), fusefs.OK
+}
+
+func (n *node) Open(_ context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+
+	if !n.ino.IsRegular() {
+		return nil, 0, syscall.EINVAL
+	}
+
+	h := &handle{ino: n.ino}
+	if err := h.reset(); err != nil {
+		return nil, 0, syscall.EIO
+	}
+
+	// The contents never change, so the page cache can be kept across opens.
+	return h, fuse.FOPEN_KEEP_CACHE, fusefs.OK
+}
+
+func (n *node) Statfs(_ context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = n.img.BlockSize()
+	out.Frsize = n.img.BlockSize()
+	out.Blocks = uint64(n.img.Blocks())
+	out.NameLen = 255
+	return fusefs.OK
+}
+
+// handle is an open regular file. Inline file data can only be read
+// sequentially, so reads that go backwards reopen the data and skip forward.
+type handle struct {
+	mu  sync.Mutex
+	ino erofs.Inode
+	ra  io.ReaderAt
+	r   io.Reader
+	off int64
+}
+
+func (h *handle) Read(_ context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if h.ra != nil {
+		n, err := h.ra.ReadAt(dest, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, syscall.EIO
+		}
+		return fuse.ReadResultData(dest[:n]), fusefs.OK
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if off < h.off {
+		if err := h.reset(); err != nil {
+			return nil, syscall.EIO
+		}
+	}
+
+	if off > h.off {
+		skipped, err := io.CopyN(io.Discard, h.r, off-h.off)
+		h.off += skipped
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return fuse.ReadResultData(nil), fusefs.OK
+			}
+			return nil, syscall.EIO
+		}
+	}
+
+	n, err := io.ReadFull(h.r, dest)
+	h.off += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, syscall.EIO
+	}
+
+	return fuse.ReadResultData(dest[:n]), fusefs.OK
+}
+
+// reset reopens the file data from the start.
+func (h *handle) reset() error {
+	r, err := h.ino.Data()
+	if err != nil {
+		return err
+	}
+
+	if ra, ok := r.(io.ReaderAt); ok {
+		h.ra = ra
+		return nil
+	}
+
+	h.r, h.off = r, 0
+	return nil
+}
+
+// inodeNumber returns the FUSE inode number of an image inode. FUSE reserves
+// inode number 0, which is usually the nid of the image root.
+func inodeNumber(ino erofs.Inode) uint64 {
+	return ino.Nid() + 1
+}
+
+func fillAttr(ino erofs.Inode, out *fuse.Attr) {
+	out.Ino = inodeNumber(ino)
+	out.Mode = fileMode(ino.Mode())
+	out.Size = ino.Size()
+	out.Blocks = (ino.Size() + 511) / 512
+	out.Nlink = ino.Nlink()
+	out.Owner = fuse.Owner{Uid: ino.UID(), Gid: ino.GID()}
+	out.Mtime = ino.Mtime()
+	out.Mtimensec = ino.MtimeNsec()
+	out.Atime, out.Atimensec = out.Mtime, out.Mtimensec
+	out.Ctime, out.Ctimensec = out.Mtime, out.Mtimensec
+}
+
+// fileMode converts a Go file mode into a Unix one.
+func fileMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		m |= syscall.S_IFDIR
+	case fs.ModeSymlink:
+		m |= syscall.S_IFLNK
+	case fs.ModeNamedPipe:
+		m |= syscall.S_IFIFO
+	case fs.ModeSocket:
+		m |= syscall.S_IFSOCK
+	case fs.ModeDevice:
+		m |= syscall.S_IFBLK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		m |= syscall.S_IFCHR
+	default:
+		m |= syscall.S_IFREG
+	}
+
+	if mode&fs.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+
+	return m
+}
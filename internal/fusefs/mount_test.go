@@ -0,0 +1,158 @@
+//go:build linux || darwin
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fusefs_test
+
+import (
+	"archive/tar"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/fusefs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMount(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	big := strings.Repeat("0123456789abcdef", 64*1024)
+
+	image := testutil.BuildImage(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 100}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/sh", Mode: 0o755}, Content: "#!/bin/true\n"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o555}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/share/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/share/big", Mode: 0o644}, Content: big},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777}},
+	}, modTime)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fusefs.Mount(ctx, image, dir, nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errCh)
+	})
+
+	// Wait for the mount to come up (or fail, eg. without /dev/fuse).
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "etc")); err == nil {
+			break
+		}
+
+		select {
+		case err := <-errCh:
+			errCh <- nil
+			t.Skipf("FUSE is not available: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.True(t, time.Now().Before(deadline), "timed out waiting for mount")
+	}
+
+	t.Run("ReadDir", func(t *testing.T) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		require.ElementsMatch(t, []string{"bin", "etc", "usr"}, names)
+	})
+
+	t.Run("ReadFile", func(t *testing.T) {
+		content, err := os.ReadFile(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(content))
+
+		content, err = os.ReadFile(filepath.Join(dir, "usr/share/big"))
+		require.NoError(t, err)
+		require.Equal(t, big, string(content))
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		f, err := os.Open(filepath.Join(dir, "usr/share/big"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		buf := make([]byte, 16)
+		_, err = f.ReadAt(buf, int64(len(big))-16)
+		require.NoError(t, err)
+		require.Equal(t, big[len(big)-16:], string(buf))
+
+		_, err = f.ReadAt(buf, 32)
+		require.NoError(t, err)
+		require.Equal(t, big[32:48], string(buf))
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		fi, err := os.Stat(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
+		require.True(t, fi.ModTime().Equal(modTime))
+
+		st := fi.Sys().(*syscall.Stat_t)
+		require.Equal(t, uint32(1000), st.Uid)
+		require.Equal(t, uint32(100), st.Gid)
+
+		fi, err = os.Stat(filepath.Join(dir, "usr/bin"))
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+		require.Equal(t, fs.FileMode(0o555), fi.Mode().Perm())
+	})
+
+	t.Run("Readlink", func(t *testing.T) {
+		target, err := os.Readlink(filepath.Join(dir, "bin"))
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", target)
+
+		content, err := os.ReadFile(filepath.Join(dir, "bin/sh"))
+		require.NoError(t, err)
+		require.Equal(t, "#!/bin/true\n", string(content))
+	})
+
+	t.Run("Read Only", func(t *testing.T) {
+		_, err := os.OpenFile(filepath.Join(dir, "etc/hostname"), os.O_WRONLY, 0)
+		require.Error(t, err)
+
+		err = os.WriteFile(filepath.Join(dir, "etc/new"), nil, 0o644)
+		require.Error(t, err)
+	})
+
+	t.Run("Not Exist", func(t *testing.T) {
+		_, err := os.Stat(filepath.Join(dir, "etc/missing"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package gpt writes GUID Partition Table disk images.
+package gpt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+const (
+	// SectorSize is the logical sector size of the disk image.
+	SectorSize = 512
+	// Alignment is the alignment of each partition (1 MiB).
+	Alignment = 1 << 20
+	// AttributeReadOnly marks a partition as read-only (as used by the
+	// Discoverable Partitions Specification).
+	AttributeReadOnly = 1 << 60
+)
+
+const (
+	headerSize      = 92
+	entrySize       = 128
+	entryCount      = 128
+	entriesSectors  = entryCount * entrySize / SectorSize
+	maxNameLen      = 36
+	alignmentSector = Alignment / SectorSize
+)
+
+// ErrNameTooLong is returned when a partition name does not fit in a
+// partition entry.
+var ErrNameTooLong = errors.New("partition name too long")
+
+// Partition types, named as by systemd-repart.
+var types = map[string]string{
+	"linux-generic":          "0fc63daf-8483-4772-8e79-3d69d8477de4",
+	"root-x86-64":            "4f68bce3-e8cd-4db1-96e7-fbcaf984b709",
+	"root-x86-64-verity":     "2c7357ed-ebd2-46d9-aec1-23d437ec2bf5",
+	"root-arm64":             "b921b045-1df0-41c3-af44-4c6f280d3fae",
+	"root-arm64-verity":      "df3300ce-d69f-4c92-978c-9bfb0f38d820",
+	"usr-x86-64":             "8484680c-9521-48c6-9c11-b0720656f69e",
+	"usr-x86-64-verity":      "77ff5f63-e7b6-4633-acf4-1565b864c0e6",
+	"usr-arm64":              "b0e01050-ee5f-4390-949a-9101b17104e9",
+	"usr-arm64-verity":       "6e11a4e7-fbca-4ded-b9e9-e1a512bb664e",
+	"root-x86-64-verity-sig": "41092b05-9fc8-4523-994f-2def0408b176",
+	"root-arm64-verity-sig":  "6db69de6-29f4-4758-a7a5-962190f00ce3",
+	"usr-x86-64-verity-sig":  "e7bb33fb-06cf-4e81-8273-e543b413e2e2",
+	"usr-arm64-verity-sig":   "c23ce4ff-44bd-4b00-b2d4-b41b3419e02a",
+}
+
+// ParseType parses a partition type, given either as a GUID or by name (eg.
+// "root-x86-64" or "linux-generic").
+func ParseType(s string) ([16]byte, error) {
+	if guid, ok := types[strings.ToLower(s)]; ok {
+		s = guid
+	}
+
+	guid, err := util.ParseUUID(s)
+	if err != nil {
+		return guid, fmt.Errorf("invalid partition type %q", s)
+	}
+
+	return guid, nil
+}
+
+// VerityType returns the type of the verity partition that protects a
+// partition of the given type, if there is one.
+func VerityType(partitionType [16]byte) ([16]byte, bool) {
+	return relatedType(partitionType, "-verity")
+}
+
+// VeritySignatureType returns the type of the partition holding the signature
+// of the root hash of a partition of the given type, if there is one.
+func VeritySignatureType(partitionType [16]byte) ([16]byte, bool) {
+	return relatedType(partitionType, "-verity-sig")
+}
+
+// relatedType returns the type named by appending suffix to the name of the
+// given partition type.
+func relatedType(partitionType [16]byte, suffix string) ([16]byte, bool) {
+	for name, guid := range types {
+		if guid != util.FormatUUID(partitionType) {
+			continue
+		}
+
+		related, ok := types[name+suffix]
+		if !ok {
+			return [16]byte{}, false
+		}
+
+		relatedGUID, err := util.ParseUUID(related)
+		return relatedGUID, err == nil
+	}
+
+	return [16]byte{}, false
+}
+
+// Partition is a partition of a disk image.
+type Partition struct {
+	// Type is the partition type GUID.
+	Type [16]byte
+	// GUID is the unique GUID of the partition.
+	GUID [16]byte
+	// Name is the label of the partition (at most 36 UTF-16 code units).
+	Name string
+	// Attributes are the partition attribute flags (eg. AttributeReadOnly).
+	Attributes uint64
+	// Data is the contents of the partition. Its size is rounded up to the
+	// partition alignment.
+	Data *io.SectionReader
+}
+
+// Write writes a disk image with a protective MBR, a GUID Partition Table
+// (and its backup) and the given partitions to w, which must read back as
+// zeroes where nothing has been written (eg. a new file). It returns the size
+// of the disk image. Writing is aborted if the context is cancelled.
+func Write(ctx context.Context, w io.WriterAt, diskGUID [16]byte, partitions []Partition) (int64, error) {
+	if len(partitions) > entryCount {
+		return 0, fmt.Errorf("too many partitions: %d", len(partitions))
+	}
+
+	entries := make([]byte, entryCount*entrySize)
+
+	// The primary header and entries take up the first 34 sectors, the
+	// partitions start at the first aligned sector after them.
+	lba := uint64(alignmentSector)
+	for i, p := range partitions {
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > maxNameLen {
+			return 0, fmt.Errorf("%w: %q", ErrNameTooLong, p.Name)
+		}
+
+		sectors := uint64(alignUp(p.Data.Size(), Alignment) / SectorSize)
+
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		putGUID(entry[0:16], p.Type)
+		putGUID(entry[16:32], p.GUID)
+		binary.LittleEndian.PutUint64(entry[32:40], lba)
+		binary.LittleEndian.PutUint64(entry[40:48], lba+sectors-1)
+		binary.LittleEndian.PutUint64(entry[48:56], p.Attributes)
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+
+		if _, err := io.Copy(io.NewOffsetWriter(w, int64(lba)*SectorSize), util.ContextReader(ctx, p.Data)); err != nil {
+			return 0, fmt.Errorf("failed to write partition %q: %w", p.Name, err)
+		}
+
+		lba += sectors
+	}
+
+	// Leave room for the backup entries and header at the end of the disk.
+	totalSectors := uint64(alignUp(int64(lba+entriesSectors+1)*SectorSize, Alignment) / SectorSize)
+	lastUsable := totalSectors - entriesSectors - 2
+
+	if err := writeProtectiveMBR(w, totalSectors); err != nil {
+		return 0, err
+	}
+
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	header := func(current, backup, entriesLBA uint64) []byte {
+		buf := make([]byte, SectorSize)
+		copy(buf[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(buf[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(buf[12:16], headerSize)
+		binary.LittleEndian.PutUint64(buf[24:32], current)
+		binary.LittleEndian.PutUint64(buf[32:40], backup)
+		binary.LittleEndian.PutUint64(buf[40:48], 2+entriesSectors)
+		binary.LittleEndian.PutUint64(buf[48:56], lastUsable)
+		putGUID(buf[56:72], diskGUID)
+		binary.LittleEndian.PutUint64(buf[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(buf[80:84], entryCount)
+		binary.LittleEndian.PutUint32(buf[84:88], entrySize)
+		binary.LittleEndian.PutUint32(buf[88:92], entriesCRC)
+		binary.LittleEndian.PutUint32(buf[16:20], crc32.ChecksumIEEE(buf[:headerSize]))
+		return buf
+	}
+
+	backupEntriesLBA := totalSectors - entriesSectors - 1
+	for _, write := range []struct {
+		lba  uint64
+		data []byte
+	}{
+		{lba: 1, data: header(1, totalSectors-1, 2)},
+		{lba: 2, data: entries},
+		{lba: backupEntriesLBA, data: entries},
+		{lba: totalSectors - 1, data: header(totalSectors-1, 1, backupEntriesLBA)},
+	} {
+		if _, err := w.WriteAt(write.data, int64(write.lba)*SectorSize); err != nil {
+			return 0, fmt.Errorf("failed to write partition table: %w", err)
+		}
+	}
+
+	return int64(totalSectors) * SectorSize, nil
+}
+
+// writeProtectiveMBR writes an MBR with a single partition of type 0xEE
+// covering the disk, so that GPT unaware tools leave it alone.
+func writeProtectiveMBR(w io.WriterAt, totalSectors uint64) error {
+	mbr := make([]byte, SectorSize)
+
+	entry := mbr[446:462]
+	entry[1], entry[2], entry[3] = 0x00, 0x02, 0x00
+	entry[4] = 0xee
+	entry[5], entry[6], entry[7] = 0xff, 0xff, 0xff
+	binary.LittleEndian.PutUint32(entry[8:12], 1)
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(min(totalSectors-1, 0xffffffff)))
+
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	if _, err := w.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("failed to write protective MBR: %w", err)
+	}
+
+	return nil
+}
+
+// putGUID stores a GUID in the mixed-endian layout used by GPT.
+func putGUID(b []byte, guid [16]byte) {
+	binary.LittleEndian.PutUint32(b[0:4], binary.BigEndian.Uint32(guid[0:4]))
+	binary.LittleEndian.PutUint16(b[4:6], binary.BigEndian.Uint16(guid[4:6]))
+	binary.LittleEndian.PutUint16(b[6:8], binary.BigEndian.Uint16(guid[6:8]))
+	copy(b[8:16], guid[8:16])
+}
+
+func alignUp(n, alignment int64) int64 {
+	return (n + alignment - 1) / alignment * alignment
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package gpt_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/gpt"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	rootType, err := gpt.ParseType("root-x86-64")
+	require.NoError(t, err)
+
+	verityType, ok := gpt.VerityType(rootType)
+	require.True(t, ok)
+	require.Equal(t, "2c7357ed-ebd2-46d9-aec1-23d437ec2bf5", util.FormatUUID(verityType))
+
+	signatureType, ok := gpt.VeritySignatureType(rootType)
+	require.True(t, ok)
+	require.Equal(t, "41092b05-9fc8-4523-994f-2def0408b176", util.FormatUUID(signatureType))
+
+	data := bytes.Repeat([]byte("erofs"), 1000)
+	hashes := bytes.Repeat([]byte("verity"), 100)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.raw"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	diskGUID := util.NameUUID("disk")
+	size, err := gpt.Write(context.Background(), f, diskGUID, []gpt.Partition{
+		{
+			Type:       rootType,
+			GUID:       util.NameUUID("root"),
+			Name:       "root",
+			Attributes: gpt.AttributeReadOnly,
+			Data:       io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+		},
+		{
+			Type: verityType,
+			GUID: util.NameUUID("verity"),
+			Name: "root-verity",
+			Data: io.NewSectionReader(bytes.NewReader(hashes), 0, int64(len(hashes))),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(4<<20), size)
+
+	disk, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Len(t, disk, int(size))
+
+	t.Run("Protective MBR", func(t *testing.T) {
+		require.Equal(t, []byte{0x55, 0xaa}, disk[510:512])
+		require.Equal(t, byte(0xee), disk[446+4])
+	})
+
+	for _, tc := range []struct {
+		name       string
+		offset     int
+		entriesLBA uint64
+	}{
+		{name: "Primary Header", offset: gpt.SectorSize, entriesLBA: 2},
+		{name: "Backup Header", offset: len(disk) - gpt.SectorSize, entriesLBA: uint64(len(disk)/gpt.SectorSize - 33)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := append([]byte(nil), disk[tc.offset:tc.offset+92]...)
+			require.Equal(t, "EFI PART", string(header[0:8]))
+
+			headerCRC := binary.LittleEndian.Uint32(header[16:20])
+			binary.LittleEndian.PutUint32(header[16:20], 0)
+			require.Equal(t, crc32.ChecksumIEEE(header), headerCRC)
+
+			require.Equal(t, tc.entriesLBA, binary.LittleEndian.Uint64(header[72:80]))
+
+			entries := disk[tc.entriesLBA*gpt.SectorSize : tc.entriesLBA*gpt.SectorSize+128*128]
+			require.Equal(t, crc32.ChecksumIEEE(entries), binary.LittleEndian.Uint32(header[88:92]))
+
+			// The type GUID is stored mixed-endian.
+			require.Equal(t, []byte{0xe3, 0xbc, 0x68, 0x4f, 0xcd, 0xe8, 0xb1, 0x4d}, entries[0:8])
+			require.Equal(t, uint64(2048), binary.LittleEndian.Uint64(entries[32:40]))
+			require.Equal(t, uint64(4095), binary.LittleEndian.Uint64(entries[40:48]))
+			require.Equal(t, uint64(gpt.AttributeReadOnly), binary.LittleEndian.Uint64(entries[48:56]))
+			require.Equal(t, []byte{'r', 0, 'o', 0, 'o', 0, 't', 0, 0, 0}, entries[56:66])
+
+			require.Equal(t, uint64(4096), binary.LittleEndian.Uint64(entries[128+32:128+40]))
+		})
+	}
+
+	t.Run("Partition Data", func(t *testing.T) {
+		require.Equal(t, data, disk[1<<20:1<<20+len(data)])
+		require.Equal(t, hashes, disk[2<<20:2<<20+len(hashes)])
+	})
+
+	t.Run("Name Too Long", func(t *testing.T) {
+		_, err := gpt.Write(context.Background(), f, diskGUID, []gpt.Partition{
+			{Name: "a-partition-name-longer-than-36-characters", Data: io.NewSectionReader(bytes.NewReader(data), 0, 1)},
+		})
+		require.ErrorIs(t, err, gpt.ErrNameTooLong)
+	})
+}
+
+func TestParseType(t *testing.T) {
+	guid, err := gpt.ParseType("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	require.NoError(t, err)
+
+	named, err := gpt.ParseType("linux-generic")
+	require.NoError(t, err)
+	require.Equal(t, named, guid)
+
+	_, ok := gpt.VerityType(guid)
+	require.False(t, ok)
+
+	_, err = gpt.ParseType("root-riscv128")
+	require.Error(t, err)
+}
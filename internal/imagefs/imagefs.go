@@ -0,0 +1,424 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package imagefs presents an EROFS image as a file system that conforms to
+// the io/fs interfaces (as checked by testing/fstest), with random access to
+// file contents and symbolic links resolved within the image.
+package imagefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed when
+// resolving a path.
+const maxSymlinks = 40
+
+var (
+	_ fs.FS                = (*FS)(nil)
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ fs.ReadDirFile       = (*dir)(nil)
+	_ io.ReaderAt          = (*file)(nil)
+	_ io.Seeker            = (*file)(nil)
+)
+
+// FS is a read-only view of an EROFS image.
+type FS struct {
+	img  *erofs.Image
+	root erofs.Inode
+}
+
+// Open opens the EROFS image.
+func Open(image io.ReaderAt) (*FS, error) {
+	img, err := erofs.OpenImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := img.Inode(img.RootNid())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root inode: %w", err)
+	}
+
+	return &FS{img: img, root: root}, nil
+}
+
+// Open opens the named file. Directories are fs.ReadDirFile, and regular
+// files support random access (io.ReaderAt and io.Seeker).
+func (fsys *FS) Open(name string) (fs.File, error) {
+	ino, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := &fileInfo{name: baseName(name), ino: ino}
+	if ino.IsDir() {
+		entries, err := fsys.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &dir{fi: fi, name: name, entries: entries}, nil
+	}
+
+	return &file{fi: fi}, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ino.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := fsys.readDir(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return entries, nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	ino, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: baseName(name), ino: ino}, nil
+}
+
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) ReadLink(name string) (string, error) {
+	ino, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if !ino.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := ino.Readlink()
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	ino, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: baseName(name), ino: ino}, nil
+}
+
+// Lstat returns a FileInfo describing the named file. If the file is a
+// symbolic link, the returned FileInfo describes the link itself. It is an
+// alias for StatLink.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.StatLink(name)
+}
+
+// resolve returns the inode of the named file, following symbolic links
+// (other than the final path component, unless follow is set).
+func (fsys *FS) resolve(op, name string, follow bool) (erofs.Inode, error) {
+	if !fs.ValidPath(name) {
+		return erofs.Inode{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var links int
+	resolved, err := fsys.walk([]erofs.Inode{fsys.root}, name, follow, &links)
+	if err != nil {
+		return erofs.Inode{}, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return resolved[len(resolved)-1], nil
+}
+
+// walk resolves the given path relative to the last of dirs (the directories
+// leading up to it from the root), following any symbolic links (relative
+// targets from the directory containing the link). It returns the resolved
+// file along with the directories leading up to it.
+func (fsys *FS) walk(dirs []erofs.Inode, name string, follow bool, links *int) ([]erofs.Inode, error) {
+	components := strings.Split(name, "/")
+	for i, component := range components {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			// The parent of the root is the root.
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+
+		d := dirs[len(dirs)-1]
+		if !d.IsDir() {
+			return nil, errors.New("not a directory")
+		}
+
+		dirent, err := d.Lookup(component)
+		if err != nil {
+			return nil, err
+		}
+
+		ino, err := fsys.img.Inode(dirent.Nid)
+		if err != nil {
+			return nil, err
+		}
+
+		last := i == len(components)-1
+		if !ino.IsSymlink() || (!follow && last) {
+			// Copy on append, as dirs may be shared with the caller.
+			dirs = append(dirs[:len(dirs):len(dirs)], ino)
+			continue
+		}
+
+		if *links++; *links > maxSymlinks {
+			return nil, errors.New("too many levels of symbolic links")
+		}
+
+		target, err := ino.Readlink()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(target, "/") {
+			dirs = dirs[:1]
+		}
+
+		dirs, err = fsys.walk(dirs, target, true, links)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dirs, nil
+}
+
+// readDir lists a directory, in name order (as stored in the image).
+func (fsys *FS) readDir(d erofs.Inode) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	err := d.IterDirents(func(name string, _ uint8, nid uint64) error {
+		if name == "." || name == ".." {
+			return nil
+		}
+
+		ino, err := fsys.img.Inode(nid)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: name, ino: ino}))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func baseName(name string) string {
+	if name == "." {
+		return name
+	}
+
+	return path.Base(name)
+}
+
+type fileInfo struct {
+	name string
+	ino  erofs.Inode
+}
+
+func (fi *fileInfo) Name() string      { return fi.name }
+func (fi *fileInfo) Size() int64       { return int64(fi.ino.Size()) }
+func (fi *fileInfo) Mode() fs.FileMode { return fi.ino.Mode() }
+func (fi *fileInfo) IsDir() bool       { return fi.ino.IsDir() }
+func (fi *fileInfo) Sys() any          { return &fi.ino }
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.ino.Mtime()), int64(fi.ino.MtimeNsec()))
+}
+
+// file is an open file. Inline file data can only be read sequentially, so
+// it is reopened and read forward to the requested offset when necessary.
+type file struct {
+	mu sync.Mutex
+	fi *fileInfo
+	r  io.Reader
+	// offset is the offset of the next Read.
+	offset int64
+	// pos is the offset of r, if it does not support random access.
+	pos int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %w", fs.ErrInvalid)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.fi.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d: %w", whence, fs.ErrInvalid)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %w", fs.ErrInvalid)
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// readAt reads len(p) bytes at off, with the semantics of io.ReaderAt.
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	if off >= f.fi.Size() {
+		return 0, io.EOF
+	}
+
+	if f.r == nil || (off < f.pos && !isReaderAt(f.r)) {
+		r, err := f.fi.ino.Data()
+		if err != nil {
+			return 0, err
+		}
+		f.r, f.pos = r, 0
+	}
+
+	if ra, ok := f.r.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+
+	n, err := io.CopyN(io.Discard, f.r, off-f.pos)
+	f.pos += n
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := io.ReadFull(f.r, p)
+	f.pos += int64(m)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+
+	return m, err
+}
+
+func isReaderAt(r io.Reader) bool {
+	_, ok := r.(io.ReaderAt)
+	return ok
+}
+
+// dir is an open directory.
+type dir struct {
+	fi      fs.FileInfo
+	name    string
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
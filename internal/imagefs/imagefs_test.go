@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package imagefs_test
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/imagefs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	large := strings.Repeat("0123456789abcdef", 1024)
+
+	fsys, err := imagefs.Open(testutil.BuildImage(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/localtime", Linkname: "../usr/share/zoneinfo/UTC", Mode: 0o777}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o644}, Content: large},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/empty", Mode: 0o644}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/share/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/share/zoneinfo/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/share/zoneinfo/UTC", Mode: 0o644}, Content: "TZif2"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "/usr/lib", Mode: 0o777}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/lib64", Linkname: "lib", Mode: 0o777}},
+	}, modTime))
+	require.NoError(t, err)
+
+	t.Run("TestFS", func(t *testing.T) {
+		require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "etc/localtime", "usr/lib/large", "usr/lib/empty", "lib"))
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		content, err := fs.ReadFile(fsys, "etc/localtime")
+		require.NoError(t, err)
+		require.Equal(t, "TZif2", string(content))
+
+		// Absolute targets resolve from the image root, not the host.
+		content, err = fs.ReadFile(fsys, "lib/large")
+		require.NoError(t, err)
+		require.Equal(t, large, string(content))
+
+		content, err = fs.ReadFile(fsys, "usr/lib64/large")
+		require.NoError(t, err)
+		require.Equal(t, large, string(content))
+
+		target, err := fsys.ReadLink("usr/lib64")
+		require.NoError(t, err)
+		require.Equal(t, "lib", target)
+
+		fi, err := fsys.StatLink("lib")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+		require.Equal(t, "lib", fi.Name())
+
+		fi, err = fsys.Stat("lib")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+		require.Equal(t, "lib", fi.Name())
+
+		_, err = fsys.ReadLink("etc/hostname")
+		require.ErrorIs(t, err, fs.ErrInvalid)
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		fi, err := fsys.Stat("etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "hostname", fi.Name())
+		require.Equal(t, int64(len("localhost\n")), fi.Size())
+		require.Equal(t, fs.FileMode(0o644), fi.Mode())
+		require.True(t, fi.ModTime().Equal(modTime))
+
+		fi, err = fsys.Stat(".")
+		require.NoError(t, err)
+		require.Equal(t, ".", fi.Name())
+		require.True(t, fi.IsDir())
+	})
+
+	t.Run("ReadAt", func(t *testing.T) {
+		f, err := fsys.Open("usr/lib/large")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		ra, ok := f.(io.ReaderAt)
+		require.True(t, ok)
+
+		buf := make([]byte, 16)
+		_, err = ra.ReadAt(buf, int64(len(large))-16)
+		require.NoError(t, err)
+		require.Equal(t, large[len(large)-16:], string(buf))
+
+		_, err = ra.ReadAt(buf, 16)
+		require.NoError(t, err)
+		require.Equal(t, large[16:32], string(buf))
+
+		_, err = ra.ReadAt(buf, int64(len(large)))
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Invalid Path", func(t *testing.T) {
+		for _, name := range []string{"/etc/hostname", "etc/../etc/hostname", "./etc", "etc/"} {
+			_, err := fsys.Open(name)
+			require.ErrorIs(t, err, fs.ErrInvalid, name)
+		}
+	})
+
+	t.Run("Not Exist", func(t *testing.T) {
+		_, err := fsys.Open("etc/missing")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fsys.Stat("etc/hostname/missing")
+		require.Error(t, err)
+	})
+}
+
+func TestFSSymlinkErrors(t *testing.T) {
+	fsys, err := imagefs.Open(testutil.BuildImage(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "b", Mode: 0o777}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "b", Linkname: "a", Mode: 0o777}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "dangling", Linkname: "/missing", Mode: 0o777}},
+	}, time.Time{}))
+	require.NoError(t, err)
+
+	t.Run("Loop", func(t *testing.T) {
+		_, err := fsys.Open("a")
+		require.ErrorContains(t, err, "too many levels of symbolic links")
+
+		fi, err := fsys.StatLink("a")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	})
+
+	t.Run("Dangling", func(t *testing.T) {
+		_, err := fsys.Open("dangling")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		target, err := fsys.ReadLink("dangling")
+		require.NoError(t, err)
+		require.Equal(t, "/missing", target)
+	})
+}
@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package inspect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// AnnotationsPath is the location of the image's annotations within its root
+// filesystem, stored as a JSON object of string keys and values.
+const AnnotationsPath = "etc/oci2erofs/annotations.json"
+
+// Report describes an EROFS image.
+type Report struct {
+	SuperBlock SuperBlock `json:"superBlock"`
+	// Annotations are the key/value pairs stored at AnnotationsPath, if any.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Files is only populated when the file tree was requested.
+	Files []File `json:"files,omitempty"`
+}
+
+// SuperBlock is the decoded EROFS superblock.
+type SuperBlock struct {
+	BlockSize       uint32    `json:"blockSize"`
+	Blocks          uint32    `json:"blocks"`
+	Inodes          uint64    `json:"inodes"`
+	UUID            string    `json:"uuid"`
+	VolumeName      string    `json:"volumeName,omitempty"`
+	FeatureCompat   uint32    `json:"featureCompat"`
+	FeatureIncompat uint32    `json:"featureIncompat"`
+	BuildTime       time.Time `json:"buildTime"`
+}
+
+// File describes a file in an EROFS image.
+type File struct {
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	UID     uint32      `json:"uid"`
+	GID     uint32      `json:"gid"`
+	ModTime time.Time   `json:"modTime"`
+	Target  string      `json:"target,omitempty"`
+}
+
+// Inspect decodes the superblock of the EROFS image and, if listFiles is set,
+// walks its file tree.
+func Inspect(src io.ReaderAt, listFiles bool) (*Report, error) {
+	img, err := erofs.OpenImage(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	sb := img.SuperBlock()
+
+	report := Report{
+		SuperBlock: SuperBlock{
+			BlockSize:       sb.BlockSize(),
+			Blocks:          sb.Blocks,
+			Inodes:          sb.Inodes,
+			UUID:            util.FormatUUID(sb.UUID),
+			VolumeName:      strings.TrimRight(string(sb.VolumeName[:]), "\x00"),
+			FeatureCompat:   sb.FeatureCompat,
+			FeatureIncompat: sb.FeatureIncompat,
+			BuildTime:       time.Unix(int64(sb.BuildTime), int64(sb.BuildTimeNsec)).UTC(),
+		},
+	}
+
+	fsys, err := erofs.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open filesystem: %w", err)
+	}
+
+	report.Annotations, err = ReadAnnotations(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	if !listFiles {
+		return &report, nil
+	}
+
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := fsys.StatLink(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+
+		f := File{
+			Path:    path,
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().UTC(),
+		}
+
+		if ino, ok := fi.Sys().(*erofs.Inode); ok {
+			f.UID = ino.UID()
+			f.GID = ino.GID()
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			f.Target, err = fsys.ReadLink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read link %q: %w", path, err)
+			}
+		}
+
+		report.Files = append(report.Files, f)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk filesystem: %w", err)
+	}
+
+	return &report, nil
+}
+
+// ReadAnnotations reads the annotations stored at AnnotationsPath. It returns
+// nil if the image has none.
+func ReadAnnotations(fsys fs.FS) (map[string]string, error) {
+	data, err := fs.ReadFile(fsys, AnnotationsPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read annotations: %w", err)
+	}
+
+	var annotations map[string]string
+	if err := json.Unmarshal(data, &annotations); err != nil {
+		return nil, fmt.Errorf("failed to decode annotations: %w", err)
+	}
+
+	return annotations, nil
+}
+
+// WriteText writes a human readable version of the report.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	sb := r.SuperBlock
+	fmt.Fprintf(tw, "Block size:\t%d\n", sb.BlockSize)
+	fmt.Fprintf(tw, "Blocks:\t%d\n", sb.Blocks)
+	fmt.Fprintf(tw, "Inodes:\t%d\n", sb.Inodes)
+	fmt.Fprintf(tw, "UUID:\t%s\n", sb.UUID)
+	if sb.VolumeName != "" {
+		fmt.Fprintf(tw, "Volume name:\t%s\n", sb.VolumeName)
+	}
+	fmt.Fprintf(tw, "Compatible features:\t0x%08x\n", sb.FeatureCompat)
+	fmt.Fprintf(tw, "Incompatible features:\t0x%08x\n", sb.FeatureIncompat)
+	fmt.Fprintf(tw, "Build time:\t%s\n", sb.BuildTime.Format(time.RFC3339))
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.Annotations) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Annotations:")
+
+		keys := make([]string, 0, len(r.Annotations))
+		for k := range r.Annotations {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, k := range keys {
+			fmt.Fprintf(tw, "  %s\t%s\n", k, r.Annotations[k])
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Files) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for _, f := range r.Files {
+		name := f.Path
+		if f.Target != "" {
+			name += " -> " + f.Target
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\n",
+			f.Mode, f.UID, f.GID, f.Size, f.ModTime.Format(time.DateTime), name)
+	}
+
+	return tw.Flush()
+}
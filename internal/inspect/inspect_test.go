@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package inspect_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/inspect"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	image := testutil.BuildImage(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 100}, Content: "localhost\n"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr", Mode: 0o777}},
+	}, modTime)
+
+	t.Run("SuperBlock", func(t *testing.T) {
+		report, err := inspect.Inspect(image, false)
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(4096), report.SuperBlock.BlockSize)
+		require.Equal(t, uint64(5), report.SuperBlock.Inodes)
+		require.Equal(t, "00000000-0000-0000-0000-000000000000", report.SuperBlock.UUID)
+		require.Empty(t, report.Files)
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		report, err := inspect.Inspect(image, true)
+		require.NoError(t, err)
+
+		var paths []string
+		for _, f := range report.Files {
+			paths = append(paths, f.Path)
+		}
+		require.Equal(t, []string{".", "bin", "etc", "etc/hostname", "usr"}, paths)
+
+		bin := report.Files[1]
+		require.Equal(t, fs.ModeSymlink, bin.Mode.Type())
+		require.Equal(t, "usr", bin.Target)
+
+		hostname := report.Files[3]
+		require.Equal(t, fs.FileMode(0o644), hostname.Mode)
+		require.Equal(t, int64(len("localhost\n")), hostname.Size)
+		require.Equal(t, uint32(1000), hostname.UID)
+		require.Equal(t, uint32(100), hostname.GID)
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		report, err := inspect.Inspect(image, true)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, report.WriteText(&buf))
+
+		require.Contains(t, buf.String(), "Block size:")
+		require.Contains(t, buf.String(), "bin -> usr")
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		report, err := inspect.Inspect(image, true)
+		require.NoError(t, err)
+
+		data, err := json.Marshal(report)
+		require.NoError(t, err)
+
+		var decoded inspect.Report
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		require.Equal(t, report, &decoded)
+	})
+
+	t.Run("Annotations", func(t *testing.T) {
+		report, err := inspect.Inspect(image, false)
+		require.NoError(t, err)
+		require.Nil(t, report.Annotations)
+
+		annotated := testutil.BuildImage(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/oci2erofs/", Mode: 0o755}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: inspect.AnnotationsPath, Mode: 0o644}, Content: `{"git.sha":"abc123","build.id":"42"}`},
+		}, modTime)
+
+		report, err = inspect.Inspect(annotated, false)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"git.sha": "abc123", "build.id": "42"}, report.Annotations)
+
+		var buf bytes.Buffer
+		require.NoError(t, report.WriteText(&buf))
+		require.Contains(t, buf.String(), "Annotations:\n  build.id  42\n  git.sha   abc123\n")
+	})
+
+	t.Run("Not EROFS", func(t *testing.T) {
+		_, err := inspect.Inspect(bytes.NewReader(make([]byte, 4096)), false)
+		require.Error(t, err)
+	})
+}
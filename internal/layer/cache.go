@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheVersion is bumped whenever the format of cached layers changes, so
+// that layers cached by older versions are not used.
+const cacheVersion = "v2"
+
+// cachePath returns the path of the cached layer with the given digest.
+func cachePath(cacheDir string, dgst digest.Digest) string {
+	return filepath.Join(cacheDir, "layers", cacheVersion, dgst.Algorithm().String(), dgst.Encoded()+".tar")
+}
+
+// cacheLocks serializes loads of the same layer, so that concurrent
+// conversions sharing a layer decompress it once and then read it from the
+// cache.
+var cacheLocks sync.Map
+
+// lockCached locks the cache entry of the layer with the given digest, and
+// returns a function unlocking it.
+func lockCached(cacheDir string, dgst digest.Digest) func() {
+	v, _ := cacheLocks.LoadOrStore(cachePath(cacheDir, dgst), &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// openCached opens the cached layer with the given digest. It returns nil if
+// the layer is not cached.
+func openCached(cacheDir string, dgst digest.Digest) (*os.File, error) {
+	path := cachePath(cacheDir, dgst)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to open cached layer: %w", err)
+	}
+
+	// The modification time records when the layer was last used.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return f, nil
+}
+
+// storeCached writes the decompressed layer to the cache.
+func storeCached(cacheDir string, dgst digest.Digest, r io.Reader) error {
+	path := cachePath(cacheDir, dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// Write to a temporary file first so that concurrent runs never see a
+	// partially written layer.
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create cached layer: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := &sparseWriter{f: f}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to write cached layer: %w", err)
+	}
+
+	if err := w.Finish(); err != nil {
+		return fmt.Errorf("failed to write cached layer: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close cached layer: %w", err)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// pruneCache removes the least recently used layers from the cache until its
+// total size is at most maxSize bytes.
+func pruneCache(cacheDir string, maxSize int64) error {
+	type cachedLayer struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var layers []cachedLayer
+	var total int64
+	err := filepath.WalkDir(filepath.Join(cacheDir, "layers"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		layers = append(layers, cachedLayer{path: path, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk cache directory: %w", err)
+	}
+
+	slices.SortFunc(layers, func(a, b cachedLayer) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	for _, l := range layers {
+		if total <= maxSize {
+			break
+		}
+
+		if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove cached layer: %w", err)
+		}
+
+		total -= l.size
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker layer media types (the OCI equivalents are in the image spec).
+const (
+	mediaTypeDockerLayer            = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerLayerZstd        = "application/vnd.docker.image.rootfs.diff.tar.zstd"
+	mediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Compression is a layer compression algorithm.
+type Compression string
+
+const (
+	CompressionNone  Compression = "none"
+	CompressionGzip  Compression = "gzip"
+	CompressionZstd  Compression = "zstd"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionXZ    Compression = "xz"
+	CompressionLZ4   Compression = "lz4"
+)
+
+// Decompressor returns a reader of the layer tarball compressed in r, for
+// layers of media types other than the built-in ones (see
+// Options.Decompressors).
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// detectCompression sniffs the compression algorithm from the magic bytes
+// at the start of the stream.
+func detectCompression(br *bufio.Reader) (Compression, error) {
+	buf, err := br.Peek(8)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(buf, []byte{0x1F, 0x8B}):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(buf, []byte{0x28, 0xB5, 0x2F, 0xFD}):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(buf, []byte{0x42, 0x5A, 0x68}):
+		return CompressionBzip2, nil
+	case bytes.HasPrefix(buf, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}):
+		return CompressionXZ, nil
+	case bytes.HasPrefix(buf, []byte{0x04, 0x22, 0x4D, 0x18}):
+		return CompressionLZ4, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+// compressionForMediaType returns the compression algorithm declared by a
+// layer media type, and false if the media type is not a recognized layer
+// type.
+func compressionForMediaType(mediaType string) (Compression, bool) {
+	// The non-distributable media types are deprecated, but still in use.
+	switch mediaType {
+	case ocispecs.MediaTypeImageLayer, mediaTypeDockerLayer,
+		ocispecs.MediaTypeImageLayerNonDistributable:
+		return CompressionNone, true
+	case ocispecs.MediaTypeImageLayerGzip, mediaTypeDockerLayerGzip,
+		ocispecs.MediaTypeImageLayerNonDistributableGzip, mediaTypeDockerForeignLayerGzip:
+		return CompressionGzip, true
+	case ocispecs.MediaTypeImageLayerZstd, mediaTypeDockerLayerZstd,
+		ocispecs.MediaTypeImageLayerNonDistributableZstd:
+		return CompressionZstd, true
+	default:
+		return "", false
+	}
+}
+
+// IsForeignMediaType reports whether the media type is that of a foreign
+// (non-distributable) layer, whose blob is typically not distributed with
+// the image, but downloaded from the URLs listed in its descriptor.
+func IsForeignMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "application/vnd.docker.image.rootfs.foreign.") ||
+		strings.HasPrefix(mediaType, "application/vnd.oci.image.layer.nondistributable.")
+}
+
+// checkMediaType returns an error if layers of the given media type cannot
+// be loaded. Unrecognized media types are allowed (and their compression
+// sniffed) if opts.LenientMediaType is set, as are layers without a media
+// type (eg. those of Docker archives).
+func checkMediaType(mediaType string, opts *Options) error {
+	if _, ok := opts.Decompressors[mediaType]; ok {
+		return nil
+	}
+
+	if _, ok := compressionForMediaType(mediaType); !ok && mediaType != "" && !opts.LenientMediaType {
+		return fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+	}
+
+	return nil
+}
+
+// newDecompressor returns a reader that decompresses r using the given
+// algorithm. Algorithms that no layer media type declares (and so can only
+// have been sniffed) are handled by uncompr.
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		// Layers made up of multiple concatenated gzip members are read to
+		// the end, as the reader is multistream by default.
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return gzr, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return zr.IOReadCloser(), nil
+	default:
+		return uncompr.NewReader(r)
+	}
+}
+
+// newLayerDecompressor returns a reader that decompresses the layer in br
+// according to its media type, using opts.Decompressors if it has one for
+// the media type. Otherwise the layer's contents are checked against the
+// compression its media type declares (see Options.LenientMediaType), and
+// warned is set if they are decompressed according to their sniffed
+// compression instead (see Options.OnWarning).
+func newLayerDecompressor(br *bufio.Reader, layerPath, mediaType string, opts *Options) (_ io.ReadCloser, warned bool, err error) {
+	if decompress, ok := opts.Decompressors[mediaType]; ok {
+		dr, err := decompress(br)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to create decompressing reader: %w", err)
+		}
+
+		return dr, false, nil
+	}
+
+	compression, err := detectCompression(br)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to detect layer compression: %w", err)
+	}
+
+	var message string
+	if expected, ok := compressionForMediaType(mediaType); ok {
+		if compression != expected {
+			if !opts.LenientMediaType {
+				return nil, false, fmt.Errorf("%w: %s declares %s compression but is %s",
+					ErrMediaTypeMismatch, mediaType, expected, compression)
+			}
+
+			message = fmt.Sprintf("media type %s declares %s compression but the layer is %s, using the detected compression",
+				mediaType, expected, compression)
+		}
+	} else if mediaType != "" {
+		message = fmt.Sprintf("unrecognized media type %s, using the detected %s compression", mediaType, compression)
+	}
+
+	if message != "" {
+		warned = true
+		if err := warning.Emit(opts.OnWarning, &warning.Warning{Kind: warning.KindMediaType, Layer: layerPath, Message: message}); err != nil {
+			return nil, warned, err
+		}
+	}
+
+	dr, err := newDecompressor(br, compression)
+	if err != nil {
+		return nil, warned, fmt.Errorf("failed to create decompressing reader: %w", err)
+	}
+
+	return dr, warned, nil
+}
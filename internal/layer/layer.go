@@ -0,0 +1,670 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/unsupported"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/opencontainers/go-digest"
+)
+
+// Options configures how a layer is loaded.
+type Options struct {
+	// LenientMediaType allows layers whose contents do not match the
+	// compression declared by their media type (a common registry bug), and
+	// layers with unrecognized media types. They are decompressed according
+	// to their sniffed type, with a warning (see OnWarning).
+	LenientMediaType bool
+	// MemoryLimit is the size in bytes up to which a decompressed layer is
+	// held in memory rather than written to a temporary file. Larger layers
+	// spill over to disk. If zero, layers are always written to disk.
+	MemoryLimit int64
+	// Jobs is the maximum number of layers LoadAll loads concurrently
+	// (defaults to GOMAXPROCS).
+	Jobs int
+	// SkipSpecialFiles drops device nodes and FIFOs (which cannot be stored
+	// in the image), and entries of unsupported types, with a warning rather
+	// than failing to load the layer.
+	SkipSpecialFiles bool
+	// PlaceholderSpecialFiles replaces device nodes and FIFOs with empty
+	// regular files of the same permissions and owner, with a warning. If
+	// neither this nor SkipSpecialFiles is set, they fail the load with
+	// unsupported.ErrUnsupportedFile.
+	PlaceholderSpecialFiles bool
+	// StrictPaths also rejects entries that are placed beneath a symbolic
+	// link in the same layer, and symbolic links whose relative targets
+	// climb above the root filesystem.
+	StrictPaths bool
+	// CacheDir, if set, is a directory in which decompressed layers are
+	// cached by digest, so that layers shared between images are only
+	// decompressed once.
+	CacheDir string
+	// CacheMaxSize is the maximum total size in bytes of the layer cache. The
+	// least recently used layers are evicted by LoadAll once it is exceeded.
+	// If zero, the cache is unbounded.
+	CacheMaxSize int64
+	// Progress, if set, is called as the compressed layer is read.
+	Progress progress.Func
+	// OnLoad, if set, is called with the statistics of each loaded layer
+	// (in layer order, when loaded by LoadAll).
+	OnLoad func(Stats)
+	// IgnoreTOC fully decompresses eStargz and zstd:chunked layers, rather
+	// than reading their files on demand using the table of contents. The
+	// table of contents is otherwise trusted to match the layer tarball.
+	IgnoreTOC bool
+	// Decompressors decompress layers of additional media types, keyed by
+	// media type. They take precedence over the built-in decompression (and
+	// the contents of such layers are not checked against their media type).
+	Decompressors map[string]Decompressor
+	// OnWarning, if set, is called with each entry that is left out of the
+	// layer, or that has extended attributes (which are not stored), and
+	// with each layer decompressed despite its media type. An
+	// error fails the load. If nil, warnings are logged. It may be called
+	// concurrently by LoadAll.
+	OnWarning warning.Func
+	// Limits caps the decompressed size and number of entries, to guard
+	// against decompression bombs. The totals apply across all the layers
+	// loaded by LoadAll.
+	Limits Limits
+
+	// limiter is shared by the layers loaded by LoadAll.
+	limiter *limiter
+}
+
+// Stats describes a loaded layer.
+type Stats struct {
+	// Path is the path of the layer within the image.
+	Path string `json:"path"`
+	// Size is the size of the (compressed) layer in bytes.
+	Size int64 `json:"size"`
+	// UncompressedSize is the size of the decompressed layer tar in bytes.
+	UncompressedSize int64 `json:"uncompressedSize"`
+	// Cached is set if the layer was read from the layer cache.
+	Cached bool `json:"cached,omitempty"`
+	// Duration is the time taken to load the layer.
+	Duration time.Duration `json:"duration"`
+}
+
+var (
+	// ErrUnsafePath is returned when a layer contains an entry that would escape
+	// the root filesystem (eg. an absolute path or a path with ".." components).
+	ErrUnsafePath = util.ErrUnsafePath
+	// ErrMediaTypeMismatch is returned when the contents of a layer do not
+	// match the compression declared by its media type.
+	ErrMediaTypeMismatch = errors.New("layer media type mismatch")
+	// ErrUnsupportedMediaType is returned for layers whose media type is not
+	// a recognized layer type.
+	ErrUnsupportedMediaType = errors.New("unsupported layer media type")
+	// ErrLimitExceeded is returned when a layer exceeds one of the
+	// configured Limits.
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// Load decompresses the described layer into memory (up to the configured
+// limit) or a temporary tar file in tempDir and returns a file system backed by it, along with a function
+// to close the layer. If a media type is given, the layer is decompressed
+// according to it (after checking the layer's contents against it),
+// otherwise the compression is sniffed from its contents. If a digest or diff ID is
+// given, the compressed or uncompressed contents are verified against it.
+// The files of eStargz and zstd:chunked layers are instead read on demand
+// (see loadTOC).
+func Load(ctx context.Context, tempDir string, imageFS fs.FS, desc Descriptor, opts *Options) (fs.FS, func() error, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	layerPath, mediaType := desc.Path, desc.MediaType
+
+	if err := checkMediaType(mediaType, opts); err != nil {
+		return nil, nil, err
+	}
+
+	lim := opts.limiter
+	if lim == nil {
+		lim = &limiter{limits: opts.Limits}
+	}
+
+	start := time.Now()
+
+	cacheKey := desc.Digest
+	if cacheKey == "" {
+		cacheKey = desc.DiffID
+	}
+	if opts.CacheDir == "" {
+		cacheKey = ""
+	}
+
+	// The digest names the cache entry, so must not be able to escape it.
+	if cacheKey != "" {
+		if err := cacheKey.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid layer digest %q: %w", cacheKey, err)
+		}
+
+		defer lockCached(opts.CacheDir, cacheKey)()
+	}
+
+	if cacheKey != "" {
+		fsys, close, err := loadCached(opts.CacheDir, cacheKey, opts.StrictPaths, lim)
+		if errors.Is(err, ErrUnsafePath) || errors.Is(err, ErrLimitExceeded) {
+			return nil, nil, err
+		} else if err != nil {
+			slog.Warn("Ignoring cached layer", slog.String("layer", layerPath), slog.Any("error", err))
+		} else if fsys != nil {
+			slog.Debug("Using cached layer", slog.String("layer", layerPath))
+
+			if opts.OnLoad != nil {
+				stats := Stats{Path: layerPath, Cached: true, Duration: time.Since(start)}
+				if fi, err := fs.Stat(imageFS, layerPath); err == nil {
+					stats.Size = fi.Size()
+				}
+				if fi, err := os.Stat(cachePath(opts.CacheDir, cacheKey)); err == nil {
+					stats.UncompressedSize = fi.Size()
+				}
+				opts.OnLoad(stats)
+			}
+
+			return fsys, close, nil
+		}
+	}
+
+	f, err := imageFS.Open(layerPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to stat layer: %w", err)
+	}
+
+	// The files of layers with a table of contents are read from the blob as
+	// they are needed, so it is kept open (and never cached).
+	if fsys, uncompressedSize, err := loadTOC(ctx, f, fi.Size(), desc, opts, lim); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	} else if fsys != nil {
+		slog.Debug("Reading layer using its table of contents", slog.String("layer", layerPath))
+
+		if opts.OnLoad != nil {
+			opts.OnLoad(Stats{
+				Path:             layerPath,
+				Size:             fi.Size(),
+				UncompressedSize: uncompressedSize,
+				Duration:         time.Since(start),
+			})
+		}
+
+		return fsys, f.Close, nil
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if opts.Progress != nil {
+		r = progress.Reader(r, opts.Progress, progress.Event{
+			Stage: progress.StageDecompress,
+			Item:  layerPath,
+			Total: fi.Size(),
+		})
+	}
+
+	if desc.Digest != "" {
+		r, err = util.VerifyingReader(r, desc.Digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to verify layer: %w", err)
+		}
+	}
+
+	br := bufio.NewReader(r)
+
+	dr, mediaTypeWarned, err := newLayerDecompressor(br, layerPath, mediaType, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dr.Close()
+
+	var tr io.Reader = dr
+
+	if desc.DiffID != "" {
+		tr, err = util.VerifyingReader(tr, desc.DiffID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to verify layer: %w", err)
+		}
+	}
+
+	// Layer paths are not necessarily unique by base name (eg. "<id>/layer.tar").
+	buf := &spillBuffer{
+		tempDir: tempDir,
+		pattern: filepath.Base(layerPath) + "-*.tar",
+		limit:   opts.MemoryLimit,
+	}
+
+	warned, err := normalize(buf, util.ContextReader(ctx, tr), layerPath, opts, lim)
+	if err == nil {
+		err = buf.Finish()
+	}
+	if err != nil {
+		_ = buf.Close()
+		return nil, nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	// The tar reader stops at the end of archive marker, so read any trailing
+	// data for the digests to be checked.
+	if desc.DiffID != "" {
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			_ = buf.Close()
+			return nil, nil, fmt.Errorf("failed to read layer: %w", err)
+		}
+	}
+
+	if desc.Digest != "" {
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			_ = buf.Close()
+			return nil, nil, fmt.Errorf("failed to read layer: %w", err)
+		}
+	}
+
+	if buf.Spilled() && opts.MemoryLimit > 0 {
+		slog.Debug("Layer exceeds memory limit, spilled to disk", slog.String("layer", layerPath))
+	}
+
+	fsys, err := util.OpenTar(buf.ReaderAt())
+	if err != nil {
+		_ = buf.Close()
+		return nil, nil, fmt.Errorf("failed to open decompressed layer: %w", err)
+	}
+
+	// Failing to cache a layer does not prevent it from being used. Layers
+	// that raised warnings are not cached, so that they raise them again.
+	if cacheKey != "" && !warned && !mediaTypeWarned {
+		if err := storeCached(opts.CacheDir, cacheKey, io.NewSectionReader(buf.ReaderAt(), 0, buf.Size())); err != nil {
+			slog.Warn("Failed to cache layer", slog.String("layer", layerPath), slog.Any("error", err))
+		}
+	}
+
+	if opts.OnLoad != nil {
+		opts.OnLoad(Stats{
+			Path:             layerPath,
+			Size:             fi.Size(),
+			UncompressedSize: buf.Size(),
+			Duration:         time.Since(start),
+		})
+	}
+
+	return fsys, buf.Close, nil
+}
+
+// loadCached returns a file system backed by the cached layer with the given
+// digest, or nil if it is not cached. Unreadable entries are removed from
+// the cache. The entries of the cached layer are checked again (if strictPaths
+// is set or limits apply), as it may have been cached by a less strict
+// conversion.
+func loadCached(cacheDir string, dgst digest.Digest, strictPaths bool, lim *limiter) (fs.FS, func() error, error) {
+	f, err := openCached(cacheDir, dgst)
+	if err != nil || f == nil {
+		return nil, nil, err
+	}
+
+	if strictPaths || lim.limits != (Limits{}) {
+		var pc pathChecker
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				_ = f.Close()
+				_ = os.Remove(f.Name())
+				return nil, nil, fmt.Errorf("failed to read cached layer: %w", err)
+			}
+
+			// Dot names at the root were anchored by normalize.
+			hdr.Name = unanchor(hdr.Name)
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = unanchor(hdr.Linkname)
+			}
+
+			if err := pc.check(hdr, strictPaths); err != nil {
+				_ = f.Close()
+				return nil, nil, err
+			}
+
+			if err := lim.add(hdr); err != nil {
+				_ = f.Close()
+				return nil, nil, err
+			}
+		}
+	}
+
+	fsys, err := util.OpenTar(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("failed to open cached layer: %w", err)
+	}
+
+	return fsys, f.Close, nil
+}
+
+// normalize copies the tar archive from src to dst, deferring directory
+// entries until after all other entries. tarfs synthesizes a default entry
+// for the parent directories of every file it sees, so an explicit directory
+// entry must come last for its mode, owner and times to be retained. Hard
+// links are deferred too, and those whose target is not in the layer are
+// dropped. Links to other links are pointed at the file itself, as tarfs only
+// resolves a link to a link if it happens to resolve the target first. If opts.SkipSpecialFiles is set, device nodes and FIFOs are
+// dropped, as are entries of unsupported types. If
+// opts.PlaceholderSpecialFiles is set, device nodes and FIFOs are replaced by
+// empty regular files instead. Every entry that is dropped or replaced, or
+// that has extended attributes, raises a warning (see Options.OnWarning), and
+// warned is set.
+//
+// Entries at the root whose names start with a dot (eg. whiteouts) are
+// written as absolute paths, as tarfs would otherwise drop the dot (see
+// util.AnchorTarPath). A directory of that kind holding other entries keeps
+// its relative name, as tarfs cannot resolve the parent of anything beneath
+// an absolute one.
+//
+// Entries are always rewritten in the PAX format, as archive/tar otherwise
+// rounds modification times to the second for headers whose format it could
+// not determine (eg. ustar entries with PAX records written by bsdtar).
+// Sparse entries (GNU or PAX) are expanded into regular files; dst should
+// leave the resulting runs of zeros as holes (see sparseWriter).
+func normalize(dst io.Writer, src io.Reader, layerPath string, opts *Options, lim *limiter) (warned bool, err error) {
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+
+	warn := func(kind warning.Kind, name, message string) error {
+		warned = true
+		return warning.Emit(opts.OnWarning, &warning.Warning{Kind: kind, Layer: layerPath, Path: name, Message: message})
+	}
+
+	type link struct {
+		hdr   *tar.Header
+		index int
+	}
+
+	var pc pathChecker
+	var dirs []*tar.Header
+	var links []link
+	// The dot directories at the root that hold other entries.
+	dotParents := make(map[string]bool)
+	// The index of the last entry written for each name, as later entries
+	// replace earlier ones (including deferred hard links).
+	written := make(map[string]int)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return warned, err
+		}
+
+		if err := pc.check(hdr, opts.StrictPaths); err != nil {
+			return warned, err
+		}
+
+		if err := lim.add(hdr); err != nil {
+			return warned, err
+		}
+
+		hdr.Format = tar.FormatPAX
+		if root, _, nested := strings.Cut(cleanPath(hdr.Name), "/"); nested && strings.HasPrefix(root, ".") {
+			dotParents[root] = true
+		}
+		if hdr.Typeflag == tar.TypeGNUSparse || hdr.Typeflag == tar.TypeCont {
+			hdr.Typeflag = tar.TypeReg
+		}
+
+		if names := xattrNames(hdr); len(names) > 0 {
+			if err := warn(warning.KindXattrs, hdr.Name, "extended attributes are not stored: "+strings.Join(names, ", ")); err != nil {
+				return warned, err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeLink:
+			links = append(links, link{hdr: hdr, index: index})
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			switch {
+			case opts.SkipSpecialFiles:
+				if err := warn(warning.KindSpecialFile, hdr.Name, "skipped device node or FIFO"); err != nil {
+					return warned, err
+				}
+				continue
+			case opts.PlaceholderSpecialFiles:
+				if err := warn(warning.KindSpecialFile, hdr.Name, "replaced device node or FIFO with an empty file"); err != nil {
+					return warned, err
+				}
+				hdr.Typeflag = tar.TypeReg
+				hdr.Size = 0
+				hdr.Devmajor, hdr.Devminor = 0, 0
+			default:
+				return warned, fmt.Errorf("%w: %q is a device node or FIFO", unsupported.ErrUnsupportedFile, hdr.Name)
+			}
+		case tar.TypeReg, tar.TypeSymlink, tar.TypeXGlobalHeader:
+		default:
+			if opts.SkipSpecialFiles {
+				if err := warn(warning.KindUnsupportedType, hdr.Name, fmt.Sprintf("skipped entry of unsupported type %q", hdr.Typeflag)); err != nil {
+					return warned, err
+				}
+				continue
+			}
+		}
+
+		if err := writeHeader(tw, hdr); err != nil {
+			return warned, err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return warned, fmt.Errorf("failed to copy contents of %q: %w", hdr.Name, err)
+		}
+
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			written[cleanPath(hdr.Name)] = index
+		}
+	}
+
+	// The file that each hard link written so far refers to.
+	linked := make(map[string]string)
+	for _, l := range links {
+		if i, ok := written[cleanPath(l.hdr.Name)]; ok && i > l.index {
+			continue
+		}
+
+		if file, ok := linked[cleanPath(l.hdr.Linkname)]; ok {
+			l.hdr.Linkname = file
+		}
+
+		if _, ok := written[cleanPath(l.hdr.Linkname)]; !ok {
+			if err := warn(warning.KindHardLink, l.hdr.Name, fmt.Sprintf("skipped hard link to missing file %q", l.hdr.Linkname)); err != nil {
+				return warned, err
+			}
+			continue
+		}
+
+		linked[cleanPath(l.hdr.Name)] = cleanPath(l.hdr.Linkname)
+
+		l.hdr.Linkname = util.AnchorTarPath(l.hdr.Linkname)
+		if err := writeHeader(tw, l.hdr); err != nil {
+			return warned, err
+		}
+	}
+
+	for _, hdr := range dirs {
+		if dotParents[cleanPath(hdr.Name)] {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return warned, fmt.Errorf("failed to write header for %q: %w", hdr.Name, err)
+			}
+			continue
+		}
+
+		if err := writeHeader(tw, hdr); err != nil {
+			return warned, err
+		}
+	}
+
+	return warned, tw.Close()
+}
+
+// writeHeader writes the header of an entry, anchoring its name if it is a
+// dot name at the root.
+func writeHeader(tw *tar.Writer, hdr *tar.Header) error {
+	name := hdr.Name
+	hdr.Name = util.AnchorTarPath(name)
+	defer func() { hdr.Name = name }()
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write header for %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// unanchor reverses util.AnchorTarPath.
+func unanchor(name string) string {
+	if relative, ok := strings.CutPrefix(name, "/"); ok && util.AnchorTarPath(relative) == name {
+		return relative
+	}
+
+	return name
+}
+
+// cleanPath cleans the name of a tar entry for comparison.
+func cleanPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// xattrNames returns the names of the extended attributes recorded in the
+// PAX records of the entry, in order.
+func xattrNames(hdr *tar.Header) []string {
+	var names []string
+	for key := range hdr.PAXRecords {
+		for _, prefix := range []string{"SCHILY.xattr.", "LIBARCHIVE.xattr."} {
+			if name, ok := strings.CutPrefix(key, prefix); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+
+	return slices.Compact(names)
+}
+
+// pathChecker checks that the entries of a layer stay within the root
+// filesystem.
+type pathChecker struct {
+	// symlinks are the (cleaned) paths of the symbolic links seen so far.
+	symlinks map[string]bool
+}
+
+// check verifies the entry. Absolute and escaping paths are always rejected.
+// If strict is set, so are entries beneath a symbolic link seen earlier in
+// the layer (which would otherwise be written through it), and symbolic
+// links whose relative targets climb above the root filesystem.
+func (pc *pathChecker) check(hdr *tar.Header, strict bool) error {
+	if err := checkPath(hdr.Name); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		if err := checkPath(hdr.Linkname); err != nil {
+			return fmt.Errorf("hard link %q: %w", hdr.Name, err)
+		}
+	}
+
+	if !strict {
+		return nil
+	}
+
+	name := path.Clean(filepath.ToSlash(hdr.Name))
+
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if pc.symlinks[dir] {
+			return fmt.Errorf("%w: %q is beneath the symbolic link %q", ErrUnsafePath, hdr.Name, dir)
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		linkname := path.Clean(filepath.ToSlash(hdr.Linkname))
+		for dir := linkname; dir != "."; dir = path.Dir(dir) {
+			if pc.symlinks[dir] {
+				return fmt.Errorf("%w: hard link %q refers through the symbolic link %q", ErrUnsafePath, hdr.Name, dir)
+			}
+		}
+	}
+
+	// A later entry replaces an earlier symbolic link.
+	if hdr.Typeflag != tar.TypeSymlink {
+		delete(pc.symlinks, name)
+		return nil
+	}
+
+	target := filepath.ToSlash(hdr.Linkname)
+	if !path.IsAbs(target) {
+		if resolved := path.Join(path.Dir(name), target); resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return fmt.Errorf("%w: symbolic link %q -> %q escapes the root filesystem", ErrUnsafePath, hdr.Name, hdr.Linkname)
+		}
+	}
+
+	if pc.symlinks == nil {
+		pc.symlinks = make(map[string]bool)
+	}
+	pc.symlinks[name] = true
+
+	return nil
+}
+
+// checkPath verifies that the given entry name stays within the root filesystem.
+func checkPath(name string) error {
+	name = filepath.ToSlash(name)
+
+	if path.IsAbs(name) {
+		return fmt.Errorf("%w: %q is absolute", ErrUnsafePath, name)
+	}
+
+	if cleaned := path.Clean(name); cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("%w: %q escapes the root filesystem", ErrUnsafePath, name)
+	}
+
+	return nil
+}
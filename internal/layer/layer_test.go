@@ -0,0 +1,1168 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/immutos/oci2erofs/internal/tocfs"
+	"github.com/immutos/oci2erofs/internal/unsupported"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("Directory Metadata", func(t *testing.T) {
+		// The explicit directory entry precedes its children.
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0o700, Uid: 1000, Gid: 1000}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo/a", Mode: 0o644}, Content: "hello world\n"},
+		})
+
+		fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, close())
+		})
+
+		fi, err := fs.Stat(fsys, "foo")
+		require.NoError(t, err)
+
+		require.True(t, fi.IsDir())
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+
+		content, err := fs.ReadFile(fsys, "foo/a")
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", string(content))
+	})
+	t.Run("Root Dot Names", func(t *testing.T) {
+		lowerDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "opt/app", Mode: 0o755}, Content: "lower"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/data", Mode: 0o644}, Content: "lower"},
+		})
+		upperDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: ".wh.opt", Mode: 0o644}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "./.dockerenv", Mode: 0o644}, Content: "upper"},
+			{Header: tar.Header{Typeflag: tar.TypeLink, Name: ".dockerenv-link", Linkname: ".dockerenv"}},
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: ".empty/", Mode: 0o700}},
+		})
+		opaqueDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: ".wh..wh..opq", Mode: 0o644}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/fresh", Mode: 0o644}, Content: "opaque"},
+		})
+
+		load := func(t *testing.T, dir string) fs.FS {
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(dir), layer.Descriptor{Path: "layer"}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			return fsys
+		}
+
+		lower, upper := load(t, lowerDir), load(t, upperDir)
+
+		fsys, err := overlayfs.New([]fs.FS{lower, upper})
+		require.NoError(t, err)
+
+		entries, err := fs.ReadDir(fsys, ".")
+		require.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		require.Equal(t, []string{".dockerenv", ".dockerenv-link", ".empty", "srv"}, names)
+
+		content, err := fs.ReadFile(fsys, ".dockerenv-link")
+		require.NoError(t, err)
+		require.Equal(t, "upper", string(content))
+
+		fi, err := fs.Stat(fsys, ".empty")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+
+		t.Run("Opaque", func(t *testing.T) {
+			fsys, err := overlayfs.New([]fs.FS{lower, upper, load(t, opaqueDir)})
+			require.NoError(t, err)
+
+			entries, err := fs.ReadDir(fsys, ".")
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			require.Equal(t, "srv", entries[0].Name())
+		})
+
+		t.Run("Cached", func(t *testing.T) {
+			layerData, err := os.ReadFile(filepath.Join(upperDir, "layer"))
+			require.NoError(t, err)
+
+			desc := layer.Descriptor{Path: "layer", Digest: digest.FromBytes(layerData)}
+			opts := &layer.Options{CacheDir: t.TempDir(), StrictPaths: true}
+
+			// The anchored names pass the checks of the cached layer.
+			for i := 0; i < 2; i++ {
+				fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(upperDir), desc, opts)
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					require.NoError(t, close())
+				})
+
+				content, err := fs.ReadFile(fsys, ".dockerenv")
+				require.NoError(t, err)
+				require.Equal(t, "upper", string(content))
+			}
+		})
+
+		t.Run("Nested", func(t *testing.T) {
+			// tarfs cannot hold entries beneath a dot directory at the root,
+			// so the directory loses its dot rather than failing to load.
+			fsys := load(t, writeLayer(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeDir, Name: ".config/", Mode: 0o755}},
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: ".config/app", Mode: 0o644}, Content: "nested"},
+			}))
+
+			content, err := fs.ReadFile(fsys, "config/app")
+			require.NoError(t, err)
+			require.Equal(t, "nested", string(content))
+		})
+	})
+	t.Run("Hard Link Chains", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "a/file", Mode: 0o644}, Content: "hello world\n"},
+			{Header: tar.Header{Typeflag: tar.TypeLink, Name: "b/link", Linkname: "a/file"}},
+			{Header: tar.Header{Typeflag: tar.TypeLink, Name: "c/chained", Linkname: "b/link"}},
+		})
+
+		fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, close())
+		})
+
+		fi, err := fs.Stat(fsys, "c/chained")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+		require.Equal(t, fs.FileMode(0o644), fi.Mode().Perm())
+
+		content, err := fs.ReadFile(fsys, "c/chained")
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", string(content))
+
+		file, err := util.HardLinkID(fsys, "a/file")
+		require.NoError(t, err)
+		require.NotNil(t, file)
+
+		chained, err := util.HardLinkID(fsys, "c/chained")
+		require.NoError(t, err)
+		require.Equal(t, file, chained)
+	})
+	t.Run("Unsafe Paths", func(t *testing.T) {
+		for _, name := range []string{"../etc/passwd", "foo/../../etc/passwd", "/abs/path"} {
+			t.Run(name, func(t *testing.T) {
+				imageDir := writeLayer(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, Content: "root::0:0::/:/bin/sh\n"},
+				})
+
+				_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+				require.ErrorIs(t, err, layer.ErrUnsafePath)
+				require.ErrorContains(t, err, name)
+			})
+		}
+
+		t.Run("Hard Link", func(t *testing.T) {
+			imageDir := writeLayer(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeLink, Name: "shadow", Linkname: "../etc/shadow"}},
+			})
+
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+			require.ErrorIs(t, err, layer.ErrUnsafePath)
+		})
+
+		t.Run("Internal Parent Reference", func(t *testing.T) {
+			imageDir := writeLayer(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo/../bar", Mode: 0o644}, Content: "bar\n"},
+			})
+
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			content, err := fs.ReadFile(fsys, "bar")
+			require.NoError(t, err)
+			require.Equal(t, "bar\n", string(content))
+		})
+
+		t.Run("Strict", func(t *testing.T) {
+			hostile := map[string][]testutil.File{
+				"Beneath Symlink": {
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc", Linkname: "/host/etc"}},
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644}, Content: "root::0:0::/:/bin/sh\n"},
+				},
+				"Beneath Nested Symlink": {
+					{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/lib", Linkname: "/"}},
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/./lib/x/evil", Mode: 0o644}, Content: "evil\n"},
+				},
+				"Hard Link Through Symlink": {
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "root", Linkname: "/"}},
+					{Header: tar.Header{Typeflag: tar.TypeLink, Name: "shadow", Linkname: "root/etc/shadow"}},
+				},
+				"Escaping Symlink": {
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "foo/passwd", Linkname: "../../etc/passwd"}},
+				},
+			}
+
+			for name, files := range hostile {
+				t.Run(name, func(t *testing.T) {
+					imageDir := writeLayer(t, files)
+
+					_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+						StrictPaths: true,
+					})
+					require.ErrorIs(t, err, layer.ErrUnsafePath)
+				})
+			}
+
+			t.Run("Safe", func(t *testing.T) {
+				imageDir := writeLayer(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "/bin/busybox"}},
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/sh", Linkname: "../../bin/sh"}},
+					// A directory replacing an earlier symlink.
+					{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"}},
+					{Header: tar.Header{Typeflag: tar.TypeDir, Name: "lib/", Mode: 0o755}},
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "lib/libc.so", Mode: 0o644}, Content: "libc\n"},
+				})
+
+				_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+					StrictPaths: true,
+				})
+				require.NoError(t, err)
+				require.NoError(t, close())
+			})
+
+			t.Run("Cached", func(t *testing.T) {
+				imageDir := writeLayer(t, hostile["Escaping Symlink"])
+
+				layerData, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+				require.NoError(t, err)
+
+				desc := layer.Descriptor{Path: "layer", Digest: digest.FromBytes(layerData)}
+				cacheDir := t.TempDir()
+
+				// Cached by a lenient conversion.
+				_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, &layer.Options{
+					CacheDir: cacheDir,
+				})
+				require.NoError(t, err)
+				require.NoError(t, close())
+
+				_, _, err = layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, &layer.Options{
+					CacheDir:    cacheDir,
+					StrictPaths: true,
+				})
+				require.ErrorIs(t, err, layer.ErrUnsafePath)
+			})
+		})
+
+		t.Run("Digest Escaping Cache", func(t *testing.T) {
+			imageDir := writeLayer(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+			})
+
+			cacheDir := filepath.Join(t.TempDir(), "cache")
+
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{
+				Path:   "layer",
+				Digest: "sha256:../../../../escaped",
+			}, &layer.Options{CacheDir: cacheDir})
+			require.Error(t, err)
+
+			_, err = os.Stat(filepath.Join(filepath.Dir(cacheDir), "escaped.tar"))
+			require.ErrorIs(t, err, fs.ErrNotExist)
+		})
+	})
+	t.Run("Limits", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644}, Content: "hello\n"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "b", Mode: 0o644}, Content: "hello world\n"},
+		})
+
+		for name, limits := range map[string]layer.Limits{
+			"File Size":  {MaxFileSize: 8},
+			"Total Size": {MaxSize: 16},
+			"Entries":    {MaxEntries: 1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+					Limits: limits,
+				})
+				require.ErrorIs(t, err, layer.ErrLimitExceeded)
+			})
+		}
+
+		t.Run("Within Limits", func(t *testing.T) {
+			_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+				Limits: layer.Limits{MaxSize: 18, MaxFileSize: 12, MaxEntries: 2},
+			})
+			require.NoError(t, err)
+			require.NoError(t, close())
+		})
+
+		t.Run("Bomb", func(t *testing.T) {
+			// A (truncated) entry claiming to be 1 PiB is rejected before any of
+			// its contents are read.
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "zeros", Mode: 0o644, Size: 1 << 50}))
+
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "layer"), append(buf.Bytes(), make([]byte, 4096)...), 0o644))
+
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(dir), layer.Descriptor{Path: "layer"}, &layer.Options{
+				Limits: layer.Limits{MaxSize: 1 << 30},
+			})
+			require.ErrorIs(t, err, layer.ErrLimitExceeded)
+		})
+	})
+	t.Run("Media Type Mismatch", func(t *testing.T) {
+		// An uncompressed layer that claims to be gzip compressed.
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+		})
+
+		t.Run("Strict", func(t *testing.T) {
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayerGzip}, nil)
+			require.ErrorIs(t, err, layer.ErrMediaTypeMismatch)
+		})
+
+		t.Run("Lenient", func(t *testing.T) {
+			var warnings []*warning.Warning
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayerGzip}, &layer.Options{
+				LenientMediaType: true,
+				OnWarning: func(w *warning.Warning) error {
+					warnings = append(warnings, w)
+					return nil
+				},
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			content, err := fs.ReadFile(fsys, "foo")
+			require.NoError(t, err)
+			require.Equal(t, "foo\n", string(content))
+
+			require.Len(t, warnings, 1)
+			require.Equal(t, warning.KindMediaType, warnings[0].Kind)
+			require.Equal(t, "layer", warnings[0].Layer)
+
+			t.Run("Strict Warnings", func(t *testing.T) {
+				errStrict := errors.New("strict")
+				_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayerGzip}, &layer.Options{
+					LenientMediaType: true,
+					OnWarning: func(*warning.Warning) error {
+						return errStrict
+					},
+				})
+				require.ErrorIs(t, err, errStrict)
+			})
+		})
+
+		t.Run("Matching", func(t *testing.T) {
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayer}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			_, err = fs.Stat(fsys, "foo")
+			require.NoError(t, err)
+		})
+	})
+	t.Run("Unsupported Media Type", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+		})
+
+		t.Run("Zstd", func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+			require.NoError(t, err)
+
+			enc, err := zstd.NewWriter(nil)
+			require.NoError(t, err)
+
+			zstdDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(zstdDir, "layer"), enc.EncodeAll(data, nil), 0o644))
+
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(zstdDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayerZstd}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			content, err := fs.ReadFile(fsys, "foo")
+			require.NoError(t, err)
+			require.Equal(t, "foo\n", string(content))
+		})
+
+		t.Run("Unrecognized", func(t *testing.T) {
+			desc := layer.Descriptor{Path: "layer", MediaType: "application/vnd.example.layer.v1.tar+lz77"}
+
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, nil)
+			require.ErrorIs(t, err, layer.ErrUnsupportedMediaType)
+
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, &layer.Options{
+				LenientMediaType: true,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			_, err = fs.Stat(fsys, "foo")
+			require.NoError(t, err)
+		})
+
+		t.Run("Custom Decompressor", func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+			require.NoError(t, err)
+
+			encodedDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(encodedDir, "layer"), []byte(base64.StdEncoding.EncodeToString(data)), 0o644))
+
+			const mediaType = "application/vnd.example.layer.v1.tar+base64"
+
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(encodedDir), layer.Descriptor{Path: "layer", MediaType: mediaType}, &layer.Options{
+				Decompressors: map[string]layer.Decompressor{
+					mediaType: func(r io.Reader) (io.ReadCloser, error) {
+						return io.NopCloser(base64.NewDecoder(base64.StdEncoding, r)), nil
+					},
+				},
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			content, err := fs.ReadFile(fsys, "foo")
+			require.NoError(t, err)
+			require.Equal(t, "foo\n", string(content))
+		})
+
+		t.Run("Foreign", func(t *testing.T) {
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", MediaType: ocispecs.MediaTypeImageLayerNonDistributable}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			_, err = fs.Stat(fsys, "foo")
+			require.NoError(t, err)
+
+			require.True(t, layer.IsForeignMediaType("application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"))
+			require.False(t, layer.IsForeignMediaType(ocispecs.MediaTypeImageLayerGzip))
+		})
+	})
+	t.Run("Digest Verification", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+		})
+
+		data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+		require.NoError(t, err)
+
+		// The layer is uncompressed, so its digest is also its diff ID.
+		dgst := digest.FromBytes(data)
+		wrong := digest.FromString("tampered")
+
+		t.Run("Matching", func(t *testing.T) {
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", Digest: dgst, DiffID: dgst}, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			_, err = fs.Stat(fsys, "foo")
+			require.NoError(t, err)
+		})
+
+		t.Run("Digest Mismatch", func(t *testing.T) {
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", Digest: wrong}, nil)
+			require.ErrorIs(t, err, util.ErrDigestMismatch)
+		})
+
+		t.Run("Diff ID Mismatch", func(t *testing.T) {
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", DiffID: wrong}, nil)
+			require.ErrorIs(t, err, util.ErrDigestMismatch)
+		})
+	})
+	t.Run("Special Files", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+		})
+
+		t.Run("Strict", func(t *testing.T) {
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, nil)
+			require.ErrorIs(t, err, unsupported.ErrUnsupportedFile)
+			require.ErrorContains(t, err, "unsupported file type")
+		})
+
+		t.Run("Skipped", func(t *testing.T) {
+			var warnings []*warning.Warning
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+				SkipSpecialFiles: true,
+				OnWarning: func(w *warning.Warning) error {
+					warnings = append(warnings, w)
+					return nil
+				},
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			_, err = fs.Stat(fsys, "dev/null")
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			_, err = fs.Stat(fsys, "foo")
+			require.NoError(t, err)
+
+			require.Len(t, warnings, 1)
+			require.Equal(t, warning.KindSpecialFile, warnings[0].Kind)
+			require.Equal(t, "layer", warnings[0].Layer)
+			require.Equal(t, "dev/null", warnings[0].Path)
+		})
+
+		t.Run("Placeholder", func(t *testing.T) {
+			var warnings []*warning.Warning
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+				PlaceholderSpecialFiles: true,
+				OnWarning: func(w *warning.Warning) error {
+					warnings = append(warnings, w)
+					return nil
+				},
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			fi, err := fs.Stat(fsys, "dev/null")
+			require.NoError(t, err)
+			require.True(t, fi.Mode().IsRegular())
+			require.Equal(t, fs.FileMode(0o666), fi.Mode().Perm())
+			require.Zero(t, fi.Size())
+
+			require.Len(t, warnings, 1)
+			require.Equal(t, warning.KindSpecialFile, warnings[0].Kind)
+			require.Equal(t, "dev/null", warnings[0].Path)
+		})
+	})
+	t.Run("Warnings", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeLink, Name: "early", Linkname: "foo"}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644, PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": "\x01",
+				"SCHILY.xattr.user.comment":        "hello",
+			}}, Content: "foo\n"},
+			{Header: tar.Header{Typeflag: tar.TypeLink, Name: "dangling", Linkname: "missing"}},
+			{Header: tar.Header{Typeflag: 'Z', Name: "unknown", Mode: 0o644}},
+		})
+
+		opts := func(warnings *[]*warning.Warning, err error) *layer.Options {
+			return &layer.Options{
+				SkipSpecialFiles: true,
+				OnWarning: func(w *warning.Warning) error {
+					*warnings = append(*warnings, w)
+					return err
+				},
+			}
+		}
+
+		t.Run("Reported", func(t *testing.T) {
+			var warnings []*warning.Warning
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, opts(&warnings, nil))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			kinds := make(map[string]warning.Kind)
+			for _, w := range warnings {
+				kinds[w.Path] = w.Kind
+			}
+			require.Equal(t, map[string]warning.Kind{
+				"foo":      warning.KindXattrs,
+				"unknown":  warning.KindUnsupportedType,
+				"dangling": warning.KindHardLink,
+			}, kinds)
+			require.Contains(t, warnings[0].Message, "security.capability, user.comment")
+
+			// A hard link to a later entry is still resolved.
+			data, err := fs.ReadFile(fsys, "early")
+			require.NoError(t, err)
+			require.Equal(t, "foo\n", string(data))
+
+			for _, name := range []string{"dangling", "unknown"} {
+				_, err = fs.Stat(fsys, name)
+				require.ErrorIs(t, err, fs.ErrNotExist)
+			}
+		})
+
+		t.Run("Error", func(t *testing.T) {
+			errStrict := errors.New("strict")
+
+			var warnings []*warning.Warning
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, opts(&warnings, errStrict))
+			require.ErrorIs(t, err, errStrict)
+			require.Len(t, warnings, 1)
+		})
+
+		t.Run("Not Cached", func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+			require.NoError(t, err)
+
+			cacheDir := t.TempDir()
+			for i := 0; i < 2; i++ {
+				var warnings []*warning.Warning
+				o := opts(&warnings, nil)
+				o.CacheDir = cacheDir
+
+				_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), layer.Descriptor{Path: "layer", Digest: digest.FromBytes(data)}, o)
+				require.NoError(t, err)
+				require.NoError(t, close())
+				require.Len(t, warnings, 3)
+			}
+		})
+	})
+	t.Run("Cache", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: "foo\n"},
+		})
+
+		data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+		require.NoError(t, err)
+
+		desc := layer.Descriptor{Path: "layer", Digest: digest.FromBytes(data)}
+		opts := &layer.Options{CacheDir: t.TempDir()}
+
+		_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, opts)
+		require.NoError(t, err)
+		require.NoError(t, close())
+
+		// The layer is no longer present in the image, so must come from the cache.
+		fsys, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(t.TempDir()), desc, opts)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, close())
+		})
+
+		content, err := fs.ReadFile(fsys, "foo")
+		require.NoError(t, err)
+		require.Equal(t, "foo\n", string(content))
+	})
+	t.Run("Concurrent Cache", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: strings.Repeat("foo\n", 1<<20)},
+		})
+
+		data, err := os.ReadFile(filepath.Join(imageDir, "layer"))
+		require.NoError(t, err)
+
+		desc := layer.Descriptor{Path: "layer", Digest: digest.FromBytes(data)}
+		cacheDir := t.TempDir()
+
+		// Only the first of the concurrent loads should decompress the layer.
+		var mu sync.Mutex
+		var cached int
+		opts := &layer.Options{
+			CacheDir: cacheDir,
+			OnLoad: func(stats layer.Stats) {
+				mu.Lock()
+				defer mu.Unlock()
+				if stats.Cached {
+					cached++
+				}
+			},
+		}
+
+		const loads = 8
+
+		errs := make(chan error, loads)
+		for range loads {
+			go func() {
+				_, close, err := layer.Load(context.Background(), t.TempDir(), os.DirFS(imageDir), desc, opts)
+				if err == nil {
+					err = close()
+				}
+				errs <- err
+			}()
+		}
+
+		for range loads {
+			require.NoError(t, <-errs)
+		}
+
+		require.Equal(t, loads-1, cached)
+	})
+	t.Run("Memory Limit", func(t *testing.T) {
+		imageDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0o644}, Content: strings.Repeat("a", 4096)},
+		})
+
+		for name, tc := range map[string]struct {
+			limit     int64
+			tempFiles int
+		}{
+			"In Memory": {limit: 1 << 20, tempFiles: 0},
+			"Spilled":   {limit: 1024, tempFiles: 1},
+			"Disabled":  {limit: 0, tempFiles: 1},
+		} {
+			t.Run(name, func(t *testing.T) {
+				tempDir := t.TempDir()
+
+				fsys, close, err := layer.Load(context.Background(), tempDir, os.DirFS(imageDir), layer.Descriptor{Path: "layer"}, &layer.Options{
+					MemoryLimit: tc.limit,
+				})
+				require.NoError(t, err)
+
+				entries, err := os.ReadDir(tempDir)
+				require.NoError(t, err)
+				require.Len(t, entries, tc.tempFiles)
+
+				content, err := fs.ReadFile(fsys, "foo")
+				require.NoError(t, err)
+				require.Equal(t, strings.Repeat("a", 4096), string(content))
+
+				require.NoError(t, close())
+
+				entries, err = os.ReadDir(tempDir)
+				require.NoError(t, err)
+				require.Empty(t, entries)
+			})
+		}
+
+		t.Run("Removed On Failure", func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			_, _, err := layer.Load(context.Background(), tempDir, os.DirFS(imageDir), layer.Descriptor{
+				Path:   "layer",
+				Digest: digest.FromString("wrong"),
+			}, &layer.Options{
+				MemoryLimit: 1024,
+			})
+			require.ErrorIs(t, err, util.ErrDigestMismatch)
+
+			entries, err := os.ReadDir(tempDir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	})
+	t.Run("eStargz", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/estargz/layer.tar.gz")
+		require.NoError(t, err)
+
+		desc := layer.Descriptor{
+			Path:      "layer.tar.gz",
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:    digest.FromBytes(data),
+		}
+
+		load := func(t *testing.T, tempDir string, opts *layer.Options) fs.FS {
+			fsys, close, err := layer.Load(context.Background(), tempDir, os.DirFS("testdata/estargz"), desc, opts)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			return fsys
+		}
+
+		tempDir := t.TempDir()
+		var stats layer.Stats
+		fsys := load(t, tempDir, &layer.Options{
+			OnLoad: func(s layer.Stats) { stats = s },
+		})
+
+		// Nothing is decompressed up front.
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		require.Equal(t, int64(10+12000+1216), stats.UncompressedSize)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(hostname))
+
+		// The same files as when the layer is fully decompressed.
+		decompressed := load(t, t.TempDir(), &layer.Options{IgnoreTOC: true})
+
+		var paths []string
+		err = fs.WalkDir(decompressed, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+
+			expected, err := d.Info()
+			require.NoError(t, err)
+
+			actual, err := fsys.(archivefs.ReadLinkFS).StatLink(path)
+			require.NoError(t, err, path)
+			require.Equal(t, expected.Mode(), actual.Mode(), path)
+			require.True(t, expected.ModTime().Equal(actual.ModTime()), path)
+
+			if d.Type().IsRegular() {
+				expected, err := fs.ReadFile(decompressed, path)
+				require.NoError(t, err)
+
+				actual, err := fs.ReadFile(fsys, path)
+				require.NoError(t, err)
+				require.Equal(t, expected, actual, path)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Contains(t, paths, "usr/bin/hello")
+
+		t.Run("Digest Mismatch", func(t *testing.T) {
+			_, _, err := layer.Load(context.Background(), t.TempDir(), os.DirFS("testdata/estargz"), layer.Descriptor{
+				Path:   desc.Path,
+				Digest: digest.FromString("tampered"),
+			}, nil)
+			require.ErrorIs(t, err, util.ErrDigestMismatch)
+		})
+
+		t.Run("Remote", func(t *testing.T) {
+			toc, err := tocfs.OpenEstargz(bytes.NewReader(data), int64(len(data)), nil)
+			require.NoError(t, err)
+
+			remoteDesc := desc
+			remoteDesc.Annotations = map[string]string{tocfs.TOCDigestAnnotation: toc.TOCDigest().String()}
+
+			// Remote blobs are not read in full, so only the table of
+			// contents is checked.
+			remoteDesc.Digest = digest.FromString("not checked")
+
+			fsys, close, err := layer.Load(context.Background(), t.TempDir(), remoteFS{os.DirFS("testdata/estargz")}, remoteDesc, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, close())
+			})
+
+			hello, err := fs.ReadFile(fsys, "usr/bin/hello")
+			require.NoError(t, err)
+			require.Equal(t, strings.Repeat("hello world\n", 1000), string(hello))
+
+			t.Run("TOC Digest Mismatch", func(t *testing.T) {
+				remoteDesc := remoteDesc
+				remoteDesc.Annotations = map[string]string{tocfs.TOCDigestAnnotation: digest.FromString("tampered").String()}
+
+				_, _, err := layer.Load(context.Background(), t.TempDir(), remoteFS{os.DirFS("testdata/estargz")}, remoteDesc, nil)
+				require.ErrorIs(t, err, util.ErrDigestMismatch)
+			})
+
+			t.Run("No TOC Digest", func(t *testing.T) {
+				// Read in full instead, which checks the blob digest.
+				remoteDesc := remoteDesc
+				remoteDesc.Annotations = nil
+
+				_, _, err := layer.Load(context.Background(), t.TempDir(), remoteFS{os.DirFS("testdata/estargz")}, remoteDesc, nil)
+				require.ErrorIs(t, err, util.ErrDigestMismatch)
+			})
+		})
+	})
+
+	t.Run("Sparse Files", func(t *testing.T) {
+		for _, name := range []string{"gnu.tar", "pax-0.0.tar", "pax-0.1.tar", "pax-1.0.tar"} {
+			t.Run(name, func(t *testing.T) {
+				data, err := os.ReadFile(filepath.Join("testdata/sparse", name))
+				require.NoError(t, err)
+
+				tempDir := t.TempDir()
+				cacheDir := t.TempDir()
+
+				fsys, close, err := layer.Load(context.Background(), tempDir, os.DirFS("testdata/sparse"), layer.Descriptor{
+					Path:   name,
+					DiffID: digest.FromBytes(data),
+				}, &layer.Options{
+					CacheDir: cacheDir,
+				})
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					require.NoError(t, close())
+				})
+
+				content, err := fs.ReadFile(fsys, "sparse")
+				require.NoError(t, err)
+				require.Len(t, content, 64<<20)
+				require.Equal(t, "head", string(content[:4]))
+				require.Equal(t, "tail", string(content[48<<20:48<<20+4]))
+
+				// The holes are not written out to disk.
+				for _, dir := range []string{tempDir, cacheDir} {
+					err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+						if err != nil || d.IsDir() {
+							return err
+						}
+
+						fi, err := d.Info()
+						require.NoError(t, err)
+						require.Greater(t, fi.Size(), int64(64<<20))
+						if usage, ok := util.DiskUsage(fi); ok {
+							require.Less(t, usage, int64(1<<20))
+						}
+						return nil
+					})
+					require.NoError(t, err)
+				}
+			})
+		}
+	})
+}
+
+// writeLayer writes an uncompressed layer containing the given files to a
+// temporary directory (as "layer") and returns the directory path.
+func writeLayer(t *testing.T, files []testutil.File) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "layer"), testutil.CreateTar(t, files), 0o644))
+
+	return dir
+}
+
+func TestLoadAll(t *testing.T) {
+	imageDir := t.TempDir()
+
+	var descriptors []layer.Descriptor
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("layer%d", i)
+		layerDir := writeLayer(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "index", Mode: 0o644}, Content: name},
+		})
+		require.NoError(t, os.Rename(filepath.Join(layerDir, "layer"), filepath.Join(imageDir, name)))
+
+		descriptors = append(descriptors, layer.Descriptor{Path: name})
+	}
+
+	t.Run("Ordered", func(t *testing.T) {
+		layers, closeAll, err := layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), descriptors, &layer.Options{
+			Jobs: 3,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		require.Len(t, layers, len(descriptors))
+		for i, fsys := range layers {
+			content, err := fs.ReadFile(fsys, "index")
+			require.NoError(t, err)
+			require.Equal(t, descriptors[i].Path, string(content))
+		}
+	})
+
+	t.Run("Cache Eviction", func(t *testing.T) {
+		var cached []layer.Descriptor
+		for _, desc := range descriptors[:2] {
+			data, err := os.ReadFile(filepath.Join(imageDir, desc.Path))
+			require.NoError(t, err)
+
+			desc.Digest = digest.FromBytes(data)
+			cached = append(cached, desc)
+		}
+
+		cacheDir := t.TempDir()
+		cachedPath := func(desc layer.Descriptor) string {
+			matches, err := filepath.Glob(filepath.Join(cacheDir, "*", "*", "sha256", desc.Digest.Encoded()+".tar"))
+			require.NoError(t, err)
+			if len(matches) == 0 {
+				return ""
+			}
+			return matches[0]
+		}
+
+		_, closeAll, err := layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), cached, &layer.Options{
+			CacheDir: cacheDir,
+		})
+		require.NoError(t, err)
+		require.NoError(t, closeAll())
+
+		// Make the first layer the least recently used.
+		first, second := cachedPath(cached[0]), cachedPath(cached[1])
+		require.NotEmpty(t, first)
+		require.NotEmpty(t, second)
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(first, old, old))
+
+		fi, err := os.Stat(second)
+		require.NoError(t, err)
+
+		_, closeAll, err = layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), cached[1:], &layer.Options{
+			CacheDir:     cacheDir,
+			CacheMaxSize: fi.Size(),
+		})
+		require.NoError(t, err)
+		require.NoError(t, closeAll())
+
+		require.Empty(t, cachedPath(cached[0]))
+		require.NotEmpty(t, cachedPath(cached[1]))
+	})
+
+	t.Run("Limits Across Layers", func(t *testing.T) {
+		// Each layer has a single 6 byte file.
+		_, _, err := layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), descriptors, &layer.Options{
+			Limits: layer.Limits{MaxEntries: int64(len(descriptors) - 1)},
+		})
+		require.ErrorIs(t, err, layer.ErrLimitExceeded)
+
+		layers, closeAll, err := layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), descriptors, &layer.Options{
+			Limits: layer.Limits{MaxEntries: int64(len(descriptors)), MaxSize: int64(6 * len(descriptors))},
+		})
+		require.NoError(t, err)
+		require.Len(t, layers, len(descriptors))
+		require.NoError(t, closeAll())
+	})
+
+	t.Run("Missing Layer", func(t *testing.T) {
+		_, _, err := layer.LoadAll(context.Background(), t.TempDir(), os.DirFS(imageDir), append(descriptors, layer.Descriptor{Path: "missing"}), nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := layer.LoadAll(ctx, t.TempDir(), os.DirFS(imageDir), descriptors, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestParseRange(t *testing.T) {
+	for s, expected := range map[string]layer.Range{
+		"1..2":  {Start: 1, End: 2},
+		"..-2":  {Start: 0, End: -2},
+		"3..":   {Start: 3, End: -1},
+		"..":    {Start: 0, End: -1},
+		"-2..":  {Start: -2, End: -1},
+		"0..0":  {Start: 0, End: 0},
+		"-3..1": {Start: -3, End: 1},
+	} {
+		r, err := layer.ParseRange(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, r, s)
+	}
+
+	for _, s := range []string{"", "1", "a..b", "1...2", "1-2"} {
+		_, err := layer.ParseRange(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	layers := []digest.Digest{digest.FromString("a"), digest.FromString("b"), digest.FromString("c")}
+
+	selected, err := layer.Select(layers, &layer.Range{Start: 1, End: -1}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, selected)
+
+	selected, err = layer.Select(layers, nil, []digest.Digest{layers[0], layers[2]})
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, selected)
+
+	_, err = layer.Select(layers, &layer.Range{Start: 2, End: 3}, nil)
+	require.Error(t, err)
+
+	_, err = layer.Select(layers, &layer.Range{Start: -1, End: 0}, nil)
+	require.Error(t, err)
+
+	_, err = layer.Select(layers, nil, []digest.Digest{digest.FromString("d")})
+	require.Error(t, err)
+
+	_, err = layer.Select(layers, &layer.Range{Start: 0, End: 0}, layers[:1])
+	require.ErrorIs(t, err, layer.ErrNoLayersSelected)
+}
+
+func TestLazy(t *testing.T) {
+	require.True(t, layer.Lazy(ocispecs.MediaTypeImageLayerGzip, map[string]string{
+		tocfs.TOCDigestAnnotation: "sha256:abc",
+	}))
+	require.True(t, layer.Lazy(ocispecs.MediaTypeImageLayerZstd, map[string]string{
+		tocfs.ManifestPositionAnnotation: "100:20:40:1",
+		tocfs.ManifestChecksumAnnotation: "sha256:abc",
+	}))
+
+	// Without a digest the table of contents cannot be trusted.
+	require.False(t, layer.Lazy(ocispecs.MediaTypeImageLayerZstd, map[string]string{
+		tocfs.ManifestPositionAnnotation: "100:20:40:1",
+	}))
+	require.False(t, layer.Lazy(ocispecs.MediaTypeImageLayerGzip, nil))
+	require.False(t, layer.Lazy(ocispecs.MediaTypeImageLayer, map[string]string{
+		tocfs.TOCDigestAnnotation: "sha256:abc",
+	}))
+}
+
+// remoteFS presents the files of a file system as remote blobs.
+type remoteFS struct {
+	fs.FS
+}
+
+func (fsys remoteFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return remoteFile{File: f, ReaderAt: f.(io.ReaderAt)}, nil
+}
+
+type remoteFile struct {
+	fs.File
+	io.ReaderAt
+}
+
+func (remoteFile) Remote() bool {
+	return true
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"sync/atomic"
+)
+
+// Limits caps the resources used by decompressing layers. Zero values are
+// unlimited.
+type Limits struct {
+	// MaxSize is the maximum total size in bytes of the file contents.
+	MaxSize int64
+	// MaxFileSize is the maximum size in bytes of a single file.
+	MaxFileSize int64
+	// MaxEntries is the maximum total number of entries.
+	MaxEntries int64
+}
+
+// limiter enforces Limits as the entries of one or more layers are read.
+type limiter struct {
+	limits  Limits
+	size    atomic.Int64
+	entries atomic.Int64
+}
+
+// add accounts for the entry, failing if a limit is exceeded. It is checked
+// before the contents are copied, so that sparse or highly compressible
+// entries are caught before they are written out.
+func (l *limiter) add(hdr *tar.Header) error {
+	if l.limits.MaxFileSize > 0 && hdr.Size > l.limits.MaxFileSize {
+		return fmt.Errorf("%w: %q is %d bytes, more than the maximum file size of %d bytes",
+			ErrLimitExceeded, hdr.Name, hdr.Size, l.limits.MaxFileSize)
+	}
+
+	if entries := l.entries.Add(1); l.limits.MaxEntries > 0 && entries > l.limits.MaxEntries {
+		return fmt.Errorf("%w: more than the maximum of %d entries", ErrLimitExceeded, l.limits.MaxEntries)
+	}
+
+	if size := l.size.Add(hdr.Size); l.limits.MaxSize > 0 && size > l.limits.MaxSize {
+		return fmt.Errorf("%w: more than the maximum total size of %d bytes", ErrLimitExceeded, l.limits.MaxSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"runtime"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+// Descriptor describes a layer to load.
+type Descriptor struct {
+	// Path is the path of the layer blob within the image.
+	Path string
+	// MediaType is the media type of the layer (may be empty).
+	MediaType string
+	// Digest is the digest of the layer blob as stored (may be empty).
+	Digest digest.Digest
+	// DiffID is the digest of the uncompressed layer tar (may be empty).
+	DiffID digest.Digest
+	// Annotations are the annotations of the layer descriptor (eg. the
+	// position of the table of contents of a zstd:chunked layer).
+	Annotations map[string]string
+}
+
+// LoadAll loads the given layers concurrently (see Options.Jobs), returning
+// their file systems in the same order, along with a function to close all
+// of them. If any layer fails to load, the layers loaded so far are closed.
+func LoadAll(ctx context.Context, tempDir string, imageFS fs.FS, descriptors []Descriptor, opts *Options) ([]fs.FS, func() error, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+
+	layers := make([]fs.FS, len(descriptors))
+	closers := make([]func() error, len(descriptors))
+
+	closeAll := func() error {
+		var firstErr error
+		for _, close := range closers {
+			if close == nil {
+				continue
+			}
+
+			if err := close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	// The limits apply to all the layers together.
+	lim := &limiter{limits: opts.Limits}
+
+	// Collect the statistics so that they are reported in layer order.
+	stats := make([]*Stats, len(descriptors))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	for i, desc := range descriptors {
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+
+			layerOpts := *opts
+			layerOpts.limiter = lim
+			if opts.OnLoad != nil {
+				layerOpts.OnLoad = func(s Stats) {
+					stats[i] = &s
+				}
+			}
+
+			layerFS, close, err := Load(gctx, tempDir, imageFS, desc, &layerOpts)
+			if err != nil {
+				return fmt.Errorf("failed to load layer %s: %w", desc.Path, err)
+			}
+
+			layers[i] = layerFS
+			closers[i] = close
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		_ = closeAll()
+
+		// Prefer the caller's cancellation over any errors it caused.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+
+		return nil, nil, err
+	}
+
+	if opts.OnLoad != nil {
+		for _, s := range stats {
+			if s != nil {
+				opts.OnLoad(*s)
+			}
+		}
+	}
+
+	if opts.CacheDir != "" && opts.CacheMaxSize > 0 {
+		if err := pruneCache(opts.CacheDir, opts.CacheMaxSize); err != nil {
+			slog.Warn("Failed to prune layer cache", slog.Any("error", err))
+		}
+	}
+
+	return layers, closeAll, nil
+}
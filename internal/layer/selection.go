@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrNoLayersSelected is returned when a layer selection excludes every
+// layer of an image.
+var ErrNoLayersSelected = errors.New("no layers selected")
+
+// Range selects a contiguous range of an image's layers. Start and End are
+// inclusive and count from 0 for the bottom layer. Negative indices count
+// back from the top layer, which is -1.
+type Range struct {
+	Start int
+	End   int
+}
+
+// ParseRange parses a layer range of the form "N..M" (eg. "0..2"). Either end
+// may be omitted to select from the bottom or up to the top layer, so
+// "..-2" selects every layer but the top one.
+func ParseRange(s string) (Range, error) {
+	startStr, endStr, ok := strings.Cut(s, "..")
+	if !ok {
+		return Range{}, fmt.Errorf("invalid layer range %q: expected N..M", s)
+	}
+
+	r := Range{Start: 0, End: -1}
+	if startStr != "" {
+		start, err := strconv.Atoi(startStr)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid layer range %q: %w", s, err)
+		}
+		r.Start = start
+	}
+
+	if endStr != "" {
+		end, err := strconv.Atoi(endStr)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid layer range %q: %w", s, err)
+		}
+		r.End = end
+	}
+
+	return r, nil
+}
+
+// String returns the range in the form accepted by ParseRange.
+func (r Range) String() string {
+	return fmt.Sprintf("%d..%d", r.Start, r.End)
+}
+
+// Select returns the indices of the layers, identified by their digests, that
+// are within r (if not nil) and not listed in skip. Every digest in skip must
+// identify one of the layers.
+func Select(layers []digest.Digest, r *Range, skip []digest.Digest) ([]int, error) {
+	for _, dgst := range skip {
+		if !slices.Contains(layers, dgst) {
+			return nil, fmt.Errorf("layer to skip %s is not in the image", dgst)
+		}
+	}
+
+	start, end := 0, len(layers)-1
+	if r != nil {
+		start, end = r.Start, r.End
+		if start < 0 {
+			start += len(layers)
+		}
+		if end < 0 {
+			end += len(layers)
+		}
+
+		if start < 0 || end >= len(layers) || start > end {
+			return nil, fmt.Errorf("layer range %s is out of bounds for an image with %d layers", r, len(layers))
+		}
+	}
+
+	var selected []int
+	for i := start; i <= end; i++ {
+		if !slices.Contains(skip, layers[i]) {
+			selected = append(selected, i)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, ErrNoLayersSelected
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// spillBuffer is a buffer that is held in memory until it grows beyond a
+// limit, at which point it is spilled to a temporary file.
+type spillBuffer struct {
+	tempDir string
+	pattern string
+	limit   int64
+	buf     bytes.Buffer
+	file    *sparseWriter
+	size    int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	n, err := b.write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *spillBuffer) write(p []byte) (int, error) {
+	if b.file == nil && int64(b.buf.Len()+len(p)) > b.limit {
+		f, err := os.CreateTemp(b.tempDir, b.pattern)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temporary tar file: %w", err)
+		}
+
+		// Set before writing, so that Close removes the file either way.
+		b.file = &sparseWriter{f: f}
+		if _, err := b.file.Write(b.buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("failed to write temporary tar file: %w", err)
+		}
+
+		b.buf = bytes.Buffer{}
+	}
+
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+
+	return b.buf.Write(p)
+}
+
+// Finish must be called once all data has been written to the buffer.
+func (b *spillBuffer) Finish() error {
+	if b.file != nil {
+		return b.file.Finish()
+	}
+
+	return nil
+}
+
+// ReaderAt returns a reader for the contents of the buffer.
+func (b *spillBuffer) ReaderAt() io.ReaderAt {
+	if b.file != nil {
+		return b.file.f
+	}
+
+	return bytes.NewReader(b.buf.Bytes())
+}
+
+// Size returns the number of bytes written to the buffer.
+func (b *spillBuffer) Size() int64 {
+	return b.size
+}
+
+// Spilled returns true if the buffer has been spilled to disk.
+func (b *spillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Close releases the buffer, removing its temporary file (if any).
+func (b *spillBuffer) Close() error {
+	b.buf = bytes.Buffer{}
+
+	if b.file == nil {
+		return nil
+	}
+
+	closeErr := b.file.f.Close()
+	if err := os.Remove(b.file.f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return closeErr
+}
+
+// sparseBlockSize is the granularity at which runs of zeros are left as holes.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// sparseWriter writes sequentially to a new file, seeking over blocks of
+// zeros rather than writing them so that they are left as holes. This keeps
+// the expanded contents of sparse tar entries from taking up disk space.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// Take the longest run of blocks that either all hold data or are all
+		// zeros. As the file is written sequentially, skipping zeros never
+		// leaves stale data behind.
+		n := w.blockLen(0, len(p))
+		zero := isZero(p[:n])
+		for n < len(p) {
+			blockLen := w.blockLen(n, len(p)-n)
+			if isZero(p[n:n+blockLen]) != zero {
+				break
+			}
+
+			n += blockLen
+		}
+
+		if !zero {
+			if _, err := w.f.WriteAt(p[:n], w.off); err != nil {
+				return written, err
+			}
+		}
+
+		w.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// blockLen returns the length of the block (up to remaining bytes) starting
+// n bytes past the current offset.
+func (w *sparseWriter) blockLen(n, remaining int) int {
+	return min(sparseBlockSize-int((w.off+int64(n))%sparseBlockSize), remaining)
+}
+
+// Finish extends the file over any trailing hole.
+func (w *sparseWriter) Finish() error {
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() < w.off {
+		return w.f.Truncate(w.off)
+	}
+
+	return nil
+}
+
+func isZero(p []byte) bool {
+	return bytes.Equal(p, zeroBlock[:len(p)])
+}
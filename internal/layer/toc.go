@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package layer
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/tocfs"
+	"github.com/immutos/oci2erofs/internal/unsupported"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/opencontainers/go-digest"
+)
+
+// RemoteFile is implemented by layer blobs that are read on demand (eg. with
+// ranged registry requests), rather than being held locally.
+type RemoteFile interface {
+	fs.File
+	io.ReaderAt
+	// Remote reports whether the blob is read on demand.
+	Remote() bool
+}
+
+// Lazy reports whether a layer with the given media type and descriptor
+// annotations can be read on demand: it has a table of contents whose digest
+// is recorded in the descriptor, so that the files that are needed can be
+// verified without reading the whole blob.
+func Lazy(mediaType string, annotations map[string]string) bool {
+	compression, ok := compressionForMediaType(mediaType)
+	switch {
+	case compression == CompressionZstd:
+		return annotations[tocfs.ManifestPositionAnnotation] != "" && annotations[tocfs.ManifestChecksumAnnotation] != ""
+	case !ok || compression == CompressionGzip:
+		return annotations[tocfs.TOCDigestAnnotation] != ""
+	default:
+		return false
+	}
+}
+
+// loadTOC returns a file system that reads the files of an eStargz or
+// zstd:chunked layer on demand using its table of contents, rather than
+// decompressing the whole layer up front. It returns nil if the layer has
+// no table of contents, or cannot be read this way.
+//
+// The table of contents is only trusted once the compressed blob has been
+// verified against its digest, so layers without one are always fully
+// decompressed. Remote blobs (see RemoteFile) are not read in full, instead
+// the table of contents is verified against the digest recorded in the
+// descriptor and the contents of files against its chunk digests. The diff
+// ID is not checked, as that would require decompressing the layer.
+func loadTOC(ctx context.Context, f fs.File, size int64, desc Descriptor, opts *Options, lim *limiter) (fs.FS, int64, error) {
+	ra, ok := f.(io.ReaderAt)
+	if !ok || desc.Digest == "" || opts.IgnoreTOC {
+		return nil, 0, nil
+	}
+
+	if _, ok := opts.Decompressors[desc.MediaType]; ok {
+		return nil, 0, nil
+	}
+
+	var open func(check func(hdr *tar.Header) (bool, error)) (*tocfs.FS, error)
+	var tocDigest digest.Digest
+
+	compression, ok := compressionForMediaType(desc.MediaType)
+	position := desc.Annotations[tocfs.ManifestPositionAnnotation]
+	switch {
+	case compression == CompressionZstd && position != "":
+		open = func(check func(hdr *tar.Header) (bool, error)) (*tocfs.FS, error) {
+			return tocfs.OpenZstdChunked(ra, size, position, check)
+		}
+		tocDigest = digest.Digest(desc.Annotations[tocfs.ManifestChecksumAnnotation])
+	case (!ok || compression == CompressionGzip) && tocfs.DetectEstargz(ra, size):
+		open = func(check func(hdr *tar.Header) (bool, error)) (*tocfs.FS, error) {
+			return tocfs.OpenEstargz(ra, size, check)
+		}
+		tocDigest = digest.Digest(desc.Annotations[tocfs.TOCDigestAnnotation])
+	default:
+		return nil, 0, nil
+	}
+
+	rf, remote := f.(RemoteFile)
+	remote = remote && rf.Remote()
+	if remote && tocDigest == "" {
+		// Nothing to verify the table of contents against.
+		return nil, 0, nil
+	}
+
+	if !remote {
+		var r io.Reader = io.NewSectionReader(ra, 0, size)
+		if opts.Progress != nil {
+			r = progress.Reader(r, opts.Progress, progress.Event{
+				Stage: progress.StageDecompress,
+				Item:  desc.Path,
+				Total: size,
+			})
+		}
+
+		vr, err := util.VerifyingReader(util.ContextReader(ctx, r), desc.Digest)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to verify layer: %w", err)
+		}
+
+		if _, err := io.Copy(io.Discard, vr); err != nil {
+			return nil, 0, fmt.Errorf("failed to verify layer: %w", err)
+		}
+	}
+
+	warn := func(kind warning.Kind, name, message string) error {
+		return warning.Emit(opts.OnWarning, &warning.Warning{Kind: kind, Layer: desc.Path, Path: name, Message: message})
+	}
+
+	var pc pathChecker
+	var uncompressedSize int64
+	fsys, err := open(func(hdr *tar.Header) (bool, error) {
+		if err := pc.check(hdr, opts.StrictPaths); err != nil {
+			return false, err
+		}
+
+		if err := lim.add(hdr); err != nil {
+			return false, err
+		}
+
+		if names := xattrNames(hdr); len(names) > 0 {
+			if err := warn(warning.KindXattrs, hdr.Name, "extended attributes are not stored: "+strings.Join(names, ", ")); err != nil {
+				return false, err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			switch {
+			case opts.SkipSpecialFiles:
+				return false, warn(warning.KindSpecialFile, hdr.Name, "skipped device node or FIFO")
+			case !opts.PlaceholderSpecialFiles:
+				return false, fmt.Errorf("%w: %q is a device node or FIFO", unsupported.ErrUnsupportedFile, hdr.Name)
+			}
+			// The entries cannot be rewritten in place, so are left for the
+			// consumer to replace (see unsupported.FS).
+		}
+
+		uncompressedSize += hdr.Size
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read layer table of contents: %w", err)
+	}
+
+	if remote {
+		if fsys.TOCDigest() != tocDigest {
+			return nil, 0, fmt.Errorf("layer table of contents %w: expected %s, got %s", util.ErrDigestMismatch, tocDigest, fsys.TOCDigest())
+		}
+
+		if err := fsys.VerifyContents(); err != nil {
+			return nil, 0, fmt.Errorf("failed to read layer table of contents: %w", err)
+		}
+	}
+
+	return fsys, uncompressedSize, nil
+}
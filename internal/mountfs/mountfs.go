@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package mountfs presents a file system at a path beneath the root, so that
+// it can be stacked onto an image as an overlay layer.
+package mountfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
+)
+
+// FS is a file system with another file system mounted at a target path.
+// The directories leading up to the target are synthesized, as is the root
+// directory (even when mounting at the root), so that stacking the file
+// system onto an image never changes the owner of the image root.
+type FS struct {
+	fsys   archivefs.ReadLinkFS
+	target string
+	base   fs.FS
+}
+
+// New returns a file system with fsys mounted at target (eg. "/etc/app").
+// The synthesized directories leading up to the target take their metadata
+// from base (eg. the image the file system is stacked onto), if it has them.
+func New(fsys archivefs.ReadLinkFS, target string, base fs.FS) *FS {
+	return &FS{
+		fsys:   fsys,
+		target: strings.TrimPrefix(path.Clean("/"+target), "/"),
+		base:   base,
+	}
+}
+
+func (m *FS) Open(name string) (fs.File, error) {
+	rel, parent, err := m.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent {
+		fi, err := m.parentInfo(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &parentDir{fi: fi, m: m, name: name}, nil
+	}
+
+	return m.fsys.Open(rel)
+}
+
+func (m *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	rel, parent, err := m.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent {
+		child := m.target
+		if name != "." {
+			child = strings.TrimPrefix(m.target, name+"/")
+		}
+		child, _, _ = strings.Cut(child, "/")
+
+		fi, err := m.StatLink(path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+
+		return []fs.DirEntry{fs.FileInfoToDirEntry(fi)}, nil
+	}
+
+	return fs.ReadDir(m.fsys, rel)
+}
+
+func (m *FS) Stat(name string) (fs.FileInfo, error) {
+	rel, parent, err := m.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent || name == "." {
+		return m.parentInfo(name)
+	}
+
+	fi, err := fs.Stat(m.fsys, rel)
+	return renamed(fi, name, rel), err
+}
+
+func (m *FS) ReadLink(name string) (string, error) {
+	rel, parent, err := m.resolve("readlink", name)
+	if err != nil {
+		return "", err
+	}
+
+	if parent {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return m.fsys.ReadLink(rel)
+}
+
+func (m *FS) StatLink(name string) (fs.FileInfo, error) {
+	rel, parent, err := m.resolve("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent || name == "." {
+		return m.parentInfo(name)
+	}
+
+	fi, err := m.fsys.StatLink(rel)
+	return renamed(fi, name, rel), err
+}
+
+// resolve returns the path of name within the mounted file system, or
+// whether it is one of the synthesized directories leading up to it.
+func (m *FS) HardLinkID(name string) (any, error) {
+	rel, parent, err := m.resolve("hardlinkid", name)
+	if err != nil || parent {
+		return nil, err
+	}
+
+	return util.HardLinkID(m.fsys, rel)
+}
+
+func (m *FS) resolve(op, name string) (rel string, parent bool, err error) {
+	if !fs.ValidPath(name) {
+		return "", false, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	switch {
+	case m.target == "":
+		return name, false, nil
+	case name == m.target:
+		return ".", false, nil
+	case strings.HasPrefix(name, m.target+"/"):
+		return strings.TrimPrefix(name, m.target+"/"), false, nil
+	case name == "." || strings.HasPrefix(m.target, name+"/"):
+		return "", true, nil
+	default:
+		return "", false, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+}
+
+// parentInfo describes one of the synthesized directories.
+func (m *FS) parentInfo(name string) (fs.FileInfo, error) {
+	if m.base != nil {
+		fi, err := fs.Stat(m.base, name)
+		if err == nil && fi.IsDir() {
+			return fi, nil
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return &dirInfo{name: path.Base(name)}, nil
+}
+
+// renamed gives the root of the mounted file system the base name of the
+// target, rather than that of eg. the host directory.
+func renamed(fi fs.FileInfo, name, rel string) fs.FileInfo {
+	if fi == nil || rel != "." {
+		return fi
+	}
+
+	return &namedInfo{FileInfo: fi, name: path.Base(name)}
+}
+
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi *namedInfo) Name() string {
+	return fi.name
+}
+
+// parentDir is an open synthesized directory.
+type parentDir struct {
+	fi     fs.FileInfo
+	m      *FS
+	name   string
+	listed bool
+}
+
+func (d *parentDir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *parentDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *parentDir) Close() error {
+	return nil
+}
+
+func (d *parentDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.listed {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.listed = true
+
+	return d.m.ReadDir(d.name)
+}
+
+// dirInfo describes a synthesized directory that is not in the base file
+// system.
+type dirInfo struct {
+	name string
+}
+
+func (fi *dirInfo) Name() string       { return fi.name }
+func (fi *dirInfo) Size() int64        { return 0 }
+func (fi *dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (fi *dirInfo) ModTime() time.Time { return time.Time{} }
+func (fi *dirInfo) IsDir() bool        { return true }
+func (fi *dirInfo) Sys() any           { return nil }
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mountfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+	"github.com/immutos/oci2erofs/internal/mountfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "keys"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keys", "key.pem"), []byte("key\n"), 0o600))
+	require.NoError(t, os.Symlink("keys/key.pem", filepath.Join(dir, "default.pem")))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o750, Uid: 10}))
+	require.NoError(t, tw.Close())
+
+	base, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	fsys := mountfs.New(dirfs.New(dir), "/etc/app/", base)
+
+	var paths []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, path)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{".", "etc", "etc/app", "etc/app/default.pem", "etc/app/keys", "etc/app/keys/key.pem"}, paths)
+
+	// Parent directories take their metadata from the base file system.
+	fi, err := fsys.Stat("etc")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDir|0o750, fi.Mode())
+	require.Equal(t, 10, fi.Sys().(*tar.Header).Uid)
+
+	fi, err = fsys.Stat("etc/app")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	data, err := fs.ReadFile(fsys, "etc/app/keys/key.pem")
+	require.NoError(t, err)
+	require.Equal(t, "key\n", string(data))
+
+	target, err := fsys.ReadLink("etc/app/default.pem")
+	require.NoError(t, err)
+	require.Equal(t, "keys/key.pem", target)
+
+	_, err = fsys.Stat("etc/hostname")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	t.Run("Root", func(t *testing.T) {
+		fsys := mountfs.New(dirfs.New(dir), "/", nil)
+
+		entries, err := fsys.ReadDir(".")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+
+		// The root directory is always synthesized.
+		fi, err := fsys.Stat(".")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o755, fi.Mode())
+		require.Nil(t, fi.Sys())
+	})
+}
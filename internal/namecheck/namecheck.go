@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package namecheck finds the entries of a root filesystem whose names cannot
+// be stored in an EROFS image (and would be rejected when it is mounted), or
+// that differ only by case from another entry in the same directory (and so
+// would collide if the image were extracted onto a case-insensitive file
+// system).
+package namecheck
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs/erofs"
+)
+
+// Problem is an entry with an unusable name.
+type Problem struct {
+	// Path is the path of the entry within the root filesystem.
+	Path string `json:"path"`
+	// Layer describes the layer that provides the entry, if known.
+	Layer string `json:"layer,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Layer != "" {
+		return fmt.Sprintf("%s (from layer %s): %s", p.Path, p.Layer, p.Message)
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+// Check walks the root filesystem, returning every problem found rather than
+// stopping at the first. If layer is set, it is called to describe the layer
+// providing each offending entry. An error is only returned if the walk could
+// not be completed.
+func Check(ctx context.Context, fsys fs.FS, layer func(name string) string) ([]Problem, error) {
+	var problems []Problem
+	report := func(name, message string) {
+		p := Problem{Path: name, Message: message}
+		if layer != nil {
+			p.Layer = layer(name)
+		}
+		problems = append(problems, p)
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		// The first entry seen with each case folded name.
+		folded := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			entryPath := path.Join(name, entry.Name())
+
+			if message := checkName(entry.Name()); message != "" {
+				report(entryPath, message)
+				continue
+			}
+
+			key := strings.ToLower(entry.Name())
+			if other, ok := folded[key]; ok {
+				report(entryPath, fmt.Sprintf("differs only by case from %s", path.Join(name, other)))
+				continue
+			}
+			folded[key] = entry.Name()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+// checkName describes what is wrong with a name, if anything.
+func checkName(name string) string {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Sprintf("%q is not a valid name", name)
+	case strings.ContainsRune(name, 0):
+		return "name contains a NUL byte"
+	case strings.ContainsRune(name, '/'):
+		return "name contains a slash"
+	case len(name) > erofs.MaxNameLen:
+		return fmt.Sprintf("name is %d bytes long, longer than the maximum of %d", len(name), erofs.MaxNameLen)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package namecheck_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/namecheck"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/hostname":               &fstest.MapFile{Data: []byte("localhost\n")},
+		"etc/HOSTNAME":               &fstest.MapFile{Data: []byte("LOCALHOST\n")},
+		"usr/share/" + long(256):     &fstest.MapFile{},
+		"usr/share/" + long(255):     &fstest.MapFile{},
+		"usr/share/nul\x00name":      &fstest.MapFile{},
+		"usr/share/Makefile":         &fstest.MapFile{},
+		"usr/share/makefile.d/Other": &fstest.MapFile{},
+	}
+
+	t.Run("Problems", func(t *testing.T) {
+		problems, err := namecheck.Check(context.Background(), fsys, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, []namecheck.Problem{
+			{Path: "etc/hostname", Message: "differs only by case from etc/HOSTNAME"},
+			{Path: "usr/share/" + long(256), Message: "name is 256 bytes long, longer than the maximum of 255"},
+			{Path: "usr/share/nul\x00name", Message: "name contains a NUL byte"},
+		}, problems)
+	})
+
+	t.Run("Layer", func(t *testing.T) {
+		problems, err := namecheck.Check(context.Background(), fsys, func(name string) string {
+			return "layer of " + name
+		})
+		require.NoError(t, err)
+		require.Len(t, problems, 3)
+		require.Equal(t, "etc/hostname (from layer layer of etc/hostname): differs only by case from etc/HOSTNAME", problems[0].String())
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		problems, err := namecheck.Check(context.Background(), fstest.MapFS{
+			"etc/hostname": &fstest.MapFile{},
+			"etc/hosts":    &fstest.MapFile{},
+		}, nil)
+		require.NoError(t, err)
+		require.Empty(t, problems)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := namecheck.Check(ctx, fsys, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func long(n int) string {
+	return strings.Repeat("a", n)
+}
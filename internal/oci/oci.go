@@ -19,55 +19,244 @@
 package oci
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
 
-	"github.com/containerd/containerd/platforms"
-	"github.com/dpeckett/archivefs/tarfs"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/provenance"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// LoadImage loads an OCI image from the given imageFS, ref, and platform.
-// It returns an overlayfs.FS of the image's root filesystem, a function to
-// close the image, and an error if any.
-func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform) (fs.FS, func() error, error) {
-	if err := verifyImageLayoutVersion(imageFS); err != nil {
+// Docker distribution media types, which are structurally compatible with
+// their OCI counterparts.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// MediaTypeArtifactManifest is the media type of the artifact manifests of
+// the OCI 1.1 release candidates. The final release replaced them with image
+// manifests that have an artifact type.
+const MediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
+
+// Docker image config media type, which is structurally compatible with
+// the OCI image config.
+const mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+// ErrManifestTooLarge is returned when an image index or manifest exceeds
+// the maximum allowed size.
+var ErrManifestTooLarge = util.ErrManifestTooLarge
+
+// ErrDigestMismatch is returned when a blob does not match the digest it is
+// referenced by.
+var ErrDigestMismatch = util.ErrDigestMismatch
+
+// ErrArtifact is returned when the selected manifest is an artifact (eg. an
+// SBOM, signature or attestation) rather than an image, or an artifact of a
+// type other than Options.ArtifactType.
+var ErrArtifact = errors.New("manifest is not an image")
+
+// ErrUnsupportedLayout is returned when the oci-layout file of an image
+// layout is missing, malformed, or has an unaccepted version.
+var ErrUnsupportedLayout = errors.New("unsupported image layout")
+
+// ErrRefNotFound is returned when no manifest matches the ref.
+var ErrRefNotFound = util.ErrRefNotFound
+
+// ErrPlatformNotFound is returned when the image has no manifest for the
+// platform.
+var ErrPlatformNotFound = util.ErrPlatformNotFound
+
+// MaxIndexDepth is the maximum number of image indexes (including the
+// top-level one) that are followed to reach a manifest.
+const MaxIndexDepth = 8
+
+// ErrIndexTooDeep is returned when image indexes are nested more than
+// MaxIndexDepth levels deep.
+var ErrIndexTooDeep = errors.New("image index nesting too deep")
+
+// ErrMissingForeignLayer is returned when the blob of a foreign layer is not
+// in the image (and AllowMissingForeignLayers is not set).
+var ErrMissingForeignLayer = errors.New("missing foreign layer")
+
+// Options configures how an OCI image is loaded.
+type Options struct {
+	// FirstManifest selects the first manifest of an image index when no
+	// platform is specified, rather than the manifest best matching the host
+	// platform.
+	FirstManifest bool
+	// Layer configures how the image layers are loaded.
+	Layer layer.Options
+	// LayoutVersions are the accepted oci-layout imageLayoutVersion values
+	// (defaults to ocispecs.ImageLayoutVersion).
+	LayoutVersions []string
+	// BlobDirs are searched, in order, for blobs missing from the layout (see
+	// NewLayoutProvider).
+	BlobDirs []fs.FS
+	// BestEffortLayout proceeds with a warning if the oci-layout file is
+	// missing or has an unaccepted version, as long as the index and blobs
+	// are present.
+	BestEffortLayout bool
+	// MaxManifestSize is the maximum size in bytes of the image index and
+	// manifest documents (defaults to util.DefaultMaxManifestSize).
+	MaxManifestSize int64
+	// EmbedProvenance stores a manifest recording which layer each file
+	// came from inside the root filesystem (see provenance.Path).
+	EmbedProvenance bool
+	// LayerRange, if set, selects the range of the image's layers to load.
+	LayerRange *layer.Range
+	// SkipLayers are the digests of layers that are not loaded.
+	SkipLayers []digest.Digest
+	// OnResolve, if set, is called with the digest of the manifest that the
+	// ref and platform resolved to.
+	OnResolve func(digest.Digest)
+	// OnConfig, if set, is called with the image config document, as stored
+	// in the image.
+	OnConfig func([]byte)
+	// OnProvenance, if set, is called with a manifest recording which layer
+	// each file in the root filesystem came from.
+	OnProvenance func(*provenance.Manifest)
+	// OnLayers, if set, is called with the descriptors of the layers that
+	// are about to be loaded. An error aborts loading (eg. if there is not
+	// enough disk space to decompress them).
+	OnLayers func([]ocispecs.Descriptor) error
+	// OnReferrers, if set, is called with the files of an OCI image layout
+	// (see ReferrersLayout) holding the referrers of the image manifest.
+	OnReferrers func(map[string][]byte)
+	// AllowMissingForeignLayers skips foreign layers whose blobs are not in
+	// the image (with a warning), rather than failing.
+	AllowMissingForeignLayers bool
+	// ArtifactType, if set, selects artifacts of this type (whose layers
+	// must be tarballs) rather than images. Other manifests are skipped when
+	// resolving the ref.
+	ArtifactType string
+}
+
+// LoadImage loads an OCI image from the OCI image layout imageFS, with the
+// given ref and platform. It returns an overlayfs.FS of the image's root
+// filesystem, a function to close the image, and an error if any. Loading is
+// aborted if the context is cancelled.
+func LoadImage(ctx context.Context, tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform, opts *Options) (fs.FS, func() error, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if err := verifyImageLayout(imageFS, opts); err != nil {
 		return nil, nil, err
 	}
 
-	manifest, err := manifestForRef(imageFS, ref, platform)
+	return LoadImageFrom(ctx, tempDir, NewLayoutProvider(imageFS, opts.BlobDirs...), ref, platform, opts)
+}
+
+// LoadImageFrom is like LoadImage, but loads the image from the given blob
+// provider.
+func LoadImageFrom(ctx context.Context, tempDir string, blobs BlobProvider, ref string, platform *ocispecs.Platform, opts *Options) (fs.FS, func() error, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	manifestDigest, manifest, err := manifestForRef(ctx, blobs, ref, platform, opts)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var layers []fs.FS
-	var closers []func() error
+	if opts.OnResolve != nil {
+		opts.OnResolve(manifestDigest)
+	}
+
+	collectProvenance := opts.EmbedProvenance || opts.OnProvenance != nil
+
+	var history []ocispecs.History
+	if opts.OnConfig != nil || collectProvenance {
+		config, err := readBlobData(ctx, blobs, manifest.Config.Digest, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read config: %w", err)
+		}
+
+		if opts.OnConfig != nil {
+			opts.OnConfig(config)
+		}
+
+		// Artifacts may not have an image config, so the history is best
+		// effort.
+		var image ocispecs.Image
+		if err := json.Unmarshal(config, &image); err == nil {
+			history = provenance.LayerHistory(image.History, len(manifest.Layers))
+		}
+	}
+
+	if opts.OnReferrers != nil {
+		referrers, err := Referrers(ctx, blobs, manifestDigest, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find referrers: %w", err)
+		}
 
-	for _, layerDescriptor := range manifest.Layers {
-		layerPath := filepath.Join("blobs", string(layerDescriptor.Digest.Algorithm()), layerDescriptor.Digest.Encoded())
-		layer, close, err := loadLayer(tempDir, imageFS, layerPath)
+		layout, err := ReferrersLayout(ctx, blobs, referrers, opts)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		layers = append(layers, layer)
-		closers = append(closers, close)
+		slog.Debug("Found referrers", slog.Int("count", len(referrers)))
+
+		opts.OnReferrers(layout)
 	}
 
-	closeAll := func() error {
-		for _, close := range closers {
-			if err := close(); err != nil {
-				return err
+	selected, err := selectLayers(manifest.Layers, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var descriptors []layer.Descriptor
+	var layerDescriptors []ocispecs.Descriptor
+	var layerHistory []ocispecs.History
+	for _, i := range selected {
+		layerDescriptor := manifest.Layers[i]
+		if IsForeignLayer(layerDescriptor) {
+			f, err := blobs.OpenBlob(ctx, layerDescriptor.Digest)
+			if err == nil {
+				_ = f.Close()
+			} else if errors.Is(err, fs.ErrNotExist) {
+				if !opts.AllowMissingForeignLayers {
+					return nil, nil, fmt.Errorf("%w: %s", ErrMissingForeignLayer, layerDescriptor.Digest)
+				}
+
+				slog.Warn("Skipping missing foreign layer", slog.String("digest", layerDescriptor.Digest.String()))
+				continue
 			}
 		}
-		return nil
+
+		layerDescriptors = append(layerDescriptors, layerDescriptor)
+		if history != nil {
+			layerHistory = append(layerHistory, history[i])
+		}
+		descriptors = append(descriptors, layer.Descriptor{
+			Path:        BlobPath(layerDescriptor.Digest),
+			MediaType:   layerDescriptor.MediaType,
+			Digest:      layerDescriptor.Digest,
+			Annotations: layerDescriptor.Annotations,
+		})
+	}
+
+	if opts.OnLayers != nil {
+		if err := opts.OnLayers(layerDescriptors); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	layers, closeAll, err := layer.LoadAll(ctx, tempDir, &blobFS{ctx: ctx, blobs: blobs}, descriptors, &opts.Layer)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	rootFS, err := overlayfs.New(layers)
@@ -76,49 +265,494 @@ func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Pla
 		return nil, nil, fmt.Errorf("failed to create overlayfs: %w", err)
 	}
 
+	if collectProvenance {
+		m, err := provenance.Collect(rootFS, layerDescriptors, layerHistory)
+		if err != nil {
+			_ = closeAll()
+			return nil, nil, fmt.Errorf("failed to collect provenance: %w", err)
+		}
+
+		if opts.OnProvenance != nil {
+			opts.OnProvenance(m)
+		}
+
+		if opts.EmbedProvenance {
+			rootFS, err = provenance.Embed(rootFS, m)
+			if err != nil {
+				_ = closeAll()
+				return nil, nil, fmt.Errorf("failed to embed provenance: %w", err)
+			}
+		}
+	}
+
 	return rootFS, closeAll, nil
 }
 
-func loadLayer(tempDir string, imageFS fs.FS, layerPath string) (fs.FS, func() error, error) {
-	f, err := imageFS.Open(layerPath)
+// selectLayers returns the indices of the layers of the manifest that are
+// selected by the layer range and the layers to skip.
+func selectLayers(layers []ocispecs.Descriptor, opts *Options) ([]int, error) {
+	if opts.LayerRange == nil && len(opts.SkipLayers) == 0 {
+		selected := make([]int, len(layers))
+		for i := range layers {
+			selected[i] = i
+		}
+
+		return selected, nil
+	}
+
+	digests := make([]digest.Digest, len(layers))
+	for i, desc := range layers {
+		digests[i] = desc.Digest
+	}
+
+	return layer.Select(digests, opts.LayerRange, opts.SkipLayers)
+}
+
+// IsArtifact reports whether the descriptor refers to an artifact (eg. an
+// SBOM, signature or attestation) rather than an image. Descriptors do not
+// always record the artifact type, so a manifest that is not known to be an
+// artifact may still turn out to be one.
+func IsArtifact(desc ocispecs.Descriptor) bool {
+	return desc.ArtifactType != "" || desc.MediaType == MediaTypeArtifactManifest
+}
+
+// FilterManifests returns the manifests that are candidates when resolving a
+// ref: images (and image indexes), or if artifactType is set, the artifacts
+// of that type.
+func FilterManifests(manifests []ocispecs.Descriptor, artifactType string) []ocispecs.Descriptor {
+	var filtered []ocispecs.Descriptor
+	for _, desc := range manifests {
+		if !matchesArtifactType(desc, artifactType) {
+			slog.Debug("Skipping manifest",
+				slog.String("digest", desc.Digest.String()),
+				slog.String("artifactType", desc.ArtifactType))
+			continue
+		}
+
+		filtered = append(filtered, desc)
+	}
+
+	return filtered
+}
+
+func matchesArtifactType(desc ocispecs.Descriptor, artifactType string) bool {
+	if artifactType == "" {
+		return !IsArtifact(desc)
+	}
+
+	// Image indexes may list artifacts of the type.
+	if desc.MediaType == ocispecs.MediaTypeImageIndex && desc.ArtifactType == "" {
+		return true
+	}
+
+	return desc.ArtifactType == artifactType
+}
+
+// manifestArtifactType returns the artifact type of a manifest, or an empty
+// string if it is an image.
+func manifestArtifactType(manifest *ocispecs.Manifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+
+	switch manifest.Config.MediaType {
+	case ocispecs.MediaTypeImageConfig, mediaTypeDockerConfig, "":
+		return ""
+	default:
+		// Artifacts without an artifact type are identified by their config.
+		return manifest.Config.MediaType
+	}
+}
+
+// checkArtifactType fails with ErrArtifact if the manifest is not of the
+// selected kind.
+func checkArtifactType(dgst digest.Digest, manifest *ocispecs.Manifest, opts *Options) error {
+	artifactType := manifestArtifactType(manifest)
+	if artifactType == opts.ArtifactType {
+		return nil
+	}
+
+	if opts.ArtifactType == "" {
+		return fmt.Errorf("%w: manifest %s is an artifact of type %s", ErrArtifact, dgst, artifactType)
+	}
+
+	if artifactType == "" {
+		return fmt.Errorf("%w: manifest %s is an image, not an artifact of type %s", ErrArtifact, dgst, opts.ArtifactType)
+	}
+
+	return fmt.Errorf("%w: manifest %s is an artifact of type %s, not %s", ErrArtifact, dgst, artifactType, opts.ArtifactType)
+}
+
+// describeSkipped explains why an artifact was not a candidate.
+func describeSkipped(desc ocispecs.Descriptor, opts *Options) error {
+	artifactType := desc.ArtifactType
+	if artifactType == "" {
+		artifactType = "unknown"
+	}
+
+	if opts.ArtifactType == "" {
+		return fmt.Errorf("%w: manifest %s is an artifact of type %s", ErrArtifact, desc.Digest, artifactType)
+	}
+
+	return fmt.Errorf("%w: manifest %s is an artifact of type %s, not %s", ErrArtifact, desc.Digest, artifactType, opts.ArtifactType)
+}
+
+// IsForeignLayer reports whether the described layer is a foreign layer,
+// whose blob may have to be downloaded from the URLs it lists.
+func IsForeignLayer(desc ocispecs.Descriptor) bool {
+	return layer.IsForeignMediaType(desc.MediaType) || len(desc.URLs) > 0
+}
+
+// digestFromRef returns the digest of a "sha256:...", "@sha256:..." or
+// "name@sha256:..." style reference.
+func digestFromRef(ref string) (digest.Digest, bool) {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		ref = ref[i+1:]
+	}
+
+	dgst, err := digest.Parse(ref)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
+		return "", false
+	}
+
+	return dgst, true
+}
+
+// AnnotationContainerdImageName is the annotation used by containerd to record
+// the full image name (alongside a bare tag in the ref name annotation).
+const AnnotationContainerdImageName = "io.containerd.image.name"
+
+// manifestForName finds the descriptor whose name annotations refer to ref.
+// Exact matches take precedence over normalized matches, which take
+// precedence over matching just the tag.
+func manifestForName(manifests []ocispecs.Descriptor, ref string) *ocispecs.Descriptor {
+	matchers := []func(desc ocispecs.Descriptor) bool{
+		func(desc ocispecs.Descriptor) bool {
+			return desc.Annotations[ocispecs.AnnotationRefName] == ref
+		},
+		func(desc ocispecs.Descriptor) bool {
+			for _, key := range []string{ocispecs.AnnotationRefName, AnnotationContainerdImageName} {
+				if name, ok := desc.Annotations[key]; ok && util.MatchesRef(name, ref) {
+					return true
+				}
+			}
+			return false
+		},
+		func(desc ocispecs.Descriptor) bool {
+			return util.MatchesTag(desc.Annotations[ocispecs.AnnotationRefName], ref)
+		},
+	}
+
+	for _, matches := range matchers {
+		for _, desc := range manifests {
+			if matches(desc) {
+				return &desc
+			}
+		}
+	}
+
+	return nil
+}
+
+// manifestForDigest finds the descriptor with the given digest, either in the
+// top-level index or in one of the (possibly nested) image indexes it
+// references.
+func manifestForDigest(ctx context.Context, blobs BlobProvider, manifests []ocispecs.Descriptor, dgst digest.Digest, opts *Options) (*ocispecs.Descriptor, error) {
+	return findManifest(ctx, blobs, manifests, dgst, 0, opts)
+}
+
+func findManifest(ctx context.Context, blobs BlobProvider, manifests []ocispecs.Descriptor, dgst digest.Digest, depth int, opts *Options) (*ocispecs.Descriptor, error) {
+	for _, desc := range manifests {
+		if desc.Digest == dgst {
+			return &desc, nil
+		}
+	}
+
+	for _, desc := range manifests {
+		if !isIndex(desc) {
+			continue
+		}
+
+		if depth >= MaxIndexDepth {
+			return nil, fmt.Errorf("%w: more than %d levels", ErrIndexTooDeep, MaxIndexDepth)
+		}
+
+		imageIndex, err := readIndex(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		found, err := findManifest(ctx, blobs, imageIndex.Manifests, dgst, depth+1, opts)
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+
+	return nil, nil
+}
+
+// IndexManifests returns the manifests of the image index with the given
+// digest, replacing those that are themselves image indexes with their
+// manifests (up to MaxIndexDepth levels deep). Manifests without a platform
+// inherit that of the nested index referencing them, if it has one.
+func IndexManifests(ctx context.Context, blobs BlobProvider, dgst digest.Digest, opts *Options) ([]ocispecs.Descriptor, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	return indexManifests(ctx, blobs, dgst, nil, 1, opts)
+}
+
+func indexManifests(ctx context.Context, blobs BlobProvider, dgst digest.Digest, platform *ocispecs.Platform, depth int, opts *Options) ([]ocispecs.Descriptor, error) {
+	imageIndex, err := readIndex(ctx, blobs, dgst, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []ocispecs.Descriptor
+	for _, desc := range imageIndex.Manifests {
+		if desc.Platform == nil {
+			desc.Platform = platform
+		}
+
+		if !isIndex(desc) {
+			manifests = append(manifests, desc)
+			continue
+		}
+
+		if depth >= MaxIndexDepth {
+			return nil, fmt.Errorf("%w: more than %d levels", ErrIndexTooDeep, MaxIndexDepth)
+		}
+
+		nested, err := indexManifests(ctx, blobs, desc.Digest, desc.Platform, depth+1, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, nested...)
+	}
+
+	return manifests, nil
+}
+
+// isIndex reports whether the descriptor is of an image index (or Docker
+// manifest list).
+func isIndex(desc ocispecs.Descriptor) bool {
+	return desc.MediaType == ocispecs.MediaTypeImageIndex || desc.MediaType == MediaTypeDockerManifestList
+}
+
+func readIndex(ctx context.Context, blobs BlobProvider, dgst digest.Digest, opts *Options) (*ocispecs.Index, error) {
+	var index ocispecs.Index
+	if err := readBlob(ctx, blobs, dgst, &index, opts); err != nil {
+		return nil, fmt.Errorf("failed to read image index: %w", err)
 	}
-	defer f.Close()
 
-	dr, err := uncompr.NewReader(f)
+	return &index, nil
+}
+
+func manifestForRef(ctx context.Context, blobs BlobProvider, ref string, platform *ocispecs.Platform, opts *Options) (digest.Digest, *ocispecs.Manifest, error) {
+	manifestDescriptor, err := descriptorForRef(ctx, blobs, ref, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create decompressing reader: %w", err)
+		return "", nil, err
+	}
+
+	switch manifestDescriptor.MediaType {
+	case ocispecs.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		indexManifests, err := IndexManifests(ctx, blobs, manifestDescriptor.Digest, opts)
+		if err != nil {
+			return "", nil, err
+		}
+
+		manifests, err := ResolvePlatforms(ctx, blobs, FilterManifests(indexManifests, opts.ArtifactType), opts)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Find the manifest for the platform.
+		manifestDescriptor, err = SelectManifest(manifests, platform, opts.FirstManifest)
+		if err != nil {
+			return "", nil, err
+		}
+	case ocispecs.MediaTypeImageManifest, MediaTypeDockerManifest:
+		// Check if the platform is correct. Descriptors often omit the
+		// platform, in which case the image config records it.
+		if platform != nil {
+			imagePlatform := manifestDescriptor.Platform
+			if imagePlatform == nil {
+				imagePlatform, err = configPlatform(ctx, blobs, manifestDescriptor.Digest, opts)
+				if err != nil {
+					return "", nil, err
+				}
+			}
+
+			matcher := util.NewPlatformMatcher(platform)
+			if imagePlatform == nil {
+				return "", nil, fmt.Errorf("%w: no manifest found for platform %s, the image does not record its platform", util.ErrPlatformNotFound, matcher)
+			} else if !matcher.Match(*imagePlatform) {
+				return "", nil, fmt.Errorf("%w: no manifest found for platform %s, available: %s", util.ErrPlatformNotFound, matcher, util.FormatPlatform(*imagePlatform))
+			}
+		}
+	case MediaTypeArtifactManifest:
+		return "", nil, fmt.Errorf("%w: manifest %s is an OCI 1.1 release candidate artifact manifest, which is not supported", ErrArtifact, manifestDescriptor.Digest)
+	default:
+		return "", nil, fmt.Errorf("unexpected manifest media type: %s", manifestDescriptor.MediaType)
 	}
-	defer dr.Close()
 
-	decompressedLayerPath := filepath.Join(tempDir, filepath.Base(layerPath)+".tar")
-	decompressedLayerFile, err := os.OpenFile(decompressedLayerPath, os.O_CREATE|os.O_RDWR, 0o644)
+	manifest, err := readManifest(ctx, blobs, manifestDescriptor.Digest, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temporary tar file: %w", err)
+		return "", nil, err
+	}
+
+	if err := checkArtifactType(manifestDescriptor.Digest, manifest, opts); err != nil {
+		return "", nil, err
+	}
+
+	return manifestDescriptor.Digest, manifest, nil
+}
+
+// Platforms returns the platforms provided by the image with the given ref
+// in the OCI image layout imageFS. Attestation manifests (which have an
+// "unknown/unknown" platform) are skipped.
+func Platforms(imageFS fs.FS, ref string, opts *Options) ([]ocispecs.Platform, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
 
-	if _, err := io.Copy(decompressedLayerFile, dr); err != nil {
-		return nil, nil, fmt.Errorf("failed to decompress layer: %w", err)
+	return PlatformsFrom(context.Background(), NewLayoutProvider(imageFS, opts.BlobDirs...), ref, opts)
+}
+
+// PlatformsFrom is like Platforms, but reads the image from the given blob
+// provider.
+func PlatformsFrom(ctx context.Context, blobs BlobProvider, ref string, opts *Options) ([]ocispecs.Platform, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
 
-	fsys, err := tarfs.Open(decompressedLayerFile)
+	desc, err := descriptorForRef(ctx, blobs, ref, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open decompressed layer: %w", err)
+		return nil, err
 	}
 
-	return fsys, decompressedLayerFile.Close, nil
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		indexManifests, err := IndexManifests(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests, err := ResolvePlatforms(ctx, blobs, indexManifests, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		var platforms []ocispecs.Platform
+		for _, desc := range PlatformManifests(manifests) {
+			platforms = append(platforms, *desc.Platform)
+		}
+
+		return platforms, nil
+	case ocispecs.MediaTypeImageManifest, MediaTypeDockerManifest:
+		if desc.Platform != nil {
+			return []ocispecs.Platform{*desc.Platform}, nil
+		}
+
+		// Fall back to the platform recorded in the image config.
+		manifest, err := readManifest(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		var config ocispecs.Image
+		if err := readBlob(ctx, blobs, manifest.Config.Digest, &config, opts); err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+
+		return []ocispecs.Platform{config.Platform}, nil
+	default:
+		return nil, fmt.Errorf("unexpected manifest media type: %s", desc.MediaType)
+	}
+}
+
+// ResolvePlatforms returns a copy of the manifests of an image index, with
+// the platform of image manifests whose descriptor omits it (as the field is
+// optional) taken from their image config.
+func ResolvePlatforms(ctx context.Context, blobs BlobProvider, manifests []ocispecs.Descriptor, opts *Options) ([]ocispecs.Descriptor, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	resolved := slices.Clone(manifests)
+	for i, desc := range resolved {
+		if desc.Platform != nil || IsArtifact(desc) {
+			continue
+		}
+
+		if desc.MediaType != ocispecs.MediaTypeImageManifest && desc.MediaType != MediaTypeDockerManifest {
+			continue
+		}
+
+		platform, err := configPlatform(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved[i].Platform = platform
+	}
+
+	return resolved, nil
 }
 
-func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*ocispecs.Manifest, error) {
-	indexFile, err := imageFS.Open("index.json")
+// configPlatform returns the platform recorded in the image config of the
+// manifest with the given digest, or nil if the manifest is an artifact or
+// its config does not record one.
+func configPlatform(ctx context.Context, blobs BlobProvider, dgst digest.Digest, opts *Options) (*ocispecs.Platform, error) {
+	manifest, err := readManifest(ctx, blobs, dgst, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifestArtifactType(manifest) != "" {
+		return nil, nil
+	}
+
+	var config ocispecs.Image
+	if err := readBlob(ctx, blobs, manifest.Config.Digest, &config, opts); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if config.OS == "" || config.Architecture == "" {
+		return nil, nil
+	}
+
+	return &config.Platform, nil
+}
+
+// PlatformManifests returns the platform specific manifests of an image index,
+// skipping attestation manifests and other artifacts.
+func PlatformManifests(manifests []ocispecs.Descriptor) []ocispecs.Descriptor {
+	var platformManifests []ocispecs.Descriptor
+	for _, desc := range manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" || IsArtifact(desc) {
+			continue
+		}
+
+		platformManifests = append(platformManifests, desc)
+	}
+
+	return platformManifests
+}
+
+// descriptorForRef returns the descriptor in the provider's index (eg. the
+// layout's index.json) that matches ref.
+func descriptorForRef(ctx context.Context, blobs BlobProvider, ref string, opts *Options) (*ocispecs.Descriptor, error) {
+	indexFile, err := blobs.OpenIndex(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open index: %w", err)
 	}
 	defer indexFile.Close()
 
 	var index ocispecs.Index
-	if err := json.NewDecoder(indexFile).Decode(&index); err != nil {
+	if err := json.NewDecoder(util.ManifestReader(indexFile, opts.MaxManifestSize)).Decode(&index); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
 	}
 
@@ -126,100 +760,216 @@ func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*oc
 		return nil, errors.New("no manifests found")
 	}
 
-	var manifestDescriptor *ocispecs.Descriptor
+	// Artifacts (eg. signatures stored alongside the image) are skipped,
+	// unless they are of the selected artifact type.
+	manifests := FilterManifests(index.Manifests, opts.ArtifactType)
+
+	var desc *ocispecs.Descriptor
 	if ref == "" {
-		if len(index.Manifests) > 1 {
-			return nil, errors.New("multiple manifests found, ref must be specified")
+		switch {
+		case len(manifests) == 0 && opts.ArtifactType == "":
+			return nil, fmt.Errorf("%w: the index only has artifacts", ErrArtifact)
+		case len(manifests) == 0:
+			return nil, fmt.Errorf("%w: the index has no artifacts of type %s", ErrArtifact, opts.ArtifactType)
+		case len(manifests) > 1:
+			return nil, fmt.Errorf("%w: multiple manifests found, ref must be specified", util.ErrAmbiguousRef)
+		}
+
+		desc = &manifests[0]
+	} else if i, ok := util.RefIndex(ref); ok {
+		// Positions refer to the index as is, including any artifacts.
+		if i >= len(index.Manifests) {
+			return nil, fmt.Errorf("%w: no manifest at position %d, the index has %d", util.ErrRefNotFound, i, len(index.Manifests))
 		}
 
-		manifestDescriptor = &index.Manifests[0]
+		desc = &index.Manifests[i]
+	} else if dgst, ok := digestFromRef(ref); ok {
+		desc, err = manifestForDigest(ctx, blobs, index.Manifests, dgst, opts)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		for _, desc := range index.Manifests {
-			if desc.Annotations[ocispecs.AnnotationRefName] == ref {
-				desc := desc
-				manifestDescriptor = &desc
-				break
-			}
+		desc = manifestForName(manifests, ref)
+		if desc == nil {
+			desc = manifestForName(index.Manifests, ref)
 		}
 	}
-	if manifestDescriptor == nil {
-		return nil, fmt.Errorf("no manifest found for ref %s", ref)
+	if desc == nil {
+		return nil, fmt.Errorf("%w: no manifest found for ref %s", util.ErrRefNotFound, ref)
 	}
 
-	if manifestDescriptor.MediaType == ocispecs.MediaTypeImageIndex {
-		imageIndexPath := filepath.Join("blobs", string(manifestDescriptor.Digest.Algorithm()), manifestDescriptor.Digest.Encoded())
+	// Manifests that are not known to be artifacts are checked once they
+	// are read.
+	if IsArtifact(*desc) && !matchesArtifactType(*desc, opts.ArtifactType) {
+		return nil, describeSkipped(*desc, opts)
+	}
 
-		imageIndexFile, err := imageFS.Open(imageIndexPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open image index file: %w", err)
-		}
-		defer imageIndexFile.Close()
+	return desc, nil
+}
+
+func readManifest(ctx context.Context, blobs BlobProvider, dgst digest.Digest, opts *Options) (*ocispecs.Manifest, error) {
+	var manifest ocispecs.Manifest
+	if err := readBlob(ctx, blobs, dgst, &manifest, opts); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// readBlob unmarshals the JSON blob with the given digest into v, failing
+// with util.ErrDigestMismatch if its content does not match the digest.
+func readBlob(ctx context.Context, blobs BlobProvider, dgst digest.Digest, v any, opts *Options) error {
+	// Read the whole blob, as the JSON decoder may stop short of the end.
+	data, err := readBlobData(ctx, blobs, dgst, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal blob: %w", err)
+	}
+
+	return nil
+}
+
+// readBlobData reads the (manifest sized) blob with the given digest,
+// verifying its contents.
+func readBlobData(ctx context.Context, blobs BlobProvider, dgst digest.Digest, opts *Options) ([]byte, error) {
+	f, err := blobs.OpenBlob(ctx, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
 
-		var imageIndex ocispecs.Index
-		if err := json.NewDecoder(imageIndexFile).Decode(&imageIndex); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+	r, err := util.VerifyingReader(util.ManifestReader(f, opts.MaxManifestSize), dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	return data, nil
+}
+
+// BlobPath returns the path of the blob with the given digest in an OCI image
+// layout.
+func BlobPath(dgst digest.Digest) string {
+	return path.Join("blobs", string(dgst.Algorithm()), dgst.Encoded())
+}
+
+// NestedLayout returns the OCI image layout nested within imageFS that holds
+// the repository named by ref, as in registries that store each repository
+// as a layout of its own (eg. zot's "<root>/<repository>/index.json"), and
+// the tag or digest of ref to look up in it (empty if ref has neither). ok is
+// false if ref doesn't name such a repository.
+func NestedLayout(imageFS fs.FS, ref string) (layoutFS fs.FS, nestedRef string, ok bool) {
+	repository, nestedRef, found := strings.Cut(ref, "@")
+	if !found {
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			repository, nestedRef = ref[:i], ref[i+1:]
 		}
+	}
 
-		// Find the manifest for the platform.
-		manifestDescriptor = nil
-		if platform == nil {
-			if len(imageIndex.Manifests) > 0 {
-				manifestDescriptor = &imageIndex.Manifests[0]
-			}
-		} else {
-			for _, desc := range imageIndex.Manifests {
-				if platforms.NewMatcher(*platform).Match(*desc.Platform) {
-					desc := desc
-					manifestDescriptor = &desc
-					break
-				}
-			}
+	if repository == "" || !fs.ValidPath(repository) {
+		return nil, "", false
+	}
+
+	if _, err := fs.Stat(imageFS, path.Join(repository, ocispecs.ImageLayoutFile)); err != nil {
+		return nil, "", false
+	}
+
+	layoutFS, err := fs.Sub(imageFS, repository)
+	if err != nil {
+		return nil, "", false
+	}
+
+	return layoutFS, nestedRef, true
+}
+
+// SelectManifest returns the descriptor of the image index manifest best
+// matching the given platform (or the host platform if nil). If firstManifest
+// is set and no platform is given, the first manifest is returned instead.
+func SelectManifest(manifests []ocispecs.Descriptor, platform *ocispecs.Platform, firstManifest bool) (*ocispecs.Descriptor, error) {
+	if len(manifests) == 0 {
+		return nil, errors.New("no manifests found in image index")
+	}
+
+	if platform == nil && firstManifest {
+		return &manifests[0], nil
+	}
+
+	matcher := util.NewPlatformMatcher(platform)
+
+	var manifestDescriptor *ocispecs.Descriptor
+	var available []string
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			continue
 		}
 
-		if manifestDescriptor == nil {
-			return nil, fmt.Errorf("no manifest found for platform %s", platforms.Format(*platform))
+		available = append(available, util.FormatPlatform(*desc.Platform))
+
+		if !matcher.Match(*desc.Platform) {
+			continue
 		}
-	} else if manifestDescriptor.MediaType == ocispecs.MediaTypeImageManifest {
-		// Check if the platform is correct.
-		if platform != nil && !platforms.NewMatcher(*platform).Match(*manifestDescriptor.Platform) {
-			return nil, errors.New("platform is not present in image")
+
+		// Prefer the most specific match.
+		if manifestDescriptor == nil || matcher.Less(*desc.Platform, *manifestDescriptor.Platform) {
+			desc := desc
+			manifestDescriptor = &desc
 		}
-	} else {
-		return nil, fmt.Errorf("unexpected manifest media type: %s", manifestDescriptor.MediaType)
 	}
 
-	manifestPath := filepath.Join("blobs", string(manifestDescriptor.Digest.Algorithm()), manifestDescriptor.Digest.Encoded())
+	if manifestDescriptor == nil {
+		return nil, fmt.Errorf("%w: no manifest found for platform %s, available: %s", util.ErrPlatformNotFound, matcher, strings.Join(available, ", "))
+	}
 
-	manifestFile, err := imageFS.Open(manifestPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open manifest file: %w", err)
+	return manifestDescriptor, nil
+}
+
+func verifyImageLayout(imageFS fs.FS, opts *Options) error {
+	err := verifyImageLayoutVersion(imageFS, opts.LayoutVersions)
+	if err == nil || !opts.BestEffortLayout {
+		return err
 	}
-	defer manifestFile.Close()
 
-	var manifest ocispecs.Manifest
-	if err := json.NewDecoder(manifestFile).Decode(&manifest); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	// Does the layout otherwise look usable?
+	if _, statErr := fs.Stat(imageFS, "index.json"); statErr != nil {
+		return fmt.Errorf("%w (and index.json is missing)", err)
 	}
 
-	return &manifest, nil
+	if fi, statErr := fs.Stat(imageFS, "blobs"); statErr != nil || !fi.IsDir() {
+		return fmt.Errorf("%w (and blobs directory is missing)", err)
+	}
+
+	slog.Warn("Proceeding with invalid image layout", slog.Any("error", err))
+
+	return nil
 }
 
-func verifyImageLayoutVersion(imageFS fs.FS) error {
-	ociLayoutFile, err := imageFS.Open("oci-layout")
+func verifyImageLayoutVersion(imageFS fs.FS, acceptedVersions []string) error {
+	if len(acceptedVersions) == 0 {
+		acceptedVersions = []string{ocispecs.ImageLayoutVersion}
+	}
+
+	ociLayoutFile, err := imageFS.Open(ocispecs.ImageLayoutFile)
 	if err != nil {
-		return fmt.Errorf("failed to open oci-layout: %w", err)
+		return fmt.Errorf("%w: failed to open oci-layout: %w", ErrUnsupportedLayout, err)
 	}
 	defer ociLayoutFile.Close()
 
 	var ociLayout struct {
 		ImageLayoutVersion string `json:"imageLayoutVersion"`
 	}
-	if err := json.NewDecoder(ociLayoutFile).Decode(&ociLayout); err != nil {
-		return fmt.Errorf("failed to unmarshal oci-layout: %w", err)
+	if err := json.NewDecoder(util.ManifestReader(ociLayoutFile, 0)).Decode(&ociLayout); err != nil {
+		return fmt.Errorf("%w: failed to unmarshal oci-layout: %w", ErrUnsupportedLayout, err)
 	}
 
-	if ociLayout.ImageLayoutVersion != ocispecs.ImageLayoutVersion {
-		return fmt.Errorf("unsupported image layout version: %s", ociLayout.ImageLayoutVersion)
+	if !slices.Contains(acceptedVersions, ociLayout.ImageLayoutVersion) {
+		return fmt.Errorf("%w version: %s", ErrUnsupportedLayout, ociLayout.ImageLayoutVersion)
 	}
 
 	return nil
@@ -19,11 +19,25 @@
 package oci_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"testing/fstest"
 
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/testutil"
 	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
 )
@@ -32,7 +46,7 @@ func TestLoadImage(t *testing.T) {
 	ref := "docker.io/tianon/toybox:0.8.11"
 
 	t.Run("Single Arch", func(t *testing.T) {
-		rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox"), ref, nil)
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox"), ref, nil, nil)
 		require.NoError(t, err)
 		t.Cleanup(func() {
 			require.NoError(t, closeAll())
@@ -51,7 +65,7 @@ func TestLoadImage(t *testing.T) {
 				OS:           "linux",
 			}
 
-			rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform)
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform, nil)
 			require.NoError(t, err)
 			t.Cleanup(func() {
 				require.NoError(t, closeAll())
@@ -69,7 +83,7 @@ func TestLoadImage(t *testing.T) {
 				OS:           "linux",
 			}
 
-			rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform)
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform, nil)
 			require.NoError(t, err)
 			t.Cleanup(func() {
 				require.NoError(t, closeAll())
@@ -80,5 +94,1095 @@ func TestLoadImage(t *testing.T) {
 
 			require.Equal(t, "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ=", h)
 		})
+
+		t.Run("Host Platform", func(t *testing.T) {
+			expectedHashes := map[string]string{
+				"amd64": "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=",
+				"arm64": "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ=",
+			}
+
+			expected, ok := expectedHashes[runtime.GOARCH]
+			if !ok || runtime.GOOS != "linux" {
+				t.Skip("test image does not contain the host platform")
+			}
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, nil, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			h, err := util.HashFS(rootFS)
+			require.NoError(t, err)
+
+			require.Equal(t, expected, h)
+		})
+
+		t.Run("First Manifest", func(t *testing.T) {
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, nil, &oci.Options{
+				FirstManifest: true,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			h, err := util.HashFS(rootFS)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+		})
+
+		t.Run("Missing Platform", func(t *testing.T) {
+			platform := ocispecs.Platform{
+				Architecture: "riscv64",
+				OS:           "linux",
+			}
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform, nil)
+			require.ErrorContains(t, err, "no manifest found for platform linux/riscv64")
+			require.ErrorIs(t, err, oci.ErrPlatformNotFound)
+		})
+	})
+
+	// Descriptors may omit the platform, in which case it is taken from the
+	// image config.
+	t.Run("Descriptor Without Platform", func(t *testing.T) {
+		t.Run("Manifest", func(t *testing.T) {
+			dir := writeImageLayout(t, testLayer{
+				mediaType: ocispecs.MediaTypeImageLayer,
+				data: testutil.CreateTar(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+				}),
+			})
+
+			platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			_, err = fs.Stat(rootFS, "etc/hostname")
+			require.NoError(t, err)
+
+			platform = ocispecs.Platform{OS: "linux", Architecture: "s390x"}
+			_, _, err = oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", &platform, nil)
+			require.ErrorIs(t, err, oci.ErrPlatformNotFound)
+			require.ErrorContains(t, err, "available: linux/amd64")
+		})
+
+		t.Run("Image Index", func(t *testing.T) {
+			dir := writeMultiPlatformImageLayout(t,
+				ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+				ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+			)
+			stripPlatforms(t, dir)
+
+			platform := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "latest", &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "platform")
+			require.NoError(t, err)
+			require.Equal(t, "linux/arm64/", string(content))
+
+			platforms, err := oci.Platforms(os.DirFS(dir), "latest", nil)
+			require.NoError(t, err)
+			require.Equal(t, []ocispecs.Platform{
+				{OS: "linux", Architecture: "amd64"},
+				{OS: "linux", Architecture: "arm64"},
+			}, platforms)
+		})
+	})
+
+	t.Run("Nested Image Index", func(t *testing.T) {
+		dir := writeMultiPlatformImageLayout(t,
+			ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+			ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+		)
+		inner := nestIndex(t, dir)
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "latest", &platform, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		content, err := fs.ReadFile(rootFS, "platform")
+		require.NoError(t, err)
+		require.Equal(t, "linux/arm64/", string(content))
+
+		platforms, err := oci.Platforms(os.DirFS(dir), "latest", nil)
+		require.NoError(t, err)
+		require.Len(t, platforms, 2)
+
+		t.Run("By Digest", func(t *testing.T) {
+			_, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), inner.String(), &platform, nil)
+			require.NoError(t, err)
+			require.NoError(t, closeAll())
+		})
+
+		t.Run("Too Deep", func(t *testing.T) {
+			for i := 0; i < oci.MaxIndexDepth; i++ {
+				nestIndex(t, dir)
+			}
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "latest", &platform, nil)
+			require.ErrorIs(t, err, oci.ErrIndexTooDeep)
+		})
+	})
+
+	t.Run("Digest", func(t *testing.T) {
+		amd64 := "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg="
+		arm64 := "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ="
+
+		tests := []struct {
+			name     string
+			ref      string
+			platform *ocispecs.Platform
+			expected string
+		}{
+			{
+				name:     "Index",
+				ref:      "sha256:8a05dbe3e013d3e7cd5ecb83b43c64a4b5ad03334c3f4d9bbfda10c79bf6d6bb",
+				platform: &ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+				expected: arm64,
+			},
+			{
+				name:     "Nested Manifest",
+				ref:      "@sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce",
+				expected: amd64,
+			},
+			{
+				name:     "Name And Digest",
+				ref:      "docker.io/tianon/toybox@sha256:42841c3db3063a527dc1adc95ff63dcdeb95dab77017fa30d514a121e40ee702",
+				expected: arm64,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), tt.ref, tt.platform, nil)
+				require.NoError(t, err)
+				t.Cleanup(func() {
+					require.NoError(t, closeAll())
+				})
+
+				h, err := util.HashFS(rootFS)
+				require.NoError(t, err)
+
+				require.Equal(t, tt.expected, h)
+			})
+		}
+
+		t.Run("Unknown", func(t *testing.T) {
+			ref := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, nil, nil)
+			require.ErrorContains(t, err, "no manifest found for ref")
+			require.ErrorIs(t, err, oci.ErrRefNotFound)
+		})
+	})
+
+	t.Run("Ref Normalization", func(t *testing.T) {
+		t.Run("Familiar Name", func(t *testing.T) {
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS("testdata/toybox"), "tianon/toybox:0.8.11", nil, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			h, err := util.HashFS(rootFS)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+		})
+
+		t.Run("Tag Only Annotation", func(t *testing.T) {
+			imageDir := writeMultiPlatformImageLayout(t, ocispecs.Platform{OS: "linux", Architecture: "amd64"})
+			platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+			for _, ref := range []string{"alpine", "docker.io/library/alpine:latest"} {
+				_, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imageDir), ref, &platform, nil)
+				require.NoError(t, err, ref)
+				require.NoError(t, closeAll())
+			}
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imageDir), "alpine:3.20", &platform, nil)
+			require.ErrorContains(t, err, "no manifest found for ref")
+			require.ErrorIs(t, err, oci.ErrRefNotFound)
+		})
+
+		t.Run("Containerd Image Name", func(t *testing.T) {
+			dir := t.TempDir()
+
+			desc := writeManifest(t, dir, ocispecs.Platform{OS: "linux", Architecture: "amd64"}, testLayer{
+				mediaType: ocispecs.MediaTypeImageLayer,
+				data: testutil.CreateTar(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+				}),
+			})
+			desc.Annotations = map[string]string{
+				ocispecs.AnnotationRefName:        "3.20",
+				oci.AnnotationContainerdImageName: "docker.io/library/alpine:3.20",
+			}
+			writeIndex(t, dir, desc)
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "alpine:3.20", nil, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "etc/hostname")
+			require.NoError(t, err)
+			require.Equal(t, "localhost\n", string(content))
+		})
+	})
+
+	t.Run("Index Position", func(t *testing.T) {
+		dir := t.TempDir()
+
+		var manifests []ocispecs.Descriptor
+		for _, hostname := range []string{"first\n", "second\n"} {
+			manifests = append(manifests, writeManifest(t, dir, ocispecs.Platform{OS: "linux", Architecture: "amd64"}, testLayer{
+				mediaType: ocispecs.MediaTypeImageLayer,
+				data: testutil.CreateTar(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: hostname},
+				}),
+			}))
+		}
+		writeIndex(t, dir, manifests...)
+
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "@1", nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		content, err := fs.ReadFile(rootFS, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "second\n", string(content))
+
+		_, _, err = oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "@2", nil, nil)
+		require.ErrorContains(t, err, "no manifest at position 2")
+		require.ErrorIs(t, err, oci.ErrRefNotFound)
+	})
+
+	t.Run("Artifacts", func(t *testing.T) {
+		const rootFSType = "application/vnd.example.rootfs"
+
+		dir := t.TempDir()
+
+		image := writeManifest(t, dir, ocispecs.Platform{OS: "linux", Architecture: "amd64"}, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayer,
+			data: testutil.CreateTar(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "image\n"},
+			}),
+		})
+
+		sbom := writeArtifact(t, dir, "application/spdx+json", testLayer{
+			mediaType: "application/spdx+json",
+			data:      []byte("{}"),
+		})
+		sbom.ArtifactType = "application/spdx+json"
+
+		rootFS := writeArtifact(t, dir, rootFSType, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayer,
+			data: testutil.CreateTar(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "artifact\n"},
+			}),
+		})
+		rootFS.ArtifactType = rootFSType
+
+		// Artifacts are not always described as such in the index.
+		signature := writeArtifact(t, dir, "application/vnd.dev.cosign.artifact.sig.v1+json", testLayer{
+			mediaType: "application/vnd.dev.cosign.simplesigning.v1+json",
+			data:      []byte("{}"),
+		})
+
+		writeIndex(t, dir, image, sbom, rootFS)
+
+		readHostname := func(t *testing.T, ref string, opts *oci.Options) string {
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), ref, nil, opts)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "etc/hostname")
+			require.NoError(t, err)
+
+			return string(content)
+		}
+
+		t.Run("Skipped", func(t *testing.T) {
+			require.Equal(t, "image\n", readHostname(t, "", nil))
+		})
+
+		t.Run("Artifact Type", func(t *testing.T) {
+			require.Equal(t, "artifact\n", readHostname(t, "", &oci.Options{ArtifactType: rootFSType}))
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", nil, &oci.Options{ArtifactType: "application/vnd.example.other"})
+			require.ErrorIs(t, err, oci.ErrArtifact)
+		})
+
+		t.Run("Selected By Digest", func(t *testing.T) {
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), sbom.Digest.String(), nil, nil)
+			require.ErrorIs(t, err, oci.ErrArtifact)
+			require.ErrorContains(t, err, "application/spdx+json")
+
+			_, _, err = oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), image.Digest.String(), nil, &oci.Options{ArtifactType: rootFSType})
+			require.ErrorIs(t, err, oci.ErrArtifact)
+		})
+
+		t.Run("Undescribed", func(t *testing.T) {
+			writeIndex(t, dir, image, signature)
+			t.Cleanup(func() {
+				writeIndex(t, dir, image, sbom, rootFS)
+			})
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "@1", nil, nil)
+			require.ErrorIs(t, err, oci.ErrArtifact)
+			require.ErrorContains(t, err, "application/vnd.dev.cosign.artifact.sig.v1+json")
+		})
 	})
+
+	t.Run("OS Version", func(t *testing.T) {
+		imageDir := writeMultiPlatformImageLayout(t,
+			ocispecs.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1234"},
+			ocispecs.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.587", OSFeatures: []string{"win32k"}},
+		)
+
+		t.Run("Matching", func(t *testing.T) {
+			platform := ocispecs.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.587"}
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imageDir), "latest", &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "platform")
+			require.NoError(t, err)
+			require.Equal(t, "windows/amd64/10.0.20348.587", string(content))
+		})
+
+		t.Run("OS Features", func(t *testing.T) {
+			platform := ocispecs.Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"win32k"}}
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imageDir), "latest", &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "platform")
+			require.NoError(t, err)
+			require.Equal(t, "windows/amd64/10.0.20348.587", string(content))
+		})
+
+		t.Run("Missing", func(t *testing.T) {
+			platform := ocispecs.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.14393.0"}
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imageDir), "latest", &platform, nil)
+			require.ErrorContains(t, err, "no manifest found for platform windows/amd64 (os.version 10.0.14393.0)")
+			require.ErrorContains(t, err, "windows/amd64 (os.version 10.0.17763.1234)")
+		})
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := oci.LoadImage(ctx, t.TempDir(), os.DirFS("testdata/toybox"), ref, nil, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+	t.Run("Multi Stream Gzip", func(t *testing.T) {
+		layer := testutil.CreateTar(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644}, Content: "hello world\n"},
+		})
+
+		// Split the tar stream across two concatenated gzip members, which
+		// must both be read (the gzip reader is multistream by default).
+		var compressed bytes.Buffer
+		for _, part := range [][]byte{layer[:len(layer)/2], layer[len(layer)/2:]} {
+			gw := gzip.NewWriter(&compressed)
+			_, err := gw.Write(part)
+			require.NoError(t, err)
+			require.NoError(t, gw.Close())
+		}
+
+		imagePath := writeImageLayout(t, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayerGzip,
+			data:      compressed.Bytes(),
+		})
+
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		content, err := fs.ReadFile(rootFS, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", string(content))
+	})
+
+	t.Run("Layer Selection", func(t *testing.T) {
+		var layers []testLayer
+		for _, name := range []string{"base", "app", "debug"} {
+			layers = append(layers, testLayer{
+				mediaType: ocispecs.MediaTypeImageLayer,
+				data: testutil.CreateTar(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}, Content: name},
+				}),
+			})
+		}
+
+		imagePath := writeImageLayout(t, layers...)
+
+		load := func(t *testing.T, opts *oci.Options) ([]string, error) {
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, opts)
+			if err != nil {
+				return nil, err
+			}
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			entries, err := fs.ReadDir(rootFS, ".")
+			require.NoError(t, err)
+
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+
+			return names, nil
+		}
+
+		t.Run("Range", func(t *testing.T) {
+			names, err := load(t, &oci.Options{LayerRange: &layer.Range{Start: 0, End: -2}})
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"base", "app"}, names)
+		})
+
+		t.Run("Skip", func(t *testing.T) {
+			names, err := load(t, &oci.Options{SkipLayers: []digest.Digest{digest.FromBytes(layers[1].data)}})
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"base", "debug"}, names)
+		})
+
+		t.Run("Unknown Digest", func(t *testing.T) {
+			_, err := load(t, &oci.Options{SkipLayers: []digest.Digest{digest.FromString("missing")}})
+			require.Error(t, err)
+		})
+
+		t.Run("Nothing Selected", func(t *testing.T) {
+			_, err := load(t, &oci.Options{
+				LayerRange: &layer.Range{Start: 1, End: 1},
+				SkipLayers: []digest.Digest{digest.FromBytes(layers[1].data)},
+			})
+			require.ErrorIs(t, err, layer.ErrNoLayersSelected)
+		})
+
+		t.Run("On Layers", func(t *testing.T) {
+			var selected []ocispecs.Descriptor
+			names, err := load(t, &oci.Options{
+				LayerRange: &layer.Range{Start: 1, End: -1},
+				OnLayers: func(descs []ocispecs.Descriptor) error {
+					selected = descs
+					return nil
+				},
+			})
+			require.NoError(t, err)
+			require.ElementsMatch(t, []string{"app", "debug"}, names)
+			require.Len(t, selected, 2)
+			require.Equal(t, digest.FromBytes(layers[1].data), selected[0].Digest)
+
+			errFull := errors.New("disk full")
+			_, err = load(t, &oci.Options{
+				OnLayers: func([]ocispecs.Descriptor) error { return errFull },
+			})
+			require.ErrorIs(t, err, errFull)
+		})
+	})
+
+	t.Run("Image Layout", func(t *testing.T) {
+		newImageLayout := func(t *testing.T) string {
+			return writeImageLayout(t, testLayer{
+				mediaType: ocispecs.MediaTypeImageLayer,
+				data: testutil.CreateTar(t, []testutil.File{
+					{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+				}),
+			})
+		}
+
+		t.Run("Unknown Version", func(t *testing.T) {
+			imagePath := newImageLayout(t)
+			require.NoError(t, os.WriteFile(filepath.Join(imagePath, ocispecs.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.1"}`), 0o644))
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, nil)
+			require.ErrorContains(t, err, "unsupported image layout version: 1.0.1")
+			require.ErrorIs(t, err, oci.ErrUnsupportedLayout)
+
+			_, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, &oci.Options{
+				LayoutVersions: []string{"1.0.0", "1.0.1"},
+			})
+			require.NoError(t, err)
+			require.NoError(t, closeAll())
+		})
+
+		t.Run("Missing", func(t *testing.T) {
+			imagePath := newImageLayout(t)
+			require.NoError(t, os.Remove(filepath.Join(imagePath, ocispecs.ImageLayoutFile)))
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, nil)
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, &oci.Options{
+				BestEffortLayout: true,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "etc/hostname")
+			require.NoError(t, err)
+			require.Equal(t, "localhost\n", string(content))
+		})
+
+		t.Run("Missing Index", func(t *testing.T) {
+			imagePath := newImageLayout(t)
+			require.NoError(t, os.Remove(filepath.Join(imagePath, ocispecs.ImageLayoutFile)))
+			require.NoError(t, os.Remove(filepath.Join(imagePath, "index.json")))
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, &oci.Options{
+				BestEffortLayout: true,
+			})
+			require.ErrorContains(t, err, "index.json is missing")
+		})
+	})
+
+	t.Run("Manifest Too Large", func(t *testing.T) {
+		imagePath := writeImageLayout(t, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayer,
+			data: testutil.CreateTar(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+			}),
+		})
+
+		_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(imagePath), "", nil, &oci.Options{
+			MaxManifestSize: 64,
+		})
+		require.ErrorIs(t, err, oci.ErrManifestTooLarge)
+	})
+
+	t.Run("Blob Dirs", func(t *testing.T) {
+		layerData := testutil.CreateTar(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+		})
+		dir := writeImageLayout(t, testLayer{mediaType: ocispecs.MediaTypeImageLayer, data: layerData})
+
+		// Move the layer into a shared blob directory.
+		dgst := digest.FromBytes(layerData)
+		sharedDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(sharedDir, dgst.Algorithm().String()), 0o755))
+		require.NoError(t, os.Rename(filepath.Join(dir, filepath.FromSlash(oci.BlobPath(dgst))), filepath.Join(sharedDir, dgst.Algorithm().String(), dgst.Encoded())))
+
+		_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", nil, nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		opts := &oci.Options{BlobDirs: []fs.FS{os.DirFS(t.TempDir()), os.DirFS(sharedDir)}}
+
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", nil, opts)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		hostname, err := fs.ReadFile(rootFS, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(hostname))
+
+		report, err := oci.Validate(context.Background(), os.DirFS(dir), nil, opts)
+		require.NoError(t, err)
+		require.True(t, report.Valid(), report.Problems)
+	})
+
+	t.Run("Nested Layout", func(t *testing.T) {
+		root := t.TempDir()
+		dir := filepath.Join(root, "library", "app")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+
+		desc := writeManifest(t, dir, ocispecs.Platform{Architecture: "amd64", OS: "linux"}, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayer,
+			data: testutil.CreateTar(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+			}),
+		})
+		desc.Annotations = map[string]string{ocispecs.AnnotationRefName: "v1"}
+		writeIndex(t, dir, desc)
+
+		layoutFS, nestedRef, ok := oci.NestedLayout(os.DirFS(root), "library/app:v1")
+		require.True(t, ok)
+		require.Equal(t, "v1", nestedRef)
+
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), layoutFS, nestedRef, nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		_, err = fs.Stat(rootFS, "etc/hostname")
+		require.NoError(t, err)
+
+		_, nestedRef, ok = oci.NestedLayout(os.DirFS(root), "library/app@"+desc.Digest.String())
+		require.True(t, ok)
+		require.Equal(t, desc.Digest.String(), nestedRef)
+
+		_, nestedRef, ok = oci.NestedLayout(os.DirFS(root), "library/app")
+		require.True(t, ok)
+		require.Empty(t, nestedRef)
+
+		_, _, ok = oci.NestedLayout(os.DirFS(root), "library/other:v1")
+		require.False(t, ok)
+
+		_, _, ok = oci.NestedLayout(os.DirFS(root), "@0")
+		require.False(t, ok)
+	})
+
+	t.Run("Tampered Blob", func(t *testing.T) {
+		layerData := testutil.CreateTar(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+		})
+
+		// Appending a newline keeps the JSON documents valid.
+		tamper := func(t *testing.T, dir string, dgst digest.Digest) {
+			f, err := os.OpenFile(filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded()), os.O_APPEND|os.O_WRONLY, 0)
+			require.NoError(t, err)
+			_, err = f.Write([]byte("\n"))
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}
+
+		t.Run("Manifest", func(t *testing.T) {
+			dir := t.TempDir()
+			desc := writeManifest(t, dir, ocispecs.Platform{Architecture: "amd64", OS: "linux"}, testLayer{mediaType: ocispecs.MediaTypeImageLayer, data: layerData})
+			writeIndex(t, dir, desc)
+
+			tamper(t, dir, desc.Digest)
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", nil, nil)
+			require.ErrorIs(t, err, oci.ErrDigestMismatch)
+		})
+
+		t.Run("Layer", func(t *testing.T) {
+			dir := writeImageLayout(t, testLayer{mediaType: ocispecs.MediaTypeImageLayer, data: layerData})
+
+			tamper(t, dir, digest.FromBytes(layerData))
+
+			_, _, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "", nil, nil)
+			require.ErrorIs(t, err, oci.ErrDigestMismatch)
+		})
+	})
+}
+
+type testLayer struct {
+	mediaType string
+	data      []byte
+}
+
+// writeImageLayout writes a single manifest OCI image layout containing the
+// given layers to a temporary directory and returns its path.
+func TestLoadImageFrom(t *testing.T) {
+	ref := "docker.io/tianon/toybox:0.8.11"
+
+	// A provider holding the blobs in memory, rather than in a layout.
+	blobs := &memoryProvider{blobs: make(map[digest.Digest][]byte)}
+
+	var err error
+	blobs.index, err = os.ReadFile("testdata/toybox/index.json")
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir("testdata/toybox/blobs/sha256")
+	require.NoError(t, err)
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("testdata/toybox/blobs/sha256", entry.Name()))
+		require.NoError(t, err)
+
+		blobs.blobs[digest.NewDigestFromEncoded(digest.SHA256, entry.Name())] = data
+	}
+
+	rootFS, closeAll, err := oci.LoadImageFrom(context.Background(), t.TempDir(), blobs, ref, nil, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeAll())
+	})
+
+	h, err := util.HashFS(rootFS)
+	require.NoError(t, err)
+
+	require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+
+	platforms, err := oci.PlatformsFrom(context.Background(), blobs, ref, nil)
+	require.NoError(t, err)
+	require.Len(t, platforms, 1)
+
+	t.Run("Missing Blob", func(t *testing.T) {
+		blobs := &memoryProvider{index: blobs.index}
+
+		_, _, err := oci.LoadImageFrom(context.Background(), t.TempDir(), blobs, ref, nil, nil)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+// memoryProvider is a blob provider backed by a map.
+type memoryProvider struct {
+	index []byte
+	blobs map[digest.Digest][]byte
+}
+
+func (p *memoryProvider) OpenIndex(_ context.Context) (fs.File, error) {
+	return fstest.MapFS{"index.json": {Data: p.index}}.Open("index.json")
+}
+
+func (p *memoryProvider) OpenBlob(_ context.Context, dgst digest.Digest) (fs.File, error) {
+	data, ok := p.blobs[dgst]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: dgst.String(), Err: fs.ErrNotExist}
+	}
+
+	return fstest.MapFS{"blob": {Data: data}}.Open("blob")
+}
+
+func TestPlatforms(t *testing.T) {
+	ref := "docker.io/tianon/toybox:0.8.11"
+
+	t.Run("Image Index", func(t *testing.T) {
+		platforms, err := oci.Platforms(os.DirFS("testdata/toybox-multiarch"), ref, nil)
+		require.NoError(t, err)
+
+		// Attestation manifests are skipped.
+		require.Equal(t, []ocispecs.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		}, platforms)
+	})
+
+	t.Run("Manifest", func(t *testing.T) {
+		platforms, err := oci.Platforms(os.DirFS("testdata/toybox"), ref, nil)
+		require.NoError(t, err)
+
+		require.Len(t, platforms, 1)
+		require.Equal(t, "linux", platforms[0].OS)
+		require.Equal(t, "amd64", platforms[0].Architecture)
+	})
+}
+
+func TestReferrers(t *testing.T) {
+	dir := t.TempDir()
+
+	image := writeManifest(t, dir, ocispecs.Platform{OS: "linux", Architecture: "amd64"}, testLayer{
+		mediaType: ocispecs.MediaTypeImageLayer,
+		data: testutil.CreateTar(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "image\n"},
+		}),
+	})
+	image.Annotations = map[string]string{ocispecs.AnnotationRefName: "latest"}
+
+	sbomLayer := writeBlob(t, dir, "application/spdx+json", []byte(`{"spdxVersion":"SPDX-2.3"}`))
+	sbom := writeJSON(t, dir, ocispecs.MediaTypeImageManifest, ocispecs.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: "application/spdx+json",
+		Config:       writeBlob(t, dir, ocispecs.MediaTypeEmptyJSON, []byte("{}")),
+		Layers:       []ocispecs.Descriptor{sbomLayer},
+		Subject:      &image,
+	})
+
+	// An artifact of another image.
+	other := writeArtifact(t, dir, "application/spdx+json", testLayer{
+		mediaType: "application/spdx+json",
+		data:      []byte("{}"),
+	})
+	other.ArtifactType = "application/spdx+json"
+
+	writeIndex(t, dir, image, sbom, other)
+
+	var layout map[string][]byte
+	_, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), "latest", nil, &oci.Options{
+		OnReferrers: func(files map[string][]byte) { layout = files },
+	})
+	require.NoError(t, err)
+	require.NoError(t, closeAll())
+
+	var index ocispecs.Index
+	require.NoError(t, json.Unmarshal(layout["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, sbom.Digest, index.Manifests[0].Digest)
+	require.Equal(t, "application/spdx+json", index.Manifests[0].ArtifactType)
+
+	require.Contains(t, layout, "oci-layout")
+	require.Contains(t, layout, "blobs/sha256/"+sbom.Digest.Encoded())
+	require.Equal(t, `{"spdxVersion":"SPDX-2.3"}`, string(layout["blobs/sha256/"+sbomLayer.Digest.Encoded()]))
+
+	t.Run("None", func(t *testing.T) {
+		referrers, err := oci.Referrers(context.Background(), oci.NewLayoutProvider(os.DirFS(dir)), sbom.Digest, nil)
+		require.NoError(t, err)
+		require.Empty(t, referrers)
+
+		layout, err := oci.ReferrersLayout(context.Background(), oci.NewLayoutProvider(os.DirFS(dir)), referrers, nil)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`, string(layout["index.json"]))
+	})
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		report, err := oci.Validate(context.Background(), os.DirFS("testdata/toybox-multiarch"), []ocispecs.Platform{
+			{OS: "linux", Architecture: "arm64"},
+		}, nil)
+		require.NoError(t, err)
+
+		require.True(t, report.Valid(), report.Problems)
+		require.NotZero(t, report.Blobs)
+		require.Equal(t, []ocispecs.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		}, report.Platforms)
+	})
+
+	t.Run("Problems", func(t *testing.T) {
+		dir := writeMultiPlatformImageLayout(t,
+			ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+			ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+		)
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ocispecs.ImageLayoutFile), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0o644))
+
+		var index ocispecs.Index
+		data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &index))
+
+		var imageIndex ocispecs.Index
+		data, err = os.ReadFile(filepath.Join(dir, "blobs", "sha256", index.Manifests[0].Digest.Encoded()))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &imageIndex))
+
+		// Remove a layer of the first manifest, and tamper with the second.
+		var manifest ocispecs.Manifest
+		data, err = os.ReadFile(filepath.Join(dir, "blobs", "sha256", imageIndex.Manifests[0].Digest.Encoded()))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &manifest))
+
+		missing := manifest.Layers[0].Digest
+		require.NoError(t, os.Remove(filepath.Join(dir, "blobs", "sha256", missing.Encoded())))
+
+		tampered := imageIndex.Manifests[1].Digest
+		f, err := os.OpenFile(filepath.Join(dir, "blobs", "sha256", tampered.Encoded()), os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("\n"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		report, err := oci.Validate(context.Background(), os.DirFS(dir), []ocispecs.Platform{
+			{OS: "linux", Architecture: "amd64"},
+			{OS: "linux", Architecture: "s390x"},
+		}, nil)
+		require.NoError(t, err)
+
+		// Every problem is reported, not just the first.
+		require.False(t, report.Valid())
+
+		var paths []string
+		for _, p := range report.Problems {
+			paths = append(paths, p.Path)
+		}
+		require.Equal(t, []string{
+			ocispecs.ImageLayoutFile,
+			"blobs/sha256/" + missing.Encoded(),
+			"blobs/sha256/" + tampered.Encoded(),
+			"blobs/sha256/" + tampered.Encoded(),
+			"index.json",
+		}, paths)
+		require.Contains(t, report.Problems[len(report.Problems)-1].Message, "linux/s390x")
+	})
+
+	t.Run("Missing Index", func(t *testing.T) {
+		report, err := oci.Validate(context.Background(), os.DirFS(t.TempDir()), nil, nil)
+		require.NoError(t, err)
+
+		require.Len(t, report.Problems, 2)
+	})
+}
+
+func writeImageLayout(t *testing.T, layers ...testLayer) string {
+	dir := t.TempDir()
+
+	manifest := writeManifest(t, dir, ocispecs.Platform{Architecture: "amd64", OS: "linux"}, layers...)
+	writeIndex(t, dir, manifest)
+
+	return dir
+}
+
+// writeMultiPlatformImageLayout writes an image layout with a nested image
+// index containing a manifest for each platform. Each manifest has a single
+// layer containing a "platform" file describing its platform.
+func writeMultiPlatformImageLayout(t *testing.T, platforms ...ocispecs.Platform) string {
+	dir := t.TempDir()
+
+	imageIndex := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	for _, platform := range platforms {
+		platform := platform
+
+		content := platform.OS + "/" + platform.Architecture + "/" + platform.OSVersion
+		desc := writeManifest(t, dir, platform, testLayer{
+			mediaType: ocispecs.MediaTypeImageLayer,
+			data: testutil.CreateTar(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "platform", Mode: 0o644}, Content: content},
+			}),
+		})
+		desc.Platform = &platform
+
+		imageIndex.Manifests = append(imageIndex.Manifests, desc)
+	}
+
+	desc := writeJSON(t, dir, ocispecs.MediaTypeImageIndex, imageIndex)
+	desc.Annotations = map[string]string{ocispecs.AnnotationRefName: "latest"}
+	writeIndex(t, dir, desc)
+
+	return dir
+}
+
+// nestIndex wraps the image index referenced by the layout's index.json in
+// another image index, returning the digest of the wrapped index.
+func nestIndex(t *testing.T, dir string) digest.Digest {
+	var index ocispecs.Index
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &index))
+
+	inner := index.Manifests[0]
+	annotations := inner.Annotations
+	inner.Annotations = nil
+
+	desc := writeJSON(t, dir, ocispecs.MediaTypeImageIndex, ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{inner},
+	})
+	desc.Annotations = annotations
+	writeIndex(t, dir, desc)
+
+	return inner.Digest
+}
+
+// stripPlatforms removes the platforms from the descriptors of the nested
+// image index written by writeMultiPlatformImageLayout.
+func stripPlatforms(t *testing.T, dir string) {
+	var index ocispecs.Index
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &index))
+
+	var imageIndex ocispecs.Index
+	data, err = os.ReadFile(filepath.Join(dir, "blobs", "sha256", index.Manifests[0].Digest.Encoded()))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &imageIndex))
+
+	for i := range imageIndex.Manifests {
+		imageIndex.Manifests[i].Platform = nil
+	}
+
+	desc := writeJSON(t, dir, ocispecs.MediaTypeImageIndex, imageIndex)
+	desc.Annotations = index.Manifests[0].Annotations
+	writeIndex(t, dir, desc)
+}
+
+func writeManifest(t *testing.T, dir string, platform ocispecs.Platform, layers ...testLayer) ocispecs.Descriptor {
+	config := ocispecs.Image{
+		Platform: platform,
+		RootFS:   ocispecs.RootFS{Type: "layers"},
+	}
+
+	manifest := ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    writeJSON(t, dir, ocispecs.MediaTypeImageConfig, config),
+	}
+
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, writeBlob(t, dir, layer.mediaType, layer.data))
+	}
+
+	return writeJSON(t, dir, ocispecs.MediaTypeImageManifest, manifest)
+}
+
+// writeArtifact writes an artifact manifest, with an empty config (as the
+// image spec recommends for artifacts).
+func writeArtifact(t *testing.T, dir, artifactType string, layers ...testLayer) ocispecs.Descriptor {
+	manifest := ocispecs.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       writeBlob(t, dir, ocispecs.MediaTypeEmptyJSON, []byte("{}")),
+	}
+
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, writeBlob(t, dir, layer.mediaType, layer.data))
+	}
+
+	return writeJSON(t, dir, ocispecs.MediaTypeImageManifest, manifest)
+}
+
+func writeIndex(t *testing.T, dir string, manifests ...ocispecs.Descriptor) {
+	index := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: manifests,
+	}
+
+	indexJSON, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), indexJSON, 0o644))
+
+	ociLayoutJSON, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ocispecs.ImageLayoutFile), ociLayoutJSON, 0o644))
+}
+
+func writeBlob(t *testing.T, dir, mediaType string, data []byte) ocispecs.Descriptor {
+	dgst := digest.FromBytes(data)
+
+	blobDir := filepath.Join(dir, "blobs", dgst.Algorithm().String())
+	require.NoError(t, os.MkdirAll(blobDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(blobDir, dgst.Encoded()), data, 0o644))
+
+	return ocispecs.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(data)),
+	}
+}
+
+func writeJSON(t *testing.T, dir, mediaType string, v any) ocispecs.Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return writeBlob(t, dir, mediaType, data)
 }
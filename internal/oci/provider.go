@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobProvider provides the content of images: an index of the images
+// available, and the blobs (manifests, configs and layers) they refer to.
+type BlobProvider interface {
+	// OpenIndex opens the index of the images provided (an image index, as
+	// in an OCI image layout's index.json). Images are found by their ref
+	// name annotations.
+	OpenIndex(ctx context.Context) (fs.File, error)
+	// OpenBlob opens the blob with the given digest. It returns an error
+	// wrapping fs.ErrNotExist if the blob is not present. The blob is
+	// verified against its digest by the caller.
+	OpenBlob(ctx context.Context, dgst digest.Digest) (fs.File, error)
+}
+
+// LayoutProvider provides the images of an OCI image layout.
+type LayoutProvider struct {
+	fsys     fs.FS
+	blobDirs []fs.FS
+}
+
+// NewLayoutProvider returns a provider of the images in the OCI image layout
+// at the root of fsys. Blobs missing from the layout are looked for in the
+// given blob directories, in order (eg. a blob directory shared between
+// layouts, as with skopeo's --shared-blob-dir), each laid out like the
+// layout's blobs directory (ie. as <alg>/<encoded>).
+func NewLayoutProvider(fsys fs.FS, blobDirs ...fs.FS) *LayoutProvider {
+	return &LayoutProvider{fsys: fsys, blobDirs: blobDirs}
+}
+
+func (p *LayoutProvider) OpenIndex(_ context.Context) (fs.File, error) {
+	return p.fsys.Open("index.json")
+}
+
+func (p *LayoutProvider) OpenBlob(_ context.Context, dgst digest.Digest) (fs.File, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid blob digest: %w", err)
+	}
+
+	f, err := p.fsys.Open(BlobPath(dgst))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	for _, dir := range p.blobDirs {
+		if f, dirErr := dir.Open(path.Join(string(dgst.Algorithm()), dgst.Encoded())); !errors.Is(dirErr, fs.ErrNotExist) {
+			return f, dirErr
+		}
+	}
+
+	return nil, err
+}
+
+// blobFS presents the blobs of a provider at their paths in an OCI image
+// layout (see BlobPath), so that layers can be loaded from it.
+type blobFS struct {
+	ctx   context.Context
+	blobs BlobProvider
+}
+
+func (b *blobFS) Open(name string) (fs.File, error) {
+	rest, ok := strings.CutPrefix(name, "blobs/")
+	alg, encoded, _ := strings.Cut(rest, "/")
+	if !ok || !fs.ValidPath(name) || encoded == "" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return b.blobs.OpenBlob(b.ctx, digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded))
+}
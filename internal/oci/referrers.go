@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Referrers returns the descriptors of the manifests in the provider's index
+// whose subject is the manifest with the given digest (eg. SBOMs and
+// provenance attestations of an image). The artifact type of each is filled
+// in from its manifest if the index does not record it.
+func Referrers(ctx context.Context, blobs BlobProvider, subject digest.Digest, opts *Options) ([]ocispecs.Descriptor, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	indexFile, err := blobs.OpenIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer indexFile.Close()
+
+	var index ocispecs.Index
+	if err := json.NewDecoder(util.ManifestReader(indexFile, opts.MaxManifestSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+
+	var referrers []ocispecs.Descriptor
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ocispecs.MediaTypeImageManifest || desc.Digest == subject {
+			continue
+		}
+
+		manifest, err := readManifest(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = manifestArtifactType(manifest)
+		}
+		desc.Annotations = manifest.Annotations
+
+		referrers = append(referrers, desc)
+	}
+
+	return referrers, nil
+}
+
+// ReferrersLayout returns the files of an OCI image layout holding the given
+// referrers and the blobs they refer to, keyed by their path within the
+// layout (eg. "index.json" and "blobs/sha256/...").
+func ReferrersLayout(ctx context.Context, blobs BlobProvider, referrers []ocispecs.Descriptor, opts *Options) (map[string][]byte, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	files := make(map[string][]byte)
+
+	for _, desc := range referrers {
+		data, err := readBlobData(ctx, blobs, desc.Digest, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read referrer %s: %w", desc.Digest, err)
+		}
+		files[BlobPath(desc.Digest)] = data
+
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal referrer %s: %w", desc.Digest, err)
+		}
+
+		for _, blobDesc := range append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if _, ok := files[BlobPath(blobDesc.Digest)]; ok {
+				continue
+			}
+
+			data, err := readDescribed(ctx, blobs, blobDesc)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read blob of referrer %s: %w", desc.Digest, err)
+			}
+			files[BlobPath(blobDesc.Digest)] = data
+		}
+	}
+
+	// Keep the index valid JSON even if there are no referrers.
+	if referrers == nil {
+		referrers = []ocispecs.Descriptor{}
+	}
+
+	indexJSON, err := json.Marshal(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: referrers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	files["index.json"] = indexJSON
+
+	layoutJSON, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	files[ocispecs.ImageLayoutFile] = layoutJSON
+
+	return files, nil
+}
+
+// readDescribed reads the described blob, verifying its size and digest.
+func readDescribed(ctx context.Context, blobs BlobProvider, desc ocispecs.Descriptor) ([]byte, error) {
+	f, err := blobs.OpenBlob(ctx, desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
+
+	r, err := util.VerifyingReader(io.LimitReader(f, desc.Size+1), desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	if int64(len(data)) != desc.Size {
+		return nil, fmt.Errorf("blob %s size mismatch: expected %d bytes, got %d", desc.Digest, desc.Size, len(data))
+	}
+
+	return data, nil
+}
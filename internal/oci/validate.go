@@ -0,0 +1,317 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Problem is something wrong with an OCI image layout.
+type Problem struct {
+	// Path is the file within the layout (eg. "index.json" or the path of a
+	// blob) that the problem concerns.
+	Path string `json:"path"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Message
+}
+
+// ValidationReport is the outcome of validating an OCI image layout.
+type ValidationReport struct {
+	// Blobs is the number of referenced blobs that were checked.
+	Blobs int `json:"blobs"`
+	// Platforms are the platforms provided by the images in the layout.
+	Platforms []ocispecs.Platform `json:"platforms,omitempty"`
+	// Problems is everything found to be wrong with the layout.
+	Problems []Problem `json:"problems,omitempty"`
+}
+
+// Valid reports whether no problems were found.
+func (r *ValidationReport) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+// Validate checks the OCI image layout imageFS: the oci-layout version, the
+// integrity of the index, the presence, size and digest of every blob
+// referenced (directly or through nested indexes and manifests), and that
+// each of the given platforms is provided by an image. Rather than stopping
+// at the first problem, all problems are collected into the report. An
+// error is only returned if validation could not be completed (eg. the
+// context was cancelled).
+func Validate(ctx context.Context, imageFS fs.FS, platforms []ocispecs.Platform, opts *Options) (*ValidationReport, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	v := &validator{
+		imageFS: imageFS,
+		blobs:   NewLayoutProvider(imageFS, opts.BlobDirs...),
+		opts:    opts,
+		report:  &ValidationReport{},
+		visited: make(map[digest.Digest]bool),
+	}
+
+	if err := verifyImageLayoutVersion(imageFS, opts.LayoutVersions); err != nil {
+		v.problem(ocispecs.ImageLayoutFile, err.Error())
+	}
+
+	if err := v.validateIndexFile(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, platform := range platforms {
+		matcher := util.NewPlatformMatcher(&platform)
+
+		var found bool
+		for _, provided := range v.report.Platforms {
+			if matcher.Match(provided) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			v.problem("index.json", fmt.Sprintf("no image for platform %s", util.FormatPlatform(platform)))
+		}
+	}
+
+	return v.report, nil
+}
+
+type validator struct {
+	imageFS fs.FS
+	blobs   *LayoutProvider
+	opts    *Options
+	report  *ValidationReport
+	visited map[digest.Digest]bool
+}
+
+func (v *validator) problem(path, message string) {
+	v.report.Problems = append(v.report.Problems, Problem{Path: path, Message: message})
+}
+
+func (v *validator) validateIndexFile(ctx context.Context) error {
+	indexFile, err := v.imageFS.Open("index.json")
+	if err != nil {
+		v.problem("index.json", fmt.Sprintf("failed to open index: %v", err))
+		return nil
+	}
+	defer indexFile.Close()
+
+	data, err := io.ReadAll(util.ManifestReader(indexFile, v.opts.MaxManifestSize))
+	if err != nil {
+		v.problem("index.json", fmt.Sprintf("failed to read index: %v", err))
+		return nil
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		v.problem("index.json", fmt.Sprintf("failed to unmarshal index: %v", err))
+		return nil
+	}
+
+	if index.SchemaVersion != 2 {
+		v.problem("index.json", fmt.Sprintf("unsupported schema version: %d", index.SchemaVersion))
+	}
+
+	if len(index.Manifests) == 0 {
+		v.problem("index.json", "no manifests found")
+	}
+
+	return v.validateManifests(ctx, "index.json", index.Manifests, 0)
+}
+
+func (v *validator) validateManifests(ctx context.Context, parent string, manifests []ocispecs.Descriptor, depth int) error {
+	for _, desc := range manifests {
+		if err := v.validateDescriptor(ctx, parent, desc, depth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateDescriptor checks the blob of a manifest or index descriptor, and
+// then everything it references.
+func (v *validator) validateDescriptor(ctx context.Context, parent string, desc ocispecs.Descriptor, depth int) error {
+	data, ok, err := v.validateBlob(ctx, parent, desc, true)
+	if err != nil || !ok {
+		return err
+	}
+
+	name := BlobPath(desc.Digest)
+
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		var index ocispecs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			v.problem(name, fmt.Sprintf("failed to unmarshal image index: %v", err))
+			return nil
+		}
+
+		if depth >= MaxIndexDepth {
+			v.problem(name, fmt.Sprintf("image indexes are nested more than %d levels deep", MaxIndexDepth))
+			return nil
+		}
+
+		return v.validateManifests(ctx, name, index.Manifests, depth+1)
+	case ocispecs.MediaTypeImageManifest, MediaTypeDockerManifest:
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			v.problem(name, fmt.Sprintf("failed to unmarshal manifest: %v", err))
+			return nil
+		}
+
+		return v.validateManifest(ctx, name, desc, &manifest)
+	case MediaTypeArtifactManifest:
+		// Release candidate artifacts are never converted, so their blobs
+		// are not required.
+		return nil
+	default:
+		v.problem(parent, fmt.Sprintf("manifest %s has unexpected media type %s", desc.Digest, desc.MediaType))
+		return nil
+	}
+}
+
+func (v *validator) validateManifest(ctx context.Context, name string, desc ocispecs.Descriptor, manifest *ocispecs.Manifest) error {
+	config, ok, err := v.validateBlob(ctx, name, manifest.Config, true)
+	if err != nil {
+		return err
+	}
+
+	artifact := IsArtifact(desc) || manifestArtifactType(manifest) != ""
+
+	if ok && !artifact {
+		platform := desc.Platform
+		if platform == nil {
+			// Fall back to the platform recorded in the image config.
+			var image ocispecs.Image
+			if err := json.Unmarshal(config, &image); err != nil {
+				v.problem(BlobPath(manifest.Config.Digest), fmt.Sprintf("failed to unmarshal config: %v", err))
+			} else {
+				platform = &image.Platform
+			}
+		}
+
+		if platform != nil && platform.OS != "unknown" {
+			v.report.Platforms = append(v.report.Platforms, *platform)
+		}
+	}
+
+	for _, layerDesc := range manifest.Layers {
+		if IsForeignLayer(layerDesc) {
+			f, err := v.blobs.OpenBlob(ctx, layerDesc.Digest)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Foreign layers are usually distributed separately.
+				continue
+			} else if err == nil {
+				_ = f.Close()
+			}
+		}
+
+		if _, _, err := v.validateBlob(ctx, name, layerDesc, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateBlob checks that the described blob is present and matches the
+// descriptor's size and digest. If read is set, the (manifest sized) blob
+// is returned. Blobs are only checked once, ok is false if the blob was
+// already checked or has a problem.
+func (v *validator) validateBlob(ctx context.Context, parent string, desc ocispecs.Descriptor, read bool) (data []byte, ok bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if err := desc.Digest.Validate(); err != nil {
+		v.problem(parent, fmt.Sprintf("invalid digest %q: %v", desc.Digest, err))
+		return nil, false, nil
+	}
+
+	if v.visited[desc.Digest] {
+		return nil, false, nil
+	}
+	v.visited[desc.Digest] = true
+	v.report.Blobs++
+
+	name := BlobPath(desc.Digest)
+
+	f, err := v.blobs.OpenBlob(ctx, desc.Digest)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			v.problem(name, fmt.Sprintf("missing blob referenced by %s", parent))
+		} else {
+			v.problem(name, fmt.Sprintf("failed to open blob: %v", err))
+		}
+		return nil, false, nil
+	}
+	defer f.Close()
+
+	r := util.ContextReader(ctx, f)
+	if read {
+		r = util.ManifestReader(r, v.opts.MaxManifestSize)
+	}
+
+	verifier := desc.Digest.Verifier()
+
+	var n int64
+	if read {
+		data, err = io.ReadAll(io.TeeReader(r, verifier))
+		n = int64(len(data))
+	} else {
+		n, err = io.Copy(verifier, r)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+
+		v.problem(name, fmt.Sprintf("failed to read blob: %v", err))
+		return nil, false, nil
+	}
+
+	ok = true
+
+	if n != desc.Size {
+		v.problem(name, fmt.Sprintf("size mismatch: expected %d bytes, got %d", desc.Size, n))
+		ok = false
+	}
+
+	if !verifier.Verified() {
+		v.problem(name, "digest mismatch")
+		ok = false
+	}
+
+	return data, ok, nil
+}
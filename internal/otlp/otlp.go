@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package otlp exports the traces and metrics of conversions using the
+// OpenTelemetry protocol (over HTTP), as configured by the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/constants"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup installs global tracer and meter providers exporting to the
+// endpoints configured in the environment. Traces are exported if either
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set,
+// and metrics if either OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_METRICS_ENDPOINT is set. The returned function flushes
+// any pending telemetry and stops exporting.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	_, traces := os.LookupEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	_, metrics := os.LookupEnv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+	if _, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		traces, metrics = true, true
+	}
+
+	var shutdowns []func(context.Context) error
+	shutdown := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range shutdowns {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	if !traces && !metrics {
+		return shutdown, nil
+	}
+
+	// The environment (eg. OTEL_SERVICE_NAME) takes precedence.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "oci2erofs"),
+			attribute.String("service.version", constants.Version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create telemetry resource: %w", err)
+	}
+
+	if traces {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		}
+
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		otel.SetTracerProvider(tp)
+		shutdowns = append(shutdowns, tp.Shutdown)
+	}
+
+	if metrics {
+		exporter, err := otlpmetrichttp.New(ctx)
+		if err != nil {
+			_ = shutdown(ctx)
+			return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+		}
+
+		mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)), sdkmetric.WithResource(res))
+		otel.SetMeterProvider(mp)
+		shutdowns = append(shutdowns, mp.Shutdown)
+	}
+
+	return shutdown, nil
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package overlayfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+var (
+	_ fs.ReadDirFile = (*dir)(nil)
+	_ io.ReaderAt    = (*file)(nil)
+	_ io.Seeker      = (*file)(nil)
+)
+
+// file is a file opened from one of the layers. Layer files that do not
+// support random access (eg. those of tar archives) are reopened and read
+// forward to the requested offset, so that every file of the overlay is an
+// io.ReaderAt and io.Seeker.
+type file struct {
+	mu   sync.Mutex
+	f    fs.File
+	open func() (fs.File, error)
+	size int64
+	// offset is the offset of the next Read.
+	offset int64
+	// pos is the offset of f, if it does not support random access.
+	pos int64
+}
+
+func newFile(layer fs.FS, name string) (*file, error) {
+	open := func() (fs.File, error) {
+		return layer.Open(name)
+	}
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &file{f: f, open: open, size: fi.Size()}, nil
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.f.Stat()
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %w", fs.ErrInvalid)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d: %w", whence, fs.ErrInvalid)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %w", fs.ErrInvalid)
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
+
+// readAt reads len(p) bytes at off, with the semantics of io.ReaderAt.
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	if ra, ok := f.f.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+
+	if err := f.seekForward(off); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(f.f, p)
+	f.pos += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// seekForward positions f at off, reopening it if off is behind it.
+func (f *file) seekForward(off int64) error {
+	if off < f.pos {
+		reopened, err := f.open()
+		if err != nil {
+			return err
+		}
+
+		_ = f.f.Close()
+		f.f, f.pos = reopened, 0
+	}
+
+	n, err := io.CopyN(io.Discard, f.f, off-f.pos)
+	f.pos += n
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// dir is an open directory of the overlay, listing the merged entries of
+// every layer (rather than just those of the topmost one).
+type dir struct {
+	fi      fs.FileInfo
+	name    string
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
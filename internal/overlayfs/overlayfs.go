@@ -22,16 +22,23 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
 )
 
 const (
 	whiteoutPrefix     = ".wh."
 	opaqueWhiteoutName = ".wh..wh..opq"
+
+	// maxSymlinks is the maximum number of symbolic links followed when
+	// resolving a path.
+	maxSymlinks = 40
 )
 
 var (
@@ -39,75 +46,68 @@ var (
 	_ fs.ReadDirFS         = (*FS)(nil)
 	_ fs.StatFS            = (*FS)(nil)
 	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
 )
 
-// FS is an overlay file system.
+// FS is an overlay file system. The merged tree is built lazily, one
+// directory at a time as it is first looked up, so that only the parts of the
+// image that are accessed are ever read from the layers.
 type FS struct {
 	root dirent
 }
 
 // New creates a new overlay file system from the given layers.
 func New(layers []fs.FS) (*FS, error) {
-	root := dirent{
-		layer:     layers[len(layers)-1],
-		layerPath: ".",
+	// Dirents keep a pointer to their parent, so the root must not be copied
+	// once it has been loaded.
+	fsys := &FS{
+		root: dirent{
+			layer:      layers[len(layers)-1],
+			layerIndex: len(layers) - 1,
+			layerPath:  ".",
+		},
 	}
 
-	for _, layer := range layers {
-		err := fs.WalkDir(layer, ".", func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				// Eg. dangling symlinks.
-				if errors.Is(err, fs.ErrNotExist) {
-					return fs.SkipDir
-				}
-
-				return err
-			}
-
-			if path == "." {
-				return nil
-			}
-
-			dir, err := resolve(&root, filepath.Dir(path))
-			if err != nil {
-				return fmt.Errorf("failed to resolve directory %q: %w", filepath.Dir(path), err)
-			}
-
-			if d.Name() == opaqueWhiteoutName {
-				dir.children = nil
-				return nil
-			}
-
-			if strings.HasPrefix(d.Name(), whiteoutPrefix) {
-				dir.removeChild(strings.TrimPrefix(d.Name(), whiteoutPrefix))
-				return nil
-			}
-
-			dir.addChild(&dirent{
-				DirEntry:  d,
-				layer:     layer,
-				layerPath: path,
-			})
-
-			return nil
+	for layerIndex, layer := range layers {
+		fsys.root.sources = append(fsys.root.sources, source{
+			layer:      layer,
+			layerIndex: layerIndex,
+			layerPath:  ".",
 		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to walk layer: %w", err)
-		}
 	}
 
-	return &FS{
-		root: root,
-	}, nil
+	// Reading the root up front catches unreadable layers early.
+	if err := fsys.root.load(); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
 }
 
+// Open opens the named file. Directories list the merged entries of every
+// layer, and regular files support random access (io.ReaderAt and io.Seeker)
+// whether or not the layer they come from does.
 func (fsys *FS) Open(name string) (fs.File, error) {
 	d, err := resolve(&fsys.root, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return d.layer.Open(d.layerPath)
+	if d == &fsys.root || d.IsDir() {
+		fi, err := fs.Stat(d.layer, d.layerPath)
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dir{fi: fi, name: name, entries: entries}, nil
+	}
+
+	return newFile(d.layer, d.layerPath)
 }
 
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
@@ -116,6 +116,10 @@ func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
 		return nil, err
 	}
 
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
 	var children []fs.DirEntry
 	for _, child := range d.children {
 		children = append(children, child)
@@ -137,15 +141,17 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 	return fs.Stat(d.layer, d.layerPath)
 }
 
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
 func (fsys *FS) ReadLink(name string) (string, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	d, err := resolveLink(&fsys.root, name)
 	if err != nil {
 		return "", err
 	}
 
-	d, found := d.findChild(filepath.Base(name))
-	if !found {
-		return "", fs.ErrNotExist
+	if d == &fsys.root || d.Type()&fs.ModeSymlink == 0 {
+		return "", fs.ErrInvalid
 	}
 
 	linkFS, ok := d.layer.(archivefs.ReadLinkFS)
@@ -153,45 +159,96 @@ func (fsys *FS) ReadLink(name string) (string, error) {
 		return "", fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
 	}
 
-	return linkFS.ReadLink(name)
+	return linkFS.ReadLink(d.layerPath)
 }
 
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
 func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	d, err := resolveLink(&fsys.root, name)
 	if err != nil {
 		return nil, err
 	}
 
-	d, found := d.findChild(filepath.Base(name))
-	if !found {
-		return nil, fs.ErrNotExist
+	if d == &fsys.root {
+		return fs.Stat(d.layer, d.layerPath)
 	}
 
 	linkFS, ok := d.layer.(archivefs.ReadLinkFS)
 	if !ok {
-		return nil, fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil, fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
+		}
+
+		return fs.Stat(d.layer, d.layerPath)
+	}
+
+	return linkFS.StatLink(d.layerPath)
+}
+
+// Lstat returns a FileInfo describing the named file. If the file is a
+// symbolic link, the returned FileInfo describes the link itself. It is an
+// alias for StatLink.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.StatLink(name)
+}
+
+// HardLinkID returns the value that identifies the named file in the layer
+// that provides it (see util.HardLinkFS). Only the hard links that come from
+// the same layer are ever links to one another.
+func (fsys *FS) HardLinkID(name string) (any, error) {
+	d, err := resolveLink(&fsys.root, name)
+	if err != nil {
+		return nil, err
 	}
 
-	return linkFS.StatLink(name)
+	return util.HardLinkID(d.layer, d.layerPath)
+}
+
+// Layer returns the index of the (topmost) layer that provides the named
+// file. If the file is a symbolic link, the link itself is considered.
+func (fsys *FS) Layer(name string) (int, error) {
+	d, err := resolveLink(&fsys.root, name)
+	if err != nil {
+		return -1, err
+	}
+
+	return d.layerIndex, nil
 }
 
 // resolve resolves the given path to a dirent.
 func resolve(root *dirent, name string) (*dirent, error) {
-	d := root
+	var links int
+	return walk(root, root, sanitizePath(name), &links)
+}
 
-	name = sanitizePath(name)
-	if name == "" {
-		return d, nil
-	}
+// walk resolves the given path relative to the directory d, following any
+// symbolic links (relative targets from the directory containing the link).
+func walk(root, d *dirent, name string, links *int) (*dirent, error) {
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			// The parent of the root is the root.
+			if d.parent != nil {
+				d = d.parent
+			}
+			continue
+		}
 
-	for _, component := range strings.Split(name, "/") {
-		var found bool
-		d, found = d.findChild(component)
-		if !found {
-			return nil, fs.ErrNotExist
+		var err error
+		d, err = d.child(component)
+		if err != nil {
+			return nil, err
 		}
 
 		if d.Type()&fs.ModeSymlink != 0 {
+			if *links++; *links > maxSymlinks {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+
 			linkFS, ok := d.layer.(archivefs.ReadLinkFS)
 			if !ok {
 				return nil, fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
@@ -204,17 +261,14 @@ func resolve(root *dirent, name string) (*dirent, error) {
 			}
 
 			// Resolve the target.
-			if !filepath.IsAbs(target) && d.parent != nil {
-				d, err = resolve(d.parent, target)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				// The target is an absolute path or the dirent is the root dirent.
-				d, err = resolve(root, target)
-				if err != nil {
-					return nil, err
-				}
+			start := d.parent
+			if filepath.IsAbs(target) {
+				start = root
+			}
+
+			d, err = walk(root, start, target, links)
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -222,39 +276,129 @@ func resolve(root *dirent, name string) (*dirent, error) {
 	return d, nil
 }
 
+// resolveLink resolves the given path to a dirent, without following the
+// final path component if it is a symbolic link.
+func resolveLink(root *dirent, name string) (*dirent, error) {
+	if sanitizePath(name) == "" {
+		return root, nil
+	}
+
+	d, err := resolve(root, filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return d.child(filepath.Base(name))
+}
+
+// sanitizePath returns the name relative to the root. Unlike tarfs, it keeps
+// the leading dot of names at the root (eg. ".wh.foo").
 func sanitizePath(name string) string {
-	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(filepath.ToSlash(strings.TrimSpace(name))), "."), "/")
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(strings.TrimSpace(name))), "/")
+}
+
+// source is a directory (or file) of a single layer.
+type source struct {
+	layer      fs.FS
+	layerIndex int
+	layerPath  string
 }
 
 type dirent struct {
 	fs.DirEntry
-	layer     fs.FS
-	layerPath string
-	parent    *dirent
-	children  map[string]*dirent
+	layer      fs.FS
+	layerIndex int
+	layerPath  string
+	parent     *dirent
+	// sources are the directories merged into this one, from the lowest
+	// layer up. It is empty for anything other than a directory.
+	sources []source
+
+	once     sync.Once
+	children map[string]*dirent
+	err      error
 }
 
-func (d *dirent) findChild(name string) (*dirent, bool) {
+// child looks up the named entry of the directory, loading the directory if
+// it has not been already.
+func (d *dirent) child(name string) (*dirent, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
 	c, ok := d.children[name]
-	return c, ok
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return c, nil
 }
 
-func (d *dirent) addChild(child *dirent) {
-	if d.children == nil {
-		d.children = make(map[string]*dirent)
-	}
+// load merges the entries of the directory's sources, applying the whiteouts
+// of each layer to those below it. The children of subdirectories are not
+// read until they are themselves loaded.
+func (d *dirent) load() error {
+	d.once.Do(func() {
+		children := make(map[string]*dirent)
 
-	c := *child
-	c.parent = d
+		for _, src := range d.sources {
+			entries, err := fs.ReadDir(src.layer, src.layerPath)
+			if err != nil {
+				// Eg. dangling symlinks.
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
 
-	// do we already have a child with the same name?
-	if existing, ok := d.children[c.Name()]; ok {
-		c.children = existing.children
-	}
+				d.err = fmt.Errorf("failed to read directory %q of layer %d: %w", src.layerPath, src.layerIndex, err)
+				return
+			}
 
-	d.children[c.Name()] = &c
-}
+			// Whiteouts only apply to the lower layers, so they are processed
+			// before any of the entries from this layer are added.
+			for _, entry := range entries {
+				name, ok := strings.CutPrefix(entry.Name(), whiteoutPrefix)
+				if !ok {
+					continue
+				}
+
+				if entry.Name() == opaqueWhiteoutName {
+					clear(children)
+				} else {
+					delete(children, name)
+				}
+			}
+
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), whiteoutPrefix) {
+					continue
+				}
+
+				child := source{
+					layer:      src.layer,
+					layerIndex: src.layerIndex,
+					layerPath:  path.Join(src.layerPath, entry.Name()),
+				}
+
+				// Directories are merged with any lower directory of the same
+				// name, any other type of file replaces it outright.
+				existing, ok := children[entry.Name()]
+				if !ok || !existing.IsDir() || !entry.IsDir() {
+					existing = &dirent{parent: d}
+					children[entry.Name()] = existing
+				}
+
+				existing.DirEntry = entry
+				existing.layer = child.layer
+				existing.layerIndex = child.layerIndex
+				existing.layerPath = child.layerPath
+				if entry.IsDir() {
+					existing.sources = append(existing.sources, child)
+				}
+			}
+		}
+
+		d.children = children
+	})
 
-func (d *dirent) removeChild(name string) {
-	delete(d.children, name)
+	return d.err
 }
@@ -19,16 +19,24 @@
 package overlayfs_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/uncompr"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/immutos/oci2erofs/internal/util"
 	"github.com/rogpeppe/go-internal/dirhash"
 	"github.com/stretchr/testify/require"
 )
@@ -352,3 +360,483 @@ func TestOverlayFS(t *testing.T) {
 		require.Equal(t, "h1:hJbAbj8GzqpjzKJ7vPyenrzI/QB2YfM5RtMYnVrwiSo=", h)
 	})
 }
+
+func TestOverlayFSDirectoryMetadata(t *testing.T) {
+	lower := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "foo/a", Mode: 0o644}, Content: "hello world\n"},
+	})
+
+	// The upper layer chmods/chowns the directory created by the lower layer.
+	upper := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0o700, Uid: 1000, Gid: 1000}},
+	})
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Stat", func(t *testing.T) {
+		fi, err := fsys.Stat("foo")
+		require.NoError(t, err)
+
+		require.True(t, fi.IsDir())
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		entries, err := fsys.ReadDir(".")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		fi, err := entries[0].Info()
+		require.NoError(t, err)
+
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+	})
+
+	t.Run("Children", func(t *testing.T) {
+		content, err := fs.ReadFile(fsys, "foo/a")
+		require.NoError(t, err)
+
+		require.Equal(t, "hello world\n", string(content))
+	})
+}
+
+func TestOverlayFSFiles(t *testing.T) {
+	lower := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "localhost\n"},
+	})
+
+	upper := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644}, Content: "hello world\n"},
+	})
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("ReadAt", func(t *testing.T) {
+		f, err := fsys.Open("etc/motd")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		ra, ok := f.(io.ReaderAt)
+		require.True(t, ok)
+
+		buf := make([]byte, 5)
+		_, err = ra.ReadAt(buf, 6)
+		require.NoError(t, err)
+		require.Equal(t, "world", string(buf))
+
+		// Reading backwards.
+		_, err = ra.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+
+		n, err := ra.ReadAt(buf, 10)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 2, n)
+
+		// ReadAt does not affect Read.
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", string(content))
+	})
+
+	t.Run("Seek", func(t *testing.T) {
+		f, err := fsys.Open("etc/motd")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		seeker, ok := f.(io.Seeker)
+		require.True(t, ok)
+
+		offset, err := seeker.Seek(-6, io.SeekEnd)
+		require.NoError(t, err)
+		require.Equal(t, int64(6), offset)
+
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "world\n", string(content))
+
+		_, err = seeker.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+
+		content, err = io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "hello world\n", string(content))
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		f, err := fsys.Open("etc")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		dir, ok := f.(fs.ReadDirFile)
+		require.True(t, ok)
+
+		// Entries from every layer, not just the topmost.
+		entries, err := dir.ReadDir(1)
+		require.NoError(t, err)
+		require.Equal(t, "hostname", entries[0].Name())
+
+		entries, err = dir.ReadDir(1)
+		require.NoError(t, err)
+		require.Equal(t, "motd", entries[0].Name())
+
+		_, err = dir.ReadDir(1)
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestOverlayFSSymlinks(t *testing.T) {
+	lower := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/busybox", Mode: 0o755}, Content: "busybox"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/sh", Linkname: "busybox", Mode: 0o777}},
+	})
+
+	// The upper layer links to a directory provided by the lower layer.
+	upper := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777}},
+	})
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("ReadLink", func(t *testing.T) {
+		target, err := fsys.ReadLink("bin")
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", target)
+
+		// Through a symlinked directory.
+		target, err = fsys.ReadLink("bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "busybox", target)
+
+		_, err = fsys.ReadLink("usr/bin/busybox")
+		require.ErrorIs(t, err, fs.ErrInvalid)
+
+		_, err = fsys.ReadLink("bin/missing")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		fi, err := fsys.Stat("bin/sh")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+		require.Equal(t, int64(len("busybox")), fi.Size())
+	})
+
+	t.Run("Lstat", func(t *testing.T) {
+		fi, err := fsys.Lstat("bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		fi, err = fsys.StatLink("bin")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		fi, err = fsys.Lstat(".")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+	})
+
+	t.Run("Parent Directory", func(t *testing.T) {
+		fsys, err := overlayfs.New([]fs.FS{lower, testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/sbin/", Mode: 0o755}},
+			{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/sbin/sh", Linkname: "../bin/sh", Mode: 0o777}},
+			// Climbing above the root stays at the root.
+			{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/sbin/busybox", Linkname: "../../../usr/bin/busybox", Mode: 0o777}},
+		})})
+		require.NoError(t, err)
+
+		for _, name := range []string{"usr/sbin/sh", "usr/sbin/busybox"} {
+			content, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, name)
+			require.Equal(t, "busybox", string(content), name)
+		}
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		fsys, err := overlayfs.New([]fs.FS{testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "b", Mode: 0o777}},
+			{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "b", Linkname: "a", Mode: 0o777}},
+		})})
+		require.NoError(t, err)
+
+		_, err = fsys.Stat("a")
+		require.ErrorContains(t, err, "too many levels of symbolic links")
+
+		// The links themselves are still readable.
+		target, err := fsys.ReadLink("a")
+		require.NoError(t, err)
+		require.Equal(t, "b", target)
+	})
+
+	t.Run("Layer", func(t *testing.T) {
+		layerIndex, err := fsys.Layer("bin")
+		require.NoError(t, err)
+		require.Equal(t, 1, layerIndex)
+
+		layerIndex, err = fsys.Layer("bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, 0, layerIndex)
+	})
+}
+
+func TestOverlayFSWhiteouts(t *testing.T) {
+	lower := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "lower"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644}, Content: "lower"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "opt/app/lib/libfoo.so", Mode: 0o644}, Content: "lower"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/stale", Mode: 0o644}, Content: "lower"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/data/old", Mode: 0o644}, Content: "lower"},
+	})
+
+	upper := testutil.CreateTarFS(t, []testutil.File{
+		// Whiteout of a single file.
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.hostname", Mode: 0o644}},
+		// Whiteout of a directory and everything below it.
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "opt/.wh.app", Mode: 0o644}},
+		// Opaque directory, the "-new" entry sorts before the marker.
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/-new", Mode: 0o644}, Content: "upper"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/.wh..wh..opq", Mode: 0o644}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "var/cache/fresh", Mode: 0o644}, Content: "upper"},
+		// A file replacing a lower directory.
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/data", Mode: 0o644}, Content: "upper"},
+		// Whiteout of something that never existed.
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "missing/.wh.nothing", Mode: 0o644}},
+	})
+
+	// A later layer recreates the directory that was whited out.
+	top := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "opt/app/bin/app", Mode: 0o755}, Content: "top"},
+	})
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper, top})
+	require.NoError(t, err)
+
+	t.Run("File", func(t *testing.T) {
+		_, err := fsys.Stat("etc/hostname")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		content, err := fs.ReadFile(fsys, "etc/hosts")
+		require.NoError(t, err)
+		require.Equal(t, "lower", string(content))
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		_, err := fsys.Stat("opt/app/lib/libfoo.so")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		entries, err := fsys.ReadDir("opt/app")
+		require.NoError(t, err)
+		require.Equal(t, []string{"bin"}, entryNames(entries))
+	})
+
+	t.Run("Opaque", func(t *testing.T) {
+		entries, err := fsys.ReadDir("var/cache")
+		require.NoError(t, err)
+		require.Equal(t, []string{"-new", "fresh"}, entryNames(entries))
+	})
+
+	t.Run("Replaced Directory", func(t *testing.T) {
+		fi, err := fsys.Stat("srv/data")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+
+		_, err = fsys.Stat("srv/data/old")
+		require.Error(t, err)
+	})
+
+	t.Run("Markers Hidden", func(t *testing.T) {
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			require.False(t, strings.HasPrefix(d.Name(), ".wh."), path)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Root", func(t *testing.T) {
+		// Dot names at the root are anchored by layer normalization, as tarfs
+		// would otherwise drop the dot.
+		lower := testutil.CreateTarFS(t, []testutil.File{
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "/.profile", Mode: 0o644}, Content: "lower"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "opt/app", Mode: 0o755}, Content: "lower"},
+			{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/data", Mode: 0o644}, Content: "lower"},
+		})
+
+		t.Run("Whiteout", func(t *testing.T) {
+			upper := testutil.CreateTarFS(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "/.wh.opt", Mode: 0o644}},
+			})
+
+			fsys, err := overlayfs.New([]fs.FS{lower, upper})
+			require.NoError(t, err)
+
+			entries, err := fsys.ReadDir(".")
+			require.NoError(t, err)
+			require.Equal(t, []string{".profile", "srv"}, entryNames(entries))
+
+			content, err := fs.ReadFile(fsys, ".profile")
+			require.NoError(t, err)
+			require.Equal(t, "lower", string(content))
+		})
+
+		t.Run("Opaque", func(t *testing.T) {
+			upper := testutil.CreateTarFS(t, []testutil.File{
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "/.wh..wh..opq", Mode: 0o644}},
+				{Header: tar.Header{Typeflag: tar.TypeReg, Name: "srv/fresh", Mode: 0o644}, Content: "upper"},
+			})
+
+			fsys, err := overlayfs.New([]fs.FS{lower, upper})
+			require.NoError(t, err)
+
+			entries, err := fsys.ReadDir(".")
+			require.NoError(t, err)
+			require.Equal(t, []string{"srv"}, entryNames(entries))
+
+			entries, err = fsys.ReadDir("srv")
+			require.NoError(t, err)
+			require.Equal(t, []string{"fresh"}, entryNames(entries))
+		})
+	})
+}
+
+func TestOverlayFSHardLinks(t *testing.T) {
+	openTar := func(hdrs ...*tar.Header) fs.FS {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			require.NoError(t, tw.WriteHeader(hdr))
+		}
+		require.NoError(t, tw.Close())
+
+		fsys, err := util.OpenTar(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		return fsys
+	}
+
+	lower := openTar(
+		&tar.Header{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0o755},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "bin/sh", Linkname: "bin/busybox"},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "bin/ls", Linkname: "bin/busybox"},
+	)
+	upper := openTar(
+		&tar.Header{Typeflag: tar.TypeReg, Name: "bin/ls", Mode: 0o755},
+	)
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	busybox, err := fsys.HardLinkID("bin/busybox")
+	require.NoError(t, err)
+	require.NotNil(t, busybox)
+
+	sh, err := fsys.HardLinkID("bin/sh")
+	require.NoError(t, err)
+	require.Equal(t, busybox, sh)
+
+	// A file from another layer is not a link, whatever it replaced.
+	ls, err := fsys.HardLinkID("bin/ls")
+	require.NoError(t, err)
+	require.Nil(t, ls)
+
+	_, err = fsys.HardLinkID("bin/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestOverlayFSLazy(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	lower := &countingFS{
+		FS: fstest.MapFS{
+			"etc/hostname":         {Data: []byte("lower")},
+			"usr/share/doc/README": {Data: []byte("lower")},
+		},
+		errs: map[string]error{"usr/share/doc": errBroken},
+	}
+	upper := &countingFS{
+		FS: fstest.MapFS{
+			"etc/hosts": {Data: []byte("upper")},
+		},
+	}
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Root Only", func(t *testing.T) {
+		require.Equal(t, []string{"."}, lower.reads())
+		require.Equal(t, []string{"."}, upper.reads())
+	})
+
+	t.Run("Memoized", func(t *testing.T) {
+		for range 2 {
+			entries, err := fsys.ReadDir("etc")
+			require.NoError(t, err)
+			require.Equal(t, []string{"hostname", "hosts"}, entryNames(entries))
+		}
+
+		require.Equal(t, []string{".", "etc"}, lower.reads())
+		require.Equal(t, []string{".", "etc"}, upper.reads())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := fsys.Stat("usr/share")
+		require.NoError(t, err)
+
+		_, err = fsys.Stat("usr/share/doc/README")
+		require.ErrorIs(t, err, errBroken)
+
+		_, err = fsys.ReadDir("usr/share/doc")
+		require.ErrorIs(t, err, errBroken)
+	})
+}
+
+// countingFS records the directories read from it, and fails to read those
+// with an error set.
+type countingFS struct {
+	fs.FS
+	mu   sync.Mutex
+	read []string
+	errs map[string]error
+}
+
+func (fsys *countingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.Lock()
+	fsys.read = append(fsys.read, name)
+	fsys.mu.Unlock()
+
+	if err, ok := fsys.errs[name]; ok {
+		return nil, err
+	}
+
+	return fs.ReadDir(fsys.FS, name)
+}
+
+func (fsys *countingFS) reads() []string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return slices.Clone(fsys.read)
+}
+
+func entryNames(entries []fs.DirEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package priority lowers the CPU and I/O scheduling priority of the
+// process, like nice(1) and ionice(1), so that conversions can run politely
+// on a shared host.
+package priority
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IOClass is an I/O scheduling class.
+type IOClass int
+
+const (
+	// IOClassBestEffort is the default class, with a priority level from
+	// 0 (highest) to 7 (lowest).
+	IOClassBestEffort IOClass = 2
+	// IOClassIdle only gets disk time when no other process needs it.
+	IOClassIdle IOClass = 3
+)
+
+// IOPriority is an I/O scheduling priority.
+type IOPriority struct {
+	Class IOClass
+	// Level is the priority within the best-effort class.
+	Level int
+}
+
+// ParseIOPriority parses an I/O priority, either "idle" or "best-effort"
+// with an optional level (eg. "best-effort:7").
+func ParseIOPriority(s string) (*IOPriority, error) {
+	class, level, hasLevel := strings.Cut(s, ":")
+
+	switch class {
+	case "idle":
+		if hasLevel {
+			return nil, fmt.Errorf("invalid I/O priority %q: the idle class has no levels", s)
+		}
+
+		return &IOPriority{Class: IOClassIdle}, nil
+	case "best-effort":
+		p := &IOPriority{Class: IOClassBestEffort, Level: 4}
+		if hasLevel {
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 0 || n > 7 {
+				return nil, fmt.Errorf("invalid I/O priority %q: the level must be from 0 to 7", s)
+			}
+			p.Level = n
+		}
+
+		return p, nil
+	default:
+		return nil, fmt.Errorf("invalid I/O priority %q: expected idle or best-effort[:LEVEL]", s)
+	}
+}
+
+// String returns the priority in the form accepted by ParseIOPriority.
+func (p IOPriority) String() string {
+	if p.Class == IOClassIdle {
+		return "idle"
+	}
+
+	return "best-effort:" + strconv.Itoa(p.Level)
+}
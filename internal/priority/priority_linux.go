@@ -0,0 +1,87 @@
+//go:build linux
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package priority
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// Set lowers the CPU priority of the process to the given niceness (if not
+// zero) and sets its I/O priority (if not nil). Scheduling priorities are
+// per thread on Linux, so every thread of the process is updated, and the
+// threads started later inherit the priority of the thread that starts them.
+func Set(nice int, io *IOPriority) error {
+	if nice == 0 && io == nil {
+		return nil
+	}
+
+	if nice < 0 || nice > 19 {
+		return fmt.Errorf("invalid niceness %d: must be from 0 to 19", nice)
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("failed to list threads: %w", err)
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := setThread(tid, nice, io); errors.Is(err, unix.ESRCH) {
+			// The thread has exited.
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setThread(tid, nice int, io *IOPriority) error {
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("failed to set CPU priority: %w", err)
+		}
+	}
+
+	if io != nil {
+		ioprio := int(io.Class)<<ioprioClassShift | io.Level
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("failed to set I/O priority: %w", errno)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package priority_test
+
+import (
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/priority"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIOPriority(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		for s, expected := range map[string]priority.IOPriority{
+			"idle":          {Class: priority.IOClassIdle},
+			"best-effort":   {Class: priority.IOClassBestEffort, Level: 4},
+			"best-effort:0": {Class: priority.IOClassBestEffort},
+			"best-effort:7": {Class: priority.IOClassBestEffort, Level: 7},
+		} {
+			p, err := priority.ParseIOPriority(s)
+			require.NoError(t, err, s)
+			require.Equal(t, expected, *p, s)
+		}
+	})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		p, err := priority.ParseIOPriority("best-effort:6")
+		require.NoError(t, err)
+		require.Equal(t, "best-effort:6", p.String())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, s := range []string{"", "realtime", "idle:3", "best-effort:8", "best-effort:-1", "best-effort:x"} {
+			_, err := priority.ParseIOPriority(s)
+			require.Error(t, err, s)
+		}
+	})
+}
+
+func TestSet(t *testing.T) {
+	require.NoError(t, priority.Set(0, nil))
+}
@@ -0,0 +1,244 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// Stage identifies a phase of a conversion.
+type Stage string
+
+const (
+	// StageDownload reports the bytes of each blob downloaded from a registry.
+	StageDownload Stage = "download"
+	// StageDecompress reports the (compressed) bytes of each layer read.
+	StageDecompress Stage = "decompress"
+	// StageBuild reports the number of files written to the image.
+	StageBuild Stage = "build"
+)
+
+// Event reports the progress of an item (eg. a blob or layer) within a stage.
+type Event struct {
+	Stage Stage `json:"stage"`
+	// Item identifies what is being processed (eg. a blob digest).
+	Item string `json:"item,omitempty"`
+	// Current is the number of bytes (or files) processed so far.
+	Current int64 `json:"current"`
+	// Total is the number of bytes (or files) expected, or zero if unknown.
+	Total int64 `json:"total,omitempty"`
+}
+
+// Done reports whether the item is complete.
+func (e Event) Done() bool {
+	return e.Total > 0 && e.Current >= e.Total
+}
+
+// Func receives progress events. It may be called concurrently.
+type Func func(Event)
+
+// Reader returns a reader that reports the bytes read from r, counting on
+// from e.Current. If fn is nil, r is returned as is.
+func Reader(r io.Reader, fn Func, e Event) io.Reader {
+	if fn == nil {
+		return r
+	}
+
+	return &reader{r: r, fn: fn, event: e}
+}
+
+type reader struct {
+	r     io.Reader
+	fn    Func
+	event Event
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.event.Current += int64(n)
+		r.fn(r.event)
+	}
+
+	return n, err
+}
+
+// Bars renders a progress bar per stage, redrawing them in place on a
+// terminal. Anything else written to the terminal while the bars are shown
+// should be written through Bars.
+type Bars struct {
+	w        io.Writer
+	interval time.Duration
+
+	mu       sync.Mutex
+	stages   []Stage
+	items    map[Stage]map[string]Event
+	lines    int
+	lastDraw time.Time
+}
+
+// NewBars returns a progress bar renderer writing to w (eg. os.Stderr).
+func NewBars(w io.Writer) *Bars {
+	return &Bars{
+		w:        w,
+		interval: 100 * time.Millisecond,
+		items:    make(map[Stage]map[string]Event),
+	}
+}
+
+// Report records an event, redrawing the bars at most every 100ms.
+func (b *Bars) Report(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	items, ok := b.items[e.Stage]
+	if !ok {
+		items = make(map[string]Event)
+		b.items[e.Stage] = items
+		b.stages = append(b.stages, e.Stage)
+	}
+	items[e.Item] = e
+
+	if time.Since(b.lastDraw) >= b.interval {
+		b.draw()
+	}
+}
+
+// Write writes p (eg. a log line) above the bars.
+func (b *Bars) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.lines > 0 {
+		// Erase the bars, they are redrawn below the written text.
+		if _, err := fmt.Fprintf(b.w, "\x1b[%dA\x1b[J", b.lines); err != nil {
+			return 0, err
+		}
+		b.lines = 0
+	}
+
+	n, err := b.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	b.draw()
+
+	return n, nil
+}
+
+// Close draws the bars one final time.
+func (b *Bars) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.draw()
+
+	return nil
+}
+
+func (b *Bars) draw() {
+	var sb strings.Builder
+
+	// Move back to the start of the previously drawn bars.
+	if b.lines > 0 {
+		fmt.Fprintf(&sb, "\x1b[%dA", b.lines)
+	}
+
+	for _, stage := range b.stages {
+		var current, total int64
+		var done int
+		for _, e := range b.items[stage] {
+			current += e.Current
+			total += e.Total
+			if e.Done() {
+				done++
+			}
+		}
+
+		fmt.Fprintf(&sb, "\x1b[2K%-10s %s %s", stage, bar(current, total, 30), formatAmount(stage, current, total))
+		if stage != StageBuild {
+			fmt.Fprintf(&sb, " (%d/%d)", done, len(b.items[stage]))
+		}
+		sb.WriteString("\n")
+	}
+
+	b.lines = len(b.stages)
+	b.lastDraw = time.Now()
+
+	_, _ = io.WriteString(b.w, sb.String())
+}
+
+func bar(current, total int64, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = int(min(current, total) * int64(width) / total)
+	}
+
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+func formatAmount(stage Stage, current, total int64) string {
+	if stage == StageBuild {
+		return fmt.Sprintf("%d/%d files", current, total)
+	}
+
+	return util.FormatBytes(current) + "/" + util.FormatBytes(total)
+}
+
+// JSON writes events as newline delimited JSON objects, for consumption by
+// CI systems and log processors.
+type JSON struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	enc      *json.Encoder
+	lastEmit map[Event]time.Time
+}
+
+// NewJSON returns a JSON progress renderer writing to w.
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{
+		interval: time.Second,
+		enc:      json.NewEncoder(w),
+		lastEmit: make(map[Event]time.Time),
+	}
+}
+
+// Report writes an event, at most once a second per item (completed items
+// are always written).
+func (j *JSON) Report(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := Event{Stage: e.Stage, Item: e.Item}
+	if !e.Done() && time.Since(j.lastEmit[key]) < j.interval {
+		return
+	}
+	j.lastEmit[key] = time.Now()
+
+	_ = j.enc.Encode(e)
+}
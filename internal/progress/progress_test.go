@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	var events []progress.Event
+	r := progress.Reader(strings.NewReader("hello"), func(e progress.Event) {
+		events = append(events, e)
+	}, progress.Event{Stage: progress.StageDownload, Item: "blob", Current: 2, Total: 7})
+
+	_, err := io.Copy(io.Discard, r)
+	require.NoError(t, err)
+
+	require.NotEmpty(t, events)
+	require.Equal(t, progress.Event{Stage: progress.StageDownload, Item: "blob", Current: 7, Total: 7}, events[len(events)-1])
+	require.True(t, events[len(events)-1].Done())
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	j := progress.NewJSON(&buf)
+
+	j.Report(progress.Event{Stage: progress.StageBuild, Current: 1, Total: 3})
+	// Throttled.
+	j.Report(progress.Event{Stage: progress.StageBuild, Current: 2, Total: 3})
+	// Complete items are always written.
+	j.Report(progress.Event{Stage: progress.StageBuild, Current: 3, Total: 3})
+
+	var events []progress.Event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e progress.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+
+	require.Equal(t, []progress.Event{
+		{Stage: progress.StageBuild, Current: 1, Total: 3},
+		{Stage: progress.StageBuild, Current: 3, Total: 3},
+	}, events)
+}
+
+func TestBars(t *testing.T) {
+	var buf bytes.Buffer
+	bars := progress.NewBars(&buf)
+
+	bars.Report(progress.Event{Stage: progress.StageDownload, Item: "a", Current: 512, Total: 1024})
+	bars.Report(progress.Event{Stage: progress.StageDownload, Item: "b", Current: 1024, Total: 1024})
+
+	_, err := bars.Write([]byte("log line\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, bars.Close())
+
+	output := buf.String()
+	require.Contains(t, output, "log line\n")
+	require.Contains(t, output, "1.5 KiB/2.0 KiB (1/2)")
+}
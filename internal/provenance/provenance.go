@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package provenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/synthetic"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Path is the location of the embedded provenance manifest within the image.
+// It must not start with a dot, as tarfs strips the leading dot from the
+// names of root level entries.
+const Path = "etc/oci2erofs/provenance.json"
+
+// Manifest records which layer each file in the merged root filesystem came from.
+type Manifest struct {
+	// Layers are the descriptors of the image layers, in order.
+	Layers []ocispecs.Descriptor `json:"layers"`
+	// History describes how each layer was created (eg. the Dockerfile
+	// instruction), aligned with Layers. It is omitted if the image config's
+	// history does not account for every layer.
+	History []ocispecs.History `json:"history,omitempty"`
+	// Files maps each path to the index of the topmost layer that provides it.
+	Files map[string]int `json:"files"`
+}
+
+// LayerHistory returns the entries of an image config's history that created
+// each of its n layers, skipping entries for empty layers. It returns nil if
+// the history does not account for exactly n layers.
+func LayerHistory(history []ocispecs.History, n int) []ocispecs.History {
+	var layerHistory []ocispecs.History
+	for _, h := range history {
+		if !h.EmptyLayer {
+			layerHistory = append(layerHistory, h)
+		}
+	}
+
+	if len(layerHistory) != n {
+		return nil
+	}
+
+	return layerHistory
+}
+
+// Collect builds a provenance manifest for the merged root filesystem. History
+// is optional, if provided it must be aligned with layers.
+func Collect(rootFS *overlayfs.FS, layers []ocispecs.Descriptor, history []ocispecs.History) (*Manifest, error) {
+	if len(history) != len(layers) {
+		history = nil
+	}
+
+	m := Manifest{
+		Layers:  layers,
+		History: history,
+		Files:   make(map[string]int),
+	}
+
+	err := fs.WalkDir(rootFS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		layerIndex, err := rootFS.Layer(path)
+		if err != nil {
+			return fmt.Errorf("failed to get layer for %q: %w", path, err)
+		}
+
+		m.Files[filepath.ToSlash(path)] = layerIndex
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Embed returns a copy of the root filesystem with the provenance manifest
+// stored at Path. The directories enclosing it keep their metadata from the
+// image.
+func Embed(rootFS *overlayfs.FS, m *Manifest) (*overlayfs.FS, error) {
+	manifestJSON, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance manifest: %w", err)
+	}
+
+	embeddedFS, _, err := synthetic.Apply(rootFS, []synthetic.Entry{{
+		Path:    Path,
+		Type:    synthetic.TypeFile,
+		Content: string(manifestJSON),
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed provenance manifest: %w", err)
+	}
+
+	return embeddedFS, nil
+}
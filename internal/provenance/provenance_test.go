@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package provenance_test
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/fs"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/provenance"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbed(t *testing.T) {
+	lower := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "lower"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644}, Content: "root"},
+	})
+
+	upper := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "upper"},
+		{Header: tar.Header{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname"}},
+	})
+
+	rootFS, err := overlayfs.New([]fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	layers := []ocispecs.Descriptor{
+		{MediaType: ocispecs.MediaTypeImageLayer, Digest: "sha256:aaaa"},
+		{MediaType: ocispecs.MediaTypeImageLayer, Digest: "sha256:bbbb"},
+	}
+
+	history := []ocispecs.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "RUN echo upper > /etc/hostname"},
+	}
+
+	m, err := provenance.Collect(rootFS, layers, history)
+	require.NoError(t, err)
+
+	embeddedFS, err := provenance.Embed(rootFS, m)
+	require.NoError(t, err)
+
+	data, err := fs.ReadFile(embeddedFS, provenance.Path)
+	require.NoError(t, err)
+
+	var embedded provenance.Manifest
+	require.NoError(t, json.Unmarshal(data, &embedded))
+
+	require.Equal(t, layers, embedded.Layers)
+	require.Equal(t, history, embedded.History)
+	require.Equal(t, map[string]int{
+		"etc":          1,
+		"etc/hostname": 1,
+		"etc/passwd":   0,
+		"hostname":     1,
+	}, embedded.Files)
+
+	// The original files should still be present.
+	data, err = fs.ReadFile(embeddedFS, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, "upper", string(data))
+}
+
+func TestLayerHistory(t *testing.T) {
+	history := []ocispecs.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV FOO=bar", EmptyLayer: true},
+		{CreatedBy: "RUN touch /foo"},
+	}
+
+	t.Run("Aligned", func(t *testing.T) {
+		require.Equal(t, []ocispecs.History{history[0], history[2]}, provenance.LayerHistory(history, 2))
+	})
+
+	t.Run("Mismatched", func(t *testing.T) {
+		require.Nil(t, provenance.LayerHistory(history, 3))
+		require.Nil(t, provenance.LayerHistory(nil, 1))
+	})
+}
@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// dockerHubHost is the registry API host for Docker Hub.
+const dockerHubHost = "registry-1.docker.io"
+
+// client is a minimal OCI distribution API client for a single repository.
+type client struct {
+	httpClient  *http.Client
+	scheme      string
+	host        string
+	repository  string
+	credentials *Credentials
+	// push requests push as well as pull access to the repository from
+	// token services whose challenge does not name a scope.
+	push bool
+
+	mu            sync.Mutex
+	authorization string
+}
+
+// get performs a GET request against the repository, authenticating if
+// challenged by the registry. Expired tokens are refreshed the same way, as
+// the registry challenges again once they expire.
+func (c *client) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	return c.send(ctx, http.MethodGet, c.url(path), header, nil, http.StatusOK, http.StatusPartialContent)
+}
+
+// url returns the URL of path within the repository, eg. "blobs/sha256:...".
+func (c *client) url(path string) string {
+	u := url.URL{
+		Scheme: c.scheme,
+		Host:   c.host,
+		Path:   "/v2/" + c.repository + "/" + path,
+	}
+
+	return u.String()
+}
+
+// send performs a request against the registry, authenticating if challenged
+// (see get). The body, if any, is sent again from the start after
+// authenticating. A response with a status other than one of statuses is
+// returned as a *statusError.
+func (c *client) send(ctx context.Context, method, u string, header http.Header, body *io.SectionReader, statuses ...int) (*http.Response, error) {
+	resp, err := c.do(ctx, method, u, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+
+		resp, err = c.do(ctx, method, u, header, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !slices.Contains(statuses, resp.StatusCode) {
+		_ = resp.Body.Close()
+		return nil, &statusError{Method: method, URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+// getURL performs a GET request against an arbitrary URL (eg. one listed by
+// a foreign layer), without the repository's credentials.
+func (c *client) getURL(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, &statusError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+// statusError is returned when the registry responds with an unexpected status.
+type statusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *statusError) Error() string {
+	if e.Method != "" && e.Method != http.MethodGet {
+		return fmt.Sprintf("unexpected status from %s %s: %s", e.Method, e.URL, e.Status)
+	}
+
+	return fmt.Sprintf("unexpected status fetching %s: %s", e.URL, e.Status)
+}
+
+// Is reports access denied by the registry as ErrUnauthorized.
+func (e *statusError) Is(target error) bool {
+	return target == ErrUnauthorized && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
+
+func (c *client) do(ctx context.Context, method, u string, header http.Header, body *io.SectionReader) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = io.NewSectionReader(body, 0, body.Size())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = body.Size()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(body, 0, body.Size())), nil
+		}
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	c.mu.Lock()
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	c.mu.Unlock()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	return resp, nil
+}
+
+// authenticate responds to a WWW-Authenticate challenge, using either basic
+// authentication or the bearer token flow.
+func (c *client) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.credentials == nil {
+			return fmt.Errorf("%w: registry %s requires credentials", ErrUnauthorized, c.host)
+		}
+
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+
+		c.mu.Lock()
+		c.authorization = req.Header.Get("Authorization")
+		c.mu.Unlock()
+
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, params)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.authorization = "Bearer " + token
+		c.mu.Unlock()
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported authentication scheme: %q", scheme)
+	}
+}
+
+// fetchToken fetches a bearer token from the token service named in the
+// challenge parameters.
+func (c *client) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("bearer challenge is missing realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse realm: %w", err)
+	}
+
+	query := u.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+
+	scope, ok := params["scope"]
+	if !ok {
+		scope = "repository:" + c.repository + ":pull"
+		if c.push {
+			scope += ",push"
+		}
+	}
+	query.Set("scope", scope)
+
+	var req *http.Request
+	if c.credentials != nil && c.credentials.IdentityToken != "" {
+		// Exchange the refresh token using the OAuth2 flow.
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", c.credentials.IdentityToken)
+		query.Set("client_id", "oci2erofs")
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(query.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = query.Encode()
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if c.credentials != nil {
+			req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w: unexpected status fetching token: %s", ErrUnauthorized, resp.Status)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status fetching token: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to unmarshal token response: %w", err)
+	}
+
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+
+	return "", fmt.Errorf("token response did not contain a token")
+}
+
+// parseChallenge parses a WWW-Authenticate header value into its scheme and
+// parameters, eg. `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			rest = rest[1:]
+
+			var sb strings.Builder
+			for len(rest) > 0 {
+				ch := rest[0]
+				rest = rest[1:]
+
+				if ch == '\\' && len(rest) > 0 {
+					sb.WriteByte(rest[0])
+					rest = rest[1:]
+					continue
+				}
+
+				if ch == '"' {
+					break
+				}
+
+				sb.WriteByte(ch)
+			}
+			value = sb.String()
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+
+		if key != "" {
+			params[key] = value
+		}
+	}
+
+	return scheme, params
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubConfigKey is the key under which Docker Hub credentials are stored
+// in the Docker config file.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// Credentials are the credentials used to authenticate with a registry.
+type Credentials struct {
+	Username string
+	Password string
+	// IdentityToken, if set, is an OAuth2 refresh token exchanged for
+	// access tokens instead of using the username and password.
+	IdentityToken string
+}
+
+// dockerConfig is the subset of the Docker config file used to look up
+// credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// CredentialsFromDockerConfig returns the credentials stored for the given
+// registry host in the Docker config file ($DOCKER_CONFIG/config.json or
+// ~/.docker/config.json), consulting any configured credential helpers
+// first. It returns nil if no credentials are stored.
+func CredentialsFromDockerConfig(host string) (*Credentials, error) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+
+		configDir = filepath.Join(homeDir, ".docker")
+	}
+
+	data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read docker config: %w", err)
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal docker config: %w", err)
+	}
+
+	// Per registry helpers take precedence over the default store.
+	helper := config.CredsStore
+	for key, h := range config.CredHelpers {
+		if matchesHost(key, host) {
+			helper = h
+			break
+		}
+	}
+
+	if helper != "" {
+		credentials, err := credentialsFromHelper(helper, host)
+		if err != nil {
+			return nil, err
+		}
+
+		if credentials != nil {
+			return credentials, nil
+		}
+	}
+
+	for key, auth := range config.Auths {
+		if !matchesHost(key, host) {
+			continue
+		}
+
+		if auth.IdentityToken != "" {
+			return &Credentials{IdentityToken: auth.IdentityToken}, nil
+		}
+
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode credentials for %s: %w", key, err)
+			}
+
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed credentials for %s", key)
+			}
+
+			return &Credentials{Username: username, Password: password}, nil
+		}
+
+		if auth.Username != "" {
+			return &Credentials{Username: auth.Username, Password: auth.Password}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// credentialsFromHelper gets the credentials for the registry host from the
+// docker-credential-<helper> program. It returns nil if the helper has no
+// credentials for the host.
+func credentialsFromHelper(helper, host string) (*Credentials, error) {
+	serverURL := host
+	if matchesHost(dockerHubConfigKey, host) {
+		serverURL = dockerHubConfigKey
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// Helpers report missing credentials on stdout and exit non-zero.
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to run credential helper %s: %w: %s", helper, err,
+			strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credential helper %s response: %w", helper, err)
+	}
+
+	// A username of "<token>" marks an identity token.
+	if resp.Username == "<token>" {
+		return &Credentials{IdentityToken: resp.Secret}, nil
+	}
+
+	return &Credentials{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// matchesHost returns true if the Docker config auths key refers to the given
+// registry host. Keys may be bare hostnames or URLs.
+func matchesHost(key, host string) bool {
+	if key == dockerHubConfigKey {
+		return host == dockerHubHost || host == "docker.io" || host == "index.docker.io"
+	}
+
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+
+	return key == host
+}
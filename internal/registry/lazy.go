@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readAheadSize is the minimum number of bytes fetched by each ranged
+// request for a lazily read layer. Files are mostly read in the order they
+// are stored, so this saves a request per small file.
+const readAheadSize = 1 << 20
+
+var _ oci.BlobProvider = (*Provider)(nil)
+
+// Provider provides the images of a layout pulled with PullLazy, reading the
+// layers that were left out of it from the registry as they are needed.
+type Provider struct {
+	*oci.LayoutProvider
+	puller *puller
+}
+
+func (p *Provider) OpenBlob(ctx context.Context, dgst digest.Digest) (fs.File, error) {
+	f, err := p.LayoutProvider.OpenBlob(ctx, dgst)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	desc, ok := p.puller.lazy[dgst]
+	if !ok {
+		return nil, err
+	}
+
+	return &remoteBlob{ctx: ctx, puller: p.puller, desc: desc}, nil
+}
+
+var _ layer.RemoteFile = (*remoteBlob)(nil)
+
+// remoteBlob is a layer blob that is read from the registry with ranged
+// requests.
+type remoteBlob struct {
+	ctx    context.Context
+	puller *puller
+	desc   ocispecs.Descriptor
+
+	mu sync.Mutex
+	// buf holds the most recently fetched range of the blob, starting at
+	// bufOffset.
+	buf       []byte
+	bufOffset int64
+	// offset is the offset of the next sequential read.
+	offset  int64
+	fetched int64
+}
+
+func (b *remoteBlob) Remote() bool {
+	return true
+}
+
+func (b *remoteBlob) Stat() (fs.FileInfo, error) {
+	return &blobInfo{desc: b.desc}, nil
+}
+
+func (b *remoteBlob) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	offset := b.offset
+	b.mu.Unlock()
+
+	n, err := b.ReadAt(p, offset)
+
+	b.mu.Lock()
+	b.offset += int64(n)
+	b.mu.Unlock()
+
+	return n, err
+}
+
+func (b *remoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= b.desc.Size {
+			return n, io.EOF
+		}
+
+		if pos < b.bufOffset || pos >= b.bufOffset+int64(len(b.buf)) {
+			length := min(max(int64(len(p)-n), readAheadSize), b.desc.Size-pos)
+
+			buf, err := b.puller.fetchRange(b.ctx, b.desc, pos, length)
+			if err != nil {
+				return n, err
+			}
+
+			b.buf, b.bufOffset = buf, pos
+			b.fetched += length
+		}
+
+		n += copy(p[n:], b.buf[pos-b.bufOffset:])
+	}
+
+	return n, nil
+}
+
+func (b *remoteBlob) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	slog.Debug("Read layer from registry on demand",
+		slog.String("digest", b.desc.Digest.String()),
+		slog.Int64("fetched", b.fetched), slog.Int64("size", b.desc.Size))
+
+	b.buf = nil
+	return nil
+}
+
+// fetchRange fetches length bytes of the blob starting at offset, retrying
+// failed requests.
+func (p *puller) fetchRange(ctx context.Context, desc ocispecs.Descriptor, offset, length int64) ([]byte, error) {
+	maxAttempts := p.opts.MaxDownloadAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxDownloadAttempts
+	}
+
+	delay := p.opts.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		buf, err := p.getRange(ctx, desc, offset, length)
+		if err == nil {
+			return buf, nil
+		}
+
+		if attempt >= maxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to read blob %s at offset %d: %w", desc.Digest, offset, err)
+		}
+
+		slog.Warn("Retrying blob read",
+			slog.String("digest", desc.Digest.String()),
+			slog.Int("attempt", attempt), slog.Int64("offset", offset), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// getRange performs a single ranged request for part of a blob.
+func (p *puller) getRange(ctx context.Context, desc ocispecs.Descriptor, offset, length int64) ([]byte, error) {
+	header := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+
+	resp, err := p.client.get(ctx, "blobs/"+desc.Digest.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("registry does not support range requests (status %s)", resp.Status)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(util.ContextReader(ctx, resp.Body), buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// blobInfo describes a remote blob.
+type blobInfo struct {
+	desc ocispecs.Descriptor
+}
+
+func (fi *blobInfo) Name() string       { return fi.desc.Digest.Encoded() }
+func (fi *blobInfo) Size() int64        { return fi.desc.Size }
+func (fi *blobInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi *blobInfo) ModTime() time.Time { return time.Time{} }
+func (fi *blobInfo) IsDir() bool        { return false }
+func (fi *blobInfo) Sys() any           { return nil }
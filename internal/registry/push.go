@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Artifact is a set of files pushed to a registry as an OCI artifact.
+type Artifact struct {
+	// ArtifactType is the type of the artifact, recorded in its manifest.
+	ArtifactType string
+	// Files are the layers of the artifact, in order.
+	Files []ArtifactFile
+	// Annotations are added to the artifact manifest.
+	Annotations map[string]string
+}
+
+// ArtifactFile is a file pushed as a layer of an artifact.
+type ArtifactFile struct {
+	// Path is the path of the file on the local filesystem. Its base name
+	// is recorded as the title of the layer.
+	Path string
+	// MediaType is the media type of the layer.
+	MediaType string
+}
+
+// Push pushes the artifact to the repository of the given reference (eg.
+// "registry.example.com/images/app:v1"), tagging its manifest. Following
+// the OCI guidance for artifacts the manifest has an empty config. Blobs the
+// registry already has are not uploaded again. Mirrors are never pushed to.
+// It returns the descriptor of the manifest.
+func Push(ctx context.Context, ref string, artifact *Artifact, opts *Options) (ocispecs.Descriptor, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	if _, ok := named.(docker.Canonical); ok {
+		return ocispecs.Descriptor{}, errors.New("artifacts can only be pushed to a tag, not a digest")
+	}
+
+	tag := "latest"
+	if tagged, ok := named.(docker.Tagged); ok {
+		tag = tagged.Tag()
+	}
+
+	host := docker.Domain(named)
+	if host == "docker.io" {
+		host = dockerHubHost
+	}
+
+	c, err := newClient(host, docker.Path(named), opts)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	c.push = true
+
+	if err := c.pushBlob(ctx, ocispecs.DescriptorEmptyJSON, bytes.NewReader(ocispecs.DescriptorEmptyJSON.Data)); err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to push config: %w", err)
+	}
+
+	manifest := ocispecs.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: artifact.ArtifactType,
+		Config:       ocispecs.DescriptorEmptyJSON,
+		Layers:       []ocispecs.Descriptor{},
+		Annotations:  artifact.Annotations,
+	}
+	// The data is only an optimization for readers, it is not pushed.
+	manifest.Config.Data = nil
+
+	for _, file := range artifact.Files {
+		desc, err := c.pushFile(ctx, file)
+		if err != nil {
+			return ocispecs.Descriptor{}, fmt.Errorf("failed to push %s: %w", file.Path, err)
+		}
+
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	resp, err := c.send(ctx, http.MethodPut, c.url("manifests/"+tag), http.Header{
+		"Content-Type": []string{ocispecs.MediaTypeImageManifest},
+	}, io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), http.StatusCreated)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to push manifest: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	return ocispecs.Descriptor{
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: artifact.ArtifactType,
+		Digest:       digest.FromBytes(data),
+		Size:         int64(len(data)),
+	}, nil
+}
+
+// pushFile uploads the file as a blob, returning its layer descriptor.
+func (c *client) pushFile(ctx context.Context, file ArtifactFile) (ocispecs.Descriptor, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to digest file: %w", err)
+	}
+
+	desc := ocispecs.Descriptor{
+		MediaType: file.MediaType,
+		Digest:    dgst,
+		Size:      fi.Size(),
+		Annotations: map[string]string{
+			ocispecs.AnnotationTitle: filepath.Base(file.Path),
+		},
+	}
+
+	if err := c.pushBlob(ctx, desc, f); err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// pushBlob uploads the blob with the given descriptor in a single request,
+// unless the registry already has it.
+func (c *client) pushBlob(ctx context.Context, desc ocispecs.Descriptor, r io.ReaderAt) error {
+	resp, err := c.send(ctx, http.MethodHead, c.url("blobs/"+desc.Digest.String()), nil, nil, http.StatusOK)
+	if err == nil {
+		_ = resp.Body.Close()
+
+		slog.Debug("Blob already exists", slog.String("digest", desc.Digest.String()))
+		return nil
+	}
+
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	resp, err = c.send(ctx, http.MethodPost, c.url("blobs/uploads/"), nil, nil, http.StatusAccepted)
+	if err != nil {
+		return fmt.Errorf("failed to start upload: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("registry returned an invalid upload location %q", resp.Header.Get("Location"))
+	}
+
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+
+	resp, err = c.send(ctx, http.MethodPut, location.String(), http.Header{
+		"Content-Type": []string{"application/octet-stream"},
+	}, io.NewSectionReader(r, 0, desc.Size), http.StatusCreated)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	return nil
+}
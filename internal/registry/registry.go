@@ -0,0 +1,992 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/signature"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrUnauthorized is returned when the registry requires credentials that
+// were not given, or denies access with the given credentials.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// manifestMediaTypes are the manifest media types accepted from registries.
+var manifestMediaTypes = []string{
+	ocispecs.MediaTypeImageIndex,
+	ocispecs.MediaTypeImageManifest,
+	oci.MediaTypeDockerManifestList,
+	oci.MediaTypeDockerManifest,
+}
+
+// Options configures how an image is pulled from a registry.
+type Options struct {
+	// Platform selects the manifest to pull from an image index (defaults to
+	// the host platform).
+	Platform *ocispecs.Platform
+	// FirstManifest selects the first manifest of an image index when no
+	// platform is specified, rather than the manifest best matching the host
+	// platform.
+	FirstManifest bool
+	// AllPlatforms pulls the manifests for every platform in an image index.
+	AllPlatforms bool
+	// Credentials are used to authenticate with the registry. If nil, the
+	// credentials stored in the Docker config file are used (if any).
+	Credentials *Credentials
+	// HTTPClient is the client used for registry requests (defaults to
+	// http.DefaultClient).
+	HTTPClient *http.Client
+	// MaxManifestSize is the maximum size in bytes of manifest documents
+	// (defaults to util.DefaultMaxManifestSize).
+	MaxManifestSize int64
+	// SignatureKey, if set, requires the image to have a cosign signature
+	// that is valid for this public key before anything else is pulled.
+	SignatureKey crypto.PublicKey
+	// InsecureRegistries are the registry hosts (eg. "localhost:5000") that
+	// are accessed over plain HTTP rather than HTTPS.
+	InsecureRegistries []string
+	// Mirrors maps a registry host (eg. "docker.io") to mirror hosts that
+	// are tried, in order, before the registry itself.
+	Mirrors map[string][]string
+	// MaxConcurrentDownloads is the number of blobs downloaded concurrently
+	// (defaults to DefaultMaxConcurrentDownloads).
+	MaxConcurrentDownloads int
+	// MaxDownloadAttempts is the number of times a blob download is
+	// attempted before giving up (defaults to DefaultMaxDownloadAttempts).
+	// Interrupted downloads are resumed where the registry supports it.
+	MaxDownloadAttempts int
+	// RetryDelay is the delay before the first retry of a failed download,
+	// doubling after each attempt (defaults to one second).
+	RetryDelay time.Duration
+	// Progress, if set, is called as blobs are downloaded.
+	Progress progress.Func
+	// AllowMissingForeignLayers skips foreign layers that cannot be
+	// downloaded from either their URLs or the registry (with a warning),
+	// rather than failing.
+	AllowMissingForeignLayers bool
+	// ArtifactType, if set, selects artifacts of this type from an image
+	// index rather than images (see oci.FilterManifests).
+	ArtifactType string
+	// OnBlobs, if set, is called with the blobs that are about to be
+	// downloaded, once the manifests have been resolved. An error aborts
+	// the pull (eg. if there is not enough disk space for them).
+	OnBlobs func([]ocispecs.Descriptor) error
+	// Referrers also pulls the artifacts that refer to the image (eg. SBOMs
+	// and provenance attestations), as listed by the registry's referrers
+	// API or the referrers tag schema. They are added to the layout index
+	// alongside the image.
+	Referrers bool
+}
+
+const (
+	// DefaultMaxConcurrentDownloads is the default number of blobs
+	// downloaded concurrently.
+	DefaultMaxConcurrentDownloads = 3
+	// DefaultMaxDownloadAttempts is the default number of times a blob
+	// download is attempted.
+	DefaultMaxDownloadAttempts = 5
+	// maxRetryDelay caps the delay between download attempts.
+	maxRetryDelay = 30 * time.Second
+)
+
+// Pull pulls the image with the given reference (eg. "docker.io/library/alpine:3.19")
+// into an OCI image layout at dir. Only the manifest for the selected platform
+// (or every platform, if AllPlatforms is set) and its blobs are downloaded. It returns the name of the image within the
+// layout, suitable for passing to oci.LoadImage. Any mirrors of the registry
+// are tried first, falling back to the registry itself.
+func Pull(ctx context.Context, dir, ref string, opts *Options) (string, error) {
+	name, _, err := pullImage(ctx, dir, ref, opts, false)
+	return name, err
+}
+
+// PullLazy is like Pull, but layers that can be read on demand (eStargz and
+// zstd:chunked layers whose table of contents is recorded in the manifest,
+// see layer.Lazy) are not downloaded. The returned provider serves the
+// images of the layout, reading those layers from the registry with ranged
+// requests as their files are needed.
+func PullLazy(ctx context.Context, dir, ref string, opts *Options) (string, *Provider, error) {
+	name, p, err := pullImage(ctx, dir, ref, opts, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, &Provider{
+		LayoutProvider: oci.NewLayoutProvider(os.DirFS(dir)),
+		puller:         p,
+	}, nil
+}
+
+// pullImage pulls the image into the layout at dir, returning its name and
+// the puller of the registry (or mirror) it was pulled from.
+func pullImage(ctx context.Context, dir, ref string, opts *Options, lazy bool) (string, *puller, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	reference := "latest"
+	if canonical, ok := named.(docker.Canonical); ok {
+		reference = canonical.Digest().String()
+	} else if tagged, ok := named.(docker.Tagged); ok {
+		reference = tagged.Tag()
+	}
+
+	domain := docker.Domain(named)
+
+	host := domain
+	if host == "docker.io" {
+		host = dockerHubHost
+	}
+
+	mirrors := opts.Mirrors[domain]
+	if domain != host {
+		mirrors = slices.Concat(mirrors, opts.Mirrors[host])
+	}
+
+	for _, mirror := range mirrors {
+		p, err := newPuller(mirror, docker.Path(named), dir, opts, lazy)
+		if err != nil {
+			return "", nil, err
+		}
+
+		desc, referrers, err := p.pull(ctx, named, reference)
+		if err == nil {
+			name, err := writeIndex(dir, named, desc, referrers)
+			return name, p, err
+		} else if ctx.Err() != nil {
+			return "", nil, err
+		}
+
+		slog.Warn("Failed to pull image from mirror",
+			slog.String("mirror", mirror), slog.Any("error", err))
+	}
+
+	p, err := newPuller(host, docker.Path(named), dir, opts, lazy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	desc, referrers, err := p.pull(ctx, named, reference)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name, err := writeIndex(dir, named, desc, referrers)
+	return name, p, err
+}
+
+// writeIndex records the pulled image (and its referrers, if any) in the
+// layout index, returning its name.
+func writeIndex(dir string, named docker.Named, desc ocispecs.Descriptor, referrers []ocispecs.Descriptor) (string, error) {
+	name := named.String()
+	desc.Annotations = map[string]string{ocispecs.AnnotationRefName: name}
+
+	if err := writeLayout(dir, append([]ocispecs.Descriptor{desc}, referrers...)...); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+type puller struct {
+	client *client
+	dir    string
+	opts   *Options
+	// lazy holds the layers left out of the layout, to be read on demand,
+	// if the image is pulled lazily (and is nil otherwise).
+	lazy map[digest.Digest]ocispecs.Descriptor
+}
+
+func newPuller(host, repository, dir string, opts *Options, lazy bool) (*puller, error) {
+	c, err := newClient(host, repository, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &puller{
+		client: c,
+		dir:    dir,
+		opts:   opts,
+	}
+	if lazy {
+		p.lazy = make(map[digest.Digest]ocispecs.Descriptor)
+	}
+
+	return p, nil
+}
+
+// newClient returns a client for the repository on the registry host.
+func newClient(host, repository string, opts *Options) (*client, error) {
+	credentials := opts.Credentials
+	if credentials == nil {
+		var err error
+		credentials, err = CredentialsFromDockerConfig(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		// Honors the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+		httpClient = http.DefaultClient
+	}
+
+	scheme := "https"
+	if slices.Contains(opts.InsecureRegistries, host) {
+		scheme = "http"
+	}
+
+	return &client{
+		httpClient:  httpClient,
+		scheme:      scheme,
+		host:        host,
+		repository:  repository,
+		credentials: credentials,
+	}, nil
+}
+
+// pull downloads the manifests and blobs of the image into the layout,
+// returning the descriptor of its top-level manifest.
+func (p *puller) pull(ctx context.Context, named docker.Named, reference string) (ocispecs.Descriptor, []ocispecs.Descriptor, error) {
+	opts := p.opts
+
+	desc, data, err := p.fetchManifest(ctx, reference)
+	if err != nil {
+		return ocispecs.Descriptor{}, nil, err
+	}
+
+	if canonical, ok := named.(docker.Canonical); ok && desc.Digest != canonical.Digest() {
+		return ocispecs.Descriptor{}, nil, fmt.Errorf("manifest %w: expected %s, got %s", util.ErrDigestMismatch, canonical.Digest(), desc.Digest)
+	}
+
+	if opts.SignatureKey != nil {
+		if err := p.verifySignature(ctx, desc.Digest); err != nil {
+			return ocispecs.Descriptor{}, nil, err
+		}
+	}
+
+	manifests := [][]byte{data}
+	subjects := []digest.Digest{desc.Digest}
+	if desc.MediaType == ocispecs.MediaTypeImageIndex || desc.MediaType == oci.MediaTypeDockerManifestList {
+		var index ocispecs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return ocispecs.Descriptor{}, nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+		}
+
+		indexManifests, err := p.indexManifests(ctx, index.Manifests, nil, 1)
+		if err != nil {
+			return ocispecs.Descriptor{}, nil, err
+		}
+
+		candidates := oci.FilterManifests(indexManifests, opts.ArtifactType)
+		if opts.AllPlatforms {
+			candidates = indexManifests
+		}
+
+		candidates, err = p.resolvePlatforms(ctx, candidates)
+		if err != nil {
+			return ocispecs.Descriptor{}, nil, err
+		}
+
+		var manifestDescs []ocispecs.Descriptor
+		if opts.AllPlatforms {
+			manifestDescs = oci.PlatformManifests(candidates)
+		} else {
+			manifestDesc, err := oci.SelectManifest(candidates, opts.Platform, opts.FirstManifest)
+			if err != nil {
+				return ocispecs.Descriptor{}, nil, err
+			}
+
+			manifestDescs = []ocispecs.Descriptor{*manifestDesc}
+		}
+
+		manifests = nil
+		for _, manifestDesc := range manifestDescs {
+			fetchedDesc, manifestData, err := p.fetchManifest(ctx, manifestDesc.Digest.String())
+			if err != nil {
+				return ocispecs.Descriptor{}, nil, err
+			}
+
+			if fetchedDesc.Digest != manifestDesc.Digest {
+				return ocispecs.Descriptor{}, nil, fmt.Errorf("manifest %w: expected %s, got %s", util.ErrDigestMismatch, manifestDesc.Digest, fetchedDesc.Digest)
+			}
+
+			manifests = append(manifests, manifestData)
+			subjects = append(subjects, manifestDesc.Digest)
+		}
+	}
+
+	// Blobs shared between platforms are only downloaded once.
+	var blobDescs []ocispecs.Descriptor
+	seen := make(map[digest.Digest]bool)
+	for _, manifestData := range manifests {
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(manifestData, &manifest); err != nil {
+			return ocispecs.Descriptor{}, nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+		}
+
+		for i, blobDesc := range append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if seen[blobDesc.Digest] {
+				continue
+			}
+			seen[blobDesc.Digest] = true
+
+			if p.lazy != nil && i > 0 && layer.Lazy(blobDesc.MediaType, blobDesc.Annotations) {
+				p.lazy[blobDesc.Digest] = blobDesc
+				continue
+			}
+
+			blobDescs = append(blobDescs, blobDesc)
+		}
+	}
+
+	if opts.OnBlobs != nil {
+		if err := opts.OnBlobs(blobDescs); err != nil {
+			return ocispecs.Descriptor{}, nil, err
+		}
+	}
+
+	jobs := opts.MaxConcurrentDownloads
+	if jobs <= 0 {
+		jobs = DefaultMaxConcurrentDownloads
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	for _, blobDesc := range blobDescs {
+		g.Go(func() error {
+			err := p.fetchBlob(gctx, blobDesc)
+			if err != nil && opts.AllowMissingForeignLayers && oci.IsForeignLayer(blobDesc) && gctx.Err() == nil {
+				slog.Warn("Skipping foreign layer that could not be downloaded",
+					slog.String("digest", blobDesc.Digest.String()), slog.Any("error", err))
+				return nil
+			}
+
+			return err
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		// Prefer the caller's cancellation over any errors it caused.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ocispecs.Descriptor{}, nil, ctxErr
+		}
+
+		return ocispecs.Descriptor{}, nil, err
+	}
+
+	var referrers []ocispecs.Descriptor
+	if opts.Referrers {
+		for _, subject := range subjects {
+			subjectReferrers, err := p.pullReferrers(ctx, subject)
+			if err != nil {
+				return ocispecs.Descriptor{}, nil, err
+			}
+
+			referrers = append(referrers, subjectReferrers...)
+		}
+	}
+
+	return desc, referrers, nil
+}
+
+// pullReferrers pulls the artifacts whose subject is the manifest with the
+// given digest, returning their descriptors.
+func (p *puller) pullReferrers(ctx context.Context, subject digest.Digest) ([]ocispecs.Descriptor, error) {
+	index, err := p.fetchReferrersIndex(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var referrers []ocispecs.Descriptor
+	for _, desc := range index.Manifests {
+		fetchedDesc, data, err := p.fetchManifest(ctx, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if fetchedDesc.Digest != desc.Digest {
+			return nil, fmt.Errorf("manifest %w: expected %s, got %s", util.ErrDigestMismatch, desc.Digest, fetchedDesc.Digest)
+		}
+
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal referrer %s: %w", desc.Digest, err)
+		}
+
+		// The tag schema index may be stale.
+		if manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+
+		for _, blobDesc := range append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := p.fetchBlob(ctx, blobDesc); err != nil {
+				return nil, err
+			}
+		}
+
+		// Recorded so that the referrer is never mistaken for the image.
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = manifest.ArtifactType
+		}
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = manifest.Config.MediaType
+		}
+
+		slog.Info("Pulled referrer",
+			slog.String("digest", desc.Digest.String()), slog.String("artifactType", desc.ArtifactType))
+
+		referrers = append(referrers, desc)
+	}
+
+	return referrers, nil
+}
+
+// fetchReferrersIndex lists the referrers of a manifest, using the referrers
+// API if the registry supports it, and the referrers tag schema (an index
+// tagged with the subject's digest) otherwise.
+func (p *puller) fetchReferrersIndex(ctx context.Context, subject digest.Digest) (*ocispecs.Index, error) {
+	var index ocispecs.Index
+
+	resp, err := p.client.get(ctx, "referrers/"+subject.String(), http.Header{
+		"Accept": []string{ocispecs.MediaTypeImageIndex},
+	})
+	if err == nil {
+		defer resp.Body.Close()
+
+		if err := json.NewDecoder(util.ManifestReader(resp.Body, p.opts.MaxManifestSize)).Decode(&index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal referrers of %s: %w", subject, err)
+		}
+
+		return &index, nil
+	}
+
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("failed to list referrers of %s: %w", subject, err)
+	}
+
+	_, data, err := p.fetchManifest(ctx, subject.Algorithm().String()+"-"+subject.Encoded())
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return &index, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list referrers of %s: %w", subject, err)
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal referrers of %s: %w", subject, err)
+	}
+
+	return &index, nil
+}
+
+// indexManifests replaces the nested image indexes among the manifests of an
+// image index with their manifests, fetching them into the layout (see
+// oci.IndexManifests).
+func (p *puller) indexManifests(ctx context.Context, manifests []ocispecs.Descriptor, platform *ocispecs.Platform, depth int) ([]ocispecs.Descriptor, error) {
+	var resolved []ocispecs.Descriptor
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			desc.Platform = platform
+		}
+
+		if desc.MediaType != ocispecs.MediaTypeImageIndex && desc.MediaType != oci.MediaTypeDockerManifestList {
+			resolved = append(resolved, desc)
+			continue
+		}
+
+		if depth >= oci.MaxIndexDepth {
+			return nil, fmt.Errorf("%w: more than %d levels", oci.ErrIndexTooDeep, oci.MaxIndexDepth)
+		}
+
+		fetchedDesc, data, err := p.fetchManifest(ctx, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if fetchedDesc.Digest != desc.Digest {
+			return nil, fmt.Errorf("manifest %w: expected %s, got %s", util.ErrDigestMismatch, desc.Digest, fetchedDesc.Digest)
+		}
+
+		var index ocispecs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+		}
+
+		nested, err := p.indexManifests(ctx, index.Manifests, desc.Platform, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved = append(resolved, nested...)
+	}
+
+	return resolved, nil
+}
+
+// resolvePlatforms fills in the platform of image index manifests whose
+// descriptor omits it from their image config (see oci.ResolvePlatforms),
+// fetching the manifest and config into the layout first.
+func (p *puller) resolvePlatforms(ctx context.Context, manifests []ocispecs.Descriptor) ([]ocispecs.Descriptor, error) {
+	for _, desc := range manifests {
+		if desc.Platform != nil || oci.IsArtifact(desc) {
+			continue
+		}
+
+		if desc.MediaType != ocispecs.MediaTypeImageManifest && desc.MediaType != oci.MediaTypeDockerManifest {
+			continue
+		}
+
+		fetchedDesc, data, err := p.fetchManifest(ctx, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if fetchedDesc.Digest != desc.Digest {
+			return nil, fmt.Errorf("manifest %w: expected %s, got %s", util.ErrDigestMismatch, desc.Digest, fetchedDesc.Digest)
+		}
+
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+		}
+
+		if err := p.fetchBlob(ctx, manifest.Config); err != nil {
+			return nil, err
+		}
+	}
+
+	return oci.ResolvePlatforms(ctx, oci.NewLayoutProvider(os.DirFS(p.dir)), manifests, &oci.Options{
+		MaxManifestSize: p.opts.MaxManifestSize,
+	})
+}
+
+// fetchManifest fetches the manifest with the given tag or digest and stores
+// it in the layout. It returns the descriptor and content of the manifest.
+func (p *puller) fetchManifest(ctx context.Context, reference string) (ocispecs.Descriptor, []byte, error) {
+	resp, err := p.client.get(ctx, "manifests/"+reference, http.Header{
+		"Accept": []string{strings.Join(manifestMediaTypes, ", ")},
+	})
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return ocispecs.Descriptor{}, nil, fmt.Errorf("%w: failed to fetch manifest %s: %w", util.ErrRefNotFound, reference, err)
+		}
+
+		return ocispecs.Descriptor{}, nil, fmt.Errorf("failed to fetch manifest %s: %w", reference, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(util.ManifestReader(resp.Body, p.opts.MaxManifestSize))
+	if err != nil {
+		return ocispecs.Descriptor{}, nil, fmt.Errorf("failed to read manifest %s: %w", reference, err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/json" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return ocispecs.Descriptor{}, nil, fmt.Errorf("failed to unmarshal manifest %s: %w", reference, err)
+		}
+
+		mediaType = versioned.MediaType
+	}
+
+	desc := ocispecs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	if err := p.writeBlob(desc, bytes.NewReader(data)); err != nil {
+		return ocispecs.Descriptor{}, nil, err
+	}
+
+	return desc, data, nil
+}
+
+// verifySignature checks that the manifest with the given digest has a
+// cosign signature that is valid for the configured public key.
+func (p *puller) verifySignature(ctx context.Context, dgst digest.Digest) error {
+	_, data, err := p.fetchManifest(ctx, signature.Tag(dgst))
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature: %w", err)
+	}
+
+	var manifest ocispecs.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to unmarshal signature manifest: %w", err)
+	}
+
+	var lastErr error
+	for _, layerDesc := range manifest.Layers {
+		sig, ok := layerDesc.Annotations[signature.AnnotationSignature]
+		if layerDesc.MediaType != signature.MediaTypeSimpleSigning || !ok {
+			continue
+		}
+
+		if err := p.fetchBlob(ctx, layerDesc); err != nil {
+			return err
+		}
+
+		payload, err := os.ReadFile(p.blobPath(layerDesc.Digest))
+		if err != nil {
+			return fmt.Errorf("failed to read signature payload: %w", err)
+		}
+
+		// Any one valid signature is sufficient.
+		if lastErr = signature.Verify(p.opts.SignatureKey, payload, sig, dgst); lastErr == nil {
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%w: no signatures found", signature.ErrInvalidSignature)
+	}
+
+	return lastErr
+}
+
+// fetchBlob downloads the described blob into the layout, verifying its
+// digest and size.
+func (p *puller) fetchBlob(ctx context.Context, desc ocispecs.Descriptor) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest: %w", err)
+	}
+
+	blobPath := p.blobPath(desc.Digest)
+
+	// Already present? The layout may be shared with other tools or left over
+	// from an interrupted pull, so its content is verified before reuse.
+	if ok, err := hasBlob(blobPath, desc); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(blobPath), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	start := time.Now()
+
+	// Foreign layers are downloaded from the URLs listed in their descriptor
+	// if possible, falling back to the registry itself.
+	var sources []string
+	for _, u := range desc.URLs {
+		if parsed, err := url.Parse(u); err == nil && (parsed.Scheme == "https" || parsed.Scheme == "http") {
+			sources = append(sources, u)
+		}
+	}
+	sources = append(sources, "")
+
+	for i, source := range sources {
+		err = p.downloadWithRetries(ctx, &download{desc: desc, url: source, f: f, digester: desc.Digest.Algorithm().Digester()})
+		if err == nil || ctx.Err() != nil || i == len(sources)-1 {
+			break
+		}
+
+		slog.Warn("Failed to download foreign layer from URL",
+			slog.String("digest", desc.Digest.String()), slog.String("url", source), slog.Any("error", err))
+
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate blob file: %w", err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek blob file: %w", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close blob file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), blobPath); err != nil {
+		return fmt.Errorf("failed to rename blob file: %w", err)
+	}
+
+	slog.Info("Downloaded blob",
+		slog.String("digest", desc.Digest.String()), slog.Int64("size", desc.Size),
+		slog.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+// downloadWithRetries downloads a blob, retrying (and resuming) failed
+// attempts, and verifies its digest.
+func (p *puller) downloadWithRetries(ctx context.Context, dl *download) error {
+	maxAttempts := p.opts.MaxDownloadAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxDownloadAttempts
+	}
+
+	delay := p.opts.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := p.downloadBlob(ctx, dl)
+		if err == nil {
+			break
+		}
+
+		if attempt >= maxAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return fmt.Errorf("failed to download blob %s: %w", dl.desc.Digest, err)
+		}
+
+		slog.Warn("Retrying blob download",
+			slog.String("digest", dl.desc.Digest.String()),
+			slog.Int("attempt", attempt), slog.Int64("offset", dl.written), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, maxRetryDelay)
+	}
+
+	if dl.digester.Digest() != dl.desc.Digest {
+		return fmt.Errorf("blob %s %w", dl.desc.Digest, util.ErrDigestMismatch)
+	}
+
+	return nil
+}
+
+// download is the state of a (possibly interrupted) blob download.
+type download struct {
+	desc ocispecs.Descriptor
+	// url is the URL the blob is downloaded from (if not the registry).
+	url      string
+	f        *os.File
+	digester digest.Digester
+	written  int64
+}
+
+// downloadBlob downloads the remainder of a blob, resuming from where the
+// previous attempt left off if the registry honors range requests.
+func (p *puller) downloadBlob(ctx context.Context, dl *download) error {
+	var header http.Header
+	if dl.written > 0 {
+		header = http.Header{"Range": []string{fmt.Sprintf("bytes=%d-", dl.written)}}
+	}
+
+	var resp *http.Response
+	var err error
+	if dl.url != "" {
+		resp, err = p.client.getURL(ctx, dl.url, header)
+	} else {
+		resp, err = p.client.get(ctx, "blobs/"+dl.desc.Digest.String(), header)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if dl.written > 0 && resp.StatusCode != http.StatusPartialContent {
+		// The registry sent the whole blob, start over.
+		if err := dl.f.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate blob file: %w", err)
+		}
+
+		if _, err := dl.f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek blob file: %w", err)
+		}
+
+		dl.digester = dl.desc.Digest.Algorithm().Digester()
+		dl.written = 0
+	}
+
+	body := progress.Reader(util.ContextReader(ctx, resp.Body), p.opts.Progress, progress.Event{
+		Stage:   progress.StageDownload,
+		Item:    dl.desc.Digest.String(),
+		Current: dl.written,
+		Total:   dl.desc.Size,
+	})
+
+	n, err := io.Copy(io.MultiWriter(dl.f, dl.digester.Hash()), io.LimitReader(body, dl.desc.Size-dl.written+1))
+	dl.written += n
+	if err != nil {
+		return err
+	}
+
+	if dl.written < dl.desc.Size {
+		return io.ErrUnexpectedEOF
+	} else if dl.written > dl.desc.Size {
+		return fmt.Errorf("blob %s size mismatch: expected %d bytes, got more", dl.desc.Digest, dl.desc.Size)
+	}
+
+	return nil
+}
+
+// isRetryable reports whether a failed download may succeed if retried.
+func isRetryable(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// writeBlob writes a blob into the layout, verifying its digest and size.
+func (p *puller) writeBlob(desc ocispecs.Descriptor, r io.Reader) error {
+	blobPath := p.blobPath(desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(blobPath), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+
+	n, err := io.Copy(io.MultiWriter(f, verifier), io.LimitReader(r, desc.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to download blob %s: %w", desc.Digest, err)
+	}
+
+	if n != desc.Size {
+		return fmt.Errorf("blob %s size mismatch: expected %d bytes, got %d", desc.Digest, desc.Size, n)
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s %w", desc.Digest, util.ErrDigestMismatch)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close blob file: %w", err)
+	}
+
+	return os.Rename(f.Name(), blobPath)
+}
+
+func (p *puller) blobPath(dgst digest.Digest) string {
+	return filepath.Join(p.dir, filepath.FromSlash(oci.BlobPath(dgst)))
+}
+
+// hasBlob reports whether the file at path holds the described blob. A file
+// whose size or digest does not match is logged and reported as missing, so
+// that it is downloaded again.
+func hasBlob(path string, desc ocispecs.Descriptor) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+
+	n, err := io.Copy(verifier, io.LimitReader(f, desc.Size+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+
+	if n != desc.Size || !verifier.Verified() {
+		slog.Warn("Replacing corrupt blob",
+			slog.String("digest", desc.Digest.String()), slog.String("path", path))
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// writeLayout writes the index.json and oci-layout files of the layout.
+func writeLayout(dir string, descs ...ocispecs.Descriptor) error {
+	index := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: descs,
+	}
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), indexJSON, 0o644); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	ociLayoutJSON, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+	if err != nil {
+		return fmt.Errorf("failed to marshal oci-layout: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ocispecs.ImageLayoutFile), ociLayoutJSON, 0o644); err != nil {
+		return fmt.Errorf("failed to write oci-layout: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1050 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/signature"
+	"github.com/immutos/oci2erofs/internal/tocfs"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPull(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	v1 := reg.addImage(t, "v1", map[string]string{
+		"amd64": "hello from amd64\n",
+		"arm64": "hello from arm64\n",
+	})
+
+	reg.addImage(t, "riscv", map[string]string{
+		"riscv64": "hello from riscv64\n",
+	})
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		t.Run(arch, func(t *testing.T) {
+			dir := t.TempDir()
+
+			platform := ocispecs.Platform{OS: "linux", Architecture: arch}
+			name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", &registry.Options{
+				Platform:    &platform,
+				Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:  reg.server.Client(),
+			})
+			require.NoError(t, err)
+			require.Equal(t, reg.host+"/test/repo:v1", name)
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "etc/motd")
+			require.NoError(t, err)
+			require.Equal(t, "hello from "+arch+"\n", string(content))
+		})
+	}
+
+	t.Run("First Manifest", func(t *testing.T) {
+		// The host platform is not in the image.
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:riscv", &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.ErrorContains(t, err, "no manifest found for platform")
+		require.ErrorIs(t, err, oci.ErrPlatformNotFound)
+
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:riscv", &registry.Options{
+			FirstManifest: true,
+			Credentials:   &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:    reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, nil, &oci.Options{
+			FirstManifest: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		content, err := fs.ReadFile(rootFS, "etc/motd")
+		require.NoError(t, err)
+		require.Equal(t, "hello from riscv64\n", string(content))
+	})
+
+	t.Run("Index Without Platforms", func(t *testing.T) {
+		// The platform is optional in descriptors, the image config always
+		// records it.
+		var index ocispecs.Index
+		require.NoError(t, json.Unmarshal(reg.manifests["v1"], &index))
+		for i := range index.Manifests {
+			index.Manifests[i].Platform = nil
+		}
+		reg.addManifest(t, "v1-no-platforms", index)
+
+		dir := t.TempDir()
+		platform := ocispecs.Platform{OS: "linux", Architecture: "arm64"}
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1-no-platforms", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		requireMotd(t, dir, name, &platform, "hello from arm64\n")
+	})
+
+	t.Run("Nested Image Index", func(t *testing.T) {
+		reg.addManifest(t, "v1-nested", ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+			Manifests: []ocispecs.Descriptor{v1},
+		})
+
+		dir := t.TempDir()
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1-nested", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		requireMotd(t, dir, name, &platform, "hello from amd64\n")
+	})
+
+	t.Run("All Platforms", func(t *testing.T) {
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", &registry.Options{
+			AllPlatforms: true,
+			Credentials:  &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:   reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		for _, arch := range []string{"amd64", "arm64"} {
+			platform := ocispecs.Platform{OS: "linux", Architecture: arch}
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, &platform, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			content, err := fs.ReadFile(rootFS, "etc/motd")
+			require.NoError(t, err)
+			require.Equal(t, "hello from "+arch+"\n", string(content))
+		}
+	})
+
+	t.Run("Signature", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		reg.addSignature(t, v1, key)
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+		t.Run("Valid", func(t *testing.T) {
+			_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+				Platform:     &platform,
+				Credentials:  &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:   reg.server.Client(),
+				SignatureKey: key.Public(),
+			})
+			require.NoError(t, err)
+		})
+
+		t.Run("Wrong Key", func(t *testing.T) {
+			otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			require.NoError(t, err)
+
+			_, err = registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+				Platform:     &platform,
+				Credentials:  &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:   reg.server.Client(),
+				SignatureKey: otherKey.Public(),
+			})
+			require.ErrorIs(t, err, signature.ErrInvalidSignature)
+		})
+
+		t.Run("Unsigned", func(t *testing.T) {
+			_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:riscv", &registry.Options{
+				FirstManifest: true,
+				Credentials:   &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:    reg.server.Client(),
+				SignatureKey:  key.Public(),
+			})
+			require.ErrorContains(t, err, "failed to fetch signature")
+		})
+	})
+
+	t.Run("Identity Token", func(t *testing.T) {
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{IdentityToken: "refresh-token"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Insecure Registry", func(t *testing.T) {
+		insecure := newInsecureTestRegistry(t)
+		insecure.addImage(t, "v1", map[string]string{"amd64": "hello over http\n"})
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		opts := &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+		}
+
+		_, err := registry.Pull(context.Background(), t.TempDir(), insecure.host+"/test/repo:v1", opts)
+		require.Error(t, err)
+
+		opts.InsecureRegistries = []string{insecure.host}
+
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, insecure.host+"/test/repo:v1", opts)
+		require.NoError(t, err)
+
+		requireMotd(t, dir, name, &platform, "hello over http\n")
+	})
+
+	t.Run("Mirror", func(t *testing.T) {
+		upstream := newInsecureTestRegistry(t)
+		upstream.addImage(t, "v1", map[string]string{"amd64": "hello from upstream\n"})
+		upstream.addImage(t, "v2", map[string]string{"amd64": "hello from upstream\n"})
+
+		mirror := newInsecureTestRegistry(t)
+		mirror.addImage(t, "v1", map[string]string{"amd64": "hello from mirror\n"})
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		opts := &registry.Options{
+			Platform:           &platform,
+			Credentials:        &registry.Credentials{Username: "user", Password: "pass"},
+			InsecureRegistries: []string{upstream.host, mirror.host},
+			Mirrors:            map[string][]string{upstream.host: {mirror.host}},
+		}
+
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, upstream.host+"/test/repo:v1", opts)
+		require.NoError(t, err)
+		require.Equal(t, upstream.host+"/test/repo:v1", name)
+
+		requireMotd(t, dir, name, &platform, "hello from mirror\n")
+
+		t.Run("Fallback", func(t *testing.T) {
+			// The mirror does not have this tag.
+			dir := t.TempDir()
+			name, err := registry.Pull(context.Background(), dir, upstream.host+"/test/repo:v2", opts)
+			require.NoError(t, err)
+
+			requireMotd(t, dir, name, &platform, "hello from upstream\n")
+		})
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "wrong"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.ErrorContains(t, err, "failed to authenticate")
+		require.ErrorIs(t, err, registry.ErrUnauthorized)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:missing", &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.ErrorContains(t, err, "404")
+		require.ErrorIs(t, err, oci.ErrRefNotFound)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		reg.truncate.Store(2)
+		reg.ranged.Store(0)
+		t.Cleanup(func() {
+			reg.truncate.Store(0)
+		})
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+			RetryDelay:  time.Millisecond,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int32(2), reg.ranged.Load())
+
+		requireMotd(t, dir, name, &platform, "hello from amd64\n")
+	})
+
+	t.Run("Retries Exhausted", func(t *testing.T) {
+		reg.truncate.Store(100)
+		t.Cleanup(func() {
+			reg.truncate.Store(0)
+		})
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+			Platform:            &platform,
+			Credentials:         &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:          reg.server.Client(),
+			MaxDownloadAttempts: 2,
+			RetryDelay:          time.Millisecond,
+		})
+		require.ErrorContains(t, err, "unexpected EOF")
+	})
+
+	t.Run("Foreign Layer", func(t *testing.T) {
+		foreignLayer := tarLayer(t, "etc/motd", "hello from foreign\n")
+		foreignDigest := digest.FromBytes(foreignLayer)
+
+		// Foreign layers are not in the registry, but served from elsewhere.
+		mux := http.NewServeMux()
+		mux.HandleFunc("/layer", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(foreignLayer)
+		})
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+
+		addImage := func(tag, url string) {
+			reg.addManifest(t, tag, ocispecs.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispecs.MediaTypeImageManifest,
+				Config: reg.addBlob(t, ocispecs.MediaTypeImageConfig, ocispecs.Image{
+					Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+					RootFS:   ocispecs.RootFS{Type: "layers"},
+				}),
+				Layers: []ocispecs.Descriptor{
+					{
+						MediaType: ocispecs.MediaTypeImageLayerNonDistributable,
+						Digest:    foreignDigest,
+						Size:      int64(len(foreignLayer)),
+						URLs:      []string{url},
+					},
+					reg.addBlob(t, ocispecs.MediaTypeImageLayer, tarLayer(t, "etc/issue", "hello\n")),
+				},
+			})
+		}
+
+		addImage("foreign", server.URL+"/layer")
+		addImage("foreign-missing", server.URL+"/missing")
+
+		dir := t.TempDir()
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:foreign", &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		requireMotd(t, dir, name, nil, "hello from foreign\n")
+
+		t.Run("Missing", func(t *testing.T) {
+			opts := &registry.Options{
+				Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:  reg.server.Client(),
+			}
+
+			_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:foreign-missing", opts)
+			require.ErrorContains(t, err, "404")
+
+			opts.AllowMissingForeignLayers = true
+
+			dir := t.TempDir()
+			name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:foreign-missing", opts)
+			require.NoError(t, err)
+
+			_, _, err = oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, nil, nil)
+			require.ErrorIs(t, err, oci.ErrMissingForeignLayer)
+
+			rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, nil, &oci.Options{
+				AllowMissingForeignLayers: true,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			_, err = fs.Stat(rootFS, "etc/motd")
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			content, err := fs.ReadFile(rootFS, "etc/issue")
+			require.NoError(t, err)
+			require.Equal(t, "hello\n", string(content))
+		})
+	})
+
+	t.Run("Referrers", func(t *testing.T) {
+		image := reg.addManifest(t, "referred", ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config: reg.addBlob(t, ocispecs.MediaTypeImageConfig, ocispecs.Image{
+				Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+				RootFS:   ocispecs.RootFS{Type: "layers"},
+			}),
+			Layers: []ocispecs.Descriptor{reg.addBlob(t, ocispecs.MediaTypeImageLayer, tarLayer(t, "etc/motd", "hello\n"))},
+		})
+
+		sbom := reg.addManifest(t, "", ocispecs.Manifest{
+			Versioned:    specs.Versioned{SchemaVersion: 2},
+			MediaType:    ocispecs.MediaTypeImageManifest,
+			ArtifactType: "application/spdx+json",
+			Config:       reg.addBlob(t, ocispecs.MediaTypeEmptyJSON, []byte("{}")),
+			Layers:       []ocispecs.Descriptor{reg.addBlob(t, "application/spdx+json", []byte(`{"spdxVersion":"SPDX-2.3"}`))},
+			Subject:      &image,
+		})
+
+		pullReferrers := func(t *testing.T) {
+			dir := t.TempDir()
+			name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:referred", &registry.Options{
+				Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:  reg.server.Client(),
+				Referrers:   true,
+			})
+			require.NoError(t, err)
+
+			requireMotd(t, dir, name, nil, "hello\n")
+
+			referrers, err := oci.Referrers(context.Background(), oci.NewLayoutProvider(os.DirFS(dir)), image.Digest, nil)
+			require.NoError(t, err)
+			require.Len(t, referrers, 1)
+			require.Equal(t, sbom.Digest, referrers[0].Digest)
+			require.Equal(t, "application/spdx+json", referrers[0].ArtifactType)
+
+			_, err = oci.ReferrersLayout(context.Background(), oci.NewLayoutProvider(os.DirFS(dir)), referrers, nil)
+			require.NoError(t, err)
+		}
+
+		t.Run("API", pullReferrers)
+
+		t.Run("Tag Schema", func(t *testing.T) {
+			reg.noReferrersAPI = true
+			t.Cleanup(func() {
+				reg.noReferrersAPI = false
+			})
+
+			sbomDesc := sbom
+			sbomDesc.ArtifactType = "application/spdx+json"
+			reg.addManifest(t, "sha256-"+image.Digest.Encoded(), ocispecs.Index{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispecs.MediaTypeImageIndex,
+				Manifests: []ocispecs.Descriptor{sbomDesc},
+			})
+
+			pullReferrers(t)
+		})
+	})
+
+	t.Run("Corrupt Blob", func(t *testing.T) {
+		reg.corrupt = true
+		t.Cleanup(func() {
+			reg.corrupt = false
+		})
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		_, err := registry.Pull(context.Background(), t.TempDir(), reg.host+"/test/repo:v1", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.ErrorContains(t, err, "digest mismatch")
+		require.ErrorIs(t, err, oci.ErrDigestMismatch)
+	})
+
+	t.Run("Corrupt Existing Blob", func(t *testing.T) {
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		opts := &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		}
+
+		dir := t.TempDir()
+		_, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", opts)
+		require.NoError(t, err)
+
+		// Overwrite every blob with content of the same size.
+		blobs, err := filepath.Glob(filepath.Join(dir, "blobs", "sha256", "*"))
+		require.NoError(t, err)
+		require.NotEmpty(t, blobs)
+
+		for _, blob := range blobs {
+			data, err := os.ReadFile(blob)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(blob, bytes.Repeat([]byte{'x'}, len(data)), 0o644))
+		}
+
+		name, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", opts)
+		require.NoError(t, err)
+
+		requireMotd(t, dir, name, &platform, "hello from amd64\n")
+	})
+
+	t.Run("On Blobs", func(t *testing.T) {
+		dir := t.TempDir()
+
+		errFull := errors.New("disk full")
+
+		var blobs []ocispecs.Descriptor
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+		_, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:v1", &registry.Options{
+			Platform:    &platform,
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+			OnBlobs: func(descs []ocispecs.Descriptor) error {
+				blobs = descs
+				return errFull
+			},
+		})
+		require.ErrorIs(t, err, errFull)
+		require.NotEmpty(t, blobs)
+
+		for _, desc := range blobs {
+			_, err := os.Stat(filepath.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+			require.ErrorIs(t, err, os.ErrNotExist)
+		}
+	})
+	t.Run("Lazy", func(t *testing.T) {
+		data, err := os.ReadFile("../layer/testdata/estargz/layer.tar.gz")
+		require.NoError(t, err)
+
+		toc, err := tocfs.OpenEstargz(bytes.NewReader(data), int64(len(data)), nil)
+		require.NoError(t, err)
+
+		platform := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+		layerDesc := reg.addBlob(t, ocispecs.MediaTypeImageLayerGzip, data)
+		layerDesc.Annotations = map[string]string{tocfs.TOCDigestAnnotation: toc.TOCDigest().String()}
+
+		reg.addManifest(t, "lazy", ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config: reg.addBlob(t, ocispecs.MediaTypeImageConfig, ocispecs.Image{
+				Platform: platform,
+				RootFS:   ocispecs.RootFS{Type: "layers"},
+			}),
+			Layers: []ocispecs.Descriptor{layerDesc},
+		})
+
+		reg.ranged.Store(0)
+
+		dir := t.TempDir()
+		name, provider, err := registry.PullLazy(context.Background(), dir, reg.host+"/test/repo:lazy", &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.NoError(t, err)
+
+		// The layer is left out of the layout.
+		_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", layerDesc.Digest.Encoded()))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.Zero(t, reg.ranged.Load())
+
+		rootFS, closeAll, err := oci.LoadImageFrom(context.Background(), t.TempDir(), provider, name, &platform, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		hostname, err := fs.ReadFile(rootFS, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(hostname))
+		require.NotZero(t, reg.ranged.Load())
+
+		t.Run("Eager", func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := registry.Pull(context.Background(), dir, reg.host+"/test/repo:lazy", &registry.Options{
+				Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+				HTTPClient:  reg.server.Client(),
+			})
+			require.NoError(t, err)
+
+			_, err = os.Stat(filepath.Join(dir, "blobs", "sha256", layerDesc.Digest.Encoded()))
+			require.NoError(t, err)
+		})
+	})
+}
+
+func TestPush(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image.erofs")
+	require.NoError(t, os.WriteFile(imagePath, []byte("not really an erofs image"), 0o644))
+	rootHashPath := filepath.Join(dir, "image.roothash")
+	require.NoError(t, os.WriteFile(rootHashPath, []byte("abcdef\n"), 0o644))
+
+	artifact := &registry.Artifact{
+		ArtifactType: "application/vnd.example.image.v1",
+		Files: []registry.ArtifactFile{
+			{Path: imagePath, MediaType: "application/vnd.example.image.v1.erofs"},
+			{Path: rootHashPath, MediaType: "application/vnd.example.roothash.v1"},
+		},
+	}
+
+	opts := &registry.Options{
+		Credentials: &registry.Credentials{Username: "user", Password: "pass"},
+		HTTPClient:  reg.server.Client(),
+	}
+
+	desc, err := registry.Push(context.Background(), reg.host+"/test/repo:erofs", artifact, opts)
+	require.NoError(t, err)
+	require.Equal(t, "application/vnd.example.image.v1", desc.ArtifactType)
+	require.Equal(t, int32(3), reg.uploads.Load())
+
+	data, ok := reg.manifests["erofs"]
+	require.True(t, ok)
+	require.Equal(t, desc.Digest, digest.FromBytes(data))
+
+	var manifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Equal(t, ocispecs.MediaTypeImageManifest, manifest.MediaType)
+	require.Equal(t, "application/vnd.example.image.v1", manifest.ArtifactType)
+	require.Equal(t, ocispecs.MediaTypeEmptyJSON, manifest.Config.MediaType)
+	require.Equal(t, []byte("{}"), reg.blobs[manifest.Config.Digest])
+
+	require.Len(t, manifest.Layers, 2)
+	require.Equal(t, "image.erofs", manifest.Layers[0].Annotations[ocispecs.AnnotationTitle])
+	require.Equal(t, "application/vnd.example.image.v1.erofs", manifest.Layers[0].MediaType)
+	require.Equal(t, []byte("not really an erofs image"), reg.blobs[manifest.Layers[0].Digest])
+	require.Equal(t, "image.roothash", manifest.Layers[1].Annotations[ocispecs.AnnotationTitle])
+	require.Equal(t, []byte("abcdef\n"), reg.blobs[manifest.Layers[1].Digest])
+
+	t.Run("Existing Blobs", func(t *testing.T) {
+		_, err := registry.Push(context.Background(), reg.host+"/test/repo:again", artifact, opts)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), reg.uploads.Load())
+		require.Equal(t, data, reg.manifests["again"])
+	})
+
+	t.Run("Digest Reference", func(t *testing.T) {
+		_, err := registry.Push(context.Background(), reg.host+"/test/repo@"+desc.Digest.String(), artifact, opts)
+		require.ErrorContains(t, err, "only be pushed to a tag")
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		_, err := registry.Push(context.Background(), reg.host+"/test/repo:erofs", artifact, &registry.Options{
+			Credentials: &registry.Credentials{Username: "user", Password: "wrong"},
+			HTTPClient:  reg.server.Client(),
+		})
+		require.ErrorIs(t, err, registry.ErrUnauthorized)
+	})
+}
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	writeConfig := func(t *testing.T, config string) {
+		configDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(configDir, "config.json"), []byte(config), 0o644))
+		t.Setenv("DOCKER_CONFIG", configDir)
+	}
+
+	// writeHelper installs a docker-credential-test helper that prints the
+	// given output.
+	writeHelper := func(t *testing.T, output string, exitCode int) {
+		binDir := t.TempDir()
+		script := fmt.Sprintf("#!/bin/sh\ncat >/dev/null\necho '%s'\nexit %d\n", output, exitCode)
+		require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-test"), []byte(script), 0o755))
+		t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	t.Run("Auths", func(t *testing.T) {
+		writeConfig(t, `{"auths":{"https://ghcr.io":{"auth":"dXNlcjpwYXNz"}}}`)
+
+		credentials, err := registry.CredentialsFromDockerConfig("ghcr.io")
+		require.NoError(t, err)
+		require.Equal(t, &registry.Credentials{Username: "user", Password: "pass"}, credentials)
+
+		credentials, err = registry.CredentialsFromDockerConfig("quay.io")
+		require.NoError(t, err)
+		require.Nil(t, credentials)
+	})
+
+	t.Run("Credential Helper", func(t *testing.T) {
+		writeConfig(t, `{"credHelpers":{"ghcr.io":"test"}}`)
+		writeHelper(t, `{"ServerURL":"ghcr.io","Username":"helper","Secret":"secret"}`, 0)
+
+		credentials, err := registry.CredentialsFromDockerConfig("ghcr.io")
+		require.NoError(t, err)
+		require.Equal(t, &registry.Credentials{Username: "helper", Password: "secret"}, credentials)
+	})
+
+	t.Run("Credential Store Fallback", func(t *testing.T) {
+		writeConfig(t, `{"credsStore":"test","auths":{"ghcr.io":{"auth":"dXNlcjpwYXNz"}}}`)
+		writeHelper(t, "credentials not found in native keychain", 1)
+
+		credentials, err := registry.CredentialsFromDockerConfig("ghcr.io")
+		require.NoError(t, err)
+		require.Equal(t, &registry.Credentials{Username: "user", Password: "pass"}, credentials)
+	})
+
+	t.Run("Identity Token", func(t *testing.T) {
+		writeConfig(t, `{"credsStore":"test"}`)
+		writeHelper(t, `{"Username":"<token>","Secret":"refresh-token"}`, 0)
+
+		credentials, err := registry.CredentialsFromDockerConfig("ghcr.io")
+		require.NoError(t, err)
+		require.Equal(t, &registry.Credentials{IdentityToken: "refresh-token"}, credentials)
+	})
+}
+
+// requireMotd checks the content of etc/motd in the pulled image.
+func requireMotd(t *testing.T, dir, name string, platform *ocispecs.Platform, expected string) {
+	rootFS, closeAll, err := oci.LoadImage(context.Background(), t.TempDir(), os.DirFS(dir), name, platform, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeAll())
+	})
+
+	content, err := fs.ReadFile(rootFS, "etc/motd")
+	require.NoError(t, err)
+	require.Equal(t, expected, string(content))
+}
+
+// testRegistry is a minimal OCI distribution registry that requires bearer
+// token authentication.
+type testRegistry struct {
+	server    *httptest.Server
+	host      string
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+	corrupt   bool
+	// noReferrersAPI makes the registry predate the referrers API.
+	noReferrersAPI bool
+	// truncate is the number of blob responses to cut short.
+	truncate atomic.Int32
+	// ranged counts the blob requests with a Range header.
+	ranged atomic.Int32
+	// uploads counts the blobs pushed to the registry.
+	uploads atomic.Int32
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	return startTestRegistry(t, httptest.NewTLSServer)
+}
+
+// newInsecureTestRegistry is like newTestRegistry, but serves plain HTTP.
+func newInsecureTestRegistry(t *testing.T) *testRegistry {
+	return startTestRegistry(t, httptest.NewServer)
+}
+
+func startTestRegistry(t *testing.T, newServer func(http.Handler) *httptest.Server) *testRegistry {
+	reg := &testRegistry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+
+	const token = "secret-token"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// OAuth2 refresh token flow.
+		if r.Method == http.MethodPost {
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+			return
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		scope := r.URL.Query().Get("scope")
+		if scope != "repository:test/repo:pull" && scope != "repository:test/repo:pull,push" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+	})
+
+	mux.HandleFunc("/v2/test/repo/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			actions := "pull"
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				actions = "pull,push"
+			}
+
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:test/repo:%s"`, reg.server.URL, actions))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		kind, reference, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/test/repo/"), "/")
+		switch {
+		case kind == "blobs" && r.Method == http.MethodPost && reference == "uploads/":
+			// Relative to the request, as some registries return.
+			w.Header().Set("Location", "uploads/"+strconv.Itoa(len(reg.blobs)))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case kind == "blobs" && r.Method == http.MethodPut && strings.HasPrefix(reference, "uploads/"):
+			data, _ := io.ReadAll(r.Body)
+
+			dgst, err := digest.Parse(r.URL.Query().Get("digest"))
+			if err != nil || dgst != digest.FromBytes(data) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			reg.blobs[dgst] = data
+			reg.uploads.Add(1)
+			w.WriteHeader(http.StatusCreated)
+			return
+		case kind == "manifests" && r.Method == http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+
+			reg.manifests[digest.FromBytes(data).String()] = data
+			reg.manifests[reference] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		switch kind {
+		case "manifests":
+			data, ok := reg.manifests[reference]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			var versioned struct {
+				MediaType string `json:"mediaType"`
+			}
+			_ = json.Unmarshal(data, &versioned)
+
+			w.Header().Set("Content-Type", versioned.MediaType)
+			_, _ = w.Write(data)
+		case "blobs":
+			data, ok := reg.blobs[digest.Digest(reference)]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if reg.corrupt {
+				data = bytes.ToUpper(data)
+			}
+
+			if r.Header.Get("Range") != "" {
+				reg.ranged.Add(1)
+			}
+
+			if reg.truncate.Add(-1) >= 0 {
+				// Drop the connection half way through the response.
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				_, _ = w.Write(data[:len(data)/2])
+				return
+			}
+
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		case "referrers":
+			if reg.noReferrersAPI {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			index := ocispecs.Index{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispecs.MediaTypeImageIndex,
+				Manifests: []ocispecs.Descriptor{},
+			}
+
+			for ref, data := range reg.manifests {
+				var manifest ocispecs.Manifest
+				if !strings.HasPrefix(ref, "sha256:") || json.Unmarshal(data, &manifest) != nil {
+					continue
+				}
+
+				if manifest.Subject != nil && manifest.Subject.Digest.String() == reference {
+					index.Manifests = append(index.Manifests, ocispecs.Descriptor{
+						MediaType:    manifest.MediaType,
+						ArtifactType: manifest.ArtifactType,
+						Digest:       digest.Digest(ref),
+						Size:         int64(len(data)),
+					})
+				}
+			}
+
+			w.Header().Set("Content-Type", ocispecs.MediaTypeImageIndex)
+			_ = json.NewEncoder(w).Encode(index)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	reg.server = newServer(mux)
+	t.Cleanup(reg.server.Close)
+
+	u, err := url.Parse(reg.server.URL)
+	require.NoError(t, err)
+	reg.host = u.Host
+
+	return reg
+}
+
+// addImage adds a multi-platform image to the registry, with a single layer
+// per platform containing etc/motd.
+func (reg *testRegistry) addImage(t *testing.T, tag string, motds map[string]string) ocispecs.Descriptor {
+	index := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	for arch, motd := range motds {
+		platform := ocispecs.Platform{OS: "linux", Architecture: arch}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/motd", Mode: 0o644, Size: int64(len(motd))}))
+		_, err := tw.Write([]byte(motd))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		manifest := ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config: reg.addBlob(t, ocispecs.MediaTypeImageConfig, ocispecs.Image{
+				Platform: platform,
+				RootFS:   ocispecs.RootFS{Type: "layers"},
+			}),
+			Layers: []ocispecs.Descriptor{reg.addBlob(t, ocispecs.MediaTypeImageLayer, buf.Bytes())},
+		}
+
+		desc := reg.addManifest(t, "", manifest)
+		desc.Platform = &platform
+
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	return reg.addManifest(t, tag, index)
+}
+
+// tarLayer returns an uncompressed layer containing a single file.
+func tarLayer(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// addSignature adds a cosign signature of the manifest with the given
+// descriptor, made with key.
+func (reg *testRegistry) addSignature(t *testing.T, desc ocispecs.Descriptor, key *ecdsa.PrivateKey) {
+	var payload signature.Payload
+	payload.Critical.Image.DockerManifestDigest = desc.Digest
+	payload.Critical.Type = "cosign container image signature"
+
+	payloadJSON, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	hash := sha256.Sum256(payloadJSON)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+
+	layerDesc := reg.addBlob(t, signature.MediaTypeSimpleSigning, payloadJSON)
+	layerDesc.Annotations = map[string]string{signature.AnnotationSignature: base64.StdEncoding.EncodeToString(sig)}
+
+	reg.addManifest(t, signature.Tag(desc.Digest), ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    reg.addBlob(t, ocispecs.MediaTypeImageConfig, map[string]string{}),
+		Layers:    []ocispecs.Descriptor{layerDesc},
+	})
+}
+
+func (reg *testRegistry) addBlob(t *testing.T, mediaType string, v any) ocispecs.Descriptor {
+	data, ok := v.([]byte)
+	if !ok {
+		var err error
+		data, err = json.Marshal(v)
+		require.NoError(t, err)
+	}
+
+	dgst := digest.FromBytes(data)
+	reg.blobs[dgst] = data
+
+	return ocispecs.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func (reg *testRegistry) addManifest(t *testing.T, tag string, v any) ocispecs.Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	require.NoError(t, json.Unmarshal(data, &versioned))
+
+	dgst := digest.FromBytes(data)
+	reg.manifests[dgst.String()] = data
+	if tag != "" {
+		reg.manifests[tag] = data
+	}
+
+	return ocispecs.Descriptor{MediaType: versioned.MediaType, Digest: dgst, Size: int64(len(data))}
+}
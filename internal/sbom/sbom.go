@@ -0,0 +1,333 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package sbom generates a software bill of materials listing every file of
+// a root filesystem with its digests, in SPDX or CycloneDX format.
+package sbom
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// The supported document formats.
+const (
+	// FormatSPDX is an SPDX 2.3 JSON document.
+	FormatSPDX = "spdx"
+	// FormatCycloneDX is a CycloneDX 1.5 JSON document.
+	FormatCycloneDX = "cyclonedx"
+)
+
+// Options configures the generated document.
+type Options struct {
+	// Name is the name of the described image (eg. its file name).
+	Name string
+	// Created is the creation time recorded in the document (defaults to
+	// now).
+	Created *time.Time
+}
+
+// CheckFormat fails if the document format is not supported.
+func CheckFormat(format string) error {
+	switch format {
+	case FormatSPDX, FormatCycloneDX:
+		return nil
+	default:
+		return fmt.Errorf("unsupported SBOM format %q (expected %s or %s)", format, FormatSPDX, FormatCycloneDX)
+	}
+}
+
+// Extension returns the conventional file extension of documents in the
+// given format.
+func Extension(format string) string {
+	if format == FormatCycloneDX {
+		return ".cdx.json"
+	}
+
+	return ".spdx.json"
+}
+
+// file is a regular file of the root filesystem.
+type file struct {
+	path   string
+	sha1   string
+	sha256 string
+}
+
+// Generate returns a document in the given format listing the regular files
+// of fsys.
+func Generate(ctx context.Context, fsys fs.FS, format string, opts *Options) ([]byte, error) {
+	if err := CheckFormat(format); err != nil {
+		return nil, err
+	}
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	created := time.Now()
+	if opts.Created != nil {
+		created = *opts.Created
+	}
+	created = created.UTC().Truncate(time.Second)
+
+	files, err := hashFiles(ctx, fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	if format == FormatCycloneDX {
+		doc = cycloneDX(files, opts.Name, created)
+	} else {
+		doc = spdx(files, opts.Name, created)
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// hashFiles walks the regular files of fsys (in lexical order), computing
+// their digests.
+func hashFiles(ctx context.Context, fsys fs.FS) ([]file, error) {
+	var files []file
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h1, h256 := sha1.New(), sha256.New()
+		if _, err := io.Copy(io.MultiWriter(h1, h256), f); err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		files = append(files, file{
+			path:   name,
+			sha1:   hex.EncodeToString(h1.Sum(nil)),
+			sha256: hex.EncodeToString(h256.Sum(nil)),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return files, nil
+}
+
+// verificationCode is the SPDX package verification code of the files: the
+// SHA-1 of their sorted SHA-1 digests. It also identifies the document.
+func verificationCode(files []file) string {
+	digests := make([]string, 0, len(files))
+	for _, f := range files {
+		digests = append(digests, f.sha1)
+	}
+	slices.Sort(digests)
+
+	sum := sha1.Sum([]byte(strings.Join(digests, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                    string                  `json:"name"`
+	SPDXID                  string                  `json:"SPDXID"`
+	DownloadLocation        string                  `json:"downloadLocation"`
+	FilesAnalyzed           bool                    `json:"filesAnalyzed"`
+	PackageVerificationCode spdxPackageVerification `json:"packageVerificationCode"`
+}
+
+type spdxPackageVerification struct {
+	Value string `json:"packageVerificationCodeValue"`
+}
+
+type spdxFile struct {
+	FileName  string         `json:"fileName"`
+	SPDXID    string         `json:"SPDXID"`
+	Checksums []spdxChecksum `json:"checksums"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+func spdx(files []file, name string, created time.Time) *spdxDocument {
+	code := verificationCode(files)
+
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: "https://spdx.org/spdxdocs/oci2erofs/" + util.FormatUUID(util.NameUUID(name+"\x00"+code)),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: oci2erofs"},
+		},
+		Packages: []spdxPackage{{
+			Name:                    name,
+			SPDXID:                  "SPDXRef-Image",
+			DownloadLocation:        "NOASSERTION",
+			FilesAnalyzed:           true,
+			PackageVerificationCode: spdxPackageVerification{Value: code},
+		}},
+		Files: []spdxFile{},
+		Relationships: []spdxRelationship{{
+			Element: "SPDXRef-DOCUMENT",
+			Type:    "DESCRIBES",
+			Related: "SPDXRef-Image",
+		}},
+	}
+
+	for i, f := range files {
+		id := "SPDXRef-File-" + strconv.Itoa(i+1)
+
+		doc.Files = append(doc.Files, spdxFile{
+			FileName: "./" + f.path,
+			SPDXID:   id,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", Value: f.sha1},
+				{Algorithm: "SHA256", Value: f.sha256},
+			},
+		})
+
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: "SPDXRef-Image",
+			Type:    "CONTAINS",
+			Related: id,
+		})
+	}
+
+	return doc
+}
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type   string    `json:"type"`
+	BOMRef string    `json:"bom-ref,omitempty"`
+	Name   string    `json:"name"`
+	Hashes []cdxHash `json:"hashes,omitempty"`
+}
+
+type cdxHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+func cycloneDX(files []file, name string, created time.Time) *cdxDocument {
+	doc := &cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + util.FormatUUID(util.NameUUID(name+"\x00"+verificationCode(files))),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: created.Format(time.RFC3339),
+			Tools: cdxTools{
+				Components: []cdxComponent{{Type: "application", Name: "oci2erofs"}},
+			},
+			Component: cdxComponent{Type: "file", BOMRef: "image", Name: name},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for _, f := range files {
+		doc.Components = append(doc.Components, cdxComponent{
+			Type:   "file",
+			BOMRef: "file:/" + f.path,
+			Name:   "/" + f.path,
+			Hashes: []cdxHash{
+				{Algorithm: "SHA-1", Content: f.sha1},
+				{Algorithm: "SHA-256", Content: f.sha256},
+			},
+		})
+	}
+
+	return doc
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sbom_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/sbom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/hostname":  {Data: []byte("toybox\n"), Mode: 0o644},
+		"bin/sh":        {Data: []byte("#!/bin/sh\n"), Mode: 0o755},
+		"var/run":       {Data: []byte("../run"), Mode: fs.ModeSymlink | 0o777},
+		"bin/ls":        {Data: []byte("ls"), Mode: 0o755},
+		"usr/lib/empty": {Mode: 0o644},
+	}
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := &sbom.Options{Name: "image.erofs", Created: &created}
+
+	t.Run("SPDX", func(t *testing.T) {
+		data, err := sbom.Generate(context.Background(), fsys, sbom.FormatSPDX, opts)
+		require.NoError(t, err)
+
+		var doc struct {
+			SPDXVersion  string `json:"spdxVersion"`
+			Name         string `json:"name"`
+			CreationInfo struct {
+				Created string `json:"created"`
+			} `json:"creationInfo"`
+			Packages []struct {
+				PackageVerificationCode struct {
+					Value string `json:"packageVerificationCodeValue"`
+				} `json:"packageVerificationCode"`
+			} `json:"packages"`
+			Files []struct {
+				FileName  string `json:"fileName"`
+				Checksums []struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"checksumValue"`
+				} `json:"checksums"`
+			} `json:"files"`
+			Relationships []struct {
+				Type string `json:"relationshipType"`
+			} `json:"relationships"`
+		}
+		require.NoError(t, json.Unmarshal(data, &doc))
+
+		require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+		require.Equal(t, "image.erofs", doc.Name)
+		require.Equal(t, "2024-01-01T00:00:00Z", doc.CreationInfo.Created)
+		require.Len(t, doc.Packages, 1)
+		require.Len(t, doc.Packages[0].PackageVerificationCode.Value, 40)
+
+		var names []string
+		for _, f := range doc.Files {
+			names = append(names, f.FileName)
+		}
+		require.Equal(t, []string{"./bin/ls", "./bin/sh", "./etc/hostname", "./usr/lib/empty"}, names)
+
+		require.Equal(t, "SHA256", doc.Files[2].Checksums[1].Algorithm)
+		require.Equal(t, "a30ff35269c32d5e2e4b49a5ecaa79cc9929a3994bb41274c0078de711c622b1", doc.Files[2].Checksums[1].Value)
+
+		// DESCRIBES, then CONTAINS for every file.
+		require.Len(t, doc.Relationships, 5)
+	})
+
+	t.Run("CycloneDX", func(t *testing.T) {
+		data, err := sbom.Generate(context.Background(), fsys, sbom.FormatCycloneDX, opts)
+		require.NoError(t, err)
+
+		var doc struct {
+			BOMFormat    string `json:"bomFormat"`
+			SerialNumber string `json:"serialNumber"`
+			Components   []struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Hashes []struct {
+					Algorithm string `json:"alg"`
+				} `json:"hashes"`
+			} `json:"components"`
+		}
+		require.NoError(t, json.Unmarshal(data, &doc))
+
+		require.Equal(t, "CycloneDX", doc.BOMFormat)
+		require.Regexp(t, "^urn:uuid:[0-9a-f-]{36}$", doc.SerialNumber)
+		require.Len(t, doc.Components, 4)
+		require.Equal(t, "file", doc.Components[0].Type)
+		require.Equal(t, "/bin/ls", doc.Components[0].Name)
+		require.Equal(t, "SHA-256", doc.Components[0].Hashes[1].Algorithm)
+	})
+
+	t.Run("Reproducible", func(t *testing.T) {
+		a, err := sbom.Generate(context.Background(), fsys, sbom.FormatSPDX, opts)
+		require.NoError(t, err)
+
+		b, err := sbom.Generate(context.Background(), fsys, sbom.FormatSPDX, opts)
+		require.NoError(t, err)
+
+		require.Equal(t, a, b)
+	})
+
+	t.Run("Unsupported Format", func(t *testing.T) {
+		_, err := sbom.Generate(context.Background(), fsys, "swid", opts)
+		require.Error(t, err)
+	})
+}
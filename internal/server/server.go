@@ -0,0 +1,561 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package server implements an HTTP API converting images on demand, for
+// provisioning services that would otherwise spawn a conversion process (and
+// download the shared layers again) for every image.
+//
+// The API is:
+//
+//	POST   /v1/jobs             submit a conversion (a JSON Request), returns its Status
+//	GET    /v1/jobs             list the status of every job
+//	GET    /v1/jobs/{id}        return the status of a job
+//	GET    /v1/jobs/{id}/events stream the progress of a job, as newline delimited JSON Updates
+//	GET    /v1/jobs/{id}/image  download the converted image
+//	DELETE /v1/jobs/{id}        cancel a job and remove its image
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+)
+
+// progressInterval is how often the progress of an item is recorded (its
+// completion is always recorded).
+const progressInterval = time.Second
+
+// Options configures a server.
+type Options struct {
+	// Dir is the directory converted images are written to.
+	Dir string
+	// Parallel is the number of images converted at a time (default 1).
+	Parallel int
+	// Retention is how long finished jobs, and their images, are kept. If
+	// zero, they are kept until deleted.
+	Retention time.Duration
+	// AllowLocalImages permits jobs to convert images other than those pulled
+	// from a registry (eg. paths on the server, or images in a local Docker
+	// daemon).
+	AllowLocalImages bool
+	// Defaults are the conversion options each job starts from (eg. registry
+	// credentials, limits and the layer cache directory).
+	Defaults oci2erofs.Options
+}
+
+// Request is a conversion submitted to the server.
+type Request struct {
+	// Image is the image to convert (eg. "docker://alpine:3.20").
+	Image string `json:"image"`
+	// Ref selects an image by name or manifest digest.
+	Ref string `json:"ref,omitempty"`
+	// Platform selects the platform to convert (eg. "linux/arm64").
+	Platform string `json:"platform,omitempty"`
+	// Exclude are glob patterns of paths to drop from the root filesystem,
+	// in addition to those excluded by the server.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// State is the state of a job.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Finished reports whether a job in this state has stopped running.
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCancelled
+}
+
+// Status is the status of a job.
+type Status struct {
+	ID      string    `json:"id"`
+	Request Request   `json:"request"`
+	State   State     `json:"state"`
+	Created time.Time `json:"created"`
+	// Error is why the job failed.
+	Error string `json:"error,omitempty"`
+	// Stats are the statistics of the converted image.
+	Stats *oci2erofs.Stats `json:"stats,omitempty"`
+}
+
+// Update is an entry of the events stream of a job, reporting either its
+// progress or a change of its state.
+type Update struct {
+	Progress *oci2erofs.ProgressEvent `json:"progress,omitempty"`
+	Status   *Status                  `json:"status,omitempty"`
+}
+
+// Server converts images submitted over HTTP.
+type Server struct {
+	opts    Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sem     chan struct{}
+	handler http.Handler
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// New returns a server writing images to opts.Dir. Close must be called to
+// stop any running conversions.
+func New(opts *Options) (*Server, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("output directory is required")
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		opts:   *opts,
+		ctx:    ctx,
+		cancel: cancel,
+		sem:    make(chan struct{}, max(opts.Parallel, 1)),
+		jobs:   make(map[string]*job),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/jobs", s.handleSubmit)
+	mux.HandleFunc("GET /v1/jobs", s.handleList)
+	mux.HandleFunc("GET /v1/jobs/{id}", s.handleStatus)
+	mux.HandleFunc("GET /v1/jobs/{id}/events", s.handleEvents)
+	mux.HandleFunc("GET /v1/jobs/{id}/image", s.handleImage)
+	mux.HandleFunc("DELETE /v1/jobs/{id}", s.handleDelete)
+	s.handler = mux
+
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close cancels any running conversions and waits for them to stop. The
+// images already written are left in place.
+func (s *Server) Close() error {
+	s.cancel()
+	s.wg.Wait()
+
+	return nil
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := s.jobOptions(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts.Output = filepath.Join(s.opts.Dir, id+".erofs")
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	j := &job{
+		path:   opts.Output,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: Status{
+			ID:      id,
+			Request: req,
+			State:   StateQueued,
+			Created: time.Now().UTC(),
+		},
+		changed:  make(chan struct{}),
+		lastEmit: make(map[oci2erofs.ProgressEvent]time.Time),
+	}
+	opts.Progress = j.report
+	opts.OnStats = j.setStats
+
+	s.mu.Lock()
+	s.jobs[id] = j
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		s.run(ctx, j, opts)
+	}()
+
+	slog.Info("Submitted job", slog.String("id", id), slog.String("image", req.Image))
+
+	w.Header().Set("Location", "/v1/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, j.Status())
+}
+
+// jobOptions returns the conversion options of a request.
+func (s *Server) jobOptions(req *Request) (*oci2erofs.Options, error) {
+	if req.Image == "" {
+		return nil, errors.New("image is required")
+	}
+
+	if req.Image == oci2erofs.Stdin {
+		return nil, errors.New("images cannot be read from standard input")
+	}
+
+	if !s.opts.AllowLocalImages && !strings.HasPrefix(req.Image, oci2erofs.DockerPrefix) {
+		return nil, fmt.Errorf("image %q is not a registry reference (%s)", req.Image, oci2erofs.DockerPrefix)
+	}
+
+	opts := s.opts.Defaults
+	opts.Image = req.Image
+	opts.OutputWriter = nil
+	opts.Force = true
+
+	if req.Ref != "" {
+		opts.Ref = req.Ref
+	}
+
+	if req.Platform != "" {
+		platform, err := platforms.Parse(req.Platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse platform: %w", err)
+		}
+		opts.Platform = &platform
+		opts.FirstManifest = false
+	}
+
+	opts.Exclude = append(slices.Clone(opts.Exclude), req.Exclude...)
+
+	return &opts, nil
+}
+
+func (s *Server) run(ctx context.Context, j *job, opts *oci2erofs.Options) {
+	defer close(j.done)
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-ctx.Done():
+		j.finish(ctx.Err())
+		return
+	}
+
+	j.setState(StateRunning)
+
+	err := oci2erofs.Convert(ctx, opts)
+	if err != nil {
+		slog.Warn("Job failed", slog.String("id", j.id()), slog.Any("error", err))
+	} else {
+		slog.Info("Job succeeded", slog.String("id", j.id()))
+	}
+	j.finish(err)
+
+	if s.opts.Retention > 0 {
+		time.AfterFunc(s.opts.Retention, func() {
+			if err := s.remove(j.id()); err != nil {
+				slog.Warn("Failed to remove expired job", slog.String("id", j.id()), slog.Any("error", err))
+			}
+		})
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.Status())
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(statuses, func(a, b Status) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, j.Status())
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	var next int
+	for {
+		updates, changed, finished := j.updatesSince(next)
+		for _, u := range updates {
+			if err := enc.Encode(u); err != nil {
+				return
+			}
+		}
+		next += len(updates)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+
+	status := j.Status()
+	if status.State != StateSucceeded {
+		http.Error(w, fmt.Sprintf("job is %s", status.State), http.StatusConflict)
+		return
+	}
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to open image: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", status.ID+".erofs"))
+	http.ServeContent(w, r, "", status.Created, f)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	j := s.job(w, r)
+	if j == nil {
+		return
+	}
+
+	// Wait for the conversion to stop, so that it does not write the image
+	// after it has been removed.
+	j.cancel()
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if err := s.remove(j.id()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// job returns the job named by the request, or writes an error response if
+// there is no such job.
+func (s *Server) job(w http.ResponseWriter, r *http.Request) *job {
+	s.mu.Lock()
+	j, ok := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return nil
+	}
+
+	return j
+}
+
+// remove forgets a finished job and removes its image.
+func (s *Server) remove(id string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	delete(s.jobs, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove image: %w", err)
+	}
+
+	return nil
+}
+
+type job struct {
+	path   string
+	cancel context.CancelFunc
+	// done is closed once the job has stopped running.
+	done chan struct{}
+
+	mu      sync.Mutex
+	status  Status
+	updates []Update
+	// changed is closed (and replaced) whenever an update is recorded.
+	changed  chan struct{}
+	lastEmit map[oci2erofs.ProgressEvent]time.Time
+}
+
+func (j *job) id() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status.ID
+}
+
+// Status returns the current status of the job.
+func (j *job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status
+}
+
+func (j *job) report(e oci2erofs.ProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := oci2erofs.ProgressEvent{Stage: e.Stage, Item: e.Item}
+	if !e.Done() && time.Since(j.lastEmit[key]) < progressInterval {
+		return
+	}
+	j.lastEmit[key] = time.Now()
+
+	j.record(Update{Progress: &e})
+}
+
+func (j *job) setStats(stats *oci2erofs.Stats) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.Stats = stats
+}
+
+func (j *job) setState(state State) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.State = state
+
+	status := j.status
+	j.record(Update{Status: &status})
+}
+
+func (j *job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	switch {
+	case err == nil:
+		j.status.State = StateSucceeded
+	case errors.Is(err, context.Canceled):
+		j.status.State = StateCancelled
+	default:
+		j.status.State = StateFailed
+		j.status.Error = err.Error()
+	}
+
+	status := j.status
+	j.record(Update{Status: &status})
+}
+
+// record appends an update, waking any streams waiting for it. j.mu must be
+// held.
+func (j *job) record(u Update) {
+	j.updates = append(j.updates, u)
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// updatesSince returns the updates recorded after the first n, a channel
+// closed when the next update is recorded, and whether the job has finished
+// (and so there will be no further updates).
+func (j *job) updatesSince(n int) ([]Update, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.updates[n:], j.changed, j.status.State.Finished()
+}
+
+func newID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %w", err)
+	}
+
+	return hex.EncodeToString(id[:]), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
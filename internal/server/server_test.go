@@ -0,0 +1,217 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/server"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+
+	srv, err := server.New(&server.Options{
+		Dir:              dir,
+		Parallel:         2,
+		AllowLocalImages: true,
+		Defaults: oci2erofs.Options{
+			LayerCacheDir: t.TempDir(),
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	t.Run("Convert", func(t *testing.T) {
+		status := submit(t, ts.URL, server.Request{Image: "../../testdata/toybox.tar", Exclude: []string{"/etc"}}, http.StatusAccepted)
+		require.Equal(t, server.StateQueued, status.State)
+
+		final := waitForJob(t, ts.URL, status.ID)
+		require.Equal(t, server.StateSucceeded, final.State, final.Error)
+		require.NotNil(t, final.Stats)
+
+		resp, err := http.Get(ts.URL + "/v1/jobs/" + status.ID + "/image")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		image, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, final.Stats.ImageSize, int64(len(image)))
+
+		fsys, err := oci2erofs.OpenImage(bytes.NewReader(image))
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "usr/bin/toybox")
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "etc")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		t.Run("List", func(t *testing.T) {
+			resp, err := http.Get(ts.URL + "/v1/jobs")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var statuses []server.Status
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&statuses))
+			require.NotEmpty(t, statuses)
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+"/v1/jobs/"+status.ID, nil)
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+			resp, err = http.Get(ts.URL + "/v1/jobs/" + status.ID)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			_, err = os.Stat(filepath.Join(dir, status.ID+".erofs"))
+			require.ErrorIs(t, err, fs.ErrNotExist)
+		})
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		status := submit(t, ts.URL, server.Request{Image: "../../testdata/nonexistent.tar"}, http.StatusAccepted)
+
+		final := waitForJob(t, ts.URL, status.ID)
+		require.Equal(t, server.StateFailed, final.State)
+		require.NotEmpty(t, final.Error)
+
+		resp, err := http.Get(ts.URL + "/v1/jobs/" + status.ID + "/image")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		for name, body := range map[string]string{
+			"Missing Image":  `{}`,
+			"Stdin":          `{"image": "-"}`,
+			"Bad Platform":   `{"image": "docker://alpine", "platform": "linux/"}`,
+			"Unknown Field":  `{"image": "docker://alpine", "output": "/etc/passwd"}`,
+			"Malformed JSON": `{"image": `,
+		} {
+			t.Run(name, func(t *testing.T) {
+				resp, err := http.Post(ts.URL+"/v1/jobs", "application/json", strings.NewReader(body))
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			})
+		}
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/v1/jobs/nonexistent")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServerLocalImages(t *testing.T) {
+	srv, err := server.New(&server.Options{Dir: t.TempDir()})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	submit(t, ts.URL, server.Request{Image: "../../testdata/toybox.tar"}, http.StatusBadRequest)
+}
+
+func submit(t *testing.T, url string, req server.Request, expectedCode int) *server.Status {
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+
+	resp, err := http.Post(url+"/v1/jobs", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, expectedCode, resp.StatusCode)
+	if expectedCode != http.StatusAccepted {
+		return nil
+	}
+
+	var status server.Status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+
+	return &status
+}
+
+// waitForJob follows the events stream of a job until it finishes, and
+// returns its final status.
+func waitForJob(t *testing.T, url, id string) *server.Status {
+	resp, err := http.Get(url + "/v1/jobs/" + id + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var last *server.Status
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var u server.Update
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &u))
+
+		if u.Status != nil {
+			last = u.Status
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	require.NotNil(t, last)
+	require.True(t, last.State.Finished())
+
+	// The stream ends once the job has finished, after which its status
+	// (which includes the statistics) is final.
+	resp, err = http.Get(url + "/v1/jobs/" + id)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var status server.Status
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, last.State, status.State)
+
+	return &status
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// MediaTypeSimpleSigning is the media type of cosign signature payloads.
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// AnnotationSignature is the layer annotation holding the base64 encoded
+	// signature of the payload.
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+)
+
+// ErrInvalidSignature is returned when an image has no signature that is
+// valid for the given public key.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ErrKeylessUnsupported is returned when a signature key is given as
+// anything other than a public key file: keyless (Fulcio/Rekor) verification
+// and key references (eg. KMS URIs) are not supported.
+var ErrKeylessUnsupported = errors.New("only cosign public keys are supported, not keyless (Fulcio/Rekor) verification or key references")
+
+// Payload is a cosign simple signing payload.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional,omitempty"`
+}
+
+// LoadPublicKey reads a PEM encoded ECDSA, RSA or Ed25519 public key (eg.
+// cosign.pub) from the given path. Keyless signing certificates and key
+// references are rejected with ErrKeylessUnsupported.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	if path == "" || strings.EqualFold(path, "keyless") || strings.Contains(path, "://") {
+		return nil, fmt.Errorf("%w: %q", ErrKeylessUnsupported, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key %s: no PEM data found", path)
+	}
+
+	// A Fulcio certificate, as used for keyless signing.
+	if block.Type == "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: %s holds a certificate", ErrKeylessUnsupported, path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// Tag returns the tag under which cosign stores the signatures of the
+// manifest with the given digest.
+func Tag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+}
+
+// Verify checks that sig (base64 encoded) is a valid signature of payload
+// for the public key, and that the payload refers to the manifest with the
+// given digest.
+func Verify(pub crypto.PublicKey, payload []byte, sig string, dgst digest.Digest) error {
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode signature: %v", ErrInvalidSignature, err)
+	}
+
+	hash := sha256.Sum256(payload)
+
+	var ok bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, hash[:], rawSig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], rawSig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, payload, rawSig)
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	if !ok {
+		return fmt.Errorf("%w: signature does not match public key", ErrInvalidSignature)
+	}
+
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("%w: failed to unmarshal payload: %v", ErrInvalidSignature, err)
+	}
+
+	if p.Critical.Image.DockerManifestDigest != dgst {
+		return fmt.Errorf("%w: payload is for %s, not %s", ErrInvalidSignature, p.Critical.Image.DockerManifestDigest, dgst)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package signature_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/signature"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	payload := createPayload(t, dgst)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keys := map[string]crypto.Signer{
+		"ECDSA":   ecdsaKey,
+		"Ed25519": ed25519Key,
+	}
+
+	for name, key := range keys {
+		t.Run(name, func(t *testing.T) {
+			pub, err := signature.LoadPublicKey(writePublicKey(t, key.Public()))
+			require.NoError(t, err)
+
+			sig := sign(t, key, payload)
+
+			t.Run("Valid", func(t *testing.T) {
+				require.NoError(t, signature.Verify(pub, payload, sig, dgst))
+			})
+
+			t.Run("Tampered Payload", func(t *testing.T) {
+				err := signature.Verify(pub, append(payload, ' '), sig, dgst)
+				require.ErrorIs(t, err, signature.ErrInvalidSignature)
+			})
+
+			t.Run("Other Manifest", func(t *testing.T) {
+				err := signature.Verify(pub, payload, sig, digest.FromString("other"))
+				require.ErrorIs(t, err, signature.ErrInvalidSignature)
+			})
+		})
+	}
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		err = signature.Verify(otherKey.Public(), payload, sign(t, ecdsaKey, payload), dgst)
+		require.ErrorIs(t, err, signature.ErrInvalidSignature)
+	})
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("Public Key", func(t *testing.T) {
+		pub, err := signature.LoadPublicKey(writePublicKey(t, key.Public()))
+		require.NoError(t, err)
+		require.True(t, key.PublicKey.Equal(pub))
+	})
+
+	t.Run("Keyless", func(t *testing.T) {
+		for _, name := range []string{"", "keyless", "https://fulcio.sigstore.dev", "awskms:///alias/cosign"} {
+			_, err := signature.LoadPublicKey(name)
+			require.ErrorIs(t, err, signature.ErrKeylessUnsupported, name)
+		}
+	})
+
+	t.Run("Certificate", func(t *testing.T) {
+		template := &x509.Certificate{SerialNumber: big.NewInt(1)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "cert.pem")
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+
+		_, err = signature.LoadPublicKey(path)
+		require.ErrorIs(t, err, signature.ErrKeylessUnsupported)
+	})
+}
+
+func TestTag(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	require.Equal(t, "sha256-"+dgst.Encoded()+".sig", signature.Tag(dgst))
+}
+
+func createPayload(t *testing.T, dgst digest.Digest) []byte {
+	var p signature.Payload
+	p.Critical.Identity.DockerReference = "example.com/test/repo"
+	p.Critical.Image.DockerManifestDigest = dgst
+	p.Critical.Type = "cosign container image signature"
+
+	payload, err := json.Marshal(p)
+	require.NoError(t, err)
+
+	return payload
+}
+
+func sign(t *testing.T, key crypto.Signer, payload []byte) string {
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func writePublicKey(t *testing.T, pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644))
+
+	return path
+}
@@ -0,0 +1,371 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package storage reads images from a containers/storage image store, as
+// used by podman, buildah and CRI-O, with the overlay driver. Layers are
+// stored extracted, so their tarballs are reassembled from the extracted
+// files and the tar-split metadata recorded when they were extracted.
+//
+// The store is read without taking its locks, so images should not be
+// removed while they are being converted.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultRoot is the root of the system image store.
+const DefaultRoot = "/var/lib/containers/storage"
+
+// The driver whose layers are read. Its name prefixes the image and layer
+// directories of the store.
+const driver = "overlay"
+
+var _ oci.BlobProvider = (*Provider)(nil)
+
+// UserRoot returns the root of the image store of the current user: the
+// system image store for root, or the rootless image store otherwise.
+func UserRoot() (string, error) {
+	if os.Geteuid() == 0 {
+		return DefaultRoot, nil
+	}
+
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find the image store: %w", err)
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dataHome, "containers", "storage"), nil
+}
+
+// image is an entry of the image store's images.json.
+type image struct {
+	ID           string   `json:"id"`
+	Names        []string `json:"names,omitempty"`
+	TopLayer     string   `json:"layer,omitempty"`
+	BigDataNames []string `json:"big-data-names,omitempty"`
+}
+
+// layer is an entry of the image store's layers.json.
+type layer struct {
+	ID         string        `json:"id"`
+	Parent     string        `json:"parent,omitempty"`
+	DiffDigest digest.Digest `json:"diff-digest,omitempty"`
+	DiffSize   int64         `json:"diff-size,omitempty"`
+}
+
+// Store is a containers/storage image store.
+type Store struct {
+	root   string
+	images []image
+	layers map[string]layer
+}
+
+// Open opens the image store at root (defaults to UserRoot).
+func Open(root string) (*Store, error) {
+	if root == "" {
+		var err error
+		root, err = UserRoot()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store{root: root}
+
+	if err := readJSON(filepath.Join(root, driver+"-images", "images.json"), &s.images); err != nil {
+		return nil, fmt.Errorf("failed to read images of store %s: %w", root, err)
+	}
+
+	var layers []layer
+	if err := readJSON(filepath.Join(root, driver+"-layers", "layers.json"), &layers); err != nil {
+		return nil, fmt.Errorf("failed to read layers of store %s: %w", root, err)
+	}
+
+	s.layers = make(map[string]layer, len(layers))
+	for _, l := range layers {
+		s.layers[l.ID] = l
+	}
+
+	return s, nil
+}
+
+// Provider returns a provider of the image with the given name (eg.
+// "docker.io/library/alpine:3.19", "alpine:3.19" or "localhost/app") or ID
+// (or an unambiguous prefix of it).
+func (s *Store) Provider(name string) (*Provider, error) {
+	img, err := s.image(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{store: s, name: name}
+
+	// The image ID is the digest of its config.
+	p.configDigest = digest.NewDigestFromEncoded(digest.SHA256, img.ID)
+	if err := p.configDigest.Validate(); err != nil {
+		return nil, fmt.Errorf("image %s has an invalid ID: %w", name, err)
+	}
+	p.configPath = filepath.Join(s.root, driver+"-images", img.ID, bigDataFileName(p.configDigest.String()))
+
+	var config ocispecs.Image
+	if err := readJSON(p.configPath, &config); err != nil {
+		return nil, fmt.Errorf("failed to read config of image %s: %w", name, err)
+	}
+
+	// Layers are stored top down, linked by their parents.
+	var layers []ocispecs.Descriptor
+	for id := img.TopLayer; id != ""; {
+		l, ok := s.layers[id]
+		if !ok {
+			return nil, fmt.Errorf("layer %s of image %s not found", id, name)
+		}
+
+		if l.DiffDigest == "" {
+			return nil, fmt.Errorf("layer %s of image %s has no digest", id, name)
+		}
+
+		layers = append([]ocispecs.Descriptor{{
+			MediaType: ocispecs.MediaTypeImageLayer,
+			Digest:    l.DiffDigest,
+			Size:      l.DiffSize,
+		}}, layers...)
+
+		id = l.Parent
+	}
+
+	fi, err := os.Stat(p.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of image %s: %w", name, err)
+	}
+
+	// The layers are uncompressed, so the manifest is synthesized rather
+	// than stored (which would refer to compressed layers).
+	p.manifest, err = json.Marshal(ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config: ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageConfig,
+			Digest:    p.configDigest,
+			Size:      fi.Size(),
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.manifestDesc = ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(p.manifest),
+		Size:      int64(len(p.manifest)),
+		Platform:  &config.Platform,
+	}
+
+	return p, nil
+}
+
+// image finds the image with the given name or ID.
+func (s *Store) image(name string) (*image, error) {
+	names := []string{name}
+
+	// Unqualified names are normalized as by podman, for images pulled from
+	// Docker Hub (eg. "alpine" -> "docker.io/library/alpine:latest") and
+	// built locally (eg. "app" -> "localhost/app:latest").
+	if named, err := dockerref.ParseDockerRef(name); err == nil {
+		names = append(names, named.String())
+
+		if !strings.Contains(name, "/") {
+			names = append(names, "localhost/"+dockerref.FamiliarString(named))
+		}
+	}
+
+	for i := range s.images {
+		for _, n := range s.images[i].Names {
+			for _, want := range names {
+				if n == want {
+					return &s.images[i], nil
+				}
+			}
+		}
+	}
+
+	var found *image
+	if len(name) >= 3 {
+		for i := range s.images {
+			if strings.HasPrefix(s.images[i].ID, name) {
+				if found != nil {
+					return nil, fmt.Errorf("%w: image ID %s matches more than one image", util.ErrAmbiguousRef, name)
+				}
+				found = &s.images[i]
+			}
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s is not in store %s: %w", util.ErrRefNotFound, name, s.root, fs.ErrNotExist)
+	}
+
+	return found, nil
+}
+
+// Provider provides an image from the image store. Its index lists just the
+// image, annotated with its name.
+type Provider struct {
+	store        *Store
+	name         string
+	configDigest digest.Digest
+	configPath   string
+	manifest     []byte
+	manifestDesc ocispecs.Descriptor
+}
+
+func (p *Provider) OpenIndex(_ context.Context) (fs.File, error) {
+	desc := p.manifestDesc
+	desc.Annotations = map[string]string{ocispecs.AnnotationRefName: p.name}
+
+	data, err := json.Marshal(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{desc},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &memFile{Reader: bytes.NewReader(data), name: "index.json"}, nil
+}
+
+func (p *Provider) OpenBlob(_ context.Context, dgst digest.Digest) (fs.File, error) {
+	switch dgst {
+	case p.manifestDesc.Digest:
+		return &memFile{Reader: bytes.NewReader(p.manifest), name: dgst.Encoded()}, nil
+	case p.configDigest:
+		return os.Open(p.configPath)
+	}
+
+	for _, l := range p.store.layers {
+		if l.DiffDigest == dgst {
+			return p.store.openLayer(l)
+		}
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: dgst.String(), Err: fs.ErrNotExist}
+}
+
+// openLayer reassembles the tarball of a layer.
+func (s *Store) openLayer(l layer) (fs.File, error) {
+	f, err := os.Open(filepath.Join(s.root, driver+"-layers", l.ID+".tar-split.gz"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("layer %s has no tar-split metadata, so its tarball cannot be reassembled", l.ID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open layer %s: %w", l.ID, err)
+	}
+
+	r, err := newAssembler(f, filepath.Join(s.root, driver, l.ID, "diff"))
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open layer %s: %w", l.ID, err)
+	}
+
+	return &layerFile{assembler: r, f: f, name: l.DiffDigest.Encoded(), size: l.DiffSize}, nil
+}
+
+// bigDataFileName returns the name of the file that an image's big data item
+// (eg. its config, keyed by digest) is stored in.
+func bigDataFileName(key string) string {
+	for _, c := range key {
+		if c != '.' && !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'z') {
+			return "=" + base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+
+	return key
+}
+
+func readJSON(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// layerFile is a reassembled layer tarball.
+type layerFile struct {
+	*assembler
+	f    *os.File
+	name string
+	size int64
+}
+
+func (f *layerFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: f.name, size: f.size}, nil
+}
+
+func (f *layerFile) Close() error {
+	return errors.Join(f.assembler.Close(), f.f.Close())
+}
+
+// memFile is a synthesized index or manifest.
+type memFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: f.name, size: f.Size()}, nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return nil }
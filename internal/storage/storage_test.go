@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/storage"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testBlobs  = "../oci/testdata/toybox/blobs/sha256"
+	testConfig = "73e30ac9c7813c3bbd8287d440e693cedb153218d1aefe616b4e1089341edbe6"
+	testLayer  = "4e4ed2728f23408f0a3be0cf892b607bc5ec32d12941a093d001bc3de60f5425"
+)
+
+func TestProvider(t *testing.T) {
+	root := t.TempDir()
+	writeTestStore(t, root)
+
+	store, err := storage.Open(root)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	for _, name := range []string{"docker.io/tianon/toybox:0.8.11", "tianon/toybox:0.8.11", testConfig[:12]} {
+		t.Run(name, func(t *testing.T) {
+			p, err := store.Provider(name)
+			require.NoError(t, err)
+
+			rootFS, closeAll, err := oci.LoadImageFrom(ctx, t.TempDir(), p, "", nil, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, closeAll())
+			})
+
+			h, err := util.HashFS(rootFS)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+		})
+	}
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, err := store.Provider("tianon/toybox:latest")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Modified Layer", func(t *testing.T) {
+		root := t.TempDir()
+		layerID := writeTestStore(t, root)
+
+		require.NoError(t, os.WriteFile(filepath.Join(root, "overlay", layerID, "diff", "etc", "passwd"), []byte("modified"), 0o644))
+
+		store, err := storage.Open(root)
+		require.NoError(t, err)
+
+		p, err := store.Provider("docker.io/tianon/toybox:0.8.11")
+		require.NoError(t, err)
+
+		_, _, err = oci.LoadImageFrom(ctx, t.TempDir(), p, "", nil, nil)
+		require.Error(t, err)
+	})
+}
+
+// writeTestStore writes an image store containing the toybox test image,
+// returning the ID of its layer.
+func writeTestStore(t *testing.T, root string) string {
+	const layerID = "b3f9d1c1f1a0c1e8d9a2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4"
+
+	compressed, err := os.Open(filepath.Join(testBlobs, testLayer))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, compressed.Close())
+	})
+
+	zr, err := gzip.NewReader(compressed)
+	require.NoError(t, err)
+
+	diffDir := filepath.Join(root, "overlay", layerID, "diff")
+	require.NoError(t, os.MkdirAll(diffDir, 0o755))
+
+	var tarSplit bytes.Buffer
+	zw := gzip.NewWriter(&tarSplit)
+	enc := json.NewEncoder(zw)
+
+	// Record the raw tar data around the file contents, as tar-split does
+	// when a layer is extracted.
+	h := digest.SHA256.Digester()
+	rec := &recorder{r: io.TeeReader(zr, h.Hash())}
+	tr := tar.NewReader(rec)
+
+	var size int64
+	flush := func() {
+		if rec.buf.Len() > 0 {
+			require.NoError(t, enc.Encode(map[string]any{"type": 2, "payload": rec.buf.Bytes()}))
+			size += int64(rec.buf.Len())
+			rec.buf.Reset()
+		}
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		flush()
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		rec.buf.Reset()
+
+		require.NoError(t, enc.Encode(map[string]any{"type": 1, "name": hdr.Name, "size": len(data)}))
+		size += int64(len(data))
+
+		if hdr.Typeflag == tar.TypeReg {
+			name := filepath.Join(diffDir, hdr.Name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+			require.NoError(t, os.WriteFile(name, data, 0o644))
+		}
+	}
+
+	_, err = io.Copy(io.Discard, rec)
+	require.NoError(t, err)
+	flush()
+
+	require.NoError(t, zw.Close())
+
+	layersDir := filepath.Join(root, "overlay-layers")
+	require.NoError(t, os.MkdirAll(layersDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(layersDir, layerID+".tar-split.gz"), tarSplit.Bytes(), 0o644))
+
+	writeJSON(t, filepath.Join(layersDir, "layers.json"), []map[string]any{{
+		"id":          layerID,
+		"diff-digest": h.Digest(),
+		"diff-size":   size,
+	}})
+
+	imageDir := filepath.Join(root, "overlay-images", testConfig)
+	require.NoError(t, os.MkdirAll(imageDir, 0o755))
+
+	config, err := os.ReadFile(filepath.Join(testBlobs, testConfig))
+	require.NoError(t, err)
+
+	configName := "=" + base64.StdEncoding.EncodeToString([]byte("sha256:"+testConfig))
+	require.NoError(t, os.WriteFile(filepath.Join(imageDir, configName), config, 0o644))
+
+	writeJSON(t, filepath.Join(root, "overlay-images", "images.json"), []map[string]any{{
+		"id":             testConfig,
+		"names":          []string{"docker.io/tianon/toybox:0.8.11"},
+		"layer":          layerID,
+		"big-data-names": []string{"sha256:" + testConfig},
+	}})
+
+	return layerID
+}
+
+func writeJSON(t *testing.T, name string, v any) {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+}
+
+// recorder records the data read through it.
+type recorder struct {
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// The types of tar-split entries.
+const (
+	// entryFile is the content of a file, which is read from the extracted
+	// layer.
+	entryFile = 1
+	// entrySegment is raw tar data (headers, padding etc.).
+	entrySegment = 2
+)
+
+// entry is a tar-split entry, one JSON object per line.
+type entry struct {
+	Type    int    `json:"type"`
+	Name    string `json:"name,omitempty"`
+	NameRaw []byte `json:"name_raw,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+// assembler reassembles a layer tarball from its tar-split metadata and the
+// files of the extracted layer.
+type assembler struct {
+	zr  *gzip.Reader
+	dec *json.Decoder
+	dir string
+
+	cur     io.Reader
+	curFile *os.File
+}
+
+func newAssembler(r io.Reader, dir string) (*assembler, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress tar-split metadata: %w", err)
+	}
+
+	return &assembler{zr: zr, dec: json.NewDecoder(zr), dir: dir}, nil
+}
+
+func (a *assembler) Read(p []byte) (int, error) {
+	for {
+		if a.cur != nil {
+			n, err := a.cur.Read(p)
+			if !errors.Is(err, io.EOF) || n > 0 {
+				return n, err
+			}
+
+			if err := a.closeFile(); err != nil {
+				return 0, err
+			}
+			a.cur = nil
+		}
+
+		var e entry
+		if err := a.dec.Decode(&e); errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to decode tar-split metadata: %w", err)
+		}
+
+		switch e.Type {
+		case entrySegment:
+			a.cur = bytes.NewReader(e.Payload)
+		case entryFile:
+			if e.Size == 0 {
+				continue
+			}
+
+			name := e.Name
+			if len(e.NameRaw) > 0 {
+				name = string(e.NameRaw)
+			}
+
+			// The file is read from within the extracted layer, whatever
+			// its name. The caller verifies the reassembled tarball, so a
+			// file that has been modified since extraction is detected.
+			f, err := os.Open(filepath.Join(a.dir, filepath.Clean("/"+name)))
+			if err != nil {
+				return 0, fmt.Errorf("failed to open layer file: %w", err)
+			}
+
+			a.curFile = f
+			a.cur = &exactReader{r: io.LimitReader(f, e.Size), remaining: e.Size, name: name}
+		default:
+			return 0, fmt.Errorf("unknown tar-split entry type %d", e.Type)
+		}
+	}
+}
+
+func (a *assembler) Close() error {
+	return errors.Join(a.closeFile(), a.zr.Close())
+}
+
+func (a *assembler) closeFile() error {
+	if a.curFile == nil {
+		return nil
+	}
+
+	err := a.curFile.Close()
+	a.curFile = nil
+	return err
+}
+
+// exactReader fails if a file is shorter than its size in the tarball.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+	name      string
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		return n, fmt.Errorf("layer file %s is truncated: %w", r.name, io.ErrUnexpectedEOF)
+	}
+
+	return n, err
+}
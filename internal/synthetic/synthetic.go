@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package synthetic
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/util"
+)
+
+// Entry types.
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+	TypeChar    = "char"
+	TypeBlock   = "block"
+	TypeFifo    = "fifo"
+)
+
+// ErrUnsupportedType is returned for entries that cannot be represented in
+// the output filesystem.
+var ErrUnsupportedType = errors.New("unsupported entry type")
+
+// ErrDotPath is returned for entries whose path starts with a dot in the
+// root directory (eg. "/.profile"), which cannot be added yet.
+var ErrDotPath = errors.New("paths in the root directory must not start with a dot")
+
+// Entry is a synthetic file system entry to inject into the root filesystem.
+type Entry struct {
+	// Path is the path of the entry within the root filesystem.
+	Path string `json:"path"`
+	// Type is the type of the entry (file, dir, symlink, char, block or fifo).
+	Type string `json:"type"`
+	// Mode is the octal permission mode of the entry (e.g. "0644").
+	Mode string `json:"mode,omitempty"`
+	// UID is the owner user id of the entry.
+	UID int `json:"uid,omitempty"`
+	// GID is the owner group id of the entry.
+	GID int `json:"gid,omitempty"`
+	// Content is the content of a regular file.
+	Content string `json:"content,omitempty"`
+	// Target is the destination of a symbolic link.
+	Target string `json:"target,omitempty"`
+	// Major is the major number of a device node.
+	Major int64 `json:"major,omitempty"`
+	// Minor is the minor number of a device node.
+	Minor int64 `json:"minor,omitempty"`
+}
+
+// Load reads a JSON list of synthetic entries from the named file.
+func Load(name string) ([]Entry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entries: %w", err)
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal entries: %w", err)
+	}
+
+	return entries, nil
+}
+
+// Apply returns a copy of the root filesystem with the given entries merged
+// on top of it. Later entries override earlier ones, and all entries override
+// image content. It also returns the paths of any image content that was
+// overridden.
+func Apply(rootFS fs.FS, entries []Entry) (*overlayfs.FS, []string, error) {
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	for _, e := range entries {
+		hdr, err := e.header()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid entry %q: %w", e.Path, err)
+		}
+
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = e.Content
+	}
+
+	var overridden []string
+	for name := range headers {
+		if _, err := lstat(rootFS, name); err == nil {
+			overridden = append(overridden, name)
+		}
+	}
+	slices.Sort(overridden)
+
+	// Parent directories not explicitly provided retain the metadata they
+	// have in the image.
+	for name := range headers {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := headers[dir]; ok {
+				continue
+			}
+
+			hdr := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0o755,
+			}
+
+			if fi, err := fs.Stat(rootFS, dir); err == nil && fi.IsDir() {
+				hdr, err = tar.FileInfoHeader(fi, "")
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to create header for %q: %w", dir, err)
+				}
+				hdr.Name = dir
+			}
+
+			headers[dir] = hdr
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	// Directories are written last, as tarfs synthesizes a default entry for
+	// the parent directories of each file it sees.
+	slices.SortFunc(names, func(a, b string) int {
+		aDir, bDir := headers[a].Typeflag == tar.TypeDir, headers[b].Typeflag == tar.TypeDir
+		if aDir != bDir {
+			if aDir {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a, b)
+	})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, name := range names {
+		hdr := headers[name]
+
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			content = []byte(contents[name])
+			hdr.Size = int64(len(content))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, fmt.Errorf("failed to write header for %q: %w", name, err)
+		}
+
+		if _, err := tw.Write(content); err != nil {
+			return nil, nil, fmt.Errorf("failed to write content for %q: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	entriesLayer, err := util.OpenTar(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open entries layer: %w", err)
+	}
+
+	mergedFS, err := overlayfs.New([]fs.FS{rootFS, entriesLayer})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create overlayfs: %w", err)
+	}
+
+	return mergedFS, overridden, nil
+}
+
+func (e *Entry) header() (*tar.Header, error) {
+	name := strings.Trim(path.Clean("/"+e.Path), "/")
+	if name == "" {
+		return nil, errors.New("path must not be the root directory")
+	}
+
+	if strings.HasPrefix(path.Base(name), ".wh.") {
+		return nil, errors.New("path must not be a whiteout")
+	}
+
+	// The entries are read back through tarfs, which drops the leading dot
+	// of names in the root directory (eg. "/.profile" would become
+	// "/profile").
+	if strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: %q", ErrDotPath, "/"+name)
+	}
+
+	hdr := &tar.Header{
+		Name: name,
+		Uid:  e.UID,
+		Gid:  e.GID,
+	}
+
+	switch e.Type {
+	case TypeFile, "":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Mode = 0o644
+	case TypeDir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Mode = 0o755
+	case TypeSymlink:
+		if e.Target == "" {
+			return nil, errors.New("symlink target must be specified")
+		}
+
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+		hdr.Mode = 0o777
+	case TypeChar, TypeBlock, TypeFifo:
+		// The EROFS encoder cannot yet write special files.
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, e.Type)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, e.Type)
+	}
+
+	if e.Mode != "" {
+		mode, err := strconv.ParseUint(e.Mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %q: %w", e.Mode, err)
+		}
+
+		hdr.Mode = int64(mode)
+	}
+
+	return hdr, nil
+}
+
+func lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if linkFS, ok := fsys.(archivefs.ReadLinkFS); ok {
+		return linkFS.StatLink(name)
+	}
+
+	return fs.Stat(fsys, name)
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package synthetic_test
+
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/synthetic"
+	"github.com/immutos/oci2erofs/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	rootFS := testutil.CreateTarFS(t, []testutil.File{
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, Content: "image"},
+		{Header: tar.Header{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644}, Content: "root"},
+		{Header: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o750, Uid: 1000}},
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		entries := []synthetic.Entry{
+			{Path: "/etc/hostname", Content: "first"},
+			{Path: "/etc/hostname", Content: "second", Mode: "0600", UID: 1000},
+			{Path: "/run/app", Type: synthetic.TypeDir, Mode: "0700"},
+			{Path: "/usr/bin/sh", Type: synthetic.TypeSymlink, Target: "busybox"},
+		}
+
+		mergedFS, overridden, err := synthetic.Apply(rootFS, entries)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"etc/hostname"}, overridden)
+
+		content, err := fs.ReadFile(mergedFS, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "second", string(content))
+
+		fi, err := mergedFS.Stat("etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o600), fi.Mode().Perm())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+
+		// Image content is retained.
+		content, err = fs.ReadFile(mergedFS, "etc/passwd")
+		require.NoError(t, err)
+		require.Equal(t, "root", string(content))
+
+		// Implicit parent directories retain their image metadata.
+		fi, err = mergedFS.Stat("etc")
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o750), fi.Mode().Perm())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+
+		fi, err = mergedFS.Stat("run/app")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+
+		target, err := mergedFS.ReadLink("usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "busybox", target)
+	})
+
+	t.Run("Device Node", func(t *testing.T) {
+		_, _, err := synthetic.Apply(rootFS, []synthetic.Entry{
+			{Path: "/dev/null", Type: synthetic.TypeChar, Major: 1, Minor: 3},
+		})
+		require.ErrorIs(t, err, synthetic.ErrUnsupportedType)
+	})
+
+	t.Run("Root Dot Path", func(t *testing.T) {
+		for _, name := range []string{"/.profile", ".ssh/authorized_keys"} {
+			_, _, err := synthetic.Apply(rootFS, []synthetic.Entry{
+				{Path: name, Content: "secret\n"},
+			})
+			require.ErrorIs(t, err, synthetic.ErrDotPath)
+		}
+
+		// Dot names further down the tree are kept as they are.
+		fsys, _, err := synthetic.Apply(rootFS, []synthetic.Entry{
+			{Path: "/root/.profile", Content: "export PS1='# '\n"},
+		})
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "root/.profile")
+		require.NoError(t, err)
+	})
+
+	t.Run("Invalid Mode", func(t *testing.T) {
+		_, _, err := synthetic.Apply(rootFS, []synthetic.Entry{
+			{Path: "/etc/hostname", Mode: "rw-r--r--"},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entries.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"path": "/etc/hostname", "type": "file", "mode": "0644", "content": "localhost\n"},
+		{"path": "/dev/null", "type": "char", "mode": "0666", "major": 1, "minor": 3}
+	]`), 0o644))
+
+	entries, err := synthetic.Load(path)
+	require.NoError(t, err)
+
+	require.Equal(t, []synthetic.Entry{
+		{Path: "/etc/hostname", Type: synthetic.TypeFile, Mode: "0644", Content: "localhost\n"},
+		{Path: "/dev/null", Type: synthetic.TypeChar, Mode: "0666", Major: 1, Minor: 3},
+	}, entries)
+}
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package sysext shapes a root filesystem into a systemd system extension
+// (sysext) or configuration extension (confext) image.
+package sysext
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/filter"
+	"github.com/immutos/oci2erofs/internal/synthetic"
+)
+
+const (
+	// Sysext extends /usr and /opt (see systemd-sysext(8)).
+	Sysext = "sysext"
+	// Confext extends /etc.
+	Confext = "confext"
+)
+
+// ErrInvalidRelease is returned if the image contains an extension-release
+// file that systemd would not accept.
+var ErrInvalidRelease = errors.New("invalid extension-release file")
+
+type profile struct {
+	// dirs are the top-level directories an extension may contain.
+	dirs []string
+	// releaseDir is the directory holding the extension-release file.
+	releaseDir string
+}
+
+var profiles = map[string]profile{
+	Sysext:  {dirs: []string{"usr", "opt"}, releaseDir: "usr/lib/extension-release.d"},
+	Confext: {dirs: []string{"etc"}, releaseDir: "etc/extension-release.d"},
+}
+
+// Check returns an error if the profile is unknown.
+func Check(name string) error {
+	if _, ok := profiles[name]; !ok {
+		return fmt.Errorf("unknown profile %q (expected %q or %q)", name, Sysext, Confext)
+	}
+
+	return nil
+}
+
+// Includes reports whether the extension profile keeps the path.
+func Includes(name, p string) bool {
+	top, _, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+	for _, dir := range profiles[name].dirs {
+		if top == dir {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReleasePath returns the path of the extension-release file that systemd
+// expects in the image of the named extension.
+func ReleasePath(name, extension string) string {
+	return path.Join(profiles[name].releaseDir, "extension-release."+extension)
+}
+
+// Apply restricts the root filesystem to the directories that the profile
+// allows, and makes sure it contains a valid extension-release file for the
+// extension (named after its image file, without the ".raw" suffix). If the
+// image has none, one matching any host (ID=_any) is added.
+func Apply(rootFS archivefs.ReadLinkFS, name, extension string) (fs.FS, error) {
+	if err := Check(name); err != nil {
+		return nil, err
+	}
+
+	if extension == "" || strings.ContainsAny(extension, "/") {
+		return nil, fmt.Errorf("invalid extension name %q", extension)
+	}
+
+	p := profiles[name]
+
+	include := make([]string, len(p.dirs))
+	for i, dir := range p.dirs {
+		include[i] = "/" + dir
+	}
+
+	filtered, err := filter.New(rootFS, &filter.Options{
+		Exclude: []string{"/*"},
+		Include: include,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	releasePath := ReleasePath(name, extension)
+
+	entries, err := fs.ReadDir(filtered, p.releaseDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", p.releaseDir, err)
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "extension-release.") {
+			continue
+		}
+
+		if entry.Name() != path.Base(releasePath) {
+			return nil, fmt.Errorf("%w: %s does not match the extension name %q (rename the output file)",
+				ErrInvalidRelease, path.Join(p.releaseDir, entry.Name()), extension)
+		}
+
+		data, err := fs.ReadFile(filtered, releasePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", releasePath, err)
+		}
+
+		if err := checkRelease(data); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidRelease, releasePath, err)
+		}
+
+		return filtered, nil
+	}
+
+	withRelease, _, err := synthetic.Apply(filtered, []synthetic.Entry{{
+		Path:    releasePath,
+		Type:    synthetic.TypeFile,
+		Mode:    "0644",
+		Content: "ID=_any\n",
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s: %w", releasePath, err)
+	}
+
+	return withRelease, nil
+}
+
+// checkRelease makes sure the extension-release file identifies the
+// operating systems the extension is compatible with.
+func checkRelease(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if ok && key == "ID" && strings.Trim(value, `"'`) != "" {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("missing ID")
+}
@@ -0,0 +1,146 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package sysext_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/immutos/oci2erofs/internal/sysext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	newFS := func(t *testing.T, files map[string]string) *tarfs.FS {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, content := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(content))}))
+			_, err := tw.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		return fsys
+	}
+
+	files := func(t *testing.T, fsys fs.FS) []string {
+		var paths []string
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !d.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		return paths
+	}
+
+	t.Run("Sysext", func(t *testing.T) {
+		src := newFS(t, map[string]string{
+			"etc/hostname":    "localhost\n",
+			"opt/tool/run":    "#!/bin/sh\n",
+			"usr/bin/tool":    "tool",
+			"var/lib/tool/db": "",
+		})
+
+		fsys, err := sysext.Apply(src, sysext.Sysext, "tool")
+		require.NoError(t, err)
+
+		require.ElementsMatch(t, []string{
+			"opt/tool/run",
+			"usr/bin/tool",
+			"usr/lib/extension-release.d/extension-release.tool",
+		}, files(t, fsys))
+
+		release, err := fs.ReadFile(fsys, sysext.ReleasePath(sysext.Sysext, "tool"))
+		require.NoError(t, err)
+		require.Equal(t, "ID=_any\n", string(release))
+	})
+
+	t.Run("Confext", func(t *testing.T) {
+		src := newFS(t, map[string]string{
+			"etc/tool.conf": "verbose=1\n",
+			"usr/bin/tool":  "tool",
+		})
+
+		fsys, err := sysext.Apply(src, sysext.Confext, "tool")
+		require.NoError(t, err)
+
+		require.ElementsMatch(t, []string{
+			"etc/extension-release.d/extension-release.tool",
+			"etc/tool.conf",
+		}, files(t, fsys))
+	})
+
+	t.Run("Existing Release", func(t *testing.T) {
+		src := newFS(t, map[string]string{
+			"usr/bin/tool": "tool",
+			"usr/lib/extension-release.d/extension-release.tool": "ID=debian\nVERSION_ID=12\n",
+		})
+
+		fsys, err := sysext.Apply(src, sysext.Sysext, "tool")
+		require.NoError(t, err)
+
+		release, err := fs.ReadFile(fsys, "usr/lib/extension-release.d/extension-release.tool")
+		require.NoError(t, err)
+		require.Equal(t, "ID=debian\nVERSION_ID=12\n", string(release))
+	})
+
+	t.Run("Mismatched Release", func(t *testing.T) {
+		src := newFS(t, map[string]string{
+			"usr/lib/extension-release.d/extension-release.other": "ID=_any\n",
+		})
+
+		_, err := sysext.Apply(src, sysext.Sysext, "tool")
+		require.ErrorIs(t, err, sysext.ErrInvalidRelease)
+	})
+
+	t.Run("Release Without ID", func(t *testing.T) {
+		src := newFS(t, map[string]string{
+			"usr/lib/extension-release.d/extension-release.tool": "VERSION_ID=12\n",
+		})
+
+		_, err := sysext.Apply(src, sysext.Sysext, "tool")
+		require.ErrorIs(t, err, sysext.ErrInvalidRelease)
+	})
+
+	t.Run("Unknown Profile", func(t *testing.T) {
+		_, err := sysext.Apply(newFS(t, nil), "portable", "tool")
+		require.Error(t, err)
+	})
+}
+
+func TestIncludes(t *testing.T) {
+	require.True(t, sysext.Includes(sysext.Sysext, "usr/bin/sh"))
+	require.True(t, sysext.Includes(sysext.Sysext, "/opt"))
+	require.False(t, sysext.Includes(sysext.Sysext, "etc/oci2erofs/config.json"))
+	require.True(t, sysext.Includes(sysext.Confext, "etc/oci2erofs/config.json"))
+	require.False(t, sysext.Includes(sysext.Confext, "usrx"))
+}
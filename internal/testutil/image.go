@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package testutil
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/builder"
+	"github.com/stretchr/testify/require"
+)
+
+// BuildImage builds an EROFS image holding the given files, each modified at
+// modTime, and returns it opened from a temporary file.
+func BuildImage(t testing.TB, files []File, modTime time.Time) *os.File {
+	files = append([]File(nil), files...)
+	for i := range files {
+		files[i].Header.ModTime = modTime
+	}
+
+	return BuildImageFS(t, CreateTarFS(t, files))
+}
+
+// BuildImageFS builds an EROFS image of the given file system, and returns it
+// opened from a temporary file.
+func BuildImageFS(t testing.TB, src fs.FS) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.erofs"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	_, err = builder.Build(context.Background(), f, src, nil)
+	require.NoError(t, err)
+
+	return f
+}
@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package testutil holds helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+// File is an entry of a tar archive, with the contents of a regular file.
+type File struct {
+	Header  tar.Header
+	Content string
+}
+
+// CreateTar returns an uncompressed tar archive containing the given files.
+// The size of each header is taken from its contents.
+func CreateTar(t testing.TB, files []File) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, f := range files {
+		hdr := f.Header
+		hdr.Size = int64(len(f.Content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		_, err := tw.Write([]byte(f.Content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// CreateTarFS returns a file system holding the given files, read from a tar
+// archive as layers are.
+func CreateTarFS(t testing.TB, files []File) *util.TarFS {
+	fsys, err := util.OpenTar(bytes.NewReader(CreateTar(t, files)))
+	require.NoError(t, err)
+
+	return fsys
+}
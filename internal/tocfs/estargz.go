@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package tocfs
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+)
+
+// See https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md
+
+const (
+	// TOCName is the name of the table of contents within its tar entry.
+	TOCName = "stargz.index.json"
+
+	// TOCDigestAnnotation is the layer descriptor annotation giving the
+	// digest of the (decompressed) table of contents of an eStargz layer.
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// footerSize is the size of the footer gzip member, which records the
+	// offset of the table of contents in its extra field.
+	footerSize = 51
+	// legacyFooterSize is the size of the footer written by the original
+	// stargz format.
+	legacyFooterSize = 47
+)
+
+// ErrNotEstargz is returned when a blob has no eStargz footer.
+var ErrNotEstargz = errors.New("not an eStargz layer")
+
+// DetectEstargz reports whether the blob ends with an eStargz footer.
+func DetectEstargz(ra io.ReaderAt, size int64) bool {
+	_, _, err := tocOffset(ra, size)
+	return err == nil
+}
+
+// tocFile is the table of contents, as stored in the layer.
+type tocFile struct {
+	TOC
+	hdr  *tar.Header
+	data []byte
+	// offset is the offset of the gzip member holding it.
+	offset int64
+}
+
+// readTOC reads the table of contents of the blob.
+func readTOC(ra io.ReaderAt, size int64) (*tocFile, error) {
+	offset, end, err := tocOffset(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(io.NewSectionReader(ra, offset, end-offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table of contents: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table of contents: %w", err)
+	}
+
+	if hdr.Name != TOCName {
+		return nil, fmt.Errorf("unexpected table of contents entry %q", hdr.Name)
+	}
+
+	if hdr.Size > maxTOCSize {
+		return nil, fmt.Errorf("table of contents is %d bytes, more than the maximum of %d bytes", hdr.Size, maxTOCSize)
+	}
+
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table of contents: %w", err)
+	}
+
+	toc := &tocFile{hdr: hdr, data: data, offset: offset}
+	if err := json.Unmarshal(data, &toc.TOC); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal table of contents: %w", err)
+	}
+
+	return toc, nil
+}
+
+// tocOffset returns the offset of the table of contents, and of the footer
+// that follows it.
+func tocOffset(ra io.ReaderAt, size int64) (int64, int64, error) {
+	for _, n := range []int64{footerSize, legacyFooterSize} {
+		if size < n {
+			continue
+		}
+
+		buf := make([]byte, n)
+		if _, err := ra.ReadAt(buf, size-n); err != nil {
+			return 0, 0, err
+		}
+
+		if offset, ok := parseFooter(buf); ok && offset < size-n {
+			return offset, size - n, nil
+		}
+	}
+
+	return 0, 0, ErrNotEstargz
+}
+
+// parseFooter parses the offset of the table of contents from the extra
+// field of the footer gzip header: "%016xSTARGZ", in a subfield named "SG"
+// (or on its own in the legacy format).
+func parseFooter(buf []byte) (int64, bool) {
+	const flagExtra = 1 << 2
+	if len(buf) < 12 || buf[0] != 0x1f || buf[1] != 0x8b || buf[2] != 8 || buf[3]&flagExtra == 0 {
+		return 0, false
+	}
+
+	extra := buf[12:]
+	xlen := int(binary.LittleEndian.Uint16(buf[10:12]))
+	if xlen > len(extra) {
+		return 0, false
+	}
+	extra = extra[:xlen]
+
+	switch {
+	case xlen == 26 && string(extra[:2]) == "SG" && binary.LittleEndian.Uint16(extra[2:4]) == 22:
+		extra = extra[4:]
+	case xlen != 22:
+		return 0, false
+	}
+
+	if string(extra[16:]) != "STARGZ" {
+		return 0, false
+	}
+
+	offset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+
+	return offset, true
+}
+
+// OpenEstargz returns the file system of the eStargz blob (see newFS for the
+// check function).
+//
+// The table of contents is itself an entry of the layer tarball (TOCName),
+// so it is included too, as it would be if the layer were decompressed.
+func OpenEstargz(ra io.ReaderAt, size int64, check func(hdr *tar.Header) (bool, error)) (*FS, error) {
+	toc, err := readTOC(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, err := newFS(ra, compressionGzip, toc.offset, toc.Entries, check, &node{hdr: *toc.hdr, data: toc.data})
+	if err != nil {
+		return nil, err
+	}
+
+	fsys.tocDigest = digest.FromBytes(toc.data)
+	return fsys, nil
+}
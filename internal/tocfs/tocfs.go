@@ -0,0 +1,824 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package tocfs reads layers with a table of contents (eStargz and
+// zstd:chunked) without decompressing them up front. The table of contents
+// describes every entry, and the contents of a file are decompressed from
+// its own gzip members or zstd frames when it is read.
+package tocfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// maxTOCSize is the maximum size of the table of contents.
+	maxTOCSize = 256 << 20
+
+	// maxSymlinks is the maximum number of symbolic links followed when
+	// resolving a path.
+	maxSymlinks = 40
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
+)
+
+// TOC is the table of contents of a layer. zstd:chunked layers use the same
+// format as eStargz, with a few additions.
+type TOC struct {
+	Version int        `json:"version"`
+	Entries []TOCEntry `json:"entries"`
+}
+
+// TOCEntry describes an entry of the layer, or an additional chunk of the
+// contents of the preceding regular file.
+type TOCEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime3339 string `json:"modtime,omitempty"`
+	LinkName    string `json:"linkName,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	UID         int    `json:"uid"`
+	GID         int    `json:"gid"`
+	Uname       string `json:"userName,omitempty"`
+	Gname       string `json:"groupName,omitempty"`
+	DevMajor    int    `json:"devMajor,omitempty"`
+	DevMinor    int    `json:"devMinor,omitempty"`
+	// Offset is the offset of the gzip member or zstd frame holding the
+	// file contents (or this chunk of them).
+	Offset int64 `json:"offset,omitempty"`
+	// EndOffset is the offset of the end of the compressed contents
+	// (zstd:chunked only).
+	EndOffset int64 `json:"endOffset,omitempty"`
+	// InnerOffset is the offset of the contents within the decompressed
+	// gzip member (eStargz only).
+	InnerOffset int64 `json:"innerOffset,omitempty"`
+	// ChunkOffset is the offset of this chunk within the file.
+	ChunkOffset int64 `json:"chunkOffset,omitempty"`
+	// ChunkSize is the size of this chunk, or zero if it runs to the end of
+	// the file.
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// ChunkType is "zeros" for a chunk of zeros with no stored contents
+	// (zstd:chunked only).
+	ChunkType string `json:"chunkType,omitempty"`
+	// Digest is the digest of the whole contents of a regular file.
+	Digest string `json:"digest,omitempty"`
+	// ChunkDigest is the digest of the decompressed contents of this chunk.
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+	// Xattrs are the extended attributes of the entry.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// compression is the compression of the contents of files.
+type compression int
+
+const (
+	compressionGzip compression = iota
+	compressionZstd
+)
+
+// FS is the file system of a layer with a table of contents.
+type FS struct {
+	ra          io.ReaderAt
+	compression compression
+	// end is the offset of the table of contents, which follows the
+	// contents of all files.
+	end  int64
+	root *node
+	// tocDigest is the digest of the table of contents, as recorded in the
+	// layer descriptor annotations.
+	tocDigest digest.Digest
+	// verify is set once the contents of files are checked against the
+	// chunk digests as they are read.
+	verify bool
+}
+
+// newFS builds the file system described by the entries of the table of
+// contents. The check function, if given, is called with the header of every
+// entry in the order they appear in the layer; entries for which it returns
+// false are left out. The extra nodes (whose contents are held in memory)
+// follow the entries.
+func newFS(ra io.ReaderAt, c compression, end int64, entries []TOCEntry, check func(hdr *tar.Header) (bool, error), extra ...*node) (*FS, error) {
+	fsys := &FS{
+		ra:          ra,
+		compression: c,
+		end:         end,
+		root: &node{hdr: tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     ".",
+			Mode:     0o755,
+		}},
+	}
+
+	type hardlink struct {
+		name, target string
+	}
+
+	// User and group names are omitted when they are the same as for the
+	// previous entry with the same ID.
+	unames, gnames := make(map[int]string), make(map[int]string)
+
+	var hardlinks []hardlink
+	var last *node
+	var lastName string
+	for _, e := range entries {
+		if e.Type == "chunk" {
+			if e.Name != lastName {
+				return nil, fmt.Errorf("chunk of %q does not follow its file", e.Name)
+			}
+
+			// Chunks of a file that was left out.
+			if last == nil {
+				continue
+			}
+
+			if err := last.addChunk(&e, end); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+		last, lastName = nil, e.Name
+
+		if e.Uname == "" {
+			e.Uname = unames[e.UID]
+		}
+		unames[e.UID] = e.Uname
+
+		if e.Gname == "" {
+			e.Gname = gnames[e.GID]
+		}
+		gnames[e.GID] = e.Gname
+
+		hdr, err := e.header()
+		if err != nil {
+			return nil, err
+		}
+
+		// Checked before the name is cleaned, so that eg. absolute paths
+		// are caught.
+		if check != nil {
+			keep, err := check(hdr)
+			if err != nil {
+				return nil, err
+			}
+
+			if !keep {
+				continue
+			}
+		}
+
+		hdr.Name = cleanName(hdr.Name)
+		if hdr.Name == "." {
+			// The root directory keeps its default metadata, as it does for
+			// other layers.
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			hardlinks = append(hardlinks, hardlink{name: hdr.Name, target: cleanName(hdr.Linkname)})
+			continue
+		}
+
+		n := &node{hdr: *hdr}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if err := n.addChunk(&e, end); err != nil {
+				return nil, err
+			}
+			last = n
+		}
+
+		fsys.insert(n)
+	}
+
+	for _, n := range extra {
+		if check != nil {
+			keep, err := check(&n.hdr)
+			if err != nil {
+				return nil, err
+			}
+
+			if !keep {
+				continue
+			}
+		}
+
+		n.hdr.Name = cleanName(n.hdr.Name)
+		fsys.insert(n)
+	}
+
+	for _, link := range hardlinks {
+		target, err := fsys.lookup(link.target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve hard link %q: %w", link.target, err)
+		}
+
+		if target.link == nil {
+			target.link = target
+		}
+
+		n := &node{hdr: target.hdr, chunks: target.chunks, data: target.data, link: target.link}
+		n.hdr.Name = link.name
+		fsys.insert(n)
+	}
+
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		if n.hdr.Typeflag == tar.TypeReg && n.data == nil && n.size() != n.hdr.Size {
+			return fmt.Errorf("chunks of %q cover %d of %d bytes", n.hdr.Name, n.size(), n.hdr.Size)
+		}
+
+		for _, child := range n.children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(fsys.root); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// TOCDigest returns the digest of the table of contents, for comparison with
+// the digest recorded in the layer descriptor (see TOCDigestAnnotation and
+// ManifestChecksumAnnotation).
+func (fsys *FS) TOCDigest() digest.Digest {
+	return fsys.tocDigest
+}
+
+// VerifyContents checks the contents of files against the chunk digests
+// listed in the table of contents as they are read, so that the blob does
+// not have to be verified as a whole. This is only meaningful once the table
+// of contents itself has been verified (see TOCDigest). It returns an error
+// if a chunk has no digest.
+func (fsys *FS) VerifyContents() error {
+	var walk func(n *node) error
+	walk = func(n *node) error {
+		for _, c := range n.chunks {
+			if c.zeros {
+				continue
+			}
+
+			if err := c.digest.Validate(); err != nil {
+				return fmt.Errorf("invalid chunk digest of %q: %w", n.hdr.Name, err)
+			}
+		}
+
+		for _, child := range n.children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(fsys.root); err != nil {
+		return err
+	}
+
+	fsys.verify = true
+	return nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	n, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{n: n, fsys: fsys, name: name}, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return n.readDir(), nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the requested name, as a symbolic link may have been followed.
+	hdr := n.hdr
+	hdr.Name = name
+	return hdr.FileInfo(), nil
+}
+
+func (fsys *FS) ReadLink(name string) (string, error) {
+	n, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if n.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return n.hdr.Linkname, nil
+}
+
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	n, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.info(), nil
+}
+
+// HardLinkID returns a value identifying the named file that is shared by all
+// of the hard links to it, or nil if it has no other links.
+func (fsys *FS) HardLinkID(name string) (any, error) {
+	n, err := fsys.resolve("hardlinkid", name, false)
+	if err != nil || n.link == nil {
+		return nil, err
+	}
+
+	return n.link, nil
+}
+
+// insert adds the node to the tree, creating default parent directories as
+// needed. An existing directory keeps its children.
+func (fsys *FS) insert(n *node) {
+	parent := fsys.root
+	dir := path.Dir(n.hdr.Name)
+	if dir != "." {
+		var prefix string
+		for _, component := range strings.Split(dir, "/") {
+			prefix = path.Join(prefix, component)
+
+			child, ok := parent.children[component]
+			if !ok || child.hdr.Typeflag != tar.TypeDir {
+				child = &node{hdr: tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     prefix,
+					Mode:     0o755,
+				}}
+				parent.addChild(child)
+			}
+			parent = child
+		}
+	}
+
+	if existing, ok := parent.children[path.Base(n.hdr.Name)]; ok && existing.hdr.Typeflag == tar.TypeDir && n.hdr.Typeflag == tar.TypeDir {
+		n.children = existing.children
+	}
+	parent.addChild(n)
+}
+
+// lookup returns the node with the given (clean) name, without following
+// symbolic links.
+func (fsys *FS) lookup(name string) (*node, error) {
+	n := fsys.root
+	if name == "." {
+		return n, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		child, ok := n.children[component]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		n = child
+	}
+
+	return n, nil
+}
+
+// resolve returns the node with the given name, following symbolic links in
+// its parent directories (and the node itself, if follow is set).
+func (fsys *FS) resolve(op, name string, follow bool) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	links := 0
+	n, err := fsys.walk(fsys.root, name, follow, &links)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return n, nil
+}
+
+func (fsys *FS) walk(dir *node, name string, follow bool, links *int) (*node, error) {
+	n := dir
+	if name == "." || name == "" {
+		return n, nil
+	}
+
+	components := strings.Split(name, "/")
+	for i, component := range components {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if n.parent != nil {
+				n = n.parent
+			}
+			continue
+		}
+
+		if n.hdr.Typeflag != tar.TypeDir {
+			return nil, fs.ErrNotExist
+		}
+
+		child, ok := n.children[component]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		if child.hdr.Typeflag == tar.TypeSymlink && (follow || i < len(components)-1) {
+			if *links++; *links > maxSymlinks {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+
+			start := n
+			if path.IsAbs(child.hdr.Linkname) {
+				start = fsys.root
+			}
+
+			var err error
+			child, err = fsys.walk(start, strings.TrimPrefix(child.hdr.Linkname, "/"), true, links)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		n = child
+	}
+
+	return n, nil
+}
+
+// cleanName returns the path of the entry relative to the root.
+func cleanName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+// header converts the entry to a tar header.
+func (e *TOCEntry) header() (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Size:     e.Size,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+		Format:   tar.FormatPAX,
+	}
+
+	switch e.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+	case "reg":
+		hdr.Typeflag = tar.TypeReg
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		hdr.Typeflag = tar.TypeLink
+	case "char":
+		hdr.Typeflag = tar.TypeChar
+	case "block":
+		hdr.Typeflag = tar.TypeBlock
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("unsupported entry type %q of %q", e.Type, e.Name)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		hdr.Size = 0
+	}
+
+	for name, value := range e.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+
+	if e.ModTime3339 != "" {
+		modTime, err := time.Parse(time.RFC3339, e.ModTime3339)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time of %q: %w", e.Name, err)
+		}
+		hdr.ModTime = modTime
+	}
+
+	return hdr, nil
+}
+
+type node struct {
+	hdr    tar.Header
+	chunks []chunk
+	// data holds the contents of a file that is not read from chunks (eg.
+	// the table of contents of an eStargz layer).
+	data []byte
+	// link, if set, is the node of the file that this one is a hard link
+	// to (or this node, if it is the target of hard links).
+	link     *node
+	parent   *node
+	children map[string]*node
+}
+
+// chunk is a piece of the contents of a file.
+type chunk struct {
+	// offset and endOffset delimit the compressed chunk in the blob.
+	offset, endOffset int64
+	// innerOffset is the offset of the chunk in the decompressed data.
+	innerOffset int64
+	size        int64
+	// zeros is set for a chunk of zeros, which has no compressed data.
+	zeros bool
+	// digest is the digest of the decompressed chunk.
+	digest digest.Digest
+}
+
+func (n *node) addChunk(e *TOCEntry, end int64) error {
+	if e.ChunkOffset != n.size() {
+		return fmt.Errorf("chunk of %q at offset %d does not follow the previous chunk", n.hdr.Name, e.ChunkOffset)
+	}
+
+	size := e.ChunkSize
+	if size == 0 {
+		size = n.hdr.Size - e.ChunkOffset
+	}
+
+	if size <= 0 || size > n.hdr.Size-e.ChunkOffset {
+		return fmt.Errorf("invalid chunk of %q at offset %d", n.hdr.Name, e.ChunkOffset)
+	}
+
+	if e.ChunkType == "zeros" {
+		n.chunks = append(n.chunks, chunk{size: size, zeros: true})
+		return nil
+	}
+
+	endOffset := e.EndOffset
+	if endOffset == 0 {
+		endOffset = end
+	}
+
+	if e.Offset <= 0 || e.Offset >= endOffset || endOffset > end || e.InnerOffset < 0 {
+		return fmt.Errorf("invalid chunk of %q at offset %d", n.hdr.Name, e.ChunkOffset)
+	}
+
+	// Files stored in a single chunk may only list the digest of the file.
+	dgst := digest.Digest(e.ChunkDigest)
+	if dgst == "" && e.ChunkOffset == 0 && size == n.hdr.Size {
+		dgst = digest.Digest(e.Digest)
+	}
+
+	n.chunks = append(n.chunks, chunk{offset: e.Offset, endOffset: endOffset, innerOffset: e.InnerOffset, size: size, digest: dgst})
+	return nil
+}
+
+// size returns the total size of the chunks.
+func (n *node) size() int64 {
+	var size int64
+	for _, c := range n.chunks {
+		size += c.size
+	}
+	return size
+}
+
+func (n *node) addChild(child *node) {
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+
+	child.parent = n
+	for _, grandchild := range child.children {
+		grandchild.parent = child
+	}
+	n.children[path.Base(child.hdr.Name)] = child
+}
+
+func (n *node) info() fs.FileInfo {
+	return n.hdr.FileInfo()
+}
+
+func (n *node) readDir() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, child := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info()))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries
+}
+
+// file is an open entry. The contents of a regular file are decompressed
+// chunk by chunk as it is read.
+type file struct {
+	n    *node
+	fsys *FS
+	name string
+
+	next     int
+	zr       *gzip.Reader
+	zstdr    *zstd.Decoder
+	r        io.Reader
+	remain   int64
+	verifier digest.Verifier
+	listed   bool
+	entries  []fs.DirEntry
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.n.info(), nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.n.hdr.Typeflag == tar.TypeDir {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+
+	if f.n.data != nil {
+		if f.r == nil {
+			f.r = bytes.NewReader(f.n.data)
+		}
+		return f.r.Read(p)
+	}
+
+	for f.remain == 0 {
+		if f.next == len(f.n.chunks) {
+			return 0, io.EOF
+		}
+
+		if err := f.openChunk(f.n.chunks[f.next]); err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.next++
+	}
+
+	if int64(len(p)) > f.remain {
+		p = p[:f.remain]
+	}
+
+	n, err := f.r.Read(p)
+	f.remain -= int64(n)
+	if errors.Is(err, io.EOF) {
+		if f.remain > 0 {
+			return n, &fs.PathError{Op: "read", Path: f.name, Err: io.ErrUnexpectedEOF}
+		}
+		err = nil
+	}
+
+	if f.remain == 0 && f.verifier != nil {
+		if !f.verifier.Verified() {
+			return n, &fs.PathError{Op: "read", Path: f.name, Err: fmt.Errorf("chunk %d %w", f.next-1, util.ErrDigestMismatch)}
+		}
+		f.verifier = nil
+	}
+
+	return n, err
+}
+
+func (f *file) openChunk(c chunk) error {
+	if c.zeros {
+		f.r, f.remain = zeroReader{}, c.size
+		return nil
+	}
+
+	sr := io.NewSectionReader(f.fsys.ra, c.offset, c.endOffset-c.offset)
+
+	var r io.Reader
+	var err error
+	switch f.fsys.compression {
+	case compressionZstd:
+		if f.zstdr == nil {
+			f.zstdr, err = zstd.NewReader(sr, zstd.WithDecoderConcurrency(1))
+		} else {
+			err = f.zstdr.Reset(sr)
+		}
+		r = f.zstdr
+	default:
+		if f.zr == nil {
+			f.zr, err = gzip.NewReader(sr)
+		} else {
+			err = f.zr.Reset(sr)
+		}
+		r = f.zr
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(io.Discard, r, c.innerOffset); err != nil {
+		return err
+	}
+
+	f.r, f.remain = r, c.size
+	if f.fsys.verify {
+		f.verifier = c.digest.Verifier()
+		f.r = io.TeeReader(r, f.verifier)
+	}
+
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (f *file) ReadDir(count int) ([]fs.DirEntry, error) {
+	if f.n.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+
+	if !f.listed {
+		f.entries, f.listed = f.n.readDir(), true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(f.entries))
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *file) Close() error {
+	if f.zstdr != nil {
+		f.zstdr.Close()
+	}
+
+	if f.zr != nil {
+		return f.zr.Close()
+	}
+	return nil
+}
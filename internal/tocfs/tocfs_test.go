@@ -0,0 +1,503 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package tocfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/tocfs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+
+	blob := buildEstargz(t, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o700, Uid: 1000, Gid: 100, ModTime: modTime}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, ModTime: modTime}, content: []byte("localhost\n")},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o644}, content: large},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/empty", Mode: 0o600}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib", Mode: 0o777}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "usr/lib/large.link", Linkname: "usr/lib/large"}},
+	}, 4096)
+
+	fsys, err := tocfs.OpenEstargz(bytes.NewReader(blob), int64(len(blob)), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "usr/lib/large", "usr/lib/empty", "usr/lib/large.link", tocfs.TOCName))
+
+	t.Run("Contents", func(t *testing.T) {
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "localhost\n", string(hostname))
+
+		for _, name := range []string{"usr/lib/large", "usr/lib/large.link", "lib/large"} {
+			data, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, name)
+			require.Equal(t, large, data, name)
+		}
+
+		empty, err := fs.ReadFile(fsys, "usr/lib/empty")
+		require.NoError(t, err)
+		require.Empty(t, empty)
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		fi, err := fsys.StatLink("etc")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+		require.Equal(t, fs.FileMode(0o700), fi.Mode().Perm())
+		require.True(t, modTime.Equal(fi.ModTime()))
+
+		hdr := fi.Sys().(*tar.Header)
+		require.Equal(t, 1000, hdr.Uid)
+		require.Equal(t, 100, hdr.Gid)
+
+		// Parent directories not in the layer are given default metadata.
+		fi, err = fsys.StatLink("usr")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o755, fi.Mode())
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		target, err := fsys.ReadLink("lib")
+		require.NoError(t, err)
+		require.Equal(t, "usr/lib", target)
+
+		fi, err := fsys.StatLink("lib")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		fi, err = fsys.Stat("lib")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+	})
+
+	t.Run("Matches Decompressed Layer", func(t *testing.T) {
+		zr, err := gzip.NewReader(bytes.NewReader(blob))
+		require.NoError(t, err)
+
+		tr := tar.NewReader(zr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			expected, err := io.ReadAll(tr)
+			require.NoError(t, err)
+
+			actual, err := fs.ReadFile(fsys, hdr.Name)
+			require.NoError(t, err, hdr.Name)
+			require.Equal(t, expected, actual, hdr.Name)
+		}
+	})
+}
+
+func TestOpenCheck(t *testing.T) {
+	blob := buildEstargz(t, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "dev/null.txt", Mode: 0o644, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.comment": "hello",
+		}}, content: []byte("x")},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "dev/fifo", Mode: 0o644}},
+	}, 4096)
+
+	var names []string
+	var xattrs []map[string]string
+	fsys, err := tocfs.OpenEstargz(bytes.NewReader(blob), int64(len(blob)), func(hdr *tar.Header) (bool, error) {
+		names = append(names, hdr.Name)
+		xattrs = append(xattrs, hdr.PAXRecords)
+		return hdr.Typeflag != tar.TypeFifo, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"dev/null.txt", "dev/fifo", tocfs.TOCName}, names)
+	require.Equal(t, map[string]string{"SCHILY.xattr.user.comment": "hello"}, xattrs[0])
+	require.Nil(t, xattrs[1])
+
+	_, err = fsys.StatLink("dev/fifo")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = tocfs.OpenEstargz(bytes.NewReader(blob), int64(len(blob)), func(hdr *tar.Header) (bool, error) {
+		return false, fmt.Errorf("rejected %s", hdr.Name)
+	})
+	require.EqualError(t, err, "rejected dev/null.txt")
+}
+
+func TestOpenZstdChunked(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+
+	blob, position := buildZstdChunked(t, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, ModTime: modTime}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, ModTime: modTime}, content: []byte("localhost\n")},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o644}, content: large},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/sparse", Mode: 0o644}, content: append(make([]byte, 8192), "tail"...)},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib", Mode: 0o777}},
+	}, 4096)
+
+	fsys, err := tocfs.OpenZstdChunked(bytes.NewReader(blob), int64(len(blob)), position, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "usr/lib/large", "usr/lib/sparse"))
+
+	fi, err := fsys.StatLink("etc/hostname")
+	require.NoError(t, err)
+	require.True(t, modTime.Equal(fi.ModTime()))
+
+	// Unlike eStargz, the manifest is not part of the layer tarball.
+	_, err = fsys.StatLink(tocfs.TOCName)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// The same contents as when the layer is fully decompressed.
+	zr, err := zstd.NewReader(bytes.NewReader(blob))
+	require.NoError(t, err)
+	defer zr.Close()
+
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		expected, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		actual, err := fs.ReadFile(fsys, hdr.Name)
+		require.NoError(t, err, hdr.Name)
+		require.Equal(t, expected, actual, hdr.Name)
+	}
+	require.Equal(t, []string{"etc/", "etc/hostname", "usr/lib/large", "usr/lib/sparse", "lib"}, names)
+
+	t.Run("Invalid Position", func(t *testing.T) {
+		for _, position := range []string{"", "1:2:3", "1:2:3:2", "-1:2:3:1", fmt.Sprintf("%d:100:100:1", len(blob))} {
+			_, err := tocfs.OpenZstdChunked(bytes.NewReader(blob), int64(len(blob)), position, nil)
+			require.Error(t, err, position)
+		}
+	})
+}
+
+func TestVerifyContents(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+
+	blob := buildEstargz(t, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, content: []byte("localhost\n")},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o644}, content: large},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/tampered", Mode: 0o644}, content: large, chunkDigest: digest.FromString("tampered")},
+	}, 4096)
+
+	fsys, err := tocfs.OpenEstargz(bytes.NewReader(blob), int64(len(blob)), nil)
+	require.NoError(t, err)
+
+	toc, err := fs.ReadFile(fsys, tocfs.TOCName)
+	require.NoError(t, err)
+	require.Equal(t, digest.FromBytes(toc), fsys.TOCDigest())
+
+	// Not checked until asked for.
+	_, err = fs.ReadFile(fsys, "usr/lib/tampered")
+	require.NoError(t, err)
+
+	require.NoError(t, fsys.VerifyContents())
+
+	for _, name := range []string{"etc/hostname", "usr/lib/large"} {
+		_, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err, name)
+	}
+
+	_, err = fs.ReadFile(fsys, "usr/lib/tampered")
+	require.ErrorIs(t, err, util.ErrDigestMismatch)
+
+	t.Run("Zstd Chunked", func(t *testing.T) {
+		blob, position := buildZstdChunked(t, []testEntry{
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, content: []byte("localhost\n")},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o644}, content: large},
+			{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/sparse", Mode: 0o644}, content: append(make([]byte, 8192), "tail"...)},
+		}, 4096)
+
+		fsys, err := tocfs.OpenZstdChunked(bytes.NewReader(blob), int64(len(blob)), position, nil)
+		require.NoError(t, err)
+		require.NoError(t, fsys.VerifyContents())
+
+		for _, name := range []string{"etc/hostname", "usr/lib/large", "usr/lib/sparse"} {
+			_, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err, name)
+		}
+	})
+}
+
+func TestDetect(t *testing.T) {
+	blob := buildEstargz(t, []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "hello", Mode: 0o644}, content: []byte("hello\n")},
+	}, 4096)
+	require.True(t, tocfs.DetectEstargz(bytes.NewReader(blob), int64(len(blob))))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	require.False(t, tocfs.DetectEstargz(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+
+	_, err := tocfs.OpenEstargz(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	require.ErrorIs(t, err, tocfs.ErrNotEstargz)
+}
+
+type testEntry struct {
+	hdr     tar.Header
+	content []byte
+	// chunkDigest, if set, is recorded for every chunk instead of the
+	// digest of its contents.
+	chunkDigest digest.Digest
+}
+
+// buildEstargz writes an eStargz blob, splitting file contents into chunks
+// of the given size, each in its own gzip member.
+func buildEstargz(t *testing.T, entries []testEntry, chunkSize int) []byte {
+	t.Helper()
+
+	var mw memberWriter
+	tw := tar.NewWriter(&mw)
+
+	var toc tocfs.TOC
+	toc.Version = 1
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		types := map[byte]string{
+			tar.TypeDir: "dir", tar.TypeReg: "reg", tar.TypeSymlink: "symlink",
+			tar.TypeLink: "hardlink", tar.TypeFifo: "fifo",
+		}
+
+		entry := tocfs.TOCEntry{
+			Name:     hdr.Name,
+			Type:     types[hdr.Typeflag],
+			Size:     hdr.Size,
+			LinkName: hdr.Linkname,
+			Mode:     hdr.Mode,
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+		}
+		if !hdr.ModTime.IsZero() {
+			entry.ModTime3339 = hdr.ModTime.Format(time.RFC3339)
+		}
+		for key, value := range hdr.PAXRecords {
+			if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				if entry.Xattrs == nil {
+					entry.Xattrs = make(map[string][]byte)
+				}
+				entry.Xattrs[name] = []byte(value)
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg && len(e.content) > 0 {
+			entry.Digest = digest.FromBytes(e.content).String()
+		}
+
+		for off := 0; off < len(e.content); off += chunkSize {
+			end := min(off+chunkSize, len(e.content))
+
+			if off > 0 {
+				entry = tocfs.TOCEntry{Name: hdr.Name, Type: "chunk"}
+			}
+			entry.Offset = mw.cut(t)
+			entry.ChunkOffset = int64(off)
+			if len(e.content) > chunkSize {
+				entry.ChunkSize = int64(end - off)
+			}
+			entry.ChunkDigest = digest.FromBytes(e.content[off:end]).String()
+			if e.chunkDigest != "" {
+				entry.ChunkDigest = e.chunkDigest.String()
+			}
+
+			_, err := tw.Write(e.content[off:end])
+			require.NoError(t, err)
+
+			toc.Entries = append(toc.Entries, entry)
+		}
+
+		if len(e.content) == 0 {
+			toc.Entries = append(toc.Entries, entry)
+		}
+	}
+
+	tocData, err := json.Marshal(&toc)
+	require.NoError(t, err)
+
+	tocOffset := mw.cut(t)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: tocfs.TOCName, Mode: 0o644, Size: int64(len(tocData))}))
+	_, err = tw.Write(tocData)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	mw.cut(t)
+
+	// The footer is an empty gzip member with the offset of the table of
+	// contents in its extra field, followed by an empty stored block.
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	footer = binary.LittleEndian.AppendUint32(footer, 0) // CRC-32
+	footer = binary.LittleEndian.AppendUint32(footer, 0) // Size
+	require.Len(t, footer, 51)
+
+	mw.buf.Write(footer)
+
+	return mw.buf.Bytes()
+}
+
+// buildZstdChunked writes a zstd:chunked blob, splitting file contents into
+// chunks of the given size, each in its own zstd frame (all-zero chunks are
+// stored as "zeros" chunks without a frame). It returns the blob and the
+// position of its manifest.
+func buildZstdChunked(t *testing.T, entries []testEntry, chunkSize int) ([]byte, string) {
+	t.Helper()
+
+	mw := memberWriter{zstd: true}
+	tw := tar.NewWriter(&mw)
+
+	var toc tocfs.TOC
+	toc.Version = 1
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		types := map[byte]string{tar.TypeDir: "dir", tar.TypeReg: "reg", tar.TypeSymlink: "symlink"}
+
+		entry := tocfs.TOCEntry{
+			Name:     hdr.Name,
+			Type:     types[hdr.Typeflag],
+			Size:     hdr.Size,
+			LinkName: hdr.Linkname,
+			Mode:     hdr.Mode,
+		}
+		if !hdr.ModTime.IsZero() {
+			entry.ModTime3339 = hdr.ModTime.Format(time.RFC3339Nano)
+		}
+
+		for off := 0; off < len(e.content); off += chunkSize {
+			end := min(off+chunkSize, len(e.content))
+			data := e.content[off:end]
+
+			if off > 0 {
+				entry = tocfs.TOCEntry{Name: hdr.Name, Type: "chunk"}
+			}
+			entry.ChunkOffset = int64(off)
+			entry.ChunkSize = int64(len(data))
+			entry.ChunkDigest = digest.FromBytes(data).String()
+
+			if bytes.Count(data, []byte{0}) == len(data) {
+				entry.ChunkType = "zeros"
+			} else {
+				entry.Offset = mw.cut(t)
+			}
+
+			_, err := tw.Write(data)
+			require.NoError(t, err)
+
+			if entry.ChunkType != "zeros" {
+				entry.EndOffset = mw.cut(t)
+			}
+
+			toc.Entries = append(toc.Entries, entry)
+		}
+
+		if len(e.content) == 0 {
+			toc.Entries = append(toc.Entries, entry)
+		}
+	}
+	require.NoError(t, tw.Close())
+	mw.cut(t)
+
+	tocData, err := json.Marshal(&toc)
+	require.NoError(t, err)
+
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	manifest := enc.EncodeAll(tocData, nil)
+
+	// The manifest is stored in a skippable frame.
+	frame := binary.LittleEndian.AppendUint32(nil, 0x184D2A50)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(manifest)))
+	offset := mw.buf.Len() + len(frame)
+	mw.buf.Write(append(frame, manifest...))
+
+	return mw.buf.Bytes(), fmt.Sprintf("%d:%d:%d:1", offset, len(manifest), len(tocData))
+}
+
+// memberWriter writes a stream of gzip members (or zstd frames).
+type memberWriter struct {
+	buf  bytes.Buffer
+	zstd bool
+	zw   io.WriteCloser
+}
+
+func (mw *memberWriter) Write(p []byte) (int, error) {
+	if mw.zw == nil {
+		if mw.zstd {
+			zw, err := zstd.NewWriter(&mw.buf)
+			if err != nil {
+				return 0, err
+			}
+			mw.zw = zw
+		} else {
+			mw.zw = gzip.NewWriter(&mw.buf)
+		}
+	}
+
+	return mw.zw.Write(p)
+}
+
+// cut ends the current member, returning the offset of the next one.
+func (mw *memberWriter) cut(t *testing.T) int64 {
+	if mw.zw != nil {
+		require.NoError(t, mw.zw.Close())
+		mw.zw = nil
+	}
+
+	return int64(mw.buf.Len())
+}
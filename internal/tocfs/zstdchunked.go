@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package tocfs
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// ManifestPositionAnnotation is the layer descriptor annotation giving the
+// position of the table of contents (the "manifest") of a zstd:chunked
+// layer, as "offset:compressedLength:uncompressedLength:type".
+const ManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+
+// ManifestChecksumAnnotation is the layer descriptor annotation giving the
+// digest of the (compressed) manifest of a zstd:chunked layer.
+const ManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+
+// manifestTypeTOC is the type of a manifest in the eStargz TOC format.
+const manifestTypeTOC = 1
+
+// OpenZstdChunked returns the file system of the zstd:chunked blob, whose
+// table of contents is at the given position (the value of the
+// ManifestPositionAnnotation). See newFS for the check function.
+func OpenZstdChunked(ra io.ReaderAt, size int64, position string, check func(hdr *tar.Header) (bool, error)) (*FS, error) {
+	offset, compressedLength, uncompressedLength, err := parseManifestPosition(position)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+compressedLength > size {
+		return nil, fmt.Errorf("manifest at %d (%d bytes) is beyond the end of the layer", offset, compressedLength)
+	}
+
+	if uncompressedLength > maxTOCSize {
+		return nil, fmt.Errorf("manifest is %d bytes, more than the maximum of %d bytes", uncompressedLength, maxTOCSize)
+	}
+
+	compressed := make([]byte, compressedLength)
+	if _, err := ra.ReadAt(compressed, offset); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(uncompressedLength)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	data, err := dec.DecodeAll(compressed, make([]byte, 0, uncompressedLength))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress manifest: %w", err)
+	}
+
+	var toc TOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	// The manifest follows the contents of all files.
+	fsys, err := newFS(ra, compressionZstd, offset, toc.Entries, check)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys.tocDigest = digest.FromBytes(compressed)
+	return fsys, nil
+}
+
+// parseManifestPosition parses the value of the ManifestPositionAnnotation.
+func parseManifestPosition(position string) (offset, compressedLength, uncompressedLength int64, err error) {
+	parts := strings.Split(position, ":")
+	if len(parts) != 4 {
+		return 0, 0, 0, fmt.Errorf("invalid manifest position %q", position)
+	}
+
+	var values [4]int64
+	for i, part := range parts {
+		values[i], err = strconv.ParseInt(part, 10, 64)
+		if err != nil || values[i] < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid manifest position %q", position)
+		}
+	}
+
+	if values[3] != manifestTypeTOC {
+		return 0, 0, 0, fmt.Errorf("unsupported manifest type %d", values[3])
+	}
+
+	return values[0], values[1], values[2], nil
+}
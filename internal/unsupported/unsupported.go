@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+// Package unsupported handles the files that cannot be stored in an EROFS
+// image (device nodes, FIFOs and sockets), according to a policy.
+package unsupported
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/warning"
+)
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ util.HardLinkFS      = (*FS)(nil)
+)
+
+// Policy decides what happens to files that cannot be stored.
+type Policy string
+
+const (
+	// PolicyError fails on the first file that cannot be stored.
+	PolicyError Policy = "error"
+	// PolicySkip leaves out files that cannot be stored, with a warning.
+	PolicySkip Policy = "skip"
+	// PolicyPlaceholder replaces files that cannot be stored with empty
+	// regular files of the same permissions and owner, with a warning.
+	PolicyPlaceholder Policy = "placeholder"
+)
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyError, PolicySkip, PolicyPlaceholder:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q, expected %q, %q or %q", s, PolicyError, PolicySkip, PolicyPlaceholder)
+	}
+}
+
+// ErrUnsupportedFile is returned for files that cannot be stored under
+// PolicyError.
+var ErrUnsupportedFile = errors.New("unsupported file type")
+
+// Supported reports whether files of the given mode can be stored.
+func Supported(mode fs.FileMode) bool {
+	switch mode.Type() {
+	case 0, fs.ModeDir, fs.ModeSymlink:
+		return true
+	default:
+		return false
+	}
+}
+
+// FS is a file system that applies a policy to the files of the underlying
+// file system that cannot be stored.
+type FS struct {
+	fsys   archivefs.ReadLinkFS
+	policy Policy
+	warn   warning.Func
+
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// New returns a file system that applies the policy to the files of fsys that
+// cannot be stored. Each file skipped or replaced is reported to warn (if
+// set) once.
+func New(fsys archivefs.ReadLinkFS, policy Policy, warn warning.Func) *FS {
+	return &FS{fsys: fsys, policy: policy, warn: warn, warned: make(map[string]bool)}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	// Stat first, as opening a FIFO blocks.
+	fi, err := fs.Stat(f.fsys, name)
+	if err != nil || Supported(fi.Mode()) {
+		return f.fsys.Open(name)
+	}
+
+	fi, err = f.handle("open", name, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &placeholderFile{fi: fi}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if Supported(entry.Type()) {
+			kept = append(kept, entry)
+			continue
+		}
+
+		entryPath := path.Join(name, entry.Name())
+
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err = f.handle("readdir", entryPath, fi)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		kept = append(kept, fs.FileInfoToDirEntry(fi))
+	}
+
+	return kept, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(f.fsys, name)
+	if err != nil || Supported(fi.Mode()) {
+		return fi, err
+	}
+
+	return f.handle("stat", name, fi)
+}
+
+func (f *FS) ReadLink(name string) (string, error) {
+	return f.fsys.ReadLink(name)
+}
+
+func (f *FS) StatLink(name string) (fs.FileInfo, error) {
+	fi, err := f.fsys.StatLink(name)
+	if err != nil || Supported(fi.Mode()) {
+		return fi, err
+	}
+
+	return f.handle("lstat", name, fi)
+}
+
+func (f *FS) HardLinkID(name string) (any, error) {
+	return util.HardLinkID(f.fsys, name)
+}
+
+// handle applies the policy to a file that cannot be stored, returning the
+// placeholder that replaces it (if any).
+func (f *FS) handle(op, name string, fi fs.FileInfo) (fs.FileInfo, error) {
+	kind := describe(fi.Mode())
+
+	switch f.policy {
+	case PolicySkip:
+		if err := f.warnOnce(name, "skipped "+kind); err != nil {
+			return nil, err
+		}
+
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case PolicyPlaceholder:
+		if err := f.warnOnce(name, "replaced "+kind+" with an empty file"); err != nil {
+			return nil, err
+		}
+
+		return &placeholderInfo{FileInfo: fi}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q is a %s", ErrUnsupportedFile, name, kind)
+	}
+}
+
+func (f *FS) warnOnce(name, message string) error {
+	if f.warn == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	warned := f.warned[name]
+	f.warned[name] = true
+	f.mu.Unlock()
+
+	if warned {
+		return nil
+	}
+
+	return f.warn(&warning.Warning{Kind: warning.KindSpecialFile, Path: name, Message: message})
+}
+
+func describe(mode fs.FileMode) string {
+	switch mode.Type() {
+	case fs.ModeDevice:
+		return "block device"
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return "character device"
+	case fs.ModeNamedPipe:
+		return "FIFO"
+	case fs.ModeSocket:
+		return "socket"
+	default:
+		return fmt.Sprintf("file of unsupported type %s", mode.Type())
+	}
+}
+
+// placeholderInfo describes an empty regular file in place of a file that
+// cannot be stored.
+type placeholderInfo struct {
+	fs.FileInfo
+}
+
+func (fi *placeholderInfo) Mode() fs.FileMode {
+	return fi.FileInfo.Mode() &^ fs.ModeType
+}
+
+func (fi *placeholderInfo) Size() int64 {
+	return 0
+}
+
+func (fi *placeholderInfo) IsDir() bool {
+	return false
+}
+
+func (fi *placeholderInfo) Sys() any {
+	hdr, ok := fi.FileInfo.Sys().(*tar.Header)
+	if !ok {
+		return fi.FileInfo.Sys()
+	}
+
+	placeholder := *hdr
+	placeholder.Typeflag = tar.TypeReg
+	placeholder.Size = 0
+	placeholder.Devmajor, placeholder.Devminor = 0, 0
+
+	return &placeholder
+}
+
+type placeholderFile struct {
+	fi fs.FileInfo
+}
+
+func (f *placeholderFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *placeholderFile) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *placeholderFile) Close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unsupported_test
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/unsupported"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := unsupported.ParsePolicy("placeholder")
+	require.NoError(t, err)
+	require.Equal(t, unsupported.PolicyPlaceholder, p)
+
+	_, err = unsupported.ParsePolicy("ignore")
+	require.Error(t, err)
+}
+
+func TestFS(t *testing.T) {
+	src := linkFS{fstest.MapFS{
+		"dev":         {Mode: fs.ModeDir | 0o755},
+		"dev/null":    {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Sys: &tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Uid: 1000, Devmajor: 1, Devminor: 3}},
+		"dev/initctl": {Mode: fs.ModeNamedPipe | 0o600},
+		"dev/README":  {Mode: 0o644, Data: []byte("hi\n")},
+	}}
+
+	readDir := func(t *testing.T, fsys fs.ReadDirFS) []string {
+		entries, err := fsys.ReadDir("dev")
+		require.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		fsys := unsupported.New(src, unsupported.PolicyError, nil)
+
+		_, err := fsys.ReadDir("dev")
+		require.ErrorIs(t, err, unsupported.ErrUnsupportedFile)
+
+		_, err = fsys.Stat("dev/null")
+		require.ErrorIs(t, err, unsupported.ErrUnsupportedFile)
+		require.ErrorContains(t, err, "character device")
+
+		_, err = fsys.StatLink("dev/initctl")
+		require.ErrorContains(t, err, "FIFO")
+
+		_, err = fsys.Stat("dev/README")
+		require.NoError(t, err)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		var warnings []*warning.Warning
+		fsys := unsupported.New(src, unsupported.PolicySkip, func(w *warning.Warning) error {
+			warnings = append(warnings, w)
+			return nil
+		})
+
+		require.Equal(t, []string{"README"}, readDir(t, fsys))
+
+		_, err := fsys.Stat("dev/null")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fsys.Open("dev/initctl")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		// Each file is only reported once.
+		require.Len(t, warnings, 2)
+		for _, w := range warnings {
+			require.Equal(t, warning.KindSpecialFile, w.Kind)
+		}
+	})
+
+	t.Run("Placeholder", func(t *testing.T) {
+		var warnings []*warning.Warning
+		fsys := unsupported.New(src, unsupported.PolicyPlaceholder, func(w *warning.Warning) error {
+			warnings = append(warnings, w)
+			return nil
+		})
+
+		require.ElementsMatch(t, []string{"README", "initctl", "null"}, readDir(t, fsys))
+
+		fi, err := fsys.StatLink("dev/null")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+		require.Equal(t, fs.FileMode(0o666), fi.Mode().Perm())
+		require.Zero(t, fi.Size())
+
+		hdr, ok := fi.Sys().(*tar.Header)
+		require.True(t, ok)
+		require.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+		require.Equal(t, 1000, hdr.Uid)
+		require.Zero(t, hdr.Devmajor)
+
+		f, err := fsys.Open("dev/initctl")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Empty(t, data)
+
+		require.Len(t, warnings, 2)
+		require.Contains(t, warnings[0].Message, "with an empty file")
+	})
+}
+
+// linkFS adds symlink support to a fstest.MapFS.
+type linkFS struct {
+	fstest.MapFS
+}
+
+func (fsys linkFS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
+
+func (fsys linkFS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.Stat(name)
+}
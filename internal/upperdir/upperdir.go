@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package upperdir presents the upper directory of an overlayfs mount (eg. the
+// read-write layer of a container) as an image layer. The kernel marks
+// deleted files with character devices numbered 0/0, and directories whose
+// lower contents are hidden with an opaque extended attribute; these are
+// translated into the whiteout files used by image layers.
+package upperdir
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+)
+
+const (
+	whiteoutPrefix     = ".wh."
+	opaqueWhiteoutName = ".wh..wh..opq"
+)
+
+// ErrUnsupported is returned for upper directories that depend on the lower
+// layers of the mount beyond whiteouts (eg. those written with the metacopy
+// or redirect_dir overlayfs features).
+var ErrUnsupported = errors.New("unsupported overlayfs feature")
+
+var (
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+)
+
+// FS is a read-only file system backed by an overlayfs upper directory on the
+// host.
+type FS struct {
+	*dirfs.FS
+	dir string
+}
+
+// New returns a file system for the upper directory dir.
+func New(dir string) *FS {
+	return &FS{FS: dirfs.New(dir), dir: dir}
+}
+
+// ReadDir lists the named directory, with whiteout devices replaced by
+// whiteout files, and an opaque whiteout file if the directory is opaque.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.FS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validated by reading the directory.
+	dir := filepath.Join(fsys.dir, filepath.FromSlash(name))
+
+	opaque, err := isOpaque(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	for i, entry := range entries {
+		if err := checkXattrs(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.ToSlash(filepath.Join(name, entry.Name())), err)
+		}
+
+		if entry.Type()&fs.ModeCharDevice == 0 {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		if isWhiteout(fi) {
+			entries[i] = whiteoutEntry(whiteoutPrefix + entry.Name())
+		}
+	}
+
+	if opaque {
+		entries = append(entries, whiteoutEntry(opaqueWhiteoutName))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+// whiteoutEntry returns an empty regular file with the given name.
+func whiteoutEntry(name string) fs.DirEntry {
+	return fs.FileInfoToDirEntry(&whiteoutInfo{name: name})
+}
+
+type whiteoutInfo struct {
+	name string
+}
+
+func (fi *whiteoutInfo) Name() string       { return fi.name }
+func (fi *whiteoutInfo) Size() int64        { return 0 }
+func (fi *whiteoutInfo) Mode() fs.FileMode  { return 0 }
+func (fi *whiteoutInfo) ModTime() time.Time { return time.Time{} }
+func (fi *whiteoutInfo) IsDir() bool        { return false }
+func (fi *whiteoutInfo) Sys() any           { return nil }
@@ -0,0 +1,105 @@
+//go:build linux
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upperdir
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The extended attributes overlayfs sets on the upper directory, both in the
+// trusted namespace and, for mounts with the userxattr option, the user
+// namespace.
+var (
+	opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+	// lowerXattrs mark renamed directories and metadata-only copy ups, both
+	// of which refer to the lower layers.
+	lowerXattrs = []string{
+		"trusted.overlay.redirect", "user.overlay.redirect",
+		"trusted.overlay.metacopy", "user.overlay.metacopy",
+	}
+)
+
+// isWhiteout reports whether the file is a whiteout device.
+func isWhiteout(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isOpaque reports whether the directory at path hides the contents of the
+// lower layers.
+func isOpaque(path string) (bool, error) {
+	for _, name := range opaqueXattrs {
+		value, _, err := getxattr(path, name)
+		if err != nil {
+			return false, err
+		}
+
+		// "x" marks a directory that merely contains whiteouts in the form
+		// of extended attributes (which are not supported).
+		if value == "y" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkXattrs returns ErrUnsupported if the file at path refers to the lower
+// layers.
+func checkXattrs(path string) error {
+	for _, name := range lowerXattrs {
+		_, ok, err := getxattr(path, name)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return fmt.Errorf("%w: %s is set", ErrUnsupported, name)
+		}
+	}
+
+	return nil
+}
+
+// getxattr returns the value of the extended attribute of the file at path
+// (not following symbolic links), and whether the file has it at all.
+func getxattr(path, name string) (string, bool, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(path, name, buf)
+		switch {
+		case errors.Is(err, unix.ERANGE):
+			buf = make([]byte, 2*len(buf))
+			continue
+		case errors.Is(err, unix.ENODATA), errors.Is(err, unix.ENOTSUP):
+			return "", false, nil
+		case err != nil:
+			return "", false, fmt.Errorf("failed to get extended attribute %s: %w", name, err)
+		}
+
+		return string(buf[:n]), true, nil
+	}
+}
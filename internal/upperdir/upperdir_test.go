@@ -0,0 +1,90 @@
+//go:build linux
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upperdir_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/upperdir"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestUpperDir(t *testing.T) {
+	lower := fstest.MapFS{
+		"etc/kept":    &fstest.MapFile{Data: []byte("kept\n")},
+		"etc/removed": &fstest.MapFile{Data: []byte("removed\n")},
+		"opt/old":     &fstest.MapFile{Data: []byte("old\n")},
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "opt"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "etc/new"), []byte("new\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "opt/kept"), []byte("kept\n"), 0o644))
+
+	if err := unix.Mknod(filepath.Join(dir, "etc/removed"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("cannot create whiteout devices: %v", err)
+	}
+
+	if err := unix.Setxattr(filepath.Join(dir, "opt"), "user.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("cannot set user extended attributes: %v", err)
+	}
+
+	fsys, err := overlayfs.New([]fs.FS{lower, upperdir.New(dir)})
+	require.NoError(t, err)
+
+	t.Run("Whiteout", func(t *testing.T) {
+		entries, err := fsys.ReadDir("etc")
+		require.NoError(t, err)
+		require.Equal(t, []string{"kept", "new"}, names(entries))
+	})
+
+	t.Run("Opaque", func(t *testing.T) {
+		entries, err := fsys.ReadDir("opt")
+		require.NoError(t, err)
+		require.Equal(t, []string{"kept"}, names(entries))
+	})
+
+	t.Run("Metacopy", func(t *testing.T) {
+		require.NoError(t, unix.Setxattr(filepath.Join(dir, "etc/new"), "user.overlay.metacopy", []byte{}, 0))
+		t.Cleanup(func() {
+			require.NoError(t, unix.Removexattr(filepath.Join(dir, "etc/new"), "user.overlay.metacopy"))
+		})
+
+		_, err := upperdir.New(dir).ReadDir("etc")
+		require.ErrorIs(t, err, upperdir.ErrUnsupported)
+	})
+}
+
+func names(entries []fs.DirEntry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrDigestMismatch is returned when the content of a blob does not match
+// its expected digest.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// VerifyingReader returns a reader that checks the content read from r
+// against dgst. If the content does not match, the final read fails with
+// ErrDigestMismatch instead of io.EOF.
+func VerifyingReader(r io.Reader, dgst digest.Digest) (io.Reader, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", dgst, err)
+	}
+
+	return &verifyingReader{r: r, dgst: dgst, verifier: dgst.Verifier()}, nil
+}
+
+type verifyingReader struct {
+	r        io.Reader
+	dgst     digest.Digest
+	verifier digest.Verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.verifier.Write(p[:n])
+
+	if errors.Is(err, io.EOF) && !r.verifier.Verified() {
+		return n, fmt.Errorf("%w: content does not match %s", ErrDigestMismatch, r.dgst)
+	}
+
+	return n, err
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import "io/fs"
+
+// HardLinkFS is a file system that knows which of its regular files are hard
+// links to one another.
+type HardLinkFS interface {
+	fs.FS
+	// HardLinkID returns a comparable value that identifies the named file,
+	// and is shared by all of its hard links. It returns nil if the file has
+	// no other links.
+	HardLinkID(name string) (any, error)
+}
+
+// HardLinkID returns the value identifying the named file that is shared by
+// all of its hard links (see HardLinkFS). It returns nil if the file has no
+// other links, or if the file system does not record them.
+func HardLinkID(fsys fs.FS, name string) (any, error) {
+	linkFS, ok := fsys.(HardLinkFS)
+	if !ok {
+		return nil, nil
+	}
+
+	return linkFS.HardLinkID(name)
+}
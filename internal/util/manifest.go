@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxManifestSize is the default maximum size of an image index,
+// manifest, or config.
+const DefaultMaxManifestSize = 4 << 20
+
+// ErrManifestTooLarge is returned when an image index, manifest, or config
+// exceeds the maximum allowed size.
+var ErrManifestTooLarge = errors.New("manifest too large")
+
+// ManifestReader returns a reader that fails with ErrManifestTooLarge once
+// more than maxSize bytes have been read. If maxSize is zero,
+// DefaultMaxManifestSize is used.
+func ManifestReader(r io.Reader, maxSize int64) io.Reader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxManifestSize
+	}
+
+	return &manifestReader{r: r, maxSize: maxSize, remaining: maxSize}
+}
+
+type manifestReader struct {
+	r         io.Reader
+	maxSize   int64
+	remaining int64
+}
+
+func (r *manifestReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, fmt.Errorf("%w: exceeds %d bytes", ErrManifestTooLarge, r.maxSize)
+	}
+
+	// Read one byte past the limit so that we can tell if it was exceeded.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return 0, fmt.Errorf("%w: exceeds %d bytes", ErrManifestTooLarge, r.maxSize)
+	}
+
+	return n, err
+}
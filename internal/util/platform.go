@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrPlatformNotFound is returned when an image is not available for the
+// requested platform.
+var ErrPlatformNotFound = errors.New("platform not found")
+
+// PlatformMatcher extends a containerd platform matcher to also match on the
+// os.version and os.features fields, which containerd ignores.
+type PlatformMatcher struct {
+	platforms.MatchComparer
+	want ocispecs.Platform
+}
+
+// NewPlatformMatcher returns a matcher for the given platform, or for the
+// host platform if platform is nil.
+func NewPlatformMatcher(platform *ocispecs.Platform) *PlatformMatcher {
+	if platform == nil {
+		// Default to the host platform.
+		return &PlatformMatcher{
+			MatchComparer: platforms.Default(),
+			want:          platforms.DefaultSpec(),
+		}
+	}
+
+	return &PlatformMatcher{
+		MatchComparer: platforms.Ordered(*platform),
+		want:          *platform,
+	}
+}
+
+func (m *PlatformMatcher) Match(platform ocispecs.Platform) bool {
+	if !m.MatchComparer.Match(platform) {
+		return false
+	}
+
+	if m.want.OSVersion != "" && m.want.OSVersion != platform.OSVersion {
+		return false
+	}
+
+	for _, feature := range m.want.OSFeatures {
+		if !slices.Contains(platform.OSFeatures, feature) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *PlatformMatcher) String() string {
+	return FormatPlatform(m.want)
+}
+
+// FormatPlatform formats a platform including its os.version and
+// os.features, if present.
+func FormatPlatform(platform ocispecs.Platform) string {
+	s := platforms.Format(platform)
+	if platform.OSVersion != "" {
+		s += fmt.Sprintf(" (os.version %s)", platform.OSVersion)
+	}
+	if len(platform.OSFeatures) > 0 {
+		s += fmt.Sprintf(" (os.features %s)", strings.Join(platform.OSFeatures, ","))
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+)
+
+// ErrRefNotFound is returned when no image matches the given ref.
+var ErrRefNotFound = errors.New("image not found")
+
+// ErrAmbiguousRef is returned when more than one image matches the given ref
+// (or there are several images and no ref was given).
+var ErrAmbiguousRef = errors.New("ambiguous ref")
+
+// MatchesRef returns true if the image name refers to the given ref. As well
+// as exact matches, references are compared in their normalized form so that
+// eg. "alpine:3.19" matches "docker.io/library/alpine:3.19".
+func MatchesRef(name, ref string) bool {
+	if name == ref {
+		return true
+	}
+
+	normalizedName, err := dockerref.ParseDockerRef(name)
+	if err != nil {
+		return false
+	}
+
+	normalizedRef, err := dockerref.ParseDockerRef(ref)
+	if err != nil {
+		return false
+	}
+
+	return normalizedName.String() == normalizedRef.String()
+}
+
+// MatchesTag returns true if the bare tag (eg. "3.19", as commonly recorded
+// in OCI ref name annotations) is the tag of the given ref.
+func MatchesTag(tag, ref string) bool {
+	if tag == "" || strings.ContainsAny(tag, "/:@") {
+		return false
+	}
+
+	normalizedRef, err := dockerref.ParseDockerRef(ref)
+	if err != nil {
+		return false
+	}
+
+	tagged, ok := normalizedRef.(dockerref.Tagged)
+	return ok && tagged.Tag() == tag
+}
+
+// RefIndex returns the position N of a ref of the form "@N", which selects
+// the N-th (zero based) image of an image index or Docker archive.
+func RefIndex(ref string) (int, bool) {
+	s, ok := strings.CutPrefix(ref, "@")
+	if !ok || s == "" || strings.ContainsAny(s, "+-") {
+		return 0, false
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+
+	return i, true
+}
@@ -0,0 +1,39 @@
+//go:build !unix
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import "io/fs"
+
+// StatOwner is not supported on this platform, files are treated as being
+// owned by root.
+func StatOwner(_ fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+// StatFileID is not supported on this platform.
+func StatFileID(_ fs.FileInfo) (any, bool) {
+	return nil, false
+}
+
+// DiskUsage is not supported on this platform.
+func DiskUsage(_ fs.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// StatOwner returns the numeric owner of a file from its platform specific
+// stat information.
+func StatOwner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return st.Uid, st.Gid, true
+}
+
+// StatFileID returns a value identifying the file from its platform specific
+// stat information, that is shared by all of its hard links. It is only
+// returned for files that have more than one link.
+func StatFileID(fi fs.FileInfo) (any, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return nil, false
+	}
+
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// fileID identifies a file on the host.
+type fileID struct {
+	dev, ino uint64
+}
+
+// DiskUsage returns the number of bytes actually allocated to a file on disk.
+func DiskUsage(fi fs.FileInfo) (int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return int64(st.Blocks) * 512, true
+}
@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/tarfs"
+)
+
+var (
+	_ fs.ReadDirFS         = (*TarFS)(nil)
+	_ fs.StatFS            = (*TarFS)(nil)
+	_ archivefs.ReadLinkFS = (*TarFS)(nil)
+	_ HardLinkFS           = (*TarFS)(nil)
+)
+
+// TarFS is a tar archive opened as a file system, that returns the targets
+// of symbolic links exactly as they were recorded in the archive. tarfs
+// cleans link targets (eg. dropping a trailing slash) and makes those that
+// start with "./" absolute, which changes where they point. It also keeps
+// track of hard links, which tarfs turns into copies of their targets.
+type TarFS struct {
+	*tarfs.FS
+	targets map[string]string
+	// links maps each hard link, and each file that is the target of one,
+	// to the name of the file that they are all links to.
+	links map[string]string
+}
+
+// OpenTar opens the tar archive as a file system.
+func OpenTar(ra io.ReaderAt) (*TarFS, error) {
+	fsys, err := tarfs.Open(ra)
+	if err != nil {
+		return nil, err
+	}
+
+	// Later entries replace earlier ones, and hard links are resolved once
+	// the whole archive has been read (as tarfs does).
+	targets := make(map[string]string)
+	hardlinks := make(map[string]string)
+	var order []string
+
+	tr := tar.NewReader(io.NewSectionReader(ra, 0, math.MaxInt64))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := cleanTarPath(hdr.Name)
+		delete(targets, name)
+		delete(hardlinks, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			targets[name] = hdr.Linkname
+		case tar.TypeLink:
+			hardlinks[name] = cleanTarPath(hdr.Linkname)
+			order = append(order, name)
+		}
+	}
+
+	links := make(map[string]string)
+	for _, name := range order {
+		target, ok := hardlinks[name]
+		if !ok {
+			continue
+		}
+
+		if raw, ok := targets[target]; ok {
+			targets[name] = raw
+		}
+
+		// Links to links are links to the same file.
+		file := target
+		for i := 0; i < len(hardlinks); i++ {
+			next, ok := hardlinks[file]
+			if !ok {
+				break
+			}
+			file = next
+		}
+
+		links[name] = file
+		links[file] = file
+	}
+
+	return &TarFS{FS: fsys, targets: targets, links: links}, nil
+}
+
+// Open opens the named file.
+func (fsys *TarFS) Open(name string) (fs.File, error) {
+	return fsys.FS.Open(tarPath(name))
+}
+
+// ReadDir reads the named directory.
+func (fsys *TarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fsys.FS.ReadDir(tarPath(name))
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fsys *TarFS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.FS.Stat(tarPath(name))
+}
+
+// StatLink returns a FileInfo describing the named file, without following
+// symbolic links.
+func (fsys *TarFS) StatLink(name string) (fs.FileInfo, error) {
+	return fsys.FS.StatLink(tarPath(name))
+}
+
+// HardLinkID returns a value identifying the named file that is shared by all
+// of the hard links to it, or nil if it has no other links.
+func (fsys *TarFS) HardLinkID(name string) (any, error) {
+	if _, err := fsys.StatLink(name); err != nil {
+		return nil, err
+	}
+
+	file, ok := fsys.links[cleanTarPath(tarPath(name))]
+	if !ok {
+		return nil, nil
+	}
+
+	return tarLink{fsys: fsys, file: file}, nil
+}
+
+// tarLink identifies a file with hard links in a tar archive.
+type tarLink struct {
+	fsys *TarFS
+	file string
+}
+
+// ReadLink returns the destination of the named symbolic link.
+func (fsys *TarFS) ReadLink(name string) (string, error) {
+	target, err := fsys.FS.ReadLink(tarPath(name))
+	if err != nil {
+		return "", err
+	}
+
+	if raw, ok := fsys.targets[cleanTarPath(tarPath(name))]; ok {
+		return raw, nil
+	}
+
+	// Eg. a link reached through a symbolic link to its parent directory,
+	// which is not recorded under that name.
+	return target, nil
+}
+
+// cleanTarPath cleans the name of a tar entry in the same way as tarfs. A
+// relative name loses its leading dot, so an entry at the root whose name
+// starts with a dot (eg. a whiteout) must be written as an absolute path
+// (see AnchorTarPath) to keep it.
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(filepath.ToSlash(strings.TrimSpace(name))), "."), "/")
+}
+
+// tarPath returns the name to look the named file up by in tarfs, which
+// cleans the names it is given as it does those of entries.
+func tarPath(name string) string {
+	return "/" + name
+}
+
+// AnchorTarPath returns the name to write an entry of a tar archive under so
+// that tarfs keeps it as is. Names at the root that start with a dot are made
+// absolute, others are returned unchanged.
+func AnchorTarPath(name string) string {
+	clean := path.Clean(filepath.ToSlash(name))
+	if strings.HasPrefix(clean, ".") && clean != "." && clean != ".." && !strings.Contains(clean, "/") {
+		return "/" + clean
+	}
+
+	return name
+}
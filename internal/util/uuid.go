@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParseUUID parses a UUID in the canonical "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+// format.
+func ParseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return uuid, fmt.Errorf("invalid UUID %q", s)
+	}
+
+	if _, err := hex.Decode(uuid[:], []byte(strings.ReplaceAll(s, "-", ""))); err != nil {
+		return uuid, fmt.Errorf("invalid UUID %q: %w", s, err)
+	}
+
+	return uuid, nil
+}
+
+// FormatUUID formats a UUID in the canonical format.
+func FormatUUID(uuid [16]byte) string {
+	s := hex.EncodeToString(uuid[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// NameUUID derives a stable UUID from the given name (eg. an image digest).
+// It is a version 8 (custom) UUID holding the leading bits of the SHA-256 of
+// the name.
+func NameUUID(name string) [16]byte {
+	sum := sha256.Sum256([]byte(name))
+
+	var uuid [16]byte
+	copy(uuid[:], sum[:16])
+	uuid[6] = (uuid[6] & 0x0f) | 0x80
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return uuid
+}
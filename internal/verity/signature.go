@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package verity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// SignatureSize is the size of a verity signature partition.
+const SignatureSize = 4096
+
+var (
+	oidData                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256                = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256       = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	errUnsupportedSigningKey = errors.New("unsupported signing key")
+)
+
+// Signer signs root hashes with a private key and its X.509 certificate.
+type Signer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// LoadSigner reads a PEM encoded RSA or ECDSA private key and the PEM encoded
+// certificate of its public key.
+func LoadSigner(keyPath, certPath string) (*Signer, error) {
+	keyBlock, err := readPEM(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	var key any
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", errUnsupportedSigningKey, key)
+	}
+
+	switch signer.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, fmt.Errorf("%w: %T", errUnsupportedSigningKey, key)
+	}
+
+	certBlock, err := readPEM(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	if !publicKeysEqual(cert.PublicKey, signer.Public()) {
+		return nil, errors.New("the certificate does not match the signing key")
+	}
+
+	return &Signer{cert: cert, key: signer}, nil
+}
+
+// Sign returns a detached PKCS#7 signature (DER encoded, without signed
+// attributes) of the hex encoded root hash, as accepted by the kernel's
+// dm-verity signature verification (veritysetup --root-hash-signature) and
+// by systemd (as a .roothash.p7s file).
+func (s *Signer) Sign(rootHash []byte) ([]byte, error) {
+	digest := sha256.Sum256([]byte(hex.EncodeToString(rootHash)))
+
+	sig, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign root hash: %w", err)
+	}
+
+	signatureAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	if _, ok := s.key.(*rsa.PrivateKey); ok {
+		signatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+
+	signedData, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      s.cert.Raw,
+		},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: s.cert.RawIssuer},
+				SerialNumber: s.cert.SerialNumber,
+			},
+			DigestAlgorithm:    sha256Algorithm,
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// SignaturePartition returns the contents of a verity signature partition,
+// as described by the Discoverable Partitions Specification: a JSON object
+// holding the root hash, the fingerprint of the certificate and the signature,
+// padded with NULs to SignatureSize.
+func (s *Signer) SignaturePartition(rootHash, sig []byte) ([]byte, error) {
+	fingerprint := sha256.Sum256(s.cert.Raw)
+
+	data, err := json.Marshal(struct {
+		RootHash               string `json:"rootHash"`
+		CertificateFingerprint string `json:"certificateFingerprint"`
+		Signature              string `json:"signature"`
+	}{
+		RootHash:               hex.EncodeToString(rootHash),
+		CertificateFingerprint: hex.EncodeToString(fingerprint[:]),
+		Signature:              base64.StdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= SignatureSize {
+		return nil, fmt.Errorf("verity signature too large: %d bytes", len(data))
+	}
+
+	partition := make([]byte, SignatureSize)
+	copy(partition, data)
+
+	return partition, nil
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version               int
+	IssuerAndSerialNumber issuerAndSerialNumber
+	DigestAlgorithm       pkix.AlgorithmIdentifier
+	SignatureAlgorithm    pkix.AlgorithmIdentifier
+	Signature             []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package verity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockSize is the data and hash block size of the generated tree.
+const BlockSize = 4096
+
+// Algorithm is the hash algorithm used for the tree.
+const Algorithm = "sha256"
+
+// ErrUnalignedData is returned when the data area is not a whole number of
+// blocks.
+var ErrUnalignedData = errors.New("data size is not a multiple of the block size")
+
+// Options configures the generated hash tree.
+type Options struct {
+	// Salt is hashed ahead of every block (it may be empty).
+	Salt []byte
+}
+
+// Tree describes a dm-verity hash tree appended to a data area.
+type Tree struct {
+	// RootHash is the hash of the top level of the tree.
+	RootHash []byte
+	// Salt is the salt used when hashing blocks.
+	Salt []byte
+	// UUID is the UUID recorded in the verity superblock.
+	UUID [16]byte
+	// DataBlocks is the number of data blocks covered by the tree.
+	DataBlocks uint64
+	// HashOffset is the offset of the verity superblock (the --hash-offset
+	// passed to veritysetup).
+	HashOffset int64
+	// Size is the size of the hash area, including the superblock.
+	Size int64
+}
+
+// ReaderWriterAt is implemented by the output file.
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Append computes a dm-verity (format 1) hash tree over the first dataSize
+// bytes of f and writes it, preceded by a veritysetup compatible superblock,
+// immediately after the data. Hashing is aborted if the context is cancelled.
+func Append(ctx context.Context, f ReaderWriterAt, dataSize int64, opts *Options) (*Tree, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if dataSize <= 0 || dataSize%BlockSize != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrUnalignedData, dataSize)
+	}
+
+	if len(opts.Salt) > 256 {
+		return nil, fmt.Errorf("salt too long: %d bytes", len(opts.Salt))
+	}
+
+	tree := &Tree{
+		Salt:       opts.Salt,
+		DataBlocks: uint64(dataSize / BlockSize),
+		HashOffset: dataSize,
+	}
+
+	// Hash every data block.
+	level := make([]byte, 0, tree.DataBlocks*sha256.Size)
+	block := make([]byte, BlockSize)
+	for offset := int64(0); offset < dataSize; offset += BlockSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return nil, fmt.Errorf("failed to read data block at %d: %w", offset, err)
+		}
+
+		level = append(level, hashBlock(opts.Salt, block)...)
+	}
+
+	// Build the rest of the tree until the top level fits into one block.
+	var levels [][]byte
+	if tree.DataBlocks == 1 {
+		// A single data block needs no hash blocks at all.
+		tree.RootHash = level
+	} else {
+		for {
+			level = padToBlock(level)
+			levels = append(levels, level)
+
+			if len(level) == BlockSize {
+				tree.RootHash = hashBlock(opts.Salt, level)
+				break
+			}
+
+			var next []byte
+			for i := 0; i < len(level); i += BlockSize {
+				next = append(next, hashBlock(opts.Salt, level[i:i+BlockSize])...)
+			}
+			level = next
+		}
+	}
+
+	copy(tree.UUID[:], tree.RootHash)
+	// Mark it as a version 4 (random) UUID.
+	tree.UUID[6] = (tree.UUID[6] & 0x0f) | 0x40
+	tree.UUID[8] = (tree.UUID[8] & 0x3f) | 0x80
+
+	sb, err := marshalSuperblock(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal superblock: %w", err)
+	}
+
+	if _, err := f.WriteAt(padToBlock(sb), tree.HashOffset); err != nil {
+		return nil, fmt.Errorf("failed to write superblock: %w", err)
+	}
+	tree.Size = BlockSize
+
+	// The top level of the tree is stored first.
+	for i := len(levels) - 1; i >= 0; i-- {
+		if _, err := f.WriteAt(levels[i], tree.HashOffset+tree.Size); err != nil {
+			return nil, fmt.Errorf("failed to write hash tree: %w", err)
+		}
+		tree.Size += int64(len(levels[i]))
+	}
+
+	return tree, nil
+}
+
+// TreeSize returns the size of the hash area, including the superblock, that
+// Append writes for dataSize bytes of data.
+func TreeSize(dataSize int64) int64 {
+	size := int64(BlockSize)
+
+	hashes := (dataSize + BlockSize - 1) / BlockSize * sha256.Size
+	if hashes <= sha256.Size {
+		return size
+	}
+
+	for {
+		level := (hashes + BlockSize - 1) / BlockSize * BlockSize
+		size += level
+
+		if level == BlockSize {
+			return size
+		}
+
+		hashes = level / BlockSize * sha256.Size
+	}
+}
+
+func hashBlock(salt, block []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(salt)
+	_, _ = h.Write(block)
+	return h.Sum(nil)
+}
+
+func padToBlock(b []byte) []byte {
+	if rem := len(b) % BlockSize; rem != 0 || len(b) == 0 {
+		b = append(b, make([]byte, BlockSize-rem)...)
+	}
+	return b
+}
+
+// superblock is the on-disk veritysetup superblock.
+type superblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [256]byte
+	_             [168]byte
+}
+
+func marshalSuperblock(tree *Tree) ([]byte, error) {
+	sb := superblock{
+		Version:       1,
+		HashType:      1,
+		UUID:          tree.UUID,
+		DataBlockSize: BlockSize,
+		HashBlockSize: BlockSize,
+		DataBlocks:    tree.DataBlocks,
+		SaltSize:      uint16(len(tree.Salt)),
+	}
+	copy(sb.Signature[:], "verity")
+	copy(sb.Algorithm[:], Algorithm)
+	copy(sb.Salt[:], tree.Salt)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
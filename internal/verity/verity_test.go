@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package verity_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/verity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppend(t *testing.T) {
+	salt := []byte("salty")
+
+	t.Run("Multiple Levels", func(t *testing.T) {
+		// Enough blocks to need a second level (128 hashes per block).
+		const dataBlocks = 200
+		f := createDataFile(t, dataBlocks)
+
+		tree, err := verity.Append(context.Background(), f, dataBlocks*verity.BlockSize, &verity.Options{Salt: salt})
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(dataBlocks), tree.DataBlocks)
+		require.Equal(t, int64(dataBlocks*verity.BlockSize), tree.HashOffset)
+		// Superblock, one top level block and two level 0 blocks.
+		require.Equal(t, int64(4*verity.BlockSize), tree.Size)
+
+		sb := readBlock(t, f, tree.HashOffset)
+		require.Equal(t, "verity\x00\x00", string(sb[:8]))
+		require.Equal(t, uint32(1), binary.LittleEndian.Uint32(sb[8:]))
+		require.Equal(t, uint32(1), binary.LittleEndian.Uint32(sb[12:]))
+		require.Equal(t, tree.UUID[:], sb[16:32])
+		require.Equal(t, "sha256", string(sb[32:38]))
+		require.Equal(t, uint32(verity.BlockSize), binary.LittleEndian.Uint32(sb[64:]))
+		require.Equal(t, uint32(verity.BlockSize), binary.LittleEndian.Uint32(sb[68:]))
+		require.Equal(t, uint64(dataBlocks), binary.LittleEndian.Uint64(sb[72:]))
+		require.Equal(t, uint16(len(salt)), binary.LittleEndian.Uint16(sb[80:]))
+		require.Equal(t, salt, sb[88:88+len(salt)])
+
+		top := readBlock(t, f, tree.HashOffset+verity.BlockSize)
+		require.Equal(t, hashBlock(salt, top), tree.RootHash)
+
+		for i := 0; i < 2; i++ {
+			level0 := readBlock(t, f, tree.HashOffset+int64(2+i)*verity.BlockSize)
+			require.Equal(t, hashBlock(salt, level0), top[i*sha256.Size:(i+1)*sha256.Size])
+		}
+
+		// Spot check the hash of the last data block.
+		level0 := readBlock(t, f, tree.HashOffset+3*verity.BlockSize)
+		data := readBlock(t, f, (dataBlocks-1)*verity.BlockSize)
+		offset := (dataBlocks - 1 - 128) * sha256.Size
+		require.Equal(t, hashBlock(salt, data), level0[offset:offset+sha256.Size])
+
+		// Unused hash slots are zeroed.
+		require.Equal(t, make([]byte, sha256.Size), level0[offset+sha256.Size:offset+2*sha256.Size])
+	})
+
+	t.Run("Single Block", func(t *testing.T) {
+		f := createDataFile(t, 1)
+
+		tree, err := verity.Append(context.Background(), f, verity.BlockSize, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, hashBlock(nil, readBlock(t, f, 0)), tree.RootHash)
+		require.Equal(t, int64(verity.BlockSize), tree.Size)
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		a, err := verity.Append(context.Background(), createDataFile(t, 10), 10*verity.BlockSize, &verity.Options{Salt: salt})
+		require.NoError(t, err)
+
+		b, err := verity.Append(context.Background(), createDataFile(t, 10), 10*verity.BlockSize, &verity.Options{Salt: salt})
+		require.NoError(t, err)
+
+		require.Equal(t, a, b)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := verity.Append(ctx, createDataFile(t, 10), 10*verity.BlockSize, nil)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Unaligned", func(t *testing.T) {
+		_, err := verity.Append(context.Background(), createDataFile(t, 1), verity.BlockSize-1, nil)
+		require.ErrorIs(t, err, verity.ErrUnalignedData)
+	})
+}
+
+func TestTreeSize(t *testing.T) {
+	for _, dataBlocks := range []int{1, 2, 128, 129, 200, 128*128 + 1} {
+		tree, err := verity.Append(context.Background(), createDataFile(t, dataBlocks), int64(dataBlocks)*verity.BlockSize, nil)
+		require.NoError(t, err)
+
+		require.Equal(t, tree.Size, verity.TreeSize(int64(dataBlocks)*verity.BlockSize), "%d data blocks", dataBlocks)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, certPath := writeSigningKey(t, dir, "signing")
+
+	signer, err := verity.LoadSigner(keyPath, certPath)
+	require.NoError(t, err)
+
+	rootHash := sha256.Sum256([]byte("root"))
+
+	sig, err := signer.Sign(rootHash[:])
+	require.NoError(t, err)
+
+	t.Run("PKCS7", func(t *testing.T) {
+		var contentInfo struct {
+			ContentType asn1.ObjectIdentifier
+			Content     asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		_, err := asn1.Unmarshal(sig, &contentInfo)
+		require.NoError(t, err)
+		require.Equal(t, asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}, contentInfo.ContentType)
+
+		var signedData struct {
+			Version          int
+			DigestAlgorithms asn1.RawValue
+			ContentInfo      asn1.RawValue
+			Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+			SignerInfos      []struct {
+				Version               int
+				IssuerAndSerialNumber asn1.RawValue
+				DigestAlgorithm       asn1.RawValue
+				SignatureAlgorithm    asn1.RawValue
+				Signature             []byte
+			} `asn1:"set"`
+		}
+		_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+		require.NoError(t, err)
+		require.Len(t, signedData.SignerInfos, 1)
+
+		cert, err := x509.ParseCertificate(signedData.Certificates.Bytes)
+		require.NoError(t, err)
+
+		// The signature covers the hex encoded root hash.
+		digest := sha256.Sum256([]byte(hex.EncodeToString(rootHash[:])))
+		require.NoError(t, rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signedData.SignerInfos[0].Signature))
+	})
+
+	t.Run("Signature Partition", func(t *testing.T) {
+		partition, err := signer.SignaturePartition(rootHash[:], sig)
+		require.NoError(t, err)
+		require.Len(t, partition, verity.SignatureSize)
+
+		var signature struct {
+			RootHash  string `json:"rootHash"`
+			Signature []byte `json:"signature"`
+		}
+		require.NoError(t, json.Unmarshal(bytes.TrimRight(partition, "\x00"), &signature))
+		require.Equal(t, hex.EncodeToString(rootHash[:]), signature.RootHash)
+		require.Equal(t, sig, signature.Signature)
+	})
+
+	t.Run("Mismatched Certificate", func(t *testing.T) {
+		_, otherCertPath := writeSigningKey(t, dir, "other")
+
+		_, err := verity.LoadSigner(keyPath, otherCertPath)
+		require.Error(t, err)
+	})
+}
+
+// writeSigningKey writes an RSA private key and a self-signed certificate for
+// it to dir, and returns their paths.
+func writeSigningKey(t *testing.T, dir, name string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+
+	certPath := filepath.Join(dir, name+".crt")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o644))
+
+	return keyPath, certPath
+}
+
+func createDataFile(t *testing.T, blocks int) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "data.img"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	for i := 0; i < blocks; i++ {
+		block := make([]byte, verity.BlockSize)
+		for j := range block {
+			block[j] = byte(i + j)
+		}
+
+		_, err := f.Write(block)
+		require.NoError(t, err)
+	}
+
+	return f
+}
+
+func readBlock(t *testing.T, f *os.File, offset int64) []byte {
+	block := make([]byte, verity.BlockSize)
+	_, err := f.ReadAt(block, offset)
+	require.NoError(t, err)
+
+	return block
+}
+
+func hashBlock(salt, block []byte) []byte {
+	h := sha256.New()
+	_, _ = h.Write(salt)
+	_, _ = h.Write(block)
+	return h.Sum(nil)
+}
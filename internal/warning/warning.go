@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package warning describes the non-fatal issues found while converting an
+// image, such as entries that cannot be stored in it.
+package warning
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Kind classifies a warning.
+type Kind string
+
+const (
+	// KindSpecialFile is a device node, FIFO or socket that was left out or
+	// replaced by an empty file.
+	KindSpecialFile Kind = "special-file"
+	// KindUnsupportedType is an entry of an unknown type that was left out.
+	KindUnsupportedType Kind = "unsupported-type"
+	// KindXattrs are extended attributes that are not stored in the image.
+	KindXattrs Kind = "xattrs"
+	// KindHardLink is a hard link whose target is missing, which was left
+	// out.
+	KindHardLink Kind = "hard-link"
+	// KindMediaType is a layer whose contents do not match the compression
+	// declared by its media type, or whose media type is not recognized,
+	// which was decompressed according to its sniffed compression.
+	KindMediaType Kind = "media-type"
+)
+
+// Warning is a non-fatal issue, which usually means that part of the source
+// image is not in the converted image.
+type Warning struct {
+	Kind Kind `json:"kind"`
+	// Layer is the path of the layer within the image, if any.
+	Layer string `json:"layer,omitempty"`
+	// Path is the path of the affected entry.
+	Path string `json:"path,omitempty"`
+	// Message describes the issue (in lower case, as for errors).
+	Message string `json:"message"`
+}
+
+// Func handles a warning. An error aborts the conversion (eg. to treat
+// warnings as errors).
+type Func func(*Warning) error
+
+func (w *Warning) Error() string {
+	var parts []string
+	if w.Layer != "" {
+		parts = append(parts, "layer "+w.Layer)
+	}
+	if w.Path != "" {
+		parts = append(parts, fmt.Sprintf("%q", w.Path))
+	}
+
+	return strings.Join(append(parts, w.Message), ": ")
+}
+
+// Log logs the warning.
+func (w *Warning) Log() {
+	attrs := []any{slog.String("kind", string(w.Kind))}
+	if w.Layer != "" {
+		attrs = append(attrs, slog.String("layer", w.Layer))
+	}
+	if w.Path != "" {
+		attrs = append(attrs, slog.String("path", w.Path))
+	}
+
+	msg := w.Message
+	if msg != "" {
+		msg = strings.ToUpper(msg[:1]) + msg[1:]
+	}
+
+	slog.Warn(msg, attrs...)
+}
+
+// Emit passes the warning to fn, or logs it if fn is nil.
+func Emit(fn Func, w *Warning) error {
+	if fn == nil {
+		w.Log()
+		return nil
+	}
+
+	return fn(w)
+}
@@ -20,26 +20,49 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/containerd/containerd/platforms"
+	"github.com/dpeckett/archivefs"
 	"github.com/dpeckett/archivefs/erofs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/telemetry"
 	"github.com/dpeckett/telemetry/v1alpha1"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/batch"
 	"github.com/immutos/oci2erofs/internal/constants"
-	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/diff"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+	"github.com/immutos/oci2erofs/internal/exitcode"
+	"github.com/immutos/oci2erofs/internal/extract"
+	"github.com/immutos/oci2erofs/internal/fusefs"
+	"github.com/immutos/oci2erofs/internal/inspect"
 	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/otlp"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/sbom"
+	"github.com/immutos/oci2erofs/internal/server"
 	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 )
@@ -51,16 +74,80 @@ func main() {
 			Usage: "Set the log verbosity level",
 			Value: util.FromSlogLevel(slog.LevelInfo),
 		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Set the log output format ('text' or 'json')",
+			Value: "text",
+		},
+		&cli.StringFlag{
+			Name:  "error-format",
+			Usage: "Set the format of the error reported on failure ('text' or 'json'), the exit code identifies the class of failure",
+			Value: "text",
+		},
+		&cli.StringFlag{
+			Name:  "pprof-addr",
+			Usage: "Serve Go runtime profiles (net/http/pprof) on this address, eg. 'localhost:6060'",
+		},
+	}
+
+	newLogger := func(c *cli.Context, w io.Writer) (*slog.Logger, error) {
+		level := *(*slog.Level)(c.Generic("log-level").(*util.LevelFlag))
+		// Only warnings and errors, unless a level is explicitly requested.
+		if c.Bool("quiet") && !c.IsSet("log-level") {
+			level = slog.LevelWarn
+		}
+
+		handlerOpts := &slog.HandlerOptions{Level: level}
+
+		switch c.String("log-format") {
+		case "text":
+			return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+		case "json":
+			return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+		default:
+			return nil, fmt.Errorf("invalid log format %q", c.String("log-format"))
+		}
 	}
 
 	initLogger := func(c *cli.Context) error {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: (*slog.Level)(c.Generic("log-level").(*util.LevelFlag)),
-		})))
+		logger, err := newLogger(c, os.Stderr)
+		if err != nil {
+			return err
+		}
+		slog.SetDefault(logger)
 
 		return nil
 	}
 
+	checkErrorFormat := func(c *cli.Context) error {
+		switch c.String("error-format") {
+		case "text", "json":
+			return nil
+		default:
+			return fmt.Errorf("invalid error format %q", c.String("error-format"))
+		}
+	}
+
+	// The error format of the (sub)command that failed, as flags set on a
+	// subcommand are not visible from the app.
+	var errorFormat string
+
+	handleExitError := func(c *cli.Context, err error) {
+		if err == nil {
+			return
+		}
+
+		if c.IsSet("error-format") || errorFormat == "" {
+			errorFormat = c.String("error-format")
+		}
+
+		// Commands that pick their own exit code (eg. diff) exit immediately.
+		var exitErr cli.ExitCoder
+		if errors.As(err, &exitErr) {
+			cli.HandleExitCoder(err)
+		}
+	}
+
 	// Collect anonymized usage statistics.
 	var telemetryReporter *telemetry.Reporter
 
@@ -108,12 +195,75 @@ func main() {
 		return nil
 	}
 
-	app := &cli.App{
-		Name:      "oci2erofs",
-		Usage:     "Convert OCI images into EROFS filesystems",
-		Version:   constants.Version,
-		ArgsUsage: "image_path",
-		Flags: append([]cli.Flag{
+	// Serve profiles of slow conversions for 'go tool pprof'.
+	initPprof := func(c *cli.Context) error {
+		if c.String("pprof-addr") == "" {
+			return nil
+		}
+
+		lis, err := net.Listen("tcp", c.String("pprof-addr"))
+		if err != nil {
+			return fmt.Errorf("failed to listen for pprof: %w", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		slog.Info("Serving profiles", slog.String("url", "http://"+lis.Addr().String()+"/debug/pprof/"))
+
+		go func() {
+			srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+			if err := srv.Serve(lis); err != nil {
+				slog.Warn("Failed to serve profiles", slog.Any("error", err))
+			}
+		}()
+
+		return nil
+	}
+
+	// Export traces and metrics if an OpenTelemetry collector is configured.
+	var shutdownOTLP func(context.Context) error
+
+	initOTLP := func(c *cli.Context) (err error) {
+		shutdownOTLP, err = otlp.Setup(c.Context)
+		return err
+	}
+
+	shutdown := func(c *cli.Context) error {
+		if shutdownOTLP != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := shutdownOTLP(ctx); err != nil {
+				slog.Warn("Failed to export telemetry", slog.Any("error", err))
+			}
+		}
+
+		return shutdownTelemetry(c)
+	}
+
+	// convertFlags returns the flags of the conversion command. Flags hold the
+	// values they are parsed into, so new flags are returned on every call.
+	convertFlags := func() []cli.Flag {
+		return []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Only log warnings and errors, and do not show progress (unless --progress is set)",
+			},
+			&cli.StringFlag{
+				Name:  "progress",
+				Usage: "Progress output: 'auto' (bars if stderr is a terminal), 'bars', 'json' or 'none'",
+				Value: "auto",
+			},
+			&cli.StringFlag{
+				Name:  "stats-json",
+				Usage: "Write conversion statistics as JSON (one object per image) to this file",
+			},
 			&cli.StringFlag{
 				Name:    "output",
 				Aliases: []string{"o"},
@@ -122,141 +272,1377 @@ func main() {
 			&cli.StringFlag{
 				Name:    "ref",
 				Aliases: []string{"r"},
-				Usage:   "Image reference (if more than one image is present)",
+				Usage:   "Image reference, manifest digest, or '@N' for the N-th (zero based) manifest (if more than one image is present)",
+			},
+			&cli.StringFlag{
+				Name:  "artifact-type",
+				Usage: "Convert an artifact of this type (whose layers are tarballs) rather than an image",
+			},
+			&cli.IntFlag{
+				Name:  "manifest-index",
+				Usage: "Select the N-th (zero based) manifest of the index, as with '--ref @N'",
 			},
 			&cli.StringFlag{
 				Name:    "platform",
 				Aliases: []string{"p"},
-				Usage:   "Target platform in the 'os/arch' format",
+				Usage:   "Target platform in the 'os/arch' format (defaults to the host platform, 'all' disables platform matching)",
 			},
-		}, persistentFlags...),
-		Before: util.BeforeAll(initLogger, initTelemetry),
-		After:  shutdownTelemetry,
-		Action: func(c *cli.Context) error {
-			if c.NArg() != 1 {
-				slog.Error("Image path is required")
-				return cli.ShowAppHelp(c)
+			&cli.BoolFlag{
+				Name:  "all-platforms",
+				Usage: "Convert every platform in the image index, writing one image per platform (eg. 'out-linux-amd64.erofs')",
+			},
+			&cli.StringFlag{
+				Name:  "platform-os-version",
+				Usage: "Target platform OS version (e.g. '10.0.17763.1234' for Windows images)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "platform-os-features",
+				Usage: "Target platform OS features (e.g. 'win32k' for Windows images)",
+			},
+			&cli.StringFlag{
+				Name:  "layers",
+				Usage: "Flatten only the layers in the range 'N..M' (zero based and inclusive, negative counts back from the top layer, eg. '..-2' skips the top layer)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "skip-layers",
+				Usage: "Digest of a layer to leave out when flattening the image (the diff ID for Docker archives)",
+			},
+			&cli.Int64Flag{
+				Name:  "max-manifest-size",
+				Usage: "Maximum size in bytes of image index, manifest, and config documents",
+				Value: oci2erofs.DefaultMaxManifestSize,
+			},
+			&cli.StringFlag{
+				Name:  "extra-entries",
+				Usage: "Path to a JSON file listing extra entries to inject into the image",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "Glob pattern of paths to drop from the image (eg. '/usr/share/doc' or '*.pyc')",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "Glob pattern of paths to keep even if they are excluded",
+			},
+			&cli.StringSliceFlag{
+				Name:  "add-dir",
+				Usage: "Merge a host directory onto the image, as 'dir' or 'dir:/target/path'",
+			},
+			&cli.StringSliceFlag{
+				Name:  "add-upper-dir",
+				Usage: "Apply an overlayfs upper directory (eg. a container's read-write layer) onto the image, honoring its whiteouts",
+			},
+			&cli.StringFlag{
+				Name:  "exclude-from",
+				Usage: "Path to a file listing patterns to exclude, one per line",
+			},
+			&cli.BoolFlag{
+				Name:  "reproducible",
+				Usage: "Clamp timestamps to SOURCE_DATE_EPOCH (or the Unix epoch if unset) for reproducible output",
+			},
+			&cli.StringFlag{
+				Name:  "mtime",
+				Usage: "Set all timestamps to this time (seconds since the epoch or RFC 3339)",
+			},
+			&cli.StringFlag{
+				Name:  "clamp-mtime",
+				Usage: "Clamp timestamps so that none are later than this time (seconds since the epoch or RFC 3339)",
+			},
+			&cli.BoolFlag{
+				Name:    "force",
+				Aliases: []string{"f"},
+				Usage:   "Overwrite the output file if it already exists",
+			},
+			&cli.BoolFlag{
+				Name:  "from-dir",
+				Usage: "Pack the given root filesystem directory as is, rather than converting an image",
+			},
+			&cli.BoolFlag{
+				Name:  "from-tar",
+				Usage: "Convert the given (optionally compressed) root filesystem tarball, rather than an image",
+			},
+			&cli.StringFlag{
+				Name:  "uuid",
+				Usage: "Filesystem UUID: a UUID, 'random', or 'digest' to derive it from the image digest",
+			},
+			&cli.StringFlag{
+				Name:  "label",
+				Usage: "Filesystem volume label (at most 16 bytes)",
+			},
+			&cli.IntFlag{
+				Name:  "block-size",
+				Usage: "Filesystem block size in bytes: 4096, 16384 or 65536 (larger blocks need a kernel with pages at least as large, eg. arm64 with 16K or 64K pages)",
+				Value: 4096,
+			},
+			&cli.StringFlag{
+				Name:  "compat",
+				Usage: "Oldest kernel release (eg. '5.10') that must be able to mount the image",
+			},
+			&cli.StringSliceFlag{
+				Name:  "disable-feature",
+				Usage: "EROFS feature the image must not use (eg. 'sb_chksum')",
+			},
+			&cli.StringFlag{
+				Name:  "inode-format",
+				Usage: "Inode format: 'auto' (compact where possible), 'extended' (keep every timestamp) or 'compact' (drop timestamps for smaller metadata)",
+				Value: "auto",
+			},
+			&cli.StringFlag{
+				Name:  "chown",
+				Usage: "Give every file the same 'uid:gid' owner (eg. '0:0')",
+			},
+			&cli.StringFlag{
+				Name:  "chmod-mask",
+				Usage: "Octal permission bits to clear from every file (eg. '022')",
+			},
+			&cli.StringSliceFlag{
+				Name:  "uidmap",
+				Usage: "Shift file owners by a 'container:host:size' user ID range (eg. '0:100000:65536')",
+			},
+			&cli.StringSliceFlag{
+				Name:  "gidmap",
+				Usage: "Shift file groups by a 'container:host:size' group ID range",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Load the image and lay out the filesystem, then print what would be built (file counts, estimated size, features) without writing anything",
+			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Keep the pulled blobs and partially written image of a failed or interrupted conversion next to the output, and pick up from them when run again",
+			},
+			&cli.BoolFlag{
+				Name:  "verify",
+				Usage: "Re-read the image once built and check that it matches the source image",
+			},
+			&cli.BoolFlag{
+				Name:  "verity",
+				Usage: "Append a dm-verity hash tree to the image and write its root hash alongside it",
+			},
+			&cli.StringFlag{
+				Name:  "verity-salt",
+				Usage: "Hex encoded dm-verity salt (defaults to random, or none for reproducible output)",
+			},
+			&cli.StringFlag{
+				Name:  "verity-sign",
+				Usage: "Path to a PEM encoded private key to sign the dm-verity root hash with (eg. image.roothash.p7s)",
+			},
+			&cli.StringFlag{
+				Name:  "verity-sign-cert",
+				Usage: "Path to the PEM encoded certificate of the --verity-sign key",
+			},
+			&cli.BoolFlag{
+				Name:  "gpt",
+				Usage: "Wrap the image in a GPT disk image (with a second partition for the dm-verity hash tree, if enabled)",
+			},
+			&cli.StringFlag{
+				Name:  "partition-type",
+				Usage: "Partition type GUID or name of the image's partition in the disk image (eg. 'root-x86-64', defaults to 'linux-generic')",
+			},
+			&cli.StringFlag{
+				Name:  "verity-partition-type",
+				Usage: "Partition type GUID or name of the dm-verity partition (defaults to the verity type matching --partition-type)",
+			},
+			&cli.StringFlag{
+				Name:  "username",
+				Usage: "Username for registry authentication (the password is read from stdin with --password-stdin)",
+			},
+			&cli.BoolFlag{
+				Name:  "password-stdin",
+				Usage: "Read the registry password from stdin",
+			},
+			&cli.StringSliceFlag{
+				Name:  "insecure-registry",
+				Usage: "Registry host (eg. 'localhost:5000') to access over plain HTTP",
+			},
+			&cli.StringSliceFlag{
+				Name:  "registry-mirror",
+				Usage: "Registry mirror in the 'registry=mirror' format (eg. 'docker.io=mirror.gcr.io'), tried before the registry",
+			},
+			&cli.StringFlag{
+				Name:    "docker-host",
+				Usage:   "Address of the Docker daemon, for docker-daemon: images",
+				EnvVars: []string{"DOCKER_HOST"},
+				Value:   "unix:///var/run/docker.sock",
+			},
+			&cli.StringFlag{
+				Name:  "containerd-address",
+				Usage: "Path of the containerd socket, for containerd:// images",
+				Value: "/run/containerd/containerd.sock",
+			},
+			&cli.StringFlag{
+				Name:  "containerd-namespace",
+				Usage: "Containerd namespace of containerd:// images",
+				Value: "default",
+			},
+			&cli.StringFlag{
+				Name:  "storage-root",
+				Usage: "Root of the image store of containers-storage: images (defaults to the podman image store of the user)",
+			},
+			&cli.IntFlag{
+				Name:  "max-concurrent-downloads",
+				Usage: "Number of blobs to download from the registry concurrently (defaults to --io-concurrency, or 3)",
+			},
+			&cli.IntFlag{
+				Name:  "max-download-attempts",
+				Usage: "Number of times to attempt each blob download, resuming interrupted downloads (defaults to 5)",
+			},
+			&cli.StringFlag{
+				Name:  "verify-signature",
+				Usage: "Path to a PEM cosign public key (eg. cosign.pub); the image must have a valid signature for it (registry images only). Keyless (Fulcio/Rekor) signatures and KMS keys are not supported",
+			},
+			&cli.BoolFlag{
+				Name:  "embed-provenance",
+				Usage: "Embed a manifest recording which layer each file came from",
+			},
+			&cli.BoolFlag{
+				Name:  "write-provenance",
+				Usage: "Write a manifest recording which layer each file came from alongside the image (eg. image.provenance.json)",
+			},
+			&cli.BoolFlag{
+				Name:  "embed-config",
+				Usage: "Store the image config (entrypoint, environment, labels etc.) in the image at /" + oci2erofs.ConfigPath,
+			},
+			&cli.StringSliceFlag{
+				Name:  "annotation",
+				Usage: "Annotation in the 'key=value' format (eg. 'git.sha=abc123') to store in the image at /" + oci2erofs.AnnotationsPath + ", can be repeated",
+			},
+			&cli.BoolFlag{
+				Name:  "write-config",
+				Usage: "Write the image config alongside the image (eg. image.config.json)",
+			},
+			&cli.BoolFlag{
+				Name:  "write-metadata",
+				Usage: "Write the digest, size and verity root hash of the image alongside it as JSON (eg. image.metadata.json)",
+			},
+			&cli.StringFlag{
+				Name:  "push",
+				Usage: "Push the image (with its verity root hash and metadata) to a registry as an OCI artifact (eg. 'oci://registry.example.com/images/app:v1')",
+			},
+			&cli.BoolFlag{
+				Name:  "embed-referrers",
+				Usage: "Store the artifacts referring to the image (eg. SBOMs and attestations) in the image at /" + oci2erofs.ReferrersPath,
+			},
+			&cli.BoolFlag{
+				Name:  "write-referrers",
+				Usage: "Write the artifacts referring to the image alongside the image as an OCI image layout (eg. image.referrers)",
+			},
+			&cli.StringFlag{
+				Name:  "sbom",
+				Usage: "Write an SBOM listing every file in the image alongside the image, in this format (spdx or cyclonedx)",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "Shape the image as a systemd extension (sysext or confext)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "oci-layout-version",
+				Usage: "Accepted OCI image layout versions (defaults to the current version)",
+			},
+			&cli.BoolFlag{
+				Name:  "best-effort-layout",
+				Usage: "Proceed if the OCI image layout file is missing or has an unaccepted version",
+			},
+			&cli.StringSliceFlag{
+				Name:  "blob-dir",
+				Usage: "Directory to search for blobs missing from an OCI image layout, laid out as <alg>/<encoded> (eg. skopeo's --shared-blob-dir), can be repeated",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-missing-foreign-layers",
+				Usage: "Skip foreign layers that are not in the image and cannot be downloaded from their URLs",
+			},
+			&cli.BoolFlag{
+				Name:  "strict-paths",
+				Usage: "Reject layers with entries beneath symbolic links, or symbolic links that climb above the root",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Fail on warnings, and on file names that cannot be stored in the image or that differ only by case, reporting the layer of each",
+			},
+			&cli.StringFlag{
+				Name:  "on-unsupported",
+				Usage: "What to do with device nodes, FIFOs and sockets, which cannot be stored in the image: error, skip or placeholder (an empty file); root filesystem tarballs skip them by default",
+			},
+			&cli.BoolFlag{
+				Name:  "ignore-layer-toc",
+				Usage: "Fully decompress eStargz and zstd:chunked layers rather than reading files on demand using their table of contents",
+			},
+			&cli.BoolFlag{
+				Name:  "lazy-pull",
+				Usage: "Read eStargz and zstd:chunked layers from the registry on demand with ranged requests, rather than downloading them in full",
+			},
+			&cli.Int64Flag{
+				Name:  "max-uncompressed-size",
+				Usage: "Maximum total size in bytes of the files in all layers (guards against decompression bombs)",
+			},
+			&cli.Int64Flag{
+				Name:  "max-file-size",
+				Usage: "Maximum size in bytes of a single file",
+			},
+			&cli.Int64Flag{
+				Name:  "max-entries",
+				Usage: "Maximum total number of entries in all layers",
+			},
+			&cli.IntFlag{
+				Name:    "jobs",
+				Aliases: []string{"j"},
+				Usage:   "Number of layers to decompress concurrently (defaults to the number of CPUs)",
+			},
+			&cli.StringFlag{
+				Name:    "tmpdir",
+				Usage:   "Directory for temporary files, such as pulled blobs and decompressed layers",
+				EnvVars: []string{"TMPDIR"},
+			},
+			&cli.Int64Flag{
+				Name:  "layer-memory-limit",
+				Usage: "Hold decompressed layers up to this size in bytes in memory rather than in temporary files",
+			},
+			&cli.Int64Flag{
+				Name:  "max-memory",
+				Usage: "Hold the metadata of the image being built up to this size in bytes in memory, spilling the rest to temporary files",
+			},
+			&cli.IntFlag{
+				Name:  "write-concurrency",
+				Usage: fmt.Sprintf("Number of files to write to the image concurrently (defaults to --io-concurrency, or %d)", oci2erofs.DefaultWriteConcurrency),
+			},
+			&cli.IntFlag{
+				Name:  "io-concurrency",
+				Usage: "Number of I/O bound operations (files written to the image, blobs downloaded) to run concurrently",
+			},
+			&cli.IntFlag{
+				Name:  "nice",
+				Usage: "Lower the CPU priority of the process to this niceness (1 to 19)",
+			},
+			&cli.StringFlag{
+				Name:  "ionice",
+				Usage: "Set the I/O priority of the process: idle or best-effort[:LEVEL] (LEVEL from 0 to 7)",
+			},
+			&cli.BoolFlag{
+				Name:  "preallocate",
+				Usage: "Reserve the full size of the image up front rather than leaving it sparse",
+			},
+			&cli.IntFlag{
+				Name:  "pad-percent",
+				Usage: "Append zeroed free space of this percentage of the image size",
+			},
+			&cli.Int64Flag{
+				Name:  "pad-size",
+				Usage: "Pad the image with zeroes to a multiple of this many bytes (eg. 1048576, or the size of the target partition)",
+			},
+			&cli.BoolFlag{
+				Name:  "hardlink-dedup",
+				Usage: "Write identical files as hard links to a single inode",
+			},
+			&cli.BoolFlag{
+				Name:  "dedupe",
+				Usage: "Write the data of files with identical contents once, shared by all of them (whatever their metadata)",
+			},
+			&cli.StringFlag{
+				Name:  "data-order",
+				Usage: "Path to an access order profile (one path per line) whose files have their data laid out first, in order, for faster readahead",
+			},
+			&cli.StringFlag{
+				Name:  "cache-dir",
+				Usage: "Directory in which to cache decompressed layers (defaults to the user cache directory)",
+			},
+			&cli.Int64Flag{
+				Name:  "cache-max-size",
+				Usage: "Maximum size in bytes of the layer cache, least recently used layers are evicted",
+				Value: 10 << 30,
+			},
+			&cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "Do not cache decompressed layers",
+			},
+			&cli.BoolFlag{
+				Name:  "lenient-media-type",
+				Usage: "Decompress layers according to their detected compression if it does not match their (or has an unrecognized) media type",
+			},
+		}
+	}
+
+	// convertOptions returns the conversion options given by the flags and
+	// arguments of the conversion command.
+	convertOptions := func(c *cli.Context) (*oci2erofs.Options, error) {
+		if c.Bool("all-platforms") && c.IsSet("platform") {
+			return nil, fmt.Errorf("--all-platforms cannot be combined with --platform")
+		}
+
+		if c.Bool("from-dir") && c.Bool("from-tar") {
+			return nil, fmt.Errorf("--from-dir cannot be combined with --from-tar")
+		}
+
+		if (c.Bool("from-dir") || c.Bool("from-tar")) && (c.Bool("all-platforms") || c.IsSet("platform") || c.IsSet("ref") || c.IsSet("manifest-index") || c.IsSet("artifact-type") || c.IsSet("layers") || c.IsSet("skip-layers")) {
+			return nil, fmt.Errorf("--from-dir and --from-tar cannot be combined with image selection flags")
+		}
+
+		ref := c.String("ref")
+		if c.IsSet("manifest-index") {
+			if c.IsSet("ref") {
+				return nil, fmt.Errorf("--manifest-index cannot be combined with --ref")
 			}
-			imagePath := c.Args().First()
 
-			tempDir, err := os.MkdirTemp("", "oci2erofs")
-			if err != nil {
-				return fmt.Errorf("failed to create temporary directory: %w", err)
+			if c.Int("manifest-index") < 0 {
+				return nil, fmt.Errorf("--manifest-index must not be negative")
 			}
-			defer os.RemoveAll(tempDir)
 
-			// Is the image a directory or a tarball?
-			fi, err := os.Stat(imagePath)
+			ref = fmt.Sprintf("@%d", c.Int("manifest-index"))
+		}
+
+		var platform *ocispecs.Platform
+		if c.String("platform") == "all" {
+			if c.IsSet("platform-os-version") || c.IsSet("platform-os-features") {
+				return nil, fmt.Errorf("platform 'all' cannot be combined with OS version or features")
+			}
+		} else if c.String("platform") != "" {
+			parsed, err := platforms.Parse(c.String("platform"))
 			if err != nil {
-				return fmt.Errorf("failed to open image: %w", err)
+				return nil, fmt.Errorf("failed to parse platform: %w", err)
 			}
+			platform = &parsed
+		}
 
-			var imageFS fs.FS
-			if fi.IsDir() {
-				imageFS = os.DirFS(imagePath)
-			} else {
-				imageFile, err := os.Open(imagePath)
-				if err != nil {
-					return fmt.Errorf("failed to open tarball: %w", err)
-				}
-				defer imageFile.Close()
+		if c.IsSet("platform-os-version") || c.IsSet("platform-os-features") {
+			if platform == nil {
+				defaultPlatform := platforms.DefaultSpec()
+				platform = &defaultPlatform
+			}
 
-				// Decompress the image if it is compressed.
-				dr, err := uncompr.NewReader(imageFile)
-				if err != nil {
-					return fmt.Errorf("failed to create decompressing reader: %w", err)
-				}
-				defer dr.Close()
+			platform.OSVersion = c.String("platform-os-version")
+			platform.OSFeatures = c.StringSlice("platform-os-features")
+		}
 
-				// Create a temporary file to store the decompressed image.
-				decompressedImageFile, err := os.OpenFile(
-					filepath.Join(tempDir, filepath.Base(imagePath)+".tar"), os.O_CREATE|os.O_RDWR, 0o644)
+		opts := oci2erofs.Options{
+			Image:                     c.Args().First(),
+			Output:                    c.String("output"),
+			Ref:                       ref,
+			ArtifactType:              c.String("artifact-type"),
+			Platform:                  platform,
+			FirstManifest:             c.String("platform") == "all",
+			AllPlatforms:              c.Bool("all-platforms"),
+			MaxManifestSize:           c.Int64("max-manifest-size"),
+			LayoutVersions:            c.StringSlice("oci-layout-version"),
+			BestEffortLayout:          c.Bool("best-effort-layout"),
+			BlobDirs:                  c.StringSlice("blob-dir"),
+			AllowMissingForeignLayers: c.Bool("allow-missing-foreign-layers"),
+			LenientMediaType:          c.Bool("lenient-media-type"),
+			StrictPaths:               c.Bool("strict-paths"),
+			Strict:                    c.Bool("strict"),
+			OnUnsupported:             oci2erofs.UnsupportedPolicy(c.String("on-unsupported")),
+			IgnoreLayerTOC:            c.Bool("ignore-layer-toc"),
+			LazyPull:                  c.Bool("lazy-pull"),
+			MaxUncompressedSize:       c.Int64("max-uncompressed-size"),
+			MaxFileSize:               c.Int64("max-file-size"),
+			MaxEntries:                c.Int64("max-entries"),
+			Jobs:                      c.Int("jobs"),
+			TempDir:                   c.String("tmpdir"),
+			LayerMemoryLimit:          c.Int64("layer-memory-limit"),
+			MaxMemory:                 c.Int64("max-memory"),
+			WriteConcurrency:          c.Int("write-concurrency"),
+			IOConcurrency:             c.Int("io-concurrency"),
+			Nice:                      c.Int("nice"),
+			Preallocate:               c.Bool("preallocate"),
+			PadPercent:                c.Int("pad-percent"),
+			PadSize:                   c.Int64("pad-size"),
+			HardlinkDedup:             c.Bool("hardlink-dedup"),
+			Dedupe:                    c.Bool("dedupe"),
+			LayerCacheMaxSize:         c.Int64("cache-max-size"),
+			EmbedProvenance:           c.Bool("embed-provenance"),
+			WriteProvenance:           c.Bool("write-provenance"),
+			EmbedConfig:               c.Bool("embed-config"),
+			WriteConfig:               c.Bool("write-config"),
+			WriteMetadata:             c.Bool("write-metadata"),
+			Push:                      c.String("push"),
+			EmbedReferrers:            c.Bool("embed-referrers"),
+			WriteReferrers:            c.Bool("write-referrers"),
+			SBOMFormat:                c.String("sbom"),
+			Profile:                   c.String("profile"),
+			Force:                     c.Bool("force"),
+			FromDir:                   c.Bool("from-dir"),
+			FromTar:                   c.Bool("from-tar"),
+			DryRun:                    c.Bool("dry-run"),
+			Resume:                    c.Bool("resume"),
+			Verify:                    c.Bool("verify"),
+			Verity:                    c.Bool("verity"),
+			GPT:                       c.Bool("gpt"),
+			PartitionType:             c.String("partition-type"),
+			VerityPartitionType:       c.String("verity-partition-type"),
+			VeritySignKey:             c.String("verity-sign"),
+			VeritySignCertificate:     c.String("verity-sign-cert"),
+			Label:                     c.String("label"),
+			BlockSize:                 c.Int("block-size"),
+			TargetKernel:              c.String("compat"),
+		}
+		if opts.Output == "" {
+			opts.Output = c.Args().Get(1)
+		}
+
+		if !c.Bool("no-cache") {
+			opts.LayerCacheDir = c.String("cache-dir")
+			if opts.LayerCacheDir == "" {
+				userCacheDir, err := os.UserCacheDir()
 				if err != nil {
-					_ = imageFile.Close()
-					return fmt.Errorf("failed to create temporary tar file: %w", err)
+					slog.Warn("Layer cache disabled, no user cache directory", slog.Any("error", err))
+				} else {
+					opts.LayerCacheDir = filepath.Join(userCacheDir, "oci2erofs")
 				}
-				defer decompressedImageFile.Close()
+			}
+		}
+
+		if c.IsSet("extra-entries") {
+			entries, err := oci2erofs.LoadExtraEntries(c.String("extra-entries"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load extra entries: %w", err)
+			}
+			opts.ExtraEntries = entries
+		}
 
-				if _, err := io.Copy(decompressedImageFile, dr); err != nil {
-					return fmt.Errorf("failed to decompress image: %w", err)
+		for _, s := range c.StringSlice("add-dir") {
+			source, target, _ := strings.Cut(s, ":")
+			if source == "" {
+				return nil, fmt.Errorf("invalid directory %q, expected 'dir' or 'dir:/target/path'", s)
+			}
+			if target == "" {
+				target = "/"
+			}
+			opts.AddDirs = append(opts.AddDirs, oci2erofs.AddDir{Source: source, Target: target})
+		}
+
+		opts.UpperDirs = c.StringSlice("add-upper-dir")
+
+		for _, a := range c.StringSlice("annotation") {
+			key, value, ok := strings.Cut(a, "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid annotation %q, expected 'key=value'", a)
+			}
+
+			if opts.Annotations == nil {
+				opts.Annotations = make(map[string]string)
+			}
+			opts.Annotations[key] = value
+		}
+
+		opts.Exclude = c.StringSlice("exclude")
+		opts.Include = c.StringSlice("include")
+		if c.IsSet("data-order") {
+			order, err := oci2erofs.LoadDataOrder(c.String("data-order"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load data order: %w", err)
+			}
+			opts.DataOrder = order
+		}
+
+		if c.IsSet("exclude-from") {
+			patterns, err := oci2erofs.LoadPatterns(c.String("exclude-from"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load exclude patterns: %w", err)
+			}
+			opts.Exclude = append(opts.Exclude, patterns...)
+		}
+
+		// Honor SOURCE_DATE_EPOCH (https://reproducible-builds.org/specs/source-date-epoch/).
+		if sourceDateEpoch := os.Getenv("SOURCE_DATE_EPOCH"); sourceDateEpoch != "" {
+			seconds, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+			}
+
+			epoch := time.Unix(seconds, 0)
+			opts.SourceDateEpoch = &epoch
+		} else if c.Bool("reproducible") {
+			epoch := time.Unix(0, 0)
+			opts.SourceDateEpoch = &epoch
+		}
+
+		if c.IsSet("mtime") {
+			mtime, err := util.ParseTime(c.String("mtime"))
+			if err != nil {
+				return nil, err
+			}
+			opts.ModTime = &mtime
+		}
+
+		if c.IsSet("clamp-mtime") {
+			mtime, err := util.ParseTime(c.String("clamp-mtime"))
+			if err != nil {
+				return nil, err
+			}
+			opts.ClampModTime = &mtime
+		}
+
+		if c.IsSet("username") || c.Bool("password-stdin") {
+			if !c.IsSet("username") {
+				return nil, fmt.Errorf("--password-stdin requires --username")
+			}
+
+			credentials := &oci2erofs.RegistryCredentials{Username: c.String("username")}
+			if c.Bool("password-stdin") {
+				if opts.Image == oci2erofs.Stdin {
+					return nil, fmt.Errorf("--password-stdin cannot be used when reading the image from stdin")
 				}
 
-				imageFS, err = tarfs.Open(decompressedImageFile)
+				password, err := io.ReadAll(os.Stdin)
 				if err != nil {
-					return fmt.Errorf("failed to open tarball: %w", err)
+					return nil, fmt.Errorf("failed to read password from stdin: %w", err)
 				}
+				credentials.Password = strings.TrimRight(string(password), "\r\n")
 			}
+			opts.RegistryCredentials = credentials
+		}
 
-			var platform *ocispecs.Platform
-			if c.String("platform") != "" {
-				parsed, err := platforms.Parse(c.String("platform"))
-				if err != nil {
-					return fmt.Errorf("failed to parse platform: %w", err)
-				}
-				platform = &parsed
+		opts.InsecureRegistries = c.StringSlice("insecure-registry")
+		opts.DockerHost = c.String("docker-host")
+		opts.ContainerdAddress = c.String("containerd-address")
+		opts.ContainerdNamespace = c.String("containerd-namespace")
+		opts.StorageRoot = c.String("storage-root")
+		opts.MaxConcurrentDownloads = c.Int("max-concurrent-downloads")
+		opts.MaxDownloadAttempts = c.Int("max-download-attempts")
+
+		for _, m := range c.StringSlice("registry-mirror") {
+			host, mirror, ok := strings.Cut(m, "=")
+			if !ok || host == "" || mirror == "" {
+				return nil, fmt.Errorf("invalid registry mirror %q, expected 'registry=mirror'", m)
 			}
 
-			// Determine if the image is a Docker or OCI image.
-			var dockerArchive, ociArchive bool
-			if _, err := imageFS.Open("manifest.json"); err == nil {
-				dockerArchive = true
+			if opts.RegistryMirrors == nil {
+				opts.RegistryMirrors = make(map[string][]string)
 			}
-			if !dockerArchive {
-				if _, err := imageFS.Open("oci-layout"); err == nil {
-					ociArchive = true
-				}
+			opts.RegistryMirrors[host] = append(opts.RegistryMirrors[host], mirror)
+		}
+
+		if c.IsSet("verify-signature") {
+			key, err := oci2erofs.LoadSignatureKey(c.String("verify-signature"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load signature key: %w", err)
 			}
-			if !dockerArchive && !ociArchive {
-				return fmt.Errorf("image is not a valid OCI or Docker image")
+			opts.SignatureKey = key
+		}
+
+		for _, name := range c.StringSlice("disable-feature") {
+			feature, err := oci2erofs.ParseFeature(name)
+			if err != nil {
+				return nil, err
 			}
+			opts.DisabledFeatures = append(opts.DisabledFeatures, feature)
+		}
 
-			var rootFS fs.FS
-			var closeAll func() error
-			if dockerArchive {
-				rootFS, closeAll, err = docker.LoadImage(tempDir, imageFS, c.String("ref"), platform)
-				if err != nil {
-					return fmt.Errorf("failed to load Docker image: %w", err)
+		inodeFormat, err := oci2erofs.ParseInodeFormat(c.String("inode-format"))
+		if err != nil {
+			return nil, err
+		}
+		opts.InodeFormat = inodeFormat
+
+		if c.IsSet("chown") {
+			owner, err := oci2erofs.ParseOwner(c.String("chown"))
+			if err != nil {
+				return nil, err
+			}
+			opts.Owner = &owner
+		}
+
+		if c.IsSet("chmod-mask") {
+			mask, err := strconv.ParseUint(c.String("chmod-mask"), 8, 32)
+			if err != nil || mask > 0o7777 {
+				return nil, fmt.Errorf("invalid permission mask %q", c.String("chmod-mask"))
+			}
+			opts.ModeMask = uint32(mask)
+		}
+
+		if c.IsSet("ionice") {
+			ioPriority, err := oci2erofs.ParseIOPriority(c.String("ionice"))
+			if err != nil {
+				return nil, err
+			}
+			opts.IOPriority = ioPriority
+		}
+
+		if c.IsSet("layers") {
+			r, err := oci2erofs.ParseLayerRange(c.String("layers"))
+			if err != nil {
+				return nil, err
+			}
+			opts.LayerRange = &r
+		}
+
+		for _, s := range c.StringSlice("skip-layers") {
+			dgst, err := digest.Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid layer digest %q: %w", s, err)
+			}
+			opts.SkipLayers = append(opts.SkipLayers, dgst)
+		}
+
+		for _, s := range c.StringSlice("uidmap") {
+			m, err := oci2erofs.ParseIDMap(s)
+			if err != nil {
+				return nil, err
+			}
+			opts.UIDMap = append(opts.UIDMap, m)
+		}
+
+		for _, s := range c.StringSlice("gidmap") {
+			m, err := oci2erofs.ParseIDMap(s)
+			if err != nil {
+				return nil, err
+			}
+			opts.GIDMap = append(opts.GIDMap, m)
+		}
+
+		switch c.String("uuid") {
+		case "":
+		case "digest":
+			opts.DigestUUID = true
+		case "random":
+			var uuid [16]byte
+			if _, err := rand.Read(uuid[:]); err != nil {
+				return nil, fmt.Errorf("failed to generate UUID: %w", err)
+			}
+			// Version 4, RFC 4122 variant.
+			uuid[6] = (uuid[6] & 0x0f) | 0x40
+			uuid[8] = (uuid[8] & 0x3f) | 0x80
+			opts.UUID = &uuid
+		default:
+			uuid, err := util.ParseUUID(c.String("uuid"))
+			if err != nil {
+				return nil, err
+			}
+			opts.UUID = &uuid
+		}
+
+		if c.IsSet("verity-salt") {
+			salt, err := hex.DecodeString(c.String("verity-salt"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid verity salt: %w", err)
+			}
+			opts.VeritySalt = salt
+		}
+
+		return &opts, nil
+	}
+
+	app := &cli.App{
+		Name:           "oci2erofs",
+		Usage:          "Convert OCI images into EROFS filesystems",
+		Version:        constants.Version,
+		ArgsUsage:      "image_path|docker://reference|docker-daemon:name|containerd://name|containers-storage:name|- [output_path]",
+		Flags:          append(convertFlags(), persistentFlags...),
+		Before:         util.BeforeAll(initLogger, checkErrorFormat, initTelemetry, initOTLP, initPprof),
+		After:          shutdown,
+		ExitErrHandler: handleExitError,
+		Commands: []*cli.Command{
+			{
+				Name:      "inspect",
+				Usage:     "Print information about an EROFS image",
+				ArgsUsage: "image.erofs",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:    "list",
+						Aliases: []string{"l"},
+						Usage:   "List the file tree",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output in JSON format",
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						slog.Error("Image path is required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					f, err := os.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open image: %w", err)
+					}
+					defer f.Close()
+
+					report, err := inspect.Inspect(f, c.Bool("list"))
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("json") {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						return enc.Encode(report)
+					}
+
+					return report.WriteText(os.Stdout)
+				},
+			},
+			{
+				Name:      "extract",
+				Usage:     "Unpack an EROFS image into a directory",
+				ArgsUsage: "image.erofs output_dir",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-same-owner",
+						Usage: "Extract files as the current user (the default when not running as root)",
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						slog.Error("Image path and output directory are required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					f, err := os.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open image: %w", err)
+					}
+					defer f.Close()
+
+					return extract.Extract(c.Context, f, c.Args().Get(1), &extract.Options{
+						NoSameOwner: c.Bool("no-same-owner") || os.Geteuid() != 0,
+					})
+				},
+			},
+			{
+				Name:      "mount",
+				Usage:     "Mount an EROFS image read-only using FUSE (runs until interrupted)",
+				ArgsUsage: "image.erofs mountpoint",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "allow-other",
+						Usage: "Allow other users to access the mounted image",
+					},
+					&cli.BoolFlag{
+						Name:  "debug",
+						Usage: "Log every FUSE request",
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						slog.Error("Image path and mountpoint are required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					f, err := os.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open image: %w", err)
+					}
+					defer f.Close()
+
+					slog.Info("Mounting image, press Ctrl+C to unmount",
+						slog.String("image", c.Args().First()), slog.String("mountpoint", c.Args().Get(1)))
+
+					return fusefs.Mount(c.Context, f, c.Args().Get(1), &fusefs.Options{
+						AllowOther: c.Bool("allow-other"),
+						Debug:      c.Bool("debug"),
+					})
+				},
+			},
+			{
+				Name:      "sbom",
+				Usage:     "Print an SBOM listing every file in an EROFS image",
+				ArgsUsage: "image.erofs",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "SBOM format (spdx or cyclonedx)",
+						Value: sbom.FormatSPDX,
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						slog.Error("Image path is required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					f, err := os.Open(c.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to open image: %w", err)
+					}
+					defer f.Close()
+
+					imageFS, err := erofs.Open(f)
+					if err != nil {
+						return fmt.Errorf("failed to open image: %w", err)
+					}
+
+					doc, err := sbom.Generate(c.Context, imageFS, c.String("format"), &sbom.Options{
+						Name: filepath.Base(c.Args().First()),
+					})
+					if err != nil {
+						return err
+					}
+
+					_, err = os.Stdout.Write(doc)
+					return err
+				},
+			},
+			{
+				Name:      "validate",
+				Usage:     "Check an OCI image layout for problems before converting it",
+				ArgsUsage: "layout",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "platform",
+						Usage: "Platform in the 'os/arch' format that must be provided by an image (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "oci-layout-version",
+						Usage: "Accepted OCI image layout versions (defaults to the current version)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "blob-dir",
+						Usage: "Directory to search for blobs missing from the layout, laid out as <alg>/<encoded> (can be repeated)",
+					},
+					&cli.Int64Flag{
+						Name:  "max-manifest-size",
+						Usage: "Maximum size in bytes of the image index and manifest documents",
+						Value: oci2erofs.DefaultMaxManifestSize,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output in JSON format",
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						slog.Error("Layout path is required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					var required []ocispecs.Platform
+					for _, s := range c.StringSlice("platform") {
+						platform, err := platforms.Parse(s)
+						if err != nil {
+							return fmt.Errorf("failed to parse platform: %w", err)
+						}
+						required = append(required, platform)
+					}
+
+					layoutPath := c.Args().First()
+					fi, err := os.Stat(layoutPath)
+					if err != nil {
+						return fmt.Errorf("failed to open layout: %w", err)
+					}
+
+					// Layouts are either directories or (uncompressed) tarballs.
+					var imageFS fs.FS
+					if fi.IsDir() {
+						imageFS = os.DirFS(layoutPath)
+					} else {
+						f, err := os.Open(layoutPath)
+						if err != nil {
+							return fmt.Errorf("failed to open layout: %w", err)
+						}
+						defer f.Close()
+
+						imageFS, err = tarfs.Open(f)
+						if err != nil {
+							return fmt.Errorf("failed to open layout: %w", err)
+						}
+					}
+
+					var blobDirs []fs.FS
+					for _, dir := range c.StringSlice("blob-dir") {
+						blobDirs = append(blobDirs, os.DirFS(dir))
+					}
+
+					report, err := oci.Validate(c.Context, imageFS, required, &oci.Options{
+						LayoutVersions:  c.StringSlice("oci-layout-version"),
+						BlobDirs:        blobDirs,
+						MaxManifestSize: c.Int64("max-manifest-size"),
+					})
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("json") {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						if err := enc.Encode(report); err != nil {
+							return err
+						}
+					} else {
+						var provided []string
+						for _, platform := range report.Platforms {
+							provided = append(provided, util.FormatPlatform(platform))
+						}
+
+						fmt.Printf("Checked %d blobs, platforms: %s\n", report.Blobs, strings.Join(provided, ", "))
+						for _, p := range report.Problems {
+							fmt.Println(p)
+						}
+					}
+
+					if !report.Valid() {
+						return fmt.Errorf("layout is invalid: %d problem(s) found", len(report.Problems))
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Report files added, removed or changed between two EROFS images, or between a directory and an image",
+				ArgsUsage: "a.erofs b.erofs | --against-dir dir image.erofs",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output in JSON format",
+					},
+					&cli.BoolFlag{
+						Name:  "ignore-mtime",
+						Usage: "Ignore changes to file modification times",
+					},
+					&cli.StringFlag{
+						Name:  "against-dir",
+						Usage: "Compare the image against a directory (eg. the /usr of the running system), reporting what replacing it with the image would change",
+					},
+					&cli.StringFlag{
+						Name:  "image-path",
+						Usage: "Compare only the tree below this directory of the images (eg. usr)",
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					var trees []archivefs.ReadLinkFS
+					if dir := c.String("against-dir"); dir != "" {
+						if c.NArg() != 1 {
+							slog.Error("One image path is required")
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						fi, err := os.Stat(dir)
+						if err != nil {
+							return fmt.Errorf("failed to open directory: %w", err)
+						}
+						if !fi.IsDir() {
+							return fmt.Errorf("%s is not a directory", dir)
+						}
+
+						trees = append(trees, dirfs.New(dir))
+					} else if c.NArg() != 2 {
+						slog.Error("Two image paths are required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					for _, imagePath := range c.Args().Slice() {
+						f, err := os.Open(imagePath)
+						if err != nil {
+							return fmt.Errorf("failed to open image: %w", err)
+						}
+						defer f.Close()
+
+						fsys, err := erofs.Open(f)
+						if err != nil {
+							return fmt.Errorf("failed to open image %q: %w", imagePath, err)
+						}
+
+						tree, err := diff.Sub(fsys, c.String("image-path"))
+						if err != nil {
+							return fmt.Errorf("failed to open %q of image %q: %w", c.String("image-path"), imagePath, err)
+						}
+
+						trees = append(trees, tree)
+					}
+
+					changes, err := diff.Compare(trees[0], trees[1], &diff.Options{
+						IgnoreModTime: c.Bool("ignore-mtime"),
+					})
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("json") {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						if err := enc.Encode(changes); err != nil {
+							return err
+						}
+					} else if err := diff.WriteText(os.Stdout, changes); err != nil {
+						return err
+					}
+
+					// Like diff(1), exit with a non-zero status if the images differ.
+					if len(changes) > 0 {
+						return cli.Exit("", 1)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "batch",
+				Usage:     "Convert every image listed in a job file",
+				ArgsUsage: "jobs.yaml",
+				Flags: append([]cli.Flag{
+					&cli.IntFlag{
+						Name:    "parallel",
+						Aliases: []string{"p"},
+						Usage:   "Number of images to convert concurrently",
+						Value:   2,
+					},
+				}, persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						slog.Error("Job file path is required")
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					f, err := batch.Load(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					// Parse the options of every job up front, so that a mistake in
+					// the job file is reported before anything is converted.
+					jobOpts := make(map[string]*oci2erofs.Options, len(f.Jobs))
+					for i, job := range f.Jobs {
+						set := flag.NewFlagSet(job.Output, flag.ContinueOnError)
+						set.SetOutput(io.Discard)
+						for _, fl := range convertFlags() {
+							if err := fl.Apply(set); err != nil {
+								return err
+							}
+						}
+
+						if err := set.Parse(f.CommandLine(job)); err != nil {
+							return fmt.Errorf("job %d: %w", i, err)
+						}
+
+						jc := cli.NewContext(c.App, set, c)
+						if jc.NArg() != 2 {
+							return fmt.Errorf("job %d: unexpected arguments %q", i, jc.Args().Slice()[2:])
+						}
+
+						if jc.Bool("password-stdin") {
+							return fmt.Errorf("job %d: --password-stdin is not supported in job files", i)
+						}
+
+						opts, err := convertOptions(jc)
+						if err != nil {
+							return fmt.Errorf("job %d: %w", i, err)
+						}
+
+						if opts.Output == "-" {
+							return fmt.Errorf("job %d: images cannot be written to stdout", i)
+						}
+
+						jobOpts[job.Output] = opts
+					}
+
+					return batch.Run(c.Context, f.Jobs, c.Int("parallel"), func(ctx context.Context, job batch.Job) error {
+						slog.Info("Converting image", slog.String("image", job.Image), slog.String("output", job.Output))
+
+						start := time.Now()
+						if err := oci2erofs.Convert(ctx, jobOpts[job.Output]); err != nil {
+							return err
+						}
+
+						slog.Info("Converted image", slog.String("image", job.Image), slog.String("output", job.Output),
+							slog.Duration("duration", time.Since(start)))
+
+						return nil
+					})
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Serve an HTTP API converting images on demand (conversion flags set the defaults of every job)",
+				Flags: append(append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to listen on",
+						Value: "localhost:8080",
+					},
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Directory to write converted images to (default: a temporary directory removed on exit)",
+					},
+					&cli.IntFlag{
+						Name:  "parallel",
+						Usage: "Number of images to convert concurrently",
+						Value: 2,
+					},
+					&cli.DurationFlag{
+						Name:  "retention",
+						Usage: "How long to keep finished jobs and their images (0 keeps them until deleted)",
+						Value: time.Hour,
+					},
+					&cli.BoolFlag{
+						Name:  "allow-local-images",
+						Usage: "Allow jobs to convert images other than those pulled from a registry (eg. paths on the server)",
+					},
+				}, convertFlags()...), persistentFlags...),
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 0 {
+						return cli.ShowSubcommandHelp(c)
+					}
+
+					for _, name := range []string{"output", "from-dir", "from-tar", "all-platforms", "password-stdin"} {
+						if c.IsSet(name) {
+							return fmt.Errorf("--%s cannot be used with serve", name)
+						}
+					}
+
+					defaults, err := convertOptions(c)
+					if err != nil {
+						return err
+					}
+
+					dir := c.String("dir")
+					if dir == "" {
+						dir, err = os.MkdirTemp(defaults.TempDir, "oci2erofs-serve-")
+						if err != nil {
+							return fmt.Errorf("failed to create output directory: %w", err)
+						}
+						defer os.RemoveAll(dir)
+					}
+
+					srv, err := server.New(&server.Options{
+						Dir:              dir,
+						Parallel:         c.Int("parallel"),
+						Retention:        c.Duration("retention"),
+						AllowLocalImages: c.Bool("allow-local-images"),
+						Defaults:         *defaults,
+					})
+					if err != nil {
+						return err
+					}
+					defer srv.Close()
+
+					httpServer := &http.Server{
+						Addr:              c.String("listen"),
+						Handler:           srv,
+						ReadHeaderTimeout: 10 * time.Second,
+					}
+
+					go func() {
+						<-c.Context.Done()
+
+						ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+						defer cancel()
+
+						_ = httpServer.Shutdown(ctx)
+					}()
+
+					slog.Info("Listening", slog.String("address", httpServer.Addr))
+
+					if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						return err
+					}
+
+					return nil
+				},
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 || c.NArg() > 2 {
+				slog.Error("Image path is required")
+				return cli.ShowAppHelp(c)
+			}
+
+			opts, err := convertOptions(c)
+			if err != nil {
+				return err
+			}
+
+			// Stream the image to stdout.
+			if opts.Output == "-" {
+				opts.Output = ""
+				opts.OutputWriter = os.Stdout
+			}
+
+			progressMode := c.String("progress")
+			if c.Bool("quiet") && !c.IsSet("progress") {
+				progressMode = "none"
+			} else if progressMode == "auto" {
+				progressMode = "none"
+				if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+					progressMode = "bars"
 				}
-			} else {
-				rootFS, closeAll, err = oci.LoadImage(tempDir, imageFS, c.String("ref"), platform)
+			}
+
+			// Print a summary of each image once it has been written.
+			var summaryWriter io.Writer
+			if !c.Bool("quiet") && progressMode != "json" {
+				summaryWriter = os.Stderr
+			}
+
+			var statsEncoder *json.Encoder
+			if c.IsSet("stats-json") {
+				f, err := os.Create(c.String("stats-json"))
 				if err != nil {
-					return fmt.Errorf("failed to load OCI image: %w", err)
+					return fmt.Errorf("failed to create statistics file: %w", err)
 				}
+				defer f.Close()
+
+				statsEncoder = json.NewEncoder(f)
 			}
-			defer func() {
-				if err := closeAll(); err != nil {
-					slog.Warn("Failed to close image layers", slog.Any("error", err))
+
+			switch progressMode {
+			case "bars":
+				bars := progress.NewBars(os.Stderr)
+				defer bars.Close()
+
+				// Log above the bars rather than over them.
+				logger, err := newLogger(c, bars)
+				if err != nil {
+					return err
 				}
-			}()
 
-			outputPath := c.String("output")
-			if outputPath == "" {
-				if fi.IsDir() {
-					outputPath = filepath.Base(imagePath) + ".erofs"
-				} else {
-					outputPath = strings.TrimSuffix(filepath.Base(imagePath), filepath.Ext(imagePath)) + ".erofs"
+				defaultLogger := slog.Default()
+				slog.SetDefault(logger)
+				defer slog.SetDefault(defaultLogger)
+
+				opts.Progress = bars.Report
+				if summaryWriter != nil {
+					summaryWriter = bars
 				}
+			case "json":
+				opts.Progress = progress.NewJSON(os.Stderr).Report
+			case "none":
+			default:
+				return fmt.Errorf("invalid progress output %q", c.String("progress"))
 			}
 
-			// Remove the output file if it already exists.
-			_ = os.Remove(outputPath)
+			// The plan is the output of a dry run, so print it regardless.
+			if c.Bool("dry-run") {
+				summaryWriter = os.Stdout
+			}
 
-			outputFile, err := os.Create(outputPath)
-			if err != nil {
-				return fmt.Errorf("failed to create output file: %w", err)
+			var statsErr error
+			if summaryWriter != nil || statsEncoder != nil {
+				opts.OnStats = func(stats *oci2erofs.Stats) {
+					if summaryWriter != nil {
+						if err := stats.WriteText(summaryWriter); err != nil {
+							slog.Warn("Failed to write summary", slog.Any("error", err))
+						}
+					}
+
+					if statsEncoder != nil && statsErr == nil {
+						statsErr = statsEncoder.Encode(stats)
+					}
+				}
+			}
+
+			if err := oci2erofs.Convert(c.Context, opts); err != nil {
+				return err
 			}
-			defer outputFile.Close()
 
-			if err := erofs.Create(outputFile, rootFS); err != nil {
-				return fmt.Errorf("failed to create EROFS filesystem: %w", err)
+			if statsErr != nil {
+				return fmt.Errorf("failed to write statistics: %w", statsErr)
 			}
 
 			return nil
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		slog.Error("Error", slog.Any("error", err))
-		os.Exit(1)
+	// Cancel the conversion (and clean up) on interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if errorFormat == "json" {
+			_ = json.NewEncoder(os.Stderr).Encode(exitcode.NewError(err))
+		} else {
+			slog.Error("Error", slog.Any("error", err))
+		}
+
+		os.Exit(int(exitcode.For(err)))
 	}
 }
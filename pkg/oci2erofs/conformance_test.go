@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs_test
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConformance converts a matrix of images, verifying each against its
+// (overlay) source, and checks that the image reads back as a conformant
+// io/fs file system. Real-world images are fetched from their registries if
+// OCI2EROFS_TEST_REMOTE is set.
+func TestConformance(t *testing.T) {
+	type image struct {
+		opts     oci2erofs.Options
+		expected []string
+	}
+
+	images := map[string]image{
+		"Toybox": {
+			opts:     oci2erofs.Options{Image: "../../testdata/toybox.tar"},
+			expected: []string{"usr/bin/toybox", "bin", "init"},
+		},
+		"Toybox Multiarch": {
+			opts: oci2erofs.Options{
+				Image:    "../../internal/oci/testdata/toybox-multiarch",
+				Ref:      "docker.io/tianon/toybox:0.8.11",
+				Platform: &ocispecs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			},
+			expected: []string{"usr/bin/toybox"},
+		},
+		"PAX": {
+			opts:     oci2erofs.Options{Image: "../../testdata/pax/gnu.tar", FromTar: true},
+			expected: []string{"link"},
+		},
+	}
+
+	if os.Getenv("OCI2EROFS_TEST_REMOTE") != "" {
+		images["Alpine"] = image{
+			opts:     oci2erofs.Options{Image: "docker://docker.io/library/alpine:3.20"},
+			expected: []string{"bin/busybox", "etc/alpine-release"},
+		}
+		images["Debian"] = image{
+			opts:     oci2erofs.Options{Image: "docker://docker.io/library/debian:bookworm-slim"},
+			expected: []string{"usr/bin/bash", "etc/debian_version"},
+		}
+		images["Distroless"] = image{
+			opts:     oci2erofs.Options{Image: "docker://gcr.io/distroless/static-debian12:latest"},
+			expected: []string{"etc/passwd", "usr/share/zoneinfo/UTC"},
+		}
+	}
+
+	epoch := time.Unix(0, 0)
+	variants := map[string]func(opts *oci2erofs.Options){
+		"Default":        func(*oci2erofs.Options) {},
+		"Reproducible":   func(opts *oci2erofs.Options) { opts.SourceDateEpoch = &epoch },
+		"Compact Inodes": func(opts *oci2erofs.Options) { opts.InodeFormat = oci2erofs.InodeFormatCompact },
+		"Large Blocks":   func(opts *oci2erofs.Options) { opts.BlockSize = 65536 },
+	}
+
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			for variant, apply := range variants {
+				t.Run(variant, func(t *testing.T) {
+					outputPath := filepath.Join(t.TempDir(), "image.erofs")
+
+					opts := img.opts
+					opts.Output = outputPath
+					opts.TempDir = t.TempDir()
+					opts.Verify = true
+					apply(&opts)
+
+					require.NoError(t, oci2erofs.Convert(context.Background(), &opts))
+
+					f, err := os.Open(outputPath)
+					require.NoError(t, err)
+					t.Cleanup(func() {
+						require.NoError(t, f.Close())
+					})
+
+					fsys, err := oci2erofs.OpenImage(f)
+					require.NoError(t, err)
+
+					require.NoError(t, fstest.TestFS(&resolvableFS{fsys}, img.expected...))
+				})
+			}
+		})
+	}
+}
+
+// resolvableFS hides symbolic links that do not resolve within the image
+// (eg. /etc/mtab, which points into /proc), as fstest.TestFS expects every
+// entry it lists to open.
+type resolvableFS struct {
+	*oci2erofs.ImageFS
+}
+
+func (fsys *resolvableFS) Open(name string) (fs.File, error) {
+	f, err := fsys.ImageFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.(fs.ReadDirFile); !ok {
+		return f, nil
+	}
+
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &resolvableDir{ReadDirFile: f.(fs.ReadDirFile), entries: entries}, nil
+}
+
+func (fsys *resolvableFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fsys.ImageFS.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolvable []fs.DirEntry
+	for _, e := range entries {
+		if e.Type()&fs.ModeSymlink != 0 {
+			if _, err := fsys.Stat(path.Join(name, e.Name())); err != nil {
+				continue
+			}
+		}
+
+		resolvable = append(resolvable, e)
+	}
+
+	return resolvable, nil
+}
+
+type resolvableDir struct {
+	fs.ReadDirFile
+	entries []fs.DirEntry
+}
+
+func (d *resolvableDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+
+	return entries, nil
+}
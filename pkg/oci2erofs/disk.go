@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package oci2erofs
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/gpt"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/verity"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultPartitionName is the name of the image's partition when the image
+// has no label.
+const defaultPartitionName = "erofs"
+
+// writeDisk writes a GPT disk image holding the EROFS filesystem of fsSize
+// bytes in f as a partition, followed by partitions holding its dm-verity
+// hash tree and the signature of its root hash (if any), to a new temporary
+// file. It returns the disk image and its size.
+func writeDisk(ctx context.Context, f *os.File, fsSize int64, tree *verity.Tree, signature []byte, tempDir, pattern string, opts *Options) (*os.File, int64, error) {
+	partitionType, err := gpt.ParseType(partitionTypeOrDefault(opts.PartitionType))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name := opts.Label
+	if name == "" {
+		name = defaultPartitionName
+	}
+
+	data := gpt.Partition{
+		Type:       partitionType,
+		Name:       name,
+		Attributes: gpt.AttributeReadOnly,
+		Data:       io.NewSectionReader(f, 0, fsSize),
+	}
+
+	partitions := []gpt.Partition{data}
+	var seed string
+	if tree != nil {
+		verityType, err := verityPartitionType(partitionType, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// As per the Discoverable Partitions Specification, the partition
+		// UUIDs are the first and last 128 bits of the root hash.
+		copy(partitions[0].GUID[:], tree.RootHash[:16])
+		partitions = append(partitions, gpt.Partition{
+			Type:       verityType,
+			Name:       name + "-verity",
+			Attributes: gpt.AttributeReadOnly,
+			Data:       io.NewSectionReader(f, tree.HashOffset, tree.Size),
+		})
+		copy(partitions[1].GUID[:], tree.RootHash[len(tree.RootHash)-16:])
+
+		if signature != nil {
+			signatureType, ok := gpt.VeritySignatureType(partitionType)
+			if !ok {
+				signatureType, _ = gpt.ParseType("linux-generic")
+			}
+
+			partitions = append(partitions, gpt.Partition{
+				Type:       signatureType,
+				GUID:       util.NameUUID("verity-sig:" + hex.EncodeToString(tree.RootHash)),
+				Name:       name + "-verity-sig",
+				Attributes: gpt.AttributeReadOnly,
+				Data:       io.NewSectionReader(bytes.NewReader(signature), 0, int64(len(signature))),
+			})
+		}
+
+		seed = hex.EncodeToString(tree.RootHash)
+	} else {
+		// Derive the partition UUID from the filesystem, so that the disk
+		// image is reproducible.
+		dgst, err := digest.SHA256.FromReader(util.ContextReader(ctx, io.NewSectionReader(f, 0, fsSize)))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to hash image: %w", err)
+		}
+
+		partitions[0].GUID = util.NameUUID(dgst.String())
+		seed = dgst.String()
+	}
+
+	diskFile, err := os.CreateTemp(tempDir, pattern)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create disk image: %w", err)
+	}
+
+	size, err := gpt.Write(ctx, diskFile, util.NameUUID("disk:"+seed), partitions)
+	if err != nil {
+		_ = diskFile.Close()
+		_ = os.Remove(diskFile.Name())
+		return nil, 0, fmt.Errorf("failed to write disk image: %w", err)
+	}
+
+	return diskFile, size, nil
+}
+
+// partitionTypeOrDefault returns the partition type, defaulting to a generic
+// Linux filesystem.
+func partitionTypeOrDefault(partitionType string) string {
+	if partitionType == "" {
+		return "linux-generic"
+	}
+
+	return partitionType
+}
+
+// verityPartitionType returns the type of the partition holding the dm-verity
+// hash tree, defaulting to the verity type that matches the type of the
+// image's partition.
+func verityPartitionType(partitionType [16]byte, opts *Options) ([16]byte, error) {
+	if opts.VerityPartitionType != "" {
+		return gpt.ParseType(opts.VerityPartitionType)
+	}
+
+	if verityType, ok := gpt.VerityType(partitionType); ok {
+		return verityType, nil
+	}
+
+	return gpt.ParseType("linux-generic")
+}
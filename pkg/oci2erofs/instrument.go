@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer and meter of conversions.
+const instrumentationName = "github.com/immutos/oci2erofs"
+
+// startSpan starts a span as a child of the span in ctx. Only the root span
+// of a conversion is started with Options.TracerProvider, the others inherit
+// it from their parent.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName).
+		Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceLayer records a span for a layer once it has been loaded (as layers
+// are loaded concurrently, deep within the image loaders).
+func traceLayer(ctx context.Context, l LayerStats) {
+	end := time.Now()
+
+	_, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName).
+		Start(ctx, "layer", trace.WithTimestamp(end.Add(-l.Duration)), trace.WithAttributes(
+			attribute.String("oci2erofs.layer.path", l.Path),
+			attribute.Int64("oci2erofs.layer.size", l.Size),
+			attribute.Int64("oci2erofs.layer.uncompressed_size", l.UncompressedSize),
+			attribute.Bool("oci2erofs.layer.cached", l.Cached),
+		))
+	span.End(trace.WithTimestamp(end))
+}
+
+// metrics are the instruments conversions are recorded with.
+type metrics struct {
+	conversions    metric.Int64Counter
+	images         metric.Int64Counter
+	layers         metric.Int64Counter
+	inputBytes     metric.Int64Counter
+	decompressed   metric.Int64Counter
+	outputBytes    metric.Int64Counter
+	phaseDurations metric.Float64Histogram
+}
+
+func newMetrics(provider metric.MeterProvider) *metrics {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(instrumentationName)
+
+	// Failing to create an instrument leaves a no-op one in its place.
+	var m metrics
+	var errs [7]error
+	m.conversions, errs[0] = meter.Int64Counter("oci2erofs.conversions",
+		metric.WithDescription("Conversions run, by result"), metric.WithUnit("{conversion}"))
+	m.images, errs[1] = meter.Int64Counter("oci2erofs.images",
+		metric.WithDescription("EROFS images written"), metric.WithUnit("{image}"))
+	m.layers, errs[2] = meter.Int64Counter("oci2erofs.layers",
+		metric.WithDescription("Layers loaded, by whether they were read from the layer cache"), metric.WithUnit("{layer}"))
+	m.inputBytes, errs[3] = meter.Int64Counter("oci2erofs.layer.input",
+		metric.WithDescription("Compressed size of the layers loaded"), metric.WithUnit("By"))
+	m.decompressed, errs[4] = meter.Int64Counter("oci2erofs.layer.uncompressed",
+		metric.WithDescription("Uncompressed size of the layers loaded"), metric.WithUnit("By"))
+	m.outputBytes, errs[5] = meter.Int64Counter("oci2erofs.image.size",
+		metric.WithDescription("Size of the EROFS images written"), metric.WithUnit("By"))
+	m.phaseDurations, errs[6] = meter.Float64Histogram("oci2erofs.phase.duration",
+		metric.WithDescription("Wall time of each phase of a conversion"), metric.WithUnit("s"))
+	if err := errors.Join(errs[:]...); err != nil {
+		slog.Debug("Failed to create metric instruments", slog.Any("error", err))
+	}
+
+	return &m
+}
+
+// recordConversion records the result of a conversion.
+func (m *metrics) recordConversion(ctx context.Context, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.conversions.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+}
+
+// recordImage records the statistics of an image written.
+func (m *metrics) recordImage(ctx context.Context, stats *Stats) {
+	m.images.Add(ctx, 1)
+	m.outputBytes.Add(ctx, stats.ImageSize)
+
+	for _, l := range stats.Layers {
+		m.layers.Add(ctx, 1, metric.WithAttributes(attribute.Bool("cached", l.Cached)))
+		m.inputBytes.Add(ctx, l.Size)
+		m.decompressed.Add(ctx, l.UncompressedSize)
+	}
+
+	p := stats.Phases
+	for phase, d := range map[string]time.Duration{
+		"pull":   p.Pull,
+		"load":   p.Load,
+		"scan":   p.Scan,
+		"write":  p.Write,
+		"verify": p.Verify,
+		"verity": p.Verity,
+		"total":  p.Total,
+	} {
+		if d > 0 {
+			m.phaseDurations.Record(ctx, d.Seconds(), metric.WithAttributes(attribute.String("phase", phase)))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/verity"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Metadata describes a built image, so that it can be referenced by other
+// tools without hashing it again (see Options.WriteMetadata).
+type Metadata struct {
+	// Digest is the digest of the image file (including any dm-verity hash
+	// tree).
+	Digest digest.Digest `json:"digest"`
+	// Size is the size in bytes of the image file.
+	Size int64 `json:"size"`
+	// FilesystemSize is the size in bytes of the EROFS filesystem, excluding
+	// any dm-verity hash tree.
+	FilesystemSize int64 `json:"filesystemSize"`
+	// Verity describes the dm-verity hash tree, if one was appended.
+	Verity *VerityMetadata `json:"verity,omitempty"`
+	// SourceDigest is the digest of the source image manifest (or the image
+	// ID of Docker images), if an image was converted.
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// Platform is the platform of the source image (eg. "linux/arm64/v8"),
+	// if an image was converted.
+	Platform string `json:"platform,omitempty"`
+}
+
+// VerityMetadata describes the dm-verity hash tree appended to an image, with
+// the parameters that veritysetup needs to open it.
+type VerityMetadata struct {
+	// RootHash is the root hash of the tree, hex encoded.
+	RootHash string `json:"rootHash"`
+	// Salt is the salt used when hashing blocks, hex encoded.
+	Salt string `json:"salt,omitempty"`
+	// HashOffset is the offset in bytes of the hash tree within the image
+	// (or within its own partition of a GPT disk image).
+	HashOffset int64 `json:"hashOffset"`
+}
+
+// metadataSidecarPath returns the path of the metadata written alongside the
+// image at outputPath.
+func metadataSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".metadata.json"
+}
+
+// imageMetadata describes the image of the given size read from r.
+func imageMetadata(ctx context.Context, r io.ReaderAt, size int64, config []byte, tree *verity.Tree, stats *Stats) ([]byte, error) {
+	dgst, err := digest.SHA256.FromReader(util.ContextReader(ctx, io.NewSectionReader(r, 0, size)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash image: %w", err)
+	}
+
+	metadata := Metadata{
+		Digest:         dgst,
+		Size:           size,
+		FilesystemSize: stats.ImageSize,
+		SourceDigest:   stats.ImageDigest,
+	}
+
+	if tree != nil {
+		metadata.Verity = &VerityMetadata{
+			RootHash:   hex.EncodeToString(tree.RootHash),
+			Salt:       hex.EncodeToString(tree.Salt),
+			HashOffset: tree.HashOffset,
+		}
+	}
+
+	if config != nil {
+		var image ocispecs.Image
+		if err := json.Unmarshal(config, &image); err != nil {
+			return nil, fmt.Errorf("failed to decode image config: %w", err)
+		}
+
+		if image.OS != "" && image.Architecture != "" {
+			metadata.Platform = platforms.Format(image.Platform)
+		}
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
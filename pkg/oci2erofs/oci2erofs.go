@@ -0,0 +1,2275 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package oci2erofs converts OCI and Docker images into EROFS filesystems.
+package oci2erofs
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/dpeckett/archivefs"
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/builder"
+	"github.com/immutos/oci2erofs/internal/containerd"
+	"github.com/immutos/oci2erofs/internal/diff"
+	"github.com/immutos/oci2erofs/internal/dirfs"
+	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/filter"
+	"github.com/immutos/oci2erofs/internal/gpt"
+	"github.com/immutos/oci2erofs/internal/imagefs"
+	"github.com/immutos/oci2erofs/internal/inspect"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/mountfs"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/priority"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/provenance"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/sbom"
+	"github.com/immutos/oci2erofs/internal/signature"
+	"github.com/immutos/oci2erofs/internal/storage"
+	"github.com/immutos/oci2erofs/internal/synthetic"
+	"github.com/immutos/oci2erofs/internal/sysext"
+	"github.com/immutos/oci2erofs/internal/unsupported"
+	"github.com/immutos/oci2erofs/internal/upperdir"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/verity"
+	"github.com/immutos/oci2erofs/internal/warning"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Stdin is the image name that reads an image tarball from standard input.
+const Stdin = "-"
+
+// DockerPrefix marks an image that should be pulled from a registry.
+const DockerPrefix = "docker://"
+
+// DockerDaemonPrefix marks an image that should be read from a Docker daemon
+// (as with "docker save").
+const DockerDaemonPrefix = "docker-daemon:"
+
+// ContainerdPrefix marks an image that should be read from the image store
+// of a containerd daemon.
+const ContainerdPrefix = "containerd://"
+
+// ContainersStoragePrefix marks an image that should be read from a
+// containers/storage image store (as used by podman and buildah).
+const ContainersStoragePrefix = "containers-storage:"
+
+// PushPrefix optionally marks the registry reference an image is pushed to,
+// see Options.Push.
+const PushPrefix = "oci://"
+
+// The types of the artifacts pushed to a registry (see Options.Push), and the
+// media types of their layers.
+const (
+	ArtifactTypeEROFS = "application/vnd.immutos.erofs.v1"
+	MediaTypeEROFS    = "application/vnd.immutos.erofs.image.v1"
+	MediaTypeRootHash = "application/vnd.immutos.erofs.roothash.v1"
+	MediaTypeMetadata = "application/vnd.immutos.erofs.metadata.v1+json"
+)
+
+// ConfigPath is the location of the image config within the root filesystem
+// when Options.EmbedConfig is set.
+const ConfigPath = "etc/oci2erofs/config.json"
+
+// AnnotationsPath is the location of the image's annotations within the root
+// filesystem when Options.Annotations is set. They can be read back with
+// ReadAnnotations, or the inspect command.
+const AnnotationsPath = inspect.AnnotationsPath
+
+// ProvenancePath is the location of the provenance manifest within the root
+// filesystem when Options.EmbedProvenance is set.
+const ProvenancePath = provenance.Path
+
+// ReferrersPath is the location of the OCI image layout holding the image's
+// referrers within the root filesystem when Options.EmbedReferrers is set.
+const ReferrersPath = "etc/oci2erofs/referrers"
+
+// The profiles that shape the image as a systemd extension, see
+// Options.Profile.
+const (
+	ProfileSysext  = sysext.Sysext
+	ProfileConfext = sysext.Confext
+)
+
+// The software bill of materials formats, see Options.SBOMFormat.
+const (
+	SBOMFormatSPDX      = sbom.FormatSPDX
+	SBOMFormatCycloneDX = sbom.FormatCycloneDX
+)
+
+// ErrVerificationFailed is returned when the built image does not match the
+// source image.
+var ErrVerificationFailed = errors.New("image verification failed")
+
+// ErrLimitExceeded is returned when the image exceeds one of the configured
+// limits (eg. Options.MaxUncompressedSize).
+var ErrLimitExceeded = layer.ErrLimitExceeded
+
+// ErrArtifact is returned when the selected manifest is an artifact (eg. an
+// SBOM or signature) rather than an image, or an artifact of a type other
+// than Options.ArtifactType.
+var ErrArtifact = oci.ErrArtifact
+
+// ErrRefNotFound is returned when no image matches Options.Ref (or the image
+// is not in the Docker daemon, containerd or containers/storage).
+var ErrRefNotFound = oci.ErrRefNotFound
+
+// ErrAmbiguousRef is returned when the image has several manifests and
+// Options.Ref does not select one of them.
+var ErrAmbiguousRef = util.ErrAmbiguousRef
+
+// ErrPlatformNotFound is returned when the image is not available for
+// Options.Platform.
+var ErrPlatformNotFound = oci.ErrPlatformNotFound
+
+// ErrUnsupportedLayout is returned when the image is neither an OCI image
+// layout nor a Docker archive, or its oci-layout file has a version not in
+// Options.LayoutVersions.
+var ErrUnsupportedLayout = oci.ErrUnsupportedLayout
+
+// ErrBlobDigestMismatch is returned when an image index, manifest, config or
+// layer does not match the digest it is referenced by.
+var ErrBlobDigestMismatch = util.ErrDigestMismatch
+
+// ErrManifestTooLarge is returned when an image index, manifest or config
+// exceeds Options.MaxManifestSize.
+var ErrManifestTooLarge = util.ErrManifestTooLarge
+
+// ErrMissingForeignLayer is returned when a foreign layer is not in the image
+// and Options.AllowMissingForeignLayers is not set.
+var ErrMissingForeignLayer = oci.ErrMissingForeignLayer
+
+// ErrNoLayersSelected is returned when Options.LayerRange and
+// Options.SkipLayers exclude every layer of the image.
+var ErrNoLayersSelected = layer.ErrNoLayersSelected
+
+// ErrUnsupportedMediaType is returned when a layer has a media type that
+// cannot be converted.
+var ErrUnsupportedMediaType = layer.ErrUnsupportedMediaType
+
+// ErrUnsafePath is returned when a layer contains a path that escapes the
+// root filesystem.
+var ErrUnsafePath = layer.ErrUnsafePath
+
+// ErrUnauthorized is returned when the registry requires credentials that
+// were not given, or denies access with the given credentials.
+var ErrUnauthorized = registry.ErrUnauthorized
+
+// ErrUnmappedID is returned when a file is owned by an ID that is not
+// covered by Options.UIDMap or Options.GIDMap.
+var ErrUnmappedID = builder.ErrUnmappedID
+
+// MaxSymlinkSize is the longest symbolic link target that can be written.
+const MaxSymlinkSize = builder.MaxSymlinkSize
+
+// ErrSymlinkTooLong is returned when the target of a symbolic link is longer
+// than MaxSymlinkSize.
+var ErrSymlinkTooLong = builder.ErrSymlinkTooLong
+
+// ErrNameTooLong is returned when the name of a file is longer than 255
+// bytes.
+var ErrNameTooLong = builder.ErrNameTooLong
+
+// ErrImageTooLarge is returned when the image would be larger than
+// MaxImageSize (or its equivalent for the block size).
+var ErrImageTooLarge = builder.ErrImageTooLarge
+
+// MaxImageSize is the size of the largest image that can be produced with the
+// default block size (about 16 TiB, the reach of 32-bit block addresses).
+// Larger blocks (see Options.BlockSize) raise it proportionally.
+const MaxImageSize = builder.MaxImageSize
+
+// ErrInvalidNames is returned when Options.Strict is set and entries of the
+// root filesystem have names that cannot be stored in the image, or that
+// differ only by case from another entry in the same directory.
+var ErrInvalidNames = errors.New("invalid file names")
+
+// ErrWarning is returned, wrapping the warning, when Options.Strict is set
+// and a warning is raised.
+var ErrWarning = errors.New("warning raised in strict mode")
+
+// ErrInsufficientSpace is returned when the temporary directory does not have
+// enough free space for the image to be pulled and its layers decompressed.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// ErrUnsupportedFile is returned for files that cannot be stored in the image
+// (device nodes, FIFOs and sockets) under UnsupportedError.
+var ErrUnsupportedFile = unsupported.ErrUnsupportedFile
+
+// UnsupportedPolicy decides what happens to files that cannot be stored in
+// the image, see Options.OnUnsupported.
+type UnsupportedPolicy = unsupported.Policy
+
+// The policies for files that cannot be stored in the image.
+const (
+	// UnsupportedError fails the conversion with ErrUnsupportedFile.
+	UnsupportedError = unsupported.PolicyError
+	// UnsupportedSkip leaves the files out, with a warning.
+	UnsupportedSkip = unsupported.PolicySkip
+	// UnsupportedPlaceholder replaces the files with empty regular files of
+	// the same permissions and owner, with a warning.
+	UnsupportedPlaceholder = unsupported.PolicyPlaceholder
+)
+
+// ParseUnsupportedPolicy parses the name of an UnsupportedPolicy.
+func ParseUnsupportedPolicy(s string) (UnsupportedPolicy, error) {
+	return unsupported.ParsePolicy(s)
+}
+
+// ErrOutputExists is returned when the output file already exists and
+// Options.Force is not set.
+var ErrOutputExists = errors.New("output file already exists")
+
+// DefaultMaxManifestSize is the default maximum size of an image index,
+// manifest, or config.
+const DefaultMaxManifestSize = util.DefaultMaxManifestSize
+
+// ExtraEntry is a synthetic entry to inject into the root filesystem.
+type ExtraEntry = synthetic.Entry
+
+// BuildOptions configures how an EROFS image is built.
+type BuildOptions = builder.Options
+
+// Summary describes a built EROFS image.
+type Summary = builder.Summary
+
+// Checkpoint configures a journal of the progress of a build, so that an
+// interrupted build can be resumed (see BuildOptions.Checkpoint).
+type Checkpoint = builder.Checkpoint
+
+// FileTransform rewrites a regular file as it is built into an image (see
+// BuildOptions.TransformFile).
+type FileTransform = builder.FileTransform
+
+// Feature is an optional EROFS on-disk feature, named as by mkfs.erofs (eg.
+// "sb_chksum").
+type Feature = builder.Feature
+
+// ParseFeature parses the name of an EROFS feature.
+func ParseFeature(name string) (Feature, error) {
+	return builder.ParseFeature(name)
+}
+
+// IDMap maps a range of user or group IDs in the image onto the host.
+type IDMap = builder.IDMap
+
+// ParseIDMap parses an ID map of the form "container:host:size".
+func ParseIDMap(s string) (IDMap, error) {
+	return builder.ParseIDMap(s)
+}
+
+// Owner is the user and group that own a file.
+type Owner = builder.Owner
+
+// ParseOwner parses an owner of the form "uid:gid".
+func ParseOwner(s string) (Owner, error) {
+	return builder.ParseOwner(s)
+}
+
+// DefaultWriteConcurrency is the default number of files whose data is
+// written to the image at once.
+const DefaultWriteConcurrency = builder.DefaultWriteConcurrency
+
+// InodeFormat selects between compact and extended inodes.
+type InodeFormat = builder.InodeFormat
+
+const (
+	// InodeFormatAuto uses a compact inode for every file that can be
+	// described by one, and an extended inode otherwise.
+	InodeFormatAuto = builder.InodeFormatAuto
+	// InodeFormatExtended uses extended inodes for every file, so that each
+	// keeps its own (nanosecond) modification time.
+	InodeFormatExtended = builder.InodeFormatExtended
+	// InodeFormatCompact uses compact inodes wherever possible, dropping
+	// the modification times of those files.
+	InodeFormatCompact = builder.InodeFormatCompact
+)
+
+// ParseInodeFormat parses the name of an inode format ("auto", "extended"
+// or "compact").
+func ParseInodeFormat(name string) (InodeFormat, error) {
+	return builder.ParseInodeFormat(name)
+}
+
+// AddDir is a host directory to merge onto the root filesystem.
+type AddDir struct {
+	// Source is the path of the directory on the host.
+	Source string
+	// Target is the path within the root filesystem where it is merged (eg.
+	// "/" or "/etc/app").
+	Target string
+}
+
+// Decompressor returns a reader of the layer tarball compressed in r (see
+// Options.Decompressors).
+type Decompressor = layer.Decompressor
+
+// LayerRange selects a contiguous range of an image's layers, counting from 0
+// for the bottom layer. Negative indices count back from the top layer.
+type LayerRange = layer.Range
+
+// ParseLayerRange parses a layer range of the form "N..M" (eg. "1..-2"),
+// where either end may be omitted.
+func ParseLayerRange(s string) (LayerRange, error) {
+	return layer.ParseRange(s)
+}
+
+// IOPriority is an I/O scheduling priority, like those set by ionice(1).
+type IOPriority = priority.IOPriority
+
+// ParseIOPriority parses an I/O priority, either "idle" or "best-effort"
+// with an optional level from 0 to 7 (eg. "best-effort:7").
+func ParseIOPriority(s string) (*IOPriority, error) {
+	return priority.ParseIOPriority(s)
+}
+
+// RegistryCredentials are the credentials used to authenticate with a
+// registry.
+type RegistryCredentials = registry.Credentials
+
+// ProgressEvent reports the progress of an item within a stage of a
+// conversion.
+type ProgressEvent = progress.Event
+
+// ProgressFunc receives progress events. It may be called concurrently.
+type ProgressFunc = progress.Func
+
+// ProgressStage identifies a stage of a conversion.
+type ProgressStage = progress.Stage
+
+// The stages reported by Options.Progress.
+const (
+	ProgressStageDownload   = progress.StageDownload
+	ProgressStageDecompress = progress.StageDecompress
+	ProgressStageBuild      = progress.StageBuild
+)
+
+// Warning is a non-fatal issue found during a conversion, which usually
+// means that part of the source image is not in the converted image.
+type Warning = warning.Warning
+
+// WarningKind classifies a warning.
+type WarningKind = warning.Kind
+
+// The kinds of warnings reported by Options.OnWarning.
+const (
+	WarningSpecialFile     = warning.KindSpecialFile
+	WarningUnsupportedType = warning.KindUnsupportedType
+	WarningXattrs          = warning.KindXattrs
+	WarningHardLink        = warning.KindHardLink
+)
+
+// Options configures a conversion.
+type Options struct {
+	// Image is the path to an OCI image layout directory, an OCI or Docker
+	// image tarball (optionally compressed), a docker:// reference, a
+	// docker-daemon:, containerd:// or containers-storage: image name, or
+	// Stdin to read a tarball from standard input.
+	Image string
+	// Output is the path of the EROFS image to create. If empty, it is
+	// derived from the image name.
+	Output string
+	// OutputWriter, if set, receives the image instead of Output. The image
+	// is written to it as it is built, in a single pass, unless it is
+	// verified, given a verity hash tree or wrapped in a GPT disk image, as
+	// those read it back once built: it is then built in a temporary file in
+	// TempDir first. No root hash file is written (it is logged instead).
+	OutputWriter io.Writer
+	// Force overwrites the output file if it already exists.
+	Force bool
+	// Ref selects the image if more than one image is present: by name,
+	// manifest digest, or position in the image index (or Docker archive)
+	// as "@N" (zero based, eg. for images without ref name annotations).
+	Ref string
+	// Platform is the target platform (defaults to the host platform).
+	Platform *ocispecs.Platform
+	// ArtifactType, if set, converts an artifact of this type (whose layers
+	// must be tarballs) rather than an image. By default artifacts (eg.
+	// SBOMs, signatures and attestations) are skipped when selecting the
+	// image.
+	ArtifactType string
+	// FirstManifest selects the first manifest of an image index when no
+	// platform is specified, rather than the manifest best matching the host
+	// platform.
+	FirstManifest bool
+	// LayerRange, if set, flattens only this range of the image's layers.
+	LayerRange *LayerRange
+	// SkipLayers are the digests of layers to leave out when flattening the
+	// image (the diff IDs for Docker archives).
+	SkipLayers []digest.Digest
+	// AllPlatforms converts every platform of an image index, writing one
+	// image per platform (see PlatformOutputPath).
+	AllPlatforms bool
+	// TempDir is where temporary files, such as pulled blobs and
+	// decompressed layers, are created (defaults to os.TempDir, ie. TMPDIR).
+	// Conversion fails early with ErrInsufficientSpace if it clearly does not
+	// have enough free space for them.
+	TempDir string
+	// MaxManifestSize is the maximum size of an image index, manifest, or
+	// config (defaults to DefaultMaxManifestSize).
+	MaxManifestSize int64
+	// LayoutVersions are the accepted OCI image layout versions.
+	LayoutVersions []string
+	// BestEffortLayout proceeds if the OCI image layout file is missing or has
+	// an unaccepted version.
+	BestEffortLayout bool
+	// BlobDirs are directories searched, in order, for blobs missing from an
+	// OCI image layout (eg. one shared between layouts, as written by
+	// skopeo's --shared-blob-dir). They are laid out like a layout's blobs
+	// directory, ie. as <alg>/<encoded>.
+	BlobDirs []string
+	// AllowMissingForeignLayers skips foreign layers that are neither in the
+	// image nor downloadable from their URLs, rather than failing.
+	AllowMissingForeignLayers bool
+	// Decompressors adds support for layers of additional media types (eg.
+	// "application/vnd.oci.image.layer.v1.tar+xz"), keyed by media type. They
+	// take precedence over the built-in gzip and zstd decompression.
+	Decompressors map[string]Decompressor
+	// LenientMediaType decompresses layers according to their detected
+	// compression if it does not match their media type, or if their media
+	// type is not recognized.
+	LenientMediaType bool
+	// Strict checks the names of the entries of the root filesystem before
+	// it is built, failing with ErrInvalidNames if any contain a NUL byte or
+	// a slash, are longer than 255 bytes, or differ only by case from another
+	// entry in the same directory. Every offending entry is logged along
+	// with the layer it came from. Warnings (see OnWarning) fail the
+	// conversion with ErrWarning.
+	Strict bool
+	// OnUnsupported decides what happens to files that cannot be stored in
+	// the image: device nodes, FIFOs and sockets. It defaults to
+	// UnsupportedError, except for root filesystem tarballs (see FromTar),
+	// whose device nodes and FIFOs are skipped.
+	OnUnsupported UnsupportedPolicy
+	// StrictPaths rejects layers with entries placed beneath a symbolic link
+	// in the same layer, or with symbolic links whose relative targets climb
+	// above the root filesystem. Absolute and escaping entry paths are always
+	// rejected.
+	StrictPaths bool
+	// IgnoreLayerTOC fully decompresses eStargz and zstd:chunked layers. By
+	// default their files are read on demand using the layer's table of
+	// contents, which saves temporary space and time.
+	IgnoreLayerTOC bool
+	// LazyPull leaves eStargz and zstd:chunked layers whose table of
+	// contents is recorded in the manifest out of the pull from a registry.
+	// Instead, the files that end up in the image are read from the registry
+	// with ranged requests, and verified against the table of contents.
+	LazyPull bool
+	// MaxUncompressedSize is the maximum total size in bytes of the file
+	// contents of all layers (unlimited if zero). Together with MaxFileSize
+	// and MaxEntries it guards against decompression bombs.
+	MaxUncompressedSize int64
+	// MaxFileSize is the maximum size in bytes of a single file (unlimited
+	// if zero).
+	MaxFileSize int64
+	// MaxEntries is the maximum total number of entries in all layers
+	// (unlimited if zero).
+	MaxEntries int64
+	// Jobs is the number of layers to decompress concurrently (defaults to
+	// the number of CPUs).
+	Jobs int
+	// LayerMemoryLimit is the size in bytes up to which decompressed layers
+	// are held in memory rather than in temporary files.
+	LayerMemoryLimit int64
+	// MaxMemory is the size in bytes up to which the metadata staged for
+	// each file of the image is held in memory while it is built, beyond
+	// which it spills over to a temporary file (unlimited if zero).
+	MaxMemory int64
+	// WriteConcurrency is the number of files whose data is written to the
+	// image at once (defaults to IOConcurrency, or DefaultWriteConcurrency).
+	WriteConcurrency int
+	// IOConcurrency is the number of I/O bound operations run at once: files
+	// written to the image and blobs downloaded from a registry. It is the
+	// default for WriteConcurrency and MaxConcurrentDownloads.
+	IOConcurrency int
+	// Nice lowers the CPU scheduling priority of the process to this
+	// niceness (from 1 to 19), like nice(1). Together with IOPriority it
+	// keeps conversions from getting in the way on a shared host. The
+	// priority of the whole process is changed, and is not restored once
+	// the conversion is done (Linux only).
+	Nice int
+	// IOPriority, if set, is the I/O scheduling priority of the process (see
+	// Nice).
+	IOPriority *IOPriority
+	// Preallocate reserves the full size of the image up front, rather than
+	// leaving it sparse.
+	Preallocate bool
+	// PadPercent appends zeroed free space of this percentage of the image
+	// size (including any verity hash tree) to the end of the image.
+	PadPercent int
+	// PadSize, if set, pads the image with zeroes to a multiple of this many
+	// bytes (eg. 1 MiB, or the size of the partition it is written to).
+	// Padding is added after PadPercent.
+	PadSize int64
+	// GPT wraps the image in a GPT disk image, as a read-only partition
+	// followed by a partition holding the dm-verity hash tree (if Verity is
+	// set), so that it can be attached to a VM or flashed as is.
+	GPT bool
+	// PartitionType is the type of the image's partition in the GPT disk
+	// image, as a GUID or by name (eg. "root-x86-64" or "usr-arm64",
+	// defaults to "linux-generic").
+	PartitionType string
+	// VerityPartitionType is the type of the partition holding the dm-verity
+	// hash tree (defaults to the verity type matching PartitionType, eg.
+	// "root-x86-64-verity", or "linux-generic").
+	VerityPartitionType string
+	// HardlinkDedup writes identical regular files as hard links to a single
+	// inode.
+	HardlinkDedup bool
+	// Dedupe writes the data of regular files with identical contents once,
+	// shared by all of their inodes (whatever their metadata).
+	Dedupe bool
+	// DataOrder is an access order profile: the paths of regular files (eg.
+	// as read when a container starts) whose data is laid out first and in
+	// this order, so that it can be read ahead in a single sweep. The data
+	// of other files follows, grouped by directory (see LoadDataOrder).
+	DataOrder []string
+	// TransformFile, if set, rewrites each regular file as it is built into
+	// the image (eg. to strip binaries, or render configuration templates),
+	// without unpacking the root filesystem first (see FileTransform).
+	TransformFile FileTransform
+	// LayerCacheDir, if set, caches decompressed layers by digest so that
+	// they are reused by later conversions.
+	LayerCacheDir string
+	// LayerCacheMaxSize is the maximum size in bytes of the layer cache
+	// (unbounded if zero).
+	LayerCacheMaxSize int64
+	// EmbedProvenance embeds a manifest recording which layer each file came
+	// from at ProvenancePath.
+	EmbedProvenance bool
+	// WriteProvenance writes a manifest recording which layer each file came
+	// from, and the config history entry that created each layer, alongside
+	// the image as JSON, replacing the extension of the output path with
+	// ".provenance.json".
+	WriteProvenance bool
+	// ExtraEntries are injected into the root filesystem.
+	ExtraEntries []ExtraEntry
+	// EmbedConfig stores the image config (entrypoint, environment, labels
+	// etc.) inside the root filesystem at ConfigPath.
+	EmbedConfig bool
+	// Annotations are arbitrary key/value pairs (eg. the source image digest,
+	// a build ID or git commit) stored inside the root filesystem at
+	// AnnotationsPath as a JSON object, so the image describes itself.
+	Annotations map[string]string
+	// WriteConfig writes the image config alongside the image, replacing the
+	// extension of the output path with ".config.json".
+	WriteConfig bool
+	// WriteMetadata writes a description of the built image (its digest,
+	// size, dm-verity root hash and source image) alongside it as JSON,
+	// replacing the extension of the output path with ".metadata.json" (see
+	// Metadata).
+	WriteMetadata bool
+	// Push, if set, pushes the image to this registry reference (eg.
+	// "oci://registry.example.com/images/app:v1") once it is written, as an
+	// OCI artifact of type ArtifactTypeEROFS. Its dm-verity root hash and
+	// metadata are pushed alongside it, if written. The registry options
+	// (eg. RegistryCredentials) apply as for pulls.
+	Push string
+	// EmbedReferrers stores the artifacts that refer to the image (eg. SBOMs
+	// and provenance attestations) in the image at ReferrersPath, as an OCI
+	// image layout. They are pulled along with registry images.
+	EmbedReferrers bool
+	// WriteReferrers writes the artifacts that refer to the image alongside
+	// it as an OCI image layout, replacing the extension of the output path
+	// with ".referrers".
+	WriteReferrers bool
+	// SBOMFormat, if set, writes a software bill of materials listing every
+	// file in the image with its digests alongside it, in this format
+	// (SBOMFormatSPDX or SBOMFormatCycloneDX). The extension of the output
+	// path is replaced with ".spdx.json" or ".cdx.json".
+	SBOMFormat string
+	// Profile shapes the image as a systemd extension (ProfileSysext or
+	// ProfileConfext): the root filesystem is restricted to the directories
+	// the extension may contain, and an extension-release file named after
+	// the image file (without its extension) is added unless the image
+	// already has one. The default output path gets a ".raw" suffix, as
+	// systemd expects.
+	Profile string
+	// Exclude are glob patterns of paths to drop from the root filesystem
+	// (eg. "/usr/share/doc"). Patterns containing a slash are matched against
+	// the whole path, others against the base name of every path (eg.
+	// "*.pyc"). Extra entries are never excluded.
+	Exclude []string
+	// Include are glob patterns of paths to keep even if they are excluded.
+	Include []string
+	// AddDirs are host directories merged onto the root filesystem, in order,
+	// as if they were extra layers (after any path filters are applied).
+	AddDirs []AddDir
+	// UpperDirs are overlayfs upper directories (eg. the read-write layer of
+	// a container) applied onto the root filesystem, in order, before
+	// AddDirs. Files deleted from the mount, which the kernel marks with
+	// whiteout devices, are removed, and opaque directories hide what is
+	// beneath them, so a running container can be flattened into an image.
+	UpperDirs []string
+	// SourceDateEpoch, if set, clamps all timestamps for reproducible output.
+	SourceDateEpoch *time.Time
+	// ClampModTime, if set, clamps all timestamps so that none are later than
+	// it.
+	ClampModTime *time.Time
+	// ModTime, if set, replaces all timestamps.
+	ModTime *time.Time
+	// Verify re-reads the built image and compares every file against the
+	// source image.
+	Verify bool
+	// Verity appends a dm-verity hash tree to the image and writes its root
+	// hash alongside it.
+	Verity bool
+	// VeritySalt is the dm-verity salt. If nil, a random salt is used unless
+	// SourceDateEpoch is set, in which case no salt is used.
+	VeritySalt []byte
+	// VeritySignKey is the path of a PEM encoded RSA or ECDSA private key
+	// used to sign the dm-verity root hash. The PKCS#7 signature is written
+	// alongside the image, replacing the extension of the output path with
+	// ".roothash.p7s", and to a signature partition of a GPT disk image.
+	VeritySignKey string
+	// VeritySignCertificate is the path of the PEM encoded certificate of
+	// VeritySignKey, embedded in the signature.
+	VeritySignCertificate string
+	// UUID, if set, is written into the superblock.
+	UUID *[16]byte
+	// DigestUUID derives the superblock UUID from the image digest (the
+	// manifest digest, or the image ID of Docker images), so that it is stable
+	// across rebuilds of the same image.
+	DigestUUID bool
+	// Label, if set, is written into the superblock as the volume label (at
+	// most 16 bytes).
+	Label string
+	// BlockSize is the size in bytes of the blocks of the image: 4096 (the
+	// default), 16384 or 65536. Linux only mounts images whose blocks are no
+	// larger than its page size, so larger blocks are for kernels with larger
+	// pages (eg. arm64 with 16 KiB or 64 KiB pages).
+	BlockSize int
+	// TargetKernel, if set, is the oldest kernel release (eg. "5.10") that
+	// must be able to mount the image. Features it does not support are not
+	// used, and conversion fails if it cannot mount EROFS images at all.
+	TargetKernel string
+	// DisabledFeatures are EROFS features that the image must not use.
+	DisabledFeatures []Feature
+	// Owner, if set, is given ownership of every file in the image (eg. for
+	// system extensions, which must be owned by root).
+	Owner *Owner
+	// ModeMask are the permission bits, in the octal form used by chmod (eg.
+	// 0o022), cleared from every file other than symbolic links.
+	ModeMask uint32
+	// UIDMap and GIDMap, if set, shift the owner of every file in the image
+	// (eg. for rootless containers or user namespace mounts).
+	UIDMap []IDMap
+	GIDMap []IDMap
+	// InodeFormat selects between compact and extended inodes. The default
+	// (InodeFormatAuto) picks the smallest format that describes each file.
+	InodeFormat InodeFormat
+	// FromDir treats Image as a root filesystem directory and packs it as
+	// is, rather than loading it as an OCI or Docker image.
+	FromDir bool
+	// FromTar treats Image as a (possibly compressed) root filesystem
+	// tarball, eg. as produced by debootstrap or mmdebstrap.
+	FromTar bool
+	// RegistryCredentials are used to authenticate with the registry. If nil,
+	// the Docker config file and its credential helpers are consulted.
+	RegistryCredentials *RegistryCredentials
+	// InsecureRegistries are the registry hosts (eg. "localhost:5000") that
+	// are accessed over plain HTTP rather than HTTPS.
+	InsecureRegistries []string
+	// RegistryMirrors maps a registry host (eg. "docker.io") to mirror hosts
+	// that are tried, in order, before the registry itself.
+	RegistryMirrors map[string][]string
+	// DockerHost is the address of the Docker daemon for docker-daemon:
+	// images (eg. "unix:///var/run/docker.sock"). Defaults to DOCKER_HOST.
+	DockerHost string
+	// ContainerdAddress is the path of the containerd socket, for
+	// containerd:// images (defaults to /run/containerd/containerd.sock).
+	ContainerdAddress string
+	// ContainerdNamespace is the containerd namespace of containerd:// images
+	// (defaults to "default").
+	ContainerdNamespace string
+	// StorageRoot is the root of the image store of containers-storage:
+	// images (defaults to /var/lib/containers/storage for root, and
+	// ~/.local/share/containers/storage otherwise).
+	StorageRoot string
+	// MaxConcurrentDownloads is the number of blobs downloaded concurrently
+	// from a registry (defaults to IOConcurrency, or 3).
+	MaxConcurrentDownloads int
+	// MaxDownloadAttempts is the number of times a blob download is
+	// attempted before giving up (defaults to 5).
+	MaxDownloadAttempts int
+	// SignatureKey, if set, requires images pulled from a registry to have a
+	// cosign signature that is valid for this public key. Only public keys
+	// are supported, keyless (Fulcio/Rekor) signatures are not verified.
+	SignatureKey crypto.PublicKey
+	// Progress, if set, is called as blobs are downloaded, layers are read
+	// and files are written to the image.
+	Progress ProgressFunc
+	// OnStats, if set, is called with the statistics of each image written.
+	OnStats func(*Stats)
+	// OnWarning, if set, is called with each warning raised, eg. for device
+	// nodes, entries of unsupported types and hard links to missing files
+	// that are left out of the image, or extended attributes, which are not
+	// stored. Warnings are logged either way. It is not called concurrently.
+	OnWarning func(*Warning)
+	// DryRun resolves and loads the image, applies the filters and extra
+	// entries and lays out the EROFS filesystem, but writes nothing. The
+	// plan is reported through OnStats (see Stats.DryRun).
+	DryRun bool
+	// Resume keeps the state of a conversion that fails or is interrupted
+	// in a directory next to the output (named after it, with a ".resume"
+	// suffix): the blobs pulled from a registry, the partially written
+	// image and a checkpoint of the files written to it. Running the same
+	// conversion again downloads only the missing blobs and writes only the
+	// files not yet written. The directory is removed once the conversion
+	// succeeds. A checkpoint is only resumed for the same image digest and
+	// layout, so the contents of directory and tarball input must not
+	// change in between.
+	Resume bool
+	// TracerProvider, if set, records a span for the conversion and each of
+	// its phases (defaults to the global tracer provider).
+	TracerProvider trace.TracerProvider
+	// MeterProvider, if set, records metrics of the conversions run, and of
+	// the layers read and images written (defaults to the global meter
+	// provider).
+	MeterProvider metric.MeterProvider
+}
+
+// ErrInvalidSignature is returned when an image does not have a valid
+// signature for Options.SignatureKey.
+var ErrInvalidSignature = signature.ErrInvalidSignature
+
+// ErrKeylessUnsupported is returned by LoadSignatureKey when it is given
+// anything other than a public key file, as keyless (Fulcio/Rekor)
+// verification is not supported.
+var ErrKeylessUnsupported = signature.ErrKeylessUnsupported
+
+// LoadExtraEntries reads a JSON file listing extra entries.
+func LoadExtraEntries(name string) ([]ExtraEntry, error) {
+	return synthetic.Load(name)
+}
+
+// LoadPatterns reads glob patterns (eg. for Options.Exclude) from a file, one
+// per line. Blank lines and lines starting with '#' are ignored.
+func LoadPatterns(name string) ([]string, error) {
+	return filter.LoadPatterns(name)
+}
+
+// LoadDataOrder reads an access order profile for Options.DataOrder from a
+// file, one path per line.
+func LoadDataOrder(name string) ([]string, error) {
+	return builder.LoadDataOrder(name)
+}
+
+// LoadSignatureKey reads a PEM encoded public key (eg. cosign.pub) for use
+// as Options.SignatureKey. Keyless signing certificates and key references
+// (eg. KMS URIs) fail with ErrKeylessUnsupported.
+func LoadSignatureKey(name string) (crypto.PublicKey, error) {
+	return signature.LoadPublicKey(name)
+}
+
+// ReadAnnotations reads the annotations stored in an image's root filesystem
+// (eg. one opened with OpenImage) at AnnotationsPath. It returns nil if the
+// image has none.
+func ReadAnnotations(fsys fs.FS) (map[string]string, error) {
+	return inspect.ReadAnnotations(fsys)
+}
+
+// Build writes an EROFS image of the given filesystem to dst.
+func Build(ctx context.Context, dst io.WriterAt, src fs.FS, opts *BuildOptions) (*Summary, error) {
+	return builder.Build(ctx, dst, src, opts)
+}
+
+// ImageFS is a read-only view of an EROFS image, that conforms to the io/fs
+// interfaces.
+type ImageFS = imagefs.FS
+
+// OpenImage opens an EROFS image (eg. one written by Convert) as a file
+// system. Symbolic links are resolved within the image.
+func OpenImage(image io.ReaderAt) (*ImageFS, error) {
+	return imagefs.Open(image)
+}
+
+// Convert converts an image into an EROFS filesystem. If the context is
+// cancelled the conversion is aborted, and all temporary files and any
+// partially written output are removed.
+func Convert(ctx context.Context, opts *Options) (err error) {
+	tracerProvider := opts.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
+	ctx, span := tracerProvider.Tracer(instrumentationName).Start(ctx, "convert",
+		trace.WithAttributes(attribute.String("oci2erofs.image", opts.Image)))
+
+	m := newMetrics(opts.MeterProvider)
+	defer func() {
+		m.recordConversion(ctx, err)
+		endSpan(span, err)
+	}()
+
+	stats := newStats(time.Now(), m)
+
+	return convert(ctx, opts, stats)
+}
+
+func convert(ctx context.Context, opts *Options, stats *Stats) (err error) {
+	if opts.IOConcurrency < 0 {
+		return errors.New("the I/O concurrency must not be negative")
+	}
+
+	if err := priority.Set(opts.Nice, opts.IOPriority); err != nil {
+		return err
+	}
+
+	if opts.InodeFormat != "" {
+		if _, err := ParseInodeFormat(string(opts.InodeFormat)); err != nil {
+			return err
+		}
+	}
+
+	if opts.BlockSize != 0 && !slices.Contains(builder.BlockSizes, opts.BlockSize) {
+		return fmt.Errorf("unsupported block size %d (must be one of %v)", opts.BlockSize, builder.BlockSizes)
+	}
+
+	if opts.DigestUUID && (opts.FromDir || opts.FromTar) {
+		return errors.New("deriving the UUID from the image digest requires an image")
+	}
+
+	if (opts.EmbedConfig || opts.WriteConfig) && (opts.FromDir || opts.FromTar) {
+		return errors.New("the image config is only available when converting an image")
+	}
+
+	for k := range opts.Annotations {
+		if k == "" {
+			return errors.New("annotation keys must not be empty")
+		}
+	}
+
+	if opts.OnUnsupported != "" {
+		if _, err := ParseUnsupportedPolicy(string(opts.OnUnsupported)); err != nil {
+			return err
+		}
+	}
+
+	if opts.Verify && opts.TransformFile != nil {
+		return errors.New("transformed files cannot be verified against the source image")
+	}
+
+	if opts.WriteConfig && opts.OutputWriter != nil {
+		return errors.New("the image config cannot be written alongside an output stream")
+	}
+
+	if (opts.LayerRange != nil || len(opts.SkipLayers) > 0) && (opts.FromDir || opts.FromTar) {
+		return errors.New("layers can only be selected when converting an image")
+	}
+
+	if opts.WriteProvenance && (opts.FromDir || opts.FromTar) {
+		return errors.New("provenance is only available when converting an image")
+	}
+
+	if opts.WriteProvenance && opts.OutputWriter != nil {
+		return errors.New("provenance cannot be written alongside an output stream")
+	}
+
+	if opts.WriteMetadata && opts.OutputWriter != nil {
+		return errors.New("metadata cannot be written alongside an output stream")
+	}
+
+	if opts.Push != "" && opts.OutputWriter != nil {
+		return errors.New("an image written to an output stream cannot be pushed")
+	}
+
+	if opts.DryRun && (opts.OutputWriter != nil || opts.Push != "") {
+		return errors.New("a dry run cannot be written to an output stream or pushed")
+	}
+
+	if opts.Resume && (opts.OutputWriter != nil || opts.DryRun) {
+		return errors.New("resuming requires an image to be written to an output path")
+	}
+
+	if opts.Push != "" && opts.AllPlatforms {
+		return errors.New("pushing is not supported when converting all platforms")
+	}
+
+	if (opts.EmbedReferrers || opts.WriteReferrers) && (opts.FromDir || opts.FromTar) {
+		return errors.New("referrers are only available when converting an image")
+	}
+
+	if opts.WriteReferrers && opts.OutputWriter != nil {
+		return errors.New("referrers cannot be written alongside an output stream")
+	}
+
+	if opts.PadPercent < 0 || opts.PadSize < 0 {
+		return errors.New("padding must not be negative")
+	}
+
+	if (opts.VeritySignKey == "") != (opts.VeritySignCertificate == "") {
+		return errors.New("signing the verity root hash requires both a key and a certificate")
+	}
+
+	if opts.VeritySignKey != "" && !opts.Verity {
+		return errors.New("signing the verity root hash requires verity")
+	}
+
+	if opts.LazyPull && opts.IgnoreLayerTOC {
+		return errors.New("lazily pulled layers must be read using their table of contents")
+	}
+
+	if opts.GPT {
+		if opts.PadPercent > 0 || opts.PadSize > 0 {
+			return errors.New("a GPT disk image cannot be padded")
+		}
+
+		for _, partitionType := range []string{opts.PartitionType, opts.VerityPartitionType} {
+			if partitionType == "" {
+				continue
+			}
+
+			if _, err := gpt.ParseType(partitionType); err != nil {
+				return err
+			}
+		}
+	} else if opts.PartitionType != "" || opts.VerityPartitionType != "" {
+		return errors.New("partition types require a GPT disk image")
+	}
+
+	if opts.SBOMFormat != "" {
+		if err := sbom.CheckFormat(opts.SBOMFormat); err != nil {
+			return err
+		}
+
+		if opts.OutputWriter != nil {
+			return errors.New("an SBOM cannot be written alongside an output stream")
+		}
+	}
+
+	if opts.Profile != "" {
+		if err := sysext.Check(opts.Profile); err != nil {
+			return err
+		}
+
+		if opts.EmbedConfig && !sysext.Includes(opts.Profile, ConfigPath) {
+			return fmt.Errorf("the image config cannot be embedded in a %s image", opts.Profile)
+		}
+
+		if len(opts.Annotations) > 0 && !sysext.Includes(opts.Profile, AnnotationsPath) {
+			return fmt.Errorf("annotations cannot be embedded in a %s image", opts.Profile)
+		}
+
+		if opts.EmbedReferrers && !sysext.Includes(opts.Profile, ReferrersPath) {
+			return fmt.Errorf("referrers cannot be embedded in a %s image", opts.Profile)
+		}
+	}
+
+	// Check the target kernel up front, rather than after loading the image.
+	if _, err := disabledFeatures(opts); err != nil {
+		return err
+	}
+
+	if opts.FromDir {
+		return convertDir(ctx, opts, stats)
+	}
+
+	tempDir, err := os.MkdirTemp(opts.TempDir, "oci2erofs")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if opts.FromTar {
+		return convertTar(ctx, tempDir, opts, stats)
+	}
+
+	ref := opts.Ref
+
+	var imageFS fs.FS
+	var blobs oci.BlobProvider
+	var defaultOutputPath string
+	if remoteRef, ok := strings.CutPrefix(opts.Image, DockerPrefix); ok {
+		// Eg. "ghcr.io/foo/bar:latest" -> "bar.erofs".
+		name, _, _ := strings.Cut(remoteRef, "@")
+		name, _, _ = strings.Cut(filepath.Base(name), ":")
+		defaultOutputPath = name + outputExt(opts)
+
+		// Pull the image from a registry into a temporary OCI image layout,
+		// or one that is kept until the conversion succeeds if it is to be
+		// resumed.
+		layoutDir := filepath.Join(tempDir, "image")
+		if opts.Resume {
+			resumeDir := resumeDirPath(cmp.Or(opts.Output, defaultOutputPath))
+			layoutDir = filepath.Join(resumeDir, "image")
+
+			defer func() {
+				if err == nil {
+					_ = os.RemoveAll(resumeDir)
+				}
+			}()
+		}
+
+		if err := os.MkdirAll(layoutDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create image layout directory: %w", err)
+		}
+
+		slog.Info("Pulling image", slog.String("ref", remoteRef))
+
+		pullStart := time.Now()
+
+		pullCtx, span := startSpan(ctx, "pull", attribute.String("oci2erofs.ref", remoteRef))
+		pullOpts := &registry.Options{
+			Platform:                  opts.Platform,
+			FirstManifest:             opts.FirstManifest,
+			AllPlatforms:              opts.AllPlatforms,
+			MaxManifestSize:           opts.MaxManifestSize,
+			Credentials:               opts.RegistryCredentials,
+			SignatureKey:              opts.SignatureKey,
+			InsecureRegistries:        opts.InsecureRegistries,
+			Mirrors:                   opts.RegistryMirrors,
+			MaxConcurrentDownloads:    cmp.Or(opts.MaxConcurrentDownloads, opts.IOConcurrency),
+			MaxDownloadAttempts:       opts.MaxDownloadAttempts,
+			Progress:                  opts.Progress,
+			AllowMissingForeignLayers: opts.AllowMissingForeignLayers,
+			ArtifactType:              opts.ArtifactType,
+			Referrers:                 opts.EmbedReferrers || opts.WriteReferrers,
+			OnBlobs: func(blobs []ocispecs.Descriptor) error {
+				// The layers of each platform are decompressed in turn, so
+				// that is checked again as they are loaded.
+				need := downloadSpace(blobs)
+				if !opts.AllPlatforms {
+					need += decompressSpace(blobs, opts)
+				}
+
+				return checkSpace(layoutDir, need)
+			},
+		}
+		if opts.LazyPull {
+			var provider *registry.Provider
+			ref, provider, err = registry.PullLazy(pullCtx, layoutDir, remoteRef, pullOpts)
+			if err == nil {
+				blobs = provider
+			}
+		} else {
+			ref, err = registry.Pull(pullCtx, layoutDir, remoteRef, pullOpts)
+		}
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to pull image: %w", err)
+		}
+
+		stats.Phases.Pull = time.Since(pullStart)
+
+		imageFS = os.DirFS(layoutDir)
+	} else if name, ok := strings.CutPrefix(opts.Image, DockerDaemonPrefix); ok {
+		if opts.SignatureKey != nil {
+			return errors.New("signature verification is only supported for images pulled from a registry")
+		}
+
+		slog.Info("Saving image from Docker daemon", slog.String("name", name))
+
+		archive, err := docker.Save(ctx, opts.DockerHost, name)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		var closeTarball func() error
+		imageFS, closeTarball, err = openTarball(ctx, tempDir, archive, "docker-daemon")
+		if err != nil {
+			return err
+		}
+		defer closeTarball()
+
+		name, _, _ = strings.Cut(name, "@")
+		name, _, _ = strings.Cut(filepath.Base(name), ":")
+		defaultOutputPath = name + outputExt(opts)
+	} else if name, ok := strings.CutPrefix(opts.Image, ContainerdPrefix); ok {
+		if opts.SignatureKey != nil {
+			return errors.New("signature verification is only supported for images pulled from a registry")
+		}
+
+		// Images are stored under their normalized names (eg. "alpine:3.19"
+		// -> "docker.io/library/alpine:3.19").
+		named, err := dockerref.ParseDockerRef(name)
+		if err != nil {
+			return fmt.Errorf("failed to parse image name: %w", err)
+		}
+
+		client, err := containerd.Dial(ctx, opts.ContainerdAddress, opts.ContainerdNamespace)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		blobs = client.Provider(named.String())
+
+		name, _, _ = strings.Cut(name, "@")
+		name, _, _ = strings.Cut(filepath.Base(name), ":")
+		defaultOutputPath = name + outputExt(opts)
+	} else if name, ok := strings.CutPrefix(opts.Image, ContainersStoragePrefix); ok {
+		if opts.SignatureKey != nil {
+			return errors.New("signature verification is only supported for images pulled from a registry")
+		}
+
+		store, err := storage.Open(opts.StorageRoot)
+		if err != nil {
+			return err
+		}
+
+		blobs, err = store.Provider(name)
+		if err != nil {
+			return err
+		}
+
+		name, _, _ = strings.Cut(name, "@")
+		name, _, _ = strings.Cut(filepath.Base(name), ":")
+		defaultOutputPath = name + outputExt(opts)
+	} else if opts.Image == Stdin {
+		if opts.SignatureKey != nil {
+			return errors.New("signature verification is only supported for images pulled from a registry")
+		}
+
+		var closeTarball func() error
+		imageFS, closeTarball, err = openTarball(ctx, tempDir, os.Stdin, "stdin")
+		if err != nil {
+			return err
+		}
+		defer closeTarball()
+
+		defaultOutputPath = "image" + outputExt(opts)
+	} else {
+		if opts.SignatureKey != nil {
+			return errors.New("signature verification is only supported for images pulled from a registry")
+		}
+
+		// Is the image a directory or a tarball?
+		fi, err := os.Stat(opts.Image)
+		if err != nil {
+			return fmt.Errorf("failed to open image: %w", err)
+		}
+
+		if fi.IsDir() {
+			imageFS = os.DirFS(opts.Image)
+			defaultOutputPath = filepath.Base(opts.Image) + outputExt(opts)
+		} else {
+			defaultOutputPath = strings.TrimSuffix(filepath.Base(opts.Image), filepath.Ext(opts.Image)) + outputExt(opts)
+
+			imageFile, err := os.Open(opts.Image)
+			if err != nil {
+				return fmt.Errorf("failed to open tarball: %w", err)
+			}
+			defer imageFile.Close()
+
+			var closeTarball func() error
+			imageFS, closeTarball, err = openTarball(ctx, tempDir, imageFile, filepath.Base(opts.Image))
+			if err != nil {
+				return err
+			}
+			defer closeTarball()
+		}
+	}
+
+	// Determine if the image is a Docker or OCI image.
+	var dockerArchive bool
+	if blobs == nil {
+		var ociArchive bool
+		if _, err := imageFS.Open("manifest.json"); err == nil {
+			dockerArchive = true
+		}
+		if !dockerArchive {
+			if _, err := imageFS.Open("oci-layout"); err == nil {
+				ociArchive = true
+			} else if _, err := imageFS.Open("index.json"); err == nil && opts.BestEffortLayout {
+				ociArchive = true
+			} else if layoutFS, nestedRef, ok := oci.NestedLayout(imageFS, ref); ok {
+				// Eg. a registry's storage, holding a layout per repository.
+				slog.Debug("Using nested image layout", slog.String("ref", ref))
+				imageFS, ref = layoutFS, nestedRef
+				ociArchive = true
+			}
+		}
+		if !dockerArchive && !ociArchive {
+			return fmt.Errorf("%w: image is not a valid OCI or Docker image", ErrUnsupportedLayout)
+		}
+	}
+
+	outputPath := opts.Output
+	if outputPath == "" {
+		outputPath = defaultOutputPath
+	}
+
+	if !opts.AllPlatforms {
+		return convertImage(ctx, tempDir, imageFS, blobs, dockerArchive, ref, opts.Platform, outputPath, opts, stats)
+	}
+
+	if dockerArchive {
+		return errors.New("converting all platforms is only supported for OCI images")
+	}
+
+	if opts.OutputWriter != nil {
+		return errors.New("converting all platforms requires an output path")
+	}
+
+	platformBlobs := blobs
+	if platformBlobs == nil {
+		platformBlobs = oci.NewLayoutProvider(imageFS, blobDirs(opts)...)
+	}
+
+	imagePlatforms, err := oci.PlatformsFrom(ctx, platformBlobs, ref, &oci.Options{MaxManifestSize: opts.MaxManifestSize})
+	if err != nil {
+		return fmt.Errorf("failed to list image platforms: %w", err)
+	}
+
+	for _, platform := range imagePlatforms {
+		slog.Info("Converting platform", slog.String("platform", util.FormatPlatform(platform)))
+
+		// Each platform is reported separately, sharing the pull time.
+		platformStats := newStats(time.Now(), stats.metrics)
+		platformStats.Phases.Pull = stats.Phases.Pull
+
+		if err := convertImage(ctx, tempDir, imageFS, blobs, false, ref, &platform, PlatformOutputPath(outputPath, platform), opts, platformStats); err != nil {
+			return fmt.Errorf("failed to convert platform %s: %w", util.FormatPlatform(platform), err)
+		}
+	}
+
+	return nil
+}
+
+// convertDir packs the root filesystem directory opts.Image.
+func convertDir(ctx context.Context, opts *Options, stats *Stats) error {
+	if opts.SignatureKey != nil {
+		return errors.New("signature verification is only supported for images pulled from a registry")
+	}
+
+	fi, err := os.Stat(opts.Image)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", opts.Image)
+	}
+
+	outputPath := opts.Output
+	if outputPath == "" {
+		outputPath = filepath.Base(filepath.Clean(opts.Image)) + outputExt(opts)
+	}
+
+	if err := checkOutput(outputPath, opts); err != nil {
+		return err
+	}
+
+	rootFS := dirfs.New(opts.Image)
+	if err := checkDir(rootFS, opts); err != nil {
+		return err
+	}
+
+	return writeImage(ctx, rootFS, nil, nil, nil, outputPath, opts, stats)
+}
+
+// convertTar converts the root filesystem tarball opts.Image.
+func convertTar(ctx context.Context, tempDir string, opts *Options, stats *Stats) error {
+	if opts.SignatureKey != nil {
+		return errors.New("signature verification is only supported for images pulled from a registry")
+	}
+
+	outputPath := opts.Output
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(filepath.Base(opts.Image), filepath.Ext(opts.Image)) + outputExt(opts)
+	}
+
+	if err := checkOutput(outputPath, opts); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(opts.Image); err == nil {
+		if err := checkSpace(tempDir, decompressSpace([]ocispecs.Descriptor{{Size: fi.Size()}}, opts)); err != nil {
+			return err
+		}
+	}
+
+	// Device nodes are common in root filesystem tarballs (eg. /dev/null),
+	// but cannot be stored in the image, so they are skipped unless asked
+	// otherwise.
+	loadStart := time.Now()
+	loadCtx, span := startSpan(ctx, "load")
+	rootFS, closeRootFS, err := layer.Load(loadCtx, tempDir, os.DirFS(filepath.Dir(opts.Image)), layer.Descriptor{
+		Path: filepath.Base(opts.Image),
+	}, &layer.Options{
+		MemoryLimit:             opts.LayerMemoryLimit,
+		SkipSpecialFiles:        opts.OnUnsupported == "" || opts.OnUnsupported == UnsupportedSkip,
+		PlaceholderSpecialFiles: opts.OnUnsupported == UnsupportedPlaceholder,
+		StrictPaths:             opts.StrictPaths,
+		Limits:                  layerLimits(opts),
+		Progress:                opts.Progress,
+		OnLoad: func(l LayerStats) {
+			stats.addLayer(l)
+			traceLayer(loadCtx, l)
+		},
+		OnWarning: warningHandler(opts, stats),
+	})
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to load tarball: %w", err)
+	}
+	defer func() {
+		if err := closeRootFS(); err != nil {
+			slog.Warn("Failed to close tarball", slog.Any("error", err))
+		}
+	}()
+	stats.Phases.Load = time.Since(loadStart)
+
+	return writeImage(ctx, rootFS, nil, nil, nil, outputPath, opts, stats)
+}
+
+// checkDir fails if the directory contains files that cannot be stored in
+// the image (unless opts.OnUnsupported says otherwise).
+func checkDir(fsys fs.FS, opts *Options) error {
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir(), d.Type()&fs.ModeSymlink != 0:
+			return nil
+		case !d.Type().IsRegular():
+			if opts.OnUnsupported == "" || opts.OnUnsupported == UnsupportedError {
+				return fmt.Errorf("%w %s: %s", ErrUnsupportedFile, d.Type(), path)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan directory: %w", err)
+	}
+
+	return nil
+}
+
+// openTarball decompresses the image tarball read from r (if it is
+// compressed) into a temporary file, as random access is needed to read it.
+func openTarball(ctx context.Context, tempDir string, r io.Reader, name string) (fs.FS, func() error, error) {
+	dr, err := uncompr.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create decompressing reader: %w", err)
+	}
+	defer dr.Close()
+
+	// Create a temporary file to store the decompressed image.
+	decompressedImageFile, err := os.OpenFile(filepath.Join(tempDir, name+".tar"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary tar file: %w", err)
+	}
+
+	if _, err := io.Copy(decompressedImageFile, util.ContextReader(ctx, dr)); err != nil {
+		_ = decompressedImageFile.Close()
+		return nil, nil, fmt.Errorf("failed to decompress image: %w", err)
+	}
+
+	imageFS, err := tarfs.Open(decompressedImageFile)
+	if err != nil {
+		_ = decompressedImageFile.Close()
+		return nil, nil, fmt.Errorf("failed to open tarball: %w", err)
+	}
+
+	return imageFS, decompressedImageFile.Close, nil
+}
+
+// PlatformOutputPath returns the output path used for the given platform when
+// converting all platforms, eg. "out.erofs" -> "out-linux-arm64-v8.erofs".
+func PlatformOutputPath(outputPath string, platform ocispecs.Platform) string {
+	parts := []string{platform.OS, platform.Architecture}
+	if platform.Variant != "" {
+		parts = append(parts, platform.Variant)
+	}
+	if platform.OSVersion != "" {
+		parts = append(parts, platform.OSVersion)
+	}
+
+	ext := filepath.Ext(outputPath)
+	return strings.TrimSuffix(outputPath, ext) + "-" + strings.Join(parts, "-") + ext
+}
+
+// convertImage converts the image for a single platform. The image is read
+// from blobs if set, otherwise from the OCI image layout or Docker archive
+// imageFS.
+func convertImage(ctx context.Context, tempDir string, imageFS fs.FS, blobs oci.BlobProvider, dockerArchive bool, ref string, platform *ocispecs.Platform, outputPath string, opts *Options, stats *Stats) error {
+	if err := checkOutput(outputPath, opts); err != nil {
+		return err
+	}
+
+	loadStart := time.Now()
+
+	rootFS, config, referrers, layerProvenance, closeAll, err := loadImage(ctx, tempDir, imageFS, blobs, dockerArchive, ref, platform, opts, stats)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := closeAll(); err != nil {
+			slog.Warn("Failed to close image layers", slog.Any("error", err))
+		}
+	}()
+	stats.Phases.Load = time.Since(loadStart)
+
+	return writeImage(ctx, rootFS, config, referrers, layerProvenance, outputPath, opts, stats)
+}
+
+// loadImage loads the root filesystem of the image for a single platform,
+// along with its config and the layout of its referrers and its provenance
+// (if requested).
+func loadImage(ctx context.Context, tempDir string, imageFS fs.FS, blobs oci.BlobProvider, dockerArchive bool, ref string, platform *ocispecs.Platform, opts *Options, stats *Stats) (rootFS fs.FS, config []byte, referrers map[string][]byte, layerProvenance *provenance.Manifest, closeAll func() error, err error) {
+	ctx, span := startSpan(ctx, "load")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	onConfig := func(data []byte) { config = data }
+	var onProvenance func(*provenance.Manifest)
+	if opts.WriteProvenance {
+		onProvenance = func(m *provenance.Manifest) { layerProvenance = m }
+	}
+	onLoad := func(l LayerStats) {
+		stats.addLayer(l)
+		traceLayer(ctx, l)
+	}
+	onWarning := warningHandler(opts, stats)
+	onLayers := func(layers []ocispecs.Descriptor) error {
+		return checkSpace(tempDir, decompressSpace(layers, opts))
+	}
+	if dockerArchive {
+		rootFS, closeAll, err = docker.LoadImage(ctx, tempDir, imageFS, ref, platform, &docker.Options{
+			Layer: layer.Options{
+				MemoryLimit:             opts.LayerMemoryLimit,
+				StrictPaths:             opts.StrictPaths,
+				Limits:                  layerLimits(opts),
+				Jobs:                    opts.Jobs,
+				CacheDir:                opts.LayerCacheDir,
+				CacheMaxSize:            opts.LayerCacheMaxSize,
+				Progress:                opts.Progress,
+				OnLoad:                  onLoad,
+				OnWarning:               onWarning,
+				SkipSpecialFiles:        opts.OnUnsupported == UnsupportedSkip,
+				PlaceholderSpecialFiles: opts.OnUnsupported == UnsupportedPlaceholder,
+			},
+			MaxManifestSize: opts.MaxManifestSize,
+			LayerRange:      opts.LayerRange,
+			SkipLayers:      opts.SkipLayers,
+			EmbedProvenance: opts.EmbedProvenance,
+			OnResolve:       stats.setImageDigest,
+			OnConfig:        onConfig,
+			OnProvenance:    onProvenance,
+		})
+		if err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to load Docker image: %w", err)
+		}
+
+		if opts.EmbedReferrers || opts.WriteReferrers {
+			slog.Warn("Docker images have no referrers")
+		}
+	} else {
+		ociOpts := &oci.Options{
+			FirstManifest: opts.FirstManifest,
+			Layer: layer.Options{
+				LenientMediaType:        opts.LenientMediaType,
+				MemoryLimit:             opts.LayerMemoryLimit,
+				StrictPaths:             opts.StrictPaths,
+				IgnoreTOC:               opts.IgnoreLayerTOC,
+				Decompressors:           opts.Decompressors,
+				Limits:                  layerLimits(opts),
+				Jobs:                    opts.Jobs,
+				CacheDir:                opts.LayerCacheDir,
+				CacheMaxSize:            opts.LayerCacheMaxSize,
+				Progress:                opts.Progress,
+				OnLoad:                  onLoad,
+				OnWarning:               onWarning,
+				SkipSpecialFiles:        opts.OnUnsupported == UnsupportedSkip,
+				PlaceholderSpecialFiles: opts.OnUnsupported == UnsupportedPlaceholder,
+			},
+			LayoutVersions:            opts.LayoutVersions,
+			BestEffortLayout:          opts.BestEffortLayout,
+			BlobDirs:                  blobDirs(opts),
+			MaxManifestSize:           opts.MaxManifestSize,
+			LayerRange:                opts.LayerRange,
+			SkipLayers:                opts.SkipLayers,
+			EmbedProvenance:           opts.EmbedProvenance,
+			OnResolve:                 stats.setImageDigest,
+			OnConfig:                  onConfig,
+			OnProvenance:              onProvenance,
+			OnLayers:                  onLayers,
+			AllowMissingForeignLayers: opts.AllowMissingForeignLayers,
+			ArtifactType:              opts.ArtifactType,
+		}
+
+		if opts.EmbedReferrers || opts.WriteReferrers {
+			ociOpts.OnReferrers = func(layout map[string][]byte) { referrers = layout }
+		}
+
+		if blobs != nil {
+			rootFS, closeAll, err = oci.LoadImageFrom(ctx, tempDir, blobs, ref, platform, ociOpts)
+		} else {
+			rootFS, closeAll, err = oci.LoadImage(ctx, tempDir, imageFS, ref, platform, ociOpts)
+		}
+		if err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to load OCI image: %w", err)
+		}
+	}
+
+	return rootFS, config, referrers, layerProvenance, closeAll, nil
+}
+
+// writeImage builds the EROFS image of rootFS at outputPath, applying the
+// extra entries and running the verification and verity steps. The image
+// config, the layout of its referrers and its provenance, if any, are
+// embedded or written alongside the image as requested.
+func writeImage(ctx context.Context, rootFS fs.FS, config []byte, referrers map[string][]byte, layerProvenance *provenance.Manifest, outputPath string, opts *Options, stats *Stats) error {
+	// Entries are traced back through any added directories to the layers
+	// of the image.
+	layers := &layerDescriber{image: rootFS, stats: stats}
+
+	if len(opts.Exclude) > 0 {
+		linkFS, ok := rootFS.(archivefs.ReadLinkFS)
+		if !ok {
+			return fmt.Errorf("source file system does not support symlinks")
+		}
+
+		var err error
+		rootFS, err = filter.New(linkFS, &filter.Options{
+			Exclude: opts.Exclude,
+			Include: opts.Include,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply path filters: %w", err)
+		}
+	}
+
+	if len(opts.UpperDirs) > 0 || len(opts.AddDirs) > 0 {
+		dirLayers := []fs.FS{rootFS}
+		for _, dir := range opts.UpperDirs {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				return fmt.Errorf("failed to add upper directory: %w", err)
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf("failed to add upper directory: %s is not a directory", dir)
+			}
+
+			dirLayers = append(dirLayers, mountfs.New(upperdir.New(dir), "/", rootFS))
+		}
+
+		for _, dir := range opts.AddDirs {
+			fi, err := os.Stat(dir.Source)
+			if err != nil {
+				return fmt.Errorf("failed to add directory: %w", err)
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf("failed to add directory: %s is not a directory", dir.Source)
+			}
+
+			dirLayers = append(dirLayers, mountfs.New(dirfs.New(dir.Source), dir.Target, rootFS))
+		}
+
+		merged, err := overlayfs.New(dirLayers)
+		if err != nil {
+			return fmt.Errorf("failed to add directories: %w", err)
+		}
+		rootFS = merged
+
+		layers.merged = merged
+		layers.sources = append(slices.Clone(opts.UpperDirs), addDirSources(opts.AddDirs)...)
+	}
+
+	extraEntries := opts.ExtraEntries
+	if opts.EmbedConfig {
+		extraEntries = append(slices.Clone(extraEntries), ExtraEntry{
+			Path:    ConfigPath,
+			Type:    synthetic.TypeFile,
+			Mode:    "0644",
+			Content: string(config),
+		})
+	}
+
+	if len(opts.Annotations) > 0 {
+		annotations, err := json.Marshal(opts.Annotations)
+		if err != nil {
+			return fmt.Errorf("failed to marshal annotations: %w", err)
+		}
+
+		extraEntries = append(slices.Clone(extraEntries), ExtraEntry{
+			Path:    AnnotationsPath,
+			Type:    synthetic.TypeFile,
+			Mode:    "0644",
+			Content: string(annotations),
+		})
+	}
+
+	if opts.EmbedReferrers && referrers != nil {
+		extraEntries = slices.Clone(extraEntries)
+		for _, name := range sortedNames(referrers) {
+			extraEntries = append(extraEntries, ExtraEntry{
+				Path:    path.Join(ReferrersPath, name),
+				Type:    synthetic.TypeFile,
+				Mode:    "0644",
+				Content: string(referrers[name]),
+			})
+		}
+	}
+
+	var overridden []string
+	if len(extraEntries) > 0 {
+		var err error
+		rootFS, overridden, err = synthetic.Apply(rootFS, extraEntries)
+		if err != nil {
+			return fmt.Errorf("failed to apply extra entries: %w", err)
+		}
+
+		for _, name := range overridden {
+			slog.Info("Extra entry overrides image content", slog.String("path", name))
+		}
+
+		stats.ExtraEntries = len(extraEntries)
+		stats.OverriddenEntries = len(overridden)
+	}
+
+	if opts.Profile != "" {
+		linkFS, ok := rootFS.(archivefs.ReadLinkFS)
+		if !ok {
+			return fmt.Errorf("source file system does not support symlinks")
+		}
+
+		ext := filepath.Ext(outputPath)
+		if ext != ".raw" {
+			slog.Warn("systemd only discovers extension images with a .raw suffix", slog.String("path", outputPath))
+		}
+
+		var err error
+		rootFS, err = sysext.Apply(linkFS, opts.Profile, strings.TrimSuffix(filepath.Base(outputPath), ext))
+		if err != nil {
+			return fmt.Errorf("failed to apply %s profile: %w", opts.Profile, err)
+		}
+	}
+
+	// Catch files that cannot be stored before the build, rather than deep
+	// inside the writer.
+	linkFS, ok := rootFS.(archivefs.ReadLinkFS)
+	if !ok {
+		return fmt.Errorf("source file system does not support symlinks")
+	}
+	rootFS = unsupported.New(linkFS, opts.OnUnsupported, warningHandler(opts, stats))
+
+	if opts.Strict {
+		if err := checkNames(ctx, rootFS, layers); err != nil {
+			return err
+		}
+	}
+
+	var signer *verity.Signer
+	if opts.VeritySignKey != "" {
+		var err error
+		signer, err = verity.LoadSigner(opts.VeritySignKey, opts.VeritySignCertificate)
+		if err != nil {
+			return err
+		}
+	}
+
+	// An image written to an output stream is streamed straight into it,
+	// unless it has to be read back once built: to verify it, append a verity
+	// hash tree or wrap it in a disk image. Otherwise the image is built in a
+	// temporary file, so that an interrupted run never leaves a truncated
+	// image behind.
+	stream := opts.OutputWriter != nil && !opts.Verify && !opts.Verity && !opts.GPT
+	tempDir, pattern := filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".tmp-*"
+	if opts.OutputWriter != nil {
+		tempDir, pattern = opts.TempDir, "oci2erofs-*.erofs"
+	}
+
+	// A dry run only lays out the image, so there is nothing to write to.
+	// The partial image of a conversion that can be resumed is left behind
+	// if it fails.
+	var dst io.WriterAt
+	var outputFile *os.File
+	var checkpoint *builder.Checkpoint
+	var partialPath string
+	if opts.Resume {
+		var err error
+		outputFile, checkpoint, err = openPartialImage(outputPath)
+		if err != nil {
+			return err
+		}
+		defer outputFile.Close()
+
+		checkpoint.Key = stats.ImageDigest
+		partialPath = outputFile.Name()
+		dst = outputFile
+	} else if !opts.DryRun && !stream {
+		var err error
+		outputFile, err = os.CreateTemp(tempDir, pattern)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer os.Remove(outputFile.Name())
+		defer outputFile.Close()
+
+		dst = outputFile
+	}
+
+	uuid := opts.UUID
+	if opts.DigestUUID {
+		digestUUID := util.NameUUID(stats.ImageDigest)
+		uuid = &digestUUID
+	}
+
+	disabled, err := disabledFeatures(opts)
+	if err != nil {
+		return err
+	}
+
+	buildCtx, span := startSpan(ctx, "build")
+	buildOpts := &builder.Options{
+		SourceDateEpoch:  opts.SourceDateEpoch,
+		ClampModTime:     opts.ClampModTime,
+		ModTime:          opts.ModTime,
+		Progress:         opts.Progress,
+		UUID:             uuid,
+		VolumeName:       opts.Label,
+		BlockSize:        opts.BlockSize,
+		DisabledFeatures: disabled,
+		Owner:            opts.Owner,
+		ModeMask:         opts.ModeMask,
+		UIDMap:           opts.UIDMap,
+		GIDMap:           opts.GIDMap,
+		InodeFormat:      opts.InodeFormat,
+		MaxMemory:        opts.MaxMemory,
+		TempDir:          opts.TempDir,
+		WriteConcurrency: cmp.Or(opts.WriteConcurrency, opts.IOConcurrency),
+		Preallocate:      opts.Preallocate,
+		HardlinkDedup:    opts.HardlinkDedup,
+		Dedupe:           opts.Dedupe,
+		DataOrder:        opts.DataOrder,
+		TransformFile:    opts.TransformFile,
+		Checkpoint:       checkpoint,
+		DryRun:           opts.DryRun,
+	}
+
+	var summary *builder.Summary
+	if stream {
+		summary, err = builder.Stream(buildCtx, opts.OutputWriter, rootFS, buildOpts)
+	} else {
+		summary, err = builder.Build(buildCtx, dst, rootFS, buildOpts)
+	}
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int("oci2erofs.image.inodes", summary.Inodes),
+			attribute.Int64("oci2erofs.image.size", summary.ImageSize),
+		)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	stats.setSummary(summary)
+
+	if opts.DryRun {
+		planImage(outputPath, summary, opts, stats)
+		return nil
+	}
+
+	if stream {
+		imageSize, err := padStream(opts.OutputWriter, summary.ImageSize, opts)
+		if err != nil {
+			return err
+		}
+
+		reportImage(ctx, outputPath, summary, len(overridden), imageSize, opts, stats)
+		return nil
+	}
+
+	if opts.Verify {
+		verifyStart := time.Now()
+		_, span := startSpan(ctx, "verify")
+		err := verifyImage(outputFile, rootFS, opts)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+		stats.Phases.Verify = time.Since(verifyStart)
+	}
+
+	var sbomDoc []byte
+	if opts.SBOMFormat != "" && opts.OutputWriter == nil {
+		// Inventory the image as built, so that the SBOM reflects any
+		// filtering and extra entries.
+		imageFS, err := erofs.Open(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to open image for SBOM: %w", err)
+		}
+
+		sbomDoc, err = sbom.Generate(ctx, imageFS, opts.SBOMFormat, &sbom.Options{
+			Name:    filepath.Base(outputPath),
+			Created: opts.SourceDateEpoch,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to generate SBOM: %w", err)
+		}
+	}
+
+	imageSize := summary.ImageSize
+
+	var tree *verity.Tree
+	if opts.Verity {
+		salt := opts.VeritySalt
+		if salt == nil && opts.SourceDateEpoch == nil {
+			salt = make([]byte, 32)
+			if _, err := rand.Read(salt); err != nil {
+				return fmt.Errorf("failed to generate verity salt: %w", err)
+			}
+		}
+
+		verityStart := time.Now()
+		verityCtx, span := startSpan(ctx, "verity")
+		tree, err = verity.Append(verityCtx, outputFile, summary.ImageSize, &verity.Options{Salt: salt})
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to append verity hash tree: %w", err)
+		}
+		stats.Phases.Verity = time.Since(verityStart)
+		imageSize = tree.HashOffset + tree.Size
+
+		slog.Info("Appended dm-verity hash tree",
+			slog.String("rootHash", hex.EncodeToString(tree.RootHash)),
+			slog.Int64("hashOffset", tree.HashOffset),
+			slog.String("salt", hex.EncodeToString(tree.Salt)))
+	}
+
+	var rootHashSig []byte
+	if signer != nil {
+		rootHashSig, err = signer.Sign(tree.RootHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.PadPercent > 0 || opts.PadSize > 0 {
+		imageSize, err = padImage(outputFile, imageSize, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.GPT {
+		var signaturePartition []byte
+		if rootHashSig != nil {
+			signaturePartition, err = signer.SignaturePartition(tree.RootHash, rootHashSig)
+			if err != nil {
+				return err
+			}
+		}
+
+		diskFile, diskSize, err := writeDisk(ctx, outputFile, summary.ImageSize, tree, signaturePartition, tempDir, pattern, opts)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(diskFile.Name())
+		defer diskFile.Close()
+
+		outputFile, imageSize = diskFile, diskSize
+
+		if tree != nil {
+			// The hash tree now starts its own partition.
+			diskTree := *tree
+			diskTree.HashOffset = 0
+			tree = &diskTree
+		}
+	}
+
+	var metadata []byte
+	if opts.WriteMetadata {
+		metadata, err = imageMetadata(ctx, outputFile, imageSize, config, tree, stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.OutputWriter != nil {
+		if _, err := outputFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind image: %w", err)
+		}
+
+		if _, err := io.Copy(opts.OutputWriter, util.ContextReader(ctx, outputFile)); err != nil {
+			return fmt.Errorf("failed to write image: %w", err)
+		}
+	}
+
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	if opts.OutputWriter == nil {
+		if err := os.Chmod(outputFile.Name(), 0o644); err != nil {
+			return fmt.Errorf("failed to set output file permissions: %w", err)
+		}
+
+		if opts.WriteConfig {
+			if err := writeFileAtomic(configSidecarPath(outputPath), config); err != nil {
+				return fmt.Errorf("failed to write image config: %w", err)
+			}
+		}
+
+		if layerProvenance != nil {
+			data, err := json.MarshalIndent(layerProvenance, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal provenance: %w", err)
+			}
+
+			if err := writeFileAtomic(provenanceSidecarPath(outputPath), data); err != nil {
+				return fmt.Errorf("failed to write provenance: %w", err)
+			}
+		}
+
+		if opts.WriteReferrers && referrers != nil {
+			if err := writeReferrers(referrersSidecarPath(outputPath), referrers); err != nil {
+				return fmt.Errorf("failed to write referrers: %w", err)
+			}
+		}
+
+		if sbomDoc != nil {
+			sbomPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + sbom.Extension(opts.SBOMFormat)
+			if err := writeFileAtomic(sbomPath, sbomDoc); err != nil {
+				return fmt.Errorf("failed to write SBOM: %w", err)
+			}
+		}
+
+		// Same naming convention as systemd uses for discoverable images.
+		if tree != nil {
+			if err := writeFileAtomic(rootHashSidecarPath(outputPath), []byte(hex.EncodeToString(tree.RootHash)+"\n")); err != nil {
+				return fmt.Errorf("failed to write verity root hash: %w", err)
+			}
+		}
+
+		if rootHashSig != nil {
+			if err := writeFileAtomic(rootHashSidecarPath(outputPath)+".p7s", rootHashSig); err != nil {
+				return fmt.Errorf("failed to write verity root hash signature: %w", err)
+			}
+		}
+
+		if metadata != nil {
+			if err := writeFileAtomic(metadataSidecarPath(outputPath), metadata); err != nil {
+				return fmt.Errorf("failed to write image metadata: %w", err)
+			}
+		}
+
+		if checkpoint != nil {
+			if err := removeCheckpoint(checkpoint); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Rename(outputFile.Name(), outputPath); err != nil {
+			return fmt.Errorf("failed to move output file into place: %w", err)
+		}
+
+		if checkpoint != nil {
+			// The partial image is still there if it was copied into a disk
+			// image, and the directory if it holds the pulled image.
+			_ = os.Remove(partialPath)
+			_ = os.Remove(resumeDirPath(outputPath))
+		}
+
+		if opts.Push != "" {
+			if err := pushImage(ctx, outputPath, tree != nil, metadata != nil, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	reportImage(ctx, outputPath, summary, len(overridden), imageSize, opts, stats)
+
+	return nil
+}
+
+// reportImage reports the image of size bytes that was written to outputPath
+// (or Options.OutputWriter).
+func reportImage(ctx context.Context, outputPath string, summary *Summary, overridden int, size int64, opts *Options, stats *Stats) {
+	slog.Debug("Created EROFS filesystem",
+		slog.String("path", outputPath),
+		slog.Int("inodes", summary.Inodes),
+		slog.Int("overridden", overridden),
+		slog.Int64("size", summary.ImageSize),
+		slog.Duration("duration", summary.ScanDuration+summary.WriteDuration))
+
+	if opts.OutputWriter == nil {
+		stats.Output = outputPath
+	}
+	stats.OutputSize = size
+	stats.Phases.Total = time.Since(stats.start)
+
+	if stats.metrics != nil {
+		stats.metrics.recordImage(ctx, stats)
+	}
+
+	if opts.OnStats != nil {
+		opts.OnStats(stats)
+	}
+}
+
+// planImage reports the image that a dry run would have written to
+// outputPath, estimating the size of its verity hash tree and padding. The
+// partition table of a GPT disk image is not included.
+func planImage(outputPath string, summary *Summary, opts *Options, stats *Stats) {
+	size := summary.ImageSize
+	if opts.Verity {
+		size += verity.TreeSize(summary.ImageSize)
+	}
+	size = paddedSize(size, opts)
+
+	slog.Debug("Planned EROFS filesystem",
+		slog.String("path", outputPath),
+		slog.Int("inodes", summary.Inodes),
+		slog.Int64("size", size))
+
+	stats.DryRun = true
+	stats.Output = outputPath
+	stats.OutputSize = size
+	stats.Phases.Total = time.Since(stats.start)
+
+	if opts.OnStats != nil {
+		opts.OnStats(stats)
+	}
+}
+
+// warningHandler returns a handler that logs and records each warning,
+// passing it on to opts.OnWarning, and fails with ErrWarning in strict mode.
+func warningHandler(opts *Options, stats *Stats) warning.Func {
+	var mu sync.Mutex
+	return func(w *Warning) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Log()
+		stats.addWarning(w)
+
+		if opts.OnWarning != nil {
+			opts.OnWarning(w)
+		}
+
+		if opts.Strict {
+			return fmt.Errorf("%w: %w", ErrWarning, w)
+		}
+
+		return nil
+	}
+}
+
+// outputExt returns the extension of the default output path.
+func outputExt(opts *Options) string {
+	if opts.Profile != "" || opts.GPT {
+		return ".raw"
+	}
+
+	return ".erofs"
+}
+
+// configSidecarPath returns the path of the image config written alongside
+// the image at outputPath.
+func configSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".config.json"
+}
+
+// provenanceSidecarPath returns the path of the provenance manifest written
+// alongside the image at outputPath.
+func provenanceSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".provenance.json"
+}
+
+// rootHashSidecarPath returns the path of the dm-verity root hash written
+// alongside the image at outputPath.
+func rootHashSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".roothash"
+}
+
+// referrersSidecarPath returns the path of the layout of the image's
+// referrers written alongside the image at outputPath.
+func referrersSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".referrers"
+}
+
+// writeReferrers writes the files of the layout of the image's referrers
+// into dir.
+func writeReferrers(dir string, layout map[string][]byte) error {
+	for _, name := range sortedNames(layout) {
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+
+		if err := writeFileAtomic(dst, layout[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortedNames returns the paths of the files of a layout in order.
+func sortedNames(layout map[string][]byte) []string {
+	names := make([]string, 0, len(layout))
+	for name := range layout {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// disabledFeatures returns the features that must not be used, given the
+// target kernel.
+func disabledFeatures(opts *Options) ([]Feature, error) {
+	disabled := slices.Clone(opts.DisabledFeatures)
+
+	if opts.TargetKernel != "" {
+		unsupported, err := builder.UnsupportedFeatures(opts.TargetKernel)
+		if err != nil {
+			return nil, err
+		}
+
+		disabled = append(disabled, unsupported...)
+	}
+
+	return disabled, nil
+}
+
+func layerLimits(opts *Options) layer.Limits {
+	return layer.Limits{
+		MaxSize:     opts.MaxUncompressedSize,
+		MaxFileSize: opts.MaxFileSize,
+		MaxEntries:  opts.MaxEntries,
+	}
+}
+
+// blobDirs returns the file systems of opts.BlobDirs.
+func blobDirs(opts *Options) []fs.FS {
+	var dirs []fs.FS
+	for _, dir := range opts.BlobDirs {
+		dirs = append(dirs, os.DirFS(dir))
+	}
+
+	return dirs
+}
+
+// checkOutput fails if the output file already exists, unless opts.Force is
+// set.
+func checkOutput(outputPath string, opts *Options) error {
+	if opts.Force || opts.OutputWriter != nil || opts.DryRun {
+		return nil
+	}
+
+	if _, err := os.Lstat(outputPath); err == nil {
+		return fmt.Errorf("%w: %s", ErrOutputExists, outputPath)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames
+// it into place.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func verifyImage(image io.ReaderAt, rootFS fs.FS, opts *Options) error {
+	imageFS, err := imagefs.Open(image)
+	if err != nil {
+		return fmt.Errorf("failed to open image for verification: %w", err)
+	}
+
+	srcFS, ok := rootFS.(archivefs.ReadLinkFS)
+	if !ok {
+		return fmt.Errorf("source file system does not support symlinks")
+	}
+
+	// Timestamps are expected to differ when they have been clamped, or
+	// dropped from compact inodes.
+	ignoreModTime := opts.SourceDateEpoch != nil || opts.ClampModTime != nil || opts.ModTime != nil ||
+		opts.InodeFormat == InodeFormatCompact
+
+	changes, err := diff.Compare(srcFS, imageFS, &diff.Options{
+		IgnoreModTime: ignoreModTime,
+		IgnoreOwner:   opts.Owner != nil || opts.UIDMap != nil || opts.GIDMap != nil,
+		IgnoreMode:    opts.ModeMask != 0,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify image: %w", err)
+	}
+
+	for _, c := range changes {
+		slog.Error("Image does not match source",
+			slog.String("path", c.Path),
+			slog.String("kind", string(c.Kind)),
+			slog.String("details", strings.Join(c.Details, ",")))
+	}
+
+	if len(changes) > 0 {
+		return fmt.Errorf("%w: %d files differ", ErrVerificationFailed, len(changes))
+	}
+
+	slog.Info("Verified image against source")
+
+	return nil
+}
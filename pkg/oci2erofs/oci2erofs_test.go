@@ -0,0 +1,1823 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/archivefs/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/pkg/oci2erofs"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestConvert(t *testing.T) {
+	epoch := time.Unix(0, 0)
+
+	t.Run("Tarball", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		var stats *oci2erofs.Stats
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			SourceDateEpoch: &epoch,
+			Verify:          true,
+			ExtraEntries: []oci2erofs.ExtraEntry{
+				{Path: "etc/hostname", Type: "file", Mode: "0644", Content: "toybox\n"},
+				{Path: "etc/group", Type: "file", Mode: "0644", Content: "root:x:0:\n"},
+			},
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = s
+			},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 2, stats.ExtraEntries)
+		require.Equal(t, 1, stats.OverriddenEntries)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		target, err := fsys.ReadLink("bin/sh")
+		require.NoError(t, err)
+		require.NotEmpty(t, target)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "toybox\n", string(hostname))
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		f, err := os.Open("../../testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		stdin := os.Stdin
+		os.Stdin = f
+		t.Cleanup(func() {
+			os.Stdin = stdin
+		})
+
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   oci2erofs.Stdin,
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		_, err = os.Stat(outputPath)
+		require.NoError(t, err)
+	})
+
+	t.Run("Output Writer", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:        "../../testdata/toybox.tar",
+			OutputWriter: &buf,
+			TempDir:      t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		target, err := fsys.ReadLink("bin/sh")
+		require.NoError(t, err)
+		require.NotEmpty(t, target)
+
+		t.Run("Streamed", func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+			require.NoError(t, oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   "../../testdata/toybox.tar",
+				Output:  outputPath,
+				TempDir: t.TempDir(),
+				PadSize: 1 << 20,
+			}))
+
+			expected, err := os.ReadFile(outputPath)
+			require.NoError(t, err)
+
+			// The image is not built in a temporary file first.
+			tempDir := t.TempDir()
+			var streamed bytes.Buffer
+			err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image: "../../testdata/toybox.tar",
+				OutputWriter: writerFunc(func(p []byte) (int, error) {
+					images, err := filepath.Glob(filepath.Join(tempDir, "*.erofs"))
+					require.NoError(t, err)
+					require.Empty(t, images)
+
+					return streamed.Write(p)
+				}),
+				TempDir: tempDir,
+				PadSize: 1 << 20,
+			})
+			require.NoError(t, err)
+			require.Equal(t, expected, streamed.Bytes())
+		})
+	})
+
+	t.Run("Image Config", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       "../../testdata/toybox.tar",
+			Output:      outputPath,
+			TempDir:     t.TempDir(),
+			EmbedConfig: true,
+			WriteConfig: true,
+		})
+		require.NoError(t, err)
+
+		sidecar, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.config.json"))
+		require.NoError(t, err)
+
+		var config ocispecs.Image
+		require.NoError(t, json.Unmarshal(sidecar, &config))
+		require.Equal(t, "linux", config.OS)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		embedded, err := fs.ReadFile(fsys, oci2erofs.ConfigPath)
+		require.NoError(t, err)
+		require.Equal(t, sidecar, embedded)
+	})
+
+	t.Run("Embedded Provenance", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			EmbedProvenance: true,
+		})
+		require.NoError(t, err)
+
+		fsys := openImage(t, outputPath)
+
+		data, err := fs.ReadFile(fsys, oci2erofs.ProvenancePath)
+		require.NoError(t, err)
+
+		var manifest struct {
+			Layers []ocispecs.Descriptor `json:"layers"`
+			Files  map[string]int        `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(data, &manifest))
+		require.NotEmpty(t, manifest.Layers)
+
+		// Every file in the image but the manifest (and its directories) is
+		// accounted for.
+		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+
+			if path != "." && !strings.HasPrefix(oci2erofs.ProvenancePath, path) {
+				require.Contains(t, manifest.Files, path)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Annotations", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		annotations := map[string]string{
+			"org.opencontainers.image.revision": "0123456789abcdef",
+			"build.id":                          "42",
+		}
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       "../../testdata/toybox.tar",
+			Output:      outputPath,
+			TempDir:     t.TempDir(),
+			Annotations: annotations,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		embedded, err := oci2erofs.ReadAnnotations(fsys)
+		require.NoError(t, err)
+		require.Equal(t, annotations, embedded)
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       "../../testdata/toybox.tar",
+			Output:      filepath.Join(t.TempDir(), "toybox.erofs"),
+			Annotations: map[string]string{"": "empty"},
+		})
+		require.ErrorContains(t, err, "annotation keys must not be empty")
+	})
+
+	t.Run("Provenance", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			WriteProvenance: true,
+		})
+		require.NoError(t, err)
+
+		sidecar, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.provenance.json"))
+		require.NoError(t, err)
+
+		var m struct {
+			Layers  []ocispecs.Descriptor `json:"layers"`
+			History []ocispecs.History    `json:"history"`
+			Files   map[string]int        `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(sidecar, &m))
+
+		require.NotEmpty(t, m.Layers)
+		require.Len(t, m.History, len(m.Layers))
+
+		layerIndex, ok := m.Files["etc/passwd"]
+		require.True(t, ok)
+		require.Less(t, layerIndex, len(m.Layers))
+	})
+
+	t.Run("Referrers", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:          "../../testdata/toybox.tar",
+			Output:         outputPath,
+			TempDir:        t.TempDir(),
+			EmbedReferrers: true,
+			WriteReferrers: true,
+		})
+		require.NoError(t, err)
+
+		// The image has no referrers, but the layout is written regardless.
+		index, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.referrers", "index.json"))
+		require.NoError(t, err)
+
+		var referrers ocispecs.Index
+		require.NoError(t, json.Unmarshal(index, &referrers))
+		require.Empty(t, referrers.Manifests)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		embedded, err := fs.ReadFile(fsys, oci2erofs.ReferrersPath+"/index.json")
+		require.NoError(t, err)
+		require.Equal(t, index, embedded)
+	})
+
+	t.Run("SBOM", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:      "../../testdata/toybox.tar",
+			Output:     outputPath,
+			TempDir:    t.TempDir(),
+			SBOMFormat: oci2erofs.SBOMFormatSPDX,
+		})
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.spdx.json"))
+		require.NoError(t, err)
+
+		var doc struct {
+			Name  string `json:"name"`
+			Files []struct {
+				FileName string `json:"fileName"`
+			} `json:"files"`
+		}
+		require.NoError(t, json.Unmarshal(data, &doc))
+		require.Equal(t, "toybox.erofs", doc.Name)
+
+		var names []string
+		for _, f := range doc.Files {
+			names = append(names, f.FileName)
+		}
+		require.Contains(t, names, "./etc/passwd")
+	})
+
+	t.Run("SBOM Unsupported Format", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:      "../../testdata/toybox.tar",
+			Output:     filepath.Join(t.TempDir(), "toybox.erofs"),
+			SBOMFormat: "swid",
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Image Config Without Image", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       t.TempDir(),
+			Output:      filepath.Join(t.TempDir(), "rootfs.erofs"),
+			FromDir:     true,
+			EmbedConfig: true,
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Sysext Profile", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.raw")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			Profile: oci2erofs.ProfileSysext,
+			Verify:  true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		entries, err := fs.ReadDir(fsys, ".")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "usr", entries[0].Name())
+
+		release, err := fs.ReadFile(fsys, "usr/lib/extension-release.d/extension-release.toybox")
+		require.NoError(t, err)
+		require.Equal(t, "ID=_any\n", string(release))
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		var mu sync.Mutex
+		last := make(map[oci2erofs.ProgressEvent]oci2erofs.ProgressEvent)
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir: t.TempDir(),
+			Progress: func(e oci2erofs.ProgressEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				last[oci2erofs.ProgressEvent{Stage: e.Stage, Item: e.Item}] = e
+			},
+		})
+		require.NoError(t, err)
+
+		stages := make(map[oci2erofs.ProgressStage]bool)
+		for _, e := range last {
+			require.True(t, e.Done(), "%s %s", e.Stage, e.Item)
+			stages[e.Stage] = true
+		}
+
+		require.True(t, stages[oci2erofs.ProgressStageDecompress])
+		require.True(t, stages[oci2erofs.ProgressStageBuild])
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		var stats []*oci2erofs.Stats
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = append(stats, s)
+			},
+		})
+		require.NoError(t, err)
+
+		require.Len(t, stats, 1)
+		s := stats[0]
+
+		require.Equal(t, outputPath, s.Output)
+		require.NotEmpty(t, s.Layers)
+		require.Positive(t, s.InputSize)
+		require.Positive(t, s.Directories)
+		require.Positive(t, s.Symlinks)
+		require.Equal(t, s.Inodes, s.Directories+s.RegularFiles+s.Symlinks)
+
+		fi, err := os.Stat(outputPath)
+		require.NoError(t, err)
+		require.Equal(t, fi.Size(), s.ImageSize)
+		require.Equal(t, s.ImageSize-s.DataSize, s.MetadataSize)
+		require.Positive(t, s.Phases.Total)
+
+		var buf bytes.Buffer
+		require.NoError(t, s.WriteText(&buf))
+		require.Contains(t, buf.String(), "Metadata overhead:")
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		outputDir := t.TempDir()
+		outputPath := filepath.Join(outputDir, "toybox.erofs")
+
+		var plan *oci2erofs.Stats
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			Verity:  true,
+			DryRun:  true,
+			OnStats: func(s *oci2erofs.Stats) {
+				plan = s
+			},
+		})
+		require.NoError(t, err)
+
+		require.NotNil(t, plan)
+		require.True(t, plan.DryRun)
+		require.Equal(t, outputPath, plan.Output)
+
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		var stats *oci2erofs.Stats
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			Verity:  true,
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = s
+			},
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, stats.Inodes, plan.Inodes)
+		require.Equal(t, stats.ImageSize, plan.ImageSize)
+		require.Equal(t, stats.Features, plan.Features)
+
+		fi, err := os.Stat(outputPath)
+		require.NoError(t, err)
+		require.Equal(t, fi.Size(), plan.OutputSize)
+		require.Equal(t, fi.Size(), stats.OutputSize)
+
+		t.Run("Push", func(t *testing.T) {
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   "../../testdata/toybox.tar",
+				Output:  outputPath,
+				TempDir: t.TempDir(),
+				Push:    "oci://localhost:5000/toybox:latest",
+				DryRun:  true,
+			})
+			require.ErrorContains(t, err, "dry run")
+		})
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		rootDir := t.TempDir()
+		for i := range 8 {
+			content := bytes.Repeat([]byte{byte('a' + i)}, 8192+i*1000)
+			require.NoError(t, os.WriteFile(filepath.Join(rootDir, fmt.Sprintf("file%d", i)), content, 0o644))
+		}
+
+		outputDir := t.TempDir()
+		outputPath := filepath.Join(outputDir, "rootfs.erofs")
+
+		// Interrupted part way through writing the image.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := oci2erofs.Convert(ctx, &oci2erofs.Options{
+			Image:            rootDir,
+			Output:           outputPath,
+			FromDir:          true,
+			WriteConcurrency: 1,
+			Resume:           true,
+			Progress: func(e oci2erofs.ProgressEvent) {
+				if e.Stage == oci2erofs.ProgressStageBuild && e.Current == 3 {
+					cancel()
+				}
+			},
+		})
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = os.Stat(outputPath)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		var stats *oci2erofs.Stats
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:            rootDir,
+			Output:           outputPath,
+			FromDir:          true,
+			WriteConcurrency: 1,
+			Resume:           true,
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = s
+			},
+		})
+		require.NoError(t, err)
+		require.Positive(t, stats.ResumedFiles)
+
+		// Nothing is left behind but the image, which is the same as if the
+		// conversion had not been interrupted.
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		resumed, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+
+		require.NoError(t, oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   rootDir,
+			Output:  outputPath,
+			Force:   true,
+			FromDir: true,
+		}))
+
+		data, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		require.Equal(t, data, resumed)
+
+		t.Run("Output Stream", func(t *testing.T) {
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:        rootDir,
+				OutputWriter: io.Discard,
+				FromDir:      true,
+				Resume:       true,
+			})
+			require.ErrorContains(t, err, "resuming requires")
+		})
+	})
+
+	t.Run("Telemetry", func(t *testing.T) {
+		spans := tracetest.NewSpanRecorder()
+		reader := sdkmetric.NewManualReader()
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:          "../../testdata/toybox.tar",
+			Output:         filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:        t.TempDir(),
+			Verify:         true,
+			TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)),
+			MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		})
+		require.NoError(t, err)
+
+		names := make(map[string]int)
+		var root sdktrace.ReadOnlySpan
+		for _, span := range spans.Ended() {
+			names[span.Name()]++
+			if span.Name() == "convert" {
+				root = span
+			}
+		}
+		require.Equal(t, map[string]int{"convert": 1, "load": 1, "layer": names["layer"], "build": 1, "verify": 1}, names)
+		require.Positive(t, names["layer"])
+
+		// Every span belongs to the conversion.
+		require.NotNil(t, root)
+		for _, span := range spans.Ended() {
+			require.Equal(t, root.SpanContext().TraceID(), span.SpanContext().TraceID())
+		}
+
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+
+		sums := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if sum, ok := m.Data.(metricdata.Sum[int64]); ok {
+					for _, dp := range sum.DataPoints {
+						sums[m.Name] += dp.Value
+					}
+				}
+			}
+		}
+		require.Equal(t, int64(1), sums["oci2erofs.conversions"])
+		require.Equal(t, int64(1), sums["oci2erofs.images"])
+		require.Equal(t, int64(names["layer"]), sums["oci2erofs.layers"])
+		require.Positive(t, sums["oci2erofs.layer.input"])
+		require.Positive(t, sums["oci2erofs.image.size"])
+	})
+
+	t.Run("Verity", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			SourceDateEpoch: &epoch,
+			Verity:          true,
+		})
+		require.NoError(t, err)
+
+		rootHash, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.roothash"))
+		require.NoError(t, err)
+		require.Len(t, rootHash, 65)
+	})
+
+	t.Run("Padding", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		var stats *oci2erofs.Stats
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:      "../../testdata/toybox.tar",
+			Output:     outputPath,
+			TempDir:    t.TempDir(),
+			PadPercent: 50,
+			PadSize:    1 << 20,
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = s
+			},
+		})
+		require.NoError(t, err)
+
+		fi, err := os.Stat(outputPath)
+		require.NoError(t, err)
+
+		require.Zero(t, fi.Size()%(1<<20))
+		require.GreaterOrEqual(t, fi.Size(), stats.ImageSize*3/2)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "etc/passwd")
+		require.NoError(t, err)
+	})
+
+	t.Run("Throttled", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("scheduling priorities are only supported on Linux")
+		}
+
+		// The default I/O priority, so as not to slow down the other tests.
+		ioPriority, err := oci2erofs.ParseIOPriority("best-effort:4")
+		require.NoError(t, err)
+
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:         "../../testdata/toybox.tar",
+			Output:        outputPath,
+			TempDir:       t.TempDir(),
+			Jobs:          1,
+			IOConcurrency: 1,
+			IOPriority:    ioPriority,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "etc/passwd")
+		require.NoError(t, err)
+	})
+
+	t.Run("GPT", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.raw")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			SourceDateEpoch: &epoch,
+			Verity:          true,
+			GPT:             true,
+			PartitionType:   "root-x86-64",
+		})
+		require.NoError(t, err)
+
+		disk, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		require.Equal(t, "EFI PART", string(disk[512:520]))
+
+		rootHash, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.roothash"))
+		require.NoError(t, err)
+
+		rootHashBytes, err := hex.DecodeString(strings.TrimSpace(string(rootHash)))
+		require.NoError(t, err)
+
+		// The partition UUIDs are derived from the root hash (the last 8
+		// bytes of a GUID are stored as is).
+		entries := disk[2*512:]
+		require.Equal(t, rootHashBytes[8:16], entries[24:32])
+		require.Equal(t, rootHashBytes[len(rootHashBytes)-8:], entries[128+24:128+32])
+
+		firstLBA := binary.LittleEndian.Uint64(entries[32:40])
+		lastLBA := binary.LittleEndian.Uint64(entries[40:48])
+		partition := disk[firstLBA*512 : (lastLBA+1)*512]
+
+		fsys, err := erofs.Open(bytes.NewReader(partition))
+		require.NoError(t, err)
+
+		_, err = fs.Stat(fsys, "etc/passwd")
+		require.NoError(t, err)
+
+		// The verity partition starts with the verity superblock.
+		verityLBA := binary.LittleEndian.Uint64(entries[128+32 : 128+40])
+		require.Equal(t, "verity", string(disk[verityLBA*512:verityLBA*512+6]))
+	})
+
+	t.Run("Verity Signature", func(t *testing.T) {
+		dir := t.TempDir()
+		outputPath := filepath.Join(dir, "toybox.raw")
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "oci2erofs"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		require.NoError(t, err)
+
+		keyPath := filepath.Join(dir, "signing.key")
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+
+		certPath := filepath.Join(dir, "signing.crt")
+		require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0o644))
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:                 "../../testdata/toybox.tar",
+			Output:                outputPath,
+			TempDir:               t.TempDir(),
+			SourceDateEpoch:       &epoch,
+			Verity:                true,
+			VeritySignKey:         keyPath,
+			VeritySignCertificate: certPath,
+			GPT:                   true,
+			PartitionType:         "usr-arm64",
+		})
+		require.NoError(t, err)
+
+		sig, err := os.ReadFile(filepath.Join(dir, "toybox.roothash.p7s"))
+		require.NoError(t, err)
+
+		rootHash, err := os.ReadFile(filepath.Join(dir, "toybox.roothash"))
+		require.NoError(t, err)
+
+		// The third partition holds the signature.
+		disk, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+
+		entry := disk[2*512+2*128:]
+		firstLBA := binary.LittleEndian.Uint64(entry[32:40])
+
+		var signature struct {
+			RootHash  string `json:"rootHash"`
+			Signature []byte `json:"signature"`
+		}
+		require.NoError(t, json.NewDecoder(bytes.NewReader(disk[firstLBA*512:])).Decode(&signature))
+		require.Equal(t, strings.TrimSpace(string(rootHash)), signature.RootHash)
+		require.Equal(t, sig, signature.Signature)
+
+		t.Run("Requires Verity", func(t *testing.T) {
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:                 "../../testdata/toybox.tar",
+				Output:                filepath.Join(t.TempDir(), "toybox.erofs"),
+				TempDir:               t.TempDir(),
+				VeritySignKey:         keyPath,
+				VeritySignCertificate: certPath,
+			})
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		var stats *oci2erofs.Stats
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:           "../../testdata/toybox.tar",
+			Output:          outputPath,
+			TempDir:         t.TempDir(),
+			SourceDateEpoch: &epoch,
+			Verity:          true,
+			WriteMetadata:   true,
+			OnStats: func(s *oci2erofs.Stats) {
+				stats = s
+			},
+		})
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.metadata.json"))
+		require.NoError(t, err)
+
+		var metadata oci2erofs.Metadata
+		require.NoError(t, json.Unmarshal(data, &metadata))
+
+		image, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+
+		require.Equal(t, digest.FromBytes(image), metadata.Digest)
+		require.Equal(t, int64(len(image)), metadata.Size)
+		require.Equal(t, stats.ImageSize, metadata.FilesystemSize)
+		require.Equal(t, stats.ImageDigest, metadata.SourceDigest)
+		require.Equal(t, "linux/amd64", metadata.Platform)
+
+		rootHash, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), "toybox.roothash"))
+		require.NoError(t, err)
+
+		require.NotNil(t, metadata.Verity)
+		require.Equal(t, strings.TrimSpace(string(rootHash)), metadata.Verity.RootHash)
+		require.Equal(t, metadata.FilesystemSize, metadata.Verity.HashOffset)
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		blobs := make(map[string][]byte)
+		var manifest []byte
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodHead:
+				w.WriteHeader(http.StatusNotFound)
+			case r.Method == http.MethodPost && r.URL.Path == "/v2/images/toybox/blobs/uploads/":
+				w.Header().Set("Location", "/v2/images/toybox/blobs/uploads/1")
+				w.WriteHeader(http.StatusAccepted)
+			case r.Method == http.MethodPut && r.URL.Path == "/v2/images/toybox/blobs/uploads/1":
+				blobs[r.URL.Query().Get("digest")], _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == http.MethodPut && r.URL.Path == "/v2/images/toybox/manifests/v1":
+				manifest, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		host := strings.TrimPrefix(server.URL, "http://")
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:               "../../testdata/toybox.tar",
+			Output:              outputPath,
+			TempDir:             t.TempDir(),
+			Verity:              true,
+			Push:                oci2erofs.PushPrefix + host + "/images/toybox:v1",
+			RegistryCredentials: &oci2erofs.RegistryCredentials{},
+			InsecureRegistries:  []string{host},
+		})
+		require.NoError(t, err)
+
+		var pushed ocispecs.Manifest
+		require.NoError(t, json.Unmarshal(manifest, &pushed))
+		require.Equal(t, oci2erofs.ArtifactTypeEROFS, pushed.ArtifactType)
+		require.Len(t, pushed.Layers, 2)
+
+		image, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+
+		require.Equal(t, oci2erofs.MediaTypeEROFS, pushed.Layers[0].MediaType)
+		require.Equal(t, "toybox.erofs", pushed.Layers[0].Annotations[ocispecs.AnnotationTitle])
+		require.Equal(t, image, blobs[pushed.Layers[0].Digest.String()])
+		require.Equal(t, oci2erofs.MediaTypeRootHash, pushed.Layers[1].MediaType)
+		require.Equal(t, "toybox.roothash", pushed.Layers[1].Annotations[ocispecs.AnnotationTitle])
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir: t.TempDir(),
+			Verify:  true,
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Transform File", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		var transformed []string
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			TransformFile: func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+				transformed = append(transformed, path)
+				return hdr, strings.NewReader("rewritten " + path), nil
+			},
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, transformed)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		data, err := fs.ReadFile(fsys, transformed[0])
+		require.NoError(t, err)
+		require.Equal(t, "rewritten "+transformed[0], string(data))
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:  "../../testdata/toybox.tar",
+			Output: filepath.Join(t.TempDir(), "toybox.erofs"),
+			Verify: true,
+			TransformFile: func(path string, hdr *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+				return hdr, r, nil
+			},
+		})
+		require.ErrorContains(t, err, "cannot be verified")
+	})
+
+	t.Run("Compact Inodes", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		// The dropped timestamps are not reported as differences.
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       "../../testdata/toybox.tar",
+			Output:      outputPath,
+			TempDir:     t.TempDir(),
+			InodeFormat: oci2erofs.InodeFormatCompact,
+			Verify:      true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		fi, err := fsys.StatLink("bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, uint16(erofs.InodeLayoutCompact), fi.Sys().(*erofs.Inode).Layout())
+	})
+
+	t.Run("Unknown Inode Format", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       "../../testdata/toybox.tar",
+			Output:      filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:     t.TempDir(),
+			InodeFormat: "tiny",
+		})
+		require.ErrorContains(t, err, "unknown inode format")
+	})
+
+	t.Run("Unsupported Block Size", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:     "../../testdata/toybox.tar",
+			Output:    filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:   t.TempDir(),
+			BlockSize: 8192,
+		})
+		require.ErrorContains(t, err, "unsupported block size")
+	})
+
+	t.Run("All Platforms", func(t *testing.T) {
+		outputDir := t.TempDir()
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:        "../../internal/oci/testdata/toybox-multiarch",
+			Output:       filepath.Join(outputDir, "toybox.erofs"),
+			Ref:          "docker.io/tianon/toybox:0.8.11",
+			TempDir:      t.TempDir(),
+			AllPlatforms: true,
+		})
+		require.NoError(t, err)
+
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		require.Equal(t, []string{"toybox-linux-amd64.erofs", "toybox-linux-arm64-v8.erofs"}, names)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		tempDir := t.TempDir()
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(ctx, &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: tempDir,
+		})
+		require.ErrorIs(t, err, context.Canceled)
+
+		// Temporary files are cleaned up.
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		// No partially written output is left behind.
+		entries, err = os.ReadDir(filepath.Dir(outputPath))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Existing Output", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+		require.NoError(t, os.WriteFile(outputPath, []byte("existing"), 0o644))
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+		})
+		require.ErrorIs(t, err, oci2erofs.ErrOutputExists)
+
+		content, err := os.ReadFile(outputPath)
+		require.NoError(t, err)
+		require.Equal(t, "existing", string(content))
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			Force:   true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		_, err = erofs.Open(f)
+		require.NoError(t, err)
+	})
+
+	t.Run("From Dir", func(t *testing.T) {
+		rootDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc/hostname"), []byte("rootfs\n"), 0o644))
+		require.NoError(t, os.Symlink("etc/hostname", filepath.Join(rootDir, "hostname")))
+
+		outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   rootDir,
+			Output:  outputPath,
+			FromDir: true,
+			Verify:  true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		target, err := fsys.ReadLink("hostname")
+		require.NoError(t, err)
+		require.Equal(t, "etc/hostname", target)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "rootfs\n", string(hostname))
+
+		t.Run("Unsupported File Type", func(t *testing.T) {
+			err := mkfifo(filepath.Join(rootDir, "fifo"))
+			if errors.Is(err, errors.ErrUnsupported) {
+				t.Skip("named pipes are not supported on this platform")
+			}
+			require.NoError(t, err)
+
+			err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   rootDir,
+				Output:  filepath.Join(t.TempDir(), "rootfs.erofs"),
+				FromDir: true,
+			})
+			require.ErrorIs(t, err, oci2erofs.ErrUnsupportedFile)
+			require.ErrorContains(t, err, "unsupported file type")
+
+			t.Run("Skip", func(t *testing.T) {
+				outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+				var warnings []*oci2erofs.Warning
+				err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+					Image:         rootDir,
+					Output:        outputPath,
+					FromDir:       true,
+					OnUnsupported: oci2erofs.UnsupportedSkip,
+					OnWarning: func(w *oci2erofs.Warning) {
+						warnings = append(warnings, w)
+					},
+				})
+				require.NoError(t, err)
+
+				fsys := openImage(t, outputPath)
+				_, err = fs.Stat(fsys, "fifo")
+				require.ErrorIs(t, err, fs.ErrNotExist)
+
+				require.Len(t, warnings, 1)
+				require.Equal(t, oci2erofs.WarningSpecialFile, warnings[0].Kind)
+				require.Equal(t, "fifo", warnings[0].Path)
+			})
+
+			t.Run("Placeholder", func(t *testing.T) {
+				outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+				err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+					Image:         rootDir,
+					Output:        outputPath,
+					FromDir:       true,
+					OnUnsupported: oci2erofs.UnsupportedPlaceholder,
+				})
+				require.NoError(t, err)
+
+				fi, err := fs.Stat(openImage(t, outputPath), "fifo")
+				require.NoError(t, err)
+				require.True(t, fi.Mode().IsRegular())
+				require.Zero(t, fi.Size())
+			})
+		})
+	})
+
+	t.Run("From Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0o755}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./etc/hostname", Mode: 0o644, Size: 7}))
+		_, err := tw.Write([]byte("rootfs\n"))
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeChar, Name: "./dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}))
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+
+		tarPath := filepath.Join(t.TempDir(), "rootfs.tar.gz")
+		require.NoError(t, os.WriteFile(tarPath, buf.Bytes(), 0o644))
+
+		outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   tarPath,
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			FromTar: true,
+			Verify:  true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		hostname, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "rootfs\n", string(hostname))
+
+		_, err = fsys.Stat("dev/null")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		t.Run("Warnings", func(t *testing.T) {
+			var warnings []*oci2erofs.Warning
+			var stats *oci2erofs.Stats
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   tarPath,
+				Output:  filepath.Join(t.TempDir(), "rootfs.erofs"),
+				TempDir: t.TempDir(),
+				FromTar: true,
+				OnWarning: func(w *oci2erofs.Warning) {
+					warnings = append(warnings, w)
+				},
+				OnStats: func(s *oci2erofs.Stats) {
+					stats = s
+				},
+			})
+			require.NoError(t, err)
+
+			require.Len(t, warnings, 1)
+			require.Equal(t, oci2erofs.WarningSpecialFile, warnings[0].Kind)
+			require.Equal(t, "./dev/null", warnings[0].Path)
+
+			require.NotNil(t, stats)
+			require.Equal(t, []oci2erofs.Warning{*warnings[0]}, stats.Warnings)
+		})
+
+		t.Run("Strict", func(t *testing.T) {
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   tarPath,
+				Output:  filepath.Join(t.TempDir(), "rootfs.erofs"),
+				TempDir: t.TempDir(),
+				FromTar: true,
+				Strict:  true,
+			})
+			require.ErrorIs(t, err, oci2erofs.ErrWarning)
+			require.ErrorContains(t, err, "dev/null")
+		})
+
+		t.Run("On Unsupported", func(t *testing.T) {
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:         tarPath,
+				Output:        filepath.Join(t.TempDir(), "rootfs.erofs"),
+				TempDir:       t.TempDir(),
+				FromTar:       true,
+				OnUnsupported: oci2erofs.UnsupportedError,
+			})
+			require.ErrorIs(t, err, oci2erofs.ErrUnsupportedFile)
+			require.ErrorContains(t, err, "dev/null")
+
+			outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+			err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:         tarPath,
+				Output:        outputPath,
+				TempDir:       t.TempDir(),
+				FromTar:       true,
+				OnUnsupported: oci2erofs.UnsupportedPlaceholder,
+				Verify:        true,
+			})
+			require.NoError(t, err)
+
+			fi, err := fs.Stat(openImage(t, outputPath), "dev/null")
+			require.NoError(t, err)
+			require.True(t, fi.Mode().IsRegular())
+			require.Equal(t, fs.FileMode(0o666), fi.Mode().Perm())
+
+			err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:         tarPath,
+				Output:        filepath.Join(t.TempDir(), "rootfs.erofs"),
+				FromTar:       true,
+				OnUnsupported: "ignore",
+			})
+			require.ErrorContains(t, err, "unknown policy")
+		})
+	})
+
+	t.Run("Add Dir", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 7}))
+		_, err := tw.Write([]byte("rootfs\n"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		tarPath := filepath.Join(t.TempDir(), "rootfs.tar")
+		require.NoError(t, os.WriteFile(tarPath, buf.Bytes(), 0o644))
+
+		extraDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(extraDir, "hostname"), []byte("extra\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(extraDir, "config"), []byte("debug = true\n"), 0o644))
+
+		outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   tarPath,
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			FromTar: true,
+			Verify:  true,
+			AddDirs: []oci2erofs.AddDir{
+				{Source: extraDir, Target: "/etc"},
+				{Source: extraDir, Target: "/opt/app"},
+			},
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		for name, content := range map[string]string{
+			"etc/hostname":     "extra\n",
+			"etc/config":       "debug = true\n",
+			"opt/app/config":   "debug = true\n",
+			"opt/app/hostname": "extra\n",
+		} {
+			data, err := fs.ReadFile(fsys, name)
+			require.NoError(t, err)
+			require.Equal(t, content, string(data), name)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/HOSTNAME", Mode: 0o644, Size: 7}))
+		_, err := tw.Write([]byte("rootfs\n"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		tarPath := filepath.Join(t.TempDir(), "rootfs.tar")
+		require.NoError(t, os.WriteFile(tarPath, buf.Bytes(), 0o644))
+
+		extraDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(extraDir, "hostname"), []byte("extra\n"), 0o644))
+
+		opts := &oci2erofs.Options{
+			Image:   tarPath,
+			Output:  filepath.Join(t.TempDir(), "rootfs.erofs"),
+			TempDir: t.TempDir(),
+			FromTar: true,
+			AddDirs: []oci2erofs.AddDir{{Source: extraDir, Target: "/etc"}},
+		}
+
+		require.NoError(t, oci2erofs.Convert(context.Background(), opts))
+
+		opts.Force = true
+		opts.Strict = true
+
+		err = oci2erofs.Convert(context.Background(), opts)
+		require.ErrorIs(t, err, oci2erofs.ErrInvalidNames)
+		require.ErrorContains(t, err, "etc/hostname (from layer "+extraDir+"): differs only by case from etc/HOSTNAME")
+
+		// Excluding either entry resolves the collision.
+		opts.Exclude = []string{"/etc/HOSTNAME"}
+		require.NoError(t, oci2erofs.Convert(context.Background(), opts))
+	})
+
+	t.Run("Docker Daemon", func(t *testing.T) {
+		archive, err := os.ReadFile("../../testdata/toybox.tar")
+		require.NoError(t, err)
+
+		socketPath := filepath.Join(t.TempDir(), "docker.sock")
+		lis, err := net.Listen("unix", socketPath)
+		require.NoError(t, err)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "tianon/toybox:0.8.11", r.URL.Query().Get("names"))
+			_, _ = w.Write(archive)
+		}))
+		server.Listener = lis
+		server.Start()
+		t.Cleanup(server.Close)
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:      oci2erofs.DockerDaemonPrefix + "tianon/toybox:0.8.11",
+			Output:     filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:    t.TempDir(),
+			DockerHost: "unix://" + socketPath,
+			Verify:     true,
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Containerd Not Running", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:             oci2erofs.ContainerdPrefix + "alpine:3.19",
+			Output:            filepath.Join(t.TempDir(), "alpine.erofs"),
+			TempDir:           t.TempDir(),
+			ContainerdAddress: filepath.Join(t.TempDir(), "containerd.sock"),
+		})
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Containers Storage Missing", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:       oci2erofs.ContainersStoragePrefix + "alpine:3.19",
+			Output:      filepath.Join(t.TempDir(), "alpine.erofs"),
+			TempDir:     t.TempDir(),
+			StorageRoot: t.TempDir(),
+		})
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Ref Not Found", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir: t.TempDir(),
+			Ref:     "tianon/toybox:missing",
+		})
+		require.ErrorIs(t, err, oci2erofs.ErrRefNotFound)
+	})
+
+	t.Run("Platform", func(t *testing.T) {
+		// The image's descriptor has no platform, the image config does.
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:    "../../testdata/toybox.tar",
+			Output:   filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:  t.TempDir(),
+			Platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		})
+		require.NoError(t, err)
+
+		err = oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:    "../../testdata/toybox.tar",
+			Output:   filepath.Join(t.TempDir(), "toybox.erofs"),
+			TempDir:  t.TempDir(),
+			Platform: &ocispecs.Platform{OS: "linux", Architecture: "s390x"},
+		})
+		require.ErrorIs(t, err, oci2erofs.ErrPlatformNotFound)
+	})
+
+	t.Run("Not An Image", func(t *testing.T) {
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   t.TempDir(),
+			Output:  filepath.Join(t.TempDir(), "empty.erofs"),
+			TempDir: t.TempDir(),
+		})
+		require.ErrorIs(t, err, oci2erofs.ErrUnsupportedLayout)
+	})
+}
+
+func TestConvertPAX(t *testing.T) {
+	longDir := strings.Repeat("d", 60) + "/" + strings.Repeat("d", 60)
+	longPath := longDir + "/file-with-a-long-name.txt"
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+
+	// Go's archive/tar, in addition to the checked in GNU tar and bsdtar
+	// fixtures (see testdata/pax).
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755},
+		{Typeflag: tar.TypeDir, Name: "./" + strings.Repeat("d", 60) + "/", Mode: 0o755},
+		{Typeflag: tar.TypeDir, Name: "./" + longDir + "/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "./" + longPath, Mode: 0o644, Size: 6},
+		{Typeflag: tar.TypeSymlink, Name: "./link", Linkname: longPath, Mode: 0o777},
+	} {
+		hdr.Uid = 3000000
+		hdr.Gid = 3000001
+		hdr.ModTime = mtime
+		hdr.Format = tar.FormatPAX
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("hello\n"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	goTarPath := filepath.Join(t.TempDir(), "go.tar")
+	require.NoError(t, os.WriteFile(goTarPath, buf.Bytes(), 0o644))
+
+	for name, tarPath := range map[string]string{
+		"GNU tar":     "../../testdata/pax/gnu.tar",
+		"bsdtar":      "../../testdata/pax/bsdtar.tar",
+		"archive/tar": goTarPath,
+	} {
+		t.Run(name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+			err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+				Image:   tarPath,
+				Output:  outputPath,
+				TempDir: t.TempDir(),
+				FromTar: true,
+				Verify:  true,
+			})
+			require.NoError(t, err)
+
+			f, err := os.Open(outputPath)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			fsys, err := erofs.Open(f)
+			require.NoError(t, err)
+
+			data, err := fs.ReadFile(fsys, longPath)
+			require.NoError(t, err)
+			require.Equal(t, "hello\n", string(data))
+
+			target, err := fsys.ReadLink("link")
+			require.NoError(t, err)
+			require.Equal(t, longPath, target)
+
+			for _, name := range []string{longDir, longPath} {
+				fi, err := fsys.Stat(name)
+				require.NoError(t, err)
+
+				ino := fi.Sys().(*erofs.Inode)
+				require.Equal(t, uint32(3000000), ino.UID(), name)
+				require.Equal(t, uint32(3000001), ino.GID(), name)
+				require.Equal(t, uint64(mtime.Unix()), ino.Mtime(), name)
+				require.Equal(t, uint32(mtime.Nanosecond()), ino.MtimeNsec(), name)
+			}
+		})
+	}
+}
+
+func TestConvertSymlinks(t *testing.T) {
+	// Targets are written exactly as they appear in the layer, whether or not
+	// they resolve.
+	targets := map[string]string{
+		"absolute":       "/usr/share/zoneinfo/UTC",
+		"relative":       "../usr/bin/env",
+		"dot":            "./busybox",
+		"trailing-slash": "usr/lib/",
+		"double-slash":   "usr//lib",
+		"dangling":       "does/not/exist",
+		"loop":           "loop",
+		"spaces":         " spaced out ",
+		// Too long to be stored inline with the inode.
+		"long": strings.Repeat("a/", 2047) + "z",
+	}
+
+	convert := func(t *testing.T, targets map[string]string) (*erofs.Filesystem, error) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, target := range targets {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "links/" + name, Linkname: target, Mode: 0o777}))
+		}
+		require.NoError(t, tw.Close())
+
+		tarPath := filepath.Join(t.TempDir(), "rootfs.tar")
+		require.NoError(t, os.WriteFile(tarPath, buf.Bytes(), 0o644))
+
+		outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   tarPath,
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			FromTar: true,
+			Verify:  true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		return erofs.Open(f)
+	}
+
+	t.Run("Targets", func(t *testing.T) {
+		require.Len(t, targets["long"], oci2erofs.MaxSymlinkSize)
+
+		fsys, err := convert(t, targets)
+		require.NoError(t, err)
+
+		for name, expected := range targets {
+			target, err := fsys.ReadLink("links/" + name)
+			require.NoError(t, err, name)
+			require.Equal(t, expected, target, name)
+		}
+	})
+
+	t.Run("Too Long", func(t *testing.T) {
+		_, err := convert(t, map[string]string{
+			"long": strings.Repeat("a", oci2erofs.MaxSymlinkSize+1),
+		})
+		require.ErrorIs(t, err, oci2erofs.ErrSymlinkTooLong)
+	})
+
+	// The toybox image is mostly symbolic links to the toybox binary.
+	t.Run("Image", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+			Image:   "../../testdata/toybox.tar",
+			Output:  outputPath,
+			TempDir: t.TempDir(),
+			Verify:  true,
+		})
+		require.NoError(t, err)
+
+		f, err := os.Open(outputPath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		expected := layerSymlinks(t, "../../testdata/toybox.tar")
+		require.NotEmpty(t, expected)
+
+		for name, expectedTarget := range expected {
+			target, err := fsys.ReadLink(name)
+			require.NoError(t, err, name)
+			require.Equal(t, expectedTarget, target, name)
+		}
+	})
+}
+
+// layerSymlinks returns the targets of the symbolic links in the layers of
+// the (single layer) OCI image archive, read directly from the layer tar.
+func layerSymlinks(t *testing.T, imagePath string) map[string]string {
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	targets := make(map[string]string)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		if !strings.HasPrefix(hdr.Name, "blobs/") || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Only layers are gzip compressed.
+		zr, err := gzip.NewReader(tr)
+		if err != nil {
+			continue
+		}
+
+		lr := tar.NewReader(zr)
+		for {
+			lhdr, err := lr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			if lhdr.Typeflag == tar.TypeSymlink {
+				targets[strings.TrimPrefix(path.Clean("/"+lhdr.Name), "/")] = lhdr.Linkname
+			}
+		}
+	}
+
+	return targets
+}
+
+func TestConvertLargeFile(t *testing.T) {
+	const (
+		size       = (4 << 30) + (1 << 20)
+		tailOffset = (4 << 30) + (512 << 10)
+	)
+
+	outputPath := filepath.Join(t.TempDir(), "rootfs.erofs")
+
+	err := oci2erofs.Convert(context.Background(), &oci2erofs.Options{
+		Image:   "../../testdata/sparse/large.tar",
+		Output:  outputPath,
+		TempDir: t.TempDir(),
+		FromTar: true,
+		Verify:  true,
+	})
+	require.NoError(t, err)
+
+	f, err := os.Open(outputPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	// The holes are not written out to disk.
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Greater(t, fi.Size(), int64(size))
+	if usage, ok := util.DiskUsage(fi); ok {
+		require.Less(t, usage, int64(1<<20))
+	}
+
+	fsys, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	fi, err = fsys.Stat("models/model.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	// The size does not fit in a compact inode.
+	ino := fi.Sys().(*erofs.Inode)
+	require.Equal(t, uint16(erofs.InodeLayoutExtended), ino.Layout())
+	require.Equal(t, uint64(size), ino.Size())
+
+	data, err := ino.Data()
+	require.NoError(t, err)
+
+	ra := data.(io.ReaderAt)
+
+	buf := make([]byte, 4)
+	_, err = ra.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "head", string(buf))
+
+	_, err = ra.ReadAt(buf, tailOffset)
+	require.NoError(t, err)
+	require.Equal(t, "tail", string(buf))
+}
+
+func openImage(t *testing.T, imagePath string) fs.FS {
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	return fsys
+}
+
+// writerFunc is an io.Writer implemented by a function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
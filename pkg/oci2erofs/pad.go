@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+package oci2erofs
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// paddedSize returns the size of an image of size bytes once the free space
+// requested by Options.PadPercent and the alignment requested by
+// Options.PadSize have been added.
+func paddedSize(size int64, opts *Options) int64 {
+	padded := size + size*int64(opts.PadPercent)/100
+
+	if opts.PadSize > 0 {
+		padded = (padded + opts.PadSize - 1) / opts.PadSize * opts.PadSize
+	}
+
+	return padded
+}
+
+// padImage appends zeroes to the image of size bytes in f, as requested by
+// Options.PadPercent and Options.PadSize, and returns its new size. The
+// padding is left sparse.
+func padImage(f *os.File, size int64, opts *Options) (int64, error) {
+	padded := paddedSize(size, opts)
+	if padded == size {
+		return size, nil
+	}
+
+	if err := f.Truncate(padded); err != nil {
+		return 0, fmt.Errorf("failed to pad image: %w", err)
+	}
+
+	return padded, nil
+}
+
+// padStream writes the zeroes that pad an image of size bytes, streamed to w,
+// as requested by Options.PadPercent and Options.PadSize, and returns its new
+// size.
+func padStream(w io.Writer, size int64, opts *Options) (int64, error) {
+	padded := paddedSize(size, opts)
+
+	zeros := make([]byte, 64<<10)
+	for remaining := padded - size; remaining > 0; {
+		n, err := w.Write(zeros[:min(remaining, int64(len(zeros)))])
+		if err != nil {
+			return 0, fmt.Errorf("failed to pad image: %w", err)
+		}
+		remaining -= int64(n)
+	}
+
+	return padded, nil
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/registry"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// pushImage pushes the image at outputPath, and its root hash and metadata
+// sidecars if they were written, to the registry reference opts.Push.
+func pushImage(ctx context.Context, outputPath string, withRootHash, withMetadata bool, opts *Options) (err error) {
+	ref := strings.TrimPrefix(opts.Push, PushPrefix)
+
+	artifact := &registry.Artifact{
+		ArtifactType: ArtifactTypeEROFS,
+		Files:        []registry.ArtifactFile{{Path: outputPath, MediaType: MediaTypeEROFS}},
+	}
+
+	if withRootHash {
+		artifact.Files = append(artifact.Files, registry.ArtifactFile{Path: rootHashSidecarPath(outputPath), MediaType: MediaTypeRootHash})
+	}
+
+	if withMetadata {
+		artifact.Files = append(artifact.Files, registry.ArtifactFile{Path: metadataSidecarPath(outputPath), MediaType: MediaTypeMetadata})
+	}
+
+	slog.Info("Pushing image", slog.String("ref", ref))
+
+	ctx, span := startSpan(ctx, "push", attribute.String("oci2erofs.ref", ref))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	desc, err := registry.Push(ctx, ref, artifact, &registry.Options{
+		Credentials:        opts.RegistryCredentials,
+		InsecureRegistries: opts.InsecureRegistries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push image: %w", err)
+	}
+
+	slog.Info("Pushed image", slog.String("ref", ref), slog.String("digest", desc.Digest.String()))
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/immutos/oci2erofs/internal/builder"
+)
+
+// resumeDirPath returns the directory that the state of a resumable
+// conversion to outputPath is kept in (see Options.Resume).
+func resumeDirPath(outputPath string) string {
+	return outputPath + ".resume"
+}
+
+// openPartialImage opens the partially written image of a resumable
+// conversion to outputPath, creating it if need be, along with the
+// checkpoint that records its progress.
+func openPartialImage(outputPath string) (*os.File, *builder.Checkpoint, error) {
+	dir := resumeDirPath(outputPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create resume directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "partial"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open partial image: %w", err)
+	}
+
+	checkpoint := &builder.Checkpoint{Path: filepath.Join(dir, "checkpoint")}
+
+	// A checkpoint is worthless without the image that it describes.
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to stat partial image: %w", err)
+	}
+
+	if fi.Size() == 0 {
+		if err := removeCheckpoint(checkpoint); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+	}
+
+	return f, checkpoint, nil
+}
+
+// removeCheckpoint removes the checkpoint of a partial image, before the
+// image is moved into place, so that it can never be resumed from an image
+// that is not there.
+func removeCheckpoint(checkpoint *builder.Checkpoint) error {
+	if err := os.Remove(checkpoint.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/util"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// checkSpace fails with ErrInsufficientSpace if the file system holding dir
+// has fewer than need bytes available. Platforms that cannot report their
+// free space are not checked.
+func checkSpace(dir string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+
+	free, ok := util.DiskFree(dir)
+	if !ok {
+		return nil
+	}
+
+	slog.Debug("Checked temporary space",
+		slog.String("dir", dir), slog.Int64("needed", need), slog.Int64("available", free))
+
+	if free < need {
+		return fmt.Errorf("%w in %s: at least %s needed, %s available (see Options.TempDir)",
+			ErrInsufficientSpace, dir, util.FormatBytes(need), util.FormatBytes(free))
+	}
+
+	return nil
+}
+
+// downloadSpace returns the space taken by downloading the blobs.
+func downloadSpace(blobs []ocispecs.Descriptor) int64 {
+	var size int64
+	for _, desc := range blobs {
+		size += desc.Size
+	}
+
+	return size
+}
+
+// decompressSpace estimates the temporary space taken by decompressing the
+// layers, as a lower bound: decompressed layers are no smaller than their
+// blobs, and are only held in memory below Options.LayerMemoryLimit. Layers
+// read using their table of contents are not decompressed.
+func decompressSpace(layers []ocispecs.Descriptor, opts *Options) int64 {
+	var size int64
+	for _, desc := range layers {
+		if !opts.IgnoreLayerTOC && layer.Lazy(desc.MediaType, desc.Annotations) {
+			continue
+		}
+
+		if desc.Size > opts.LayerMemoryLimit {
+			size += desc.Size
+		}
+	}
+
+	return size
+}
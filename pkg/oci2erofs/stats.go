@@ -0,0 +1,250 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerStats describes an input layer of a conversion.
+type LayerStats = layer.Stats
+
+// Stats describes a conversion, for tuning image size budgets.
+type Stats struct {
+	// Output is the path of the EROFS image (empty if streamed).
+	Output string `json:"output,omitempty"`
+	// DryRun is set if the image was only planned (see Options.DryRun), in
+	// which case nothing was written to Output and OutputSize is an
+	// estimate.
+	DryRun bool `json:"dryRun,omitempty"`
+	// ImageDigest is the digest of the image manifest (or the image ID of
+	// Docker images), if an image was converted.
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// Layers are the input layers, in order (empty for directory and
+	// tarball input).
+	Layers []LayerStats `json:"layers,omitempty"`
+	// InputSize is the total (compressed) size of the input layers.
+	InputSize int64 `json:"inputSize"`
+	// UncompressedInputSize is the total size of the decompressed layers.
+	UncompressedInputSize int64 `json:"uncompressedInputSize"`
+	// Inodes is the number of inodes in the image.
+	Inodes int `json:"inodes"`
+	// Directories is the number of directories in the image.
+	Directories int `json:"directories"`
+	// RegularFiles is the number of regular files in the image.
+	RegularFiles int `json:"regularFiles"`
+	// Symlinks is the number of symbolic links in the image.
+	Symlinks int `json:"symlinks"`
+	// DataSize is the total size of all regular file contents.
+	DataSize int64 `json:"dataSize"`
+	// ImageSize is the size of the EROFS filesystem (excluding any verity
+	// hash tree).
+	ImageSize int64 `json:"imageSize"`
+	// OutputSize is the size of the output, including any verity hash tree
+	// and padding.
+	OutputSize int64 `json:"outputSize"`
+	// Features are the optional EROFS features that the image uses.
+	Features []Feature `json:"features,omitempty"`
+	// ExtraEntries is the number of extra entries added on top of the image
+	// root filesystem (see Options.ExtraEntries, including those that embed
+	// the config, annotations or referrers), and OverriddenEntries the number
+	// of those that replaced image content.
+	ExtraEntries      int `json:"extraEntries,omitempty"`
+	OverriddenEntries int `json:"overriddenEntries,omitempty"`
+	// MetadataSize is the part of the image not taken up by file contents,
+	// ie. inodes, directories and block padding.
+	MetadataSize int64 `json:"metadataSize"`
+	// HardLinks is the number of regular files written as hard links to
+	// another, either because they are hard links in the image or because
+	// they are identical (see Options.HardlinkDedup).
+	HardLinks int `json:"hardLinks"`
+	// SharedFiles is the number of regular files that share the data blocks
+	// of another file with identical contents (see Options.Dedupe).
+	SharedFiles int `json:"sharedFiles"`
+	// DedupSavings is the number of bytes saved by deduplicating file
+	// contents.
+	DedupSavings int64 `json:"dedupSavings"`
+	// ResumedFiles is the number of regular files whose data had already
+	// been written by an interrupted conversion (see Options.Resume), and
+	// ResumedBytes the size of that data.
+	ResumedFiles int   `json:"resumedFiles,omitempty"`
+	ResumedBytes int64 `json:"resumedBytes,omitempty"`
+	// CompressionRatio is the ratio of the uncompressed size of the file
+	// contents to the size of the image. The encoder does not compress yet,
+	// so this reflects the metadata overhead (and any deduplication).
+	CompressionRatio float64 `json:"compressionRatio"`
+	// Xattrs is the number of extended attributes written to the image.
+	// None are written yet (see the warnings raised for them).
+	Xattrs int `json:"xattrs"`
+	// Warnings are the warnings raised by the conversion (see
+	// Options.OnWarning).
+	Warnings []Warning `json:"warnings,omitempty"`
+	// Phases is the wall time taken by each phase of the conversion.
+	Phases PhaseDurations `json:"phases"`
+
+	start   time.Time
+	metrics *metrics
+}
+
+// PhaseDurations is the wall time taken by each phase of a conversion.
+type PhaseDurations struct {
+	// Pull is the time taken to pull the image from a registry.
+	Pull time.Duration `json:"pull,omitempty"`
+	// Load is the time taken to read and decompress the layers.
+	Load time.Duration `json:"load"`
+	// Scan is the time taken to walk the merged root filesystem.
+	Scan time.Duration `json:"scan"`
+	// Write is the time taken to encode and write the image.
+	Write time.Duration `json:"write"`
+	// Verify is the time taken to verify the image (if requested).
+	Verify time.Duration `json:"verify,omitempty"`
+	// Verity is the time taken to append the verity hash tree (if requested).
+	Verity time.Duration `json:"verity,omitempty"`
+	// Total is the wall time of the whole conversion.
+	Total time.Duration `json:"total"`
+}
+
+// WriteText writes a human readable version of the statistics.
+func (s *Stats) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if s.Output != "" {
+		fmt.Fprintf(tw, "Output:\t%s\n", s.Output)
+	}
+	if s.DryRun {
+		fmt.Fprintf(tw, "Dry run:\tnothing written\n")
+	}
+	if s.ImageDigest != "" {
+		fmt.Fprintf(tw, "Image digest:\t%s\n", s.ImageDigest)
+	}
+
+	for i, l := range s.Layers {
+		cached := ""
+		if l.Cached {
+			cached = " (cached)"
+		}
+
+		fmt.Fprintf(tw, "Layer %d:\t%s -> %s%s\t%s\n", i+1,
+			util.FormatBytes(l.Size), util.FormatBytes(l.UncompressedSize), cached, l.Path)
+	}
+	if len(s.Layers) > 0 {
+		fmt.Fprintf(tw, "Input size:\t%s (%s uncompressed)\n",
+			util.FormatBytes(s.InputSize), util.FormatBytes(s.UncompressedInputSize))
+	}
+
+	fmt.Fprintf(tw, "Inodes:\t%d (%d directories, %d files, %d symlinks)\n",
+		s.Inodes, s.Directories, s.RegularFiles, s.Symlinks)
+	if s.HardLinks > 0 {
+		fmt.Fprintf(tw, "Hard links:\t%d\n", s.HardLinks)
+	}
+	if s.SharedFiles > 0 {
+		fmt.Fprintf(tw, "Shared data:\t%d files\n", s.SharedFiles)
+	}
+	if s.ExtraEntries > 0 {
+		fmt.Fprintf(tw, "Extra entries:\t%d (%d replacing image content)\n", s.ExtraEntries, s.OverriddenEntries)
+	}
+	fmt.Fprintf(tw, "File data:\t%s\n", util.FormatBytes(s.DataSize))
+	fmt.Fprintf(tw, "Image size:\t%s\n", util.FormatBytes(s.ImageSize))
+	if s.OutputSize != s.ImageSize {
+		fmt.Fprintf(tw, "Output size:\t%s\n", util.FormatBytes(s.OutputSize))
+	}
+	if len(s.Features) > 0 {
+		features := make([]string, len(s.Features))
+		for i, feature := range s.Features {
+			features[i] = string(feature)
+		}
+		fmt.Fprintf(tw, "Features:\t%s\n", strings.Join(features, ", "))
+	}
+	fmt.Fprintf(tw, "Metadata overhead:\t%s\n", util.FormatBytes(s.MetadataSize))
+	fmt.Fprintf(tw, "Dedup savings:\t%s\n", util.FormatBytes(s.DedupSavings))
+	fmt.Fprintf(tw, "Compression ratio:\t%.2f\n", s.CompressionRatio)
+	if s.ResumedFiles > 0 {
+		fmt.Fprintf(tw, "Resumed:\t%d files (%s)\n", s.ResumedFiles, util.FormatBytes(s.ResumedBytes))
+	}
+	if len(s.Warnings) > 0 {
+		fmt.Fprintf(tw, "Warnings:\t%d\n", len(s.Warnings))
+	}
+
+	p := s.Phases
+	if p.Pull > 0 {
+		fmt.Fprintf(tw, "Pull time:\t%s\n", p.Pull.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "Load time:\t%s\n", p.Load.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Scan time:\t%s\n", p.Scan.Round(time.Millisecond))
+	fmt.Fprintf(tw, "Write time:\t%s\n", p.Write.Round(time.Millisecond))
+	if p.Verify > 0 {
+		fmt.Fprintf(tw, "Verify time:\t%s\n", p.Verify.Round(time.Millisecond))
+	}
+	if p.Verity > 0 {
+		fmt.Fprintf(tw, "Verity time:\t%s\n", p.Verity.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "Total time:\t%s\n", p.Total.Round(time.Millisecond))
+
+	return tw.Flush()
+}
+
+func newStats(start time.Time, m *metrics) *Stats {
+	return &Stats{start: start, metrics: m}
+}
+
+// setImageDigest records the digest of the resolved image.
+func (s *Stats) setImageDigest(dgst digest.Digest) {
+	s.ImageDigest = string(dgst)
+}
+
+// addLayer records a loaded layer.
+func (s *Stats) addLayer(l LayerStats) {
+	s.Layers = append(s.Layers, l)
+	s.InputSize += l.Size
+	s.UncompressedInputSize += l.UncompressedSize
+}
+
+// addWarning records a warning.
+func (s *Stats) addWarning(w *Warning) {
+	s.Warnings = append(s.Warnings, *w)
+}
+
+// setSummary records the image produced by the builder.
+func (s *Stats) setSummary(summary *Summary) {
+	s.Inodes = summary.Inodes
+	s.Directories = summary.Directories
+	s.RegularFiles = summary.RegularFiles
+	s.Symlinks = summary.Symlinks
+	s.DataSize = summary.DataBytes
+	s.ImageSize = summary.ImageSize
+	s.Features = summary.Features
+	s.HardLinks = summary.HardLinks
+	s.SharedFiles = summary.SharedFiles
+	s.DedupSavings = summary.DedupBytes
+	s.ResumedFiles = summary.ResumedFiles
+	s.ResumedBytes = summary.ResumedBytes
+	s.MetadataSize = max(summary.ImageSize-(summary.DataBytes-summary.DedupBytes), 0)
+	s.CompressionRatio = summary.CompressionRatio
+	s.Xattrs = summary.Xattrs
+	s.Phases.Scan = summary.ScanDuration
+	s.Phases.Write = summary.WriteDuration
+}
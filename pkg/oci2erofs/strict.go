@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci2erofs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	"github.com/immutos/oci2erofs/internal/namecheck"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+)
+
+// checkNames fails with ErrInvalidNames if any entry of the root filesystem
+// has an unusable name (see Options.Strict), logging each of them.
+func checkNames(ctx context.Context, rootFS fs.FS, layers *layerDescriber) error {
+	ctx, span := startSpan(ctx, "check-names")
+	problems, err := namecheck.Check(ctx, rootFS, layers.describe)
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to check names: %w", err)
+	}
+
+	for _, p := range problems {
+		slog.Error("Invalid file name",
+			slog.String("path", p.Path), slog.String("layer", p.Layer), slog.String("problem", p.Message))
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%w: %s", ErrInvalidNames, problems[0])
+	default:
+		return fmt.Errorf("%w: %s (and %d more)", ErrInvalidNames, problems[0], len(problems)-1)
+	}
+}
+
+// layerDescriber describes the layer that provides an entry of the root
+// filesystem: one of the directories added onto the image, or a layer of the
+// image itself.
+type layerDescriber struct {
+	// image is the root filesystem of the image, before anything is added.
+	image fs.FS
+	stats *Stats
+	// merged is the image with the directories added onto it, whose sources
+	// are the layers that follow the image.
+	merged  *overlayfs.FS
+	sources []string
+}
+
+func (l *layerDescriber) describe(name string) string {
+	if l.merged != nil {
+		if i, err := l.merged.Layer(name); err == nil && i > 0 && i <= len(l.sources) {
+			return l.sources[i-1]
+		}
+	}
+
+	image, ok := l.image.(*overlayfs.FS)
+	if !ok {
+		return ""
+	}
+
+	i, err := image.Layer(name)
+	if err != nil || i >= len(l.stats.Layers) {
+		return ""
+	}
+
+	return l.stats.Layers[i].Path
+}
+
+// addDirSources returns the host paths of the added directories.
+func addDirSources(dirs []AddDir) []string {
+	sources := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		sources = append(sources, dir.Source)
+	}
+
+	return sources
+}